@@ -0,0 +1,375 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gilbertchen/cli"
+
+	"github.com/gilbertchen/duplicacy/src"
+)
+
+// The hidden command called by the completion scripts with the words on the command line, the last one being the word
+// to be completed.  It prints the candidates one per line.
+const completeCommand = "__complete"
+
+// Passed by the completion scripts in place of an empty word to be completed, for shells that drop empty arguments
+// when running a program
+const completeEmptyWord = "__empty__"
+
+// flagMetadata describes an option for the completion scripts and for tools that drive the command line.  'Complete'
+// tells what the value of the option can be completed with: storage names, snapshot ids, revisions, or files.
+type flagMetadata struct {
+	Names      []string `json:"names"`
+	Usage      string   `json:"usage"`
+	Argument   string   `json:"argument,omitempty"`
+	TakesValue bool     `json:"takes_value"`
+	Complete   string   `json:"complete,omitempty"`
+}
+
+// commandMetadata describes a command and its options.
+type commandMetadata struct {
+	Name        string            `json:"name"`
+	Aliases     []string          `json:"aliases,omitempty"`
+	Usage       string            `json:"usage"`
+	ArgsUsage   string            `json:"args_usage,omitempty"`
+	Flags       []flagMetadata    `json:"flags"`
+	Subcommands []commandMetadata `json:"subcommands,omitempty"`
+}
+
+// appMetadata describes the global options and all commands.
+type appMetadata struct {
+	Name        string            `json:"name"`
+	Version     string            `json:"version"`
+	GlobalFlags []flagMetadata    `json:"global_flags"`
+	Commands    []commandMetadata `json:"commands"`
+}
+
+// The kind of completion for the values of options, identified by the argument shown in the help
+var flagCompletions = map[string]string{
+	"<storage name>":         "storage",
+	"<snapshot id>":          "snapshot",
+	"<revision>":             "revision",
+	"<file>":                 "file",
+	"<file name>":            "file",
+	"<file path>":            "file",
+	"<path>":                 "file",
+	"<directory>":            "file",
+	"<repository directory>": "file",
+	"<private key>":          "file",
+}
+
+func getFlagMetadata(flag cli.Flag) flagMetadata {
+	names, takesValue := getFlagNames(flag)
+	metadata := flagMetadata{Names: names, TakesValue: takesValue}
+	switch flag := flag.(type) {
+	case cli.BoolFlag:
+		metadata.Usage = flag.Usage
+	case cli.BoolTFlag:
+		metadata.Usage = flag.Usage
+	case cli.StringFlag:
+		metadata.Usage, metadata.Argument = flag.Usage, flag.Argument
+	case cli.IntFlag:
+		metadata.Usage, metadata.Argument = flag.Usage, flag.Argument
+	case cli.StringSliceFlag:
+		metadata.Usage, metadata.Argument = flag.Usage, flag.Argument
+	case cli.IntSliceFlag:
+		metadata.Usage, metadata.Argument = flag.Usage, flag.Argument
+	case cli.GenericFlag:
+		metadata.Usage, metadata.Argument = flag.Usage, flag.Arg
+	}
+	metadata.Complete = flagCompletions[metadata.Argument]
+	return metadata
+}
+
+func getFlagsMetadata(flags []cli.Flag) []flagMetadata {
+	metadata := []flagMetadata{}
+	for _, flag := range flags {
+		metadata = append(metadata, getFlagMetadata(flag))
+	}
+	return metadata
+}
+
+func getCommandMetadata(command cli.Command) commandMetadata {
+	metadata := commandMetadata{
+		Name:      command.Name,
+		Aliases:   command.Aliases,
+		Usage:     command.Usage,
+		ArgsUsage: strings.TrimSpace(command.ArgsUsage),
+		Flags:     getFlagsMetadata(command.Flags),
+	}
+	if command.ShortName != "" {
+		metadata.Aliases = append(metadata.Aliases, command.ShortName)
+	}
+	for _, subcommand := range command.Subcommands {
+		metadata.Subcommands = append(metadata.Subcommands, getCommandMetadata(subcommand))
+	}
+	return metadata
+}
+
+func getAppMetadata(app *cli.App) appMetadata {
+	metadata := appMetadata{Name: app.Name, Version: app.Version, GlobalFlags: getFlagsMetadata(app.Flags)}
+	for _, command := range app.Commands {
+		metadata.Commands = append(metadata.Commands, getCommandMetadata(command))
+	}
+	return metadata
+}
+
+func findFlagMetadata(flags []flagMetadata, name string) *flagMetadata {
+	for i := range flags {
+		for _, flagName := range flags[i].Names {
+			if flagName == name {
+				return &flags[i]
+			}
+		}
+	}
+	return nil
+}
+
+func findCommandMetadata(commands []commandMetadata, name string) *commandMetadata {
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+		for _, alias := range commands[i].Aliases {
+			if alias == name {
+				return &commands[i]
+			}
+		}
+	}
+	return nil
+}
+
+// getOptionValue returns the value of the first of the options given in the words, or "" if none is given.
+func getOptionValue(words []string, names ...string) string {
+	for i, word := range words {
+		for _, name := range names {
+			if word == "-"+name || word == "--"+name {
+				if i+1 < len(words) {
+					return words[i+1]
+				}
+			} else if strings.HasPrefix(word, "-"+name+"=") || strings.HasPrefix(word, "--"+name+"=") {
+				return word[strings.Index(word, "=")+1:]
+			}
+		}
+	}
+	return ""
+}
+
+// loadCompletionPreferences loads the preferences of the repository containing the current directory, returning false
+// if there is no repository.  Errors are ignored as completion must not print anything else.
+func loadCompletionPreferences() (loaded bool) {
+	defer func() {
+		if recover() != nil {
+			loaded = false
+		}
+	}()
+
+	repository, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	for {
+		if _, err := os.Stat(path.Join(repository, duplicacy.DUPLICACY_DIRECTORY)); err == nil {
+			break
+		}
+		parent := path.Dir(repository)
+		if parent == repository || parent == "" {
+			return false
+		}
+		repository = parent
+	}
+	return duplicacy.LoadPreferences(repository) && len(duplicacy.Preferences) > 0
+}
+
+// completeValue returns the candidates for the value of an option from the preferences and the local snapshot cache.
+// The storage and the snapshot id are taken from the options already given, or from the default storage.
+func completeValue(kind string, words []string) (candidates []string) {
+	if kind != "storage" && kind != "snapshot" && kind != "revision" {
+		return nil
+	}
+	if !loadCompletionPreferences() {
+		return nil
+	}
+
+	if kind == "storage" {
+		for _, preference := range duplicacy.Preferences {
+			candidates = append(candidates, preference.Name)
+		}
+		return candidates
+	}
+
+	preference := &duplicacy.Preferences[0]
+	if storageName := getOptionValue(words, "storage", "from"); storageName != "" {
+		if preference = duplicacy.FindPreference(storageName); preference == nil {
+			return nil
+		}
+	}
+
+	if kind == "snapshot" {
+		return duplicacy.ListCachedSnapshotIDs(preference.Name)
+	}
+
+	snapshotID := getOptionValue(words, "id")
+	if snapshotID == "" {
+		snapshotID = preference.SnapshotID
+	}
+	for _, revision := range duplicacy.ListCachedRevisions(preference.Name, snapshotID) {
+		candidates = append(candidates, strconv.Itoa(revision))
+	}
+	return candidates
+}
+
+// getCompletions returns the candidates for the last of the words, which are the arguments following the program
+// name.  Commands and subcommands are completed at their positions, options when the word starts with '-', and the
+// values of options according to their kinds.  Nothing is returned for values that should be completed as files, so
+// that the shell falls back to its own file completion.
+func getCompletions(app *cli.App, words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current := words[len(words)-1]
+	previous := words[:len(words)-1]
+
+	metadata := getAppMetadata(app)
+	flags := metadata.GlobalFlags
+	commands := metadata.Commands
+	for i := 0; i < len(previous); i++ {
+		word := previous[i]
+		if strings.HasPrefix(word, "-") && word != "-" {
+			flag := findFlagMetadata(flags, strings.TrimLeft(word, "-"))
+			if flag != nil && flag.TakesValue && !strings.Contains(word, "=") {
+				if i == len(previous)-1 {
+					return filterCompletions(completeValue(flag.Complete, previous), current)
+				}
+				i++
+			}
+		} else if command := findCommandMetadata(commands, word); command != nil {
+			flags, commands = command.Flags, command.Subcommands
+		} else {
+			// Commands can't follow the arguments of a command
+			commands = nil
+		}
+	}
+
+	var candidates []string
+	if strings.HasPrefix(current, "-") {
+		for _, flag := range flags {
+			for _, name := range flag.Names {
+				candidates = append(candidates, "-"+name)
+			}
+		}
+	} else {
+		for _, command := range commands {
+			candidates = append(candidates, command.Name)
+		}
+	}
+	return filterCompletions(candidates, current)
+}
+
+func filterCompletions(candidates []string, prefix string) (filtered []string) {
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
+
+// runCompletion handles the hidden completion command before the arguments are parsed by the cli package.
+func runCompletion(app *cli.App, words []string) {
+	duplicacy.SetLogOutput(ioutil.Discard)
+	if len(words) > 0 && words[0] == "--" {
+		words = words[1:]
+	}
+	if len(words) > 0 && words[len(words)-1] == completeEmptyWord {
+		words[len(words)-1] = ""
+	}
+	for _, candidate := range getCompletions(app, words) {
+		fmt.Println(candidate)
+	}
+}
+
+// The completion scripts, which pass the words on the command line to the hidden completion command
+var completionScripts = map[string]string{
+	"bash": `# bash completion for duplicacy; add to ~/.bashrc: source <(duplicacy completion bash)
+_duplicacy() {
+    local IFS=$'\n'
+    COMPREPLY=($(duplicacy ` + completeCommand + ` -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _duplicacy duplicacy
+`,
+	"zsh": `#compdef duplicacy
+# zsh completion for duplicacy; add to ~/.zshrc: source <(duplicacy completion zsh)
+_duplicacy() {
+    local -a candidates
+    candidates=("${(@f)$(duplicacy ` + completeCommand + ` -- "${(@)words[2,$CURRENT]}" 2>/dev/null)}")
+    if [[ -n "${candidates[1]}" ]]; then
+        compadd -a candidates
+    else
+        _files
+    fi
+}
+compdef _duplicacy duplicacy
+`,
+	"fish": `# fish completion for duplicacy; save as ~/.config/fish/completions/duplicacy.fish
+function __duplicacy_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    duplicacy ` + completeCommand + ` -- $tokens[2..-1] 2>/dev/null
+end
+complete -c duplicacy -a '(__duplicacy_complete)'
+`,
+	"powershell": `# PowerShell completion for duplicacy; add to $PROFILE: duplicacy completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName duplicacy, duplicacy.exe -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() })
+    if ($wordToComplete -eq '') { $words += '` + completeEmptyWord + `' }
+    duplicacy ` + completeCommand + ` -- @words 2>$null | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`,
+}
+
+func printCompletion(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if context.Bool("metadata") {
+		if len(context.Args()) != 0 {
+			fmt.Fprintf(context.App.Writer, "The -metadata option requires no arguments.\n\n")
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+		description, err := json.MarshalIndent(getAppMetadata(context.App), "", "    ")
+		if err != nil {
+			duplicacy.LOG_ERROR("COMPLETION_METADATA", "Failed to encode the command metadata: %v", err)
+			return
+		}
+		fmt.Printf("%s\n", description)
+		return
+	}
+
+	if len(context.Args()) != 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires a shell name.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	script, found := completionScripts[context.Args()[0]]
+	if !found {
+		fmt.Fprintf(context.App.Writer, "Unsupported shell: %s; the supported shells are bash, zsh, fish, and "+
+			"powershell\n", context.Args()[0])
+		os.Exit(ArgumentExitCode)
+	}
+	fmt.Print(script)
+}
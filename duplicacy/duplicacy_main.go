@@ -7,7 +7,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -17,10 +16,9 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/gilbertchen/cli"
 
 	"io/ioutil"
@@ -31,9 +29,12 @@ import (
 )
 
 const (
-	ArgumentExitCode = 3
+	ArgumentExitCode = duplicacy.ArgumentExitCode
 )
 
+// How long to wait for the operation to stop after an interrupt before exiting anyway
+const InterruptGracePeriod = 30 * time.Second
+
 var ScriptEnabled bool
 var GitCommit = "unofficial" + duplicacy.COMPILATION_SANITY_CHECK
 
@@ -79,6 +80,8 @@ func getRepositoryPreference(context *cli.Context, storageName string) (reposito
 			repository = duplicacy.Preferences[0].RepositoryPath
 			duplicacy.LOG_INFO("REPOSITORY_SET", "Repository set to %s", repository)
 		}
+		duplicacy.SetSourceRoots(duplicacy.Preferences[0].Roots)
+		enableNotifications(context, &duplicacy.Preferences[0])
 		return repository, &duplicacy.Preferences[0]
 	}
 
@@ -93,10 +96,23 @@ func getRepositoryPreference(context *cli.Context, storageName string) (reposito
 		repository = preference.RepositoryPath
 		duplicacy.LOG_INFO("REPOSITORY_SET", "Repository set to %s", repository)
 	}
+	duplicacy.SetSourceRoots(preference.Roots)
+	enableNotifications(context, preference)
 
 	return repository, preference
 }
 
+// enableNotifications sets up the notifications configured for the storage, which are sent when the command
+// completes.  The set command only changes the notifications so it doesn't send them, the daemon and 'service
+// install' leave them to the operations they run, and fleet-status only reads the reports of other commands.
+func enableNotifications(context *cli.Context, preference *duplicacy.Preference) {
+	if !context.GlobalBool("no-notify") && context.Command.Name != "set" && context.Command.Name != "daemon" &&
+		context.Command.Name != "install" && context.Command.Name != "fleet-status" {
+		duplicacy.EnableNotifications(preference.Notifications, context.Command.Name, preference.SnapshotID,
+			preference.Name)
+	}
+}
+
 func getRevisions(context *cli.Context) (revisions []int) {
 
 	flags := context.StringSlice("r")
@@ -150,16 +166,58 @@ func setGlobalOptions(context *cli.Context) {
 		duplicacy.SetLoggingLevel(duplicacy.DEBUG)
 	}
 
+	if context.GlobalString("log-level") != "" {
+		err := duplicacy.SetSubsystemLoggingLevels(context.GlobalString("log-level"))
+		if err != nil {
+			fmt.Fprintf(context.App.Writer, "Invalid value for -log-level: %v\n", err)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+
+	if context.GlobalString("log-file") != "" || context.GlobalString("error-log-file") != "" {
+		options := duplicacy.LogFileOptions{
+			MaxAge:   time.Duration(context.GlobalInt("log-max-age")) * 24 * time.Hour,
+			Keep:     context.GlobalInt("log-keep"),
+			Compress: context.GlobalBool("log-compress"),
+		}
+		if context.GlobalString("log-max-size") != "" {
+			options.MaxSize = int64(duplicacy.AtoSize(context.GlobalString("log-max-size")))
+			if options.MaxSize == 0 && context.GlobalString("log-max-size") != "0" {
+				fmt.Fprintf(context.App.Writer, "Invalid value for -log-max-size: %s\n", context.GlobalString("log-max-size"))
+				os.Exit(ArgumentExitCode)
+			}
+		}
+
+		if context.GlobalString("log-file") != "" {
+			err := duplicacy.EnableLogFile(context.GlobalString("log-file"), options)
+			if err != nil {
+				fmt.Fprintf(context.App.Writer, "Failed to open the log file: %v\n", err)
+				os.Exit(ArgumentExitCode)
+			}
+		}
+		if context.GlobalString("error-log-file") != "" {
+			err := duplicacy.EnableErrorLogFile(context.GlobalString("error-log-file"), options)
+			if err != nil {
+				fmt.Fprintf(context.App.Writer, "Failed to open the error log file: %v\n", err)
+				os.Exit(ArgumentExitCode)
+			}
+		}
+	}
+
 	ScriptEnabled = true
 	if context.GlobalBool("no-script") {
 		ScriptEnabled = false
 	}
 
-	address := context.GlobalString("profile")
+	address := context.GlobalString("debug-listen")
+	if address == "" {
+		address = context.GlobalString("profile")
+	}
 	if address != "" {
-		go func() {
-			http.ListenAndServe(address, nil)
-		}()
+		if _, err := duplicacy.StartDebugServer(address); err != nil {
+			fmt.Fprintf(context.App.Writer, "Failed to listen on %s: %v\n", address, err)
+			os.Exit(ArgumentExitCode)
+		}
 	}
 
 	for _, logID := range context.GlobalStringSlice("suppress") {
@@ -167,6 +225,16 @@ func setGlobalOptions(context *cli.Context) {
 	}
 
 	duplicacy.RunInBackground = context.GlobalBool("background")
+
+	if context.GlobalBool("json") {
+		duplicacy.EnableJSONOutput(context.Command.Name)
+	}
+
+	duplicacy.EnableSystemdIntegration(context.Command.Name)
+
+	if !context.GlobalBool("no-progress") {
+		duplicacy.EnableProgressBars()
+	}
 }
 
 func runScript(context *cli.Context, storageName string, phase string) bool {
@@ -215,6 +283,16 @@ func runScript(context *cli.Context, storageName string, phase string) bool {
 	return true
 }
 
+// runWithHooks runs the operation between the pre and post hooks configured in the preference, unless scripts are
+// disabled.
+func runWithHooks(preference *duplicacy.Preference, repository string, operation string, revision int,
+	run func() *duplicacy.OperationSummary) *duplicacy.OperationSummary {
+	if !ScriptEnabled {
+		return run()
+	}
+	return duplicacy.RunWithHooks(preference, repository, operation, revision, run)
+}
+
 func loadRSAPrivateKey(keyFile string, passphrase string, preference *duplicacy.Preference, backupManager *duplicacy.BackupManager, resetPasswords bool) {
 	if keyFile == "" {
 		return
@@ -231,6 +309,113 @@ func loadRSAPrivateKey(keyFile string, passphrase string, preference *duplicacy.
 
 }
 
+// enableQuarantine sets up the chunk quarantine if -quarantine is specified.  The storage given by -mirror, if any,
+// is where good copies of corrupted chunks will be searched for.
+func enableQuarantine(context *cli.Context, repository string, manager *duplicacy.BackupManager) {
+	if !context.Bool("quarantine") {
+		return
+	}
+
+	var mirrors []*duplicacy.SnapshotManager
+	if context.String("mirror") != "" {
+		mirror := duplicacy.FindPreference(context.String("mirror"))
+		if mirror == nil {
+			duplicacy.LOG_ERROR("STORAGE_NONE", "No storage named '%s' is found", context.String("mirror"))
+			return
+		}
+
+		duplicacy.LOG_INFO("STORAGE_SET", "Mirror storage set to %s", mirror.StorageURL)
+		mirrorStorage := duplicacy.CreateStorage(*mirror, false, context.Int("threads"))
+		if mirrorStorage == nil {
+			return
+		}
+
+		mirrorPassword := ""
+		if mirror.Encrypted {
+			mirrorPassword = duplicacy.GetPassword(*mirror, "password", "Enter mirror storage password:", false, false)
+		}
+
+		mirrorManager := duplicacy.CreateBackupManager(mirror.SnapshotID, mirrorStorage, repository, mirrorPassword, "", "", false)
+		duplicacy.SavePassword(*mirror, "password", mirrorPassword)
+		if mirrorManager.IsRSAEncrypted() {
+			// Copies of the file chunks can't be decrypted without the private key, which is the same one as for
+			// the storage, as with copy
+			loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), mirror, mirrorManager, false)
+		}
+		mirrors = append(mirrors, mirrorManager.SnapshotManager)
+	}
+
+	manager.SnapshotManager.EnableQuarantine(mirrors...)
+}
+
+// enableFailover adds the storages given by -failover as the storages from which chunks missing or corrupted on the
+// primary storage will be downloaded.
+func enableFailover(context *cli.Context, repository string, manager *duplicacy.BackupManager) {
+	for _, name := range context.StringSlice("failover") {
+		failover := duplicacy.FindPreference(name)
+		if failover == nil {
+			duplicacy.LOG_ERROR("STORAGE_NONE", "No storage named '%s' is found", name)
+			return
+		}
+
+		duplicacy.LOG_INFO("STORAGE_SET", "Failover storage set to %s", failover.StorageURL)
+		failoverStorage := duplicacy.CreateStorage(*failover, false, context.Int("threads"))
+		if failoverStorage == nil {
+			return
+		}
+
+		failoverPassword := ""
+		if failover.Encrypted {
+			prompt := fmt.Sprintf("Enter the password for the failover storage %s:", name)
+			failoverPassword = duplicacy.GetPassword(*failover, "password", prompt, false, false)
+		}
+
+		failoverManager := duplicacy.CreateBackupManager(failover.SnapshotID, failoverStorage, repository,
+			failoverPassword, "", "", false)
+		duplicacy.SavePassword(*failover, "password", failoverPassword)
+		if !manager.SnapshotManager.AddFailoverStorage(name, failoverManager.SnapshotManager) {
+			return
+		}
+	}
+}
+
+// enableRepair makes check recover missing and corrupted chunks, looking for copies in the storages given by
+// -repair-from and then chunking the files in the repository again.
+func enableRepair(context *cli.Context, repository string, manager *duplicacy.BackupManager) {
+	if !context.Bool("repair") {
+		return
+	}
+
+	for _, name := range context.StringSlice("repair-from") {
+		source := duplicacy.FindPreference(name)
+		if source == nil {
+			duplicacy.LOG_ERROR("STORAGE_NONE", "No storage named '%s' is found", name)
+			return
+		}
+
+		duplicacy.LOG_INFO("STORAGE_SET", "Repair storage set to %s", source.StorageURL)
+		sourceStorage := duplicacy.CreateStorage(*source, false, context.Int("threads"))
+		if sourceStorage == nil {
+			return
+		}
+
+		sourcePassword := ""
+		if source.Encrypted {
+			prompt := fmt.Sprintf("Enter the password for the storage %s:", name)
+			sourcePassword = duplicacy.GetPassword(*source, "password", prompt, false, false)
+		}
+
+		sourceManager := duplicacy.CreateBackupManager(source.SnapshotID, sourceStorage, repository,
+			sourcePassword, "", "", false)
+		duplicacy.SavePassword(*source, "password", sourcePassword)
+		if !manager.SnapshotManager.AddRepairStorage(name, sourceManager.SnapshotManager) {
+			return
+		}
+	}
+
+	manager.SnapshotManager.SetChunkRepair(true, repository)
+}
+
 func initRepository(context *cli.Context) {
 	configRepository(context, true)
 }
@@ -350,7 +535,7 @@ func configRepository(context *cli.Context, init bool) {
 		prompt := fmt.Sprintf("Enter storage password for %s:", preference.StorageURL)
 		storagePassword = duplicacy.GetPassword(preference, "password", prompt, false, true)
 	} else {
-		if context.String("key") != "" {
+		if context.String("key") != "" && context.String("kms") == "" {
 			duplicacy.LOG_ERROR("STORAGE_CONFIG", "RSA encryption can't be enabled with an unencrypted storage")
 			return
 		}
@@ -486,13 +671,24 @@ func configRepository(context *cli.Context, init bool) {
 			}
 		}
 
-		duplicacy.ConfigStorage(storage, iterations, compressionLevel, averageChunkSize, maximumChunkSize,
-			minimumChunkSize, storagePassword, otherConfig, bitCopy, context.String("key"), dataShards, parityShards)
+		duplicacy.ConfigStorageWithKMS(storage, context.String("kms"), iterations, compressionLevel, averageChunkSize,
+			maximumChunkSize, minimumChunkSize, storagePassword, otherConfig, bitCopy, context.String("key"), dataShards,
+			parityShards, context.Bool("random-chunk-keys"))
 	}
 
-	duplicacy.Preferences = append(duplicacy.Preferences, preference)
-
-	duplicacy.SavePreferences()
+	// Check again under the lock in case another command has saved the preferences in the meantime
+	duplicacy.UpdatePreferences(func() bool {
+		if init && len(duplicacy.Preferences) > 0 {
+			duplicacy.LOG_ERROR("REPOSITORY_INIT", "The repository %s has already been initialized", repository)
+			return false
+		}
+		if duplicacy.FindPreference(storageName) != nil {
+			duplicacy.LOG_ERROR("STORAGE_DUPLICATE", "There is already a storage named '%s'", storageName)
+			return false
+		}
+		duplicacy.Preferences = append(duplicacy.Preferences, preference)
+		return true
+	})
 
 	if repositoryPath == "" {
 		repositoryPath = repository
@@ -563,7 +759,42 @@ func setPreference(context *cli.Context) {
 		return
 	}
 
-	newPreference := *oldPreference
+	// Another command may have changed the preferences since they were loaded, so the options are applied to the
+	// preference as saved in the file
+	storageName = oldPreference.Name
+	saved := duplicacy.UpdatePreferences(func() bool {
+		oldPreference = duplicacy.FindPreference(storageName)
+		if oldPreference == nil {
+			duplicacy.LOG_ERROR("STORAGE_SET", "The storage '%s' has been removed from the repository %s",
+				storageName, repository)
+			return false
+		}
+
+		newPreference := *oldPreference
+		if !setPreferenceOptions(context, &newPreference) {
+			return false
+		}
+
+		if duplicacy.IsTracing() {
+			description, _ := json.MarshalIndent(newPreference, "", "    ")
+			fmt.Printf("%s\n", description)
+		}
+
+		if newPreference.Equal(oldPreference) {
+			duplicacy.LOG_INFO("STORAGE_SET", "The options for storage %s have not been modified",
+				oldPreference.StorageURL)
+			return false
+		}
+		*oldPreference = newPreference
+		return true
+	})
+	if saved {
+		duplicacy.LOG_INFO("STORAGE_SET", "New options for storage %s have been saved", oldPreference.StorageURL)
+	}
+}
+
+// setPreferenceOptions changes the preference according to the options of the set command.
+func setPreferenceOptions(context *cli.Context, newPreference *duplicacy.Preference) bool {
 
 	triBool := context.Generic("e").(*TriBool)
 	if triBool.IsSet() {
@@ -593,11 +824,169 @@ func setPreference(context *cli.Context) {
 		newPreference.FiltersFile = context.String("filters")
 	}
 
+	triBool = context.Generic("exclude-caches").(*TriBool)
+	if triBool.IsSet() {
+		newPreference.ExcludeCaches = triBool.IsTrue()
+	}
+
+	if context.IsSet("exclude-if-present") {
+		newPreference.ExcludeIfPresent = nil
+		for _, markerFile := range context.StringSlice("exclude-if-present") {
+			if markerFile != "" {
+				newPreference.ExcludeIfPresent = append(newPreference.ExcludeIfPresent, markerFile)
+			}
+		}
+	}
+
+	if context.IsSet("root") {
+		newPreference.Roots = nil
+		for _, text := range context.StringSlice("root") {
+			if text == "" {
+				continue
+			}
+			root, err := duplicacy.ParseSourceRoot(text)
+			if err != nil {
+				duplicacy.LOG_ERROR("STORAGE_SET", "Invalid source root: %v", err)
+				return false
+			}
+			for _, other := range newPreference.Roots {
+				if other.Name == root.Name {
+					duplicacy.LOG_ERROR("STORAGE_SET", "The source root '%s' is specified more than once", root.Name)
+					return false
+				}
+			}
+			newPreference.Roots = append(newPreference.Roots, root)
+		}
+	}
+
 	triBool = context.Generic("exclude-by-attribute").(*TriBool)
 	if triBool.IsSet() {
 		newPreference.ExcludeByAttribute = triBool.IsTrue()
 	}
 
+	if context.IsSet("snapshot-method") {
+		method := context.String("snapshot-method")
+		switch method {
+		case "auto":
+			method = ""
+		case "", "none", "lvm", "btrfs", "zfs":
+		default:
+			duplicacy.LOG_ERROR("STORAGE_SET", "Invalid snapshot method '%s'", method)
+			return false
+		}
+		newPreference.SnapshotMethod = method
+	}
+
+	if context.IsSet("snapshot-size") {
+		newPreference.SnapshotSize = context.String("snapshot-size")
+	}
+
+	if context.IsSet("keyring") {
+		keyring := context.String("keyring")
+		valid := keyring == "default"
+		for _, name := range duplicacy.GetKeyringNames() {
+			if keyring == name {
+				valid = true
+			}
+		}
+		if !valid {
+			duplicacy.LOG_ERROR("STORAGE_SET", "Invalid keyring '%s'; must be one of %s or default", keyring,
+				strings.Join(duplicacy.GetKeyringNames(), ", "))
+			return false
+		}
+		if keyring == "default" {
+			keyring = ""
+		}
+		newPreference.Keyring = keyring
+	}
+
+	if context.IsSet("password-command") {
+		newPreference.PasswordCommand = context.String("password-command")
+	}
+
+	if context.IsSet("change-feed") {
+		newPreference.ChangeFeed = context.String("change-feed")
+	}
+
+	if context.IsSet("retry") {
+		newPreference.Retry = nil
+		if settings := context.String("retry"); settings != "" {
+			policy, err := duplicacy.ParseRetryPolicy(settings)
+			if err != nil {
+				duplicacy.LOG_ERROR("STORAGE_SET", "Invalid retry policy '%s': %v", settings, err)
+				return false
+			}
+			newPreference.Retry = policy
+		}
+	}
+
+	if context.IsSet("network") {
+		newPreference.Network = nil
+		if settings := context.String("network"); settings != "" {
+			options, err := duplicacy.ParseNetworkOptions(settings)
+			if err != nil {
+				duplicacy.LOG_ERROR("STORAGE_SET", "Invalid network options '%s': %v", settings, err)
+				return false
+			}
+			newPreference.Network = options
+		}
+	}
+
+	if context.IsSet("cache-size") {
+		cacheSize := context.String("cache-size")
+		if cacheSize != "" {
+			if _, err := duplicacy.ParseStorageSize(cacheSize); err != nil {
+				duplicacy.LOG_ERROR("STORAGE_SET", "Invalid cache size '%s': %v", cacheSize, err)
+				return false
+			}
+		}
+		newPreference.CacheSize = cacheSize
+	}
+
+	if phase := context.String("hook"); phase != "" {
+		validPhase := false
+		for _, hookPhase := range duplicacy.HookPhases {
+			validPhase = validPhase || phase == hookPhase
+		}
+		if !validPhase {
+			duplicacy.LOG_ERROR("STORAGE_SET", "Invalid hook '%s'; must be one of %s", phase,
+				strings.Join(duplicacy.HookPhases, ", "))
+			return false
+		}
+
+		// Make a deep copy of the hooks for the same reason as the keys below
+		newHooks := make(map[string]duplicacy.Hook)
+		for k, v := range newPreference.Hooks {
+			newHooks[k] = v
+		}
+
+		hook := newHooks[phase]
+		if context.IsSet("hook-command") {
+			hook.Command = context.String("hook-command")
+		}
+		if context.IsSet("hook-on-failure") {
+			hook.OnFailure = context.String("hook-on-failure")
+			if hook.OnFailure != "abort" && hook.OnFailure != "warn" {
+				duplicacy.LOG_ERROR("STORAGE_SET", "Invalid failure policy '%s'; must be abort or warn", hook.OnFailure)
+				return false
+			}
+		}
+
+		if hook.Command == "" {
+			delete(newHooks, phase)
+		} else {
+			newHooks[phase] = hook
+		}
+		newPreference.Hooks = newHooks
+		if len(newHooks) == 0 {
+			newPreference.Hooks = nil
+		}
+	}
+
+	if !setNotifications(context, newPreference) {
+		return false
+	}
+
 	key := context.String("key")
 	value := context.String("value")
 
@@ -620,19 +1009,129 @@ func setPreference(context *cli.Context) {
 		}
 	}
 
-	if duplicacy.IsTracing() {
-		description, _ := json.MarshalIndent(newPreference, "", "    ")
-		fmt.Printf("%s\n", description)
+	return true
+}
+
+// setNotifications updates the notifications in the preference from the -notify-* options of the set command.
+func setNotifications(context *cli.Context, preference *duplicacy.Preference) bool {
+
+	// Make a copy of the notifications for the same reason as the hooks
+	notifications := duplicacy.Notifications{}
+	if preference.Notifications != nil {
+		notifications = *preference.Notifications
 	}
 
-	if newPreference.Equal(oldPreference) {
-		duplicacy.LOG_INFO("STORAGE_SET", "The options for storage %s have not been modified",
-			oldPreference.StorageURL)
-	} else {
-		*oldPreference = newPreference
-		duplicacy.SavePreferences()
-		duplicacy.LOG_INFO("STORAGE_SET", "New options for storage %s have been saved", oldPreference.StorageURL)
+	if context.IsSet("notify-on") {
+		validOn := false
+		for _, on := range duplicacy.NotificationOnValues {
+			validOn = validOn || context.String("notify-on") == on
+		}
+		if !validOn {
+			duplicacy.LOG_ERROR("STORAGE_SET", "Invalid notification condition '%s'; must be one of %s",
+				context.String("notify-on"), strings.Join(duplicacy.NotificationOnValues, ", "))
+			return false
+		}
+	}
+
+	if context.IsSet("notify-webhook") || context.IsSet("notify-webhook-template") ||
+		context.IsSet("notify-webhook-header") || (context.IsSet("notify-on") && notifications.Webhook != nil) {
+		webhook := duplicacy.WebhookNotification{}
+		if notifications.Webhook != nil {
+			webhook = *notifications.Webhook
+		}
+		if context.IsSet("notify-webhook") {
+			webhook.URL = context.String("notify-webhook")
+		}
+		if context.IsSet("notify-webhook-template") {
+			webhook.Template = ""
+			if file := context.String("notify-webhook-template"); file != "" {
+				content, err := ioutil.ReadFile(file)
+				if err != nil {
+					duplicacy.LOG_ERROR("STORAGE_SET", "Failed to read the webhook template %s: %v", file, err)
+					return false
+				}
+				webhook.Template = string(content)
+			}
+		}
+		if context.IsSet("notify-webhook-header") {
+			webhook.Headers = nil
+			for _, header := range context.StringSlice("notify-webhook-header") {
+				if header == "" {
+					continue
+				}
+				i := strings.Index(header, ":")
+				if i <= 0 {
+					duplicacy.LOG_ERROR("STORAGE_SET", "Invalid webhook header '%s'; must be name:value", header)
+					return false
+				}
+				if webhook.Headers == nil {
+					webhook.Headers = make(map[string]string)
+				}
+				webhook.Headers[strings.TrimSpace(header[:i])] = strings.TrimSpace(header[i+1:])
+			}
+		}
+		if context.IsSet("notify-on") {
+			webhook.On = context.String("notify-on")
+		}
+		notifications.Webhook = &webhook
+		if webhook.URL == "" {
+			notifications.Webhook = nil
+		}
+	}
+
+	if context.IsSet("notify-healthchecks") {
+		notifications.Healthchecks = context.String("notify-healthchecks")
+	}
+
+	if triBool := context.Generic("notify-report").(*TriBool); triBool.IsSet() {
+		notifications.Report = triBool.IsTrue()
+	}
+
+	if context.IsSet("notify-email") || context.IsSet("notify-email-from") || context.IsSet("notify-smtp") ||
+		context.IsSet("notify-smtp-username") || context.IsSet("notify-smtp-password") ||
+		(context.IsSet("notify-on") && notifications.Email != nil) {
+		email := duplicacy.EmailNotification{}
+		if notifications.Email != nil {
+			email = *notifications.Email
+		}
+		if context.IsSet("notify-email") {
+			email.To = nil
+			for _, address := range context.StringSlice("notify-email") {
+				if address != "" {
+					email.To = append(email.To, address)
+				}
+			}
+		}
+		if context.IsSet("notify-email-from") {
+			email.From = context.String("notify-email-from")
+		}
+		if context.IsSet("notify-smtp") {
+			email.Server = context.String("notify-smtp")
+		}
+		if context.IsSet("notify-smtp-username") {
+			email.Username = context.String("notify-smtp-username")
+		}
+		if context.IsSet("notify-smtp-password") {
+			email.Password = context.String("notify-smtp-password")
+		}
+		if context.IsSet("notify-on") {
+			email.On = context.String("notify-on")
+		}
+		notifications.Email = &email
+		if len(email.To) == 0 {
+			notifications.Email = nil
+		} else if email.Server == "" || email.From == "" {
+			duplicacy.LOG_ERROR("STORAGE_SET", "The email notification requires the -notify-smtp and -notify-email-from options")
+			return false
+		}
+	}
+
+	preference.Notifications = &notifications
+	if notifications.Webhook == nil && notifications.Healthchecks == "" && notifications.Email == nil &&
+		!notifications.Report {
+		preference.Notifications = nil
 	}
+	return true
 }
 
 func changePassword(context *cli.Context) {
@@ -729,34 +1228,51 @@ func changePassword(context *cli.Context) {
 	removeLocalCopy = true
 }
 
-func backupRepository(context *cli.Context) {
+// getMarkerFiles returns the names of the files that exclude the directory containing them, from the preference and
+// the -exclude-caches and -exclude-if-present options if the command has them.
+func getMarkerFiles(context *cli.Context, preference *duplicacy.Preference) (markerFiles []string) {
+	if preference.NobackupFile != "" {
+		markerFiles = append(markerFiles, preference.NobackupFile)
+	}
+	markerFiles = append(markerFiles, preference.ExcludeIfPresent...)
+	markerFiles = append(markerFiles, context.StringSlice("exclude-if-present")...)
+	if preference.ExcludeCaches || context.Bool("exclude-caches") {
+		markerFiles = append(markerFiles, duplicacy.CACHEDIR_TAG)
+	}
+	return markerFiles
+}
+
+func testFilters(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
-	if len(context.Args()) != 0 {
-		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+	if len(context.Args()) == 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires at least one path.\n\n", context.Command.Name)
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
 
 	repository, preference := getRepositoryPreference(context, "")
+	duplicacy.ExplainFilters(repository, preference.FiltersFile, getMarkerFiles(context, preference), context.Args())
+}
 
-	if preference.BackupProhibited {
-		duplicacy.LOG_ERROR("BACKUP_DISABLED", "Backup from this repository to %s was disabled by the preference",
-			preference.StorageURL)
-		return
+func rotateKey(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
-	// >>> DYNRATE
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		duplicacy.LOG_ERROR("RATE_FILE_WATCHER", "Failed to init rate-limit file watcher: %v", err)
-		return
+	if context.String("key") == "" || context.String("new-key") == "" {
+		fmt.Fprintf(context.App.Writer, "Both the current private key and the new public key must be specified.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
-	defer func(watcher *fsnotify.Watcher) { _ = watcher.Close() }(watcher)
-	// <<< DYNRATE
 
-	runScript(context, preference.Name, "pre")
+	repository, preference := getRepositoryPreference(context, "")
 
 	threads := context.Int("threads")
 	if threads < 1 {
@@ -769,29 +1285,58 @@ func backupRepository(context *cli.Context) {
 		return
 	}
 
-	// >>> DYNRATE
-	ThrottleFile := "/home/nulldev/Documents/SystemDocumentation/duplicacy-throttle/cur"
-	updateThrottle := func() {
-		ttext, err := ioutil.ReadFile(ThrottleFile)
-		if err != nil {
-			return
-		}
-		atoi, err := strconv.Atoi(strings.TrimSpace(string(ttext)))
-		if err != nil || atoi < 0 {
-			return
-		}
-		storage.SetRateLimits(0, atoi)
-		duplicacy.LOG_INFO("RATE_LIMIT_UPDATED", "Throttle updated to: %d", atoi)
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
-	updateThrottleThrottled := throttle.ThrottleFunc(time.Second, true, updateThrottle)
-	defer updateThrottleThrottled.Stop()
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
+
+	iterations := context.Int("iterations")
+	if iterations == 0 {
+		iterations = duplicacy.CONFIG_DEFAULT_ITERATIONS
+	}
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.RotateRSAKey(context.String("new-key"), password, iterations, threads)
+}
+
+// >>> DYNRATE
+// The file containing the upload rate limit (in kB/s) that running operations apply whenever it changes
+var ThrottleFile = "/home/nulldev/Documents/SystemDocumentation/duplicacy-throttle/cur"
+
+// startDynamicRateLimit watches the throttle file and applies the upload rate it contains to the storage whenever the
+// file is updated.  The returned functions apply the current rate immediately and stop watching the file.
+func startDynamicRateLimit(storage duplicacy.Storage) (updateThrottle func(), stop func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		duplicacy.LOG_ERROR("RATE_FILE_WATCHER", "Failed to init rate-limit file watcher: %v", err)
+		return
+	}
+
+	updateThrottle = func() {
+		ttext, err := ioutil.ReadFile(ThrottleFile)
+		if err != nil {
+			return
+		}
+		atoi, err := strconv.Atoi(strings.TrimSpace(string(ttext)))
+		if err != nil || atoi < 0 {
+			return
+		}
+		storage.SetRateLimits(0, atoi)
+		duplicacy.LOG_INFO("RATE_LIMIT_UPDATED", "Throttle updated to: %d", atoi)
+	}
+	updateThrottleThrottled := throttle.ThrottleFunc(time.Second, true, updateThrottle)
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
 				duplicacy.LOG_INFO("RATE_LIMIT_EVENT", "Rate-limit file updated, new event: %v", event)
 				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
 					go updateThrottleThrottled.Trigger()
@@ -806,9 +1351,114 @@ func backupRepository(context *cli.Context) {
 	}()
 	err = watcher.Add(filepath.Dir(ThrottleFile))
 	if err != nil {
+		watcher.Close()
 		duplicacy.LOG_ERROR("RATE_FILE_WATCHER", "Failed to start rate-limit file watcher: %v", err)
 		return
 	}
+
+	return updateThrottle, func() {
+		updateThrottleThrottled.Stop()
+		_ = watcher.Close()
+	}
+}
+
+// readDynamicRateLimit returns the upload rate limit in the throttle file, or 0 if the file doesn't exist.
+func readDynamicRateLimit() (int, error) {
+	ttext, err := ioutil.ReadFile(ThrottleFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(ttext)))
+}
+
+// writeDynamicRateLimit saves the upload rate limit to the throttle file, to be applied by all running operations.
+func writeDynamicRateLimit(rate int) error {
+	err := os.MkdirAll(filepath.Dir(ThrottleFile), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ThrottleFile, []byte(strconv.Itoa(rate)+"\n"), 0600)
+}
+// <<< DYNRATE
+
+// lockRepository keeps other backups and prunes from running in the repository until the command completes, waiting
+// for the one in progress as long as specified by -lock-wait.
+func lockRepository(context *cli.Context) *duplicacy.RepositoryLock {
+	wait := time.Duration(context.Int("lock-wait")) * time.Second
+	return duplicacy.AcquireRepositoryLock(duplicacy.GetDuplicacyPreferencePath(), context.Command.Name, wait)
+}
+
+func backupRepository(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	stdinName := ""
+	if context.Bool("stdin") {
+		stdinName = context.String("stdin-name")
+		if stdinName == "" || strings.ContainsAny(stdinName, "/\\") || stdinName == "." || stdinName == ".." {
+			fmt.Fprintf(context.App.Writer, "The name specified by -stdin-name must be a file name without directories.\n\n")
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+		for _, option := range []string{"vss", "snapshot", "journal", "enum-only", "metadata-only"} {
+			if context.Bool(option) {
+				fmt.Fprintf(context.App.Writer, "The -%s option can't be used with -stdin.\n\n", option)
+				cli.ShowCommandHelp(context, context.Command.Name)
+				os.Exit(ArgumentExitCode)
+			}
+		}
+		// The standard input carries the data to be backed up, so passwords can't be read from it
+		duplicacy.RunInBackground = true
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	if preference.BackupProhibited {
+		duplicacy.LOG_ERROR("BACKUP_DISABLED", "Backup from this repository to %s was disabled by the preference",
+			preference.StorageURL)
+		return
+	}
+
+	// A backup from the standard input must not become the previous revision of the repository's backups
+	snapshotID := preference.SnapshotID
+	if stdinName != "" {
+		snapshotID = context.String("id")
+		if snapshotID == "" || snapshotID == preference.SnapshotID {
+			fmt.Fprintf(context.App.Writer, "The -stdin option requires a snapshot id specified by -id that is different "+
+				"from the repository's snapshot id %s.\n\n", preference.SnapshotID)
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+	} else if context.String("id") != "" {
+		fmt.Fprintf(context.App.Writer, "The -id option can only be used with -stdin.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	runScript(context, preference.Name, "pre")
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	// >>> DYNRATE
+	updateThrottle, stopThrottle := startDynamicRateLimit(storage)
+	defer stopThrottle()
 	// <<< DYNRATE
 
 	password := ""
@@ -823,7 +1473,7 @@ func backupRepository(context *cli.Context) {
 
 	showStatistics := context.Bool("stats")
 
-	enableVSS := context.Bool("vss")
+	enableVSS := context.Bool("vss") || context.Bool("snapshot")
 	vssTimeout := context.Int("vss-timeout")
 
 	dryRun := context.Bool("dry-run")
@@ -833,27 +1483,196 @@ func backupRepository(context *cli.Context) {
 	// >>> DYNRATE
 	updateThrottle()
 	// <<< DYNRATE
-	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, preference.NobackupFile, preference.FiltersFile, preference.ExcludeByAttribute)
+	backupManager := duplicacy.CreateBackupManager(snapshotID, storage, repository, password, preference.NobackupFile, preference.FiltersFile, preference.ExcludeByAttribute)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	backupManager.SetupSnapshotCache(preference.Name)
 	backupManager.SetDryRun(dryRun)
-	backupManager.Backup(repository, quickMode, threads, context.String("t"), showStatistics, enableVSS, vssTimeout, enumOnly)
+	backupManager.SetSpecialFiles(context.Bool("special-files"))
+	backupManager.SetMarkerFiles(getMarkerFiles(context, preference))
+	backupManager.SetOneFileSystem(context.Bool("one-file-system"))
+	backupManager.SetChangeJournal(context.Bool("journal"))
+	backupManager.SetStdinName(stdinName)
+	duplicacy.SetFilterTracing(context.Bool("trace-filters"))
+	backupManager.SetShadowCopyOptions(duplicacy.ShadowCopyOptions{
+		Retries:         context.Int("vss-retries"),
+		ExcludedWriters: context.StringSlice("vss-exclude-writer"),
+		Method:          preference.SnapshotMethod,
+		SnapshotSize:    preference.SnapshotSize,
+	})
+	backupManager.SetOpenRetryOptions(duplicacy.OpenRetryOptions{
+		Retries: context.Int("open-retries"),
+		Delay:   time.Duration(context.Int("open-retry-delay")) * time.Second,
+	})
+	backupManager.SetSkippedReport(context.String("skipped-report"))
+	backupManager.SetMetadataOnly(context.Bool("metadata-only"))
+	backupManager.SetBackupNote(context.String("note"))
+	if context.String("verify-after") != "" {
+		percentage, err := duplicacy.ParseVerifyPercentage(context.String("verify-after"))
+		if err != nil {
+			fmt.Fprintf(context.App.Writer, "Invalid value for -verify-after: %v\n\n", err)
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+		backupManager.SetVerifyAfter(percentage)
+	}
+	lock := lockRepository(context)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	summary := runWithHooks(preference, repository, "backup", 0, func() *duplicacy.OperationSummary {
+		if !backupManager.Backup(repository, quickMode, threads, context.String("t"), showStatistics, enableVSS,
+			vssTimeout, enumOnly) {
+			return nil
+		}
+		summary := backupManager.GetSummary()
+		if !enumOnly {
+			duplicacy.SetJSONResult(&summary)
+		}
+		return &summary
+	})
+	if summary != nil && !enumOnly && context.Bool("index") {
+		backupManager.SnapshotManager.UpdateFileIndex(snapshotID)
+	}
 
 	runScript(context, preference.Name, "post")
 }
 
+func watchRepository(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	interval := context.Int("interval")
+	if interval < 1 {
+		interval = 1
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	if preference.BackupProhibited {
+		duplicacy.LOG_ERROR("BACKUP_DISABLED", "Backup from this repository to %s was disabled by the preference",
+			preference.StorageURL)
+		return
+	}
+
+	top, err := filepath.Abs(repository)
+	if err != nil {
+		duplicacy.LOG_ERROR("REPOSITORY_ERR", "Failed to obtain the absolute path of the repository: %v", err)
+		return
+	}
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	// >>> DYNRATE
+	updateThrottle, stopThrottle := startDynamicRateLimit(storage)
+	defer stopThrottle()
+	// <<< DYNRATE
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	storage.SetRateLimits(0, context.Int("limit-rate"))
+	// >>> DYNRATE
+	updateThrottle()
+	// <<< DYNRATE
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, preference.NobackupFile, preference.FiltersFile, preference.ExcludeByAttribute)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SetSpecialFiles(context.Bool("special-files"))
+	backupManager.SetMarkerFiles(getMarkerFiles(context, preference))
+	backupManager.SetOneFileSystem(context.Bool("one-file-system"))
+	backupManager.SetShadowCopyOptions(duplicacy.ShadowCopyOptions{
+		Retries:         context.Int("vss-retries"),
+		ExcludedWriters: context.StringSlice("vss-exclude-writer"),
+		Method:          preference.SnapshotMethod,
+		SnapshotSize:    preference.SnapshotSize,
+	})
+	backupManager.SetOpenRetryOptions(duplicacy.OpenRetryOptions{
+		Retries: context.Int("open-retries"),
+		Delay:   time.Duration(context.Int("open-retry-delay")) * time.Second,
+	})
+	backupManager.SetSkippedReport(context.String("skipped-report"))
+
+	// The repository must be watched before the first backup lists it, so no changes made during the backup are missed
+	watcher, err := duplicacy.CreateRepositoryWatcher(top)
+	if err != nil {
+		duplicacy.LOG_ERROR("WATCH_START", "Failed to watch the repository: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	changes := duplicacy.CreateChangeSet()
+	enableVSS := context.Bool("vss") || context.Bool("snapshot")
+	for {
+		backupManager.SetChangeSet(changes)
+		runScript(context, preference.Name, "pre")
+		runWithHooks(preference, repository, "backup", 0, func() *duplicacy.OperationSummary {
+			if !backupManager.Backup(repository, !context.Bool("hash"), threads, context.String("t"),
+				context.Bool("stats"), enableVSS, context.Int("vss-timeout"), false) {
+				return nil
+			}
+			summary := backupManager.GetSummary()
+			return &summary
+		})
+		runScript(context, preference.Name, "post")
+
+		duplicacy.LOG_INFO("WATCH_WAIT", "Waiting for changes in %s", top)
+		changes = watcher.Wait(changes, time.Duration(interval)*time.Second, context.Int("threshold"))
+	}
+}
+
 func restoreRepository(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
 	revision := context.Int("r")
-	if revision <= 0 {
+	checkReport := context.String("check-report")
+	deletedSince := context.Int("deleted-since")
+	if deletedSince > 0 {
+		if (revision > 0 && revision != deletedSince) || context.Bool("delete") {
+			fmt.Fprintf(context.App.Writer, "The -deleted-since option can't be used with -delete or a different -r\n\n")
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+		revision = deletedSince
+	}
+	if revision <= 0 && checkReport == "" {
 		fmt.Fprintf(context.App.Writer, "The revision flag is not specified or invalid\n\n")
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
 
+	archivePath := context.String("to-archive")
+	if archivePath != "" && (context.Bool("dry-run") || context.Bool("diff")) {
+		fmt.Fprintf(context.App.Writer, "The -to-archive option can't be used with -dry-run or -diff\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+	// The standard output is reserved for the archive
+	if archivePath == "-" {
+		duplicacy.SetLogOutput(os.Stderr)
+	}
+
 	repository, preference := getRepositoryPreference(context, "")
 
 	if preference.RestoreProhibited {
@@ -884,6 +1703,86 @@ func restoreRepository(context *cli.Context) {
 	overwrite := context.Bool("overwrite")
 	deleteMode := context.Bool("delete")
 	setOwner := !context.Bool("ignore-owner")
+	dryRun := context.Bool("dry-run") || context.Bool("diff")
+
+	normalization, err := duplicacy.ParseNormalization(context.String("normalize"))
+	if err != nil {
+		duplicacy.LOG_ERROR("RESTORE_NORMALIZE", "%v", err)
+		return
+	}
+	collisionPolicy, err := duplicacy.ParseCollisionPolicy(context.String("case-collision"))
+	if err != nil {
+		duplicacy.LOG_ERROR("RESTORE_COLLISION", "%v", err)
+		return
+	}
+	conflictPolicy, err := duplicacy.ParseConflictPolicy(context.String("on-conflict"))
+	if err != nil {
+		duplicacy.LOG_ERROR("RESTORE_CONFLICT", "%v", err)
+		return
+	}
+	if overwrite && conflictPolicy != "" && conflictPolicy != duplicacy.ConflictOverwrite {
+		duplicacy.LOG_ERROR("RESTORE_CONFLICT", "The -overwrite option can't be used with -on-conflict %s", conflictPolicy)
+		return
+	}
+	overwrite = overwrite || conflictPolicy == duplicacy.ConflictOverwrite
+	ownerPolicySetOwner, ownerErrorsAsWarnings, err := duplicacy.ParseOwnerPolicy(context.String("restore-owner"))
+	if err != nil {
+		duplicacy.LOG_ERROR("RESTORE_OWNER", "%v", err)
+		return
+	}
+	setOwner = setOwner && ownerPolicySetOwner
+	duplicacy.SetOwnerErrorsAsWarnings(ownerErrorsAsWarnings)
+
+	ownerMapping := duplicacy.CreateOwnerMapping()
+	if owner := context.String("chown"); owner != "" {
+		if err := ownerMapping.SetOwner(owner); err != nil {
+			duplicacy.LOG_ERROR("RESTORE_OWNER", "%v", err)
+			return
+		}
+	}
+	for _, isGroup := range []bool{false, true} {
+		flag := "map-uid"
+		if isGroup {
+			flag = "map-gid"
+		}
+		for _, text := range context.StringSlice(flag) {
+			if err := ownerMapping.AddIDMapping(text, isGroup); err != nil {
+				duplicacy.LOG_ERROR("RESTORE_OWNER", "%v", err)
+				return
+			}
+		}
+	}
+
+	var mappings []duplicacy.RestoreMapping
+	for _, rule := range context.StringSlice("map") {
+		mapping, err := duplicacy.ParseRestoreMapping(rule)
+		if err != nil {
+			duplicacy.LOG_ERROR("RESTORE_MAP", "%v", err)
+			return
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	var priorities [2][]string
+	for i, flag := range []string{"priority", "priority-last"} {
+		for _, text := range context.StringSlice(flag) {
+			pattern, err := duplicacy.ParseRestorePriority(text)
+			if err != nil {
+				duplicacy.LOG_ERROR("RESTORE_PRIORITY", "%v", err)
+				return
+			}
+			priorities[i] = append(priorities[i], pattern)
+		}
+	}
+
+	prefetchMemory := int64(duplicacy.DefaultRestorePrefetchMemory)
+	if context.String("prefetch-memory") != "" {
+		prefetchMemory, err = duplicacy.ParseStorageSize(context.String("prefetch-memory"))
+		if err != nil {
+			duplicacy.LOG_ERROR("RESTORE_PREFETCH", "Invalid prefetch memory '%s': %v", context.String("prefetch-memory"), err)
+			return
+		}
+	}
 
 	showStatistics := context.Bool("stats")
 	persist := context.Bool("persist")
@@ -917,7 +1816,55 @@ func restoreRepository(context *cli.Context) {
 	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
 
 	backupManager.SetupSnapshotCache(preference.Name)
-	failed := backupManager.Restore(repository, revision, true, quickMode, threads, overwrite, deleteMode, setOwner, showStatistics, patterns, persist)
+	backupManager.SetMarkerFiles(getMarkerFiles(context, preference))
+	backupManager.SetNormalization(normalization)
+	backupManager.SetCollisionPolicy(collisionPolicy)
+	backupManager.SetRestoreMappings(mappings)
+	backupManager.SetOwnerMapping(ownerMapping)
+	backupManager.SetConflictPolicy(conflictPolicy)
+	backupManager.SetRestorePriorities(priorities[0], priorities[1])
+	backupManager.SetRestorePrefetchMemory(prefetchMemory)
+	backupManager.SetRestoreVerification(context.Bool("verify") || context.String("verify-report") != "",
+		context.String("verify-report"))
+	enableQuarantine(context, repository, backupManager)
+	enableFailover(context, repository, backupManager)
+	backupManager.SetRestoreDeletedOnly(deletedSince > 0)
+
+	if checkReport != "" {
+		if backupManager.CheckRestoreReport(checkReport) {
+			runScript(context, preference.Name, "post")
+		}
+		return
+	}
+
+	if archivePath != "" {
+		failed := backupManager.RestoreToArchive(revision, archivePath, threads, showStatistics, patterns)
+		if failed > 0 {
+			duplicacy.LOG_ERROR("RESTORE_FAIL", "%d file(s) were not restored correctly", failed)
+			return
+		}
+		runScript(context, preference.Name, "post")
+		return
+	}
+
+	if dryRun {
+		backupManager.SetDryRun(true)
+		backupManager.SetRestoreDiff(context.Bool("diff"))
+		failed := backupManager.Restore(repository, revision, true, quickMode, threads, overwrite, deleteMode, setOwner, showStatistics, patterns, persist)
+		if failed > 0 {
+			duplicacy.LOG_ERROR("RESTORE_FAIL", "%d file(s) can't be restored", failed)
+		}
+		return
+	}
+
+	failed := 0
+	runWithHooks(preference, repository, "restore", revision, func() *duplicacy.OperationSummary {
+		failed = backupManager.Restore(repository, revision, true, quickMode, threads, overwrite, deleteMode, setOwner,
+			showStatistics, patterns, persist)
+		summary := backupManager.GetSummary()
+		duplicacy.SetJSONResult(&summary)
+		return &summary
+	})
 	if failed > 0 {
 		duplicacy.LOG_ERROR("RESTORE_FAIL", "%d file(s) were not restored correctly", failed)
 		return
@@ -969,38 +1916,32 @@ func listSnapshots(context *cli.Context) {
 
 	showFiles := context.Bool("files")
 	showChunks := context.Bool("chunks")
+	showStatistics := context.Bool("stats")
 
 	// list doesn't need to decrypt file chunks; but we need -key here so we can reset the passphrase for the private key
 	loadRSAPrivateKey(context.String("key"), "", preference, backupManager, resetPassword)
 
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.ListSnapshots(id, revisions, tag, showFiles, showChunks)
+	backupManager.SnapshotManager.ListSnapshots(id, revisions, tag, showFiles, showChunks, showStatistics)
 
 	runScript(context, preference.Name, "post")
 }
 
-func checkSnapshots(context *cli.Context) {
+func findFiles(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
-	if len(context.Args()) != 0 {
-		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+	if len(context.Args()) != 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires a pattern.\n\n", context.Command.Name)
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
 
 	repository, preference := getRepositoryPreference(context, "")
 
-	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
-
 	runScript(context, preference.Name, "pre")
 
-	threads := context.Int("threads")
-	if threads < 1 {
-		threads = 1
-	}
-
-	storage := duplicacy.CreateStorage(*preference, false, threads)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
 	if storage == nil {
 		return
 	}
@@ -1010,14 +1951,9 @@ func checkSnapshots(context *cli.Context) {
 		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	tag := context.String("t")
-	revisions := getRevisions(context)
-
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
 	duplicacy.SavePassword(*preference, "password", password)
 
-	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
-
 	id := preference.SnapshotID
 	if context.Bool("all") {
 		id = ""
@@ -1025,37 +1961,93 @@ func checkSnapshots(context *cli.Context) {
 		id = context.String("id")
 	}
 
-	showStatistics := context.Bool("stats")
-	showTabular := context.Bool("tabular")
-	checkFiles := context.Bool("files")
-	checkChunks := context.Bool("chunks")
-	searchFossils := context.Bool("fossils")
-	resurrect := context.Bool("resurrect")
-	persist := context.Bool("persist")
-
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.CheckSnapshots(id, revisions, tag, showStatistics, showTabular, checkFiles, checkChunks, searchFossils, resurrect, threads, persist)
+	if context.Bool("update") && !updateFileIndexes(backupManager, id) {
+		return
+	}
+
+	var ids []string
+	if id != "" {
+		ids = []string{id}
+	}
+	backupManager.SnapshotManager.FindFiles(ids, context.Args()[0])
 
 	runScript(context, preference.Name, "post")
 }
 
-func printFile(context *cli.Context) {
+func checkSnapshots(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
-	if len(context.Args()) > 1 {
-		fmt.Fprintf(context.App.Writer, "The %s command requires at most 1 argument.\n\n", context.Command.Name)
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if (context.Int("reverify-after") != 0 || context.Int("max-chunks") != 0) && !context.Bool("chunks") {
+		fmt.Fprintf(context.App.Writer, "The -reverify-after and -max-chunks options require -chunks.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if context.Int("reverify-after") < 0 || context.Int("max-chunks") < 0 {
+		fmt.Fprintf(context.App.Writer, "The -reverify-after and -max-chunks options can't be negative.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if context.Bool("cleanup") && !context.Bool("orphans") {
+		fmt.Fprintf(context.App.Writer, "The -cleanup option requires -orphans.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if context.Bool("orphans") && (context.Bool("stats") || context.Bool("tabular") || context.Bool("files") ||
+		context.Bool("chunks") || context.Bool("low-memory") || context.Bool("repair")) {
+		fmt.Fprintf(context.App.Writer, "The -orphans option can't be used with -stats, -tabular, -files, -chunks, -low-memory, or -repair.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if context.Bool("checksums") && (context.Bool("stats") || context.Bool("tabular") || context.Bool("files") ||
+		context.Bool("chunks") || context.Bool("low-memory") || context.Bool("repair") || context.Bool("orphans")) {
+		fmt.Fprintf(context.App.Writer, "The -checksums option can't be used with -stats, -tabular, -files, -chunks, -low-memory, -repair, or -orphans.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if len(context.StringSlice("repair-from")) > 0 && !context.Bool("repair") {
+		fmt.Fprintf(context.App.Writer, "The -repair-from option requires -repair.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if context.Bool("repair") && (context.Bool("low-memory") || context.Bool("files")) {
+		fmt.Fprintf(context.App.Writer, "The -repair option can't be used with -low-memory or -files.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	if context.Bool("low-memory") && (context.Bool("stats") || context.Bool("tabular") || context.Bool("files") ||
+		context.Bool("chunks")) {
+		fmt.Fprintf(context.App.Writer, "The -low-memory option can't be used with -stats, -tabular, -files, or -chunks.\n\n")
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
 
 	repository, preference := getRepositoryPreference(context, "")
 
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+
 	runScript(context, preference.Name, "pre")
 
-	// Do not print out storage for this command
-	//duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
-	storage := duplicacy.CreateStorage(*preference, false, 1)
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	storage := duplicacy.CreateStorage(*preference, false, threads)
 	if storage == nil {
 		return
 	}
@@ -1065,44 +2057,116 @@ func printFile(context *cli.Context) {
 		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	revision := context.Int("r")
-
-	snapshotID := preference.SnapshotID
-	if context.String("id") != "" {
-		snapshotID = context.String("id")
-	}
+	tag := context.String("t")
+	revisions := getRevisions(context)
 
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
 
+	id := preference.SnapshotID
+	if context.Bool("all") {
+		id = ""
+	} else if context.String("id") != "" {
+		id = context.String("id")
+	}
+
+	showStatistics := context.Bool("stats")
+	showTabular := context.Bool("tabular")
+	checkFiles := context.Bool("files")
+	checkChunks := context.Bool("chunks")
+	searchFossils := context.Bool("fossils")
+	resurrect := context.Bool("resurrect")
+	persist := context.Bool("persist")
+
 	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.SetLowMemoryCheck(context.Bool("low-memory"))
+	backupManager.SnapshotManager.SetFullListing(context.Bool("full-listing"))
+	backupManager.SnapshotManager.SetChunkVerification(time.Duration(context.Int("reverify-after"))*24*time.Hour,
+		context.Int("max-chunks"))
+
+	if context.Bool("encryption") {
+		if context.Bool("reencrypt-metadata") {
+			iterations := context.Int("iterations")
+			if iterations == 0 {
+				iterations = duplicacy.CONFIG_DEFAULT_ITERATIONS
+			}
+			if !backupManager.SnapshotManager.ReencryptMetadataChunks(password, iterations, threads) {
+				return
+			}
+		}
+		backupManager.SnapshotManager.AuditEncryption(threads)
+		runScript(context, preference.Name, "post")
+		return
+	}
 
-	file := ""
-	if len(context.Args()) > 0 {
-		file = context.Args()[0]
+	if context.Bool("orphans") {
+		backupManager.SnapshotManager.ReportOrphans(preference.SnapshotID, context.Bool("cleanup"), threads)
+		runScript(context, preference.Name, "post")
+		return
+	}
+
+	if context.Bool("checksums") {
+		backupManager.SnapshotManager.CheckChunkChecksums()
+		runScript(context, preference.Name, "post")
+		return
+	}
+
+	enableQuarantine(context, repository, backupManager)
+	enableRepair(context, repository, backupManager)
+	if !backupManager.SnapshotManager.CheckSnapshots(id, revisions, tag, showStatistics, showTabular, checkFiles, checkChunks, searchFossils, resurrect, threads, persist) {
+		duplicacy.SetExitCode(duplicacy.IntegrityExitCode)
+		duplicacy.EmitJSONResult(false, nil)
+		duplicacy.SendNotifications(false, nil)
+	} else if context.Bool("index") {
+		updateFileIndexes(backupManager, id)
 	}
-	backupManager.SnapshotManager.PrintFile(snapshotID, revision, file)
 
 	runScript(context, preference.Name, "post")
 }
 
-func diff(context *cli.Context) {
+// updateFileIndexes brings the local file index of the snapshot id, or of all snapshot ids if 'id' is empty, up to
+// date with the storage.
+func updateFileIndexes(backupManager *duplicacy.BackupManager, id string) bool {
+	ids := []string{id}
+	if id == "" {
+		var err error
+		ids, err = backupManager.SnapshotManager.ListSnapshotIDs()
+		if err != nil {
+			duplicacy.LOG_ERROR("SNAPSHOT_LIST", "Failed to list all snapshots: %v", err)
+			return false
+		}
+	}
+	for _, id := range ids {
+		if !backupManager.SnapshotManager.UpdateFileIndex(id) {
+			return false
+		}
+	}
+	return true
+}
+
+func printFile(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
 	if len(context.Args()) > 1 {
-		fmt.Fprintf(context.App.Writer, "The %s command requires 0 or 1 argument.\n\n", context.Command.Name)
+		fmt.Fprintf(context.App.Writer, "The %s command requires at most 1 argument.\n\n", context.Command.Name)
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
 
+	// The standard output is reserved for the file content
+	if len(context.Args()) > 0 {
+		duplicacy.SetLogOutput(os.Stderr)
+	}
+
 	repository, preference := getRepositoryPreference(context, "")
 
 	runScript(context, preference.Name, "pre")
 
-	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	// Do not print out storage for this command
+	//duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
 	storage := duplicacy.CreateStorage(*preference, false, 1)
 	if storage == nil {
 		return
@@ -1113,40 +2177,35 @@ func diff(context *cli.Context) {
 		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	revisions := context.IntSlice("r")
-	if len(revisions) > 2 {
-		fmt.Fprintf(context.App.Writer, "The %s command requires at most 2 revisions.\n", context.Command.Name)
-		os.Exit(ArgumentExitCode)
-	}
+	revision := context.Int("r")
 
 	snapshotID := preference.SnapshotID
 	if context.String("id") != "" {
 		snapshotID = context.String("id")
 	}
 
-	path := ""
-	if len(context.Args()) > 0 {
-		path = context.Args()[0]
-	}
-
-	compareByHash := context.Bool("hash")
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
 
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.Diff(repository, snapshotID, revisions, path, compareByHash, preference.NobackupFile, preference.FiltersFile, preference.ExcludeByAttribute)
+
+	file := ""
+	if len(context.Args()) > 0 {
+		file = context.Args()[0]
+	}
+	backupManager.SnapshotManager.PrintFile(snapshotID, revision, file, context.Int("threads"))
 
 	runScript(context, preference.Name, "post")
 }
 
-func showHistory(context *cli.Context) {
+func mountSnapshots(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
-	if len(context.Args()) != 1 {
-		fmt.Fprintf(context.App.Writer, "The %s command requires 1 argument.\n\n", context.Command.Name)
+	if len(context.Args()) > 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires at most 1 argument.\n\n", context.Command.Name)
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
@@ -1166,25 +2225,23 @@ func showHistory(context *cli.Context) {
 		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	snapshotID := preference.SnapshotID
-	if context.String("id") != "" {
-		snapshotID = context.String("id")
-	}
-
-	path := context.Args()[0]
-
-	revisions := getRevisions(context)
-	showLocalHash := context.Bool("hash")
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
 	duplicacy.SavePassword(*preference, "password", password)
 
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
+
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.ShowHistory(repository, snapshotID, revisions, path, showLocalHash)
+
+	mountPoint := ""
+	if len(context.Args()) > 0 {
+		mountPoint = context.Args()[0]
+	}
+	duplicacy.MountSnapshots(backupManager.SnapshotManager, context.String("address"), mountPoint)
 
 	runScript(context, preference.Name, "post")
 }
 
-func pruneSnapshots(context *cli.Context) {
+func serveSnapshots(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
@@ -1194,9 +2251,10 @@ func pruneSnapshots(context *cli.Context) {
 		os.Exit(ArgumentExitCode)
 	}
 
-	threads := context.Int("threads")
-	if threads < 1 {
-		threads = 1
+	if (context.String("tls-cert") == "") != (context.String("tls-key") == "") {
+		fmt.Fprintf(context.App.Writer, "The -tls-cert and -tls-key options must be specified together.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
 	repository, preference := getRepositoryPreference(context, "")
@@ -1204,7 +2262,7 @@ func pruneSnapshots(context *cli.Context) {
 	runScript(context, preference.Name, "pre")
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
-	storage := duplicacy.CreateStorage(*preference, false, threads)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
 	if storage == nil {
 		return
 	}
@@ -1214,41 +2272,30 @@ func pruneSnapshots(context *cli.Context) {
 		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	revisions := getRevisions(context)
-	tags := context.StringSlice("t")
-	retentions := context.StringSlice("keep")
-	selfID := preference.SnapshotID
-	snapshotID := preference.SnapshotID
-	if context.Bool("all") {
-		snapshotID = ""
-	} else if context.String("id") != "" {
-		snapshotID = context.String("id")
-	}
-
-	ignoredIDs := context.StringSlice("ignore")
-	exhaustive := context.Bool("exhaustive")
-	exclusive := context.Bool("exclusive")
-	dryRun := context.Bool("dry-run")
-	deleteOnly := context.Bool("delete-only")
-	collectOnly := context.Bool("collect-only")
-
-	if !storage.IsMoveFileImplemented() && !exclusive {
-		fmt.Fprintf(context.App.Writer, "The --exclusive option must be enabled for storage %s\n",
-			preference.StorageURL)
-		os.Exit(ArgumentExitCode)
-	}
-
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
 	duplicacy.SavePassword(*preference, "password", password)
 
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
+
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.SnapshotManager.PruneSnapshots(selfID, snapshotID, revisions, tags, retentions,
-		exhaustive, exclusive, ignoredIDs, dryRun, deleteOnly, collectOnly, threads)
+
+	options := duplicacy.ServeOptions{
+		Address:  context.String("address"),
+		Username: context.String("user"),
+		HTTPOnly: context.Bool("http"),
+		CertFile: context.String("tls-cert"),
+		KeyFile:  context.String("tls-key"),
+	}
+	if options.Username != "" {
+		options.Password = duplicacy.GetPassword(*preference, "serve_password",
+			"Enter the password for accessing the snapshots:", false, false)
+	}
+	duplicacy.ServeSnapshots(backupManager.SnapshotManager, options)
 
 	runScript(context, preference.Name, "post")
 }
 
-func copySnapshots(context *cli.Context) {
+func runDaemon(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
@@ -1258,359 +2305,2273 @@ func copySnapshots(context *cli.Context) {
 		os.Exit(ArgumentExitCode)
 	}
 
-	uploadingThreads := context.Int("threads")
-	if uploadingThreads < 1 {
-		uploadingThreads = 1
+	if context.GlobalBool("json") {
+		fmt.Fprintf(context.App.Writer, "The %s command doesn't support the -json option.\n\n", context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
-	downloadingThreads := context.Int("download-threads")
-	if downloadingThreads < 1 {
-		downloadingThreads = 1
+	// Make sure the repository has been initialized; operations are run from the current directory so they find the
+	// same repository
+	_, preference := getRepositoryPreference(context, "")
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		duplicacy.LOG_ERROR("REPOSITORY_PATH", "Failed to retrieve the current working directory: %v", err)
+		return
 	}
 
-	repository, source := getRepositoryPreference(context, context.String("from"))
-
-	runScript(context, source.Name, "pre")
-
-	duplicacy.LOG_INFO("STORAGE_SET", "Source storage set to %s", source.StorageURL)
-	sourceStorage := duplicacy.CreateStorage(*source, false, downloadingThreads)
-	if sourceStorage == nil {
+	executable, err := os.Executable()
+	if err != nil {
+		duplicacy.LOG_ERROR("DAEMON_EXECUTABLE", "Failed to locate the duplicacy executable: %v", err)
 		return
 	}
 
-	sourcePassword := ""
-	if source.Encrypted {
-		sourcePassword = duplicacy.GetPassword(*source, "password", "Enter source storage password:", false, false)
+	options := duplicacy.DaemonOptions{
+		Address:      context.String("listen"),
+		Executable:   executable,
+		Repository:   workingDirectory,
+		GetRateLimit: readDynamicRateLimit,
+		SetRateLimit: writeDynamicRateLimit,
+		TokenFile:    path.Join(duplicacy.GetDuplicacyPreferencePath(), "daemon_token"),
 	}
+	if context.Bool("token") {
+		options.Token = duplicacy.GetPassword(*preference, "daemon_token",
+			"Enter the token for accessing the REST API:", false, false)
+	}
+	duplicacy.RunDaemon(options)
+}
 
-	sourceManager := duplicacy.CreateBackupManager(source.SnapshotID, sourceStorage, repository, sourcePassword, "", "", false)
-	sourceManager.SetupSnapshotCache(source.Name)
-	duplicacy.SavePassword(*source, "password", sourcePassword)
+// The flags shared by 'service install' and 'service run'
+var serviceFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:     "name",
+		Usage:    "the name of the service, also used as the event log source (default is duplicacy)",
+		Argument: "<name>",
+	},
+	cli.StringFlag{
+		Name:     "interval",
+		Value:    "1h",
+		Usage:    "the time between the end of a run and the start of the next one (default is 1h)",
+		Argument: "<duration>",
+	},
+	cli.BoolFlag{
+		Name:  "pause-on-battery",
+		Usage: "skip scheduled runs and stop the running command while the computer is running on battery",
+	},
+	cli.BoolFlag{
+		Name:  "pause-on-metered",
+		Usage: "skip scheduled runs and stop the running command while the network connection is metered",
+	},
+}
 
-	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), source, sourceManager, false)
+// getServiceOptions returns the options of the service from the flags shared by 'service install' and 'service run'.
+func getServiceOptions(context *cli.Context) duplicacy.ServiceOptions {
+	if len(context.Args()) == 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires the command to be run on schedule.\n\n",
+			context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
 
-	_, destination := getRepositoryPreference(context, context.String("to"))
+	command := context.Args()[0]
+	allowed := false
+	for _, name := range duplicacy.DaemonCommands {
+		if name == command {
+			allowed = true
+		}
+	}
+	if !allowed {
+		fmt.Fprintf(context.App.Writer, "The %s command can't be run on schedule.\n\n", command)
+		os.Exit(ArgumentExitCode)
+	}
 
-	if destination.Name == source.Name {
-		duplicacy.LOG_ERROR("COPY_IDENTICAL", "The source storage and the destination storage are the same")
-		return
+	interval, err := time.ParseDuration(context.String("interval"))
+	if err != nil || interval <= 0 {
+		fmt.Fprintf(context.App.Writer, "Invalid interval: %s.\n\n", context.String("interval"))
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
-	if destination.BackupProhibited {
-		duplicacy.LOG_ERROR("COPY_DISABLED", "Copying snapshots to %s was disabled by the preference",
-			destination.StorageURL)
-		return
+	executable, err := os.Executable()
+	if err != nil {
+		duplicacy.LOG_ERROR("SERVICE_EXECUTABLE", "Failed to locate the duplicacy executable: %v", err)
 	}
 
-	duplicacy.LOG_INFO("STORAGE_SET", "Destination storage set to %s", destination.StorageURL)
-	destinationStorage := duplicacy.CreateStorage(*destination, false, uploadingThreads)
-	if destinationStorage == nil {
-		return
+	name := context.String("name")
+	if name == "" {
+		name = duplicacy.DefaultServiceName
 	}
 
-	destinationPassword := ""
-	if destination.Encrypted {
-		destinationPassword = duplicacy.GetPassword(*destination, "password",
-			"Enter destination storage password:", false, false)
+	return duplicacy.ServiceOptions{
+		Name:           name,
+		Executable:     executable,
+		Arguments:      context.Args(),
+		Interval:       interval,
+		PauseOnBattery: context.Bool("pause-on-battery"),
+		PauseOnMetered: context.Bool("pause-on-metered"),
 	}
+}
 
-	sourceStorage.SetRateLimits(context.Int("download-limit-rate"), 0)
-	destinationStorage.SetRateLimits(0, context.Int("upload-limit-rate"))
+func installService(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
 
-	destinationManager := duplicacy.CreateBackupManager(destination.SnapshotID, destinationStorage, repository,
-		destinationPassword, "", "", false)
-	duplicacy.SavePassword(*destination, "password", destinationPassword)
-	destinationManager.SetupSnapshotCache(destination.Name)
+	options := getServiceOptions(context)
 
-	revisions := getRevisions(context)
-	snapshotID := ""
-	if context.String("id") != "" {
-		snapshotID = context.String("id")
+	// Make sure the repository has been initialized; the command is run from the current directory so it finds the
+	// same repository
+	getRepositoryPreference(context, "")
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		duplicacy.LOG_ERROR("REPOSITORY_PATH", "Failed to retrieve the current working directory: %v", err)
+		return
 	}
+	options.Repository = workingDirectory
 
-	sourceManager.CopySnapshots(destinationManager, snapshotID, revisions, uploadingThreads, downloadingThreads)
-	runScript(context, source.Name, "post")
+	duplicacy.InstallService(options)
 }
 
-func infoStorage(context *cli.Context) {
+func uninstallService(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
-	if len(context.Args()) != 1 {
-		fmt.Fprintf(context.App.Writer, "The %s command requires a storage URL argument.\n\n", context.Command.Name)
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
 
-	repository := context.String("repository")
-	if repository != "" {
-		preferencePath := path.Join(repository, duplicacy.DUPLICACY_DIRECTORY)
-		duplicacy.SetDuplicacyPreferencePath(preferencePath)
-		duplicacy.SetKeyringFile(path.Join(preferencePath, "keyring"))
+	name := context.String("name")
+	if name == "" {
+		name = duplicacy.DefaultServiceName
 	}
+	duplicacy.UninstallService(name)
+}
 
-	resetPasswords := context.Bool("reset-passwords")
-	isEncrypted := context.Bool("e")
-	preference := duplicacy.Preference{
-		Name:              "default",
-		SnapshotID:        "default",
-		StorageURL:        context.Args()[0],
-		Encrypted:         isEncrypted,
-		DoNotSavePassword: true,
-	}
+func runService(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
 
-	storageName := context.String("storage-name")
-	if storageName != "" {
-		preference.Name = storageName
+	if context.GlobalBool("json") {
+		fmt.Fprintf(context.App.Writer, "The %s command doesn't support the -json option.\n\n", context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
-	if resetPasswords {
-		// We don't want password entered for the info command to overwrite the saved password for the default storage,
-		// so we simply assign an empty name.
-		preference.Name = ""
+	options := getServiceOptions(context)
+	options.Repository = context.String("repository")
+	if options.Repository == "" {
+		workingDirectory, err := os.Getwd()
+		if err != nil {
+			duplicacy.LOG_ERROR("REPOSITORY_PATH", "Failed to retrieve the current working directory: %v", err)
+			return
+		}
+		options.Repository = workingDirectory
 	}
 
-	password := ""
-	if isEncrypted {
-		password = duplicacy.GetPassword(preference, "password", "Enter the storage password:", false, resetPasswords)
+	duplicacy.RunService(options)
+}
+
+func runInAllRepositories(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if context.String("repos") == "" || len(context.Args()) == 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires the -repos option and a command to run.\n\n",
+			context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
-	storage := duplicacy.CreateStorage(preference, resetPasswords, 1)
-	config, isStorageEncrypted, err := duplicacy.DownloadConfig(storage, password)
+	if context.Int("parallel") < 1 || context.Int("limit-rate") < 0 {
+		fmt.Fprintf(context.App.Writer, "Invalid number of parallel repositories or rate limit.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
 
-	if isStorageEncrypted {
-		duplicacy.LOG_INFO("STORAGE_ENCRYPTED", "The storage is encrypted with a password")
-	} else if err != nil {
-		duplicacy.LOG_ERROR("STORAGE_ERROR", "%v", err)
-	} else if config == nil {
-		duplicacy.LOG_INFO("STORAGE_NOT_INITIALIZED", "The storage has not been initialized")
-	} else {
-		config.Print()
+	repositories, err := duplicacy.ListRepositories(context.String("repos"))
+	if err != nil {
+		duplicacy.LOG_ERROR("REPOSITORY_PATH", "Failed to list the repositories in %s: %v", context.String("repos"), err)
+		return
+	}
+	if len(repositories) == 0 {
+		duplicacy.LOG_ERROR("REPOSITORY_PATH", "No repositories are listed in %s", context.String("repos"))
+		return
 	}
 
-	dirs, _, err := storage.ListFiles(0, "snapshots/")
+	executable, err := os.Executable()
 	if err != nil {
-		duplicacy.LOG_WARN("STORAGE_LIST", "Failed to list repository ids: %v", err)
+		duplicacy.LOG_ERROR("ALL_EXECUTABLE", "Failed to locate the duplicacy executable: %v", err)
 		return
 	}
 
-	for _, dir := range dirs {
-		if len(dir) > 0 && dir[len(dir)-1] == '/' {
-			duplicacy.LOG_INFO("STORAGE_SNAPSHOT", "%s", dir[0:len(dir)-1])
-		}
+	results := duplicacy.RunInRepositories(repositories, duplicacy.MultiRepositoryOptions{
+		Executable: executable,
+		Arguments:  context.Args(),
+		Parallel:   context.Int("parallel"),
+		RateLimit:  context.Int("limit-rate"),
+	})
+
+	duplicacy.SetJSONResult(results)
+	if failed := duplicacy.PrintRepositoryReport(results); failed > 0 {
+		duplicacy.LOG_ERROR("ALL_FAILED", "%s failed in %d of %d repositories", strings.Join(context.Args(), " "),
+			failed, len(results))
+		return
+	}
+}
+
+func diff(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) > 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires 0 or 1 argument.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	revisions := context.IntSlice("r")
+	if len(revisions) > 2 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires at most 2 revisions.\n", context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	snapshotID := preference.SnapshotID
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	path := ""
+	if len(context.Args()) > 0 {
+		path = context.Args()[0]
 	}
 
+	compareByHash := context.Bool("hash")
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.Diff(repository, snapshotID, revisions, path, compareByHash, getMarkerFiles(context, preference), preference.FiltersFile, preference.ExcludeByAttribute,
+		context.Bool("content"))
+
+	runScript(context, preference.Name, "post")
 }
 
-func benchmark(context *cli.Context) {
+func showHistory(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
 
-	fileSize := context.Int("file-size")
-	if fileSize == 0 {
-		fileSize = 256
+	if len(context.Args()) != 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires 1 argument.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
-	chunkCount := context.Int("chunk-count")
-	if chunkCount == 0 {
-		chunkCount = 64
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
+	if storage == nil {
+		return
 	}
 
-	chunkSize := context.Int("chunk-size")
-	if chunkSize == 0 {
-		chunkSize = 4
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
 	}
 
-	downloadThreads := context.Int("download-threads")
-	if downloadThreads < 1 {
-		downloadThreads = 1
+	snapshotID := preference.SnapshotID
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
 	}
 
-	uploadThreads := context.Int("upload-threads")
-	if uploadThreads < 1 {
-		uploadThreads = 1
+	path := context.Args()[0]
+
+	revisions := getRevisions(context)
+	showLocalHash := context.Bool("hash")
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.ShowHistory(repository, snapshotID, revisions, path, showLocalHash,
+		context.Bool("changes"))
+
+	runScript(context, preference.Name, "post")
+}
+
+func pruneSnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
-	threads := downloadThreads
-	if threads < uploadThreads {
-		threads = uploadThreads
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
 	}
 
-	repository, preference := getRepositoryPreference(context, context.String("storage"))
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
 	storage := duplicacy.CreateStorage(*preference, false, threads)
 	if storage == nil {
 		return
 	}
-	duplicacy.Benchmark(repository, storage, int64(fileSize)*1024*1024, chunkSize*1024*1024, chunkCount, uploadThreads, downloadThreads)
-}
 
-func main() {
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
 
-	duplicacy.SetLoggingLevel(duplicacy.INFO)
+	revisions := getRevisions(context)
+	tags := context.StringSlice("t")
+	retentions, err := duplicacy.ExpandRetentions(context.StringSlice("keep"))
+	if err != nil {
+		fmt.Fprintf(context.App.Writer, "Invalid -keep option: %v\n\n", err)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+	if context.Bool("explain") && len(retentions) == 0 {
+		fmt.Fprintf(context.App.Writer, "The -explain option requires -keep.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+	selfID := preference.SnapshotID
+	snapshotID := preference.SnapshotID
+	if context.Bool("all") {
+		snapshotID = ""
+	} else if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
 
-	app := cli.NewApp()
+	ignoredIDs := context.StringSlice("ignore")
+	exhaustive := context.Bool("exhaustive")
+	exclusive := context.Bool("exclusive")
+	dryRun := context.Bool("dry-run") || context.Bool("explain")
+	deleteOnly := context.Bool("delete-only")
+	collectOnly := context.Bool("collect-only")
 
-	app.Commands = []cli.Command{
-		{
-			Name: "init",
-			Flags: []cli.Flag{
-				cli.BoolFlag{
-					Name:  "encrypt, e",
-					Usage: "encrypt the storage with a password",
-				},
-				cli.StringFlag{
-					Name:     "chunk-size, c",
-					Value:    "4M",
-					Usage:    "the average size of chunks (defaults to 4M)",
-					Argument: "<size>",
-				},
-				cli.StringFlag{
-					Name:     "max-chunk-size, max",
-					Usage:    "the maximum size of chunks (defaults to chunk-size*4)",
-					Argument: "<size>",
-				},
-				cli.StringFlag{
-					Name:     "min-chunk-size, min",
-					Usage:    "the minimum size of chunks (defaults to chunk-size/4)",
-					Argument: "<size>",
-				},
-				cli.IntFlag{
-					Name:     "iterations",
-					Usage:    "the number of iterations used in storage key derivation (default is 16384)",
-					Argument: "<i>",
-				},
-				cli.StringFlag{
-					Name:     "pref-dir",
-					Usage:    "alternate location for the .duplicacy directory (absolute or relative to current directory)",
-					Argument: "<path>",
-				},
+	if !storage.IsMoveFileImplemented() && !exclusive {
+		fmt.Fprintf(context.App.Writer, "The --exclusive option must be enabled for storage %s\n",
+			preference.StorageURL)
+		os.Exit(ArgumentExitCode)
+	}
+
+	targetSize := int64(0)
+	if context.String("target-size") != "" {
+		var err error
+		targetSize, err = duplicacy.ParseStorageSize(context.String("target-size"))
+		if err != nil {
+			fmt.Fprintf(context.App.Writer, "Invalid target size: %v\n\n", err)
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+	if context.Int("keep-min") < 0 || context.Int("keep-last") < 0 {
+		fmt.Fprintf(context.App.Writer, "The number of revisions to keep can't be negative\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	lock := lockRepository(context)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	if context.String("keep-gfs") != "" {
+		retention, err := duplicacy.ParseGFSRetention(context.String("keep-gfs"))
+		if err != nil {
+			duplicacy.LOG_ERROR("RETENTION_INVALID", "Invalid GFS retention policy: %v", err)
+			return
+		}
+		backupManager.SnapshotManager.SetGFSRetention(retention)
+	}
+	if targetSize > 0 {
+		backupManager.SnapshotManager.SetTargetSize(targetSize, context.Int("keep-min"))
+	}
+	backupManager.SnapshotManager.SetKeptTags(context.StringSlice("keep-tag"))
+	backupManager.SnapshotManager.SetKeepLast(context.Int("keep-last"))
+	backupManager.SnapshotManager.SetExplainRetention(context.Bool("explain"))
+	backupManager.SnapshotManager.SetIgnorePruneLock(context.Bool("ignore-lock"))
+	backupManager.SnapshotManager.SetFullListing(context.Bool("full-listing"))
+	backupManager.SnapshotManager.PruneSnapshots(selfID, snapshotID, revisions, tags, retentions,
+		exhaustive, exclusive, ignoredIDs, dryRun, deleteOnly, collectOnly, threads)
+
+	runScript(context, preference.Name, "post")
+}
+
+func pinSnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) > 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command takes at most one argument.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	revisions := getRevisions(context)
+	if len(revisions) == 0 && !context.Bool("list") {
+		fmt.Fprintf(context.App.Writer, "Please specify the revisions to pin or unpin.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	snapshotID := preference.SnapshotID
+	if len(context.Args()) == 1 {
+		snapshotID = context.Args()[0]
+	} else if context.Bool("list") && len(revisions) == 0 {
+		snapshotID = ""
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	if context.Bool("list") {
+		backupManager.SnapshotManager.ShowPinnedSnapshots(snapshotID)
+	} else if context.Bool("unpin") {
+		backupManager.SnapshotManager.UnpinSnapshots(snapshotID, revisions)
+	} else {
+		backupManager.SnapshotManager.PinSnapshots(snapshotID, revisions, context.String("reason"))
+	}
+
+	runScript(context, preference.Name, "post")
+}
+
+func tagSnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) > 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command takes at most one argument.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	revisions := getRevisions(context)
+	if len(revisions) == 0 {
+		fmt.Fprintf(context.App.Writer, "Please specify the revisions to tag.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	added := context.StringSlice("add")
+	removed := context.StringSlice("remove")
+	if len(added) == 0 && len(removed) == 0 {
+		fmt.Fprintf(context.App.Writer, "Please specify the tags to add or remove.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	snapshotID := preference.SnapshotID
+	if len(context.Args()) == 1 {
+		snapshotID = context.Args()[0]
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.TagSnapshots(snapshotID, revisions, added, removed)
+
+	runScript(context, preference.Name, "post")
+}
+
+func annotateSnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	note := ""
+	if context.Bool("clear") {
+		if len(context.Args()) != 0 {
+			fmt.Fprintf(context.App.Writer, "The %s command takes no arguments with -clear.\n\n", context.Command.Name)
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+	} else if len(context.Args()) != 1 || strings.TrimSpace(context.Args()[0]) == "" {
+		fmt.Fprintf(context.App.Writer, "The %s command requires the note as the only argument.\n\n",
+			context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	} else {
+		note = context.Args()[0]
+	}
+
+	revisions := getRevisions(context)
+	if len(revisions) == 0 {
+		fmt.Fprintf(context.App.Writer, "Please specify the revisions to annotate.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, 1)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	snapshotID := preference.SnapshotID
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.AnnotateSnapshots(snapshotID, revisions, note)
+
+	runScript(context, preference.Name, "post")
+}
+
+func purgeFiles(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	// Each filter selects the files to purge, so a pattern without a prefix is an include pattern
+	var patterns []string
+	for _, pattern := range context.StringSlice("filter") {
+		if pattern == "" {
+			continue
+		}
+		if pattern[0] != '+' && pattern[0] != '-' && !strings.HasPrefix(pattern, "i:") &&
+			!strings.HasPrefix(pattern, "e:") {
+			pattern = "+" + pattern
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		fmt.Fprintf(context.App.Writer, "Please specify the files to purge with -filter.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	exclusive := context.Bool("exclusive")
+	if !storage.IsMoveFileImplemented() && !exclusive {
+		fmt.Fprintf(context.App.Writer, "The --exclusive option must be enabled for storage %s\n",
+			preference.StorageURL)
+		os.Exit(ArgumentExitCode)
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	snapshotID := preference.SnapshotID
+	if context.Bool("all") {
+		snapshotID = ""
+	} else if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
+
+	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SnapshotManager.SetIgnorePruneLock(context.Bool("ignore-lock"))
+	backupManager.PurgeFiles(snapshotID, getRevisions(context), patterns, exclusive, context.Bool("dry-run"), threads)
+
+	runScript(context, preference.Name, "post")
+}
+
+func copySnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	uploadingThreads := context.Int("threads")
+	if uploadingThreads < 1 {
+		uploadingThreads = 1
+	}
+
+	downloadingThreads := context.Int("download-threads")
+	if downloadingThreads < 1 {
+		downloadingThreads = 1
+	}
+
+	// With -sync each storage is both uploaded to and downloaded from, so both need enough threads for either
+	sync := context.Bool("sync")
+	sourceThreads, destinationThreads := downloadingThreads, uploadingThreads
+	if sync {
+		if uploadingThreads > downloadingThreads {
+			sourceThreads = uploadingThreads
+		} else {
+			destinationThreads = downloadingThreads
+		}
+	}
+
+	repository, source := getRepositoryPreference(context, context.String("from"))
+
+	runScript(context, source.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Source storage set to %s", source.StorageURL)
+	sourceStorage := duplicacy.CreateStorage(*source, false, sourceThreads)
+	if sourceStorage == nil {
+		return
+	}
+
+	sourcePassword := ""
+	if source.Encrypted {
+		sourcePassword = duplicacy.GetPassword(*source, "password", "Enter source storage password:", false, false)
+	}
+
+	sourceManager := duplicacy.CreateBackupManager(source.SnapshotID, sourceStorage, repository, sourcePassword, "", "", false)
+	sourceManager.SetupSnapshotCache(source.Name)
+	duplicacy.SavePassword(*source, "password", sourcePassword)
+
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), source, sourceManager, false)
+
+	_, destination := getRepositoryPreference(context, context.String("to"))
+
+	if destination.Name == source.Name {
+		duplicacy.LOG_ERROR("COPY_IDENTICAL", "The source storage and the destination storage are the same")
+		return
+	}
+
+	if destination.BackupProhibited {
+		duplicacy.LOG_ERROR("COPY_DISABLED", "Copying snapshots to %s was disabled by the preference",
+			destination.StorageURL)
+		return
+	}
+
+	if sync && source.BackupProhibited {
+		duplicacy.LOG_ERROR("COPY_DISABLED", "Copying snapshots to %s was disabled by the preference",
+			source.StorageURL)
+		return
+	}
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Destination storage set to %s", destination.StorageURL)
+	destinationStorage := duplicacy.CreateStorage(*destination, false, destinationThreads)
+	if destinationStorage == nil {
+		return
+	}
+
+	destinationPassword := ""
+	if destination.Encrypted {
+		destinationPassword = duplicacy.GetPassword(*destination, "password",
+			"Enter destination storage password:", false, false)
+	}
+
+	if sync {
+		sourceStorage.SetRateLimits(context.Int("download-limit-rate"), context.Int("upload-limit-rate"))
+		destinationStorage.SetRateLimits(context.Int("download-limit-rate"), context.Int("upload-limit-rate"))
+	} else {
+		sourceStorage.SetRateLimits(context.Int("download-limit-rate"), 0)
+		destinationStorage.SetRateLimits(0, context.Int("upload-limit-rate"))
+	}
+
+	destinationManager := duplicacy.CreateBackupManager(destination.SnapshotID, destinationStorage, repository,
+		destinationPassword, "", "", false)
+	duplicacy.SavePassword(*destination, "password", destinationPassword)
+	destinationManager.SetupSnapshotCache(destination.Name)
+	if sync {
+		loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), destination, destinationManager, false)
+	}
+
+	revisions := getRevisions(context)
+	snapshotID := ""
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	sourceManager.SetSkipExistingVerify(context.Bool("skip-existing-verify"))
+	if sync {
+		destinationManager.SetSkipExistingVerify(context.Bool("skip-existing-verify"))
+		sourceManager.SyncSnapshots(destinationManager, snapshotID, revisions, uploadingThreads, downloadingThreads)
+	} else {
+		sourceManager.CopySnapshots(destinationManager, snapshotID, revisions, uploadingThreads, downloadingThreads)
+	}
+	runScript(context, source.Name, "post")
+}
+
+func exportSnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires a bundle directory argument.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	revisions := getRevisions(context)
+	if len(revisions) == 0 {
+		fmt.Fprintf(context.App.Writer, "Please specify the revisions to export.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	runScript(context, preference.Name, "pre")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	snapshotID := preference.SnapshotID
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+	backupManager.SetupSnapshotCache(preference.Name)
+
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, backupManager, false)
+
+	bundleStorage, err := duplicacy.CreateSnapshotBundle(storage, context.Args()[0], threads)
+	if err != nil {
+		duplicacy.LOG_ERROR("BUNDLE_CREATE", "Failed to create the bundle: %v", err)
+		return
+	}
+
+	// The bundle has the same config file as the storage, so the same password opens it
+	bundleManager := duplicacy.CreateBackupManager(preference.SnapshotID, bundleStorage, repository, password, "", "",
+		false)
+	bundleManager.SetupSnapshotCache("bundle")
+
+	backupManager.ExportSnapshots(bundleManager, snapshotID, revisions, threads)
+	runScript(context, preference.Name, "post")
+}
+
+func importSnapshots(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires a bundle directory argument.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	threads := context.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	if preference.BackupProhibited {
+		duplicacy.LOG_ERROR("COPY_DISABLED", "Copying snapshots to %s was disabled by the preference",
+			preference.StorageURL)
+		return
+	}
+
+	runScript(context, preference.Name, "pre")
+
+	bundleStorage, bundle, err := duplicacy.OpenSnapshotBundle(context.Args()[0], threads)
+	if err != nil {
+		duplicacy.LOG_ERROR("BUNDLE_OPEN", "Failed to open the bundle: %v", err)
+		return
+	}
+
+	// The bundle may come from a storage with a different password
+	bundlePassword := ""
+	if _, isEncrypted, _ := duplicacy.DownloadConfig(bundleStorage, ""); isEncrypted {
+		bundlePreference := duplicacy.Preference{Name: "bundle", DoNotSavePassword: true}
+		bundlePassword = duplicacy.GetPassword(bundlePreference, "password", "Enter the password of the bundle:",
+			false, false)
+	}
+
+	bundleManager := duplicacy.CreateBackupManager(preference.SnapshotID, bundleStorage, repository, bundlePassword,
+		"", "", false)
+	bundleManager.SetupSnapshotCache("bundle")
+
+	loadRSAPrivateKey(context.String("key"), context.String("key-passphrase"), preference, bundleManager, false)
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, false)
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+	backupManager.SetupSnapshotCache(preference.Name)
+
+	bundleManager.ImportSnapshots(bundle, backupManager, threads)
+	runScript(context, preference.Name, "post")
+}
+
+func manageCache(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	purge := context.String("purge")
+	if purge != "" && purge != "chunks" && purge != "snapshots" && purge != "all" {
+		fmt.Fprintf(context.App.Writer, "The -purge option must be chunks, snapshots, or all.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	_, preference := getRepositoryPreference(context, "")
+
+	var storageNames []string
+	if context.String("storage") != "" {
+		storageNames = []string{preference.Name}
+	} else {
+		var err error
+		storageNames, err = duplicacy.ListSnapshotCaches()
+		if err != nil {
+			duplicacy.LOG_ERROR("CACHE_LIST", "Failed to list the snapshot caches: %v", err)
+			return
+		}
+	}
+
+	for _, storageName := range storageNames {
+		if purge != "" {
+			err := duplicacy.PurgeSnapshotCache(storageName, purge)
+			if err != nil {
+				duplicacy.LOG_ERROR("CACHE_PURGE", "Failed to purge the snapshot cache of %s: %v", storageName, err)
+				return
+			}
+			duplicacy.LOG_INFO("CACHE_PURGE", "Purged %s from the snapshot cache of %s", purge, storageName)
+			if purge == "all" {
+				continue
+			}
+		}
+
+		limit := int64(0)
+		if storagePreference := duplicacy.FindPreference(storageName); storagePreference != nil &&
+			storagePreference.CacheSize != "" {
+			limit, _ = duplicacy.ParseStorageSize(storagePreference.CacheSize)
+		}
+		if context.Bool("trim") && limit > 0 {
+			removedFiles, removedBytes, err := duplicacy.TrimSnapshotCache(storageName, limit)
+			if err != nil {
+				duplicacy.LOG_ERROR("CACHE_TRIM", "Failed to trim the snapshot cache of %s: %v", storageName, err)
+				return
+			}
+			duplicacy.LOG_INFO("CACHE_TRIM", "Removed %d chunks (%s) from the snapshot cache of %s", removedFiles,
+				duplicacy.PrettySize(removedBytes), storageName)
+		}
+
+		usage, err := duplicacy.GetSnapshotCacheUsage(storageName)
+		if err != nil {
+			duplicacy.LOG_ERROR("CACHE_USAGE", "Failed to get the size of the snapshot cache of %s: %v", storageName, err)
+			return
+		}
+		limitText := "no limit"
+		if limit > 0 {
+			limitText = "limit " + duplicacy.PrettySize(limit)
+		}
+		duplicacy.LOG_INFO("CACHE_USAGE", "%s: %s (%s), %d chunks (%s), %d snapshot files (%s), other files %s",
+			storageName, duplicacy.PrettySize(usage.GetTotalBytes()), limitText, usage.ChunkFiles,
+			duplicacy.PrettySize(usage.ChunkBytes), usage.SnapshotFiles, duplicacy.PrettySize(usage.SnapshotBytes),
+			duplicacy.PrettySize(usage.OtherBytes))
+	}
+}
+
+func showFleetStatus(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires no arguments.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	staleDays := context.Int("stale")
+	if staleDays <= 0 {
+		fmt.Fprintf(context.App.Writer, "The -stale option must be a positive number of days.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, preference := getRepositoryPreference(context, "")
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+
+	resetPassword := context.Bool("reset-passwords")
+	storage := duplicacy.CreateStorage(*preference, resetPassword, 1)
+	if storage == nil {
+		return
+	}
+
+	password := ""
+	if preference.Encrypted {
+		password = duplicacy.GetPassword(*preference, "password", "Enter storage password:", false, resetPassword)
+	}
+
+	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, "", "", false)
+	duplicacy.SavePassword(*preference, "password", password)
+
+	statuses := backupManager.SnapshotManager.ShowFleetStatus(time.Duration(staleDays) * 24 * time.Hour)
+	duplicacy.SetJSONResult(statuses)
+}
+
+func infoStorage(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	if len(context.Args()) != 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires a storage URL argument.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository := context.String("repository")
+	if repository != "" {
+		preferencePath := path.Join(repository, duplicacy.DUPLICACY_DIRECTORY)
+		duplicacy.SetDuplicacyPreferencePath(preferencePath)
+		duplicacy.SetKeyringFile(path.Join(preferencePath, "keyring"))
+	}
+
+	resetPasswords := context.Bool("reset-passwords")
+	isEncrypted := context.Bool("e")
+	preference := duplicacy.Preference{
+		Name:              "default",
+		SnapshotID:        "default",
+		StorageURL:        context.Args()[0],
+		Encrypted:         isEncrypted,
+		DoNotSavePassword: true,
+	}
+
+	storageName := context.String("storage-name")
+	if storageName != "" {
+		preference.Name = storageName
+	}
+
+	if resetPasswords {
+		// We don't want password entered for the info command to overwrite the saved password for the default storage,
+		// so we simply assign an empty name.
+		preference.Name = ""
+	}
+
+	password := ""
+	if isEncrypted {
+		password = duplicacy.GetPassword(preference, "password", "Enter the storage password:", false, resetPasswords)
+	}
+
+	storage := duplicacy.CreateStorage(preference, resetPasswords, 1)
+	config, isStorageEncrypted, err := duplicacy.DownloadConfig(storage, password)
+
+	if isStorageEncrypted {
+		duplicacy.LOG_INFO("STORAGE_ENCRYPTED", "The storage is encrypted with a password")
+	} else if err != nil {
+		duplicacy.LOG_ERROR("STORAGE_ERROR", "%v", err)
+	} else if config == nil {
+		duplicacy.LOG_INFO("STORAGE_NOT_INITIALIZED", "The storage has not been initialized")
+	} else {
+		config.Print()
+	}
+
+	if context.Bool("usage") {
+		if config == nil {
+			duplicacy.LOG_ERROR("STORAGE_USAGE", "The usage can't be computed without the storage config")
+			return
+		}
+		if usage := duplicacy.ShowStorageUsage(config, storage); usage != nil {
+			duplicacy.SetJSONResult(usage)
+		}
+		return
+	}
+
+	dirs, _, err := storage.ListFiles(0, "snapshots/")
+	if err != nil {
+		duplicacy.LOG_WARN("STORAGE_LIST", "Failed to list repository ids: %v", err)
+		return
+	}
+
+	for _, dir := range dirs {
+		if len(dir) > 0 && dir[len(dir)-1] == '/' {
+			duplicacy.LOG_INFO("STORAGE_SNAPSHOT", "%s", dir[0:len(dir)-1])
+		}
+	}
+
+}
+
+func benchmark(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	fileSize := context.Int("file-size")
+	if fileSize == 0 {
+		fileSize = 256
+	}
+
+	chunkCount := context.Int("chunk-count")
+	if chunkCount == 0 {
+		chunkCount = 64
+	}
+
+	chunkSize := context.Int("chunk-size")
+	if chunkSize == 0 {
+		chunkSize = 4
+	}
+
+	downloadThreads := context.Int("download-threads")
+	if downloadThreads < 1 {
+		downloadThreads = 1
+	}
+
+	uploadThreads := context.Int("upload-threads")
+	if uploadThreads < 1 {
+		uploadThreads = 1
+	}
+
+	threads := downloadThreads
+	if threads < uploadThreads {
+		threads = uploadThreads
+	}
+
+	var objectSizes []int
+	var threadCounts []int
+	if context.Bool("latency") {
+		for _, size := range strings.Split(context.String("object-sizes"), ",") {
+			objectSize := duplicacy.AtoSize(strings.TrimSpace(size))
+			if objectSize == 0 {
+				fmt.Fprintf(context.App.Writer, "Invalid object size: %s.\n\n", size)
+				cli.ShowCommandHelp(context, context.Command.Name)
+				os.Exit(ArgumentExitCode)
+			}
+			objectSizes = append(objectSizes, objectSize)
+		}
+		for _, count := range strings.Split(context.String("thread-counts"), ",") {
+			threadCount, err := strconv.Atoi(strings.TrimSpace(count))
+			if err != nil || threadCount < 1 {
+				fmt.Fprintf(context.App.Writer, "Invalid thread count: %s.\n\n", count)
+				cli.ShowCommandHelp(context, context.Command.Name)
+				os.Exit(ArgumentExitCode)
+			}
+			threadCounts = append(threadCounts, threadCount)
+			if threads < threadCount {
+				threads = threadCount
+			}
+		}
+		if context.Int("chunk-count") == 0 {
+			chunkCount = 32
+		}
+	}
+
+	repository, preference := getRepositoryPreference(context, context.String("storage"))
+
+	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
+	storage := duplicacy.CreateStorage(*preference, false, threads)
+	if storage == nil {
+		return
+	}
+
+	if context.Bool("latency") {
+		results, recommendation := duplicacy.BenchmarkLatencies(storage, objectSizes, threadCounts, chunkCount)
+		duplicacy.SetJSONResult(map[string]interface{}{"results": results, "recommendation": recommendation})
+		return
+	}
+	duplicacy.Benchmark(repository, storage, int64(fileSize)*1024*1024, chunkSize*1024*1024, chunkCount, uploadThreads, downloadThreads)
+}
+
+// getFlagNames returns the names of the flag, including its short name, and whether the flag takes a value.
+func getFlagNames(flag cli.Flag) (names []string, takesValue bool) {
+	for _, name := range strings.Split(flag.GetName(), ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	switch flag.(type) {
+	case cli.BoolFlag, cli.BoolTFlag:
+		return names, false
+	}
+	return names, true
+}
+
+// findFlag returns the flag with the name, or nil if there isn't one.
+func findFlag(flags []cli.Flag, name string) cli.Flag {
+	for _, flag := range flags {
+		names, _ := getFlagNames(flag)
+		for _, flagName := range names {
+			if flagName == name {
+				return flag
+			}
+		}
+	}
+	return nil
+}
+
+// scanFlags returns the names of the flags given in the arguments, and the index of the first argument that isn't a
+// flag or the value of one.
+func scanFlags(flags []cli.Flag, arguments []string) (given map[string]bool, end int) {
+	given = make(map[string]bool)
+	for i := 0; i < len(arguments); i++ {
+		argument := arguments[i]
+		if argument == "-" || !strings.HasPrefix(argument, "-") {
+			return given, i
+		} else if argument == "--" {
+			return given, i + 1
+		}
+
+		name := strings.TrimLeft(argument, "-")
+		hasValue := false
+		if equal := strings.Index(name, "="); equal >= 0 {
+			name, hasValue = name[:equal], true
+		}
+		flag := findFlag(flags, name)
+		if flag == nil {
+			continue
+		}
+		names, takesValue := getFlagNames(flag)
+		for _, flagName := range names {
+			given[flagName] = true
+		}
+		if takesValue && !hasValue {
+			i++
+		}
+	}
+	return given, len(arguments)
+}
+
+// applyDefaults inserts the options from the defaults file that are not given on the command line into the
+// arguments.  Options in the table of the command take precedence over those outside of any table, which apply to
+// the global options and to the command if it has them.
+func applyDefaults(app *cli.App, arguments []string, defaults *duplicacy.Defaults) []string {
+	if defaults == nil || len(arguments) == 0 {
+		return arguments
+	}
+
+	givenGlobals, end := scanFlags(app.Flags, arguments[1:])
+	commandIndex := end + 1
+	var command *cli.Command
+	givenOptions := make(map[string]bool)
+	if commandIndex < len(arguments) {
+		command = app.Command(arguments[commandIndex])
+	}
+	if command != nil {
+		givenOptions, _ = scanFlags(command.Flags, arguments[commandIndex+1:])
+	}
+
+	// Mark all names of the flag as given so that a default can't be set twice under different names
+	addOption := func(options []string, given map[string]bool, flag cli.Flag, option duplicacy.DefaultOption) []string {
+		names, _ := getFlagNames(flag)
+		for _, name := range names {
+			if given[name] {
+				return options
+			}
+		}
+		for _, name := range names {
+			given[name] = true
+		}
+		return append(options, option.GetArguments()...)
+	}
+
+	var globalOptions, commandOptions []string
+	for _, table := range defaults.GetTables() {
+		tableCommand := app.Command(table)
+		if tableCommand == nil {
+			fmt.Fprintf(os.Stderr, "%s: unknown command %s\n", defaults.Path, table)
+			continue
+		} else if command == nil || tableCommand.Name != command.Name {
+			continue
+		}
+		for _, option := range defaults.GetOptions(table) {
+			flag := findFlag(command.Flags, option.Name)
+			if flag == nil {
+				fmt.Fprintf(os.Stderr, "%s: the %s command has no -%s option\n", defaults.Path, table, option.Name)
+				continue
+			}
+			commandOptions = addOption(commandOptions, givenOptions, flag, option)
+		}
+	}
+
+	for _, option := range defaults.GetOptions("") {
+		if flag := findFlag(app.Flags, option.Name); flag != nil {
+			globalOptions = addOption(globalOptions, givenGlobals, flag, option)
+		} else if command != nil {
+			if flag := findFlag(command.Flags, option.Name); flag != nil {
+				commandOptions = addOption(commandOptions, givenOptions, flag, option)
+			}
+		}
+	}
+
+	result := append([]string{arguments[0]}, globalOptions...)
+	if command == nil {
+		return append(result, arguments[1:]...)
+	}
+	result = append(result, arguments[1:commandIndex+1]...)
+	result = append(result, commandOptions...)
+	return append(result, arguments[commandIndex+1:]...)
+}
+
+func main() {
+
+	duplicacy.SetLoggingLevel(duplicacy.INFO)
+
+	app := cli.NewApp()
+
+	app.Commands = []cli.Command{
+		{
+			Name: "init",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "encrypt, e",
+					Usage: "encrypt the storage with a password",
+				},
+				cli.StringFlag{
+					Name:     "chunk-size, c",
+					Value:    "4M",
+					Usage:    "the average size of chunks (defaults to 4M)",
+					Argument: "<size>",
+				},
+				cli.StringFlag{
+					Name:     "max-chunk-size, max",
+					Usage:    "the maximum size of chunks (defaults to chunk-size*4)",
+					Argument: "<size>",
+				},
+				cli.StringFlag{
+					Name:     "min-chunk-size, min",
+					Usage:    "the minimum size of chunks (defaults to chunk-size/4)",
+					Argument: "<size>",
+				},
+				cli.IntFlag{
+					Name:     "iterations",
+					Usage:    "the number of iterations used in storage key derivation (default is 16384)",
+					Argument: "<i>",
+				},
+				cli.StringFlag{
+					Name:     "pref-dir",
+					Usage:    "alternate location for the .duplicacy directory (absolute or relative to current directory)",
+					Argument: "<path>",
+				},
+				cli.StringFlag{
+					Name:     "storage-name",
+					Usage:    "assign a name to the storage",
+					Argument: "<name>",
+				},
+				cli.StringFlag{
+					Name:     "repository",
+					Usage:    "initialize a new repository at the specified path rather than the current working directory",
+					Argument: "<path>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA public key to encrypt file chunks",
+					Argument: "<public key>",
+				},
+				cli.StringFlag{
+					Name:     "kms",
+					Usage:    "wrap the storage key with vault://<mount>/<key>, awskms://<key>, or gcpkms://<key name>",
+					Argument: "<uri>",
+				},
+				cli.StringFlag{
+					Name:     "erasure-coding",
+					Usage:    "enable erasure coding to protect against storage corruption",
+					Argument: "<data shards>:<parity shards>",
+				},
+				cli.BoolFlag{
+					Name:  "random-chunk-keys",
+					Usage: "encrypt every chunk with a random key instead of a key derived from the chunk hash",
+				},
+			},
+			Usage:     "Initialize the storage if necessary and the current directory as the repository",
+			ArgsUsage: "<snapshot id> <storage url>",
+			Action:    initRepository,
+		},
+		{
+			Name: "backup",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "hash",
+					Usage: "detect file differences by hash (rather than size and timestamp)",
+				},
+				cli.StringFlag{
+					Name:     "t",
+					Usage:    "assign a tag to the backup",
+					Argument: "<tag>",
+				},
+				cli.BoolFlag{
+					Name:  "stats",
+					Usage: "show statistics during and after backup",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of uploading threads",
+					Argument: "<n>",
+				},
+				cli.IntFlag{
+					Name:     "limit-rate",
+					Value:    0,
+					Usage:    "the maximum upload rate (in kilobytes/sec)",
+					Argument: "<kB/s>",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "estimate the new chunks and bytes to upload against the chunks of the last backup, without writing to the storage",
+				},
+				cli.BoolFlag{
+					Name:  "vss",
+					Usage: "enable the Volume Shadow Copy service (Windows, macOS using APFS, and Linux using LVM/btrfs/ZFS)",
+				},
+				cli.BoolFlag{
+					Name:  "special-files",
+					Usage: "back up named pipes, sockets, and device nodes instead of skipping them",
+				},
+				cli.BoolFlag{
+					Name:  "exclude-caches",
+					Usage: "skip directories containing a valid CACHEDIR.TAG file",
+				},
+				cli.BoolFlag{
+					Name:  "journal",
+					Usage: "list only directories changed since the last backup according to the USN journal (Windows) or FSEvents (macOS)",
+				},
+				cli.BoolFlag{
+					Name:  "one-file-system",
+					Usage: "don't descend into mounted file systems other than the one containing the repository",
+				},
+				cli.StringSliceFlag{
+					Name:     "exclude-if-present",
+					Usage:    "skip directories containing a file with this name (can be specified multiple times)",
+					Argument: "<file name>",
+				},
+				cli.BoolFlag{
+					Name:  "trace-filters",
+					Usage: "show the pattern that includes or excludes each file",
+				},
+				cli.BoolFlag{
+					Name:  "snapshot",
+					Usage: "back up from a read-only local snapshot of the repository volume (APFS on macOS; same as -vss on Windows)",
+				},
+				cli.IntFlag{
+					Name:     "vss-timeout",
+					Value:    0,
+					Usage:    "the timeout in seconds to wait for the Volume Shadow Copy operation to complete",
+					Argument: "<timeout>",
+				},
+				cli.IntFlag{
+					Name:     "vss-retries",
+					Value:    0,
+					Usage:    "retry creating the shadow copy up to <n> times if it fails",
+					Argument: "<n>",
+				},
+				cli.StringSliceFlag{
+					Name:     "vss-exclude-writer",
+					Usage:    "exclude the VSS writer with the specified class id from the shadow copy (can be specified multiple times; Windows only)",
+					Argument: "<writer id>",
+				},
+				cli.IntFlag{
+					Name:     "open-retries",
+					Value:    0,
+					Usage:    "retry opening a file in use by another process up to <n> times (Windows only)",
+					Argument: "<n>",
+				},
+				cli.IntFlag{
+					Name:     "open-retry-delay",
+					Value:    1,
+					Usage:    "wait <seconds> before the first retry to open a file in use, doubling the wait after each retry",
+					Argument: "<seconds>",
+				},
+				cli.StringFlag{
+					Name:     "skipped-report",
+					Usage:    "write the files and directories that could not be backed up, with the reasons, to <file>",
+					Argument: "<file>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "backup to the specified storage instead of the default one",
+					Argument: "<storage name>",
+				},
+				cli.BoolFlag{
+					Name:  "enum-only",
+					Usage: "enumerate the repository recursively and then exit",
+				},
+				cli.BoolFlag{
+					Name:  "metadata-only",
+					Usage: "record the file tree without uploading file contents (with -hash, compute the hashes of all files)",
+				},
+				cli.BoolFlag{
+					Name:  "index",
+					Usage: "add the new revision to the local file index used by the find command",
+				},
 				cli.StringFlag{
-					Name:     "storage-name",
-					Usage:    "assign a name to the storage",
+					Name:     "verify-after",
+					Usage:    "download and verify this percentage of the newly uploaded chunks after the backup, or all of them",
+					Argument: "<n% | all>",
+				},
+				cli.StringFlag{
+					Name:     "note",
+					Usage:    "attach a note describing the new revision, displayed by the list command",
+					Argument: "<text>",
+				},
+				cli.BoolFlag{
+					Name:  "stdin",
+					Usage: "back up the data read from the standard input as a single file instead of the repository",
+				},
+				cli.StringFlag{
+					Name:     "stdin-name",
+					Value:    "stdin",
+					Usage:    "the name of the file containing the data read from the standard input",
 					Argument: "<name>",
 				},
 				cli.StringFlag{
-					Name:     "repository",
-					Usage:    "initialize a new repository at the specified path rather than the current working directory",
-					Argument: "<path>",
+					Name:     "id",
+					Usage:    "the snapshot id of the backup from the standard input, which must differ from the repository's",
+					Argument: "<snapshot id>",
+				},
+				cli.IntFlag{
+					Name:     "lock-wait",
+					Usage:    "wait up to the specified number of seconds for another backup or prune in the repository to finish",
+					Argument: "<seconds>",
+				},
+			},
+			Usage:     "Save a snapshot of the repository to the storage",
+			ArgsUsage: " ",
+			Action:    backupRepository,
+		},
+
+		{
+			Name: "watch",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:     "interval",
+					Value:    60,
+					Usage:    "start a backup when no more changes have been made for this many seconds",
+					Argument: "<seconds>",
+				},
+				cli.IntFlag{
+					Name:     "threshold",
+					Value:    1000,
+					Usage:    "start a backup without waiting once this many changes have been made (0 to disable)",
+					Argument: "<n>",
+				},
+				cli.BoolFlag{
+					Name:  "hash",
+					Usage: "detect file differences by hash (rather than size and timestamp)",
+				},
+				cli.StringFlag{
+					Name:     "t",
+					Usage:    "assign a tag to the backups",
+					Argument: "<tag>",
+				},
+				cli.BoolFlag{
+					Name:  "stats",
+					Usage: "show statistics during and after each backup",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of uploading threads",
+					Argument: "<n>",
+				},
+				cli.IntFlag{
+					Name:     "limit-rate",
+					Value:    0,
+					Usage:    "the maximum upload rate (in kilobytes/sec)",
+					Argument: "<kB/s>",
+				},
+				cli.BoolFlag{
+					Name:  "vss",
+					Usage: "enable the Volume Shadow Copy service (Windows, macOS using APFS, and Linux using LVM/btrfs/ZFS)",
+				},
+				cli.BoolFlag{
+					Name:  "special-files",
+					Usage: "back up named pipes, sockets, and device nodes instead of skipping them",
+				},
+				cli.BoolFlag{
+					Name:  "exclude-caches",
+					Usage: "skip directories containing a valid CACHEDIR.TAG file",
+				},
+				cli.BoolFlag{
+					Name:  "one-file-system",
+					Usage: "don't descend into mounted file systems other than the one containing the repository",
+				},
+				cli.StringSliceFlag{
+					Name:     "exclude-if-present",
+					Usage:    "skip directories containing a file with this name (can be specified multiple times)",
+					Argument: "<file name>",
+				},
+				cli.BoolFlag{
+					Name:  "snapshot",
+					Usage: "back up from a read-only local snapshot of the repository volume (APFS on macOS; same as -vss on Windows)",
+				},
+				cli.IntFlag{
+					Name:     "vss-timeout",
+					Value:    0,
+					Usage:    "the timeout in seconds to wait for the Volume Shadow Copy operation to complete",
+					Argument: "<timeout>",
+				},
+				cli.IntFlag{
+					Name:     "vss-retries",
+					Value:    0,
+					Usage:    "retry creating the shadow copy up to <n> times if it fails",
+					Argument: "<n>",
+				},
+				cli.StringSliceFlag{
+					Name:     "vss-exclude-writer",
+					Usage:    "exclude the VSS writer with the specified class id from the shadow copy (can be specified multiple times; Windows only)",
+					Argument: "<writer id>",
+				},
+				cli.IntFlag{
+					Name:     "open-retries",
+					Value:    0,
+					Usage:    "retry opening a file in use by another process up to <n> times (Windows only)",
+					Argument: "<n>",
+				},
+				cli.IntFlag{
+					Name:     "open-retry-delay",
+					Value:    1,
+					Usage:    "wait <seconds> before the first retry to open a file in use, doubling the wait after each retry",
+					Argument: "<seconds>",
+				},
+				cli.StringFlag{
+					Name:     "skipped-report",
+					Usage:    "write the files and directories that could not be backed up, with the reasons, to <file>",
+					Argument: "<file>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "backup to the specified storage instead of the default one",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Keep running and back up the repository whenever files are changed",
+			ArgsUsage: " ",
+			Action:    watchRepository,
+		},
+
+		{
+			Name: "restore",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot (required)",
+					Argument: "<revision>",
+				},
+				cli.IntFlag{
+					Name:     "deleted-since",
+					Usage:    "restore only the files in the specified revision that no longer exist in the latest revision",
+					Argument: "<revision>",
+				},
+				cli.BoolFlag{
+					Name:  "hash",
+					Usage: "detect file differences by hash (rather than size and timestamp)",
+				},
+				cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "overwrite existing files in the repository",
+				},
+				cli.StringFlag{
+					Name:     "on-conflict",
+					Usage:    "overwrite, skip, keep-both (restore as 'name (restored).ext'), or newer (overwrite only older files) for existing files that differ",
+					Argument: "<policy>",
+				},
+				cli.BoolFlag{
+					Name:  "delete",
+					Usage: "delete files not in the snapshot",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-owner",
+					Usage: "do not set the original uid/gid on restored files",
+				},
+				cli.StringFlag{
+					Name:     "restore-owner",
+					Usage:    "yes (the default), try (only warn if the owner can't be set), or no (same as -ignore-owner)",
+					Argument: "<policy>",
+				},
+				cli.StringFlag{
+					Name:     "chown",
+					Usage:    "set the owner of all restored files to the specified user and/or group (by names or ids)",
+					Argument: "<user[:group]>",
+				},
+				cli.StringSliceFlag{
+					Name:     "map-uid",
+					Usage:    "restore files owned by the uid <from> in the snapshot as owned by the user <to> (can be specified multiple times)",
+					Argument: "<from=to>",
+				},
+				cli.StringSliceFlag{
+					Name:     "map-gid",
+					Usage:    "restore files owned by the gid <from> in the snapshot as owned by the group <to> (can be specified multiple times)",
+					Argument: "<from=to>",
+				},
+				cli.StringFlag{
+					Name:     "normalize",
+					Usage:    "convert file names to the Unicode normalization form nfc or nfd",
+					Argument: "<form>",
+				},
+				cli.StringFlag{
+					Name:     "case-collision",
+					Usage:    "rename, skip, or fail on files whose names differ only in case (the default is to rename them on case-insensitive file systems)",
+					Argument: "<policy>",
+				},
+				cli.StringSliceFlag{
+					Name:     "map",
+					Usage:    "restore files under <from> (a path in the snapshot or an absolute path, which may contain wildcards) to <to> instead (can be specified multiple times)",
+					Argument: "<from=to>",
+				},
+				cli.StringSliceFlag{
+					Name:     "priority",
+					Usage:    "restore files matching the pattern before all other files (can be specified multiple times to restore groups in order)",
+					Argument: "<pattern>",
+				},
+				cli.StringSliceFlag{
+					Name:     "priority-last",
+					Usage:    "restore files matching the pattern after all other files (can be specified multiple times to restore groups in order)",
+					Argument: "<pattern>",
+				},
+				cli.StringFlag{
+					Name:     "prefetch-memory",
+					Usage:    "the size of chunks to download ahead of the files being written, such as 512M (the default is 256M; 0 to only prefetch for the current file)",
+					Argument: "<size>",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list the files to be created, overwritten, or deleted without restoring them",
+				},
+				cli.BoolFlag{
+					Name:  "verify",
+					Usage: "re-hash all restored files after the restore and write a signed verification report",
+				},
+				cli.StringFlag{
+					Name:     "verify-report",
+					Usage:    "write the verification report to the specified file (implies -verify)",
+					Argument: "<file>",
+				},
+				cli.StringFlag{
+					Name:     "check-report",
+					Usage:    "validate the signature of a verification report instead of restoring",
+					Argument: "<file>",
+				},
+				cli.StringFlag{
+					Name:     "to-archive",
+					Usage:    "write the files into a .zip, .tar, .tar.gz, or .tgz archive instead of the repository ('-' for a tar stream to stdout)",
+					Argument: "<archive>",
+				},
+				cli.BoolFlag{
+					Name:  "diff",
+					Usage: "show the size and hash differences of files to be overwritten (implies -dry-run)",
+				},
+				cli.BoolFlag{
+					Name:  "stats",
+					Usage: "show statistics during and after restore",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of downloading threads",
+					Argument: "<n>",
+				},
+				cli.IntFlag{
+					Name:     "limit-rate",
+					Value:    0,
+					Usage:    "the maximum download rate (in kilobytes/sec)",
+					Argument: "<kB/s>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "restore from the specified storage instead of the default one",
+					Argument: "<storage name>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks",
+					Argument: "<private key>",
+				},
+				cli.BoolFlag{
+					Name:  "persist",
+					Usage: "continue processing despite chunk errors or existing files (without -overwrite), reporting any affected files",
+				},
+				cli.BoolFlag{
+					Name:  "quarantine",
+					Usage: "move corrupted chunks to the quarantine directory and upload good copies if available",
+				},
+				cli.StringFlag{
+					Name:     "mirror",
+					Usage:    "look for good copies of corrupted chunks in the specified storage (with -quarantine)",
+					Argument: "<storage name>",
+				},
+				cli.StringSliceFlag{
+					Name:     "failover",
+					Usage:    "download chunks missing or corrupted on the storage from the specified storage populated by copy (can be specified multiple times)",
+					Argument: "<storage name>",
+				},
+				cli.StringFlag{
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
+				},
+			},
+			Usage:     "Restore the repository to a previously saved snapshot",
+			ArgsUsage: "[--] [pattern] ...",
+			Action:    restoreRepository,
+		},
+
+		{
+			Name: "list",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "list snapshots with any id",
+				},
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "list snapshots with the specified id rather than the default one",
+					Argument: "<snapshot id>",
+				},
+				cli.StringSliceFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot",
+					Argument: "<revision>",
+				},
+				cli.StringFlag{
+					Name:     "t",
+					Usage:    "list snapshots with a tag matching the pattern",
+					Argument: "<tag>",
+				},
+				cli.BoolFlag{
+					Name:  "files",
+					Usage: "print the file list in each snapshot",
+				},
+				cli.BoolFlag{
+					Name:  "chunks",
+					Usage: "print chunks in each snapshot or all chunks if no snapshot specified",
+				},
+				cli.BoolFlag{
+					Name:  "stats",
+					Usage: "show the size, new chunks and dedup ratio of each revision",
+				},
+				cli.BoolFlag{
+					Name:  "reset-passwords",
+					Usage: "take passwords from input rather than keychain/keyring",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "retrieve snapshots from the specified storage",
+					Argument: "<storage name>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks",
+					Argument: "<private key>",
+				},
+			},
+			Usage:     "List snapshots",
+			ArgsUsage: " ",
+			Action:    listSnapshots,
+		},
+		{
+			Name: "find",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "search snapshots with any id",
+				},
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "search snapshots with the specified id rather than the default one",
+					Argument: "<snapshot id>",
 				},
-				cli.StringFlag{
-					Name:     "key",
-					Usage:    "the RSA public key to encrypt file chunks",
-					Argument: "<public key>",
+				cli.BoolFlag{
+					Name:  "update",
+					Usage: "update the local file index from the storage before searching",
 				},
 				cli.StringFlag{
-					Name:     "erasure-coding",
-					Usage:    "enable erasure coding to protect against storage corruption",
-					Argument: "<data shards>:<parity shards>",
+					Name:     "storage",
+					Usage:    "search snapshots from the specified storage",
+					Argument: "<storage name>",
 				},
 			},
-			Usage:     "Initialize the storage if necessary and the current directory as the repository",
-			ArgsUsage: "<snapshot id> <storage url>",
-			Action:    initRepository,
+			Usage:     "Find files in all revisions using the local file index",
+			ArgsUsage: "<pattern>",
+			Action:    findFiles,
 		},
 		{
-			Name: "backup",
+			Name: "check",
 			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name:  "hash",
-					Usage: "detect file differences by hash (rather than size and timestamp)",
+					Name:  "all, a",
+					Usage: "check snapshots with any id",
+				},
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "check snapshots with the specified id rather than the default one",
+					Argument: "<snapshot id>",
+				},
+				cli.StringSliceFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot",
+					Argument: "<revision>",
 				},
 				cli.StringFlag{
 					Name:     "t",
-					Usage:    "assign a tag to the backup",
+					Usage:    "check snapshots with a tag matching the pattern",
 					Argument: "<tag>",
 				},
+				cli.BoolFlag{
+					Name:  "fossils",
+					Usage: "search fossils if a chunk can't be found",
+				},
+				cli.BoolFlag{
+					Name:  "resurrect",
+					Usage: "turn referenced fossils back into chunks",
+				},
+				cli.BoolFlag{
+					Name:  "files",
+					Usage: "verify the integrity of every file",
+				},
+				cli.BoolFlag{
+					Name:  "chunks",
+					Usage: "verify the integrity of every chunk",
+				},
+				cli.IntFlag{
+					Name:     "reverify-after",
+					Usage:    "with -chunks, verify chunks again if they were last verified more than <days> ago",
+					Argument: "<days>",
+				},
+				cli.IntFlag{
+					Name:     "max-chunks",
+					Usage:    "with -chunks, verify at most <n> chunks, least recently verified first",
+					Argument: "<n>",
+				},
 				cli.BoolFlag{
 					Name:  "stats",
-					Usage: "show statistics during and after backup",
+					Usage: "show deduplication statistics (imply -all and all revisions)",
+				},
+				cli.BoolFlag{
+					Name:  "encryption",
+					Usage: "report how file and metadata chunks are encrypted (hash-derived or random keys)",
+				},
+				cli.BoolFlag{
+					Name:  "reencrypt-metadata",
+					Usage: "with -encryption, switch to random chunk keys and encrypt existing metadata chunks with random keys",
+				},
+				cli.IntFlag{
+					Name:     "iterations",
+					Usage:    "with -reencrypt-metadata, the number of iterations used in storage key derivation (default is 16384)",
+					Argument: "<i>",
+				},
+				cli.BoolFlag{
+					Name:  "tabular",
+					Usage: "show tabular usage and deduplication statistics (imply -stats, -all, and all revisions)",
+				},
+				cli.BoolFlag{
+					Name:  "low-memory",
+					Usage: "find missing chunks using sorted temporary files instead of memory (for storages with many chunks)",
+				},
+				cli.BoolFlag{
+					Name:  "full-listing",
+					Usage: "list all chunks and rebuild the chunk index instead of reading the change feed set by 'set -change-feed'",
+				},
+				cli.BoolFlag{
+					Name:  "orphans",
+					Usage: "report unreferenced chunks, leftover fossils, temporary files, and redundant copies or versions of chunks",
+				},
+				cli.BoolFlag{
+					Name:  "checksums",
+					Usage: "compare the checksums reported by the storage (B2 or S3) with those recorded when chunks were uploaded",
+				},
+				cli.BoolFlag{
+					Name:  "cleanup",
+					Usage: "with -orphans, delete redundant copies and versions and run an exhaustive prune to remove the rest",
+				},
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "recover missing chunks (and corrupted chunks with -chunks) and upload them again",
+				},
+				cli.StringSliceFlag{
+					Name:     "repair-from",
+					Usage:    "look for copies of the chunks to repair in the specified storage populated by copy (can be specified multiple times)",
+					Argument: "<storage name>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "retrieve snapshots from the specified storage",
+					Argument: "<storage name>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks",
+					Argument: "<private key>",
+				},
+				cli.StringFlag{
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
 				},
 				cli.IntFlag{
 					Name:     "threads",
 					Value:    1,
-					Usage:    "number of uploading threads",
+					Usage:    "number of threads used to verify chunks",
 					Argument: "<n>",
 				},
+				cli.BoolFlag{
+					Name:  "persist",
+					Usage: "continue processing despite chunk errors, reporting any affected (corrupted) files",
+				},
+				cli.BoolFlag{
+					Name:  "index",
+					Usage: "update the local file index used by the find command after a successful check",
+				},
+				cli.BoolFlag{
+					Name:  "quarantine",
+					Usage: "move corrupted chunks to the quarantine directory and upload good copies if available",
+				},
+				cli.StringFlag{
+					Name:     "mirror",
+					Usage:    "look for good copies of corrupted chunks in the specified storage (with -quarantine)",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Check the integrity of snapshots",
+			ArgsUsage: " ",
+			Action:    checkSnapshots,
+		},
+		{
+			Name: "cat",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "retrieve from the snapshot with the specified id",
+					Argument: "<snapshot id>",
+				},
 				cli.IntFlag{
-					Name:     "limit-rate",
-					Value:    0,
-					Usage:    "the maximum upload rate (in kilobytes/sec)",
-					Argument: "<kB/s>",
+					Name:     "r",
+					Usage:    "the revision number of the snapshot",
+					Argument: "<revision>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "retrieve the file from the specified storage",
+					Argument: "<storage name>",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of downloading threads",
+					Argument: "<n>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks",
+					Argument: "<private key>",
+				},
+				cli.StringFlag{
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
+				},
+			},
+			Usage:     "Print to stdout the specified file, or the snapshot content if no file is specified",
+			ArgsUsage: "[<file>]",
+			Action:    printFile,
+		},
+
+		{
+			Name: "diff",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "diff snapshots with the specified id",
+					Argument: "<snapshot id>",
+				},
+				cli.IntSliceFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot",
+					Argument: "<revision>",
 				},
 				cli.BoolFlag{
-					Name:  "dry-run",
-					Usage: "dry run for testing, don't backup anything. Use with -stats and -d",
+					Name:  "hash",
+					Usage: "compute the hashes of on-disk files",
 				},
 				cli.BoolFlag{
-					Name:  "vss",
-					Usage: "enable the Volume Shadow Copy service (Windows and macOS using APFS only)",
+					Name:  "content",
+					Usage: "show unified diffs of the contents of changed text files",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "retrieve files from the specified storage",
+					Argument: "<storage name>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks",
+					Argument: "<private key>",
+				},
+				cli.StringFlag{
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
+				},
+			},
+			Usage:     "Compare two snapshots or two revisions of a file",
+			ArgsUsage: "[<file>]",
+			Action:    diff,
+		},
+
+		{
+			Name: "history",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "find the file in the snapshot with the specified id",
+					Argument: "<snapshot id>",
+				},
+				cli.StringSliceFlag{
+					Name:     "r",
+					Usage:    "show history of the specified revisions",
+					Argument: "<revision>",
+				},
+				cli.BoolFlag{
+					Name:  "hash",
+					Usage: "show the hash of the on-disk file",
+				},
+				cli.BoolFlag{
+					Name:  "changes",
+					Usage: "only show the revisions in which the file was added, modified, or deleted",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "retrieve files from the specified storage",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Show the history of a file",
+			ArgsUsage: "<file>",
+			Action:    showHistory,
+		},
+
+		{
+			Name: "daemon",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "listen",
+					Value:    "127.0.0.1:8200",
+					Usage:    "serve the REST API on the specified address (use :<port> to accept connections from other machines)",
+					Argument: "<address:port>",
+				},
+				cli.BoolFlag{
+					Name:  "token",
+					Usage: "read the bearer token clients must send from DUPLICACY_DAEMON_TOKEN or prompt for it, instead of generating one into .duplicacy/daemon_token",
+				},
+			},
+			Usage:     "Serve a REST API for running operations, querying their progress, adjusting the rate limit, and browsing snapshots",
+			ArgsUsage: " ",
+			Action:    runDaemon,
+		},
+
+		{
+			Name: "all",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "repos",
+					Usage:    "the directory listing the repositories, as subdirectories or as files with one path per line",
+					Argument: "<directory>",
 				},
 				cli.IntFlag{
-					Name:     "vss-timeout",
-					Value:    0,
-					Usage:    "the timeout in seconds to wait for the Volume Shadow Copy operation to complete",
-					Argument: "<timeout>",
+					Name:     "parallel",
+					Value:    1,
+					Usage:    "the number of repositories to process at the same time",
+					Argument: "<n>",
 				},
-				cli.StringFlag{
-					Name:     "storage",
-					Usage:    "backup to the specified storage instead of the default one",
-					Argument: "<storage name>",
+				cli.IntFlag{
+					Name:     "limit-rate",
+					Value:    0,
+					Usage:    "the total upload/download rate in kB/s, shared by the backup, restore, or copy commands running at the same time",
+					Argument: "<kB/s>",
 				},
+			},
+			Usage:     "Run a command in each of the repositories listed in a directory and report the results",
+			ArgsUsage: "<command> [<option>...]",
+			Action:    runInAllRepositories,
+		},
+
+		{
+			Name: "completion",
+			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name:  "enum-only",
-					Usage: "enumerate the repository recursively and then exit",
+					Name:  "metadata",
+					Usage: "print the commands and their options as JSON instead",
 				},
 			},
-			Usage:     "Save a snapshot of the repository to the storage",
-			ArgsUsage: " ",
-			Action:    backupRepository,
+			Usage:     "Print the completion script for bash, zsh, fish, or powershell",
+			ArgsUsage: "<shell>",
+			Action:    printCompletion,
 		},
 
 		{
-			Name: "restore",
-			Flags: []cli.Flag{
-				cli.IntFlag{
-					Name:     "r",
-					Usage:    "the revision number of the snapshot (required)",
-					Argument: "<revision>",
+			Name:  "service",
+			Usage: "Run a command on schedule as a Windows service",
+			Subcommands: []cli.Command{
+				{
+					Name:      "install",
+					Flags:     serviceFlags,
+					Usage:     "Register a service that runs the command on schedule in the current repository",
+					ArgsUsage: "<command> [<option>...]",
+					Action:    installService,
 				},
-				cli.BoolFlag{
-					Name:  "hash",
-					Usage: "detect file differences by hash (rather than size and timestamp)",
+				{
+					Name: "uninstall",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "name",
+							Usage:    "the name of the service (default is duplicacy)",
+							Argument: "<name>",
+						},
+					},
+					Usage:     "Stop and remove the service",
+					ArgsUsage: " ",
+					Action:    uninstallService,
 				},
-				cli.BoolFlag{
-					Name:  "overwrite",
-					Usage: "overwrite existing files in the repository",
+				{
+					Name: "run",
+					Flags: append(serviceFlags, cli.StringFlag{
+						Name:     "repository",
+						Usage:    "run the command in the specified repository (default is the current directory)",
+						Argument: "<path>",
+					}),
+					Usage:     "Run the command on schedule, as the service manager does; runs in the foreground if started from a console",
+					ArgsUsage: "<command> [<option>...]",
+					Action:    runService,
 				},
-				cli.BoolFlag{
-					Name:  "delete",
-					Usage: "delete files not in the snapshot",
+			},
+		},
+
+		{
+			Name: "serve",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "address",
+					Value:    "127.0.0.1:8080",
+					Usage:    "serve the snapshots on the specified address (use :<port> to accept connections from other machines, which requires -user)",
+					Argument: "<address:port>",
 				},
-				cli.BoolFlag{
-					Name:  "ignore-owner",
-					Usage: "do not set the original uid/gid on restored files",
+				cli.StringFlag{
+					Name:     "user",
+					Usage:    "require basic authentication with this username; the password is read from DUPLICACY_SERVE_PASSWORD or prompted for",
+					Argument: "<username>",
 				},
 				cli.BoolFlag{
-					Name:  "stats",
-					Usage: "show statistics during and after restore",
+					Name:  "http",
+					Usage: "serve plain HTTP (directory listings and downloads) only, without WebDAV",
 				},
-				cli.IntFlag{
-					Name:     "threads",
-					Value:    1,
-					Usage:    "number of downloading threads",
-					Argument: "<n>",
+				cli.StringFlag{
+					Name:     "tls-cert",
+					Usage:    "serve HTTPS with the certificate in the specified file",
+					Argument: "<file>",
 				},
-				cli.IntFlag{
-					Name:     "limit-rate",
-					Value:    0,
-					Usage:    "the maximum download rate (in kilobytes/sec)",
-					Argument: "<kB/s>",
+				cli.StringFlag{
+					Name:     "tls-key",
+					Usage:    "the private key of the HTTPS certificate",
+					Argument: "<file>",
 				},
 				cli.StringFlag{
 					Name:     "storage",
-					Usage:    "restore from the specified storage instead of the default one",
+					Usage:    "serve the snapshots in the specified storage",
 					Argument: "<storage name>",
 				},
 				cli.StringFlag{
@@ -1618,58 +4579,29 @@ func main() {
 					Usage:    "the RSA private key to decrypt file chunks",
 					Argument: "<private key>",
 				},
-				cli.BoolFlag{
-					Name:  "persist",
-					Usage: "continue processing despite chunk errors or existing files (without -overwrite), reporting any affected files",
-				},
 				cli.StringFlag{
 					Name:     "key-passphrase",
 					Usage:    "the passphrase to decrypt the RSA private key",
 					Argument: "<private key passphrase>",
 				},
 			},
-			Usage:     "Restore the repository to a previously saved snapshot",
-			ArgsUsage: "[--] [pattern] ...",
-			Action:    restoreRepository,
+			Usage:     "Serve the snapshots read-only over HTTP and WebDAV",
+			ArgsUsage: " ",
+			Action:    serveSnapshots,
 		},
 
 		{
-			Name: "list",
+			Name: "mount",
 			Flags: []cli.Flag{
-				cli.BoolFlag{
-					Name:  "all, a",
-					Usage: "list snapshots with any id",
-				},
-				cli.StringFlag{
-					Name:     "id",
-					Usage:    "list snapshots with the specified id rather than the default one",
-					Argument: "<snapshot id>",
-				},
-				cli.StringSliceFlag{
-					Name:     "r",
-					Usage:    "the revision number of the snapshot",
-					Argument: "<revision>",
-				},
 				cli.StringFlag{
-					Name:     "t",
-					Usage:    "list snapshots with the specified tag",
-					Argument: "<tag>",
-				},
-				cli.BoolFlag{
-					Name:  "files",
-					Usage: "print the file list in each snapshot",
-				},
-				cli.BoolFlag{
-					Name:  "chunks",
-					Usage: "print chunks in each snapshot or all chunks if no snapshot specified",
-				},
-				cli.BoolFlag{
-					Name:  "reset-passwords",
-					Usage: "take passwords from input rather than keychain/keyring",
+					Name:     "address",
+					Value:    "127.0.0.1:0",
+					Usage:    "serve the snapshots on the specified loopback address (a random port by default)",
+					Argument: "<address:port>",
 				},
 				cli.StringFlag{
 					Name:     "storage",
-					Usage:    "retrieve snapshots from the specified storage",
+					Usage:    "mount the snapshots in the specified storage",
 					Argument: "<storage name>",
 				},
 				cli.StringFlag{
@@ -1677,254 +4609,278 @@ func main() {
 					Usage:    "the RSA private key to decrypt file chunks",
 					Argument: "<private key>",
 				},
+				cli.StringFlag{
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
+				},
 			},
-			Usage:     "List snapshots",
-			ArgsUsage: " ",
-			Action:    listSnapshots,
+			Usage: "Make all snapshots browsable as a read-only WebDAV share, mapped to a drive on Windows " +
+				"(the first available drive letter if none is specified)",
+			ArgsUsage: "[<drive>]",
+			Action:    mountSnapshots,
 		},
+
 		{
-			Name: "check",
+			Name: "prune",
 			Flags: []cli.Flag{
-				cli.BoolFlag{
-					Name:  "all, a",
-					Usage: "check snapshots with any id",
-				},
 				cli.StringFlag{
 					Name:     "id",
-					Usage:    "check snapshots with the specified id rather than the default one",
+					Usage:    "delete snapshots with the specified id instead of the default one",
 					Argument: "<snapshot id>",
 				},
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "match against all snapshot IDs",
+				},
 				cli.StringSliceFlag{
 					Name:     "r",
-					Usage:    "the revision number of the snapshot",
+					Usage:    "delete snapshots with the specified revisions",
 					Argument: "<revision>",
 				},
-				cli.StringFlag{
+				cli.StringSliceFlag{
 					Name:     "t",
-					Usage:    "check snapshots with the specified tag",
+					Usage:    "delete snapshots with tags matching the patterns, e.g. nightly-*",
 					Argument: "<tag>",
 				},
+				cli.StringSliceFlag{
+					Name:     "keep-tag",
+					Usage:    "never delete snapshots with tags matching the pattern, e.g. release-*",
+					Argument: "<pattern>",
+				},
+				cli.StringSliceFlag{
+					Name:     "keep",
+					Usage:    "keep 1 snapshot every n days for snapshots older than m days; also accepts rules separated by commas with units, e.g. 1d:7,7d:4w,30d:12m",
+					Argument: "<n:m>",
+				},
 				cli.BoolFlag{
-					Name:  "fossils",
-					Usage: "search fossils if a chunk can't be found",
+					Name:  "explain",
+					Usage: "show which -keep rule keeps or deletes each revision without deleting anything (implies -dry-run)",
+				},
+				cli.StringFlag{
+					Name:     "keep-gfs",
+					Usage:    "keep the latest snapshot in each of the most recent periods, e.g. \"7 daily, 4 weekly, 12 monthly, 5 yearly\" or \"7d,4w,12m,5y\"",
+					Argument: "<policy>",
+				},
+				cli.StringFlag{
+					Name:     "target-size",
+					Usage:    "delete the oldest revisions until the chunks left take up less than the given size, e.g. 800G",
+					Argument: "<size>",
+				},
+				cli.IntFlag{
+					Name:     "keep-min",
+					Value:    1,
+					Usage:    "always keep the latest n revisions of each snapshot id when pruning to a target size",
+					Argument: "<n>",
+				},
+				cli.IntFlag{
+					Name:     "keep-last",
+					Usage:    "never delete the latest n revisions of any snapshot id, whatever the other options select",
+					Argument: "<n>",
 				},
 				cli.BoolFlag{
-					Name:  "resurrect",
-					Usage: "turn referenced fossils back into chunks",
+					Name:  "exhaustive",
+					Usage: "remove all unreferenced chunks (not just those referenced by deleted snapshots)",
 				},
 				cli.BoolFlag{
-					Name:  "files",
-					Usage: "verify the integrity of every file",
+					Name:  "full-listing",
+					Usage: "list all chunks and rebuild the chunk index instead of reading the change feed set by 'set -change-feed'",
 				},
 				cli.BoolFlag{
-					Name:  "chunks",
-					Usage: "verify the integrity of every chunk",
+					Name:  "exclusive",
+					Usage: "assume exclusive access to the storage (disable two-step fossil collection)",
 				},
 				cli.BoolFlag{
-					Name:  "stats",
-					Usage: "show deduplication statistics (imply -all and all revisions)",
+					Name:  "dry-run, d",
+					Usage: "show what would have been deleted and the space that would be reclaimed",
 				},
 				cli.BoolFlag{
-					Name:  "tabular",
-					Usage: "show tabular usage and deduplication statistics (imply -stats, -all, and all revisions)",
+					Name:  "delete-only",
+					Usage: "delete fossils previously collected (if deletable) and don't collect fossils",
 				},
-				cli.StringFlag{
-					Name:     "storage",
-					Usage:    "retrieve snapshots from the specified storage",
-					Argument: "<storage name>",
+				cli.BoolFlag{
+					Name:  "collect-only",
+					Usage: "identify and collect fossils, but don't delete fossils previously collected",
 				},
-				cli.StringFlag{
-					Name:     "key",
-					Usage:    "the RSA private key to decrypt file chunks",
-					Argument: "<private key>",
+				cli.StringSliceFlag{
+					Name:     "ignore",
+					Usage:    "ignore snapshots with the specified id when deciding if fossils can be deleted",
+					Argument: "<id>",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-lock",
+					Usage: "prune even if another client appears to be pruning the storage",
 				},
 				cli.StringFlag{
-					Name:     "key-passphrase",
-					Usage:    "the passphrase to decrypt the RSA private key",
-					Argument: "<private key passphrase>",
+					Name:     "storage",
+					Usage:    "prune snapshots from the specified storage",
+					Argument: "<storage name>",
 				},
 				cli.IntFlag{
 					Name:     "threads",
 					Value:    1,
-					Usage:    "number of threads used to verify chunks",
+					Usage:    "number of threads used to prune unreferenced chunks",
 					Argument: "<n>",
 				},
-				cli.BoolFlag{
-					Name:  "persist",
-					Usage: "continue processing despite chunk errors, reporting any affected (corrupted) files",
+				cli.IntFlag{
+					Name:     "lock-wait",
+					Usage:    "wait up to the specified number of seconds for another backup or prune in the repository to finish",
+					Argument: "<seconds>",
 				},
 			},
-			Usage:     "Check the integrity of snapshots",
+			Usage:     "Prune snapshots by revision, tag, or retention policy",
 			ArgsUsage: " ",
-			Action:    checkSnapshots,
+			Action:    pruneSnapshots,
 		},
+
 		{
-			Name: "cat",
+			Name: "pin",
 			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:     "id",
-					Usage:    "retrieve from the snapshot with the specified id",
-					Argument: "<snapshot id>",
-				},
-				cli.IntFlag{
+				cli.StringSliceFlag{
 					Name:     "r",
-					Usage:    "the revision number of the snapshot",
+					Usage:    "the revision number of the snapshot to pin or unpin",
 					Argument: "<revision>",
 				},
 				cli.StringFlag{
-					Name:     "storage",
-					Usage:    "retrieve the file from the specified storage",
-					Argument: "<storage name>",
+					Name:     "reason",
+					Usage:    "record why the revisions are pinned, e.g. a legal hold",
+					Argument: "<text>",
 				},
-				cli.StringFlag{
-					Name:     "key",
-					Usage:    "the RSA private key to decrypt file chunks",
-					Argument: "<private key>",
+				cli.BoolFlag{
+					Name:  "unpin",
+					Usage: "remove the pins so the revisions can be pruned again",
+				},
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "list the pinned revisions (of all snapshot ids if no id or revision is given)",
 				},
 				cli.StringFlag{
-					Name:     "key-passphrase",
-					Usage:    "the passphrase to decrypt the RSA private key",
-					Argument: "<private key passphrase>",
+					Name:     "storage",
+					Usage:    "pin snapshots in the specified storage",
+					Argument: "<storage name>",
 				},
 			},
-			Usage:     "Print to stdout the specified file, or the snapshot content if no file is specified",
-			ArgsUsage: "[<file>]",
-			Action:    printFile,
+			Usage:     "Pin revisions so that prune never deletes them",
+			ArgsUsage: "[<snapshot id>]",
+			Action:    pinSnapshots,
 		},
 
 		{
-			Name: "diff",
+			Name: "tag",
 			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:     "id",
-					Usage:    "diff snapshots with the specified id",
-					Argument: "<snapshot id>",
-				},
-				cli.IntSliceFlag{
+				cli.StringSliceFlag{
 					Name:     "r",
-					Usage:    "the revision number of the snapshot",
+					Usage:    "the revision number of the snapshot to tag",
 					Argument: "<revision>",
 				},
-				cli.BoolFlag{
-					Name:  "hash",
-					Usage: "compute the hashes of on-disk files",
+				cli.StringSliceFlag{
+					Name:     "add",
+					Usage:    "add the tag to the revisions (can be specified multiple times)",
+					Argument: "<tag>",
+				},
+				cli.StringSliceFlag{
+					Name:     "remove",
+					Usage:    "remove the tags matching the pattern from the revisions (can be specified multiple times)",
+					Argument: "<pattern>",
 				},
 				cli.StringFlag{
 					Name:     "storage",
-					Usage:    "retrieve files from the specified storage",
+					Usage:    "tag snapshots in the specified storage",
 					Argument: "<storage name>",
 				},
-				cli.StringFlag{
-					Name:     "key",
-					Usage:    "the RSA private key to decrypt file chunks",
-					Argument: "<private key>",
-				},
-				cli.StringFlag{
-					Name:     "key-passphrase",
-					Usage:    "the passphrase to decrypt the RSA private key",
-					Argument: "<private key passphrase>",
-				},
 			},
-			Usage:     "Compare two snapshots or two revisions of a file",
-			ArgsUsage: "[<file>]",
-			Action:    diff,
+			Usage:     "Add or remove tags of existing revisions",
+			ArgsUsage: "[<snapshot id>]",
+			Action:    tagSnapshots,
 		},
 
 		{
-			Name: "history",
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:     "id",
-					Usage:    "find the file in the snapshot with the specified id",
-					Argument: "<snapshot id>",
-				},
+			Name: "annotate",
+			Flags: []cli.Flag{
 				cli.StringSliceFlag{
 					Name:     "r",
-					Usage:    "show history of the specified revisions",
+					Usage:    "the revision number of the snapshot to annotate",
 					Argument: "<revision>",
 				},
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "annotate snapshots with the specified id instead of the default one",
+					Argument: "<snapshot id>",
+				},
 				cli.BoolFlag{
-					Name:  "hash",
-					Usage: "show the hash of the on-disk file",
+					Name:  "clear",
+					Usage: "remove the notes of the revisions",
 				},
 				cli.StringFlag{
 					Name:     "storage",
-					Usage:    "retrieve files from the specified storage",
+					Usage:    "annotate snapshots in the specified storage",
 					Argument: "<storage name>",
 				},
 			},
-			Usage:     "Show the history of a file",
-			ArgsUsage: "<file>",
-			Action:    showHistory,
+			Usage:     "Attach a note to existing revisions, replacing any previous note",
+			ArgsUsage: "<note>",
+			Action:    annotateSnapshots,
 		},
 
 		{
-			Name: "prune",
+			Name: "purge",
 			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:     "filter",
+					Usage:    "purge files matching the pattern, in the same format as the filters file (can be specified multiple times)",
+					Argument: "<pattern>",
+				},
 				cli.StringFlag{
 					Name:     "id",
-					Usage:    "delete snapshots with the specified id instead of the default one",
+					Usage:    "purge files from snapshots with the specified id instead of the default one",
 					Argument: "<snapshot id>",
 				},
 				cli.BoolFlag{
 					Name:  "all, a",
-					Usage: "match against all snapshot IDs",
+					Usage: "purge files from snapshots with any id",
 				},
 				cli.StringSliceFlag{
 					Name:     "r",
-					Usage:    "delete snapshots with the specified revisions",
+					Usage:    "purge files only from the specified revisions",
 					Argument: "<revision>",
 				},
-				cli.StringSliceFlag{
-					Name:     "t",
-					Usage:    "delete snapshots with the specified tags",
-					Argument: "<tag>",
-				},
-				cli.StringSliceFlag{
-					Name:     "keep",
-					Usage:    "keep 1 snapshot every n days for snapshots older than m days",
-					Argument: "<n:m>",
-				},
-				cli.BoolFlag{
-					Name:  "exhaustive",
-					Usage: "remove all unreferenced chunks (not just those referenced by deleted snapshots)",
-				},
-				cli.BoolFlag{
-					Name:  "exclusive",
-					Usage: "assume exclusive access to the storage (disable two-step fossil collection)",
-				},
 				cli.BoolFlag{
 					Name:  "dry-run, d",
-					Usage: "show what would have been deleted",
+					Usage: "show the files that would be purged without changing the storage",
 				},
 				cli.BoolFlag{
-					Name:  "delete-only",
-					Usage: "delete fossils previously collected (if deletable) and don't collect fossils",
+					Name:  "exclusive",
+					Usage: "delete the chunks no longer referenced immediately, assuming no other client is using the storage",
 				},
 				cli.BoolFlag{
-					Name:  "collect-only",
-					Usage: "identify and collect fossils, but don't delete fossils previously collected",
+					Name:  "ignore-lock",
+					Usage: "remove the chunks even if another client holds the prune lock",
 				},
-				cli.StringSliceFlag{
-					Name:     "ignore",
-					Usage:    "ignore snapshots with the specified id when deciding if fossils can be deleted",
-					Argument: "<id>",
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks shared by purged and other files",
+					Argument: "<private key>",
 				},
 				cli.StringFlag{
-					Name:     "storage",
-					Usage:    "prune snapshots from the specified storage",
-					Argument: "<storage name>",
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
 				},
 				cli.IntFlag{
 					Name:     "threads",
 					Value:    1,
-					Usage:    "number of threads used to prune unreferenced chunks",
+					Usage:    "number of threads used to download and upload chunks",
 					Argument: "<n>",
 				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "purge files from snapshots in the specified storage",
+					Argument: "<storage name>",
+				},
 			},
-			Usage:     "Prune snapshots by revision, tag, or retention policy",
+			Usage:     "Remove files from existing revisions, e.g. files backed up by mistake",
 			ArgsUsage: " ",
-			Action:    pruneSnapshots,
+			Action:    purgeFiles,
 		},
 
 		{
@@ -1946,6 +4902,65 @@ func main() {
 			Action:    changePassword,
 		},
 
+		{
+			Name:  "key",
+			Usage: "Manage the RSA key pair used to encrypt file chunks",
+			Subcommands: []cli.Command{
+				{
+					Name: "rotate",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "key",
+							Usage:    "the current RSA private key",
+							Argument: "<private key>",
+						},
+						cli.StringFlag{
+							Name:     "key-passphrase",
+							Usage:    "the passphrase to decrypt the current RSA private key",
+							Argument: "<private key passphrase>",
+						},
+						cli.StringFlag{
+							Name:     "new-key",
+							Usage:    "the new RSA public key",
+							Argument: "<public key>",
+						},
+						cli.StringFlag{
+							Name:     "storage",
+							Usage:    "rotate the key of the specified storage",
+							Argument: "<storage name>",
+						},
+						cli.IntFlag{
+							Name:     "threads",
+							Value:    1,
+							Usage:    "number of threads used to re-wrap chunks",
+							Argument: "<n>",
+						},
+						cli.IntFlag{
+							Name:     "iterations",
+							Usage:    "the number of iterations used in storage key derivation (default is 16384)",
+							Argument: "<i>",
+						},
+					},
+					Usage:     "Re-wrap file chunks under a new RSA public key (run again if interrupted)",
+					ArgsUsage: " ",
+					Action:    rotateKey,
+				},
+			},
+		},
+
+		{
+			Name:  "filters",
+			Usage: "Debug the include/exclude patterns",
+			Subcommands: []cli.Command{
+				{
+					Name:      "test",
+					Usage:     "Show whether each path would be backed up, and the pattern that decides it",
+					ArgsUsage: "<path>...",
+					Action:    testFilters,
+				},
+			},
+		},
+
 		{
 			Name: "add",
 			Flags: []cli.Flag{
@@ -1993,11 +5008,20 @@ func main() {
 					Usage:    "the RSA public key to encrypt file chunks",
 					Argument: "<public key>",
 				},
+				cli.StringFlag{
+					Name:     "kms",
+					Usage:    "wrap the storage key with vault://<mount>/<key>, awskms://<key>, or gcpkms://<key name>",
+					Argument: "<uri>",
+				},
 				cli.StringFlag{
 					Name:     "erasure-coding",
 					Usage:    "enable erasure coding to protect against storage corruption",
 					Argument: "<data shards>:<parity shards>",
 				},
+				cli.BoolFlag{
+					Name:  "random-chunk-keys",
+					Usage: "encrypt every chunk with a random key instead of a key derived from the chunk hash",
+				},
 			},
 			Usage:     "Add an additional storage to be used for the existing repository",
 			ArgsUsage: "<storage name> <snapshot id> <storage url>",
@@ -2037,12 +5061,139 @@ func main() {
 					Argument: "<file name>",
 					Value:    "",
 				},
+				cli.GenericFlag{
+					Name:  "exclude-caches",
+					Usage: "Directories containing a valid CACHEDIR.TAG file will not be backed up",
+					Value: &TriBool{},
+					Arg:   "true",
+				},
+				cli.StringSliceFlag{
+					Name:     "exclude-if-present",
+					Usage:    "Directories containing a file with this name will not be backed up (can be specified multiple times; an empty name clears the list)",
+					Argument: "<file name>",
+				},
+				cli.StringSliceFlag{
+					Name:     "root",
+					Usage:    "back up the directory <path> as <name> at the repository root (can be specified multiple times; replaces the current roots, and an empty value removes all)",
+					Argument: "<name>=<path>",
+				},
 				cli.GenericFlag{
 					Name:  "exclude-by-attribute",
 					Usage: "Exclude files based on file attributes. (macOS only, com_apple_backup_excludeItem)",
 					Value: &TriBool{},
 					Arg:   "true",
 				},
+				cli.StringFlag{
+					Name:     "snapshot-method",
+					Usage:    "how to create the snapshot for backup -vss on Linux: auto, lvm, btrfs, zfs, or none",
+					Argument: "<method>",
+				},
+				cli.StringFlag{
+					Name:     "snapshot-size",
+					Usage:    "the size of a non-thin LVM snapshot, such as 10G or 20%ORIGIN (default 10%ORIGIN)",
+					Argument: "<size>",
+				},
+				cli.StringFlag{
+					Name:     "keyring",
+					Usage:    "where to save passwords: system (Keychain, Credential Manager, or Secret Service), file (Windows only), none, or default; saved passwords are asked for again after a change",
+					Argument: "<keyring>",
+				},
+				cli.StringFlag{
+					Name:     "password-command",
+					Usage:    "the command printing the password or key named by the DUPLICACY_PASSWORD_TYPE environment variable, such as 'pass show duplicacy/$DUPLICACY_PASSWORD_TYPE' (an empty command removes it)",
+					Argument: "<command>",
+				},
+				cli.StringFlag{
+					Name:     "change-feed",
+					Usage:    "make check and prune list chunks from a local index updated by this S3 inventory (<bucket>/<prefix>, where the manifests are delivered) or directory of B2 event notifications saved by a webhook receiver (an empty location disables it)",
+					Argument: "<location>",
+				},
+				cli.StringFlag{
+					Name:     "retry",
+					Usage:    "override the retry policy of a B2, S3, SFTP or WebDAV storage, such as 'attempts=8,delay=1,max-delay=60,jitter=0.5,budget.upload=100', where the budget of each operation class (list, download, upload, delete, or other) limits its retries for the whole run (an empty policy restores the defaults)",
+					Argument: "<policy>",
+				},
+				cli.StringFlag{
+					Name:     "network",
+					Usage:    "control how a B2, S3, Wasabi, SFTP, WebDAV, OneDrive, Hubic, ACD or File Fabric storage connects, such as 'ip=4,fallback-delay=100ms,resolver=1.1.1.1,pin.api.backblazeb2.com=104.153.233.177', where ip is 4, 6 or any, fallback-delay is how long a connection is tried before the other IP version is tried too (or off), and resolver and pin can be repeated (empty options restore the defaults)",
+					Argument: "<options>",
+				},
+				cli.StringFlag{
+					Name:     "cache-size",
+					Usage:    "limit the snapshot cache to this size, such as 500M, by removing the least recently used chunks (an empty size removes the limit)",
+					Argument: "<size>",
+				},
+				cli.StringFlag{
+					Name:     "hook",
+					Usage:    "set the command for pre-backup, post-backup, pre-restore, or post-restore with the -hook-command option",
+					Argument: "<phase>",
+				},
+				cli.StringFlag{
+					Name:     "hook-command",
+					Usage:    "the command run by the shell for the hook (an empty command removes the hook)",
+					Argument: "<command>",
+				},
+				cli.StringFlag{
+					Name:     "hook-on-failure",
+					Usage:    "abort the operation or only warn if the hook fails (default abort for pre hooks and warn for post hooks)",
+					Argument: "<abort|warn>",
+				},
+				cli.StringFlag{
+					Name:     "notify-webhook",
+					Usage:    "post the result of every command to the url as JSON (an empty url removes the webhook)",
+					Argument: "<url>",
+				},
+				cli.StringFlag{
+					Name:     "notify-webhook-template",
+					Usage:    "the text/template in the file that produces the JSON payload of the webhook",
+					Argument: "<file>",
+				},
+				cli.StringSliceFlag{
+					Name:     "notify-webhook-header",
+					Usage:    "add a header to the webhook request (can be specified multiple times)",
+					Argument: "<name:value>",
+				},
+				cli.StringFlag{
+					Name:     "notify-healthchecks",
+					Usage:    "ping the start, success, and fail endpoints of the healthchecks.io url (an empty url removes it)",
+					Argument: "<url>",
+				},
+				cli.StringSliceFlag{
+					Name:     "notify-email",
+					Usage:    "email the result of every command to the address (can be specified multiple times; an empty address removes the email)",
+					Argument: "<address>",
+				},
+				cli.StringFlag{
+					Name:     "notify-email-from",
+					Usage:    "the sender of the email",
+					Argument: "<address>",
+				},
+				cli.StringFlag{
+					Name:     "notify-smtp",
+					Usage:    "the SMTP server to send the email through",
+					Argument: "<host:port>",
+				},
+				cli.StringFlag{
+					Name:     "notify-smtp-username",
+					Usage:    "the username for the SMTP server",
+					Argument: "<username>",
+				},
+				cli.StringFlag{
+					Name:     "notify-smtp-password",
+					Usage:    "the password for the SMTP server",
+					Argument: "<password>",
+				},
+				cli.GenericFlag{
+					Name:  "notify-report",
+					Usage: "upload a signed report of every command to the storage, to be shown by the fleet-status command",
+					Value: &TriBool{},
+					Arg:   "true",
+				},
+				cli.StringFlag{
+					Name:     "notify-on",
+					Usage:    "send the webhook and the email always (the default), or only on success or on failure",
+					Argument: "<always|success|failure>",
+				},
 				cli.StringFlag{
 					Name:  "key",
 					Usage: "add a key/password whose value is supplied by the -value option",
@@ -2113,6 +5264,14 @@ func main() {
 					Usage:    "number of downloading threads",
 					Argument: "<n>",
 				},
+				cli.BoolFlag{
+					Name:  "sync",
+					Usage: "also copy the revisions missing from the source storage back to it and report divergent revisions",
+				},
+				cli.BoolFlag{
+					Name:  "skip-existing-verify",
+					Usage: "trust the destination listing and copy missing chunks without looking each one up first",
+				},
 				cli.StringFlag{
 					Name:     "key",
 					Usage:    "the RSA private key to decrypt file chunks from the source storage",
@@ -2129,6 +5288,99 @@ func main() {
 			Action:    copySnapshots,
 		},
 
+		{
+			Name: "export",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "id",
+					Usage:    "export snapshots with the specified id instead of the default one",
+					Argument: "<snapshot id>",
+				},
+				cli.StringSliceFlag{
+					Name:     "r",
+					Usage:    "the revision number of the snapshot to export",
+					Argument: "<revision>",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "export snapshots from the specified storage",
+					Argument: "<storage name>",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of threads used to download and write chunks",
+					Argument: "<n>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks",
+					Argument: "<private key>",
+				},
+				cli.StringFlag{
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
+				},
+			},
+			Usage:     "Export revisions and the chunks they reference into a bundle directory",
+			ArgsUsage: "<bundle directory>",
+			Action:    exportSnapshots,
+		},
+
+		{
+			Name: "import",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "import snapshots into the specified storage",
+					Argument: "<storage name>",
+				},
+				cli.IntFlag{
+					Name:     "threads",
+					Value:    1,
+					Usage:    "number of threads used to read and upload chunks",
+					Argument: "<n>",
+				},
+				cli.StringFlag{
+					Name:     "key",
+					Usage:    "the RSA private key to decrypt file chunks in the bundle",
+					Argument: "<private key>",
+				},
+				cli.StringFlag{
+					Name:     "key-passphrase",
+					Usage:    "the passphrase to decrypt the RSA private key",
+					Argument: "<private key passphrase>",
+				},
+			},
+			Usage:     "Import the revisions in a bundle directory into a compatible storage",
+			ArgsUsage: "<bundle directory>",
+			Action:    importSnapshots,
+		},
+
+		{
+			Name: "cache",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "show or purge only the snapshot cache of the specified storage",
+					Argument: "<storage name>",
+				},
+				cli.StringFlag{
+					Name:     "purge",
+					Usage:    "remove the cached chunks, the cached snapshot files, or everything",
+					Argument: "<chunks|snapshots|all>",
+				},
+				cli.BoolFlag{
+					Name:  "trim",
+					Usage: "remove the least recently used chunks now from caches larger than their size limit",
+				},
+			},
+			Usage:     "Show the disk space used by the snapshot caches and purge them",
+			ArgsUsage: " ",
+			Action:    manageCache,
+		},
+
 		{
 			Name: "info",
 			Flags: []cli.Flag{
@@ -2150,12 +5402,40 @@ func main() {
 					Name:  "reset-passwords",
 					Usage: "take passwords from input rather than keychain/keyring",
 				},
+				cli.BoolFlag{
+					Name:  "usage",
+					Usage: "show the chunks and bytes owned exclusively by each snapshot id and those shared with other snapshot ids",
+				},
 			},
 			Usage:     "Show the information about the specified storage",
 			ArgsUsage: "<storage url>",
 			Action:    infoStorage,
 		},
 
+		{
+			Name: "fleet-status",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:     "stale",
+					Value:    2,
+					Usage:    "warn about snapshot ids without a successful backup in this many days",
+					Argument: "<days>",
+				},
+				cli.BoolFlag{
+					Name:  "reset-passwords",
+					Usage: "take passwords from input rather than keychain/keyring",
+				},
+				cli.StringFlag{
+					Name:     "storage",
+					Usage:    "read the run reports from the specified storage instead of the default one",
+					Argument: "<storage name>",
+				},
+			},
+			Usage:     "Show when each host last ran a command and backed up, from the run reports in the storage",
+			ArgsUsage: " ",
+			Action:    showFleetStatus,
+		},
+
 		{
 			Name: "benchmark",
 			Flags: []cli.Flag{
@@ -2166,7 +5446,7 @@ func main() {
 				},
 				cli.IntFlag{
 					Name:     "chunk-count",
-					Usage:    "the number of chunks to upload and download (default to 64)",
+					Usage:    "the number of chunks to upload and download (default to 64, or 32 per combination with -latency)",
 					Argument: "<count>",
 				},
 				cli.IntFlag{
@@ -2189,6 +5469,22 @@ func main() {
 					Usage:    "run the download/upload test agaist the specified storage",
 					Argument: "<storage name>",
 				},
+				cli.BoolFlag{
+					Name:  "latency",
+					Usage: "measure the latency percentiles of uploads, downloads, lists, and deletes at each object size and thread count, and recommend the threads and the chunk size",
+				},
+				cli.StringFlag{
+					Name:     "object-sizes",
+					Value:    "256K,1M,4M,16M",
+					Usage:    "the object sizes tested with -latency",
+					Argument: "<size,...>",
+				},
+				cli.StringFlag{
+					Name:     "thread-counts",
+					Value:    "1,4,16",
+					Usage:    "the thread counts tested with -latency",
+					Argument: "<n,...>",
+				},
 			},
 			Usage:     "Run a set of benchmarks to test download and upload speeds",
 			ArgsUsage: " ",
@@ -2221,10 +5517,16 @@ func main() {
 			Name:  "background",
 			Usage: "read passwords, tokens, or keys only from keychain/keyring or env",
 		},
+		cli.StringFlag{
+			Name:     "debug-listen",
+			Value:    "",
+			Usage:    "serve pprof profiles and execution traces on the specified address:port",
+			Argument: "<address:port>",
+		},
 		cli.StringFlag{
 			Name:     "profile",
 			Value:    "",
-			Usage:    "enable the profiling tool and listen on the specified address:port",
+			Usage:    "same as -debug-listen (deprecated)",
 			Argument: "<address:port>",
 		},
 		cli.StringFlag{
@@ -2236,6 +5538,54 @@ func main() {
 			Usage:    "suppress logs with the specified id",
 			Argument: "<id>",
 		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output logs, progress, and results as JSON records, one per line",
+		},
+		cli.StringFlag{
+			Name:     "log-level",
+			Usage:    "set the logging levels of subsystems, such as b2client=debug,chunkuploader=info; a level without a subsystem applies to all others",
+			Argument: "<levels>",
+		},
+		cli.BoolFlag{
+			Name:  "no-notify",
+			Usage: "do not send the notifications configured for the storage",
+		},
+		cli.BoolFlag{
+			Name:  "no-progress",
+			Usage: "do not show progress bars when the output is a terminal",
+		},
+		cli.StringFlag{
+			Name:     "log-file",
+			Usage:    "also write the logs with timestamps to the specified file",
+			Argument: "<file>",
+		},
+		cli.StringFlag{
+			Name:     "error-log-file",
+			Usage:    "also write the errors to the specified file",
+			Argument: "<file>",
+		},
+		cli.StringFlag{
+			Name:     "log-max-size",
+			Value:    "10M",
+			Usage:    "rotate the log files once they reach the specified size; 0 disables size-based rotation",
+			Argument: "<size>",
+		},
+		cli.IntFlag{
+			Name:     "log-max-age",
+			Usage:    "rotate the log files once they are older than the specified number of days",
+			Argument: "<days>",
+		},
+		cli.IntFlag{
+			Name:     "log-keep",
+			Value:    5,
+			Usage:    "keep the specified number of rotated log files; 0 keeps all of them",
+			Argument: "<n>",
+		},
+		cli.BoolFlag{
+			Name:  "log-compress",
+			Usage: "compress the rotated log files with gzip",
+		},
 	}
 
 	app.HideVersion = true
@@ -2247,22 +5597,49 @@ func main() {
 	// Exit with code 2 if an invalid command is provided
 	app.CommandNotFound = func(context *cli.Context, command string) {
 		fmt.Fprintf(context.App.Writer, "Invalid command: %s\n", command)
-		os.Exit(2)
+		os.Exit(duplicacy.CommandExitCode)
 	}
 
-	// If the program is interrupted, call the RunAtError function.
+	cli.AppHelpTemplate += "EXIT CODES:\n" + duplicacy.GetExitCodeHelp()
+
+	// If the program is interrupted or terminated, cancel the operation so that chunk transfers stop and the
+	// incomplete snapshot is saved.  If the operation doesn't stop in time, or on a second signal, call the RunAtError
+	// function and exit.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for range c {
-			duplicacy.RunAtError()
-			os.Exit(1)
+		<-c
+		duplicacy.LOG_WARN("INTERRUPTED", "Stopping the operation; interrupt again to exit immediately")
+		duplicacy.CancelOperation()
+		select {
+		case <-c:
+		case <-time.After(InterruptGracePeriod):
 		}
+		duplicacy.RunAtError()
+		interrupted := &duplicacy.Exception{Level: duplicacy.ERROR, LogID: "INTERRUPTED",
+			Message: "The program was interrupted"}
+		duplicacy.EmitJSONResult(false, interrupted)
+		duplicacy.SendNotifications(false, interrupted)
+		os.Exit(duplicacy.InterruptedExitCode)
 	}()
 
-	err := app.Run(os.Args)
+	if len(os.Args) > 1 && os.Args[1] == completeCommand {
+		runCompletion(app, os.Args[2:])
+		return
+	}
+
+	defaults, err := duplicacy.LoadDefaults(duplicacy.GetDefaultsFilePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the defaults file: %v\n", err)
+	}
+	duplicacy.SetDefaultFiltersFile(defaults.GetPreference("filters"))
+
+	err = app.Run(applyDefaults(app, os.Args, defaults))
 	if err != nil {
-		os.Exit(2)
+		os.Exit(duplicacy.CommandExitCode)
 	}
+	duplicacy.EmitJSONResult(true, nil)
+	duplicacy.SendNotifications(true, nil)
+	os.Exit(duplicacy.GetExitCode())
 
 }
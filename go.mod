@@ -16,7 +16,7 @@ require (
 	github.com/gilbertchen/cli v1.2.1-0.20160223210219-1de0a1836ce9
 	github.com/gilbertchen/go-dropbox v0.0.0-20201103213208-2233fa1dd846
 	github.com/gilbertchen/go-ole v1.2.0
-	github.com/gilbertchen/go.dbus v0.0.0-20190607191240-8591994fa32f // indirect
+	github.com/gilbertchen/go.dbus v0.0.0-20190607191240-8591994fa32f
 	github.com/gilbertchen/goamz v0.0.0-20170712012135-eada9f4e8cc2
 	github.com/gilbertchen/gopass v0.0.0-20170109162249-bf9dde6d0d2c
 	github.com/gilbertchen/keyring v0.0.0-20170923175943-8855f5632086
@@ -43,7 +43,8 @@ require (
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20200822124328-c89045814202
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
-	golang.org/x/sys v0.0.0-20200409092240-59c9f1ba88fa // indirect
+	golang.org/x/sys v0.0.0-20200409092240-59c9f1ba88fa
+	golang.org/x/text v0.3.2
 	golang.org/x/tools v0.0.0-20200925191224-5d1fdd8fa346 // indirect
 	google.golang.org/api v0.21.0
 	google.golang.org/appengine v1.6.5 // indirect
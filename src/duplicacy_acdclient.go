@@ -6,6 +6,7 @@ package duplicacy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -41,6 +42,9 @@ type ACDClient struct {
 	MetadataURL string
 
 	TestMode bool
+
+	// Returns the context of the requests; the context of the running operation is used if it is nil
+	ContextFunction func() context.Context
 }
 
 func NewACDClient(tokenFile string) (*ACDClient, error) {
@@ -56,7 +60,7 @@ func NewACDClient(tokenFile string) (*ACDClient, error) {
 	}
 
 	client := &ACDClient{
-		HTTPClient: http.DefaultClient,
+		HTTPClient: newStorageHTTPClient(),
 		TokenFile:  tokenFile,
 		Token:      token,
 		TokenLock:  &sync.Mutex{},
@@ -95,7 +99,7 @@ func (client *ACDClient) call(url string, method string, input interface{}, cont
 			inputReader = input.(*RateLimitedReader)
 		}
 
-		request, err := http.NewRequest(method, url, inputReader)
+		request, err := http.NewRequestWithContext(getRequestContext(client.ContextFunction), method, url, inputReader)
 		if err != nil {
 			return nil, 0, err
 		}
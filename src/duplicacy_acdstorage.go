@@ -35,6 +35,7 @@ func CreateACDStorage(tokenFile string, storagePath string, threads int) (storag
 		idCacheLock:     &sync.Mutex{},
 		numberOfThreads: threads,
 	}
+	client.ContextFunction = storage.GetContext
 
 	storagePathID, err := storage.getIDFromPath(0, storagePath, false)
 	if err != nil {
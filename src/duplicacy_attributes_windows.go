@@ -0,0 +1,321 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// On Windows, the file attributes, the security descriptor, and the alternate data streams are stored as entry
+// attributes with these names.  A stream is stored under the stream attribute prefix followed by the stream name.
+const (
+	windowsFileAttributes    = "windows:attributes"
+	windowsSecurity          = "windows:security"
+	windowsStreamPrefix      = "windows:stream:"
+	maximumAlternateDataSize = 1024 * 1024
+)
+
+// Only these attributes are restored; others, such as the archive bit, are maintained by the file system.
+const windowsAttributeMask = syscall.FILE_ATTRIBUTE_READONLY | syscall.FILE_ATTRIBUTE_HIDDEN |
+	syscall.FILE_ATTRIBUTE_SYSTEM | FILE_ATTRIBUTE_NOT_CONTENT_INDEXED | FILE_ATTRIBUTE_COMPRESSED
+
+const (
+	FILE_ATTRIBUTE_COMPRESSED          = 0x00000800
+	FILE_ATTRIBUTE_NOT_CONTENT_INDEXED = 0x00002000
+	FILE_WRITE_ATTRIBUTES              = 0x00000100
+
+	OWNER_SECURITY_INFORMATION = 0x00000001
+	GROUP_SECURITY_INFORMATION = 0x00000002
+	DACL_SECURITY_INFORMATION  = 0x00000004
+	SACL_SECURITY_INFORMATION  = 0x00000008
+
+	ERROR_PRIVILEGE_NOT_HELD   = 1314
+	FSCTL_SET_COMPRESSION      = 0x0009C040
+	COMPRESSION_FORMAT_DEFAULT = 1
+)
+
+var (
+	modAdvapi32 = syscall.NewLazyDLL("advapi32.dll")
+	modKernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procGetFileSecurity       = modAdvapi32.NewProc("GetFileSecurityW")
+	procSetFileSecurity       = modAdvapi32.NewProc("SetFileSecurityW")
+	procLookupPrivilegeValue  = modAdvapi32.NewProc("LookupPrivilegeValueW")
+	procAdjustTokenPrivileges = modAdvapi32.NewProc("AdjustTokenPrivileges")
+	procFindFirstStream       = modKernel32.NewProc("FindFirstStreamW")
+	procFindNextStream        = modKernel32.NewProc("FindNextStreamW")
+)
+
+type win32FindStreamData struct {
+	StreamSize int64
+	StreamName [syscall.MAX_PATH + 36]uint16
+}
+
+// LUID is made of two 32-bit integers so that it is 4-byte aligned as in the Windows headers
+type luidAndAttributes struct {
+	LuidLowPart  uint32
+	LuidHighPart int32
+	Attributes   uint32
+}
+
+type tokenPrivileges struct {
+	PrivilegeCount uint32
+	Privileges     [1]luidAndAttributes
+}
+
+var enablePrivilegesOnce sync.Once
+
+// enablePrivileges enables, if the process holds them, the privileges needed to read and write the owner and the
+// system access control list of files that the user may not have access to.
+func enablePrivileges() {
+	var token syscall.Token
+	process, _ := syscall.GetCurrentProcess()
+	err := syscall.OpenProcessToken(process, syscall.TOKEN_ADJUST_PRIVILEGES|syscall.TOKEN_QUERY, &token)
+	if err != nil {
+		LOG_DEBUG("ATTR_PRIVILEGE", "Failed to open the process token: %v", err)
+		return
+	}
+	defer token.Close()
+
+	for _, name := range []string{"SeBackupPrivilege", "SeRestorePrivilege", "SeSecurityPrivilege"} {
+		var privileges tokenPrivileges
+		r, _, err := procLookupPrivilegeValue.Call(0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(name))),
+			uintptr(unsafe.Pointer(&privileges.Privileges[0].LuidLowPart)))
+		if r == 0 {
+			LOG_DEBUG("ATTR_PRIVILEGE", "Failed to look up %s: %v", name, err)
+			continue
+		}
+		privileges.PrivilegeCount = 1
+		privileges.Privileges[0].Attributes = 2 // SE_PRIVILEGE_ENABLED
+		procAdjustTokenPrivileges.Call(uintptr(token), 0, uintptr(unsafe.Pointer(&privileges)), 0, 0, 0)
+	}
+}
+
+// getFileSecurity returns the security descriptor of the file, prefixed with the security information flags that
+// describe which parts were retrieved.  The SACL is only included when the privilege to read it is held.
+func getFileSecurity(fullPath string) ([]byte, error) {
+
+	path := syscall.StringToUTF16Ptr(fullPath)
+	for _, information := range []uint32{
+		OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION | DACL_SECURITY_INFORMATION | SACL_SECURITY_INFORMATION,
+		OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION | DACL_SECURITY_INFORMATION,
+	} {
+		var needed uint32
+		procGetFileSecurity.Call(uintptr(unsafe.Pointer(path)), uintptr(information), 0, 0,
+			uintptr(unsafe.Pointer(&needed)))
+		if needed == 0 {
+			continue
+		}
+
+		descriptor := make([]byte, 4+needed)
+		binary.LittleEndian.PutUint32(descriptor, information)
+		r, _, err := procGetFileSecurity.Call(uintptr(unsafe.Pointer(path)), uintptr(information),
+			uintptr(unsafe.Pointer(&descriptor[4])), uintptr(needed), uintptr(unsafe.Pointer(&needed)))
+		if r != 0 {
+			return descriptor, nil
+		}
+		if errno, ok := err.(syscall.Errno); !ok || errno != ERROR_PRIVILEGE_NOT_HELD {
+			return nil, err
+		}
+	}
+	return nil, syscall.Errno(ERROR_PRIVILEGE_NOT_HELD)
+}
+
+// listAlternateDataStreams returns the names and sizes of the alternate data streams of the file.  The unnamed
+// stream containing the file content is not included.
+func listAlternateDataStreams(fullPath string) (names []string, sizes []int64) {
+
+	var data win32FindStreamData
+	handle, _, _ := procFindFirstStream.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(fullPath))), 0,
+		uintptr(unsafe.Pointer(&data)), 0)
+	if syscall.Handle(handle) == syscall.InvalidHandle {
+		return nil, nil
+	}
+	defer syscall.FindClose(syscall.Handle(handle))
+
+	for {
+		// Stream names are in the form of :name:$DATA
+		name := strings.TrimSuffix(strings.TrimPrefix(syscall.UTF16ToString(data.StreamName[:]), ":"), ":$DATA")
+		if name != "" && name != ":$DATA" {
+			names = append(names, name)
+			sizes = append(sizes, data.StreamSize)
+		}
+
+		r, _, _ := procFindNextStream.Call(handle, uintptr(unsafe.Pointer(&data)))
+		if r == 0 {
+			break
+		}
+	}
+	return names, sizes
+}
+
+func (entry *Entry) ReadAttributes(top string) {
+
+	if entry.IsLink() {
+		return
+	}
+
+	enablePrivilegesOnce.Do(enablePrivileges)
+	fullPath := joinRootPath(top, entry.Path)
+	attributes := make(map[string][]byte)
+
+	fileAttributes, err := syscall.GetFileAttributes(syscall.StringToUTF16Ptr(fullPath))
+	if err == nil && fileAttributes&windowsAttributeMask != 0 {
+		value := make([]byte, 4)
+		binary.LittleEndian.PutUint32(value, fileAttributes&windowsAttributeMask)
+		attributes[windowsFileAttributes] = value
+	}
+
+	var data syscall.Win32FileAttributeData
+	err = syscall.GetFileAttributesEx(syscall.StringToUTF16Ptr(fullPath), syscall.GetFileExInfoStandard,
+		(*byte)(unsafe.Pointer(&data)))
+	if err == nil && data.CreationTime.Nanoseconds() > 0 {
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, uint64(data.CreationTime.Nanoseconds()))
+		attributes[birthTimeAttribute] = value
+	}
+
+	descriptor, err := getFileSecurity(fullPath)
+	if err != nil {
+		LOG_DEBUG("ATTR_SECURITY", "Failed to read the security descriptor of %s: %v", entry.Path, err)
+	} else {
+		attributes[windowsSecurity] = descriptor
+	}
+
+	names, sizes := listAlternateDataStreams(fullPath)
+	for i, name := range names {
+		if sizes[i] > maximumAlternateDataSize {
+			LOG_WARN("ATTR_STREAM", "The alternate data stream %s of %s is too large (%d bytes) and is not included",
+				name, entry.Path, sizes[i])
+			continue
+		}
+		content, err := ioutil.ReadFile(fullPath + ":" + name)
+		if err != nil {
+			LOG_WARN("ATTR_STREAM", "Failed to read the alternate data stream %s of %s: %v", name, entry.Path, err)
+			continue
+		}
+		attributes[windowsStreamPrefix+name] = content
+	}
+
+	if len(attributes) > 0 {
+		entry.Attributes = attributes
+	}
+}
+
+func (entry *Entry) SetAttributesToFile(fullPath string) {
+
+	enablePrivilegesOnce.Do(enablePrivileges)
+
+	for name, value := range entry.Attributes {
+		if !strings.HasPrefix(name, windowsStreamPrefix) {
+			continue
+		}
+		streamName := name[len(windowsStreamPrefix):]
+		oldValue, err := ioutil.ReadFile(fullPath + ":" + streamName)
+		if err == nil && bytes.Equal(oldValue, value) {
+			continue
+		}
+		err = ioutil.WriteFile(fullPath+":"+streamName, value, 0644)
+		if err != nil {
+			LOG_WARN("RESTORE_STREAM", "Failed to restore the alternate data stream %s of %s: %v", streamName,
+				fullPath, err)
+		}
+	}
+
+	if descriptor, found := entry.Attributes[windowsSecurity]; found && len(descriptor) > 4 {
+		information := binary.LittleEndian.Uint32(descriptor)
+		r, _, err := procSetFileSecurity.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(fullPath))),
+			uintptr(information), uintptr(unsafe.Pointer(&descriptor[4])))
+		if r == 0 {
+			LOG_WARN("RESTORE_SECURITY", "Failed to restore the security descriptor of %s: %v", fullPath, err)
+		}
+	}
+
+	if birthTime, found := entry.getMetadataAttribute(birthTimeAttribute); found {
+		restoreCreationTime(fullPath, int64(birthTime))
+	}
+
+	if value, found := entry.Attributes[windowsFileAttributes]; found && len(value) == 4 {
+		restoreFileAttributes(fullPath, binary.LittleEndian.Uint32(value))
+	}
+}
+
+// restoreCreationTime sets the creation time, given in nanoseconds since the Unix epoch, leaving the other times
+// unchanged.
+func restoreCreationTime(fullPath string, birthTime int64) {
+
+	handle, err := syscall.CreateFile(syscall.StringToUTF16Ptr(fullPath), FILE_WRITE_ATTRIBUTES,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		LOG_WARN("RESTORE_BIRTHTIME", "Failed to open %s to restore the creation time: %v", fullPath, err)
+		return
+	}
+	defer syscall.CloseHandle(handle)
+
+	creationTime := syscall.NsecToFiletime(birthTime)
+	if err = syscall.SetFileTime(handle, &creationTime, nil, nil); err != nil {
+		LOG_WARN("RESTORE_BIRTHTIME", "Failed to restore the creation time of %s: %v", fullPath, err)
+	}
+}
+
+// restoreFileAttributes sets the hidden, system, read-only, not-content-indexed, and compressed attributes.
+func restoreFileAttributes(fullPath string, fileAttributes uint32) {
+
+	path := syscall.StringToUTF16Ptr(fullPath)
+	oldAttributes, err := syscall.GetFileAttributes(path)
+	if err != nil {
+		LOG_WARN("RESTORE_ATTRIBUTES", "Failed to read the attributes of %s: %v", fullPath, err)
+		return
+	}
+
+	if (oldAttributes^fileAttributes)&FILE_ATTRIBUTE_COMPRESSED != 0 {
+		file, err := os.OpenFile(fullPath, os.O_RDWR, 0)
+		if err != nil {
+			// Directories must be opened with FILE_FLAG_BACKUP_SEMANTICS
+			var handle syscall.Handle
+			handle, err = syscall.CreateFile(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+				syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING,
+				syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+			if err == nil {
+				file = os.NewFile(uintptr(handle), fullPath)
+			}
+		}
+		if err == nil {
+			format := uint16(0)
+			if fileAttributes&FILE_ATTRIBUTE_COMPRESSED != 0 {
+				format = COMPRESSION_FORMAT_DEFAULT
+			}
+			var bytesReturned uint32
+			err = syscall.DeviceIoControl(syscall.Handle(file.Fd()), FSCTL_SET_COMPRESSION,
+				(*byte)(unsafe.Pointer(&format)), 2, nil, 0, &bytesReturned, nil)
+			file.Close()
+		}
+		if err != nil {
+			LOG_WARN("RESTORE_ATTRIBUTES", "Failed to change the compression state of %s: %v", fullPath, err)
+		}
+	}
+
+	// FILE_ATTRIBUTE_COMPRESSED can't be set by SetFileAttributes
+	settable := uint32(windowsAttributeMask &^ FILE_ATTRIBUTE_COMPRESSED)
+	newAttributes := (oldAttributes &^ settable) | (fileAttributes & settable)
+	newAttributes &^= FILE_ATTRIBUTE_COMPRESSED | syscall.FILE_ATTRIBUTE_DIRECTORY
+	if newAttributes == 0 {
+		newAttributes = syscall.FILE_ATTRIBUTE_NORMAL
+	}
+	if newAttributes != oldAttributes&^(FILE_ATTRIBUTE_COMPRESSED|syscall.FILE_ATTRIBUTE_DIRECTORY) {
+		err = syscall.SetFileAttributes(path, newAttributes)
+		if err != nil {
+			LOG_WARN("RESTORE_ATTRIBUTES", "Failed to set the attributes of %s: %v", fullPath, err)
+		}
+	}
+}
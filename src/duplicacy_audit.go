@@ -0,0 +1,312 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// These are the ways a chunk can be encrypted, as reported by the encryption audit.
+const (
+	ChunkEncryptionNone       = 0 // not encrypted
+	ChunkEncryptionDerivedKey = 1 // key derived from the chunk hash, so identical chunks have identical keys
+	ChunkEncryptionRSAKey     = 2 // random key wrapped by the RSA public key (ENCRYPTION_VERSION_RSA)
+	ChunkEncryptionWrappedKey = 3 // random key wrapped by the hash-derived key (ENCRYPTION_VERSION_WRAPPED)
+	ChunkEncryptionUnknown    = 4 // the chunk can't be recognized
+)
+
+var chunkEncryptionNames = []string{"not encrypted", "hash-derived key", "random key wrapped by the RSA key",
+	"random key wrapped by the hash-derived key", "unrecognized"}
+
+// GetChunkEncryption determines how the chunk was encrypted, by looking at the banner of the raw chunk content.
+// Note that the nonce is always randomly generated for every chunk regardless of how the key is obtained.
+func GetChunkEncryption(content []byte) int {
+
+	bannerLength := len(ENCRYPTION_BANNER)
+
+	if len(content) > bannerLength && string(content[:bannerLength]) == ERASURE_CODING_BANNER {
+		// Skip the erasure coding header and the shard hashes to get to the actual chunk data
+		if len(content) < bannerLength+14 {
+			return ChunkEncryptionUnknown
+		}
+		header := content[bannerLength : bannerLength+14]
+		dataShards := int(binary.LittleEndian.Uint16(header[8:10]))
+		parityShards := int(binary.LittleEndian.Uint16(header[10:12]))
+		dataOffset := bannerLength + len(header) + (dataShards+parityShards)*32
+		if len(content) < dataOffset {
+			return ChunkEncryptionUnknown
+		}
+		content = content[dataOffset:]
+	}
+
+	if len(content) < bannerLength || string(content[:bannerLength-1]) != ENCRYPTION_BANNER[:bannerLength-1] {
+		return ChunkEncryptionNone
+	}
+
+	switch content[bannerLength-1] {
+	case 0:
+		return ChunkEncryptionDerivedKey
+	case ENCRYPTION_VERSION_RSA:
+		return ChunkEncryptionRSAKey
+	case ENCRYPTION_VERSION_WRAPPED:
+		return ChunkEncryptionWrappedKey
+	default:
+		return ChunkEncryptionUnknown
+	}
+}
+
+// listMetadataChunks returns the hashes of the metadata chunks of all snapshots indexed by the chunk ids, or nil if
+// the snapshots can't be listed.
+func (manager *SnapshotManager) listMetadataChunks() map[string]string {
+
+	metadataChunks := make(map[string]string)
+	snapshotIDs, err := manager.ListSnapshotIDs()
+	if err != nil {
+		LOG_ERROR("AUDIT_LIST", "Failed to list all snapshots: %v", err)
+		return nil
+	}
+	for _, snapshotID := range snapshotIDs {
+		revisions, err := manager.ListSnapshotRevisions(snapshotID)
+		if err != nil {
+			LOG_ERROR("AUDIT_LIST", "Failed to list all revisions for snapshot %s: %v", snapshotID, err)
+			return nil
+		}
+		for _, revision := range revisions {
+			snapshot := manager.DownloadSnapshot(snapshotID, revision)
+			if snapshot == nil {
+				continue
+			}
+			for _, sequence := range [][]string{snapshot.FileSequence, snapshot.ChunkSequence, snapshot.LengthSequence} {
+				for _, chunkHash := range sequence {
+					metadataChunks[manager.config.GetChunkIDFromHash(chunkHash)] = chunkHash
+				}
+			}
+		}
+	}
+	return metadataChunks
+}
+
+// AuditEncryption downloads every chunk in the storage and reports how file chunks and metadata chunks were
+// encrypted.  Chunks encrypted with a key derived from the chunk hash (convergent encryption) reveal to anyone with
+// access to the storage whether two repositories contain the same data, or whether a repository contains a known
+// piece of data.  Storages initialized with an RSA key use random keys for file chunks, and those initialized with
+// -random-chunk-keys use random keys for all chunks, including metadata chunks which are never encrypted by the RSA
+// key so that snapshots can be listed without the private key.
+func (manager *SnapshotManager) AuditEncryption(threads int) bool {
+
+	if threads < 1 {
+		threads = 1
+	}
+
+	metadataChunks := manager.listMetadataChunks()
+	if metadataChunks == nil {
+		return false
+	}
+
+	LOG_INFO("AUDIT_LIST", "Listing all chunks")
+	allChunks, _ := manager.ListAllFiles(manager.storage, chunkDir)
+
+	chunkQueue := make(chan string, threads)
+	// Indexed first by whether the chunk is a metadata chunk and then by the encryption method
+	var counts [2][5]int
+	var derivedMetadataChunks []string
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+
+	for i := 0; i < threads; i++ {
+		wait.Add(1)
+		go func(threadIndex int) {
+			defer CatchLogException()
+			defer wait.Done()
+			chunk := CreateChunk(manager.config, true)
+			for file := range chunkQueue {
+				chunk.Reset(false)
+				err := manager.storage.DownloadFile(threadIndex, chunkDir+file, chunk)
+				if err != nil {
+					LOG_WARN("AUDIT_DOWNLOAD", "Failed to download the chunk %s: %v", file, err)
+					continue
+				}
+
+				chunkID := strings.Replace(file, "/", "", -1)
+				encryption := GetChunkEncryption(chunk.GetBytes())
+				isMetadata := 0
+				if metadataChunks[chunkID] != "" {
+					isMetadata = 1
+				}
+				LOG_DEBUG("AUDIT_CHUNK", "Chunk %s: %s", chunkID, chunkEncryptionNames[encryption])
+
+				lock.Lock()
+				counts[isMetadata][encryption]++
+				if isMetadata == 1 && encryption == ChunkEncryptionDerivedKey {
+					derivedMetadataChunks = append(derivedMetadataChunks, chunkID)
+				}
+				lock.Unlock()
+			}
+		}(i)
+	}
+
+	for _, file := range allChunks {
+		if len(file) == 0 || file[len(file)-1] == '/' || strings.HasSuffix(file, ".fsl") || strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+		chunkQueue <- file
+	}
+	close(chunkQueue)
+	wait.Wait()
+
+	for isMetadata, kind := range []string{"File", "Metadata"} {
+		for encryption, count := range counts[isMetadata] {
+			if count > 0 {
+				LOG_INFO("AUDIT_ENCRYPTION", "%s chunks with %s: %d", kind, chunkEncryptionNames[encryption], count)
+			}
+		}
+	}
+
+	if IsTracing() {
+		for _, chunkID := range derivedMetadataChunks {
+			LOG_TRACE("AUDIT_ENCRYPTION", "Metadata chunk %s uses a hash-derived key", chunkID)
+		}
+	}
+
+	if counts[0][ChunkEncryptionDerivedKey] > 0 {
+		LOG_INFO("AUDIT_ENCRYPTION", "Chunks with hash-derived keys are encrypted with random nonces, but identical "+
+			"chunks can still be recognized by their ids; initialize the storage with an RSA key or -random-chunk-keys to use random keys for file chunks")
+	}
+
+	if counts[1][ChunkEncryptionDerivedKey] > 0 {
+		LOG_INFO("AUDIT_ENCRYPTION", "Run check -encryption -reencrypt-metadata to encrypt the metadata chunks with "+
+			"random keys")
+	}
+
+	if counts[0][ChunkEncryptionUnknown]+counts[1][ChunkEncryptionUnknown] > 0 {
+		LOG_WARN("AUDIT_ENCRYPTION", "Some chunks can't be recognized; run check -chunks to verify them")
+		return false
+	}
+
+	return true
+}
+
+// ReencryptMetadataChunks switches the storage to random chunk keys and encrypts again the metadata chunks of all
+// snapshots that were encrypted with keys derived from the chunk hashes.  File chunks are left as they are, as there
+// are usually too many of them to be rewritten, but new file chunks will use random keys too.  The chunk ids don't
+// change, so the snapshots are unaffected, and chunks already encrypted with random keys are skipped when this is run
+// again after being interrupted.
+func (manager *SnapshotManager) ReencryptMetadataChunks(password string, iterations int, threads int) bool {
+
+	if len(manager.config.ChunkKey) == 0 {
+		LOG_ERROR("AUDIT_REENCRYPT", "The storage is not encrypted")
+		return false
+	}
+
+	if threads < 1 {
+		threads = 1
+	}
+
+	// New chunks are encrypted with random keys from now on, even if some existing chunks can't be rewritten
+	if !manager.config.RandomChunkKeys {
+		newConfig := *manager.config
+		newConfig.RandomChunkKeys = true
+		if !manager.replaceConfig(&newConfig, password, iterations) {
+			return false
+		}
+		manager.config.RandomChunkKeys = true
+		LOG_INFO("AUDIT_REENCRYPT", "New chunks will be encrypted with random keys")
+	}
+
+	metadataChunks := manager.listMetadataChunks()
+	if metadataChunks == nil {
+		return false
+	}
+
+	chunkQueue := make(chan string, threads)
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	numberOfReencryptedChunks := 0
+	numberOfSkippedChunks := 0
+	numberOfFailedChunks := 0
+
+	for i := 0; i < threads; i++ {
+		wait.Add(1)
+		go func(threadIndex int) {
+			defer CatchLogException()
+			defer wait.Done()
+			chunk := CreateChunk(manager.config, true)
+			for chunkID := range chunkQueue {
+				reencrypted, err := manager.reencryptChunk(threadIndex, chunkID, metadataChunks[chunkID], chunk)
+				if err != nil {
+					LOG_WARN("AUDIT_REENCRYPT", "Failed to encrypt the chunk %s again: %v", chunkID, err)
+				}
+
+				lock.Lock()
+				if err != nil {
+					numberOfFailedChunks++
+				} else if reencrypted {
+					numberOfReencryptedChunks++
+				} else {
+					numberOfSkippedChunks++
+				}
+				lock.Unlock()
+			}
+		}(i)
+	}
+
+	for chunkID := range metadataChunks {
+		chunkQueue <- chunkID
+	}
+	close(chunkQueue)
+	wait.Wait()
+
+	LOG_INFO("AUDIT_REENCRYPT", "Encrypted %d metadata chunks with random keys; %d chunks already had random keys",
+		numberOfReencryptedChunks, numberOfSkippedChunks)
+
+	if numberOfFailedChunks > 0 {
+		LOG_ERROR("AUDIT_REENCRYPT", "%d chunks could not be encrypted again; run the command again to retry",
+			numberOfFailedChunks)
+		return false
+	}
+	return true
+}
+
+// reencryptChunk encrypts the metadata chunk 'chunkID' with a random key and uploads it in place of the existing
+// chunk, if the existing chunk was encrypted with the key derived from 'chunkHash'.  It returns false if the chunk
+// doesn't need to be encrypted again.
+func (manager *SnapshotManager) reencryptChunk(threadIndex int, chunkID string, chunkHash string,
+	chunk *Chunk) (bool, error) {
+
+	chunkPath, exist, _, err := manager.storage.FindChunk(threadIndex, chunkID, false)
+	if err != nil {
+		return false, err
+	}
+	if !exist {
+		return false, fmt.Errorf("The chunk doesn't exist")
+	}
+
+	chunk.Reset(false)
+	if err = manager.storage.DownloadFile(threadIndex, chunkPath, chunk); err != nil {
+		return false, err
+	}
+
+	if GetChunkEncryption(chunk.GetBytes()) != ChunkEncryptionDerivedKey {
+		LOG_DEBUG("AUDIT_REENCRYPT", "Chunk %s doesn't use a hash-derived key", chunkID)
+		return false, nil
+	}
+
+	if err = chunk.Decrypt(manager.config.ChunkKey, chunkHash); err != nil {
+		return false, err
+	}
+	if chunk.GetID() != chunkID {
+		return false, fmt.Errorf("The chunk has a hash id of %s", chunk.GetID())
+	}
+
+	if _, err = manager.uploadChunkContent(threadIndex, chunkID, chunkHash, chunk.GetBytes(), true); err != nil {
+		return false, err
+	}
+
+	LOG_DEBUG("AUDIT_REENCRYPT", "Chunk %s has been encrypted with a random key", chunkID)
+	return true, nil
+}
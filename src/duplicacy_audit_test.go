@@ -0,0 +1,219 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReencryptMetadataChunks(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "reencrypt")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	for i := 0; i < 5; i++ {
+		createRandomFile(joinPath(repository, fmt.Sprintf("file%d", i)), 20000)
+	}
+
+	password := "duplicacy"
+	storage, err := CreateFileStorage(joinPath(testDir, "storage"), false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage.SetDefaultNestingLevels([]int{2, 3}, 2)
+	if !ConfigStorage(storage, 16384, 100, 4*1024, 16*1024, 1024, password, nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, password, "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, 2, "first", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+
+	// checkEncryption checks how the metadata chunks of all snapshots are encrypted
+	manager := backupManager.SnapshotManager
+	checkEncryption := func(expected int) {
+		metadataChunks := manager.listMetadataChunks()
+		if len(metadataChunks) == 0 {
+			t.Errorf("No metadata chunks found")
+		}
+		chunk := CreateChunk(manager.config, true)
+		for chunkID := range metadataChunks {
+			chunkPath, _, _, err := storage.FindChunk(0, chunkID, false)
+			if err == nil {
+				chunk.Reset(false)
+				err = storage.DownloadFile(0, chunkPath, chunk)
+			}
+			if err != nil {
+				t.Errorf("Failed to download the chunk %s: %v", chunkID, err)
+			} else if encryption := GetChunkEncryption(chunk.GetBytes()); encryption != expected {
+				t.Errorf("The metadata chunk %s is encrypted with %s", chunkID, chunkEncryptionNames[encryption])
+			}
+		}
+	}
+	checkEncryption(ChunkEncryptionDerivedKey)
+
+	if !manager.ReencryptMetadataChunks(password, 16384, 2) {
+		t.Fatalf("Failed to encrypt the metadata chunks again")
+	}
+	checkEncryption(ChunkEncryptionWrappedKey)
+
+	config, _, err := DownloadConfig(storage, password)
+	if err != nil || !config.RandomChunkKeys {
+		t.Errorf("The storage isn't configured to use random chunk keys: %v", err)
+	}
+
+	// Running it again leaves the chunks as they are, and new chunks use random keys too
+	if !manager.ReencryptMetadataChunks(password, 16384, 1) {
+		t.Errorf("Failed to encrypt the metadata chunks again for the second time")
+	}
+	createRandomFile(joinPath(repository, "file5"), 20000)
+	if !backupManager.Backup(repository, true, 2, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+	checkEncryption(ChunkEncryptionWrappedKey)
+
+	// The snapshots are still readable without the snapshot cache
+	os.RemoveAll(joinPath(repository, DUPLICACY_DIRECTORY, "cache"))
+	backupManager = CreateBackupManager("host1", storage, testDir, password, "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.SnapshotManager.CheckSnapshots("host1", []int{1, 2}, "", false, false, true, false, false,
+		false, 1, false) {
+		t.Errorf("The check failed")
+	}
+
+	restored := joinPath(testDir, "restored")
+	os.MkdirAll(restored, 0700)
+	if failures := backupManager.Restore(restored, 2, true, false, 1, false, false, false, false, nil,
+		false); failures != 0 {
+		t.Errorf("%d files failed to be restored", failures)
+	}
+	for i := 0; i < 6; i++ {
+		file := fmt.Sprintf("file%d", i)
+		if hash1, hash2 := getFileHash(joinPath(repository, file)), getFileHash(joinPath(restored, file)); hash1 != hash2 {
+			t.Errorf("File %s has a hash of %s after being restored instead of %s", file, hash2, hash1)
+		}
+	}
+}
+
+var auditCountPattern = regexp.MustCompile(`^((File|Metadata) chunks with .*): \d+$`)
+
+func TestAuditEncryption(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	// Each banner version is reported with the label of its kind
+	banner := ENCRYPTION_BANNER[:len(ENCRYPTION_BANNER)-1]
+	for version, expected := range map[byte]string{
+		0:                          "hash-derived key",
+		ENCRYPTION_VERSION_RSA:     "random key wrapped by the RSA key",
+		ENCRYPTION_VERSION_WRAPPED: "random key wrapped by the hash-derived key",
+		9:                          "unrecognized",
+	} {
+		content := append([]byte(banner), version, 0, 0, 0)
+		if name := chunkEncryptionNames[GetChunkEncryption(content)]; name != expected {
+			t.Errorf("A chunk of banner version %d is reported as encrypted with %s", version, name)
+		}
+	}
+	if name := chunkEncryptionNames[GetChunkEncryption([]byte("plain chunk content"))]; name != "not encrypted" {
+		t.Errorf("An unencrypted chunk is reported as encrypted with %s", name)
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "audit")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	for i := 0; i < 3; i++ {
+		createRandomFile(joinPath(repository, fmt.Sprintf("file%d", i)), 20000)
+	}
+
+	publicKey, _ := createTestRSAKeys(t)
+	password := "duplicacy"
+	removeMockStore("mocktest/audit")
+	storage, err := CreateMockStorage("mocktest/audit", 1)
+	if err != nil {
+		t.Fatalf("Failed to create the mock storage: %v", err)
+	}
+	if !ConfigStorage(storage, 16384, 100, 4*1024, 16*1024, 1024, password, nil, false, publicKey, 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, password, "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, 1, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	// audit returns the kinds of file chunks and metadata chunks reported by the audit
+	audit := func() (kinds []string) {
+		LogFunction = func(level int, logID string, message string) {
+			if match := auditCountPattern.FindStringSubmatch(message); logID == "AUDIT_ENCRYPTION" && match != nil {
+				kinds = append(kinds, match[1])
+			}
+		}
+		defer func() { LogFunction = nil }()
+		if !backupManager.SnapshotManager.AuditEncryption(1) {
+			t.Errorf("The audit failed")
+		}
+		sort.Strings(kinds)
+		return kinds
+	}
+
+	if kinds := strings.Join(audit(), "; "); kinds != "File chunks with random key wrapped by the RSA key; "+
+		"Metadata chunks with hash-derived key" {
+		t.Errorf("The audit reported %s", kinds)
+	}
+
+	if !backupManager.SnapshotManager.ReencryptMetadataChunks(password, 16384, 1) {
+		t.Fatalf("Failed to encrypt the metadata chunks again")
+	}
+	if kinds := strings.Join(audit(), "; "); kinds != "File chunks with random key wrapped by the RSA key; "+
+		"Metadata chunks with random key wrapped by the hash-derived key" {
+		t.Errorf("The audit reported %s after encrypting the metadata chunks again", kinds)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/base64"
+	"context"
 )
 
 type B2Error struct {
@@ -51,19 +52,21 @@ type B2Client struct {
 	StorageDir         string
 
 	Lock               sync.Mutex
-	AuthorizationToken string
 	APIURL             string
 	DownloadURL        string
-	IsAuthorized       bool
 
-	UploadURLs         []string
-	UploadTokens       []string
+	// The account authorization token shared by all threads, renewed by the first thread getting a 401
+	authorization      *tokenSource
+
+	// Upload URLs not being used by any thread; each one can only be used by one upload at a time
+	uploadURLs         []B2UploadArgument
 
 	Threads            int
-	MaximumRetries     int
+	RetryPolicy        *RetryPolicy
 	TestMode           bool
 
-	LastAuthorizationTime int64
+	// Returns the context of the requests; the context of the running operation is used if it is nil
+	ContextFunction    func() context.Context
 }
 
 // URL encode the given path but keep the slashes intact
@@ -90,17 +93,19 @@ func NewB2Client(applicationKeyID string, applicationKey string, downloadURL str
 		maximumRetries, _ = strconv.Atoi(value)
 		LOG_INFO("B2_RETRIES", "Setting maximum retries for B2 to %d", maximumRetries)
 	}
+	if maximumRetries < 0 {
+		maximumRetries = 0
+	}
 
 	client := &B2Client{
-		HTTPClient:       http.DefaultClient,
+		HTTPClient:       newStorageHTTPClient(),
 		ApplicationKeyID: applicationKeyID,
 		ApplicationKey:   applicationKey,
 		DownloadURL:      downloadURL,
 		StorageDir:       storageDir,
-		UploadURLs:       make([]string, threads),
-		UploadTokens:     make([]string, threads),
+		authorization:    newTokenSource(""),
 		Threads:          threads,
-		MaximumRetries:   maximumRetries,
+		RetryPolicy:      CreateRetryPolicy(maximumRetries+1, 2, 64, 0.5),
 	}
 	return client
 }
@@ -117,29 +122,55 @@ func (client *B2Client) getDownloadURL() string {
 	return client.DownloadURL
 }
 
-func (client *B2Client) retry(retries int, response *http.Response) int {
+// takeUploadURL returns an upload URL not used by other threads, getting a new one if there is none.
+func (client *B2Client) takeUploadURL(threadIndex int) (*B2UploadArgument, error) {
+	client.Lock.Lock()
+	if n := len(client.uploadURLs); n > 0 {
+		upload := client.uploadURLs[n-1]
+		client.uploadURLs = client.uploadURLs[:n-1]
+		client.Lock.Unlock()
+		return &upload, nil
+	}
+	client.Lock.Unlock()
+
+	return client.getUploadURL(threadIndex)
+}
+
+// returnUploadURL makes an upload URL that has been used successfully available to other uploads.
+func (client *B2Client) returnUploadURL(upload *B2UploadArgument) {
+	client.Lock.Lock()
+	defer client.Lock.Unlock()
+	client.uploadURLs = append(client.uploadURLs, *upload)
+}
+
+// b2RetryAfter returns the delay asked by the Retry-After header of the response, if any.
+func b2RetryAfter(response *http.Response) time.Duration {
 	if response != nil {
 		if backoffList, found := response.Header["Retry-After"]; found && len(backoffList) > 0 {
 			retryAfter, _ := strconv.Atoi(backoffList[0])
 			if retryAfter >= 1 {
-				time.Sleep(time.Duration(retryAfter) * time.Second)
-				return 1
+				return time.Duration(retryAfter) * time.Second
 			}
 		}
 	}
+	return 0
+}
 
-	if retries >= client.MaximumRetries + 1 {
-		return 0
-	}
-	retries++
-	delay := 1 << uint(retries)
-	if delay > 64 {
-		delay = 64
+// b2RetryClass returns the class of the operation made by a request to 'requestURL', the class of uploads being
+// known by the caller since their URLs are obtained later.
+func b2RetryClass(requestURL string, method string, isUpload bool) string {
+	switch {
+	case isUpload:
+		return RetryClassUpload
+	case strings.Contains(requestURL, "/b2_list_"):
+		return RetryClassList
+	case strings.Contains(requestURL, "/b2_delete_file_version") || strings.Contains(requestURL, "/b2_hide_file"):
+		return RetryClassDelete
+	case method == http.MethodGet:
+		return RetryClassDownload
+	default:
+		return RetryClassOther
 	}
-	delayInSeconds := (rand.Float32() + 1.0) * float32(delay) / 2.0
-
-	time.Sleep(time.Duration(delayInSeconds) * time.Second)
-	return retries
 }
 
 func (client *B2Client) call(threadIndex int, requestURL string, method string, requestHeaders map[string]string, input interface{}) (
@@ -147,7 +178,10 @@ func (client *B2Client) call(threadIndex int, requestURL string, method string,
 
 	var response *http.Response
 
-	retries := 0
+	ctx := getRequestContext(client.ContextFunction)
+	var retryState *retryState
+	var upload *B2UploadArgument
+	reauthorized := false
 	for {
 		var inputReader io.Reader
 		isUpload := false
@@ -171,31 +205,38 @@ func (client *B2Client) call(threadIndex int, requestURL string, method string,
 			inputReader = rateLimitedReader
 		}
 
+		if retryState == nil {
+			operation := method + " " + requestURL
+			if isUpload {
+				operation = "upload of " + requestHeaders["X-Bz-File-Name"]
+			}
+			retryState = client.RetryPolicy.startRequest(ctx, "B2", b2RetryClass(requestURL, method, isUpload), operation)
+		}
 
-		if isUpload {
-			if client.UploadURLs[threadIndex] == "" || client.UploadTokens[threadIndex] == "" {
-				err := client.getUploadURL(threadIndex)
-				if err != nil {
-					return nil, nil, 0, err
-				}
+		if isUpload && upload == nil {
+			var err error
+			upload, err = client.takeUploadURL(threadIndex)
+			if err != nil {
+				return nil, nil, 0, err
 			}
-			requestURL = client.UploadURLs[threadIndex]
+		}
+		if isUpload {
+			requestURL = upload.URL
 		}
 
-		request, err := http.NewRequest(method, requestURL, inputReader)
+		request, err := http.NewRequestWithContext(ctx, method, requestURL, inputReader)
 		if err != nil {
 			return nil, nil, 0, err
 		}
 
+		token, generation := client.authorization.Get()
 		if requestURL == B2AuthorizationURL {
 			request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(client.ApplicationKeyID+":"+client.ApplicationKey)))
 		} else if isUpload {
 			request.ContentLength, _ = strconv.ParseInt(requestHeaders["Content-Length"], 10, 64)
-			request.Header.Set("Authorization", client.UploadTokens[threadIndex])
+			request.Header.Set("Authorization", upload.Token)
 		} else {
-			client.Lock.Lock()
-			request.Header.Set("Authorization", client.AuthorizationToken)
-			client.Lock.Unlock()
+			request.Header.Set("Authorization", token.(string))
 		}
 
 		if requestHeaders != nil {
@@ -219,27 +260,26 @@ func (client *B2Client) call(threadIndex int, requestURL string, method string,
 		if err != nil {
 
 			// Don't retry when the first authorization request fails
-			if requestURL == B2AuthorizationURL && !client.IsAuthorized {
+			if requestURL == B2AuthorizationURL && generation == 0 {
 				return nil, nil, 0, err
 			}
 
 			LOG_TRACE("BACKBLAZE_CALL", "[%d] URL request '%s' returned an error: %v", threadIndex, requestURL, err)
 
-			retries = client.retry(retries, response)
-			if retries <= 0 {
+			if !retryState.retry(err, 0) {
 				return nil, nil, 0, err
 			}
 
-			// Clear the upload url to requrest a new one on retry
-			if isUpload {
-				client.UploadURLs[threadIndex] = ""
-				client.UploadTokens[threadIndex] = ""
-			}
+			// Discard the upload url to request a new one on retry
+			upload = nil
 			continue
 
 		}
 
 		if response.StatusCode < 300 {
+			if upload != nil {
+				client.returnUploadURL(upload)
+			}
 			return response.Body, response.Header, response.ContentLength, nil
 		}
 
@@ -257,9 +297,17 @@ func (client *B2Client) call(threadIndex int, requestURL string, method string,
 				return nil, nil, 0, fmt.Errorf("Authorization failure")
 			}
 
-			// Attempt authorization again.  If authorization is actually not done, run the random backoff
-			_, allowed := client.AuthorizeAccount(threadIndex)
-			if allowed {
+			// Retry once right away with a new token; an expired upload token is replaced by getting a new upload
+			// url, which renews the account authorization if needed.  Further 401s run the random backoff.
+			if !reauthorized {
+				reauthorized = true
+				if isUpload {
+					upload = nil
+					continue
+				}
+				if _, _, err := client.authorization.Refresh(generation, client.authorize(threadIndex)); err != nil {
+					return nil, nil, 0, err
+				}
 				continue
 			}
 		} else if response.StatusCode == 403 {
@@ -278,15 +326,12 @@ func (client *B2Client) call(threadIndex int, requestURL string, method string,
 			}
 		}
 
-		retries = client.retry(retries, response)
-		if retries <= 0 {
-			return nil, nil, 0, fmt.Errorf("URL request '%s' returned %d %s", requestURL, response.StatusCode, e.Message)
+		err = fmt.Errorf("URL request '%s' returned %d %s", requestURL, response.StatusCode, e.Message)
+		if !retryState.retry(err, b2RetryAfter(response)) {
+			return nil, nil, 0, err
 		}
 
-		if isUpload {
-			client.UploadURLs[threadIndex] = ""
-			client.UploadTokens[threadIndex] = ""
-		}
+		upload = nil
 	}
 
 }
@@ -298,43 +343,49 @@ type B2AuthorizeAccountOutput struct {
 	DownloadURL        string
 }
 
+// AuthorizeAccount obtains the first account authorization token.  'allowed' is false if another thread has already
+// done so.
 func (client *B2Client) AuthorizeAccount(threadIndex int) (err error, allowed bool) {
-	client.Lock.Lock()
-	defer client.Lock.Unlock()
-
-	// Don't authorize if the previous one was done less than 30 seconds ago
-	if client.LastAuthorizationTime != 0 && client.LastAuthorizationTime > time.Now().Unix() - 30 {
+	_, generation := client.authorization.Get()
+	if generation > 0 {
 		return nil, false
 	}
+	_, _, err = client.authorization.Refresh(generation, client.authorize(threadIndex))
+	return err, true
+}
 
-	readCloser, _, _, err := client.call(threadIndex, B2AuthorizationURL, http.MethodPost, nil, make(map[string]string))
-	if err != nil {
-		return err, true
-	}
+// authorize returns the function that renews the account authorization token for the token source.
+func (client *B2Client) authorize(threadIndex int) func(current interface{}) (interface{}, error) {
+	return func(current interface{}) (interface{}, error) {
 
-	defer readCloser.Close()
+		readCloser, _, _, err := client.call(threadIndex, B2AuthorizationURL, http.MethodPost, nil, make(map[string]string))
+		if err != nil {
+			return nil, err
+		}
 
-	output := &B2AuthorizeAccountOutput{}
+		defer readCloser.Close()
 
-	if err = json.NewDecoder(readCloser).Decode(&output); err != nil {
-		return err, true
-	}
+		output := &B2AuthorizeAccountOutput{}
 
-	// The account id may be different from the application key id so we're getting the account id from the returned
-	// json object here, which is needed by the b2_list_buckets call.
-	client.AccountID = output.AccountID
+		if err = json.NewDecoder(readCloser).Decode(&output); err != nil {
+			return nil, err
+		}
 
-	client.AuthorizationToken = output.AuthorizationToken
-	client.APIURL = output.APIURL
-	if client.DownloadURL == "" {
-		client.DownloadURL = output.DownloadURL
-	}
-	LOG_INFO("BACKBLAZE_URL", "download URL is: %s", client.DownloadURL)
-	client.IsAuthorized = true
+		client.Lock.Lock()
+		defer client.Lock.Unlock()
+
+		// The account id may be different from the application key id so we're getting the account id from the
+		// returned json object here, which is needed by the b2_list_buckets call.
+		client.AccountID = output.AccountID
 
-	client.LastAuthorizationTime = time.Now().Unix()
+		client.APIURL = output.APIURL
+		if client.DownloadURL == "" {
+			client.DownloadURL = output.DownloadURL
+		}
+		LOG_INFO("BACKBLAZE_URL", "download URL is: %s", client.DownloadURL)
 
-	return nil, true
+		return output.AuthorizationToken, nil
+	}
 }
 
 type ListBucketOutput struct {
@@ -386,6 +437,7 @@ type B2Entry struct {
 	Action          string
 	Size            int64
 	UploadTimestamp int64
+	ContentSha1     string
 }
 
 type B2ListFileNamesOutput struct {
@@ -493,7 +545,9 @@ func (client *B2Client) ListFileNames(threadIndex int, startFileName string, sin
 			}
 			fileUploadTimestamp, _ := strconv.ParseInt(responseHeader.Get("X-Bz-Upload-Timestamp"), 0, 64)
 
-			return []*B2Entry{{fileID, fileName[len(client.StorageDir):], fileAction, fileSize, fileUploadTimestamp}}, nil
+			fileSha1 := responseHeader.Get("X-Bz-Content-Sha1")
+
+			return []*B2Entry{{fileID, fileName[len(client.StorageDir):], fileAction, fileSize, fileUploadTimestamp, fileSha1}}, nil
 		}
 
 		if err = json.NewDecoder(readCloser).Decode(&output); err != nil {
@@ -596,14 +650,14 @@ type B2GetUploadArgumentOutput struct {
 	AuthorizationToken string
 }
 
-func (client *B2Client) getUploadURL(threadIndex int) error {
+func (client *B2Client) getUploadURL(threadIndex int) (*B2UploadArgument, error) {
 	input := make(map[string]string)
 	input["bucketId"] = client.BucketID
 
 	url := client.getAPIURL() + "/b2api/v1/b2_get_upload_url"
 	readCloser, _, _, err := client.call(threadIndex, url, http.MethodPost, make(map[string]string), input)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer readCloser.Close()
@@ -611,13 +665,10 @@ func (client *B2Client) getUploadURL(threadIndex int) error {
 	output := &B2GetUploadArgumentOutput{}
 
 	if err = json.NewDecoder(readCloser).Decode(&output); err != nil {
-		return err
+		return nil, err
 	}
 
-	client.UploadURLs[threadIndex] = output.UploadURL
-	client.UploadTokens[threadIndex] = output.AuthorizationToken
-
-	return nil
+	return &B2UploadArgument{URL: output.UploadURL, Token: output.AuthorizationToken}, nil
 }
 
 func (client *B2Client) UploadFile(threadIndex int, filePath string, content []byte, rateLimit int) (err error) {
@@ -0,0 +1,143 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// b2Event is an event in the payload of a B2 event notification.
+type b2Event struct {
+	EventType      string `json:"eventType"`
+	EventTimestamp int64  `json:"eventTimestamp"`
+	ObjectName     string `json:"objectName"`
+	ObjectSize     int64  `json:"objectSize"`
+}
+
+// parseB2EventPayload returns the events in the payload of a B2 event notification.
+func parseB2EventPayload(content []byte) ([]b2Event, error) {
+	var payload struct {
+		Events []b2Event `json:"events"`
+	}
+	if err := json.Unmarshal(content, &payload); err != nil {
+		return nil, err
+	}
+	return payload.Events, nil
+}
+
+// listB2EventFiles returns the names of the files under the directory 'location' of the storage after 'cursor'.
+func (storage *B2Storage) listB2EventFiles(threadIndex int, location string, cursor string) (files []string, err error) {
+	dir := strings.Trim(location, "/") + "/"
+	entries, err := storage.client.ListFileNames(threadIndex, dir, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.FileName > cursor {
+			files = append(files, entry.FileName)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// GetChangeFeedCursor returns the name of the last file of event notifications in the directory 'location'.
+func (storage *B2Storage) GetChangeFeedCursor(threadIndex int, location string) (cursor string, err error) {
+	files, err := storage.listB2EventFiles(threadIndex, location, "")
+	if err != nil || len(files) == 0 {
+		return "", err
+	}
+	return files[len(files)-1], nil
+}
+
+// ReadChangeFeed reads the event notifications saved after 'cursor' in the directory 'location' of the storage.
+// B2 sends the notifications to a webhook, so this requires a webhook receiver saving each payload as a file in that
+// directory, with names sorted by the time they are received.  The notification rule should cover the chunks
+// directory only.
+//
+// A deleted version may be the chunk itself or the hide marker that makes it a fossil, so the names with deleted
+// versions are looked up after all events have been applied.
+func (storage *B2Storage) ReadChangeFeed(threadIndex int, location string, cursor string,
+	handler func(change ChunkChange)) (newCursor string, complete bool, err error) {
+
+	files, err := storage.listB2EventFiles(threadIndex, location, cursor)
+	if err != nil {
+		return "", false, err
+	}
+	if len(files) == 0 {
+		return cursor, false, nil
+	}
+
+	var events []b2Event
+	for _, file := range files {
+		readCloser, _, err := storage.client.DownloadFile(threadIndex, file)
+		if err != nil {
+			return "", false, err
+		}
+		content, err := ioutil.ReadAll(readCloser)
+		readCloser.Close()
+		if err != nil {
+			return "", false, err
+		}
+
+		fileEvents, err := parseB2EventPayload(content)
+		if err != nil {
+			LOG_WARN("CHUNK_INDEX", "Skipped the invalid event notification %s: %v", file, err)
+			continue
+		}
+		events = append(events, fileEvents...)
+	}
+
+	deleted := applyB2Events(events, storage.client.StorageDir+chunkDir, handler)
+	for _, name := range deleted {
+		for _, file := range []string{name, name + ".fsl"} {
+			exist, _, size, err := storage.GetFileInfo(threadIndex, chunkDir+file)
+			if err != nil {
+				return "", false, fmt.Errorf("failed to look up %s: %v", file, err)
+			}
+			handler(ChunkChange{File: file, Size: size, Deleted: !exist})
+		}
+	}
+
+	return files[len(files)-1], false, nil
+}
+
+// applyB2Events calls 'handler' with the changes made by the events to the files under 'chunkPrefix', in the order
+// the events happened, and returns the names of the files with deleted versions.
+func applyB2Events(events []b2Event, chunkPrefix string, handler func(change ChunkChange)) (deleted []string) {
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].EventTimestamp < events[j].EventTimestamp
+	})
+
+	deletedNames := make(map[string]bool)
+	for _, event := range events {
+		if !strings.HasPrefix(event.ObjectName, chunkPrefix) {
+			continue
+		}
+		name := event.ObjectName[len(chunkPrefix):]
+
+		switch {
+		case strings.HasPrefix(event.EventType, "b2:ObjectCreated:"):
+			// A new version replaces the hide marker of a fossil
+			handler(ChunkChange{File: name + ".fsl", Deleted: true})
+			handler(ChunkChange{File: name, Size: event.ObjectSize})
+		case strings.HasPrefix(event.EventType, "b2:HideMarkerCreated:"):
+			handler(ChunkChange{File: name, Deleted: true})
+			handler(ChunkChange{File: name + ".fsl"})
+		case strings.HasPrefix(event.EventType, "b2:ObjectDeleted:"):
+			if !deletedNames[name] {
+				deletedNames[name] = true
+				deleted = append(deleted, name)
+			}
+		}
+	}
+	return deleted
+}
@@ -5,6 +5,8 @@
 package duplicacy
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"strings"
 )
 
@@ -32,12 +34,18 @@ func CreateB2Storage(accountID string, applicationKey string, downloadURL string
 	storage = &B2Storage{
 		client: client,
 	}
+	client.ContextFunction = storage.GetContext
 
 	storage.DerivedStorage = storage
 	storage.SetDefaultNestingLevels([]int{0}, 0)
 	return storage, nil
 }
 
+// SetRetryPolicy replaces the settings of the default retry policy with the non-zero ones of 'policy'.
+func (storage *B2Storage) SetRetryPolicy(policy *RetryPolicy) {
+	storage.client.RetryPolicy = storage.client.RetryPolicy.override(policy)
+}
+
 // ListFiles return the list of files and subdirectories under 'dir' (non-recursively)
 func (storage *B2Storage) ListFiles(threadIndex int, dir string) (files []string, sizes []int64, err error) {
 	for len(dir) > 0 && dir[len(dir)-1] == '/' {
@@ -220,6 +228,63 @@ func (storage *B2Storage) UploadFile(threadIndex int, filePath string, content [
 	return storage.client.UploadFile(threadIndex, filePath, content, storage.UploadRateLimit()/storage.client.Threads)
 }
 
+// ListOldVersions returns the versions of the files under 'dir' that are neither the current version nor, for a
+// fossil, the version hidden by the fossil.  These versions are not listed by ListFiles but still take up space in
+// buckets that keep all versions.
+func (storage *B2Storage) ListOldVersions(threadIndex int, dir string) (versions []storageFileVersion, err error) {
+	entries, err := storage.client.ListFileNames(threadIndex, dir, false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions of the same file are listed from the newest to the oldest
+	lastFile := ""
+	uploadFound := false
+	for _, entry := range entries {
+		if entry.FileName != lastFile {
+			lastFile = entry.FileName
+			uploadFound = false
+		}
+		if uploadFound {
+			versions = append(versions, storageFileVersion{path: entry.FileName, id: entry.FileID, size: entry.Size})
+		} else if entry.Action == "upload" {
+			uploadFound = true
+		}
+	}
+	return versions, nil
+}
+
+// DeleteOldVersion deletes a version returned by ListOldVersions.
+func (storage *B2Storage) DeleteOldVersion(threadIndex int, version storageFileVersion) (err error) {
+	return storage.client.DeleteFile(threadIndex, version.path, version.id)
+}
+
+// ComputeChecksum returns the SHA1 that B2 keeps for a file with the given content.
+func (storage *B2Storage) ComputeChecksum(content []byte) string {
+	hash := sha1.Sum(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// ListChecksums returns the files under 'dir' and their SHA1 checksums.  Large files uploaded in parts have no
+// SHA1, and files with server-side encryption may report it with an 'unverified:' prefix.
+func (storage *B2Storage) ListChecksums(threadIndex int, dir string) (files []string, checksums []string, err error) {
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	entries, err := storage.client.ListFileNames(threadIndex, dir, false, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, entry := range entries {
+		checksum := strings.TrimPrefix(entry.ContentSha1, "unverified:")
+		if checksum == "none" {
+			checksum = ""
+		}
+		files = append(files, entry.FileName[len(dir):])
+		checksums = append(checksums, checksum)
+	}
+	return files, checksums, nil
+}
+
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
 // managing snapshots.
 func (storage *B2Storage) IsCacheNeeded() bool { return true }
@@ -0,0 +1,81 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestBackupDryRun(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "backupdryrun")
+	os.RemoveAll(testDir)
+
+	repository := joinPath(testDir, "repository1")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	chunks, _ := backupManager.SnapshotManager.ListAllFiles(storage, "chunks/")
+
+	createRandomFile(joinPath(repository, "file2"), 200000)
+	backupManager.SetDryRun(true)
+	if !backupManager.Backup(repository, true, threads, "second", false, false, 0, false) {
+		t.Fatalf("The dry-run backup failed")
+	}
+
+	summary := backupManager.GetSummary()
+	info, _ := os.Stat(joinPath(repository, "file2"))
+	if !summary.DryRun || summary.Revision != 2 || summary.NewFiles != 1 || summary.NewFileSize != info.Size() {
+		t.Errorf("The dry-run backup summary is %+v", summary)
+	}
+	if summary.NewChunks == 0 || summary.TransferredBytes < info.Size() {
+		t.Errorf("The dry-run backup estimated %d new chunks and %d bytes", summary.NewChunks,
+			summary.TransferredBytes)
+	}
+
+	if newChunks, _ := backupManager.SnapshotManager.ListAllFiles(storage, "chunks/"); len(newChunks) != len(chunks) {
+		t.Errorf("The dry-run backup changed the number of chunks from %d to %d", len(chunks), len(newChunks))
+	}
+	if revisions, _ := backupManager.SnapshotManager.ListSnapshotRevisions("host1"); len(revisions) != 1 {
+		t.Errorf("The dry-run backup created a snapshot: %v", revisions)
+	}
+}
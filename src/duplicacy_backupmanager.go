@@ -10,12 +10,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -34,18 +34,134 @@ type BackupManager struct {
 
 	config *Config // contains a number of options
 
-	nobackupFile string // don't backup directory when this file name is found
+	markerFiles []string // don't backup directory when a file with one of these names is found
 
   filtersFile string  // the path to the filters file
 
   excludeByAttribute bool // don't backup file based on file attribute
 
+	shadowCopyOptions ShadowCopyOptions // options for creating the shadow copy
+
+	specialFiles bool // back up named pipes, sockets, and device nodes
+
+	oneFileSystem bool // don't descend into directories on other file systems
+
+	changeJournal bool // list only directories changed since the last backup according to the change journal
+
+	changeSet *ChangeSet // the changes since the last backup detected by a RepositoryWatcher
+
+	summary OperationSummary // the results of the last backup or restore
+
+	stdinName string // back up the standard input as a file with this name instead of the repository
+
+	openRetryOptions OpenRetryOptions // how to retry opening files in use by other processes
+
+	skippedReport string // the file to write the list of files and directories that couldn't be backed up to
+
+	normalization   string // the Unicode normalization form of the file names restored
+	collisionPolicy string // how to restore files whose names collide on a case-insensitive file system
+	conflictPolicy  string // how to restore files that already exist and differ from the snapshot
+
+	metadataOnly bool // record the file tree without uploading file contents
+
+	backupNote string // the note attached to the revision created by the backup
+
+	verifyPercentage   int        // the percentage of newly uploaded chunks to download again and verify
+	uploadedChunks     []string   // the hashes of the chunks uploaded by the backup, recorded only for verification
+	uploadedChunksLock sync.Mutex // protects uploadedChunks from the uploading threads
+
+	skipExistingVerify bool // copy the chunks missing from the destination listing without looking each one up
+
+	restoreMappings []RestoreMapping // rules to restore files to locations other than the repository
+	restoreDiff     bool             // show size and hash differences in a dry-run restore
+	ownerMapping    *OwnerMapping    // translation of uids and gids applied to restored files
+	restoreVerify   bool             // re-hash restored files after the restore
+	verifyReport    string           // the file to write the verification report to
+	restoreFirst    []string         // patterns of the files to restore before the others, in order
+	restoreLast     []string         // patterns of the files to restore after the others, in order
+
+	restoreDeletedOnly bool // restore only the files that don't exist in the latest revision
+
+	restorePrefetchMemory int64 // the size of chunks that the restore can download ahead of the files being restored
+}
+
+// OperationSummary contains the results of a backup or restore, such as those passed to the post-backup and
+// post-restore hooks.
+type OperationSummary struct {
+	Revision         int   `json:"revision"`
+	TotalFiles       int   `json:"total_files"`
+	TotalFileSize    int64 `json:"total_file_size"`
+	NewFiles         int   `json:"new_files"`            // files uploaded by the backup or downloaded by the restore
+	NewFileSize      int64 `json:"new_file_size"`
+	TransferredBytes int64 `json:"transferred_bytes"`    // bytes of chunks actually uploaded or downloaded
+	SkippedFiles     int   `json:"skipped_files"`        // files and directories that couldn't be backed up, or files already up to date
+	FailedFiles      int   `json:"failed_files"`         // files that couldn't be restored
+	NewChunks        int   `json:"new_chunks,omitempty"` // chunks uploaded by the backup
+	DryRun           bool  `json:"dry_run,omitempty"`    // nothing was uploaded; the new chunks and bytes are estimates
+}
+
+// ShadowCopyOptions are the platform specific options for creating the shadow copy used by the backup.
+type ShadowCopyOptions struct {
+	Retries         int      // how many times to retry creating the shadow copy
+	ExcludedWriters []string // class ids of VSS writers not to be involved in the shadow copy (Windows only)
+	Method          string   // lvm, btrfs, or zfs; detected from the file system if empty (Linux only)
+	SnapshotSize    string   // the size reserved for a non-thin LVM snapshot, as accepted by lvcreate (Linux only)
 }
 
 func (manager *BackupManager) SetDryRun(dryRun bool) {
 	manager.config.dryRun = dryRun
 }
 
+func (manager *BackupManager) SetShadowCopyOptions(options ShadowCopyOptions) {
+	manager.shadowCopyOptions = options
+}
+
+func (manager *BackupManager) SetSpecialFiles(specialFiles bool) {
+	manager.specialFiles = specialFiles
+}
+
+func (manager *BackupManager) SetOneFileSystem(oneFileSystem bool) {
+	manager.oneFileSystem = oneFileSystem
+}
+
+func (manager *BackupManager) SetChangeJournal(changeJournal bool) {
+	manager.changeJournal = changeJournal
+}
+
+// GetSummary returns the results of the last backup or restore.
+func (manager *BackupManager) GetSummary() OperationSummary {
+	return manager.summary
+}
+
+// SetStdinName makes the backup create a snapshot containing only a file named 'name' whose content is read from the
+// standard input, instead of listing the repository.
+func (manager *BackupManager) SetStdinName(name string) {
+	manager.stdinName = name
+}
+
+// SetOpenRetryOptions determines how to retry opening files in use by other processes (Windows only).
+func (manager *BackupManager) SetOpenRetryOptions(options OpenRetryOptions) {
+	manager.openRetryOptions = options
+}
+
+// SetSkippedReport makes the backup write the files and directories that couldn't be backed up, along with the
+// reasons, to 'path'.  The file is removed if there are none.
+func (manager *BackupManager) SetSkippedReport(path string) {
+	manager.skippedReport = path
+}
+
+// SetChangeSet supplies the changes made since the last backup, as collected by a RepositoryWatcher.  The previous
+// snapshot is reused for unchanged directories only if it was created by the backup that used the last change set.
+func (manager *BackupManager) SetChangeSet(changes *ChangeSet) {
+	manager.changeSet = changes
+}
+
+// SetMarkerFiles replaces the nobackup file passed to CreateBackupManager with a list of file names; a directory
+// containing any of them is not backed up.
+func (manager *BackupManager) SetMarkerFiles(markerFiles []string) {
+	manager.markerFiles = markerFiles
+}
+
 // CreateBackupManager creates a backup manager using the specified 'storage'.  'snapshotID' is a unique id to
 // identify snapshots created for this repository.  'top' is the top directory of the repository.  'password' is the
 // master key which can be nil if encryption is not enabled.
@@ -71,17 +187,21 @@ func CreateBackupManager(snapshotID string, storage Storage, top string, passwor
 
 		config: config,
 
-		nobackupFile: nobackupFile,
+		markerFiles: []string{nobackupFile},
 
 		filtersFile: filtersFile,
 
 		excludeByAttribute: excludeByAttribute,
+
+		restorePrefetchMemory: DefaultRestorePrefetchMemory,
 	}
 
 	if IsDebugging() {
 		config.Print()
 	}
 
+	setReportStorage(storage, config, top)
+
 	return backupManager
 }
 
@@ -90,6 +210,48 @@ func (manager *BackupManager) LoadRSAPrivateKey(keyFile string, passphrase strin
 	manager.config.loadRSAPrivateKey(keyFile, passphrase)
 }
 
+// IsRSAEncrypted returns true if the file chunks in the storage are encrypted by an RSA key, in which case the private
+// key must be loaded to read them.
+func (manager *BackupManager) IsRSAEncrypted() bool {
+	return manager.config.rsaPublicKey != nil
+}
+
+// writeSkippedReport writes the directories that couldn't be listed, the files that couldn't be read while listing,
+// and the files that couldn't be opened for reading to the report file, one per line.
+func (manager *BackupManager) writeSkippedReport(skippedDirectories []string, skippedFiles []string,
+	fileReader *FileReader) {
+
+	if manager.skippedReport == "" {
+		return
+	}
+
+	if len(skippedDirectories)+len(skippedFiles)+len(fileReader.SkippedFiles) == 0 {
+		err := os.Remove(manager.skippedReport)
+		if err != nil && !os.IsNotExist(err) {
+			LOG_WARN("SKIP_REPORT", "Failed to remove the report %s: %v", manager.skippedReport, err)
+		}
+		return
+	}
+
+	var report bytes.Buffer
+	for _, directory := range skippedDirectories {
+		fmt.Fprintf(&report, "%s\tcannot be listed\n", directory)
+	}
+	for _, file := range skippedFiles {
+		fmt.Fprintf(&report, "%s\tcannot be accessed\n", file)
+	}
+	for i, file := range fileReader.SkippedFiles {
+		fmt.Fprintf(&report, "%s\t%v\n", file, fileReader.SkippedErrors[i])
+	}
+
+	err := ioutil.WriteFile(manager.skippedReport, report.Bytes(), 0644)
+	if err != nil {
+		LOG_WARN("SKIP_REPORT", "Failed to write the report %s: %v", manager.skippedReport, err)
+		return
+	}
+	LOG_INFO("SKIP_REPORT", "The files not backed up have been listed in %s", manager.skippedReport)
+}
+
 // SetupSnapshotCache creates the snapshot cache, which is merely a local storage under the default .duplicacy
 // directory
 func (manager *BackupManager) SetupSnapshotCache(storageName string) bool {
@@ -114,6 +276,19 @@ func (manager *BackupManager) SetupSnapshotCache(storageName string) bool {
 	storage.SetDefaultNestingLevels([]int{1}, 1)
 	manager.snapshotCache = storage
 	manager.SnapshotManager.snapshotCache = storage
+
+	if preference := FindPreference(storageName); preference != nil {
+		if preference.CacheSize != "" {
+			limit, err := ParseStorageSize(preference.CacheSize)
+			if err != nil {
+				LOG_WARN("BACKUP_CACHE", "Invalid cache size '%s' for the storage %s: %v", preference.CacheSize,
+					storageName, err)
+			} else {
+				manager.SnapshotManager.SetCacheSizeLimit(storageName, limit)
+			}
+		}
+		manager.SnapshotManager.SetChangeFeed(preference.ChangeFeed)
+	}
 	return true
 }
 
@@ -173,6 +348,58 @@ func setEntryContent(entries []*Entry, chunkLengths []int, offset int) {
 	}
 }
 
+// listAllChunks adds all chunks in the storage to 'chunkCache'.
+func (manager *BackupManager) listAllChunks(chunkCache map[string]bool) {
+	LOG_INFO("BACKUP_LIST", "Listing all chunks")
+	manager.SnapshotManager.forEachFile(manager.storage, "chunks/", func(chunk string, size int64) {
+		if len(chunk) == 0 || chunk[len(chunk)-1] == '/' {
+			return
+		}
+
+		if strings.HasSuffix(chunk, ".fsl") {
+			return
+		}
+
+		chunk = strings.Replace(chunk, "/", "", -1)
+		chunkCache[chunk] = true
+	})
+}
+
+// reportSkippedEntries warns about the directories and files not included in the backup due to access errors.
+func reportSkippedEntries(skippedDirectories []string, skippedFiles []string) {
+	skipped := ""
+	if len(skippedDirectories) > 0 {
+		if len(skippedDirectories) == 1 {
+			skipped = "1 directory"
+		} else {
+			skipped = fmt.Sprintf("%d directories", len(skippedDirectories))
+		}
+	}
+
+	if len(skippedFiles) > 0 {
+		if len(skipped) > 0 {
+			skipped += " and "
+		}
+		if len(skippedFiles) == 1 {
+			skipped += "1 file"
+		} else {
+			skipped += fmt.Sprintf("%d files", len(skippedFiles))
+		}
+	}
+
+	if len(skipped) > 0 {
+		if len(skippedDirectories)+len(skippedFiles) == 1 {
+			skipped += " was"
+		} else {
+			skipped += " were"
+		}
+
+		skipped += " not included due to access errors"
+		LOG_WARN("BACKUP_SKIPPED", skipped)
+		SetExitCode(WarningExitCode)
+	}
+}
+
 // Backup creates a snapshot for the repository 'top'.  If 'quickMode' is true, only files with different sizes
 // or timestamps since last backup will be uploaded (however the snapshot is still a full snapshot that shares
 // unmodified files with last backup).  Otherwise (or if this is the first backup), the entire repository will
@@ -191,6 +418,11 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 	LOG_DEBUG("BACKUP_PARAMETERS", "top: %s, quick: %t, tag: %s", top, quickMode, tag)
 
+	manager.SnapshotManager.checkPruneLock()
+
+	// Keep the machine from sleeping or shutting down in the middle of the backup
+	defer InhibitSleep(fmt.Sprintf("Backing up %s", top))()
+
 	if manager.config.DataShards != 0 && manager.config.ParityShards != 0 {
 		LOG_INFO("BACKUP_ERASURECODING", "Erasure coding is enabled with %d data shards and %d parity shards",
 		         manager.config.DataShards, manager.config.ParityShards)
@@ -204,7 +436,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		LOG_INFO("BACKUP_EXCLUDE", "Exclude files with no-backup attributes")
 	}
 
-	remoteSnapshot := manager.SnapshotManager.downloadLatestSnapshot(manager.snapshotID)
+	remoteSnapshot := manager.SnapshotManager.downloadLatestSnapshotInfo(manager.snapshotID)
 	if remoteSnapshot == nil {
 		remoteSnapshot = CreateEmptySnapshot(manager.snapshotID)
 		LOG_INFO("BACKUP_START", "No previous backup found")
@@ -212,17 +444,67 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		LOG_INFO("BACKUP_START", "Last backup at revision %d found", remoteSnapshot.Revision)
 	}
 
-	shadowTop := CreateShadowCopy(top, shadowCopy, shadowCopyTimeout)
-	defer DeleteShadowCopy()
-
-	LOG_INFO("BACKUP_INDEXING", "Indexing %s", top)
-	localSnapshot, skippedDirectories, skippedFiles, err := CreateSnapshotFromDirectory(manager.snapshotID, shadowTop,
-		                                                                                manager.nobackupFile, manager.filtersFile, manager.excludeByAttribute)
-	if err != nil {
-		LOG_ERROR("SNAPSHOT_LIST", "Failed to list the directory %s: %v", top, err)
+	// Mixing backups of the repository and from the standard input under one snapshot id would make each one the
+	// previous revision of the other, so every file would be packed again
+	if remoteSnapshot.Revision > 0 && remoteSnapshot.IsStdin() != (manager.stdinName != "") {
+		if manager.stdinName != "" {
+			LOG_ERROR("BACKUP_STDIN", "The snapshot id %s is used by backups of a repository; backups from the standard "+
+				"input require a different snapshot id", manager.snapshotID)
+		} else {
+			LOG_ERROR("BACKUP_STDIN", "The snapshot id %s is used by backups from the standard input; the repository "+
+				"requires a different snapshot id", manager.snapshotID)
+		}
 		return false
 	}
 
+	// A streaming backup reads the files of the previous snapshot while listing the repository, so they are only
+	// loaded here otherwise.  Attributes of the previous snapshot are needed if their entries may be reused.
+	streaming := manager.canStreamBackup(remoteSnapshot, quickMode, enumOnly)
+	if remoteSnapshot.Revision > 0 && !streaming {
+		manager.SnapshotManager.DownloadSnapshotContents(remoteSnapshot, nil,
+			manager.changeJournal || manager.changeSet != nil)
+	}
+
+	// The journal position must be obtained before the shadow copy is created or the repository is listed
+	var changes *ChangeSet
+	var journalPosition string
+	if manager.changeSet != nil {
+		changes = manager.changeSet
+		if changes.revision > 0 && changes.revision == remoteSnapshot.Revision {
+			changes.SetPreviousSnapshot(remoteSnapshot)
+		} else if remoteSnapshot.Revision > 0 {
+			LOG_INFO("WATCH_FULL", "Listing all files as revision %d wasn't created while watching the repository",
+				remoteSnapshot.Revision)
+		}
+	} else if manager.changeJournal {
+		changes, journalPosition = manager.prepareChangeJournal(top, remoteSnapshot)
+	}
+
+	shadowTop := top
+	var localSnapshot *Snapshot
+	var skippedDirectories, skippedFiles []string
+	if manager.stdinName != "" {
+		LOG_INFO("BACKUP_STDIN", "Reading %s from the standard input", manager.stdinName)
+		localSnapshot = CreateEmptySnapshot(manager.snapshotID)
+		localSnapshot.Files = []*Entry{CreateEntry(manager.stdinName, 0, time.Now().Unix(), 0644)}
+	} else {
+		shadowTop = CreateShadowCopy(top, shadowCopy, shadowCopyTimeout, manager.shadowCopyOptions)
+		defer DeleteShadowCopy()
+
+		LOG_INFO("BACKUP_INDEXING", "Indexing %s", top)
+		if streaming {
+			return manager.backupStreaming(top, shadowTop, remoteSnapshot, quickMode, tag, shadowCopy, threads,
+				showStatistics, startTime)
+		}
+		localSnapshot, skippedDirectories, skippedFiles, err = CreateSnapshotFromDirectory(manager.snapshotID, shadowTop,
+			manager.markerFiles, manager.filtersFile, manager.excludeByAttribute, manager.specialFiles,
+			manager.oneFileSystem, changes)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list the directory %s: %v", top, err)
+			return false
+		}
+	}
+
 	if enumOnly {
 		return true
 	}
@@ -232,6 +514,18 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		return false
 	}
 
+	if manager.metadataOnly {
+		return manager.backupMetadataOnly(top, shadowTop, remoteSnapshot, localSnapshot, !quickMode, tag, shadowCopy,
+			threads, showStatistics, startTime, skippedDirectories, skippedFiles)
+	}
+
+	// Files in a metadata-only snapshot have no contents to be shared with the new snapshot
+	noPreviousContent := remoteSnapshot.IsMetadataOnly()
+	if noPreviousContent {
+		LOG_INFO("BACKUP_METADATA", "Uploading all files as revision %d is a metadata-only snapshot",
+			remoteSnapshot.Revision)
+	}
+
 	// This cache contains all chunks referenced by last snasphot. Any other chunks will lead to a call to
 	// UploadChunk.
 	chunkCache := make(map[string]bool)
@@ -247,28 +541,19 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	} else {
 
 		// In quick mode, attempt to load the incomplete snapshot from last incomplete backup if there is one.
-		if quickMode {
+		if quickMode && manager.stdinName == "" {
 			incompleteSnapshot = LoadIncompleteSnapshot()
 		}
 
 		// If the listing operation is fast or there is an incomplete snapshot, list all chunks and
-		// put them in the cache.
-		if manager.storage.IsFastListing() || incompleteSnapshot != nil {
-			LOG_INFO("BACKUP_LIST", "Listing all chunks")
-			allChunks, _ := manager.SnapshotManager.ListAllFiles(manager.storage, "chunks/")
-
-			for _, chunk := range allChunks {
-				if len(chunk) == 0 || chunk[len(chunk)-1] == '/' {
-					continue
-				}
-
-				if strings.HasSuffix(chunk, ".fsl") {
-					continue
-				}
-
-				chunk = strings.Replace(chunk, "/", "", -1)
-				chunkCache[chunk] = true
+		// put them in the cache.  The chunks in a checkpoint are known to exist and don't need to be listed.
+		if incompleteSnapshot != nil && incompleteSnapshot.checkpoint && !manager.storage.IsFastListing() {
+			LOG_INFO("BACKUP_RESUME", "Resuming from the checkpoint of the last backup")
+			for _, chunkHash := range incompleteSnapshot.ChunkHashes {
+				chunkCache[manager.config.GetChunkIDFromHash(chunkHash)] = true
 			}
+		} else if manager.storage.IsFastListing() || incompleteSnapshot != nil {
+			manager.listAllChunks(chunkCache)
 		}
 
 		if incompleteSnapshot != nil {
@@ -307,17 +592,9 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 	}
 
-	var numberOfNewFileChunks int64        // number of new file chunks
-	var totalUploadedFileChunkLength int64 // total length of uploaded file chunks
-	var totalUploadedFileChunkBytes int64  // how many actual bytes have been uploaded
-
-	var totalUploadedSnapshotChunkLength int64 // size of uploaded snapshot chunks
-	var totalUploadedSnapshotChunkBytes int64  // how many actual bytes have been uploaded
-
 	localSnapshot.Revision = remoteSnapshot.Revision + 1
 
-	var totalModifiedFileSize int64    // total size of modified files
-	var uploadedModifiedFileSize int64 // portions that have been uploaded (including cache hits)
+	var totalModifiedFileSize int64 // total size of modified files
 
 	var modifiedEntries []*Entry  // Files that has been modified or newly created
 	var preservedEntries []*Entry // Files unchanges
@@ -326,7 +603,9 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	// we simply treat all files as if they were new, and break them into chunks.
 	// Otherwise, we need to find those that are new or recently modified
 
-	if (remoteSnapshot.Revision == 0 || !quickMode) && incompleteSnapshot == nil {
+	// The file read from the standard input is always new.
+	if (remoteSnapshot.Revision == 0 || !quickMode || manager.stdinName != "" || noPreviousContent) &&
+		incompleteSnapshot == nil {
 		modifiedEntries = localSnapshot.Files
 		for _, entry := range modifiedEntries {
 			totalModifiedFileSize += entry.Size
@@ -417,37 +696,32 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 	// the file reader implements the Reader interface. When an EOF is encounter, it opens the next file unless it
 	// is the last file.
-	fileReader := CreateFileReader(shadowTop, modifiedEntries)
-
-	startUploadingTime := time.Now().Unix()
-
-	lastUploadingTime := time.Now().Unix()
-
-	keepUploadAlive := int64(1800)
-
-	if os.Getenv("DUPLICACY_UPLOAD_KEEPALIVE") != "" {
-		value, _ := strconv.Atoi(os.Getenv("DUPLICACY_UPLOAD_KEEPALIVE"))
-		if value < 10 {
-			value = 10
-		}
-		LOG_INFO("UPLOAD_KEEPALIVE", "Setting KeepUploadAlive to %d", value)
-		keepUploadAlive = int64(value)
-	}
-
-	// Fail at the chunk specified by DUPLICACY_FAIL_CHUNK to simulate a backup error
-	chunkToFail := -1
-	if value, found := os.LookupEnv("DUPLICACY_FAIL_CHUNK"); found {
-		chunkToFail, _ = strconv.Atoi(value)
-		LOG_INFO("SNAPSHOT_FAIL", "Will abort the backup on chunk %d", chunkToFail)
+	var fileReader *FileReader
+	if manager.stdinName != "" {
+		fileReader = CreateFileReaderFromFile(modifiedEntries[0], os.Stdin)
+	} else {
+		fileReader = CreateFileReader(shadowTop, modifiedEntries, manager.openRetryOptions)
 	}
 
-	chunkMaker := CreateChunkMaker(manager.config, false)
-	chunkUploader := CreateChunkUploader(manager.config, manager.storage, nil, threads, nil)
+	upload := manager.createBackupUpload(chunkCache, threads, totalModifiedFileSize, showStatistics)
 
 	localSnapshotReady := false
 	var once sync.Once
 
-	if remoteSnapshot.Revision == 0 {
+	// Checkpoints are only needed when an incomplete snapshot would be saved on errors
+	if remoteSnapshot.Revision == 0 && manager.stdinName == "" && !manager.config.dryRun {
+		upload.checkpoint = createBackupCheckpoint()
+		upload.saveCheckpoint = func(confirmed int) {
+			uploadedChunkLock.Lock()
+			snapshot := createCheckpointSnapshot(localSnapshot.Files, preservedChunkHashes, preservedChunkLengths,
+				uploadedEntries, uploadedChunkHashes, uploadedChunkLengths, confirmed)
+			uploadedChunkLock.Unlock()
+			SaveIncompleteSnapshotCheckpoint(snapshot)
+		}
+	}
+
+	// The standard input can't be read again so the incomplete snapshot is useless, and so is one from a dry run
+	if remoteSnapshot.Revision == 0 && manager.stdinName == "" && !manager.config.dryRun {
 		// In case an error occurs during the initial backup, save the incomplete snapshot
 		RunAtError = func() {
 			once.Do(
@@ -479,97 +753,29 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 		LOG_TRACE("PACK_START", "Packing %s", fileReader.CurrentEntry.Path)
 
-		chunkIndex := 0
 		if threads < 1 {
 			threads = 1
 		}
-		if threads > 1 {
-			LOG_INFO("BACKUP_THREADS", "Use %d uploading threads", threads)
-		}
-
-		var numberOfCollectedChunks int64
-
-		completionFunc := func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int) {
-			action := "Skipped"
-			if skipped {
-				LOG_DEBUG("CHUNK_CACHE", "Skipped chunk %s in cache", chunk.GetID())
-			} else {
-				if uploadSize > 0 {
-					atomic.AddInt64(&numberOfNewFileChunks, 1)
-					atomic.AddInt64(&totalUploadedFileChunkLength, int64(chunkSize))
-					atomic.AddInt64(&totalUploadedFileChunkBytes, int64(uploadSize))
-					action = "Uploaded"
-				} else {
-					LOG_DEBUG("CHUNK_EXIST", "Skipped chunk %s in the storage", chunk.GetID())
-				}
-			}
-
-			uploadedModifiedFileSize := atomic.AddInt64(&uploadedModifiedFileSize, int64(chunkSize))
-
-			if (IsTracing() || showStatistics) && totalModifiedFileSize > 0 {
-				now := time.Now().Unix()
-				if now <= startUploadingTime {
-					now = startUploadingTime + 1
-				}
-				speed := uploadedModifiedFileSize / (now - startUploadingTime)
-				remainingTime := int64(0)
-				if speed > 0 {
-					remainingTime = (totalModifiedFileSize-uploadedModifiedFileSize)/speed + 1
-				}
-				percentage := float32(uploadedModifiedFileSize * 1000 / totalModifiedFileSize)
-				LOG_INFO("UPLOAD_PROGRESS", "%s chunk %d size %d, %sB/s %s %.1f%%", action, chunkIndex,
-					chunkSize, PrettySize(speed), PrettyTime(remainingTime), percentage/10)
-			}
-
-			atomic.AddInt64(&numberOfCollectedChunks, 1)
-			manager.config.PutChunk(chunk)
-		}
-		chunkUploader.completionFunc = completionFunc
-		chunkUploader.Start()
+		upload.start(threads)
 
 		// Break files into chunks
-		chunkMaker.ForEachChunk(
-			fileReader.CurrentFile,
+		upload.chunkMaker.ForEachChunk(
+			upload.progress.StartFile(fileReader.CurrentEntry, fileReader.CurrentFile),
 			func(chunk *Chunk, final bool) {
 
 				hash := chunk.GetHash()
-				chunkID := chunk.GetID()
 				chunkSize := chunk.GetLength()
-
-				if chunkSize == 0 {
-					LOG_DEBUG("CHUNK_EMPTY", "Ignored chunk %s of size 0", chunkID)
+				if !upload.uploadChunk(chunk) {
 					return
 				}
 
-				chunkIndex++
-
-				_, found := chunkCache[chunkID]
-				if found {
-					if time.Now().Unix()-lastUploadingTime > keepUploadAlive {
-						LOG_INFO("UPLOAD_KEEPALIVE", "Skip chunk cache to keep connection alive")
-						found = false
-					}
-				}
-
-				if found {
-					completionFunc(chunk, chunkIndex, true, chunkSize, 0)
-				} else {
-					lastUploadingTime = time.Now().Unix()
-					chunkCache[chunkID] = true
-
-					chunkUploader.StartChunk(chunk, chunkIndex)
-				}
-
 				// Must lock it because the RunAtError function called by other threads may access these two slices
 				uploadedChunkLock.Lock()
 				uploadedChunkHashes = append(uploadedChunkHashes, hash)
 				uploadedChunkLengths = append(uploadedChunkLengths, chunkSize)
 				uploadedChunkLock.Unlock()
 
-				if len(uploadedChunkHashes) == chunkToFail {
-					LOG_ERROR("SNAPSHOT_FAIL", "Artificially fail the chunk %d for testing purposes", chunkToFail)
-				}
-
+				upload.checkChunkToFail(len(uploadedChunkHashes))
 			},
 			func(fileSize int64, hash string) (io.Reader, bool) {
 
@@ -583,7 +789,9 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 				entry.Size = fileSize
 				uploadedEntries = append(uploadedEntries, entry)
 
-				if !showStatistics || IsTracing() || RunInBackground {
+				if upload.bar != nil {
+					LOG_TRACE("PACK_END", "Packed %s (%d)", entry.Path, entry.Size)
+				} else if !showStatistics || IsTracing() || RunInBackground {
 					LOG_INFO("PACK_END", "Packed %s (%d)", entry.Path, entry.Size)
 				}
 
@@ -591,12 +799,12 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 
 				if fileReader.CurrentFile != nil {
 					LOG_TRACE("PACK_START", "Packing %s", fileReader.CurrentEntry.Path)
-					return fileReader.CurrentFile, true
+					return upload.progress.StartFile(fileReader.CurrentEntry, fileReader.CurrentFile), true
 				}
 				return nil, false
 			})
 
-		chunkUploader.Stop()
+		upload.stop()
 
 		// We can't set the offsets in the ForEachChunk loop because in that loop, when switching to a new file, the
 		// data in the buffer may not have been pushed into chunks; it may happen that new chunks can be created
@@ -628,8 +836,9 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	}
 
 	localSnapshot.Tag = tag
+	localSnapshot.Note = manager.backupNote
 	localSnapshot.Options = ""
-	if !quickMode || remoteSnapshot.Revision == 0 {
+	if !quickMode || remoteSnapshot.Revision == 0 || noPreviousContent {
 		localSnapshot.Options = "-hash"
 	}
 
@@ -646,25 +855,23 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		}
 	}
 
+	if manager.stdinName != "" {
+		localSnapshot.Options = strings.TrimSpace(localSnapshot.Options + " -stdin")
+	}
+
 	var preservedFileSize int64
 	var uploadedFileSize int64
-	var totalFileChunkLength int64
 	for _, file := range preservedEntries {
 		preservedFileSize += file.Size
 	}
 	for _, file := range uploadedEntries {
 		uploadedFileSize += file.Size
 	}
-	for _, length := range localSnapshot.ChunkLengths {
-		totalFileChunkLength += int64(length)
-	}
 
 	localSnapshot.FileSize = preservedFileSize + uploadedFileSize
 	localSnapshot.NumberOfFiles = int64(len(preservedEntries) + len(uploadedEntries))
 
-	totalSnapshotChunkLength, numberOfNewSnapshotChunks,
-		totalUploadedSnapshotChunkLength, totalUploadedSnapshotChunkBytes :=
-		manager.UploadSnapshot(chunkMaker, chunkUploader, top, localSnapshot, chunkCache)
+	upload.uploadSnapshot(top, localSnapshot)
 
 	if showStatistics && !RunInBackground {
 		for _, entry := range uploadedEntries {
@@ -672,86 +879,23 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 		}
 	}
 
-	for _, dir := range skippedDirectories {
-		LOG_WARN("SKIP_DIRECTORY", "Subdirectory %s cannot be listed", dir)
-	}
+	skippedFiles = manager.logSkippedEntries(skippedDirectories, skippedFiles, fileReader)
+	upload.finish(top, localSnapshot, len(uploadedEntries), uploadedFileSize)
 
-	for _, file := range fileReader.SkippedFiles {
-		LOG_WARN("SKIP_FILE", "File %s cannot be opened", file)
-	}
-	skippedFiles = append(skippedFiles, fileReader.SkippedFiles...)
-
-	if !manager.config.dryRun {
-		manager.SnapshotManager.CleanSnapshotCache(localSnapshot, nil)
-	}
-	LOG_INFO("BACKUP_END", "Backup for %s at revision %d completed", top, localSnapshot.Revision)
-
-	RunAtError = func() {}
-	RemoveIncompleteSnapshot()
-
-	totalSnapshotChunks := len(localSnapshot.FileSequence) + len(localSnapshot.ChunkSequence) +
-		len(localSnapshot.LengthSequence)
-	if showStatistics {
-
-		LOG_INFO("BACKUP_STATS", "Files: %d total, %s bytes; %d new, %s bytes",
-			len(preservedEntries)+len(uploadedEntries),
-			PrettyNumber(preservedFileSize+uploadedFileSize),
-			len(uploadedEntries), PrettyNumber(uploadedFileSize))
-
-		LOG_INFO("BACKUP_STATS", "File chunks: %d total, %s bytes; %d new, %s bytes, %s bytes uploaded",
-			len(localSnapshot.ChunkHashes), PrettyNumber(totalFileChunkLength),
-			numberOfNewFileChunks, PrettyNumber(totalUploadedFileChunkLength),
-			PrettyNumber(totalUploadedFileChunkBytes))
-
-		LOG_INFO("BACKUP_STATS", "Metadata chunks: %d total, %s bytes; %d new, %s bytes, %s bytes uploaded",
-			totalSnapshotChunks, PrettyNumber(totalSnapshotChunkLength),
-			numberOfNewSnapshotChunks, PrettyNumber(totalUploadedSnapshotChunkLength),
-			PrettyNumber(totalUploadedSnapshotChunkBytes))
-
-		LOG_INFO("BACKUP_STATS", "All chunks: %d total, %s bytes; %d new, %s bytes, %s bytes uploaded",
-			len(localSnapshot.ChunkHashes)+totalSnapshotChunks,
-			PrettyNumber(totalFileChunkLength+totalSnapshotChunkLength),
-			int(numberOfNewFileChunks)+numberOfNewSnapshotChunks,
-			PrettyNumber(totalUploadedFileChunkLength+totalUploadedSnapshotChunkLength),
-			PrettyNumber(totalUploadedFileChunkBytes+totalUploadedSnapshotChunkBytes))
-
-		now := time.Now().Unix()
-		if now == startTime {
-			now = startTime + 1
-		}
-		LOG_INFO("BACKUP_STATS", "Total running time: %s", PrettyTime(now-startTime))
-	}
-
-	skipped := ""
-	if len(skippedDirectories) > 0 {
-		if len(skippedDirectories) == 1 {
-			skipped = "1 directory"
-		} else {
-			skipped = fmt.Sprintf("%d directories", len(skippedDirectories))
-		}
+	if !manager.verifyUploadedChunks(threads) {
+		return false
 	}
 
-	if len(skippedFiles) > 0 {
-		if len(skipped) > 0 {
-			skipped += " and "
-		}
-		if len(skippedFiles) == 1 {
-			skipped += "1 file"
-		} else {
-			skipped += fmt.Sprintf("%d files", len(skippedFiles))
+	if changes != nil && !manager.config.dryRun {
+		changes.revision = localSnapshot.Revision
+		changes.retry = append(append([]string{}, skippedDirectories...), skippedFiles...)
+		if journalPosition != "" {
+			manager.saveChangeJournalState(top, localSnapshot.Revision, journalPosition, changes.Settings,
+				skippedDirectories, skippedFiles)
 		}
 	}
 
-	if len(skipped) > 0 {
-		if len(skippedDirectories)+len(skippedFiles) == 1 {
-			skipped += " was"
-		} else {
-			skipped += " were"
-		}
-
-		skipped += " not included due to access errors"
-		LOG_WARN("BACKUP_SKIPPED", skipped)
-	}
+	upload.report(localSnapshot, len(uploadedEntries), uploadedFileSize, skippedDirectories, skippedFiles, startTime)
 
 	return true
 }
@@ -781,7 +925,7 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 	}
 
 	_, err := os.Stat(top)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && !manager.config.dryRun {
 		err = os.Mkdir(top, 0744)
 		if err != nil {
 			LOG_ERROR("RESTORE_MKDIR", "Can't create the directory to be restored: %v", err)
@@ -790,17 +934,24 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 	}
 
 	// How will behave restore when repo created using -repo-dir ,??
-	err = os.Mkdir(path.Join(top, DUPLICACY_DIRECTORY), 0744)
-	if err != nil && !os.IsExist(err) {
-		LOG_ERROR("RESTORE_MKDIR", "Failed to create the preference directory: %v", err)
-		return 0
+	if !manager.config.dryRun {
+		err = os.Mkdir(path.Join(top, DUPLICACY_DIRECTORY), 0744)
+		if err != nil && !os.IsExist(err) {
+			LOG_ERROR("RESTORE_MKDIR", "Failed to create the preference directory: %v", err)
+			return 0
+		}
 	}
 
 	remoteSnapshot := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, revision)
+	if remoteSnapshot.IsMetadataOnly() {
+		LOG_ERROR("RESTORE_METADATA", "Revision %d is a metadata-only snapshot with no file contents to restore",
+			revision)
+		return 0
+	}
 	manager.SnapshotManager.DownloadSnapshotContents(remoteSnapshot, patterns, true)
 
-	localSnapshot, _, _, err := CreateSnapshotFromDirectory(manager.snapshotID, top, manager.nobackupFile,
-		                                                    manager.filtersFile, manager.excludeByAttribute)
+	localSnapshot, _, _, err := CreateSnapshotFromDirectory(manager.snapshotID, top, manager.markerFiles,
+		                                                    manager.filtersFile, manager.excludeByAttribute, true, false, nil)
 	if err != nil {
 		LOG_ERROR("SNAPSHOT_LIST", "Failed to list the repository: %v", err)
 		return 0
@@ -814,7 +965,7 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 	if len(patterns) > 0 {
 		for _, file := range remoteSnapshot.Files {
 
-			if MatchPath(file.Path, patterns) {
+			if MatchEntry(file, patterns) {
 				includedFiles = append(includedFiles, file)
 			}
 		}
@@ -822,6 +973,24 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 		remoteSnapshot.Files = includedFiles
 	}
 
+	if manager.restoreDeletedOnly {
+		var ok bool
+		if remoteSnapshot.Files, ok = manager.filterDeletedFiles(revision, remoteSnapshot.Files); !ok {
+			return 0
+		}
+		// Files that exist in the latest revision are not restored, so none of the local files can be extra
+		deleteMode = false
+	}
+
+	remoteSnapshot.Files = manager.mapRestorePaths(top, remoteSnapshot.Files)
+	for _, file := range remoteSnapshot.Files {
+		manager.ownerMapping.apply(file)
+	}
+
+	if manager.config.dryRun {
+		return manager.previewRestore(top, remoteSnapshot, localSnapshot, quickMode, overwrite, deleteMode, patterns)
+	}
+
 	// local files that don't exist in the remote snapshot
 	var extraFiles []string
 
@@ -840,6 +1009,7 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 	for _, entry := range remoteSnapshot.Files {
 
 		skipped := false
+		fullPath, mapped := manager.getRestorePath(top, entry.Path)
 		// Find local files that don't exist in the remote snapshot
 		for i < len(localSnapshot.Files) {
 			local := localSnapshot.Files[i]
@@ -851,7 +1021,8 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			} else {
 				if compare == 0 {
 					i++
-					if quickMode && local.IsSameAs(entry) {
+					// A relocated file is compared with the file at its new location later
+					if quickMode && !mapped && local.IsSameAs(entry) {
 						LOG_TRACE("RESTORE_SKIP", "File %s unchanged (by size and timestamp)", local.Path)
 						skippedFileSize += entry.Size
 						skippedFiles++
@@ -866,7 +1037,6 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			continue
 		}
 
-		fullPath := joinPath(top, entry.Path)
 		if entry.IsLink() {
 			stat, err := os.Lstat(fullPath)
 			if stat != nil {
@@ -888,6 +1058,23 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			}
 			entry.RestoreMetadata(fullPath, nil, setOwner)
 			LOG_TRACE("DOWNLOAD_DONE", "Symlink %s updated", entry.Path)
+		} else if entry.IsSpecial() {
+			stat, _ := os.Lstat(fullPath)
+			if stat != nil {
+				if stat.Mode()&os.ModeType == os.FileMode(entry.Mode)&os.ModeType && GetDeviceNumber(stat) == entry.Device {
+					entry.RestoreMetadata(fullPath, nil, setOwner)
+					continue
+				}
+				os.Remove(fullPath)
+			}
+
+			err = CreateSpecialFile(fullPath, entry)
+			if err != nil {
+				LOG_WARN("RESTORE_SPECIAL", "Can't create the special file %s: %v", entry.Path, err)
+				continue
+			}
+			entry.RestoreMetadata(fullPath, nil, setOwner)
+			LOG_TRACE("DOWNLOAD_DONE", "Special file %s created", entry.Path)
 		} else if entry.IsDir() {
 			stat, err := os.Stat(fullPath)
 
@@ -919,26 +1106,45 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 
 	// Sort entries by their starting chunks in order to linearize the access to the chunk chain.
 	sort.Sort(ByChunk(fileEntries))
+	queue := manager.prioritizeRestoreFiles(fileEntries)
 
-	chunkDownloader := CreateChunkDownloader(manager.config, manager.storage, nil, showStatistics, threads, allowFailures)
+	var chunkDownloader *ChunkDownloader
+	if manager.restorePrefetchMemory > 0 {
+		chunkDownloader = CreatePrefetchingChunkDownloader(manager.config, manager.storage, showStatistics, threads,
+			allowFailures, manager.restorePrefetchMemory)
+	} else {
+		chunkDownloader = CreateChunkDownloader(manager.config, manager.storage, nil, showStatistics, threads, allowFailures)
+	}
+	chunkDownloader.quarantine = manager.SnapshotManager.createChunkQuarantine()
+	chunkDownloader.failover = manager.SnapshotManager.failoverStorages
 	chunkDownloader.AddFiles(remoteSnapshot, fileEntries)
 
 	chunkMaker := CreateChunkMaker(manager.config, true)
 
 	startDownloadingTime := time.Now().Unix()
 
-	// Now download files one by one
-	for _, file := range fileEntries {
+	progress := loadRestoreProgress(manager.snapshotID, revision, top)
+	keptFiles := make(map[*Entry]bool) // existing files kept by the conflict policy
+	planner := manager.createRestorePlanner(top, fileEntries, queue, chunkDownloader)
 
-		fullPath := joinPath(top, file.Path)
+	// restoreFile restores a single file; it returns false if the restore can't continue
+	restoreFile := func(file *Entry) bool {
+		fullPath, _ := manager.getRestorePath(top, file.Path)
 		stat, _ := os.Stat(fullPath)
 		if stat != nil {
+			if progress.isCompleted(file, stat) {
+				LOG_TRACE("RESTORE_SKIP", "File %s restored by the previous restore", file.Path)
+				skippedFileSize += file.Size
+				skippedFiles++
+				return true
+			}
+
 			if quickMode {
 				if file.IsSameAsFileInfo(stat) {
 					LOG_TRACE("RESTORE_SKIP", "File %s unchanged (by size and timestamp)", file.Path)
 					skippedFileSize += file.Size
 					skippedFiles++
-					continue
+					return true
 				}
 			}
 
@@ -946,7 +1152,7 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 				LOG_TRACE("RESTORE_SKIP", "File %s unchanged (size 0)", file.Path)
 				skippedFileSize += file.Size
 				skippedFiles++
-				continue
+				return true
 			}
 		} else {
 			parent, _ := SplitDir(fullPath)
@@ -961,7 +1167,7 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			newFile, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.GetPermissions())
 			if err != nil {
 				LOG_ERROR("DOWNLOAD_OPEN", "Failed to create empty file: %v", err)
-				return 0
+				return false
 			}
 			newFile.Close()
 
@@ -972,17 +1178,23 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 				downloadedFiles = append(downloadedFiles, file)
 			}
 
-			continue
+			return true
 		}
 
 		downloaded, err := manager.RestoreFile(chunkDownloader, chunkMaker, file, top, inPlace, overwrite, showStatistics,
 			totalFileSize, downloadedFileSize, startDownloadingTime, allowFailures)
-		if err != nil {
+		if err == errFileKept {
+			// The existing file is kept as it is, including its metadata
+			keptFiles[file] = true
+			skippedFileSize += file.Size
+			skippedFiles++
+			return true
+		} else if err != nil {
 			// RestoreFile returned an error; if allowFailures is false RestoerFile would error out and not return so here
 			// we just need to show a warning
 			failedFiles++
 			LOG_WARN("DOWNLOAD_FAIL", "Failed to restore %s: %v", file.Path, err)
-			continue
+			return true
 		}
 
 		// No error
@@ -995,14 +1207,44 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			skippedFileSize += file.Size
 			skippedFiles++
 		}
+		// The file may have been restored under a new name by the conflict policy
+		fullPath, _ = manager.getRestorePath(top, file.Path)
 		file.RestoreMetadata(fullPath, nil, setOwner)
+		progress.fileCompleted(file.Path)
+		return true
 	}
 
+	// Now download files one by one
+	for index, file := range fileEntries {
+
+		queue.next(index)
+		if planner.isRestoredEarly(index) {
+			continue
+		}
+		planner.plan(index)
+
+		// Later files whose chunks have all arrived are restored while this one is waiting for its chunks
+		for early := planner.next(index, index+1); early >= 0; early = planner.next(index, early+1) {
+			LOG_DEBUG("RESTORE_EARLY", "Restoring %s while waiting for the chunks of %s", fileEntries[early].Path,
+				file.Path)
+			if !restoreFile(fileEntries[early]) {
+				return 0
+			}
+			planner.restored(early)
+		}
+
+		if !restoreFile(file) {
+			return 0
+		}
+		chunkDownloader.ReleaseFile(file)
+	}
+	queue.done()
+
 	if deleteMode && len(patterns) == 0 {
 		// Reverse the order to make sure directories are empty before being deleted
 		for i := range extraFiles {
 			file := extraFiles[len(extraFiles)-1-i]
-			fullPath := joinPath(top, file)
+			fullPath := joinRootPath(top, file)
 			os.Remove(fullPath)
 			LOG_INFO("RESTORE_DELETE", "Deleted %s", file)
 		}
@@ -1010,7 +1252,7 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 
 	for _, entry := range remoteSnapshot.Files {
 		if entry.IsDir() && !entry.IsLink() {
-			dir := joinPath(top, entry.Path)
+			dir, _ := manager.getRestorePath(top, entry.Path)
 			entry.RestoreMetadata(dir, nil, setOwner)
 		}
 	}
@@ -1021,6 +1263,40 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 		}
 	}
 
+	// Files that don't match the snapshot are counted as failed, and the progress is discarded so that they won't
+	// be skipped by the next restore
+	mismatchedFiles := 0
+	if manager.restoreVerify {
+		verifiedFiles := remoteSnapshot.Files
+		if len(keptFiles) > 0 {
+			verifiedFiles = nil
+			for _, file := range remoteSnapshot.Files {
+				if !keptFiles[file] {
+					verifiedFiles = append(verifiedFiles, file)
+				}
+			}
+		}
+		mismatchedFiles = manager.verifyRestoredFiles(top, revision, verifiedFiles)
+	}
+	progress.finish(failedFiles == 0 || mismatchedFiles > 0)
+	failedFiles += mismatchedFiles
+
+	manager.summary = OperationSummary{
+		Revision:         revision,
+		TotalFiles:       len(fileEntries),
+		TotalFileSize:    totalFileSize,
+		NewFiles:         len(downloadedFiles),
+		NewFileSize:      downloadedFileSize,
+		TransferredBytes: chunkDownloader.downloadedChunkSize,
+		SkippedFiles:     int(skippedFiles),
+		FailedFiles:      failedFiles,
+	}
+
+	if chunkDownloader.numberOfFailoverChunks > 0 {
+		LOG_WARN("RESTORE_FAILOVER", "%d chunks missing or corrupted on the storage were downloaded from the failover "+
+			"storages", chunkDownloader.numberOfFailoverChunks)
+	}
+
 	if failedFiles > 0 {
 		return failedFiles
 	}
@@ -1050,9 +1326,10 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 type fileEncoder struct {
 	top            string
 	readAttributes bool
-	files          []*Entry
+	next           func() (*Entry, error) // returns the next file, or nil after the last one
 	currentIndex   int
 	buffer         *bytes.Buffer
+	done           bool
 }
 
 // Read reads data from the embedded buffer
@@ -1063,23 +1340,27 @@ func (encoder fileEncoder) Read(data []byte) (n int, err error) {
 // NextFile switches to the next file and generates its json description in the buffer.  It also takes care of
 // the ending ']' and the commas between files.
 func (encoder *fileEncoder) NextFile() (io.Reader, bool) {
-	if encoder.currentIndex == len(encoder.files) {
+	if encoder.done {
 		return nil, false
 	}
-	if encoder.currentIndex == len(encoder.files)-1 {
+	entry, err := encoder.next()
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_ENCODE", "Failed to read the file list: %v", err)
+		return nil, false
+	}
+	if entry == nil {
 		encoder.buffer.Write([]byte("]"))
-		encoder.currentIndex++
+		encoder.done = true
 		return encoder, true
 	}
 
 	encoder.currentIndex++
-	entry := encoder.files[encoder.currentIndex]
 	if encoder.readAttributes {
 		entry.ReadAttributes(encoder.top)
 	}
 	description, err := json.Marshal(entry)
 	if err != nil {
-		LOG_FATAL("SNAPSHOT_ENCODE", "Failed to encode file %s: %v", encoder.files[encoder.currentIndex].Path, err)
+		LOG_FATAL("SNAPSHOT_ENCODE", "Failed to encode file %s: %v", entry.Path, err)
 		return nil, false
 	}
 
@@ -1103,14 +1384,19 @@ func (manager *BackupManager) UploadSnapshot(chunkMaker *ChunkMaker, uploader *C
 
 	uploader.snapshotCache = manager.snapshotCache
 
+	// The completion function is called by all uploading threads
+	var statisticsLock sync.Mutex
 	completionFunc := func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int) {
 		if skipped {
 			LOG_DEBUG("CHUNK_CACHE", "Skipped snapshot chunk %s in cache", chunk.GetID())
 		} else {
 			if uploadSize > 0 {
+				manager.recordUploadedChunk(chunk.GetHash())
+				statisticsLock.Lock()
 				numberOfNewSnapshotChunks++
 				totalUploadedSnapshotChunkSize += int64(chunkSize)
 				totalUploadedSnapshotChunkBytes += int64(uploadSize)
+				statisticsLock.Unlock()
 			} else {
 				LOG_DEBUG("CHUNK_EXIST", "Skipped snapshot chunk %s in the storage", chunk.GetID())
 			}
@@ -1143,8 +1429,8 @@ func (manager *BackupManager) UploadSnapshot(chunkMaker *ChunkMaker, uploader *C
 	}
 
 	sequences := []string{"chunks", "lengths"}
-	// The file list is assumed not to be too large when fixed-size chunking is used
-	if chunkMaker.minimumChunkSize == chunkMaker.maximumChunkSize {
+	// The file list is assumed not to be too large when fixed-size chunking is used, unless it is kept in a file
+	if chunkMaker.minimumChunkSize == chunkMaker.maximumChunkSize && snapshot.fileList == nil {
 		sequences = append(sequences, "files")
 	}
 
@@ -1167,15 +1453,33 @@ func (manager *BackupManager) UploadSnapshot(chunkMaker *ChunkMaker, uploader *C
 
 	// File sequence may be too big to fit into the memory.  So we encode files one by one and take advantages of
 	// the multi-reader capability of the chunk maker.
-	if chunkMaker.minimumChunkSize != chunkMaker.maximumChunkSize {
+	if chunkMaker.minimumChunkSize != chunkMaker.maximumChunkSize || snapshot.fileList != nil {
 		encoder := fileEncoder{
 			top:            top,
 			readAttributes: snapshot.discardAttributes,
-			files:          snapshot.Files,
 			currentIndex:   -1,
 			buffer:         new(bytes.Buffer),
 		}
 
+		if snapshot.fileList != nil {
+			reader, err := snapshot.fileList.NewReader()
+			if err != nil {
+				LOG_ERROR("SNAPSHOT_ENCODE", "Failed to read the file list: %v", err)
+				return int64(0), 0, int64(0), int64(0)
+			}
+			defer reader.Close()
+			encoder.next = reader.Next
+		} else {
+			next := 0
+			encoder.next = func() (*Entry, error) {
+				if next >= len(snapshot.Files) {
+					return nil, nil
+				}
+				next++
+				return snapshot.Files[next-1], nil
+			}
+		}
+
 		encoder.buffer.Write([]byte("["))
 		sequence := uploadSequenceFunc(encoder,
 			func(fileSize int64, hash string) (io.Reader, bool) {
@@ -1185,6 +1489,7 @@ func (manager *BackupManager) UploadSnapshot(chunkMaker *ChunkMaker, uploader *C
 	}
 
 	uploader.Stop()
+	manager.SnapshotManager.SaveRecordedChecksums(uploader.checksums)
 
 	description, err := snapshot.MarshalJSON()
 	if err != nil {
@@ -1192,7 +1497,7 @@ func (manager *BackupManager) UploadSnapshot(chunkMaker *ChunkMaker, uploader *C
 		return int64(0), 0, int64(0), int64(0)
 	}
 
-	path := fmt.Sprintf("snapshots/%s/%d", manager.snapshotID, snapshot.Revision)
+	path := fmt.Sprintf("snapshots/%s/%d", snapshot.ID, snapshot.Revision)
 	if !manager.config.dryRun {
 		manager.SnapshotManager.UploadFile(path, path, description)
 	}
@@ -1215,7 +1520,11 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 
 	preferencePath := GetDuplicacyPreferencePath()
 	temporaryPath := path.Join(preferencePath, "temporary")
-	fullPath := joinPath(top, entry.Path)
+	fullPath, mapped := manager.getRestorePath(top, entry.Path)
+	if mapped {
+		// The new location may be on a different volume, to which the temporary file can't be renamed
+		temporaryPath = fullPath + ".duplicacy_temporary"
+	}
 
 	defer func() {
 		if existingFile != nil {
@@ -1376,11 +1685,34 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 				return false, nil
 			}
 
-			// fileHash != entry.Hash, warn/error depending on -overwrite option
+			// fileHash != entry.Hash, warn/error depending on -overwrite option and the conflict policy
 			if !overwrite && !isNewFile {
-				LOG_WERROR(allowFailures, "DOWNLOAD_OVERWRITE",
-							"File %s already exists.  Please specify the -overwrite option to overwrite", entry.Path)
-				return false, fmt.Errorf("file exists")
+				stat, _ := existingFile.Stat()
+				switch manager.resolveConflict(entry, stat) {
+				case ConflictOverwrite:
+					if manager.conflictPolicy == ConflictNewer {
+						LOG_INFO("RESTORE_CONFLICT", "Overwriting %s with the newer version in the snapshot", entry.Path)
+					}
+				case ConflictSkip:
+					LOG_INFO("RESTORE_CONFLICT", "%s", manager.describeConflict(entry))
+					return false, errFileKept
+				case ConflictKeepBoth:
+					// Restore to a new file, so none of the existing chunks can be reused
+					newPath := manager.getKeepBothPath(top, entry)
+					LOG_INFO("RESTORE_CONFLICT", "%s already exists; restoring it as %s", entry.Path, newPath)
+					entry.Path = newPath
+					fullPath, _ = manager.getRestorePath(top, entry.Path)
+					existingFile.Close()
+					existingFile = nil
+					existingChunks, existingLengths = nil, nil
+					offsetMap = make(map[string]int64)
+					lengthMap = make(map[string]int)
+					offset = 0
+				default:
+					LOG_WERROR(allowFailures, "DOWNLOAD_OVERWRITE",
+								"File %s already exists.  Please specify the -overwrite option to overwrite", entry.Path)
+					return false, fmt.Errorf("file exists")
+				}
 			}
 
 		} else {
@@ -1754,29 +2086,41 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 		snapshot.ChunkHashes = nil
 	}
 
-	otherChunkFiles, otherChunkSizes := otherManager.SnapshotManager.ListAllFiles(otherManager.storage, "chunks/")
+	var chunksToCopy []string
 
-	for i, otherChunkID := range otherChunkFiles {
-		otherChunkID = strings.Replace(otherChunkID, "/", "", -1)
-		if len(otherChunkID) != 64 {
-			continue
-		}
-		if otherChunkSizes[i] == 0 {
-			LOG_DEBUG("SNAPSHOT_COPY", "Chunk %s has length = 0", otherChunkID)
-			continue
-		}
-		otherChunks[otherChunkID] = false
-	}
+	// An interrupted copy of the same revisions knows which chunks are missing from the destination
+	copyRevisions := getCopyRevisions(snapshots, revisionMap)
+	progress := otherManager.SnapshotManager.loadCopyProgress(copyRevisions)
+	if progress != nil {
+		chunksToCopy = progress.getRemainingChunks()
+		LOG_INFO("COPY_RESUME", "Resuming the interrupted copy with %d of %d chunks already copied",
+			len(progress.Chunks) - len(chunksToCopy), len(progress.Chunks))
+	} else {
+		otherChunkFiles, otherChunkSizes := otherManager.SnapshotManager.ListAllFiles(otherManager.storage, "chunks/")
 
-	LOG_DEBUG("SNAPSHOT_COPY", "Found %d chunks on destination storage", len(otherChunks))
+		for i, otherChunkID := range otherChunkFiles {
+			otherChunkID = strings.Replace(otherChunkID, "/", "", -1)
+			if len(otherChunkID) != 64 {
+				continue
+			}
+			if otherChunkSizes[i] == 0 {
+				LOG_DEBUG("SNAPSHOT_COPY", "Chunk %s has length = 0", otherChunkID)
+				continue
+			}
+			otherChunks[otherChunkID] = false
+		}
 
-	var chunksToCopy []string
+		LOG_DEBUG("SNAPSHOT_COPY", "Found %d chunks on destination storage", len(otherChunks))
 
-	for chunkHash := range chunks {
-		otherChunkID := otherManager.config.GetChunkIDFromHash(chunkHash)
-		if _, found := otherChunks[otherChunkID]; !found {
-			chunksToCopy = append(chunksToCopy, chunkHash)
+		for chunkHash := range chunks {
+			otherChunkID := otherManager.config.GetChunkIDFromHash(chunkHash)
+			if _, found := otherChunks[otherChunkID]; !found {
+				chunksToCopy = append(chunksToCopy, chunkHash)
+			}
 		}
+
+		progress = createCopyProgress(copyRevisions, chunksToCopy)
+		progress.save(otherManager.SnapshotManager)
 	}
 
 	LOG_INFO("SNAPSHOT_COPY", "Chunks to copy: %d, to skip: %d, total: %d", len(chunksToCopy), len(chunks) - len(chunksToCopy), len(chunks))
@@ -1805,7 +2149,12 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 					action, chunk.GetID(), chunkIndex + 1, len(chunksToCopy),
 					PrettySize(speed), PrettyTime(remainingTime), percentage)
 			otherManager.config.PutChunk(chunk)
+
+			if progress.chunkCopied(chunksToCopy[chunkIndex]) {
+				progress.save(otherManager.SnapshotManager)
+			}
 		})
+	chunkUploader.skipExistenceCheck = manager.skipExistingVerify
 
 	chunkUploader.Start()
 
@@ -1826,6 +2175,7 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 
 	chunkDownloader.Stop()
 	chunkUploader.Stop()
+	otherManager.SnapshotManager.SaveRecordedChecksums(chunkUploader.checksums)
 
 	LOG_INFO("SNAPSHOT_COPY", "Copied %d new chunks and skipped %d existing chunks", copiedChunks, len(chunks) - copiedChunks)
 
@@ -1836,9 +2186,11 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 		otherManager.storage.CreateDirectory(0, fmt.Sprintf("snapshots/%s", snapshot.ID))
 		description, _ := snapshot.MarshalJSON()
 		path := fmt.Sprintf("snapshots/%s/%d", snapshot.ID, snapshot.Revision)
-		otherManager.SnapshotManager.UploadFile(path, path, description)
+		otherManager.SnapshotManager.UploadFileOnce(path, path, description)
 		LOG_INFO("SNAPSHOT_COPY", "Copied snapshot %s at revision %d", snapshot.ID, snapshot.Revision)
 	}
 
+	otherManager.SnapshotManager.finishUploadedFiles()
+	otherManager.SnapshotManager.removeCopyProgress()
 	return true
 }
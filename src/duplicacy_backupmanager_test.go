@@ -354,7 +354,7 @@ func TestBackupManager(t *testing.T) {
 		}
 	}
 
-	numberOfSnapshots := backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false)
+	numberOfSnapshots := backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false /*showStatistics*/, false)
 	if numberOfSnapshots != 3 {
 		t.Errorf("Expected 3 snapshots but got %d", numberOfSnapshots)
 	}
@@ -362,7 +362,7 @@ func TestBackupManager(t *testing.T) {
 		/*showStatistics*/ false /*showTabular*/, false /*checkFiles*/, false /*checkChunks*/, false /*searchFossils*/, false /*resurrect*/, false, 1 /*allowFailures*/, false)
 	backupManager.SnapshotManager.PruneSnapshots("host1", "host1" /*revisions*/, []int{1} /*tags*/, nil /*retentions*/, nil,
 		/*exhaustive*/ false /*exclusive=*/, false /*ignoredIDs*/, nil /*dryRun*/, false /*deleteOnly*/, false /*collectOnly*/, false, 1)
-	numberOfSnapshots = backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false)
+	numberOfSnapshots = backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false /*showStatistics*/, false)
 	if numberOfSnapshots != 2 {
 		t.Errorf("Expected 2 snapshots but got %d", numberOfSnapshots)
 	}
@@ -371,7 +371,7 @@ func TestBackupManager(t *testing.T) {
 	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, false, threads, "fourth", false, false, 0, false)
 	backupManager.SnapshotManager.PruneSnapshots("host1", "host1" /*revisions*/, nil /*tags*/, nil /*retentions*/, nil,
 		/*exhaustive*/ false /*exclusive=*/, true /*ignoredIDs*/, nil /*dryRun*/, false /*deleteOnly*/, false /*collectOnly*/, false, 1)
-	numberOfSnapshots = backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false)
+	numberOfSnapshots = backupManager.SnapshotManager.ListSnapshots( /*snapshotID*/ "host1" /*revisionsToList*/, nil /*tag*/, "" /*showFiles*/, false /*showChunks*/, false /*showStatistics*/, false)
 	if numberOfSnapshots != 3 {
 		t.Errorf("Expected 3 snapshots but got %d", numberOfSnapshots)
 	}
@@ -720,4 +720,115 @@ func TestPersistRestore(t *testing.T) {
 		checkAllUncorrupted("/repository3")
 	}
 
-}
\ No newline at end of file
+}
+func TestBackupStdin(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "stdin")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir+"/repository/.duplicacy", 0700)
+	os.MkdirAll(testDir+"/restored", 0700)
+
+	// The data piped to the backup is read from the standard input
+	input := testDir + "/input"
+	createRandomFile(input, 500000)
+	stdin, err := os.Open(input)
+	if err != nil {
+		t.Fatalf("Failed to open the input: %v", err)
+	}
+	defer stdin.Close()
+	originalStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = originalStdin }()
+
+	storage, err := loadStorage(testDir+"/storage", 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(testDir + "/repository/.duplicacy")
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	backupManager.SetStdinName("dump.sql")
+	if !backupManager.Backup(testDir+"/repository", true, 1, "stdin", false, false, 0, false) {
+		t.Fatalf("The backup from the standard input failed")
+	}
+
+	if failed := backupManager.Restore(testDir+"/restored", 1, true, false, 1, false, false, false, false, nil,
+		false); failed != 0 {
+		t.Errorf("%d files failed to be restored", failed)
+	}
+
+	inputInfo, _ := os.Stat(input)
+	restoredInfo, err := os.Stat(testDir + "/restored/dump.sql")
+	if err != nil {
+		t.Fatalf("The entry read from the standard input wasn't restored: %v", err)
+	}
+	if restoredInfo.Size() != inputInfo.Size() {
+		t.Errorf("The restored entry has a size of %d instead of %d", restoredInfo.Size(), inputInfo.Size())
+	}
+	if hash1, hash2 := getFileHash(input), getFileHash(testDir+"/restored/dump.sql"); hash1 != hash2 {
+		t.Errorf("The restored entry has a hash of %s instead of %s", hash2, hash1)
+	}
+
+	if snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 1); !snapshot.IsStdin() {
+		t.Errorf("Revision 1 has options '%s'", snapshot.Options)
+	}
+
+	// Backups of a repository and from the standard input can't share a snapshot id
+	expectStdinError := func(backupManager *BackupManager) {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(Exception); !ok || e.LogID != "BACKUP_STDIN" {
+					panic(r)
+				}
+			}
+		}()
+		setTestingT(nil)
+		defer setTestingT(t)
+		backupManager.Backup(testDir+"/repository", true, 1, "", false, false, 0, false)
+		t.Errorf("The backup with a snapshot id used by the other kind of backups didn't fail")
+	}
+	createRandomFile(testDir+"/repository/file", 1000)
+	repositoryManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	repositoryManager.SetupSnapshotCache("default")
+	expectStdinError(repositoryManager)
+
+	repositoryManager = CreateBackupManager("host2", storage, testDir, "", "", "", false)
+	repositoryManager.SetupSnapshotCache("default")
+	if !repositoryManager.Backup(testDir+"/repository", true, 1, "", false, false, 0, false) {
+		t.Fatalf("The backup of the repository failed")
+	}
+	stdinManager := CreateBackupManager("host2", storage, testDir, "", "", "", false)
+	stdinManager.SetupSnapshotCache("default")
+	stdinManager.SetStdinName("dump.sql")
+	expectStdinError(stdinManager)
+
+	// While another backup from the standard input under the same id follows the first one
+	if os.Stdin, err = os.Open(input); err != nil {
+		t.Fatalf("Failed to open the input: %v", err)
+	}
+	defer os.Stdin.Close()
+	if !backupManager.Backup(testDir+"/repository", true, 1, "", false, false, 0, false) {
+		t.Errorf("The second backup from the standard input failed")
+	}
+}
@@ -0,0 +1,659 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// canStreamBackup returns true if the backup can pack files while the repository is still being listed, so that it
+// never needs all the entries in memory.  This is the case unless the backup reads the standard input, uses the
+// change journal, or resumes an incomplete backup.  Backups in the quick mode compare the listing with the files of
+// the previous snapshot as they are read.
+func (manager *BackupManager) canStreamBackup(remoteSnapshot *Snapshot, quickMode bool, enumOnly bool) bool {
+
+	if manager.stdinName != "" || manager.metadataOnly || manager.changeSet != nil || manager.changeJournal ||
+		enumOnly {
+		return false
+	}
+
+	// An incomplete snapshot is only loaded in the quick mode
+	if remoteSnapshot.Revision == 0 && quickMode {
+		if _, err := os.Stat(joinPath(GetDuplicacyPreferencePath(), "incomplete")); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// previousFiles finds the files unchanged since the previous snapshot for a backup in the quick mode.  The files of
+// the previous snapshot are read one at a time along with the listing, since both are in the same order.
+type previousFiles struct {
+	snapshot   *Snapshot
+	reader     *snapshotFileReader
+	current    *Entry // the last file read from the previous snapshot
+	done       bool
+	usedChunks []bool // whether each chunk of the previous snapshot is referenced by an unchanged file
+}
+
+// createPreviousFiles downloads the chunks of 'snapshot' in order to compare its files with the listing.
+func (manager *BackupManager) createPreviousFiles(snapshot *Snapshot) *previousFiles {
+	if len(snapshot.ChunkLengths) == 0 {
+		manager.SnapshotManager.DownloadSnapshotSequence(snapshot, "lengths")
+	}
+	if len(snapshot.ChunkHashes) != len(snapshot.ChunkLengths) {
+		LOG_ERROR("SNAPSHOT_CHECK", "The snapshot %s at revision %d contains an error: "+
+			"The number of chunk hashes (%d) is different from the number of chunk lengths (%d)",
+			snapshot.ID, snapshot.Revision, len(snapshot.ChunkHashes), len(snapshot.ChunkLengths))
+		return nil
+	}
+	return &previousFiles{
+		snapshot:   snapshot,
+		reader:     manager.SnapshotManager.createSnapshotFileReader(snapshot),
+		usedChunks: make([]bool, len(snapshot.ChunkHashes)),
+	}
+}
+
+// find returns true if 'local' is unchanged since the previous snapshot, in which case it is given the contents of
+// the file in the previous snapshot.  It must be called with the listed files in order.
+func (previous *previousFiles) find(local *Entry) bool {
+
+	for !previous.done && (previous.current == nil || !previous.current.IsFile() ||
+		previous.current.Compare(local) < 0) {
+		current, err := previous.reader.Next()
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PARSE", "Failed to load files specified in the snapshot %s at revision %d: %v",
+				previous.snapshot.ID, previous.snapshot.Revision, err)
+			return false
+		}
+		previous.current = current
+		previous.done = current == nil
+	}
+
+	remote := previous.current
+	if remote == nil || remote.Path != local.Path || !local.IsSameAs(remote) {
+		return false
+	}
+
+	if remote.StartChunk < 0 || remote.EndChunk < remote.StartChunk || remote.EndChunk >= len(previous.usedChunks) {
+		LOG_ERROR("SNAPSHOT_CHECK", "The snapshot %s at revision %d contains an error: "+
+			"The file %s starts at chunk %d and ends at chunk %d while the number of chunks is %d",
+			previous.snapshot.ID, previous.snapshot.Revision, remote.Path, remote.StartChunk, remote.EndChunk,
+			len(previous.usedChunks))
+		return false
+	}
+
+	local.Hash = remote.Hash
+	local.StartChunk = remote.StartChunk
+	local.StartOffset = remote.StartOffset
+	local.EndChunk = remote.EndChunk
+	local.EndOffset = remote.EndOffset
+	for i := remote.StartChunk; i <= remote.EndChunk; i++ {
+		previous.usedChunks[i] = true
+	}
+	return true
+}
+
+// preservedChunks returns the chunks of the previous snapshot referenced by the unchanged files, and where each chunk
+// of the previous snapshot is among them.
+func (previous *previousFiles) preservedChunks() (chunkHashes []string, chunkLengths []int, newIndices []int) {
+	newIndices = make([]int, len(previous.usedChunks))
+	for i, used := range previous.usedChunks {
+		newIndices[i] = len(chunkHashes)
+		if used {
+			chunkHashes = append(chunkHashes, previous.snapshot.ChunkHashes[i])
+			chunkLengths = append(chunkLengths, previous.snapshot.ChunkLengths[i])
+		}
+	}
+	return chunkHashes, chunkLengths, newIndices
+}
+
+// setPreservedContent returns a copy of 'files' in which the unchanged files reference the chunks preserved from the
+// previous snapshot as given by 'newIndices', and the files at 'packedPositions' in the list, which have been packed
+// into 'chunkLengths' in order, have their contents set to follow the preserved chunks.  Packed files whose ends
+// can't be found are marked as unprocessed, as setEntryContent does.
+func setPreservedContent(files *entryList, packedPositions []int, newIndices []int, numberOfPreservedChunks int,
+	chunkLengths []int) (*entryList, error) {
+
+	reader, err := files.NewReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	list := createEntryList()
+	var tracker entryContentTracker
+	for position := 0; ; position++ {
+		entry, err := reader.Next()
+		if err != nil {
+			list.Close()
+			return nil, err
+		}
+		if entry == nil {
+			return list, nil
+		}
+
+		if len(packedPositions) > 0 && packedPositions[0] == position {
+			packedPositions = packedPositions[1:]
+			tracker.addFile(entry)
+			tracker.advance(chunkLengths)
+			// Files are completed in order, so this file is complete unless some file is still pending
+			if len(tracker.files) > 0 {
+				entry.Size = -1
+			} else {
+				entry.StartChunk += numberOfPreservedChunks
+				entry.EndChunk += numberOfPreservedChunks
+			}
+		} else if entry.IsFile() && entry.Size > 0 {
+			entry.StartChunk = newIndices[entry.StartChunk]
+			entry.EndChunk = newIndices[entry.EndChunk]
+		}
+
+		if err = list.Add(entry); err != nil {
+			list.Close()
+			return nil, err
+		}
+	}
+}
+
+// entryContentTracker sets the start and end of each packed file as soon as the chunks containing the file have been
+// made, in the same way setEntryContent would do after all chunks are made.
+type entryContentTracker struct {
+	files []*Entry // packed files whose ends haven't been found; the first one has its start set
+	ends  []int64  // where each file in 'files' ends in the packed content
+
+	packedSize int64 // the total size of the files packed so far
+	chunk      int   // the chunk being compared with the end of the first file
+	chunkStart int64 // where 'chunk' starts in the packed content
+
+	nextStartChunk  int // where the file packed after the last one in 'files' will start
+	nextStartOffset int
+}
+
+// addFile records 'entry' as the next file that has been packed.
+func (tracker *entryContentTracker) addFile(entry *Entry) {
+	if len(tracker.files) == 0 {
+		entry.StartChunk = tracker.nextStartChunk
+		entry.StartOffset = tracker.nextStartOffset
+	}
+	tracker.packedSize += entry.Size
+	tracker.files = append(tracker.files, entry)
+	tracker.ends = append(tracker.ends, tracker.packedSize)
+}
+
+// advance sets the ends of the packed files that are complete with 'chunkLengths', the lengths of all chunks made
+// so far.
+func (tracker *entryContentTracker) advance(chunkLengths []int) {
+	for len(tracker.files) > 0 && tracker.chunk < len(chunkLengths) {
+		chunkEnd := tracker.chunkStart + int64(chunkLengths[tracker.chunk])
+		end := tracker.ends[0]
+		if chunkEnd < end {
+			tracker.chunkStart = chunkEnd
+			tracker.chunk++
+			continue
+		}
+
+		entry := tracker.files[0]
+		entry.EndChunk = tracker.chunk
+		entry.EndOffset = int(end - tracker.chunkStart)
+
+		// If the current file ends at the end of the current chunk, the next file will start at the next chunk
+		if chunkEnd == end {
+			tracker.nextStartChunk = tracker.chunk + 1
+			tracker.nextStartOffset = 0
+		} else {
+			tracker.nextStartChunk = tracker.chunk
+			tracker.nextStartOffset = int(end - tracker.chunkStart)
+		}
+
+		tracker.files = tracker.files[1:]
+		tracker.ends = tracker.ends[1:]
+		if len(tracker.files) > 0 {
+			tracker.files[0].StartChunk = tracker.nextStartChunk
+			tracker.files[0].StartOffset = tracker.nextStartOffset
+		}
+	}
+}
+
+// isPending returns true if 'entry' has been packed but its end hasn't been found yet.  Only the first entry not
+// added to the file list can be checked this way.
+func (tracker *entryContentTracker) isPending(entry *Entry) bool {
+	return len(tracker.files) > 0 && tracker.files[0] == entry
+}
+
+// processedFiles returns a function that returns the entries read by 'reader', stopping before the first file that
+// hasn't been processed, or if 'confirmed' is not negative, before the first file packed into chunks other than the
+// first 'confirmed' chunks.
+func processedFiles(reader *entryListReader, confirmed int) func() (*Entry, error) {
+	done := false
+	return func() (*Entry, error) {
+		if done {
+			return nil, nil
+		}
+		entry, err := reader.Next()
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		if entry.IsFile() && (entry.Size < 0 || (confirmed >= 0 && entry.Hash != "" && entry.EndChunk >= confirmed)) {
+			done = true
+			return nil, nil
+		}
+		return entry, nil
+	}
+}
+
+// backupStreaming creates a snapshot while the repository is being listed.  The entries are kept in an entryList
+// instead of the Files of the snapshot, and added to the list in the order they are listed once the chunks of the
+// files have been made.  In the quick mode, files unchanged since the previous snapshot are found by reading the files
+// of the previous snapshot along with the listing, and only the other files are packed.
+func (manager *BackupManager) backupStreaming(top string, shadowTop string, remoteSnapshot *Snapshot, quickMode bool,
+	tag string, shadowCopy bool, threads int, showStatistics bool, startTime int64) bool {
+
+	localSnapshot := CreateEmptySnapshot(manager.snapshotID)
+	localSnapshot.Revision = remoteSnapshot.Revision + 1
+	fileList := createEntryList()
+	localSnapshot.fileList = fileList
+
+	patterns := ProcessFilters(getFiltersFile(manager.filtersFile))
+
+	// Files in a metadata-only snapshot have no contents to be shared with the new snapshot
+	noPreviousContent := remoteSnapshot.IsMetadataOnly()
+	if noPreviousContent {
+		LOG_INFO("BACKUP_METADATA", "Uploading all files as revision %d is a metadata-only snapshot",
+			remoteSnapshot.Revision)
+	}
+	compareMode := quickMode && remoteSnapshot.Revision > 0 && !noPreviousContent
+
+	// This cache contains all chunks referenced by last snasphot. Any other chunks will lead to a call to
+	// UploadChunk.  It is filled once the listing has started.
+	chunkCache := make(map[string]bool)
+
+	// The total size isn't known until the listing is done
+	upload := manager.createBackupUpload(chunkCache, threads, 0, showStatistics)
+
+	// Entries are listed by another goroutine and passed through the channel
+	scanned := make(chan *Entry, 1024)
+	stopScanning := make(chan struct{})
+	defer close(stopScanning)
+
+	var skippedDirectories, skippedFiles []string
+	var scanErr error
+	go func() {
+		defer close(scanned)
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(Exception); ok {
+					scanErr = fmt.Errorf("%s", e.Message)
+				} else {
+					scanErr = fmt.Errorf("%v", r)
+				}
+			}
+		}()
+		skippedDirectories, skippedFiles, scanErr = scanRepository(shadowTop, patterns, manager.markerFiles,
+			manager.excludeByAttribute, manager.specialFiles, manager.oneFileSystem, nil, nil,
+			func(entries []*Entry) bool {
+				for _, entry := range entries {
+					if entry.Path == "" {
+						continue
+					}
+					// In the compare mode only the modified files are counted, when they are compared
+					if entry.IsFile() && !compareMode {
+						atomic.AddInt64(&upload.totalModifiedFileSize, entry.Size)
+					}
+					select {
+					case scanned <- entry:
+					case <-stopScanning:
+						return false
+					}
+				}
+				return true
+			})
+	}()
+
+	if remoteSnapshot.Revision > 0 {
+		for _, chunkID := range manager.SnapshotManager.GetSnapshotChunks(remoteSnapshot, true) {
+			chunkCache[chunkID] = true
+		}
+	} else if manager.storage.IsFastListing() {
+		manager.listAllChunks(chunkCache)
+	}
+
+	var previous *previousFiles
+	if compareMode {
+		previous = manager.createPreviousFiles(remoteSnapshot)
+	}
+
+	firstEntry, found := <-scanned
+	if !found {
+		if scanErr != nil {
+			LOG_ERROR("LIST_FAILURE", "Failed to list the repository root: %v", scanErr)
+			return false
+		}
+		LOG_ERROR("SNAPSHOT_EMPTY", "No files under the repository to be backed up")
+		return false
+	}
+
+	var numberOfUploadedFiles int
+	var uploadedFileSize int64
+	var numberOfPreservedFiles int
+	var preservedFileSize int64
+
+	// Entries taken from the listing that haven't been added to the file list, either because they are being packed
+	// or because the chunks containing their ends haven't been made yet.  These and the tracker are only accessed by
+	// this goroutine, while the file list and the uploaded chunks may be read by other threads saving the incomplete
+	// snapshot.
+	var pendingEntries []*Entry
+	var tracker entryContentTracker
+	var uploadedChunkHashes []string
+	var uploadedChunkLengths []int
+	var uploadedChunkLock = &sync.Mutex{}
+
+	// In the compare mode the contents of the packed files are only set once the number of preserved chunks is known,
+	// so the packed files are added to the list without waiting for their ends, and their positions are recorded
+	var packedEntries []*Entry
+	var packedPositions []int
+
+	// addCompletedEntries moves the pending entries whose contents are known to the file list.  It must be called with
+	// uploadedChunkLock held.
+	addCompletedEntries := func(all bool) {
+		for len(pendingEntries) > 0 {
+			entry := pendingEntries[0]
+			if !all && entry.IsFile() && (entry.Size < 0 || tracker.isPending(entry)) {
+				break
+			}
+			if len(packedEntries) > 0 && packedEntries[0] == entry {
+				packedPositions = append(packedPositions, fileList.Len())
+				packedEntries = packedEntries[1:]
+			}
+			if err := fileList.Add(entry); err != nil {
+				LOG_ERROR("SNAPSHOT_LIST", "Failed to save the file list: %v", err)
+			}
+			pendingEntries = pendingEntries[1:]
+		}
+	}
+
+	// nextEntry returns the next entry to be given to the file reader.  It must be called with uploadedChunkLock
+	// held.
+	nextEntry := func() *Entry {
+		for {
+			entry := firstEntry
+			if entry == nil {
+				entry = <-scanned
+				if entry == nil {
+					return nil
+				}
+			}
+			firstEntry = nil
+			pendingEntries = append(pendingEntries, entry)
+
+			if previous == nil {
+				// Set all file sizes to -1 to indicate they haven't been processed
+				entry.Size = -1
+				return entry
+			}
+
+			if !entry.IsFile() || entry.Size == 0 {
+				return entry
+			}
+
+			// An unchanged file isn't given to the file reader, and since the files before it have all been packed,
+			// it can be added to the list at once
+			if previous.find(entry) {
+				numberOfPreservedFiles++
+				preservedFileSize += entry.Size
+				addCompletedEntries(false)
+				continue
+			}
+
+			atomic.AddInt64(&upload.totalModifiedFileSize, entry.Size)
+			entry.Size = -1
+			return entry
+		}
+	}
+
+	uploadedChunkLock.Lock()
+	fileReader := CreateFileReaderFromSource(shadowTop, nextEntry, manager.openRetryOptions)
+	addCompletedEntries(false)
+	uploadedChunkLock.Unlock()
+
+	var once sync.Once
+
+	// Checkpoints are only needed when an incomplete snapshot would be saved on errors
+	if remoteSnapshot.Revision == 0 && !manager.config.dryRun {
+		upload.checkpoint = createBackupCheckpoint()
+		upload.saveCheckpoint = func(confirmed int) {
+			// Only the files added to the list so far are read, so the list can still be added to while the
+			// checkpoint is being saved
+			uploadedChunkLock.Lock()
+			reader, err := fileList.NewReader()
+			// A chunk found in the cache is completed before it is added to the uploaded chunks
+			if confirmed > len(uploadedChunkHashes) {
+				confirmed = len(uploadedChunkHashes)
+			}
+			chunkHashes := uploadedChunkHashes[:confirmed]
+			chunkLengths := uploadedChunkLengths[:confirmed]
+			uploadedChunkLock.Unlock()
+			if err != nil {
+				LOG_WARN("INCOMPLETE_WRITE", "Failed to save the incomplete snapshot: %v", err)
+				return
+			}
+			saveIncompleteFiles(processedFiles(reader, confirmed), chunkHashes, chunkLengths, true)
+			reader.Close()
+		}
+	}
+
+	// The files in the list are read back when saving the incomplete snapshot, so the list can't be removed until
+	// RunAtError has been called
+	defer func() {
+		if r := recover(); r != nil {
+			RunAtError()
+			RunAtError = func() {}
+			fileList.Close()
+			panic(r)
+		}
+		fileList.Close()
+	}()
+
+	// The incomplete snapshot from a dry run is useless
+	if remoteSnapshot.Revision == 0 && !manager.config.dryRun {
+		// In case an error occurs during the initial backup, save the incomplete snapshot
+		RunAtError = func() {
+			once.Do(
+				func() {
+					// Lock it to gain exclusive access to the file list and uploadedChunkHashes
+					uploadedChunkLock.Lock()
+					reader, err := fileList.NewReader()
+					chunkHashes := uploadedChunkHashes
+					chunkLengths := uploadedChunkLengths
+					uploadedChunkLock.Unlock()
+					if err != nil {
+						LOG_WARN("INCOMPLETE_WRITE", "Failed to save the incomplete snapshot: %v", err)
+						return
+					}
+					defer reader.Close()
+					saveIncompleteFiles(processedFiles(reader, -1), chunkHashes, chunkLengths, false)
+				})
+		}
+	}
+
+	if fileReader.CurrentFile != nil {
+
+		LOG_TRACE("PACK_START", "Packing %s", fileReader.CurrentEntry.Path)
+
+		if threads < 1 {
+			threads = 1
+		}
+		upload.start(threads)
+
+		// Break files into chunks
+		upload.chunkMaker.ForEachChunk(
+			upload.progress.StartFile(fileReader.CurrentEntry, fileReader.CurrentFile),
+			func(chunk *Chunk, final bool) {
+
+				hash := chunk.GetHash()
+				chunkSize := chunk.GetLength()
+				if !upload.uploadChunk(chunk) {
+					return
+				}
+
+				func() {
+					uploadedChunkLock.Lock()
+					defer uploadedChunkLock.Unlock()
+					uploadedChunkHashes = append(uploadedChunkHashes, hash)
+					uploadedChunkLengths = append(uploadedChunkLengths, chunkSize)
+					tracker.advance(uploadedChunkLengths)
+					addCompletedEntries(false)
+				}()
+
+				upload.checkChunkToFail(len(uploadedChunkHashes))
+			},
+			func(fileSize int64, hash string) (io.Reader, bool) {
+
+				uploadedChunkLock.Lock()
+				defer uploadedChunkLock.Unlock()
+
+				// This function is called when a new file is needed
+				entry := fileReader.CurrentEntry
+				entry.Hash = hash
+				entry.Size = fileSize
+				if previous == nil {
+					tracker.addFile(entry)
+					tracker.advance(uploadedChunkLengths)
+				} else {
+					packedEntries = append(packedEntries, entry)
+				}
+				numberOfUploadedFiles++
+				uploadedFileSize += fileSize
+
+				if upload.bar != nil {
+					LOG_TRACE("PACK_END", "Packed %s (%d)", entry.Path, entry.Size)
+				} else if !showStatistics || IsTracing() || RunInBackground {
+					LOG_INFO("PACK_END", "Packed %s (%d)", entry.Path, entry.Size)
+				}
+
+				fileReader.NextFile()
+				addCompletedEntries(false)
+
+				if fileReader.CurrentFile != nil {
+					LOG_TRACE("PACK_START", "Packing %s", fileReader.CurrentEntry.Path)
+					return upload.progress.StartFile(fileReader.CurrentEntry, fileReader.CurrentFile), true
+				}
+				return nil, false
+			})
+
+		upload.stop()
+	}
+
+	if scanErr != nil {
+		LOG_ERROR("SNAPSHOT_LIST", "Failed to list the directory %s: %v", top, scanErr)
+		return false
+	}
+
+	// Files whose ends can't be found are marked as unprocessed, as setEntryContent does
+	func() {
+		uploadedChunkLock.Lock()
+		defer uploadedChunkLock.Unlock()
+		tracker.advance(uploadedChunkLengths)
+		for _, entry := range tracker.files {
+			entry.Size = -1
+		}
+		addCompletedEntries(true)
+	}()
+
+	localSnapshot.ChunkHashes = uploadedChunkHashes
+	localSnapshot.ChunkLengths = uploadedChunkLengths
+
+	// The unchanged files keep the chunks they reference in the previous snapshot, which are placed before the chunks
+	// of the packed files
+	if previous != nil {
+		preservedChunkHashes, preservedChunkLengths, newIndices := previous.preservedChunks()
+		list, err := setPreservedContent(fileList, packedPositions, newIndices, len(preservedChunkHashes),
+			uploadedChunkLengths)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to save the file list: %v", err)
+			return false
+		}
+		fileList.Close()
+		fileList = list
+		localSnapshot.fileList = list
+		localSnapshot.ChunkHashes = append(preservedChunkHashes, uploadedChunkHashes...)
+		localSnapshot.ChunkLengths = append(preservedChunkLengths, uploadedChunkLengths...)
+		localSnapshot.preservedChunks = len(preservedChunkHashes)
+	}
+
+	localSnapshot.EndTime = time.Now().Unix()
+
+	err := manager.SnapshotManager.CheckSnapshot(localSnapshot)
+	if err != nil {
+		RunAtError = func() {} // Don't save the incomplete snapshot
+		LOG_ERROR("SNAPSHOT_CHECK", "The snapshot contains an error: %v", err)
+		return false
+	}
+
+	localSnapshot.Tag = tag
+	localSnapshot.Note = manager.backupNote
+	localSnapshot.Options = ""
+	if previous == nil {
+		localSnapshot.Options = "-hash"
+	}
+
+	if _, found := os.LookupEnv("DUPLICACY_FAIL_SNAPSHOT"); found {
+		LOG_ERROR("SNAPSHOT_FAIL", "Artificially fail the backup for testing purposes")
+		return false
+	}
+
+	if shadowCopy {
+		if localSnapshot.Options == "" {
+			localSnapshot.Options = "-vss"
+		} else {
+			localSnapshot.Options += " -vss"
+		}
+	}
+
+	localSnapshot.FileSize = preservedFileSize + uploadedFileSize
+	localSnapshot.NumberOfFiles = int64(numberOfPreservedFiles + numberOfUploadedFiles)
+
+	upload.uploadSnapshot(top, localSnapshot)
+
+	if showStatistics && !RunInBackground {
+		reader, err := fileList.NewReader()
+		for position := 0; err == nil; position++ {
+			var entry *Entry
+			if entry, err = reader.Next(); err != nil || entry == nil {
+				break
+			}
+			// Unchanged files have hashes too, so in the compare mode the packed files are known by their positions
+			packed := entry.IsFile() && entry.Hash != ""
+			if previous != nil {
+				packed = len(packedPositions) > 0 && packedPositions[0] == position
+				if packed {
+					packedPositions = packedPositions[1:]
+				}
+			}
+			if packed {
+				LOG_INFO("UPLOAD_FILE", "Uploaded %s (%d)", entry.Path, entry.Size)
+			}
+		}
+		if reader != nil {
+			reader.Close()
+		}
+	}
+
+	skippedFiles = manager.logSkippedEntries(skippedDirectories, skippedFiles, fileReader)
+	upload.finish(top, localSnapshot, numberOfUploadedFiles, uploadedFileSize)
+
+	if !manager.verifyUploadedChunks(threads) {
+		return false
+	}
+
+	upload.report(localSnapshot, numberOfUploadedFiles, uploadedFileSize, skippedDirectories, skippedFiles, startTime)
+
+	return true
+}
@@ -0,0 +1,278 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestEntryContentTracker(t *testing.T) {
+
+	for round := 0; round < 100; round++ {
+		var files, expected []*Entry
+		var totalSize int64
+		numberOfFiles := 1 + rand.Intn(20)
+		for i := 0; i < numberOfFiles; i++ {
+			size := int64(0)
+			if rand.Intn(4) != 0 {
+				size = int64(1 + rand.Intn(300))
+			}
+			totalSize += size
+			files = append(files, CreateEntry(fmt.Sprintf("file%d", i), size, 0, 0644))
+			expected = append(expected, CreateEntry(fmt.Sprintf("file%d", i), size, 0, 0644))
+		}
+
+		var chunkLengths []int
+		for remaining := totalSize; remaining > 0; {
+			length := int64(1 + rand.Intn(100))
+			if length > remaining {
+				length = remaining
+			}
+			chunkLengths = append(chunkLengths, int(length))
+			remaining -= length
+		}
+		setEntryContent(expected, chunkLengths, 0)
+
+		// Chunks may be made before or after the files in them are packed
+		var tracker entryContentTracker
+		packed, made := 0, 0
+		for packed < len(files) || made < len(chunkLengths) {
+			if packed < len(files) && (made == len(chunkLengths) || rand.Intn(2) == 0) {
+				tracker.addFile(files[packed])
+				packed++
+			} else {
+				made++
+			}
+			tracker.advance(chunkLengths[:made])
+		}
+
+		for i, file := range files {
+			if len(chunkLengths) == 0 {
+				break
+			}
+			if file.StartChunk != expected[i].StartChunk || file.StartOffset != expected[i].StartOffset ||
+				file.EndChunk != expected[i].EndChunk || file.EndOffset != expected[i].EndOffset {
+				t.Errorf("File %d has content %d:%d:%d:%d instead of %d:%d:%d:%d", i, file.StartChunk,
+					file.StartOffset, file.EndChunk, file.EndOffset, expected[i].StartChunk, expected[i].StartOffset,
+					expected[i].EndChunk, expected[i].EndOffset)
+			}
+		}
+	}
+}
+
+func TestBackupStreaming(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	// The file list is moved to a temporary file early
+	memoryLimit := entryListMemoryLimit
+	entryListMemoryLimit = 5
+	defer func() { entryListMemoryLimit = memoryLimit }()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "backupstreaming")
+	os.RemoveAll(testDir)
+
+	repository := joinPath(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	for i := 0; i < 4; i++ {
+		directory := joinPath(repository, fmt.Sprintf("dir%d/subdir", i))
+		os.MkdirAll(directory, 0700)
+		for j := 0; j < 5; j++ {
+			createRandomFile(joinPath(directory, fmt.Sprintf("file%d", j)), 20000)
+		}
+		createRandomFile(joinPath(repository, fmt.Sprintf("dir%d/file", i)), 50000)
+		os.WriteFile(joinPath(repository, fmt.Sprintf("dir%d/empty", i)), nil, 0644)
+	}
+
+	storage, err := CreateFileStorage(joinPath(testDir, "storage"), false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage.SetDefaultNestingLevels([]int{2, 3}, 2)
+	if !ConfigStorage(storage, 16384, 100, 4*1024, 16*1024, 1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+
+	// The initial backup and the one with -hash pack the files while listing them, and the quick one in between
+	// compares them with the files of the previous snapshot instead
+	if !backupManager.Backup(repository, true, 2, "first", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+	if !backupManager.Backup(repository, true, 2, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+	if !backupManager.Backup(repository, false, 2, "third", false, false, 0, false) {
+		t.Fatalf("The third backup failed")
+	}
+
+	var descriptions []string
+	for _, revision := range []int{1, 3} {
+		snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", revision)
+		backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, true)
+		if snapshot.NumberOfFiles != 28 || len(snapshot.Files) != 36 {
+			t.Errorf("Revision %d has %d files and %d entries", revision, snapshot.NumberOfFiles, len(snapshot.Files))
+		}
+		description, _ := json.Marshal(snapshot.Files)
+		descriptions = append(descriptions, string(description))
+	}
+	if descriptions[0] != descriptions[1] {
+		t.Errorf("The files in revisions 1 and 3 are different")
+	}
+
+	// A quick backup after some files have been modified, added and removed packs only the modified and new files
+	createRandomFile(joinPath(repository, "dir0/file"), 30000)
+	createRandomFile(joinPath(repository, "dir2/subdir/new"), 25000)
+	os.Remove(joinPath(repository, "dir3/subdir/file2"))
+	if !backupManager.Backup(repository, true, 2, "fourth", false, false, 0, false) {
+		t.Fatalf("The fourth backup failed")
+	}
+	newFileSize := int64(0)
+	for _, file := range []string{"dir0/file", "dir2/subdir/new"} {
+		stat, _ := os.Stat(joinPath(repository, file))
+		newFileSize += stat.Size()
+	}
+	if summary := backupManager.summary; summary.TotalFiles != 24 || summary.NewFiles != 2 ||
+		summary.NewFileSize != newFileSize {
+		t.Errorf("The fourth backup has %d files with %d new files of %d bytes", summary.TotalFiles,
+			summary.NewFiles, summary.NewFileSize)
+	}
+
+	// The unchanged non-empty files reference the same chunks as in the previous revision; empty files are neither
+	// packed nor preserved by a quick backup
+	snapshots := make(map[int]*Snapshot)
+	files := make(map[int]map[string]*Entry)
+	for _, revision := range []int{1, 2, 3, 4} {
+		snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", revision)
+		backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, true)
+		snapshots[revision] = snapshot
+		files[revision] = make(map[string]*Entry)
+		for _, entry := range snapshot.Files {
+			files[revision][entry.Path] = entry
+		}
+	}
+	for _, revision := range []int{2, 4} {
+		if snapshots[revision].NumberOfFiles != 24 || len(snapshots[revision].Files) != 36 {
+			t.Errorf("Revision %d has %d files and %d entries", revision, snapshots[revision].NumberOfFiles,
+				len(snapshots[revision].Files))
+		}
+		for path, entry := range files[revision] {
+			previous := files[revision-1][path]
+			if !entry.IsFile() || entry.Size == 0 || (revision == 4 && (path == "dir0/file" || path == "dir2/subdir/new")) {
+				continue
+			}
+			if entry.Hash != previous.Hash || entry.StartOffset != previous.StartOffset ||
+				entry.EndOffset != previous.EndOffset || entry.EndChunk-entry.StartChunk != previous.EndChunk-previous.StartChunk {
+				t.Errorf("File %s has changed from revision %d to %d", path, revision-1, revision)
+				continue
+			}
+			for i := 0; i <= entry.EndChunk-entry.StartChunk; i++ {
+				if snapshots[revision].ChunkHashes[entry.StartChunk+i] !=
+					snapshots[revision-1].ChunkHashes[previous.StartChunk+i] {
+					t.Errorf("File %s doesn't reference the same chunks in revisions %d and %d", path, revision-1,
+						revision)
+					break
+				}
+			}
+		}
+	}
+
+	if !backupManager.SnapshotManager.CheckSnapshots("host1", []int{1, 2, 3, 4}, "", false, true, false, false,
+		false, false, 1, false) {
+		t.Errorf("The check failed")
+	}
+
+	restored := joinPath(testDir, "restored")
+	os.MkdirAll(restored, 0700)
+	failures := backupManager.Restore(restored, 3, true, false, 1, false, false, false, false, nil, false)
+	if failures != 0 {
+		t.Errorf("%d files failed to be restored", failures)
+	}
+	for i := 0; i < 4; i++ {
+		for _, file := range []string{"file", "empty", "subdir/file0", "subdir/file4"} {
+			file = fmt.Sprintf("dir%d/%s", i, file)
+			if file == "dir0/file" {
+				continue
+			}
+			if hash1, hash2 := getFileHash(joinPath(repository, file)), getFileHash(joinPath(restored, file)); hash1 != hash2 {
+				t.Errorf("File %s has a hash of %s after being restored instead of %s", file, hash2, hash1)
+			}
+		}
+	}
+
+	restored = joinPath(testDir, "restored4")
+	os.MkdirAll(restored, 0700)
+	failures = backupManager.Restore(restored, 4, true, false, 1, false, false, false, false, nil, false)
+	if failures != 0 {
+		t.Errorf("%d files failed to be restored from revision 4", failures)
+	}
+	for path, entry := range files[4] {
+		if !entry.IsFile() {
+			continue
+		}
+		if hash1, hash2 := getFileHash(joinPath(repository, path)), getFileHash(joinPath(restored, path)); hash1 != hash2 {
+			t.Errorf("File %s has a hash of %s after being restored from revision 4 instead of %s", path, hash2, hash1)
+		}
+	}
+	if _, err := os.Stat(joinPath(restored, "dir3/subdir/file2")); err == nil {
+		t.Errorf("The removed file was restored from revision 4")
+	}
+
+	// The incomplete snapshot is saved from the file list, stopping at the first file that hasn't been processed
+	list := createEntryList()
+	defer list.Close()
+	for i := 0; i < 8; i++ {
+		entry := CreateEntry(fmt.Sprintf("file%d", i), 10, 0, 0644)
+		entry.Hash = "hash"
+		entry.StartChunk, entry.EndChunk, entry.EndOffset = i, i, 10
+		if i == 6 {
+			entry.Size = -1
+		}
+		list.Add(entry)
+	}
+	for _, confirmed := range []int{-1, 3} {
+		reader, err := list.NewReader()
+		if err != nil {
+			t.Fatalf("Failed to read the file list: %v", err)
+		}
+		saveIncompleteFiles(processedFiles(reader, confirmed), []string{"chunk1"}, []int{10}, confirmed >= 0)
+		reader.Close()
+
+		incompleteSnapshot := LoadIncompleteSnapshot()
+		expected := 6
+		if confirmed >= 0 {
+			expected = confirmed
+		}
+		if incompleteSnapshot == nil || len(incompleteSnapshot.Files) != expected ||
+			incompleteSnapshot.checkpoint != (confirmed >= 0) || len(incompleteSnapshot.ChunkHashes) != 1 ||
+			incompleteSnapshot.ChunkHashes[0] != "chunk1" {
+			t.Errorf("The incomplete snapshot saved with %d confirmed chunks is %+v", confirmed, incompleteSnapshot)
+		}
+	}
+	RemoveIncompleteSnapshot()
+}
@@ -0,0 +1,291 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// backupUpload uploads the file chunks made by a backup and the snapshot, and keeps the statistics reported at the
+// end.  It is shared by Backup and backupStreaming, which differ in how they find the files to be packed.
+type backupUpload struct {
+	manager        *BackupManager
+	chunkCache     map[string]bool // chunks known to be in the storage
+	chunkMaker     *ChunkMaker
+	chunkUploader  *ChunkUploader
+	progress       *BackupProgress
+	bar            *ProgressBar
+	showStatistics bool
+	progressSize   int64 // the total size shown by the progress, 0 if not known when the upload starts
+
+	keepUploadAlive   int64 // chunks are uploaded even if in the cache when none has been uploaded for this long
+	lastUploadingTime int64
+	chunkToFail       int // set by DUPLICACY_FAIL_CHUNK to simulate a backup error
+	chunkIndex        int
+
+	checkpoint     *backupCheckpoint
+	saveCheckpoint func(confirmed int) // saves the files in the first 'confirmed' chunks as the incomplete snapshot
+
+	// These are updated atomically since the completion function is called by all uploading threads
+	startUploadingTime           int64
+	totalModifiedFileSize        int64 // total size of the files to be packed, or listed so far if not known yet
+	uploadedModifiedFileSize     int64 // portions that have been uploaded (including cache hits)
+	numberOfNewFileChunks        int64 // number of new file chunks
+	totalUploadedFileChunkLength int64 // total length of uploaded file chunks
+	totalUploadedFileChunkBytes  int64 // how many actual bytes have been uploaded
+
+	totalSnapshotChunkLength         int64 // size of all snapshot chunks
+	numberOfNewSnapshotChunks        int
+	totalUploadedSnapshotChunkLength int64 // size of uploaded snapshot chunks
+	totalUploadedSnapshotChunkBytes  int64 // how many actual bytes have been uploaded
+}
+
+// createBackupUpload creates the uploader of a backup.  'totalModifiedFileSize' is 0 if the size of the files to be
+// packed isn't known yet, in which case it is updated as files are found.
+func (manager *BackupManager) createBackupUpload(chunkCache map[string]bool, threads int, totalModifiedFileSize int64,
+	showStatistics bool) *backupUpload {
+
+	upload := &backupUpload{
+		manager:               manager,
+		chunkCache:            chunkCache,
+		chunkMaker:            CreateChunkMaker(manager.config, false),
+		chunkUploader:         CreateChunkUploader(manager.config, manager.storage, nil, threads, nil),
+		showStatistics:        showStatistics,
+		progressSize:          totalModifiedFileSize,
+		keepUploadAlive:       int64(1800),
+		chunkToFail:           -1,
+		totalModifiedFileSize: totalModifiedFileSize,
+	}
+	upload.chunkUploader.knownChunks = manager.loadKnownChunks()
+
+	if os.Getenv("DUPLICACY_UPLOAD_KEEPALIVE") != "" {
+		value, _ := strconv.Atoi(os.Getenv("DUPLICACY_UPLOAD_KEEPALIVE"))
+		if value < 10 {
+			value = 10
+		}
+		LOG_INFO("UPLOAD_KEEPALIVE", "Setting KeepUploadAlive to %d", value)
+		upload.keepUploadAlive = int64(value)
+	}
+
+	// Fail at the chunk specified by DUPLICACY_FAIL_CHUNK to simulate a backup error
+	if value, found := os.LookupEnv("DUPLICACY_FAIL_CHUNK"); found {
+		upload.chunkToFail, _ = strconv.Atoi(value)
+		LOG_INFO("SNAPSHOT_FAIL", "Will abort the backup on chunk %d", upload.chunkToFail)
+	}
+
+	return upload
+}
+
+// start shows the progress and starts the uploading threads.
+func (upload *backupUpload) start(threads int) {
+	if upload.showStatistics {
+		upload.progress = CreateBackupProgress(upload.progressSize, upload.manager.storage)
+	}
+	upload.bar = StartProgressBar("Upload", upload.progressSize, "")
+	upload.startUploadingTime = time.Now().Unix()
+	upload.lastUploadingTime = time.Now().Unix()
+
+	if threads > 1 {
+		LOG_INFO("BACKUP_THREADS", "Use %d uploading threads", threads)
+	}
+	upload.chunkUploader.completionFunc = upload.chunkCompleted
+	upload.chunkUploader.Start()
+}
+
+// stop waits for all file chunks to be uploaded.
+func (upload *backupUpload) stop() {
+	upload.chunkUploader.Stop()
+	upload.bar.Finish()
+}
+
+// chunkCompleted is called when a file chunk has been uploaded, found in the storage, or skipped as it is in the
+// cache.
+func (upload *backupUpload) chunkCompleted(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int) {
+	action := "Skipped"
+	if skipped {
+		LOG_DEBUG("CHUNK_CACHE", "Skipped chunk %s in cache", chunk.GetID())
+	} else {
+		if uploadSize > 0 {
+			upload.manager.recordUploadedChunk(chunk.GetHash())
+			atomic.AddInt64(&upload.numberOfNewFileChunks, 1)
+			atomic.AddInt64(&upload.totalUploadedFileChunkLength, int64(chunkSize))
+			atomic.AddInt64(&upload.totalUploadedFileChunkBytes, int64(uploadSize))
+			action = "Uploaded"
+		} else {
+			LOG_DEBUG("CHUNK_EXIST", "Skipped chunk %s in the storage", chunk.GetID())
+		}
+	}
+
+	uploadedModifiedFileSize := atomic.AddInt64(&upload.uploadedModifiedFileSize, int64(chunkSize))
+	upload.progress.ChunkCompleted(chunkSize, uploadSize)
+	upload.bar.Add(int64(chunkSize), int64(chunkSize))
+
+	if confirmed, due := upload.checkpoint.chunkCompleted(chunkIndex); due {
+		upload.saveCheckpoint(confirmed)
+		upload.checkpoint.saved()
+	}
+
+	totalModifiedFileSize := atomic.LoadInt64(&upload.totalModifiedFileSize)
+	if (IsTracing() || upload.showStatistics) && totalModifiedFileSize > 0 {
+		now := time.Now().Unix()
+		if now <= upload.startUploadingTime {
+			now = upload.startUploadingTime + 1
+		}
+		speed := uploadedModifiedFileSize / (now - upload.startUploadingTime)
+		remainingTime := int64(0)
+		if speed > 0 && totalModifiedFileSize > uploadedModifiedFileSize {
+			remainingTime = (totalModifiedFileSize-uploadedModifiedFileSize)/speed + 1
+		}
+		percentage := float32(uploadedModifiedFileSize * 1000 / totalModifiedFileSize)
+		LOG_INFO("UPLOAD_PROGRESS", "%s chunk %d size %d, %sB/s %s %.1f%%", action, chunkIndex,
+			chunkSize, PrettySize(speed), PrettyTime(remainingTime), percentage/10)
+	}
+
+	upload.manager.config.PutChunk(chunk)
+}
+
+// uploadChunk is called with each chunk made from the files being packed.  It returns false if the chunk is empty
+// and won't be part of the snapshot.
+func (upload *backupUpload) uploadChunk(chunk *Chunk) bool {
+	chunkID := chunk.GetID()
+	chunkSize := chunk.GetLength()
+
+	if chunkSize == 0 {
+		LOG_DEBUG("CHUNK_EMPTY", "Ignored chunk %s of size 0", chunkID)
+		return false
+	}
+
+	upload.chunkIndex++
+
+	_, found := upload.chunkCache[chunkID]
+	if found {
+		if time.Now().Unix()-upload.lastUploadingTime > upload.keepUploadAlive {
+			LOG_INFO("UPLOAD_KEEPALIVE", "Skip chunk cache to keep connection alive")
+			found = false
+		}
+	}
+
+	if found {
+		upload.chunkCompleted(chunk, upload.chunkIndex, true, chunkSize, 0)
+	} else {
+		upload.lastUploadingTime = time.Now().Unix()
+		upload.chunkCache[chunkID] = true
+
+		upload.chunkUploader.StartChunk(chunk, upload.chunkIndex)
+	}
+	return true
+}
+
+// checkChunkToFail fails the backup if 'numberOfChunks' chunks have been made and DUPLICACY_FAIL_CHUNK is set to
+// that number.
+func (upload *backupUpload) checkChunkToFail(numberOfChunks int) {
+	if numberOfChunks == upload.chunkToFail {
+		LOG_ERROR("SNAPSHOT_FAIL", "Artificially fail the chunk %d for testing purposes", upload.chunkToFail)
+	}
+}
+
+// uploadSnapshot uploads the metadata chunks and the snapshot file.
+func (upload *backupUpload) uploadSnapshot(top string, snapshot *Snapshot) {
+	upload.totalSnapshotChunkLength, upload.numberOfNewSnapshotChunks,
+		upload.totalUploadedSnapshotChunkLength, upload.totalUploadedSnapshotChunkBytes =
+		upload.manager.UploadSnapshot(upload.chunkMaker, upload.chunkUploader, top, snapshot, upload.chunkCache)
+	upload.manager.saveKnownChunks(upload.chunkUploader.knownChunks)
+}
+
+// logSkippedEntries warns about the directories that can't be listed and the files that can't be opened, and returns
+// all the files skipped.
+func (manager *BackupManager) logSkippedEntries(skippedDirectories []string, skippedFiles []string,
+	fileReader *FileReader) []string {
+
+	for _, dir := range skippedDirectories {
+		LOG_WARN("SKIP_DIRECTORY", "Subdirectory %s cannot be listed", dir)
+	}
+
+	for i, file := range fileReader.SkippedFiles {
+		LOG_WARN("SKIP_FILE", "File %s cannot be opened: %v", file, fileReader.SkippedErrors[i])
+	}
+	manager.writeSkippedReport(skippedDirectories, skippedFiles, fileReader)
+	return append(skippedFiles, fileReader.SkippedFiles...)
+}
+
+// finish cleans up the snapshot cache and the incomplete snapshot once the snapshot has been uploaded.
+// 'numberOfNewFiles' and 'newFileSize' are the files that have been packed.
+func (upload *backupUpload) finish(top string, snapshot *Snapshot, numberOfNewFiles int, newFileSize int64) {
+	manager := upload.manager
+	if !manager.config.dryRun {
+		manager.SnapshotManager.CleanSnapshotCache(snapshot, nil)
+		LOG_INFO("BACKUP_END", "Backup for %s at revision %d completed", top, snapshot.Revision)
+	} else {
+		// Chunks not referenced by the last backup are counted as new even if they were uploaded by other
+		// repositories, so this is an upper bound of what the backup would upload
+		LOG_INFO("BACKUP_DRYRUN", "Dry run for %s at revision %d completed: %d new files, %s bytes; "+
+			"%d new chunks, %s bytes; %s bytes would be uploaded", top, snapshot.Revision,
+			numberOfNewFiles, PrettyNumber(newFileSize),
+			int(upload.numberOfNewFileChunks)+upload.numberOfNewSnapshotChunks,
+			PrettyNumber(upload.totalUploadedFileChunkLength+upload.totalUploadedSnapshotChunkLength),
+			PrettyNumber(upload.totalUploadedFileChunkBytes+upload.totalUploadedSnapshotChunkBytes))
+	}
+
+	RunAtError = func() {}
+	RemoveIncompleteSnapshot()
+}
+
+// report logs the statistics if requested and sets the summary of the backup.
+func (upload *backupUpload) report(snapshot *Snapshot, numberOfNewFiles int, newFileSize int64,
+	skippedDirectories []string, skippedFiles []string, startTime int64) {
+
+	var totalFileChunkLength int64
+	for _, length := range snapshot.ChunkLengths {
+		totalFileChunkLength += int64(length)
+	}
+
+	totalSnapshotChunks := len(snapshot.FileSequence) + len(snapshot.ChunkSequence) + len(snapshot.LengthSequence)
+	if upload.showStatistics {
+
+		LOG_INFO("BACKUP_STATS", "Files: %d total, %s bytes; %d new, %s bytes",
+			snapshot.NumberOfFiles, PrettyNumber(snapshot.FileSize),
+			numberOfNewFiles, PrettyNumber(newFileSize))
+
+		LOG_INFO("BACKUP_STATS", "File chunks: %d total, %s bytes; %d new, %s bytes, %s bytes uploaded",
+			len(snapshot.ChunkHashes), PrettyNumber(totalFileChunkLength),
+			upload.numberOfNewFileChunks, PrettyNumber(upload.totalUploadedFileChunkLength),
+			PrettyNumber(upload.totalUploadedFileChunkBytes))
+
+		LOG_INFO("BACKUP_STATS", "Metadata chunks: %d total, %s bytes; %d new, %s bytes, %s bytes uploaded",
+			totalSnapshotChunks, PrettyNumber(upload.totalSnapshotChunkLength),
+			upload.numberOfNewSnapshotChunks, PrettyNumber(upload.totalUploadedSnapshotChunkLength),
+			PrettyNumber(upload.totalUploadedSnapshotChunkBytes))
+
+		LOG_INFO("BACKUP_STATS", "All chunks: %d total, %s bytes; %d new, %s bytes, %s bytes uploaded",
+			len(snapshot.ChunkHashes)+totalSnapshotChunks,
+			PrettyNumber(totalFileChunkLength+upload.totalSnapshotChunkLength),
+			int(upload.numberOfNewFileChunks)+upload.numberOfNewSnapshotChunks,
+			PrettyNumber(upload.totalUploadedFileChunkLength+upload.totalUploadedSnapshotChunkLength),
+			PrettyNumber(upload.totalUploadedFileChunkBytes+upload.totalUploadedSnapshotChunkBytes))
+
+		now := time.Now().Unix()
+		if now == startTime {
+			now = startTime + 1
+		}
+		LOG_INFO("BACKUP_STATS", "Total running time: %s", PrettyTime(now-startTime))
+	}
+
+	reportSkippedEntries(skippedDirectories, skippedFiles)
+
+	upload.manager.summary = OperationSummary{
+		Revision:         snapshot.Revision,
+		TotalFiles:       int(snapshot.NumberOfFiles),
+		TotalFileSize:    snapshot.FileSize,
+		NewFiles:         numberOfNewFiles,
+		NewFileSize:      newFileSize,
+		TransferredBytes: upload.totalUploadedFileChunkBytes + upload.totalUploadedSnapshotChunkBytes,
+		SkippedFiles:     len(skippedDirectories) + len(skippedFiles),
+		NewChunks:        int(upload.numberOfNewFileChunks) + upload.numberOfNewSnapshotChunks,
+		DryRun:           upload.manager.config.dryRun,
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// ParseVerifyPercentage parses the argument of backup -verify-after, which is either a percentage such as "10%" or
+// "all".
+func ParseVerifyPercentage(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "all" {
+		return 100, nil
+	}
+	percentage, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || percentage < 1 || percentage > 100 {
+		return 0, fmt.Errorf("'%s' is not a percentage between 1%% and 100%%", value)
+	}
+	return percentage, nil
+}
+
+// SetVerifyAfter makes the backup download the given percentage of the chunks it uploaded, after the snapshot has
+// been saved, to make sure the storage returns them intact while the files still exist locally.
+func (manager *BackupManager) SetVerifyAfter(percentage int) {
+	manager.verifyPercentage = percentage
+}
+
+// recordUploadedChunk remembers a chunk uploaded by the backup if the uploaded chunks are to be verified.  It is
+// called from the uploading threads.
+func (manager *BackupManager) recordUploadedChunk(chunkHash string) {
+	if manager.verifyPercentage <= 0 {
+		return
+	}
+	manager.uploadedChunksLock.Lock()
+	manager.uploadedChunks = append(manager.uploadedChunks, chunkHash)
+	manager.uploadedChunksLock.Unlock()
+}
+
+// verifyUploadedChunks downloads a random sample of the chunks uploaded by the backup, bypassing the snapshot cache,
+// and reports every chunk that can't be downloaded or doesn't match its hash.
+func (manager *BackupManager) verifyUploadedChunks(threads int) bool {
+
+	manager.uploadedChunksLock.Lock()
+	chunks := manager.uploadedChunks
+	manager.uploadedChunks = nil
+	manager.uploadedChunksLock.Unlock()
+
+	if manager.verifyPercentage <= 0 || manager.config.dryRun {
+		return true
+	}
+	if len(chunks) == 0 {
+		LOG_INFO("BACKUP_VERIFY", "No new chunks were uploaded to be verified")
+		return true
+	}
+
+	numberOfChunks := (len(chunks)*manager.verifyPercentage + 99) / 100
+	if numberOfChunks < len(chunks) {
+		rand.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+		chunks = chunks[:numberOfChunks]
+	}
+	LOG_INFO("BACKUP_VERIFY", "Verifying %d of the newly uploaded chunks", numberOfChunks)
+
+	if threads < 1 {
+		threads = 1
+	}
+	chunkDownloader := CreateChunkDownloader(manager.config, manager.storage, nil, false, threads, true)
+	for _, chunkHash := range chunks {
+		chunkDownloader.AddChunk(chunkHash)
+	}
+
+	var corruptedChunks []string
+	for i, chunkHash := range chunks {
+		chunk := chunkDownloader.WaitForChunk(i)
+		if chunk.isBroken {
+			corruptedChunks = append(corruptedChunks, manager.config.GetChunkIDFromHash(chunkHash))
+		}
+	}
+	chunkDownloader.Stop()
+
+	if len(corruptedChunks) > 0 {
+		for _, chunkID := range corruptedChunks {
+			LOG_WARN("BACKUP_VERIFY", "The uploaded chunk %s failed the verification", chunkID)
+		}
+		LOG_ERROR("BACKUP_VERIFY", "%d of the %d verified chunks are missing or corrupted in the storage; "+
+			"run check -chunks -repair to fix them", len(corruptedChunks), numberOfChunks)
+		return false
+	}
+
+	LOG_INFO("BACKUP_VERIFY", "All %d verified chunks were downloaded intact", numberOfChunks)
+	return true
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestParseVerifyPercentage(t *testing.T) {
+	for value, expected := range map[string]int{"10%": 10, "100": 100, "all": 100, " 5% ": 5} {
+		percentage, err := ParseVerifyPercentage(value)
+		if err != nil || percentage != expected {
+			t.Errorf("%s was parsed as %d: %v", value, percentage, err)
+		}
+	}
+	for _, value := range []string{"0%", "101%", "ten", "-5", ""} {
+		if _, err := ParseVerifyPercentage(value); err == nil {
+			t.Errorf("%s was accepted as a percentage", value)
+		}
+	}
+}
+
+func TestBackupVerifyAfter(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "backupverify")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+	createRandomFile(joinPath(repository, "file2"), 200000)
+
+	threads := 2
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	backupManager.SetVerifyAfter(100)
+
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup with verification failed")
+	}
+	if len(backupManager.uploadedChunks) != 0 {
+		t.Errorf("%d uploaded chunks are still recorded after the backup", len(backupManager.uploadedChunks))
+	}
+
+	// The chunks of the first backup are verified when they are recorded as uploaded
+	snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 1)
+	chunkHashes := make(map[string]bool)
+	backupManager.SnapshotManager.GetSnapshotChunkHashes(snapshot, &chunkHashes, make(map[string]bool))
+	if len(chunkHashes) == 0 {
+		t.Fatalf("The first revision references no chunks")
+	}
+	for chunkHash := range chunkHashes {
+		backupManager.recordUploadedChunk(chunkHash)
+	}
+	if !backupManager.verifyUploadedChunks(threads) {
+		t.Errorf("The uploaded chunks failed the verification")
+	}
+
+	// A chunk that doesn't exist in the storage fails the verification
+	backupManager.recordUploadedChunk("missing chunk")
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(Exception); !ok || e.LogID != "BACKUP_VERIFY" {
+					panic(r)
+				}
+			}
+		}()
+		setTestingT(nil)
+		defer setTestingT(t)
+		if backupManager.verifyUploadedChunks(threads) {
+			t.Errorf("A missing chunk passed the verification")
+		}
+	}()
+}
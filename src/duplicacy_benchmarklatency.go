@@ -0,0 +1,272 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// The number of list operations measured for each combination of object size and thread count
+var benchmarkListCount = 8
+
+// A combination whose throughput is within this fraction of the best is considered as good as the best, so the
+// recommendation prefers fewer threads and smaller chunks, which are cheaper and deduplicate better.
+var benchmarkRecommendationTolerance = 0.9
+
+// BenchmarkLatency is the latency distribution of one kind of operation, in seconds.
+type BenchmarkLatency struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// BenchmarkLatencyResult is the outcome of the workload at one object size and thread count.
+type BenchmarkLatencyResult struct {
+	ObjectSize    int              `json:"object_size"`
+	Threads       int              `json:"threads"`
+	UploadSpeed   int64            `json:"upload_speed"`
+	DownloadSpeed int64            `json:"download_speed"`
+	Upload        BenchmarkLatency `json:"upload"`
+	Download      BenchmarkLatency `json:"download"`
+	List          BenchmarkLatency `json:"list"`
+	Delete        BenchmarkLatency `json:"delete"`
+	Errors        int              `json:"errors"`
+}
+
+// BenchmarkRecommendation is the thread count and the chunk size suggested for the storage.
+type BenchmarkRecommendation struct {
+	Threads   int `json:"threads"`
+	ChunkSize int `json:"chunk_size"`
+}
+
+// getBenchmarkLatency returns the percentiles of the durations using the nearest-rank method.
+func getBenchmarkLatency(durations []time.Duration) BenchmarkLatency {
+	latency := BenchmarkLatency{Count: len(durations)}
+	if len(durations) == 0 {
+		return latency
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p int) float64 {
+		rank := (p*len(sorted) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		return sorted[rank-1].Seconds()
+	}
+	latency.P50 = percentile(50)
+	latency.P95 = percentile(95)
+	latency.P99 = percentile(99)
+	latency.Max = sorted[len(sorted)-1].Seconds()
+	return latency
+}
+
+// benchmarkTimedRun runs the job for each index with the given number of threads and returns the duration of each
+// job, along with the total running time and the number of jobs that failed.
+func benchmarkTimedRun(threads int, count int, job func(threadIndex int, index int) error) (durations []time.Duration,
+	runningTime time.Duration, errors int) {
+
+	durations = make([]time.Duration, count)
+	failed := make([]bool, count)
+	startTime := time.Now()
+	benchmarkRun(threads, count, func(threadIndex int, index int) {
+		jobStartTime := time.Now()
+		failed[index] = job(threadIndex, index) != nil
+		durations[index] = time.Since(jobStartTime)
+	})
+	runningTime = time.Since(startTime)
+
+	var succeeded []time.Duration
+	for i, duration := range durations {
+		if failed[i] {
+			errors++
+		} else {
+			succeeded = append(succeeded, duration)
+		}
+	}
+	return succeeded, runningTime, errors
+}
+
+// benchmarkWorkload uploads, lists, downloads, and then deletes count objects of the given size with the given number
+// of threads, measuring the latency of every operation.
+func benchmarkWorkload(storage Storage, data []byte, objectSize int, threads int, count int) BenchmarkLatencyResult {
+
+	result := BenchmarkLatencyResult{ObjectSize: objectSize, Threads: threads}
+	content := data[:objectSize]
+	getPath := func(index int) string {
+		return fmt.Sprintf("benchmark/latency%d-%d", objectSize, index)
+	}
+
+	durations, runningTime, errors := benchmarkTimedRun(threads, count, func(threadIndex int, index int) error {
+		err := storage.UploadFile(threadIndex, getPath(index), content)
+		if err != nil {
+			LOG_WARN("BENCHMARK_UPLOAD", "Failed to upload %s: %v", getPath(index), err)
+		}
+		return err
+	})
+	result.Upload = getBenchmarkLatency(durations)
+	result.UploadSpeed = int64(float64(objectSize*len(durations)) / runningTime.Seconds())
+	result.Errors += errors
+
+	durations, _, errors = benchmarkTimedRun(threads, benchmarkListCount, func(threadIndex int, index int) error {
+		_, _, err := storage.ListFiles(threadIndex, "benchmark/")
+		if err != nil {
+			LOG_WARN("BENCHMARK_LIST", "Failed to list the benchmark directory: %v", err)
+		}
+		return err
+	})
+	result.List = getBenchmarkLatency(durations)
+	result.Errors += errors
+
+	chunks := make([]*Chunk, threads)
+	for i := range chunks {
+		chunks[i] = CreateChunk(CreateConfig(), true)
+	}
+	durations, runningTime, errors = benchmarkTimedRun(threads, count, func(threadIndex int, index int) error {
+		chunk := chunks[threadIndex]
+		chunk.Reset(false)
+		err := storage.DownloadFile(threadIndex, getPath(index), chunk)
+		if err == nil && chunk.GetLength() != objectSize {
+			err = fmt.Errorf("%d bytes were downloaded instead of %d", chunk.GetLength(), objectSize)
+		}
+		if err != nil {
+			LOG_WARN("BENCHMARK_DOWNLOAD", "Failed to download %s: %v", getPath(index), err)
+		}
+		return err
+	})
+	result.Download = getBenchmarkLatency(durations)
+	result.DownloadSpeed = int64(float64(objectSize*len(durations)) / runningTime.Seconds())
+	result.Errors += errors
+
+	durations, _, errors = benchmarkTimedRun(threads, count, func(threadIndex int, index int) error {
+		err := storage.DeleteFile(threadIndex, getPath(index))
+		if err != nil {
+			LOG_WARN("BENCHMARK_DELETE", "Failed to delete %s: %v", getPath(index), err)
+		}
+		return err
+	})
+	result.Delete = getBenchmarkLatency(durations)
+	result.Errors += errors
+
+	return result
+}
+
+// getBenchmarkRecommendation picks the smallest object size whose best throughput is close to the best of all sizes,
+// and then the fewest threads that come close to the best throughput for that size.  The throughput of a combination
+// is the average of its upload and download speeds.
+func getBenchmarkRecommendation(results []BenchmarkLatencyResult) (recommendation BenchmarkRecommendation) {
+
+	throughput := func(result BenchmarkLatencyResult) float64 {
+		return float64(result.UploadSpeed+result.DownloadSpeed) / 2
+	}
+
+	bestBySize := make(map[int]float64)
+	best := 0.0
+	for _, result := range results {
+		if result.Errors > 0 {
+			continue
+		}
+		if throughput(result) > bestBySize[result.ObjectSize] {
+			bestBySize[result.ObjectSize] = throughput(result)
+		}
+		if throughput(result) > best {
+			best = throughput(result)
+		}
+	}
+	if best == 0 {
+		return recommendation
+	}
+
+	for size, sizeBest := range bestBySize {
+		if sizeBest >= best*benchmarkRecommendationTolerance && (recommendation.ChunkSize == 0 || size < recommendation.ChunkSize) {
+			recommendation.ChunkSize = size
+		}
+	}
+
+	for _, result := range results {
+		if result.Errors > 0 || result.ObjectSize != recommendation.ChunkSize {
+			continue
+		}
+		if throughput(result) >= bestBySize[result.ObjectSize]*benchmarkRecommendationTolerance &&
+			(recommendation.Threads == 0 || result.Threads < recommendation.Threads) {
+			recommendation.Threads = result.Threads
+		}
+	}
+	return recommendation
+}
+
+// formatBenchmarkLatency formats the percentiles in milliseconds.
+func formatBenchmarkLatency(latency BenchmarkLatency) string {
+	return fmt.Sprintf("p50 %.0fms p95 %.0fms p99 %.0fms", latency.P50*1000, latency.P95*1000, latency.P99*1000)
+}
+
+// BenchmarkLatencies runs the mixed workload of uploads, lists, downloads, and deletes for every combination of the
+// object sizes and the thread counts, reports the latency percentiles of each operation, and recommends the number of
+// threads and the chunk size for the storage.  The storage must have been created with at least as many threads as
+// the largest thread count.
+func BenchmarkLatencies(storage Storage, objectSizes []int, threadCounts []int, count int) ([]BenchmarkLatencyResult,
+	BenchmarkRecommendation) {
+
+	maximumSize := 0
+	for _, size := range objectSizes {
+		if size > maximumSize {
+			maximumSize = size
+		}
+	}
+
+	LOG_INFO("BENCHMARK_GENERATE", "Generating %s byte random data in memory", PrettySize(int64(maximumSize)))
+	data := make([]byte, maximumSize)
+	rand.Read(data)
+
+	storage.CreateDirectory(0, "benchmark")
+
+	var results []BenchmarkLatencyResult
+	for _, size := range objectSizes {
+		for _, threads := range threadCounts {
+			LOG_INFO("BENCHMARK_LATENCY", "Testing %d objects of %s bytes with %d threads", count,
+				PrettySize(int64(size)), threads)
+			result := benchmarkWorkload(storage, data, size, threads, count)
+
+			LOG_INFO("BENCHMARK_LATENCY", "Upload:   %s/s, %s", PrettySize(result.UploadSpeed), formatBenchmarkLatency(result.Upload))
+			LOG_INFO("BENCHMARK_LATENCY", "Download: %s/s, %s", PrettySize(result.DownloadSpeed), formatBenchmarkLatency(result.Download))
+			LOG_INFO("BENCHMARK_LATENCY", "List:     %s", formatBenchmarkLatency(result.List))
+			LOG_INFO("BENCHMARK_LATENCY", "Delete:   %s", formatBenchmarkLatency(result.Delete))
+			if result.Errors > 0 {
+				LOG_WARN("BENCHMARK_LATENCY", "%d operations failed", result.Errors)
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	recommendation := getBenchmarkRecommendation(results)
+	if recommendation.Threads == 0 {
+		LOG_WARN("BENCHMARK_RECOMMEND", "No recommendation can be made because all combinations had failures")
+	} else {
+		LOG_INFO("BENCHMARK_RECOMMEND", "Recommended: %d threads with a chunk size of %s (-threads %d, init -c %s)",
+			recommendation.Threads, PrettySize(int64(recommendation.ChunkSize)), recommendation.Threads,
+			formatBenchmarkSize(recommendation.ChunkSize))
+	}
+
+	return results, recommendation
+}
+
+// formatBenchmarkSize formats the size the way AtoSize parses it.
+func formatBenchmarkSize(size int) string {
+	if size%(1024*1024) == 0 {
+		return fmt.Sprintf("%dM", size/1024/1024)
+	} else if size%1024 == 0 {
+		return fmt.Sprintf("%dK", size/1024)
+	}
+	return fmt.Sprintf("%d", size)
+}
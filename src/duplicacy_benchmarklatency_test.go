@@ -0,0 +1,66 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBenchmarkLatencies(t *testing.T) {
+
+	setTestingT(t)
+
+	var durations []time.Duration
+	for i := 100; i >= 1; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	latency := getBenchmarkLatency(durations)
+	if latency.Count != 100 || latency.P50 != 0.05 || latency.P95 != 0.095 || latency.P99 != 0.099 || latency.Max != 0.1 {
+		t.Errorf("The latency of 1ms to 100ms is %+v", latency)
+	}
+	if latency = getBenchmarkLatency(durations[99:]); latency.P50 != 0.001 || latency.P99 != 0.001 {
+		t.Errorf("The latency of a single operation is %+v", latency)
+	}
+
+	// 4M is nearly as fast as 16M, and 4 threads nearly as fast as 16, so the smaller values are recommended
+	results := []BenchmarkLatencyResult{
+		{ObjectSize: 1 << 20, Threads: 16, UploadSpeed: 50, DownloadSpeed: 50},
+		{ObjectSize: 4 << 20, Threads: 1, UploadSpeed: 30, DownloadSpeed: 30},
+		{ObjectSize: 4 << 20, Threads: 4, UploadSpeed: 92, DownloadSpeed: 92},
+		{ObjectSize: 4 << 20, Threads: 16, UploadSpeed: 95, DownloadSpeed: 95},
+		{ObjectSize: 16 << 20, Threads: 16, UploadSpeed: 100, DownloadSpeed: 100},
+		{ObjectSize: 256 << 10, Threads: 16, UploadSpeed: 200, DownloadSpeed: 200, Errors: 1},
+	}
+	if recommendation := getBenchmarkRecommendation(results); recommendation.ChunkSize != 4<<20 || recommendation.Threads != 4 {
+		t.Errorf("The recommendation is %+v", recommendation)
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "benchmark")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	storage, err := CreateFileStorage(testDir, false, 2)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	results, recommendation := BenchmarkLatencies(storage, []int{16 * 1024, 64 * 1024}, []int{1, 2}, 8)
+	if len(results) != 4 || recommendation.Threads == 0 {
+		t.Fatalf("The benchmark returned %d results with the recommendation %+v", len(results), recommendation)
+	}
+	for _, result := range results {
+		if result.Errors != 0 || result.Upload.Count != 8 || result.Download.Count != 8 || result.Delete.Count != 8 ||
+			result.List.Count != benchmarkListCount {
+			t.Errorf("The benchmark of %d bytes with %d threads returned %+v", result.ObjectSize, result.Threads, result)
+		}
+	}
+
+	files, _, _ := storage.ListFiles(0, "benchmark/")
+	if len(files) != 0 {
+		t.Errorf("%d benchmark files were left in the storage", len(files))
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// bundleManifestFile is the file in the root of a bundle that describes the revisions it contains.
+var bundleManifestFile = "bundle"
+
+// SnapshotBundle describes a set of revisions exported with their chunks into a directory.  The directory has the
+// layout of a file storage and a copy of the config file of the original storage, so chunks are stored exactly as
+// they are in the original storage, and the same password opens the bundle.
+type SnapshotBundle struct {
+	SnapshotID string `json:"id"`
+	Revisions  []int  `json:"revisions"`
+	Host       string `json:"host"`
+	Time       int64  `json:"time"`
+}
+
+// CreateSnapshotBundle turns the directory, which must be empty or not exist, into a bundle with the config file
+// of 'storage'.
+func CreateSnapshotBundle(storage Storage, bundleDir string, threads int) (*FileStorage, error) {
+
+	files, err := ioutil.ReadDir(bundleDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return nil, fmt.Errorf("the directory %s is not empty", bundleDir)
+	}
+
+	bundleStorage, err := CreateFileStorage(bundleDir, false, threads)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile := CreateChunk(CreateConfig(), true)
+	err = storage.DownloadFile(0, "config", configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the config file: %v", err)
+	}
+	for _, dir := range []string{"chunks", "snapshots"} {
+		err = bundleStorage.CreateDirectory(0, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = bundleStorage.UploadFile(0, "config", configFile.GetBytes())
+	if err != nil {
+		return nil, err
+	}
+	return bundleStorage, nil
+}
+
+// OpenSnapshotBundle opens a bundle created by ExportSnapshots.
+func OpenSnapshotBundle(bundleDir string, threads int) (*FileStorage, *SnapshotBundle, error) {
+
+	description, err := ioutil.ReadFile(path.Join(bundleDir, bundleManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("%s is not a snapshot bundle", bundleDir)
+		}
+		return nil, nil, err
+	}
+
+	bundle := &SnapshotBundle{}
+	err = json.Unmarshal(description, bundle)
+	if err != nil {
+		return nil, nil, fmt.Errorf("the bundle manifest can't be parsed: %v", err)
+	}
+
+	bundleStorage, err := CreateFileStorage(bundleDir, false, threads)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bundleStorage, bundle, nil
+}
+
+// ExportSnapshots copies the given revisions of the snapshot id, along with exactly the chunks they reference, into
+// the bundle and then records the revisions in the bundle manifest.  'bundleManager' must be created on a storage
+// returned by CreateSnapshotBundle.
+func (manager *BackupManager) ExportSnapshots(bundleManager *BackupManager, snapshotID string, revisions []int,
+	threads int) bool {
+
+	if snapshotID == "" || len(revisions) == 0 {
+		LOG_ERROR("BUNDLE_EXPORT", "The snapshot id and the revisions to export must be specified")
+		return false
+	}
+
+	existingRevisions, err := manager.SnapshotManager.ListSnapshotRevisions(snapshotID)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_LIST", "Failed to list all revisions for snapshot %s: %v", snapshotID, err)
+		return false
+	}
+	existing := make(map[int]bool)
+	for _, revision := range existingRevisions {
+		existing[revision] = true
+	}
+	for _, revision := range revisions {
+		if !existing[revision] {
+			LOG_ERROR("SNAPSHOT_NOT_EXIST", "Snapshot %s at revision %d does not exist", snapshotID, revision)
+			return false
+		}
+	}
+
+	if !manager.CopySnapshots(bundleManager, snapshotID, revisions, threads, threads) {
+		return false
+	}
+
+	host, _ := os.Hostname()
+	bundle := SnapshotBundle{
+		SnapshotID: snapshotID,
+		Revisions:  revisions,
+		Host:       host,
+		Time:       time.Now().Unix(),
+	}
+	description, err := json.MarshalIndent(bundle, "", "    ")
+	if err != nil {
+		LOG_ERROR("BUNDLE_EXPORT", "Failed to create the bundle manifest: %v", err)
+		return false
+	}
+	err = bundleManager.storage.UploadFile(0, bundleManifestFile, description)
+	if err != nil {
+		LOG_ERROR("BUNDLE_EXPORT", "Failed to save the bundle manifest: %v", err)
+		return false
+	}
+
+	LOG_INFO("BUNDLE_EXPORT", "Exported snapshot %s at revisions %v", snapshotID, revisions)
+	return true
+}
+
+// ImportSnapshots copies the revisions in the bundle, which 'manager' must have been created on, into the storage
+// of 'otherManager'.  Revisions already in the destination are skipped, like in a copy.
+func (manager *BackupManager) ImportSnapshots(bundle *SnapshotBundle, otherManager *BackupManager, threads int) bool {
+
+	LOG_INFO("BUNDLE_IMPORT", "Importing snapshot %s at revisions %v exported from %s at %s", bundle.SnapshotID,
+		bundle.Revisions, bundle.Host, time.Unix(bundle.Time, 0).Format("2006-01-02 15:04"))
+
+	if !manager.CopySnapshots(otherManager, bundle.SnapshotID, bundle.Revisions, threads, threads) {
+		return false
+	}
+
+	LOG_INFO("BUNDLE_IMPORT", "Imported snapshot %s at revisions %v", bundle.SnapshotID, bundle.Revisions)
+	return true
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotBundle(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "bundle")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+	createRandomFile(joinPath(repository, "file2"), 100000)
+	if !backupManager.Backup(repository, true, threads, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+
+	// Only the chunks of the first revision go into the bundle
+	bundleDir := filepath.Join(testDir, "bundle")
+	bundleStorage, err := CreateSnapshotBundle(storage, bundleDir, threads)
+	if err != nil {
+		t.Fatalf("Failed to create the bundle: %v", err)
+	}
+	bundleManager := CreateBackupManager("host1", bundleStorage, testDir, "", "", "", false)
+	bundleManager.SetupSnapshotCache("bundle")
+	if !backupManager.ExportSnapshots(bundleManager, "host1", []int{1}, threads) {
+		t.Fatalf("Failed to export the first revision")
+	}
+
+	snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 1)
+	referencedChunks := make(map[string]bool)
+	for _, chunk := range backupManager.SnapshotManager.GetSnapshotChunks(snapshot, false) {
+		referencedChunks[chunk] = true
+	}
+	allFiles, _ := bundleManager.SnapshotManager.ListAllFiles(bundleStorage, "chunks/")
+	var bundleChunks []string
+	for _, file := range allFiles {
+		if !strings.HasSuffix(file, "/") {
+			bundleChunks = append(bundleChunks, file)
+		}
+	}
+	if len(bundleChunks) != len(referencedChunks) {
+		t.Errorf("The bundle has %d chunks while the revision references %d", len(bundleChunks), len(referencedChunks))
+	}
+	for _, chunk := range bundleChunks {
+		if !referencedChunks[strings.Replace(chunk, "/", "", -1)] {
+			t.Errorf("The bundle has an unreferenced chunk %s", chunk)
+		}
+	}
+
+	if _, err = CreateSnapshotBundle(storage, bundleDir, threads); err == nil {
+		t.Errorf("A bundle was created in a non-empty directory")
+	}
+
+	// Import the bundle into a storage that is copy-compatible with the original one
+	otherStorage, err := loadStorage(filepath.Join(testDir, "other"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create the other storage: %v", err)
+	}
+	cleanStorage(otherStorage)
+	if !ConfigStorage(otherStorage, 16384, 100, 16*1024, 64*1024, 4*1024, "", backupManager.config, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the other storage")
+	}
+	otherManager := CreateBackupManager("host1", otherStorage, testDir, "", "", "", false)
+	otherManager.SetupSnapshotCache("other")
+
+	bundleStorage, bundle, err := OpenSnapshotBundle(bundleDir, threads)
+	if err != nil {
+		t.Fatalf("Failed to open the bundle: %v", err)
+	}
+	if bundle.SnapshotID != "host1" || len(bundle.Revisions) != 1 || bundle.Revisions[0] != 1 {
+		t.Errorf("The bundle contains snapshot %s at revisions %v", bundle.SnapshotID, bundle.Revisions)
+	}
+	bundleManager = CreateBackupManager("host1", bundleStorage, testDir, "", "", "", false)
+	bundleManager.SetupSnapshotCache("bundle")
+	if !bundleManager.ImportSnapshots(bundle, otherManager, threads) {
+		t.Fatalf("Failed to import the bundle")
+	}
+
+	revisions, _ := otherManager.SnapshotManager.ListSnapshotRevisions("host1")
+	if len(revisions) != 1 || revisions[0] != 1 {
+		t.Errorf("The other storage has revisions %v after the import", revisions)
+	}
+	if !otherManager.SnapshotManager.CheckSnapshots("host1", []int{1}, "", false, false, true, false, false, false,
+		threads, false) {
+		t.Errorf("The imported revision failed the check")
+	}
+}
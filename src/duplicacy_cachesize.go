@@ -0,0 +1,174 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SnapshotCacheUsage is the disk space used by the snapshot cache of one storage under .duplicacy/cache.
+type SnapshotCacheUsage struct {
+	StorageName   string
+	ChunkFiles    int
+	ChunkBytes    int64
+	SnapshotFiles int
+	SnapshotBytes int64
+	OtherBytes    int64 // Verified chunks, file indexes, and other state kept in the cache
+}
+
+// GetTotalBytes returns the size of all files in the cache.
+func (usage *SnapshotCacheUsage) GetTotalBytes() int64 {
+	return usage.ChunkBytes + usage.SnapshotBytes + usage.OtherBytes
+}
+
+// GetSnapshotCacheDir returns the directory of the snapshot cache for the storage.
+func GetSnapshotCacheDir(storageName string) string {
+	return path.Join(GetDuplicacyPreferencePath(), "cache", storageName)
+}
+
+// ListSnapshotCaches returns the names of all storages that have a snapshot cache.
+func ListSnapshotCaches() (storageNames []string, err error) {
+	files, err := ioutil.ReadDir(path.Join(GetDuplicacyPreferencePath(), "cache"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			storageNames = append(storageNames, file.Name())
+		}
+	}
+	sort.Strings(storageNames)
+	return storageNames, nil
+}
+
+// GetSnapshotCacheUsage adds up the sizes of the files in the snapshot cache of the storage.
+func GetSnapshotCacheUsage(storageName string) (*SnapshotCacheUsage, error) {
+	cacheDir := GetSnapshotCacheDir(storageName)
+	usage := &SnapshotCacheUsage{StorageName: storageName}
+	err := filepath.Walk(cacheDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(cacheDir, filePath)
+		if err != nil {
+			return err
+		}
+		switch strings.SplitN(filepath.ToSlash(relativePath), "/", 2)[0] {
+		case "chunks":
+			usage.ChunkFiles++
+			usage.ChunkBytes += info.Size()
+		case "snapshots":
+			usage.SnapshotFiles++
+			usage.SnapshotBytes += info.Size()
+		default:
+			usage.OtherBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// PurgeSnapshotCache removes the cached chunks, the cached snapshot files, or everything, including the records of
+// verified chunks and the file indexes, from the snapshot cache of the storage.  Whatever is removed is downloaded
+// again when needed.
+func PurgeSnapshotCache(storageName string, part string) error {
+	cacheDir := GetSnapshotCacheDir(storageName)
+	switch part {
+	case "chunks", "snapshots":
+		err := os.RemoveAll(path.Join(cacheDir, part))
+		if err != nil {
+			return err
+		}
+		return os.Mkdir(path.Join(cacheDir, part), 0744)
+	case "all":
+		return os.RemoveAll(cacheDir)
+	default:
+		return fmt.Errorf("unknown part of the cache '%s'; must be chunks, snapshots, or all", part)
+	}
+}
+
+// TrimSnapshotCache removes cached chunks, the least recently used first, until the snapshot cache of the storage
+// is no larger than 'limit'.  Chunks loaded from the cache have their modification times updated, so the oldest
+// modification time marks the least recently used chunk.
+func TrimSnapshotCache(storageName string, limit int64) (removedFiles int, removedBytes int64, err error) {
+
+	usage, err := GetSnapshotCacheUsage(storageName)
+	if err != nil || usage.GetTotalBytes() <= limit {
+		return 0, 0, err
+	}
+
+	type cachedChunk struct {
+		path    string
+		size    int64
+		modTime int64
+	}
+	var chunks []cachedChunk
+	chunkDir := path.Join(GetSnapshotCacheDir(storageName), "chunks")
+	err = filepath.Walk(chunkDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			chunks = append(chunks, cachedChunk{path: filePath, size: info.Size(), modTime: info.ModTime().UnixNano()})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].modTime < chunks[j].modTime })
+
+	totalBytes := usage.GetTotalBytes()
+	for _, chunk := range chunks {
+		if totalBytes <= limit {
+			break
+		}
+		err = os.Remove(chunk.path)
+		if err != nil {
+			return removedFiles, removedBytes, err
+		}
+		totalBytes -= chunk.size
+		removedFiles++
+		removedBytes += chunk.size
+	}
+	return removedFiles, removedBytes, nil
+}
+
+// SetCacheSizeLimit sets the maximum size of the snapshot cache and trims the cache if it is already larger.
+func (manager *SnapshotManager) SetCacheSizeLimit(storageName string, limit int64) {
+	manager.cacheStorageName = storageName
+	manager.cacheSizeLimit = limit
+	manager.trimSnapshotCache()
+}
+
+// trimSnapshotCache enforces the limit set by SetCacheSizeLimit.  Failing to trim the cache is not an error.
+func (manager *SnapshotManager) trimSnapshotCache() {
+	if manager.cacheSizeLimit <= 0 {
+		return
+	}
+	removedFiles, removedBytes, err := TrimSnapshotCache(manager.cacheStorageName, manager.cacheSizeLimit)
+	if err != nil {
+		LOG_WARN("CACHE_TRIM", "Failed to trim the snapshot cache to %s: %v", PrettySize(manager.cacheSizeLimit), err)
+	} else if removedFiles > 0 {
+		LOG_INFO("CACHE_TRIM", "Removed %d least recently used chunks (%s) from the snapshot cache", removedFiles,
+			PrettySize(removedBytes))
+	}
+}
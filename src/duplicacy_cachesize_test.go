@@ -0,0 +1,75 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTrimSnapshotCache(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "cachesize")
+	os.RemoveAll(testDir)
+	SetDuplicacyPreferencePath(testDir)
+
+	cacheDir := GetSnapshotCacheDir("default")
+	os.MkdirAll(path.Join(cacheDir, "chunks", "aa"), 0744)
+	os.MkdirAll(path.Join(cacheDir, "snapshots", "host1"), 0744)
+	ioutil.WriteFile(path.Join(cacheDir, "snapshots", "host1", "1"), make([]byte, 100), 0644)
+	ioutil.WriteFile(path.Join(cacheDir, "verified_chunks"), make([]byte, 50), 0644)
+
+	// Chunk 'aa0' is the least recently used and 'aa3' the most recently used
+	now := time.Now()
+	for i, name := range []string{"0", "1", "2", "3"} {
+		chunkPath := path.Join(cacheDir, "chunks", "aa", name)
+		ioutil.WriteFile(chunkPath, make([]byte, 1000), 0644)
+		modTime := now.Add(time.Duration(i-10) * time.Hour)
+		os.Chtimes(chunkPath, modTime, modTime)
+	}
+
+	usage, err := GetSnapshotCacheUsage("default")
+	if err != nil {
+		t.Fatalf("Failed to get the cache usage: %v", err)
+	}
+	if usage.ChunkFiles != 4 || usage.ChunkBytes != 4000 || usage.SnapshotFiles != 1 || usage.SnapshotBytes != 100 ||
+		usage.OtherBytes != 50 {
+		t.Errorf("The cache usage is %+v", *usage)
+	}
+
+	removedFiles, removedBytes, err := TrimSnapshotCache("default", 2500)
+	if err != nil || removedFiles != 2 || removedBytes != 2000 {
+		t.Errorf("Trimming removed %d chunks (%d bytes): %v", removedFiles, removedBytes, err)
+	}
+	for i, name := range []string{"0", "1", "2", "3"} {
+		_, err := os.Stat(path.Join(cacheDir, "chunks", "aa", name))
+		if (i < 2) != os.IsNotExist(err) {
+			t.Errorf("Chunk %s was removed: %t", name, os.IsNotExist(err))
+		}
+	}
+
+	if removedFiles, _, _ = TrimSnapshotCache("default", 2500); removedFiles != 0 {
+		t.Errorf("Trimming again removed %d chunks", removedFiles)
+	}
+
+	if err = PurgeSnapshotCache("default", "chunks"); err != nil {
+		t.Errorf("Failed to purge the chunks: %v", err)
+	}
+	usage, _ = GetSnapshotCacheUsage("default")
+	if usage.ChunkFiles != 0 || usage.SnapshotFiles != 1 || usage.OtherBytes != 50 {
+		t.Errorf("The cache usage after purging the chunks is %+v", *usage)
+	}
+	if err = PurgeSnapshotCache("default", "all"); err != nil {
+		t.Errorf("Failed to purge the cache: %v", err)
+	}
+	if caches, _ := ListSnapshotCaches(); len(caches) != 0 {
+		t.Errorf("The caches %v remain after purging", caches)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// The exit code when the operation is stopped by an interrupt or a termination signal
+const InterruptedExitCode = 102
+
+// The context of the running operation, cancelled by CancelOperation.  Storages make their requests with it unless
+// they have been given another context by SetContext, so chunk transfers in progress fail as soon as it is cancelled,
+// and the chunk uploader and downloader don't start new ones.  The operation then stops by raising an exception;
+// CatchLogException runs RunAtError to save the incomplete snapshot and exits with InterruptedExitCode.
+var operationContext, cancelOperationContext = context.WithCancel(context.Background())
+var operationContextLock sync.RWMutex
+
+// GetOperationContext returns the context of the running operation.
+func GetOperationContext() context.Context {
+	operationContextLock.RLock()
+	defer operationContextLock.RUnlock()
+	return operationContext
+}
+
+// SetOperationContext replaces the context of the running operation, so that the operation stops when 'ctx' is done.
+// It returns a function that restores the previous context.
+func SetOperationContext(ctx context.Context) (restore func()) {
+	operationContextLock.Lock()
+	defer operationContextLock.Unlock()
+	savedContext, savedCancel := operationContext, cancelOperationContext
+	operationContext, cancelOperationContext = context.WithCancel(ctx)
+	cancel := cancelOperationContext
+	return func() {
+		cancel()
+		operationContextLock.Lock()
+		operationContext, cancelOperationContext = savedContext, savedCancel
+		operationContextLock.Unlock()
+	}
+}
+
+// getRequestContext returns the context of the requests made by the HTTP clients of storages, which is the one
+// returned by 'contextFunction', usually the GetContext method of the storage, or the context of the running operation
+// if it is nil.
+func getRequestContext(contextFunction func() context.Context) context.Context {
+	if contextFunction != nil {
+		return contextFunction()
+	}
+	return GetOperationContext()
+}
+
+// CancelOperation cancels the running operation.
+func CancelOperation() {
+	operationContextLock.RLock()
+	defer operationContextLock.RUnlock()
+	cancelOperationContext()
+}
+
+// IsOperationCancelled returns true if the running operation has been cancelled.
+func IsOperationCancelled() bool {
+	return GetOperationContext().Err() != nil
+}
+
+// checkOperationCancelled raises an exception if 'ctx' has been cancelled.
+func checkOperationCancelled(ctx context.Context) {
+	if ctx.Err() != nil {
+		LOG_ERROR("OPERATION_CANCELLED", "The operation has been cancelled")
+	}
+}
+
+// cancellableReader fails reads once the running operation is cancelled.
+type cancellableReader struct {
+	reader io.Reader
+	ctx    context.Context
+}
+
+func (reader *cancellableReader) Read(p []byte) (n int, err error) {
+	if err = reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(p)
+}
+
+// SetContext makes the requests of the storage and the snapshot cache used by the manager fail once 'ctx' is done.
+// If it is nil, the requests follow the context of the running operation.
+func (manager *BackupManager) SetContext(ctx context.Context) {
+	manager.storage.SetContext(ctx)
+	if manager.snapshotCache != nil {
+		manager.snapshotCache.SetContext(ctx)
+	}
+}
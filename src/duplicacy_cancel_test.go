@@ -0,0 +1,121 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestOperationCancellation(t *testing.T) {
+
+	setTestingT(t)
+
+	content := make([]byte, 100000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	restore := SetOperationContext(ctx)
+
+	reader := CreateRateLimitedReader(content, 0)
+	if data, err := ioutil.ReadAll(reader); err != nil || len(data) != len(content) {
+		t.Errorf("Read %d bytes before the cancellation: %v", len(data), err)
+	}
+
+	cancel()
+	if !IsOperationCancelled() {
+		t.Errorf("The operation is not cancelled")
+	}
+
+	reader = CreateRateLimitedReader(content, 1000)
+	if _, err := ioutil.ReadAll(reader); err != context.Canceled {
+		t.Errorf("The upload was not stopped: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	if _, err := RateLimitedCopy(&buffer, bytes.NewReader(content), 0); err != context.Canceled {
+		t.Errorf("The download was not stopped: %v", err)
+	}
+
+	func() {
+		setTestingT(nil)
+		defer func() {
+			setTestingT(t)
+			exception, ok := recover().(Exception)
+			if !ok || exception.LogID != "OPERATION_CANCELLED" {
+				t.Errorf("The cancellation raised %v", exception)
+			}
+		}()
+		checkOperationCancelled(GetOperationContext())
+	}()
+
+	restore()
+	if IsOperationCancelled() {
+		t.Errorf("The context was not restored")
+	}
+	checkOperationCancelled(GetOperationContext())
+}
+
+func TestStorageContext(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "storage_context")
+	os.RemoveAll(testDir)
+	os.MkdirAll(filepath.Join(testDir, "storage"), 0700)
+
+	// The server holds the downloads until the client goes away
+	handler := &webdav.Handler{FileSystem: webdav.Dir(testDir), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "GET" {
+			<-request.Context().Done()
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	storage, err := CreateWebDAVStorage(serverURL.Hostname(), port, "user", "", "storage", true, 1)
+	if err != nil {
+		t.Fatalf("Failed to create the WebDAV storage: %v", err)
+	}
+	if storage.GetContext() != GetOperationContext() {
+		t.Errorf("The storage doesn't follow the running operation by default")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	storage.SetContext(ctx)
+	if err = storage.UploadFile(0, "chunks/file1", []byte("content")); err != nil {
+		t.Fatalf("Failed to upload the file: %v", err)
+	}
+
+	// The download in progress is aborted as soon as the context of the storage is cancelled
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	chunk := CreateChunk(CreateConfig(), true)
+	if err = storage.DownloadFile(0, "chunks/file1", chunk); err == nil {
+		t.Errorf("The download wasn't aborted")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("The download was aborted after %s", time.Since(start))
+	}
+
+	storage.SetContext(nil)
+	if storage.GetContext() != GetOperationContext() {
+		t.Errorf("The storage doesn't follow the running operation after its context is reset")
+	}
+}
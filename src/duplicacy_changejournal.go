@@ -0,0 +1,301 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ChangeJournal is a journal maintained by the operating system that records the changes made to a volume, such as
+// the NTFS USN journal on Windows or the FSEvents database on macOS.  It allows a backup to list again only the
+// directories changed since the last backup.
+type ChangeJournal interface {
+	// Position returns an opaque string identifying the current end of the journal.
+	Position() (position string, err error)
+
+	// ReadChanges marks in 'changes' every file or directory under the repository changed after 'position'.  An error
+	// is returned if the journal no longer contains all the changes since then.
+	ReadChanges(position string, changes *ChangeSet) (err error)
+
+	Close()
+}
+
+// ChangeSet contains the directories that must be listed again, and the entries from the previous snapshot that can
+// be reused for those not changed.
+type ChangeSet struct {
+	Settings string // a digest of the options that affect which files are listed
+
+	changed  map[string]bool     // directories to be listed, and whether their subdirectories must be listed as well
+	previous map[string][]*Entry // the entries in each directory in the previous snapshot
+	reused   int                 // the number of directories not listed
+	revision int                 // the revision created by the backup using this change set
+	retry    []string            // files and directories (ending with '/') that the backup couldn't back up
+}
+
+func CreateChangeSet() *ChangeSet {
+	return &ChangeSet{
+		changed: make(map[string]bool),
+	}
+}
+
+// MarkChanged records that the file or directory 'path', relative to the repository root, has been changed, so its
+// parent directory must be listed again.  If 'recursive' is true, 'path' and all directories under it must be
+// listed too.
+func (changes *ChangeSet) MarkChanged(path string, recursive bool) {
+
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	if path == "" {
+		changes.changed[""] = changes.changed[""] || recursive
+		return
+	}
+
+	parent := ""
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		parent = path[:i+1]
+	}
+	if _, found := changes.changed[parent]; !found {
+		changes.changed[parent] = false
+	}
+	if recursive {
+		changes.changed[path+"/"] = true
+	}
+}
+
+// SetPreviousSnapshot indexes the entries in the previous snapshot by their directories.
+func (changes *ChangeSet) SetPreviousSnapshot(snapshot *Snapshot) {
+	changes.previous = make(map[string][]*Entry)
+	changes.previous[""] = nil
+	for _, entry := range snapshot.Files {
+		path := strings.TrimSuffix(entry.Path, "/")
+		parent := ""
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			parent = path[:i+1]
+		}
+		changes.previous[parent] = append(changes.previous[parent], entry)
+		if entry.IsDir() {
+			if _, found := changes.previous[entry.Path]; !found {
+				changes.previous[entry.Path] = nil
+			}
+		}
+	}
+}
+
+// getPreviousEntries returns copies of the entries of 'directory' in the previous snapshot if the directory hasn't
+// been changed since then.  The repository root is always listed.
+func (changes *ChangeSet) getPreviousEntries(directory string) (entries []*Entry, found bool) {
+
+	if changes == nil || changes.previous == nil || directory == "" {
+		return nil, false
+	}
+	if _, found = changes.changed[directory]; found {
+		return nil, false
+	}
+	if changes.changed[""] {
+		return nil, false
+	}
+	for i := 0; i < len(directory)-1; i++ {
+		if directory[i] == '/' && changes.changed[directory[:i+1]] {
+			return nil, false
+		}
+	}
+
+	previousEntries, found := changes.previous[directory]
+	if !found {
+		return nil, false
+	}
+
+	for _, previous := range previousEntries {
+		entries = append(entries, &Entry{
+			Path:       previous.Path,
+			Size:       previous.Size,
+			Time:       previous.Time,
+			Mode:       previous.Mode,
+			Link:       previous.Link,
+			UID:        previous.UID,
+			GID:        previous.GID,
+			Device:     previous.Device,
+			Attributes: previous.Attributes,
+		})
+	}
+	changes.reused++
+	return entries, true
+}
+
+// markListedSubdirectories is called after listing a changed directory with the files and subdirectories found.  All
+// subdirectories linked from the repository root and the source roots, which may be on other volumes not covered by
+// the journal, must be listed as well as those under a directory whose ignore file has changed.
+func (changes *ChangeSet) markListedSubdirectories(top string, directory string, files []*Entry,
+	subdirectories []*Entry) {
+
+	if changes.previous == nil {
+		return
+	}
+
+	recursive := false
+	if directory == "" {
+		for _, subdirectory := range subdirectories {
+			stat, err := os.Lstat(joinPath(top, subdirectory.Path))
+			if isSourceRoot(subdirectory.Path) || (err == nil && stat.Mode()&os.ModeSymlink != 0) {
+				changes.changed[subdirectory.Path] = true
+			}
+		}
+	}
+
+	ignoreFile := directory + DUPLICACY_IGNORE_FILE
+	var current, previous *Entry
+	for _, file := range files {
+		if file.Path == ignoreFile {
+			current = file
+		}
+	}
+	for _, file := range changes.previous[directory] {
+		if file.Path == ignoreFile {
+			previous = file
+		}
+	}
+	if (current == nil) != (previous == nil) || (current != nil && !current.IsSameAs(previous)) {
+		recursive = true
+	}
+
+	if recursive {
+		for _, subdirectory := range subdirectories {
+			changes.changed[subdirectory.Path] = true
+		}
+	}
+}
+
+// getListingSettings returns a digest of the options that determine which files are included in the snapshot.  The
+// previous snapshot can't be reused if any of them has changed.
+func getListingSettings(patterns []string, markerFiles []string, excludeByAttribute bool, specialFiles bool,
+	oneFileSystem bool) string {
+	settings := fmt.Sprintf("%s\n%s\n%t %t %t\n%s", strings.Join(patterns, "\n"), strings.Join(markerFiles, "\n"),
+		excludeByAttribute, specialFiles, oneFileSystem, getSourceRootSettings())
+	digest := sha256.Sum256([]byte(settings))
+	return hex.EncodeToString(digest[:])
+}
+
+// changeJournalState is saved after each backup and records where the journal was read up to.
+type changeJournalState struct {
+	SnapshotID string   `json:"id"`
+	Revision   int      `json:"revision"`
+	Top        string   `json:"top"`
+	Position   string   `json:"position"`
+	Settings   string   `json:"settings"`
+	Retry      []string `json:"retry,omitempty"` // files and directories (ending with '/') that couldn't be backed up
+}
+
+func (manager *BackupManager) getChangeJournalStateFile() string {
+	return joinPath(manager.snapshotCache.storageDir, "journal")
+}
+
+// prepareChangeJournal opens the change journal of the volume containing the repository and records its current
+// position.  The returned change set contains the changes since the previous snapshot; the previous snapshot can't be
+// reused, so all directories are listed, if the journal state is missing or stale.  It returns nil if the journal is
+// not available.
+func (manager *BackupManager) prepareChangeJournal(top string, previous *Snapshot) (changes *ChangeSet,
+	position string) {
+
+	journal, err := OpenChangeJournal(top)
+	if err != nil {
+		LOG_WARN("JOURNAL_OPEN", "The change journal is not available: %v", err)
+		return nil, ""
+	}
+	defer journal.Close()
+
+	position, err = journal.Position()
+	if err != nil {
+		LOG_WARN("JOURNAL_POSITION", "Failed to read the change journal: %v", err)
+		return nil, ""
+	}
+
+	changes = CreateChangeSet()
+
+	var state changeJournalState
+	description, err := ioutil.ReadFile(manager.getChangeJournalStateFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("JOURNAL_STATE", "Failed to read the change journal state: %v", err)
+		}
+		LOG_INFO("JOURNAL_FULL", "Listing all files as the change journal hasn't been read before")
+		return changes, position
+	}
+	if err = json.Unmarshal(description, &state); err != nil {
+		LOG_WARN("JOURNAL_STATE", "Failed to parse the change journal state: %v", err)
+		return changes, position
+	}
+
+	if state.SnapshotID != manager.snapshotID || state.Top != top || state.Revision != previous.Revision ||
+		previous.Revision == 0 {
+		LOG_INFO("JOURNAL_FULL", "Listing all files as the last backup didn't read the change journal")
+		return changes, position
+	}
+
+	err = journal.ReadChanges(state.Position, changes)
+	if err != nil {
+		LOG_INFO("JOURNAL_FULL", "Listing all files as the change journal can't be used: %v", err)
+		return CreateChangeSet(), position
+	}
+	for _, path := range state.Retry {
+		changes.MarkChanged(path, strings.HasSuffix(path, "/"))
+	}
+
+	LOG_INFO("JOURNAL_READ", "%d directories have been changed since revision %d", len(changes.changed),
+		previous.Revision)
+	changes.Settings = state.Settings
+	changes.SetPreviousSnapshot(previous)
+	return changes, position
+}
+
+// saveChangeJournalState records the position of the journal read before listing the repository, so that the next
+// backup only needs to read the changes after it.
+func (manager *BackupManager) saveChangeJournalState(top string, revision int, position string, settings string,
+	skippedDirectories []string, skippedFiles []string) {
+
+	state := changeJournalState{
+		SnapshotID: manager.snapshotID,
+		Revision:   revision,
+		Top:        top,
+		Position:   position,
+		Settings:   settings,
+		Retry:      append(append([]string{}, skippedDirectories...), skippedFiles...),
+	}
+
+	description, err := json.Marshal(state)
+	if err == nil {
+		err = ioutil.WriteFile(manager.getChangeJournalStateFile(), description, 0644)
+	}
+	if err != nil {
+		LOG_WARN("JOURNAL_STATE", "Failed to save the change journal state: %v", err)
+	}
+}
+
+// getRelativePath returns the path of 'fullPath' relative to 'top', with '/' as the separator, or false if it
+// isn't under 'top'.
+func getRelativePath(top string, fullPath string, caseInsensitive bool) (string, bool) {
+	top = strings.TrimSuffix(filepath.ToSlash(getNormalPath(top)), "/")
+	fullPath = filepath.ToSlash(getNormalPath(fullPath))
+	if top == "" {
+		return fullPath, true
+	}
+	if caseInsensitive {
+		if len(fullPath) < len(top) || !strings.EqualFold(fullPath[:len(top)], top) {
+			return "", false
+		}
+	} else if !strings.HasPrefix(fullPath, top) {
+		return "", false
+	}
+	relative := fullPath[len(top):]
+	if relative != "" && relative[0] != '/' {
+		return "", false
+	}
+	return strings.TrimPrefix(relative, "/"), true
+}
@@ -0,0 +1,243 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The flags of the records in the FSEvents database
+const (
+	fseventsFolderEvent   = 0x00000001
+	fseventsMount         = 0x00000002
+	fseventsUnmount       = 0x00000004
+	fseventsRenamed       = 0x08000000
+	fseventsFolderCreated = 0x80000000
+)
+
+// fseventsJournal reads the FSEvents database kept by fseventsd in the .fseventsd directory at the root of each
+// volume.  Each file in the database is a gzip-compressed list of pages containing records of the changed paths
+// and their event ids, which always increase.  Reading the database requires root privileges.
+type fseventsJournal struct {
+	top       string // the path of the repository relative to the volume root
+	directory string // the .fseventsd directory
+}
+
+type fseventsRecord struct {
+	path  string
+	id    uint64
+	flags uint32
+}
+
+func OpenChangeJournal(top string) (ChangeJournal, error) {
+
+	resolvedTop, err := filepath.EvalSymlinks(top)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoint, _, err := getVolumeMountPoint(resolvedTop)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the volume of %s: %v", resolvedTop, err)
+	}
+
+	relativeTop := resolvedTop
+	if mountPoint != "/" && strings.HasPrefix(resolvedTop, mountPoint+"/") {
+		relativeTop = resolvedTop[len(mountPoint):]
+	}
+
+	journal := &fseventsJournal{
+		top:       strings.TrimPrefix(relativeTop, "/"),
+		directory: filepath.Join(mountPoint, ".fseventsd"),
+	}
+	if _, err := journal.listFiles(); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (journal *fseventsJournal) Close() {
+}
+
+// listFiles returns the files in the database ordered from the oldest to the newest.
+func (journal *fseventsJournal) listFiles() (files []string, err error) {
+	infos, err := ioutil.ReadDir(journal.directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the FSEvents database (root privileges are required): %v", err)
+	}
+	for _, info := range infos {
+		if _, err := strconv.ParseUint(info.Name(), 16, 64); err == nil && info.Mode().IsRegular() {
+			files = append(files, info.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// getVolumeID returns the uuid that changes whenever the database is reset.
+func (journal *fseventsJournal) getVolumeID() (string, error) {
+	id, err := ioutil.ReadFile(filepath.Join(journal.directory, "fseventsd-uuid"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(id)), nil
+}
+
+// readFile returns all the records in a database file.
+func (journal *fseventsJournal) readFile(name string) (records []fseventsRecord, err error) {
+
+	file, err := os.Open(filepath.Join(journal.directory, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	for len(content) >= 12 {
+		magic := string(content[:4])
+		pageLength := int(binary.LittleEndian.Uint32(content[8:12]))
+		if pageLength < 12 || pageLength > len(content) {
+			break
+		}
+
+		// Version 2 adds a node id and version 3 adds another 4 bytes of unknown purpose to each record
+		extra := 0
+		switch magic {
+		case "1SLD":
+		case "2SLD":
+			extra = 8
+		case "3SLD":
+			extra = 12
+		default:
+			return records, fmt.Errorf("unrecognized page in %s", name)
+		}
+
+		page := content[12:pageLength]
+		for len(page) > 0 {
+			end := bytes.IndexByte(page, 0)
+			if end < 0 || end+1+12+extra > len(page) {
+				break
+			}
+			record := fseventsRecord{
+				path:  string(page[:end]),
+				id:    binary.LittleEndian.Uint64(page[end+1:]),
+				flags: binary.LittleEndian.Uint32(page[end+9:]),
+			}
+			records = append(records, record)
+			page = page[end+1+12+extra:]
+		}
+		content = content[pageLength:]
+	}
+	return records, nil
+}
+
+func (journal *fseventsJournal) Position() (string, error) {
+
+	id, err := journal.getVolumeID()
+	if err != nil {
+		return "", err
+	}
+
+	files, err := journal.listFiles()
+	if err != nil {
+		return "", err
+	}
+
+	// The newest file may still be being written
+	for i := len(files) - 1; i >= 0; i-- {
+		records, err := journal.readFile(files[i])
+		if err != nil || len(records) == 0 {
+			continue
+		}
+		last := uint64(0)
+		for _, record := range records {
+			if record.id > last {
+				last = record.id
+			}
+		}
+		return fmt.Sprintf("%s:%x", id, last), nil
+	}
+	return "", fmt.Errorf("the FSEvents database is empty")
+}
+
+func (journal *fseventsJournal) ReadChanges(position string, changes *ChangeSet) error {
+
+	separator := strings.LastIndex(position, ":")
+	if separator < 0 {
+		return fmt.Errorf("invalid journal position '%s'", position)
+	}
+	lastID, err := strconv.ParseUint(position[separator+1:], 16, 64)
+	if err != nil {
+		return fmt.Errorf("invalid journal position '%s'", position)
+	}
+
+	id, err := journal.getVolumeID()
+	if err != nil {
+		return err
+	}
+	if id != position[:separator] {
+		return fmt.Errorf("the FSEvents database has been reset")
+	}
+
+	files, err := journal.listFiles()
+	if err != nil {
+		return err
+	}
+
+	// Read from the newest file until reaching the file containing the last event read by the previous backup
+	covered := false
+	for i := len(files) - 1; i >= 0 && !covered; i-- {
+		records, err := journal.readFile(files[i])
+		if err != nil {
+			if i == len(files)-1 {
+				continue
+			}
+			return fmt.Errorf("failed to read %s: %v", files[i], err)
+		}
+		for _, record := range records {
+			if record.id <= lastID {
+				covered = true
+				continue
+			}
+			journal.processRecord(record, changes)
+		}
+	}
+
+	if !covered {
+		return fmt.Errorf("the FSEvents database no longer contains the changes since the last backup")
+	}
+	return nil
+}
+
+func (journal *fseventsJournal) processRecord(record fseventsRecord, changes *ChangeSet) {
+
+	relativePath, ok := getRelativePath(journal.top, record.path, false)
+	if !ok {
+		return
+	}
+
+	recursive := record.flags&(fseventsMount|fseventsUnmount) != 0 ||
+		(record.flags&fseventsFolderEvent != 0 && record.flags&(fseventsRenamed|fseventsFolderCreated) != 0)
+	changes.MarkChanged(relativePath, recursive)
+}
@@ -0,0 +1,17 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build !windows,!darwin
+
+package duplicacy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// OpenChangeJournal returns an error since there is no persistent change journal on this platform.
+func OpenChangeJournal(top string) (ChangeJournal, error) {
+	return nil, fmt.Errorf("change journals are not supported on %s", runtime.GOOS)
+}
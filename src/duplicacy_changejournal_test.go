@@ -0,0 +1,79 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChangeSet(t *testing.T) {
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+
+	createFiles := func(files ...string) {
+		for _, file := range files {
+			os.MkdirAll(filepath.Dir(filepath.Join(testDir, file)), 0700)
+			ioutil.WriteFile(filepath.Join(testDir, file), []byte(file), 0600)
+		}
+	}
+	listFiles := func(changes *ChangeSet) string {
+		snapshot, _, _, err := CreateSnapshotFromDirectory("test", testDir, nil, filepath.Join(testDir, "nofilters"),
+			false, false, false, changes)
+		if err != nil {
+			t.Fatalf("Failed to list the directory: %v", err)
+		}
+		var paths []string
+		for _, file := range snapshot.Files {
+			paths = append(paths, file.Path)
+		}
+		return strings.Join(paths, " ")
+	}
+
+	createFiles("a/x", "a/b/y", "c/z", "d/e/f/g")
+	initial := CreateChangeSet()
+	listFiles(initial)
+	previous, _, _, _ := CreateSnapshotFromDirectory("test", testDir, nil, filepath.Join(testDir, "nofilters"),
+		false, false, false, nil)
+
+	// Files added to directories not marked as changed are not found
+	createFiles("a/b/new", "c/unnoticed", "d/e/f/h")
+	changes := CreateChangeSet()
+	changes.Settings = initial.Settings
+	changes.MarkChanged("a/b/new", false)
+	changes.MarkChanged("d/e", true)
+	changes.SetPreviousSnapshot(previous)
+
+	listed := listFiles(changes)
+	expected := "a/ a/x a/b/ a/b/new a/b/y c/ c/z d/ d/e/ d/e/f/ d/e/f/g d/e/f/h"
+	if listed != expected {
+		t.Errorf("Listed %s; expected %s", listed, expected)
+	}
+	if changes.reused != 2 {
+		t.Errorf("%d directories reused; expected 2", changes.reused)
+	}
+
+	// The previous snapshot is ignored if the settings are different
+	changes = CreateChangeSet()
+	changes.Settings = "different"
+	changes.SetPreviousSnapshot(previous)
+	listed = listFiles(changes)
+	if !strings.Contains(listed, "c/unnoticed") {
+		t.Errorf("Listed %s without c/unnoticed", listed)
+	}
+
+	if path, ok := getRelativePath("C:/repo", "c:/Repo/dir/file", true); !ok || path != "dir/file" {
+		t.Errorf("The relative path is %s (%t)", path, ok)
+	}
+	if _, ok := getRelativePath("/repo", "/repository/file", false); ok {
+		t.Errorf("/repository/file should not be under /repo")
+	}
+
+	os.RemoveAll(testDir)
+}
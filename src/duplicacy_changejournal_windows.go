@@ -0,0 +1,255 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	FSCTL_QUERY_USN_JOURNAL = 0x000900f4
+	FSCTL_READ_USN_JOURNAL  = 0x000900bb
+
+	USN_REASON_RENAME_NEW_NAME = 0x00002000
+
+	FILE_ID_TYPE          = 0
+	EXTENDED_FILE_ID_TYPE = 2
+)
+
+var (
+	procOpenFileById             = modKernel32.NewProc("OpenFileById")
+	procGetFinalPathNameByHandle = modKernel32.NewProc("GetFinalPathNameByHandleW")
+)
+
+type usnJournalData struct {
+	UsnJournalID    uint64
+	FirstUsn        int64
+	NextUsn         int64
+	LowestValidUsn  int64
+	MaxUsn          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+type readUsnJournalData struct {
+	StartUsn          int64
+	ReasonMask        uint32
+	ReturnOnlyOnClose uint32
+	Timeout           uint64
+	BytesToWaitFor    uint64
+	UsnJournalID      uint64
+}
+
+type fileIDDescriptor struct {
+	Size   uint32
+	Type   uint32
+	FileID [16]byte
+}
+
+// usnJournal reads the USN journal of the NTFS volume containing the repository.  Each journal record identifies the
+// parent directory of the changed file by its file reference number, which is converted to a path with OpenFileById.
+type usnJournal struct {
+	top    string
+	volume syscall.Handle
+	paths  map[[16]byte]string // the paths of the parent directories found
+}
+
+func OpenChangeJournal(top string) (ChangeJournal, error) {
+
+	resolvedTop, err := filepath.EvalSymlinks(top)
+	if err != nil {
+		return nil, err
+	}
+	resolvedTop, err = filepath.Abs(resolvedTop)
+	if err != nil {
+		return nil, err
+	}
+
+	volumePath, err := getVolumePathName(resolvedTop)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the volume of %s: %v", resolvedTop, err)
+	}
+	device := strings.TrimSuffix(volumePath, `\`)
+	if len(device) == 2 && device[1] == ':' {
+		device = `\\.\` + device
+	} else if !strings.HasPrefix(device, `\\?\Volume`) {
+		return nil, fmt.Errorf("%s is not a local volume", volumePath)
+	}
+
+	volume, err := syscall.CreateFile(syscall.StringToUTF16Ptr(device), syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the volume %s (administrator privileges are required): %v", device, err)
+	}
+
+	return &usnJournal{
+		top:    resolvedTop,
+		volume: volume,
+		paths:  make(map[[16]byte]string),
+	}, nil
+}
+
+func (journal *usnJournal) Close() {
+	syscall.CloseHandle(journal.volume)
+}
+
+func (journal *usnJournal) query() (data usnJournalData, err error) {
+	var bytesReturned uint32
+	err = syscall.DeviceIoControl(journal.volume, FSCTL_QUERY_USN_JOURNAL, nil, 0, (*byte)(unsafe.Pointer(&data)),
+		uint32(unsafe.Sizeof(data)), &bytesReturned, nil)
+	if err != nil {
+		return data, fmt.Errorf("failed to query the USN journal: %v", err)
+	}
+	return data, nil
+}
+
+func (journal *usnJournal) Position() (string, error) {
+	data, err := journal.query()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x:%d", data.UsnJournalID, data.NextUsn), nil
+}
+
+func (journal *usnJournal) ReadChanges(position string, changes *ChangeSet) error {
+
+	var journalID uint64
+	var startUsn int64
+	if _, err := fmt.Sscanf(position, "%x:%d", &journalID, &startUsn); err != nil {
+		return fmt.Errorf("invalid journal position '%s'", position)
+	}
+
+	data, err := journal.query()
+	if err != nil {
+		return err
+	}
+	if data.UsnJournalID != journalID {
+		return fmt.Errorf("the USN journal has been recreated")
+	}
+	if startUsn < data.FirstUsn || startUsn < data.LowestValidUsn {
+		return fmt.Errorf("the USN journal no longer contains the changes since the last backup")
+	}
+
+	buffer := make([]byte, 64*1024)
+	for usn := startUsn; usn < data.NextUsn; {
+		input := readUsnJournalData{
+			StartUsn:     usn,
+			ReasonMask:   0xffffffff,
+			UsnJournalID: journalID,
+		}
+		var bytesReturned uint32
+		err = syscall.DeviceIoControl(journal.volume, FSCTL_READ_USN_JOURNAL, (*byte)(unsafe.Pointer(&input)),
+			uint32(unsafe.Sizeof(input)), &buffer[0], uint32(len(buffer)), &bytesReturned, nil)
+		if err != nil {
+			return fmt.Errorf("failed to read the USN journal: %v", err)
+		}
+		if bytesReturned <= 8 {
+			break
+		}
+
+		usn = int64(binary.LittleEndian.Uint64(buffer))
+		for offset := uint32(8); offset+8 <= bytesReturned; {
+			length := binary.LittleEndian.Uint32(buffer[offset:])
+			if length == 0 || offset+length > bytesReturned {
+				break
+			}
+			journal.processRecord(buffer[offset:offset+length], changes)
+			offset += length
+		}
+	}
+	return nil
+}
+
+// processRecord marks the file in a USN_RECORD_V2 or USN_RECORD_V3 as changed.
+func (journal *usnJournal) processRecord(record []byte, changes *ChangeSet) {
+
+	var parent [16]byte
+	var reason, attributes uint32
+	var nameLength, nameOffset uint16
+
+	switch binary.LittleEndian.Uint16(record[4:]) {
+	case 2:
+		if len(record) < 60 {
+			return
+		}
+		copy(parent[:8], record[16:24])
+		reason = binary.LittleEndian.Uint32(record[40:])
+		attributes = binary.LittleEndian.Uint32(record[52:])
+		nameLength = binary.LittleEndian.Uint16(record[56:])
+		nameOffset = binary.LittleEndian.Uint16(record[58:])
+	case 3:
+		if len(record) < 76 {
+			return
+		}
+		copy(parent[:], record[24:40])
+		reason = binary.LittleEndian.Uint32(record[56:])
+		attributes = binary.LittleEndian.Uint32(record[68:])
+		nameLength = binary.LittleEndian.Uint16(record[72:])
+		nameOffset = binary.LittleEndian.Uint16(record[74:])
+	default:
+		return
+	}
+	if int(nameOffset)+int(nameLength) > len(record) {
+		return
+	}
+
+	parentPath, found := journal.paths[parent]
+	if !found {
+		// The parent directory may have been deleted, in which case the deletion is recorded for its own parent
+		parentPath = journal.getPathByID(parent, binary.LittleEndian.Uint16(record[4:]) == 3)
+		journal.paths[parent] = parentPath
+	}
+	if parentPath == "" {
+		return
+	}
+
+	name := make([]uint16, nameLength/2)
+	for i := range name {
+		name[i] = binary.LittleEndian.Uint16(record[int(nameOffset)+2*i:])
+	}
+
+	relativePath, ok := getRelativePath(journal.top, parentPath+`\`+syscall.UTF16ToString(name), true)
+	if !ok {
+		return
+	}
+	recursive := reason&USN_REASON_RENAME_NEW_NAME != 0 && attributes&syscall.FILE_ATTRIBUTE_DIRECTORY != 0
+	changes.MarkChanged(relativePath, recursive)
+}
+
+// getPathByID returns the current path of the directory with the file reference number, or an empty string if it
+// doesn't exist any more.
+func (journal *usnJournal) getPathByID(id [16]byte, extended bool) string {
+
+	descriptor := fileIDDescriptor{Type: FILE_ID_TYPE, FileID: id}
+	if extended {
+		descriptor.Type = EXTENDED_FILE_ID_TYPE
+	}
+	descriptor.Size = uint32(unsafe.Sizeof(descriptor))
+
+	handle, _, _ := procOpenFileById.Call(uintptr(journal.volume), uintptr(unsafe.Pointer(&descriptor)), 0,
+		uintptr(syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE), 0,
+		uintptr(syscall.FILE_FLAG_BACKUP_SEMANTICS))
+	if syscall.Handle(handle) == syscall.InvalidHandle {
+		return ""
+	}
+	defer syscall.CloseHandle(syscall.Handle(handle))
+
+	buffer := make([]uint16, syscall.MAX_LONG_PATH)
+	r, _, _ := procGetFinalPathNameByHandle.Call(handle, uintptr(unsafe.Pointer(&buffer[0])), uintptr(len(buffer)), 0)
+	if r == 0 || int(r) > len(buffer) {
+		return ""
+	}
+
+	path := syscall.UTF16ToString(buffer[:r])
+	if strings.HasPrefix(path, `\\?\UNC\`) {
+		return `\\` + path[8:]
+	}
+	return strings.TrimPrefix(path, `\\?\`)
+}
@@ -0,0 +1,215 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SetLowMemoryCheck makes CheckSnapshots find missing chunks by sorting the chunk ids in the storage and those
+// referenced by snapshots into temporary files and merging them, rather than building in-memory sets.  This allows
+// storages with tens of millions of chunks to be checked on machines with little memory.
+func (manager *SnapshotManager) SetLowMemoryCheck(enabled bool) {
+	manager.lowMemoryCheck = enabled
+}
+
+// checkChunksWithExternalSort verifies that all chunks referenced by the snapshots exist, like CheckSnapshots does
+// without -files, -chunks, or statistics.  Temporary files are created under the system temporary directory.
+func (manager *SnapshotManager) checkChunksWithExternalSort(snapshotMap map[string][]*Snapshot, searchFossils bool,
+	resurrect bool) bool {
+
+	existingChunks, err := createExternalSorter(os.TempDir())
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_CHECK", "Failed to create the temporary directory for sorting chunks: %v", err)
+		return false
+	}
+	defer existingChunks.Close()
+
+	referencedChunks, err := createExternalSorter(os.TempDir())
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_CHECK", "Failed to create the temporary directory for sorting chunks: %v", err)
+		return false
+	}
+	defer referencedChunks.Close()
+
+	LOG_INFO("SNAPSHOT_CHECK", "Listing all chunks")
+	numberOfChunks := 0
+	emptyChunks := 0
+	var totalChunkSize int64
+	ok := manager.listChunks(func(file string, size int64) {
+		if err != nil || len(file) == 0 || file[len(file)-1] == '/' || strings.HasSuffix(file, ".fsl") ||
+			strings.HasSuffix(file, ".tmp") {
+			return
+		}
+
+		chunk := strings.Replace(file, "/", "", -1)
+		if size == 0 {
+			LOG_WARN("SNAPSHOT_CHECK", "Chunk %s has a size of 0", chunk)
+			emptyChunks++
+		}
+		numberOfChunks++
+		totalChunkSize += size
+		err = existingChunks.Add(chunk)
+	})
+	if !ok {
+		return false
+	} else if err != nil {
+		LOG_ERROR("SNAPSHOT_CHECK", "Failed to save the list of chunks: %v", err)
+		return false
+	}
+	LOG_INFO("SNAPSHOT_CHECK", "Total chunk size is %s in %d chunks", PrettyNumber(totalChunkSize), numberOfChunks)
+
+	// Snapshots are identified by their indices in this list in the sorted file
+	var snapshots []*Snapshot
+	for _, snapshotList := range snapshotMap {
+		snapshots = append(snapshots, snapshotList...)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].ID != snapshots[j].ID {
+			return snapshots[i].ID < snapshots[j].ID
+		}
+		return snapshots[i].Revision < snapshots[j].Revision
+	})
+
+	for index, snapshot := range snapshots {
+		for _, chunk := range manager.GetSnapshotChunks(snapshot, false) {
+			err = referencedChunks.Add(fmt.Sprintf("%s %d", chunk, index))
+			if err != nil {
+				LOG_ERROR("SNAPSHOT_CHECK", "Failed to save the list of referenced chunks: %v", err)
+				return false
+			}
+		}
+	}
+
+	existing, err := existingChunks.Sorted()
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_CHECK", "Failed to sort the list of chunks: %v", err)
+		return false
+	}
+	defer existing.Close()
+
+	referenced, err := referencedChunks.Sorted()
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_CHECK", "Failed to sort the list of referenced chunks: %v", err)
+		return false
+	}
+	defer referenced.Close()
+
+	missingChunks := make([]int, len(snapshots))
+	totalMissingChunks := 0
+	lookups := 0
+
+	existingChunk, hasExisting := existing.Next()
+	currentChunk := ""
+	lastIndex := -1
+	exist, isFossil := false, false
+	for {
+		line, found := referenced.Next()
+		if !found {
+			break
+		}
+
+		separator := strings.IndexByte(line, ' ')
+		chunkID := line[:separator]
+		index, _ := strconv.Atoi(line[separator+1:])
+
+		if chunkID != currentChunk {
+			currentChunk = chunkID
+			lastIndex = -1
+			for hasExisting && existingChunk < chunkID {
+				existingChunk, hasExisting = existing.Next()
+			}
+			exist, isFossil = hasExisting && existingChunk == chunkID, false
+			if !exist {
+				exist, isFossil = manager.findUnlistedChunk(chunkID, &lookups, searchFossils, resurrect)
+			}
+		} else if index == lastIndex {
+			// The chunk is referenced more than once by the same snapshot
+			continue
+		}
+		lastIndex = index
+
+		snapshot := snapshots[index]
+		if !exist {
+			missingChunks[index]++
+			totalMissingChunks++
+			LOG_WARN("SNAPSHOT_VALIDATE", "Chunk %s referenced by snapshot %s at revision %d does not exist",
+				chunkID, snapshot.ID, snapshot.Revision)
+		} else if isFossil && !resurrect {
+			LOG_WARN("SNAPSHOT_FOSSIL", "Chunk %s referenced by snapshot %s at revision %d "+
+				"has been marked as a fossil", chunkID, snapshot.ID, snapshot.Revision)
+		}
+	}
+
+	if err = existing.Err(); err == nil {
+		err = referenced.Err()
+	}
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_CHECK", "Failed to read the sorted list of chunks: %v", err)
+		return false
+	}
+
+	for index, snapshot := range snapshots {
+		if missingChunks[index] > 0 {
+			LOG_WARN("SNAPSHOT_CHECK", "Some chunks referenced by snapshot %s at revision %d are missing",
+				snapshot.ID, snapshot.Revision)
+		} else {
+			LOG_INFO("SNAPSHOT_CHECK", "All chunks referenced by snapshot %s at revision %d exist",
+				snapshot.ID, snapshot.Revision)
+		}
+	}
+
+	if totalMissingChunks > 0 {
+		LOG_ERROR("SNAPSHOT_CHECK", "Some chunks referenced by some snapshots do not exist in the storage")
+		return false
+	}
+
+	if emptyChunks > 0 {
+		LOG_ERROR("SNAPSHOT_CHECK", "%d chunks have a size of 0", emptyChunks)
+		return false
+	}
+
+	return true
+}
+
+// findUnlistedChunk looks for a referenced chunk that was not in the listing: it may have been uploaded after the
+// listing (only looked up for the first 100 such chunks, unless the listing comes from a chunk index that may miss
+// them), or it may be a fossil if 'searchFossils' is true.
+func (manager *SnapshotManager) findUnlistedChunk(chunkID string, lookups *int, searchFossils bool,
+	resurrect bool) (exist bool, isFossil bool) {
+
+	if *lookups < 100 || manager.chunkIndex.mayMissChunks() {
+		*lookups++
+		chunkPath, exist, size, err := manager.storage.FindChunk(0, chunkID, false)
+		if err != nil {
+			LOG_WARN("SNAPSHOT_VALIDATE", "Failed to check the existence of chunk %s: %v", chunkID, err)
+		} else if exist {
+			LOG_INFO("SNAPSHOT_VALIDATE", "Chunk %s is confirmed to exist", chunkID)
+			manager.chunkIndex.addFile(chunkPath, size)
+			return true, false
+		}
+	}
+
+	if !searchFossils {
+		return false, false
+	}
+
+	chunkPath, exist, _, err := manager.storage.FindChunk(0, chunkID, true)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_VALIDATE", "Failed to check the existence of fossil %s: %v", chunkID, err)
+		return false, false
+	} else if !exist {
+		return false, false
+	}
+
+	if resurrect {
+		manager.resurrectChunk(chunkPath, chunkID)
+	}
+	return true, true
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The default interval between two checkpoints of an initial backup
+const defaultCheckpointInterval = 5 * time.Minute
+
+// backupCheckpoint keeps track of the chunks uploaded by an initial backup, which may complete out of order when
+// there are multiple uploading threads, in order to periodically save the files whose chunks have all been uploaded
+// as an incomplete snapshot.  If the backup is interrupted in a way that prevents RunAtError from being called, such
+// as a crash or a reboot, the next backup resumes from the last checkpoint.
+type backupCheckpoint struct {
+	interval time.Duration
+
+	lock      sync.Mutex
+	completed map[int]bool // chunks completed after a chunk with a smaller index that is still being uploaded
+	confirmed int          // chunks from 1 to 'confirmed' have all been uploaded
+	lastSave  time.Time
+	saving    bool
+}
+
+// createBackupCheckpoint creates a checkpoint tracker with the interval set by DUPLICACY_CHECKPOINT_INTERVAL (in
+// seconds), or the default interval.
+func createBackupCheckpoint() *backupCheckpoint {
+	interval := defaultCheckpointInterval
+	if value, found := os.LookupEnv("DUPLICACY_CHECKPOINT_INTERVAL"); found {
+		seconds, _ := strconv.Atoi(value)
+		if seconds < 1 {
+			seconds = 1
+		}
+		LOG_INFO("BACKUP_CHECKPOINT", "Setting the checkpoint interval to %d seconds", seconds)
+		interval = time.Duration(seconds) * time.Second
+	}
+	return &backupCheckpoint{
+		interval:  interval,
+		completed: make(map[int]bool),
+		lastSave:  time.Now(),
+	}
+}
+
+// chunkCompleted records that the chunk with the index 'chunkIndex' (starting from 1) has been uploaded or found in
+// the storage.  It returns the number of chunks that have been uploaded without gaps and, if it is time to save a
+// checkpoint, true; in that case saved must be called once the checkpoint has been saved.
+func (checkpoint *backupCheckpoint) chunkCompleted(chunkIndex int) (confirmed int, due bool) {
+	if checkpoint == nil {
+		return 0, false
+	}
+
+	checkpoint.lock.Lock()
+	defer checkpoint.lock.Unlock()
+
+	checkpoint.completed[chunkIndex] = true
+	for checkpoint.completed[checkpoint.confirmed+1] {
+		delete(checkpoint.completed, checkpoint.confirmed+1)
+		checkpoint.confirmed++
+	}
+
+	if checkpoint.saving || time.Since(checkpoint.lastSave) < checkpoint.interval {
+		return checkpoint.confirmed, false
+	}
+	checkpoint.saving = true
+	return checkpoint.confirmed, true
+}
+
+func (checkpoint *backupCheckpoint) saved() {
+	checkpoint.lock.Lock()
+	checkpoint.saving = false
+	checkpoint.lastSave = time.Now()
+	checkpoint.lock.Unlock()
+}
+
+// createCheckpointSnapshot creates the incomplete snapshot to be saved at a checkpoint.  'files' are all the entries
+// in the snapshot being created, in which files that haven't been processed have a size of -1.  Files that have been
+// packed into chunks are included only if all their chunks are among the first 'confirmed' uploaded chunks.  The
+// entries are copied so the backup in progress is not affected.
+func createCheckpointSnapshot(files []*Entry, preservedChunkHashes []string, preservedChunkLengths []int,
+	uploadedEntries []*Entry, uploadedChunkHashes []string, uploadedChunkLengths []int, confirmed int) *Snapshot {
+
+	// A chunk found in the cache is completed before it is added to the uploaded chunks
+	if confirmed > len(uploadedChunkHashes) {
+		confirmed = len(uploadedChunkHashes)
+	}
+
+	var confirmedSize int64
+	for _, length := range uploadedChunkLengths[:confirmed] {
+		confirmedSize += int64(length)
+	}
+
+	uploaded := make(map[*Entry]bool)
+	for _, entry := range uploadedEntries {
+		uploaded[entry] = true
+	}
+
+	// The content of uploaded files is set in the copies only
+	copies := make(map[*Entry]*Entry)
+	var copiedEntries []*Entry
+	var packedSize int64
+	for _, entry := range uploadedEntries {
+		packedSize += entry.Size
+		if packedSize > confirmedSize {
+			break
+		}
+		copied := *entry
+		copies[entry] = &copied
+		copiedEntries = append(copiedEntries, &copied)
+	}
+	setEntryContent(copiedEntries, uploadedChunkLengths[:confirmed], len(preservedChunkHashes))
+
+	var checkpointFiles []*Entry
+	for _, entry := range files {
+		if copied, found := copies[entry]; found {
+			checkpointFiles = append(checkpointFiles, copied)
+			continue
+		}
+		if entry.IsFile() && (uploaded[entry] || entry.Size < 0) {
+			break
+		}
+		copied := *entry
+		checkpointFiles = append(checkpointFiles, &copied)
+	}
+
+	return &Snapshot{
+		Files:        checkpointFiles,
+		ChunkHashes:  append(append([]string{}, preservedChunkHashes...), uploadedChunkHashes[:confirmed]...),
+		ChunkLengths: append(append([]int{}, preservedChunkLengths...), uploadedChunkLengths[:confirmed]...),
+	}
+}
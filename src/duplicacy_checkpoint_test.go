@@ -0,0 +1,69 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackupCheckpoint(t *testing.T) {
+
+	checkpoint := &backupCheckpoint{
+		interval:  time.Hour,
+		completed: make(map[int]bool),
+		lastSave:  time.Now(),
+	}
+
+	// Chunk 1 is still being uploaded
+	for _, index := range []int{2, 3} {
+		if confirmed, due := checkpoint.chunkCompleted(index); confirmed != 0 || due {
+			t.Errorf("After chunk %d: %d chunks confirmed, due: %t", index, confirmed, due)
+		}
+	}
+	if confirmed, _ := checkpoint.chunkCompleted(1); confirmed != 3 {
+		t.Errorf("%d chunks confirmed after chunk 1 is completed", confirmed)
+	}
+
+	checkpoint.lastSave = time.Now().Add(-2 * time.Hour)
+	if _, due := checkpoint.chunkCompleted(5); !due {
+		t.Errorf("The checkpoint is not due")
+	}
+	if _, due := checkpoint.chunkCompleted(6); due {
+		t.Errorf("Another checkpoint is due while the last one is being saved")
+	}
+	checkpoint.saved()
+
+	// 'dir/' hasn't been processed (directories keep a size of -1); 'file3' has been packed but its second chunk
+	// hasn't been uploaded yet and 'file4' hasn't been packed
+	files := []*Entry{
+		CreateEntry("dir/", -1, 0, 0700|uint32(os.ModeDir)),
+		CreateEntry("file1", 100, 0, 0644),
+		CreateEntry("file2", 50, 0, 0644),
+		CreateEntry("file3", 200, 0, 0644),
+		CreateEntry("file4", -1, 0, 0644),
+	}
+	uploadedEntries := files[1:4]
+	chunkHashes := []string{"chunk1", "chunk2", "chunk3"}
+	chunkLengths := []int{120, 100, 130}
+
+	snapshot := createCheckpointSnapshot(files, nil, nil, uploadedEntries, chunkHashes, chunkLengths, 2)
+
+	if len(snapshot.Files) != 3 || snapshot.Files[2].Path != "file2" {
+		t.Fatalf("The checkpoint contains %d files", len(snapshot.Files))
+	}
+	if len(snapshot.ChunkHashes) != 2 || len(snapshot.ChunkLengths) != 2 {
+		t.Errorf("The checkpoint contains %d chunks", len(snapshot.ChunkHashes))
+	}
+	file2 := snapshot.Files[2]
+	if file2.StartChunk != 0 || file2.StartOffset != 100 || file2.EndChunk != 1 || file2.EndOffset != 30 {
+		t.Errorf("file2 has content %d:%d:%d:%d", file2.StartChunk, file2.StartOffset, file2.EndChunk,
+			file2.EndOffset)
+	}
+	if files[2].EndChunk != 0 || files[2].EndOffset != 0 {
+		t.Errorf("The content of the original entry has been changed")
+	}
+}
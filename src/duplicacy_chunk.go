@@ -19,7 +19,6 @@ import (
 	"hash"
 	"io"
 	"os"
-	"runtime"
 
 	"github.com/bkaradzic/go-lz4"
 	"github.com/minio/highwayhash"
@@ -27,24 +26,46 @@ import (
 )
 
 // A chunk needs to acquire a new buffer and return the old one for every encrypt/decrypt operation, therefore
-// we maintain a pool of previously used buffers.
-var chunkBufferPool chan *bytes.Buffer = make(chan *bytes.Buffer, runtime.NumCPU()*16)
+// each config maintains a pool of previously used buffers.  All buffers in the pool can hold a chunk of the maximum
+// size at every stage, so that downloading, decrypting and decompressing a chunk never has to grow a buffer.  Being a
+// sync.Pool, the free buffers are eventually returned to the garbage collector instead of the pool being capped.
+
+// The space reserved in a chunk buffer for the banner, the RSA encrypted key, the nonce, the padding, the GCM tag,
+// and the free space bytes.Buffer.ReadFrom needs to avoid growing the buffer.
+const chunkBufferOverhead = 1024 + bytes.MinRead
+
+// chunkBufferSize returns the capacity of the buffers in the pool.
+func (config *Config) chunkBufferSize() int {
+	size := lz4.CompressBound(config.MaximumChunkSize) + chunkBufferOverhead
+	if config.DataShards > 0 && config.ParityShards > 0 {
+		shardSize := (size + config.DataShards - 1) / config.DataShards
+		size = len(ERASURE_CODING_BANNER) + 2*14 + (config.DataShards+config.ParityShards)*(shardSize+32)
+	}
+	return size
+}
 
-func AllocateChunkBuffer() (buffer *bytes.Buffer) {
-	select {
-	case buffer = <-chunkBufferPool:
-	default:
-		buffer = new(bytes.Buffer)
+// AllocateChunkBuffer returns an empty buffer from the pool, or a new one if the pool is empty.
+func (config *Config) AllocateChunkBuffer() *bytes.Buffer {
+	if config.bufferPool != nil {
+		if buffer, ok := config.bufferPool.Get().(*bytes.Buffer); ok {
+			buffer.Reset()
+			return buffer
+		}
 	}
-	return buffer
+	return bytes.NewBuffer(make([]byte, 0, config.chunkBufferSize()))
 }
 
-func ReleaseChunkBuffer(buffer *bytes.Buffer) {
-	select {
-	case chunkBufferPool <- buffer:
-	default:
-		LOG_INFO("CHUNK_BUFFER", "Discarding a free chunk buffer due to a full pool")
+// ReleaseChunkBuffer returns a buffer to the pool.  Buffers too small to be reused without growing are discarded, and
+// so are those that have grown much larger than needed, which would otherwise be kept alive by the pool.
+func (config *Config) ReleaseChunkBuffer(buffer *bytes.Buffer) {
+	if buffer == nil || config.bufferPool == nil {
+		return
 	}
+	size := config.chunkBufferSize()
+	if buffer.Cap() < size || buffer.Cap() > 2*size {
+		return
+	}
+	config.bufferPool.Put(buffer)
 }
 
 // Chunk is the object being passed between the chunk maker, the chunk uploader, and chunk downloader.  It can be
@@ -77,6 +98,10 @@ var ENCRYPTION_BANNER = "duplicacy\000"
 // RSA encrypted chunks start with "duplicacy\002"
 var ENCRYPTION_VERSION_RSA byte = 2
 
+// Chunks encrypted with a random key, which is in turn encrypted with the key that would otherwise be used, start
+// with "duplicacy\004"
+var ENCRYPTION_VERSION_WRAPPED byte = 4
+
 var ERASURE_CODING_BANNER = "duplicacy\003"
 
 // CreateChunk creates a new chunk.
@@ -85,11 +110,7 @@ func CreateChunk(config *Config, bufferNeeded bool) *Chunk {
 	var buffer *bytes.Buffer
 
 	if bufferNeeded {
-		buffer = AllocateChunkBuffer()
-		buffer.Reset()
-		if buffer.Cap() < config.MaximumChunkSize {
-			buffer.Grow(config.MaximumChunkSize - buffer.Cap())
-		}
+		buffer = config.AllocateChunkBuffer()
 	}
 
 	return &Chunk{
@@ -148,6 +169,23 @@ func (chunk *Chunk) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// ReadFrom implements the ReaderFrom interface, so that io.Copy reads directly into the free space of the chunk
+// buffer instead of copying through a temporary buffer.
+func (chunk *Chunk) ReadFrom(reader io.Reader) (int64, error) {
+
+	if chunk.buffer == nil {
+		// Hide ReadFrom from io.Copy, which would otherwise call it again
+		return io.Copy(struct{ io.Writer }{chunk}, reader)
+	}
+
+	start := chunk.buffer.Len()
+	n, err := chunk.buffer.ReadFrom(reader)
+	if chunk.hasher != nil {
+		chunk.hasher.Write(chunk.buffer.Bytes()[start:])
+	}
+	return n, err
+}
+
 // GetHash returns the chunk hash.
 func (chunk *Chunk) GetHash() string {
 	if len(chunk.hash) == 0 {
@@ -193,16 +231,16 @@ func (chunk *Chunk) Encrypt(encryptionKey []byte, derivationKey string, isSnapsh
 	var nonce []byte
 	var offset int
 
-	encryptedBuffer := AllocateChunkBuffer()
-	encryptedBuffer.Reset()
+	encryptedBuffer := chunk.config.AllocateChunkBuffer()
 	defer func() {
-		ReleaseChunkBuffer(encryptedBuffer)
+		chunk.config.ReleaseChunkBuffer(encryptedBuffer)
 	}()
 
 	if len(encryptionKey) > 0 {
 
 		key := encryptionKey
 		usingRSA := false
+		var wrappedKey []byte
 		// Enable RSA encryption only when the chunk is not a snapshot chunk
 		if chunk.config.rsaPublicKey != nil && !isSnapshot && !chunk.isSnapshot {
 			randomKey := make([]byte, 32)
@@ -212,10 +250,23 @@ func (chunk *Chunk) Encrypt(encryptionKey []byte, derivationKey string, isSnapsh
 			}
 			key = randomKey
 			usingRSA = true
-		} else if len(derivationKey) > 0 {
-			hasher := chunk.config.NewKeyedHasher([]byte(derivationKey))
-			hasher.Write(encryptionKey)
-			key = hasher.Sum(nil)
+		} else {
+			if len(derivationKey) > 0 {
+				hasher := chunk.config.NewKeyedHasher([]byte(derivationKey))
+				hasher.Write(encryptionKey)
+				key = hasher.Sum(nil)
+			}
+			if chunk.config.RandomChunkKeys {
+				randomKey := make([]byte, 32)
+				if _, err := rand.Read(randomKey); err != nil {
+					return err
+				}
+				wrappedKey, err = wrapChunkKey(key, randomKey)
+				if err != nil {
+					return err
+				}
+				key = randomKey
+			}
 		}
 
 		aesBlock, err = aes.NewCipher(key)
@@ -241,6 +292,11 @@ func (chunk *Chunk) Encrypt(encryptionKey []byte, derivationKey string, isSnapsh
 			}
 			binary.Write(encryptedBuffer, binary.LittleEndian, uint16(len(encryptedKey)))
 			encryptedBuffer.Write(encryptedKey)
+		} else if wrappedKey != nil {
+			// A chunk with a wrapped key starts with "duplicacy\004" followed by the wrapped key
+			encryptedBuffer.Write([]byte(ENCRYPTION_BANNER)[:len(ENCRYPTION_BANNER) - 1])
+			encryptedBuffer.Write([]byte{ENCRYPTION_VERSION_WRAPPED})
+			encryptedBuffer.Write(wrappedKey)
 		} else {
 			encryptedBuffer.Write([]byte(ENCRYPTION_BANNER))
 		}
@@ -375,10 +431,9 @@ func (chunk *Chunk) Decrypt(encryptionKey []byte, derivationKey string) (err err
 
 	var offset int
 
-	encryptedBuffer := AllocateChunkBuffer()
-	encryptedBuffer.Reset()
+	encryptedBuffer := chunk.config.AllocateChunkBuffer()
 	defer func() {
-		ReleaseChunkBuffer(encryptedBuffer)
+		chunk.config.ReleaseChunkBuffer(encryptedBuffer)
 	}()
 
 	chunk.buffer, encryptedBuffer = encryptedBuffer, chunk.buffer
@@ -486,14 +541,13 @@ func (chunk *Chunk) Decrypt(encryptionKey []byte, derivationKey string) (err err
 				return err
 			}
 			LOG_DEBUG("CHUNK_ERASURECODE", "Chunk data successfully recovered")
-			buffer := AllocateChunkBuffer()
-			buffer.Reset()
+			buffer := chunk.config.AllocateChunkBuffer()
 			for i := 0; i < dataShards; i++ {
 				buffer.Write(data[i])
 			}
 			buffer.Truncate(chunkSize)
 
-			ReleaseChunkBuffer(encryptedBuffer)
+			chunk.config.ReleaseChunkBuffer(encryptedBuffer)
 			encryptedBuffer = buffer
 		}
 
@@ -524,10 +578,23 @@ func (chunk *Chunk) Decrypt(encryptionKey []byte, derivationKey string) (err err
 		}
 
 		encryptionVersion := encryptedBuffer.Bytes()[bannerLength-1]
-		if encryptionVersion != 0 && encryptionVersion != ENCRYPTION_VERSION_RSA {
+		if encryptionVersion != 0 && encryptionVersion != ENCRYPTION_VERSION_RSA &&
+			encryptionVersion != ENCRYPTION_VERSION_WRAPPED {
 			return fmt.Errorf("Unsupported encryption version %d", encryptionVersion)
 		}
 
+		if encryptionVersion == ENCRYPTION_VERSION_WRAPPED {
+			if len(encryptedBuffer.Bytes()) < bannerLength + wrappedChunkKeyLength + 12 {
+				return fmt.Errorf("No enough encrypted data (%d bytes) provided", len(encryptedBuffer.Bytes()))
+			}
+
+			key, err = unwrapChunkKey(key, encryptedBuffer.Bytes()[bannerLength:bannerLength + wrappedChunkKeyLength])
+			if err != nil {
+				return err
+			}
+			bannerLength += wrappedChunkKeyLength
+		}
+
 		if encryptionVersion == ENCRYPTION_VERSION_RSA {
 			if chunk.config.rsaPrivateKey == nil {
 				LOG_ERROR("CHUNK_DECRYPT", "An RSA private key is required to decrypt the chunk")
@@ -593,13 +660,17 @@ func (chunk *Chunk) Decrypt(encryptionKey []byte, derivationKey string) (err err
 
 	compressed := encryptedBuffer.Bytes()
 	if len(compressed) > 4 && string(compressed[:4]) == "LZ4 " {
+		// Decode directly into the free space of the chunk buffer; lz4.Decode only allocates a new slice if the
+		// chunk doesn't fit, in which case the new slice becomes the buffer
 		chunk.buffer.Reset()
-		decompressed, err := lz4.Decode(chunk.buffer.Bytes(), encryptedBuffer.Bytes()[4:])
+		decompressed, err := lz4.Decode(chunk.buffer.Bytes()[:chunk.buffer.Cap()], encryptedBuffer.Bytes()[4:])
 		if err != nil {
 			return err
 		}
 
-		chunk.buffer.Write(decompressed)
+		if len(decompressed) > 0 {
+			chunk.buffer = bytes.NewBuffer(decompressed)
+		}
 		chunk.hasher = chunk.config.NewKeyedHasher(chunk.config.HashKey)
 		chunk.hasher.Write(decompressed)
 		chunk.hash = nil
@@ -623,3 +694,86 @@ func (chunk *Chunk) Decrypt(encryptionKey []byte, derivationKey string) (err err
 	return nil
 
 }
+
+// RewrapRSAKey decrypts the random key of an RSA encrypted chunk with 'privateKey' and encrypts it again with
+// 'publicKey'.  The encrypted chunk data is left untouched.  This doesn't work for erasure coded chunks, which have
+// to be decrypted and encrypted again.
+func (chunk *Chunk) RewrapRSAKey(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) error {
+
+	bannerLength := len(ENCRYPTION_BANNER)
+	content := chunk.buffer.Bytes()
+
+	if len(content) < bannerLength+2 || string(content[:bannerLength-1]) != ENCRYPTION_BANNER[:bannerLength-1] ||
+		content[bannerLength-1] != ENCRYPTION_VERSION_RSA {
+		return fmt.Errorf("The chunk is not encrypted by an RSA key")
+	}
+
+	encryptedKeyLength := int(binary.LittleEndian.Uint16(content[bannerLength : bannerLength+2]))
+	if len(content) < bannerLength+2+encryptedKeyLength {
+		return fmt.Errorf("No enough encrypted data (%d bytes) provided", len(content))
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, content[bannerLength+2:bannerLength+2+encryptedKeyLength], nil)
+	if err != nil {
+		return err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return err
+	}
+
+	rewrappedBuffer := chunk.config.AllocateChunkBuffer()
+	rewrappedBuffer.Reset()
+	rewrappedBuffer.Write(content[:bannerLength])
+	binary.Write(rewrappedBuffer, binary.LittleEndian, uint16(len(encryptedKey)))
+	rewrappedBuffer.Write(encryptedKey)
+	rewrappedBuffer.Write(content[bannerLength+2+encryptedKeyLength:])
+
+	chunk.buffer, rewrappedBuffer = rewrappedBuffer, chunk.buffer
+	chunk.config.ReleaseChunkBuffer(rewrappedBuffer)
+	return nil
+}
+
+// The length of a random chunk key wrapped by wrapChunkKey: the nonce, the key and the GCM tag
+const wrappedChunkKeyLength = 12 + 32 + 16
+
+// wrapChunkKey encrypts the random key of a chunk with 'key', the key that would be used if random keys were not
+// enabled.
+func wrapChunkKey(key []byte, randomKey []byte) ([]byte, error) {
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, randomKey, nil), nil
+}
+
+// unwrapChunkKey decrypts the random key of a chunk wrapped by wrapChunkKey.
+func unwrapChunkKey(key []byte, wrappedKey []byte) ([]byte, error) {
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	randomKey, err := gcm.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt the chunk key: %v", err)
+	}
+	return randomKey, nil
+}
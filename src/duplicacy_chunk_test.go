@@ -8,6 +8,7 @@ import (
 	"bytes"
 	crypto_rand "crypto/rand"
 	"crypto/rsa"
+	"io"
 	"math/rand"
 	"testing"
 )
@@ -134,3 +135,205 @@ func TestChunkBasic(t *testing.T) {
 	}
 
 }
+
+func TestChunkEncryptionAudit(t *testing.T) {
+
+	key := []byte("duplicacydefault")
+
+	privateKey, err := rsa.GenerateKey(crypto_rand.Reader, 2048)
+	if err != nil {
+		t.Errorf("Failed to generate a random private key: %v", err)
+		return
+	}
+
+	for _, dataShards := range []int{0, 5} {
+		config := CreateConfig()
+		config.HashKey = key
+		config.IDKey = key
+		config.CompressionLevel = DEFAULT_COMPRESSION_LEVEL
+		config.DataShards = dataShards
+		config.ParityShards = 2
+
+		for _, test := range []struct {
+			encryptionKey []byte
+			usingRSA      bool
+			randomKeys    bool
+			expected      int
+		}{
+			{nil, false, false, ChunkEncryptionNone},
+			{key, false, false, ChunkEncryptionDerivedKey},
+			{key, true, false, ChunkEncryptionRSAKey},
+			{key, false, true, ChunkEncryptionWrappedKey},
+			{key, true, true, ChunkEncryptionRSAKey},
+		} {
+			config.rsaPublicKey = nil
+			config.rsaPrivateKey = nil
+			if test.usingRSA {
+				config.rsaPublicKey = privateKey.Public().(*rsa.PublicKey)
+				config.rsaPrivateKey = privateKey
+			}
+			config.RandomChunkKeys = test.randomKeys
+
+			chunk := CreateChunk(config, true)
+			chunk.Reset(true)
+			chunk.Write(bytes.Repeat([]byte("duplicacy"), 100))
+			err := chunk.Encrypt(test.encryptionKey, "", false)
+			if err != nil {
+				t.Errorf("Failed to encrypt the test data: %v", err)
+				return
+			}
+
+			encryption := GetChunkEncryption(chunk.GetBytes())
+			if encryption != test.expected {
+				t.Errorf("Chunk encryption is %s instead of %s (data shards: %d)", chunkEncryptionNames[encryption],
+					chunkEncryptionNames[test.expected], dataShards)
+			}
+
+			encrypted := append([]byte{}, chunk.GetBytes()...)
+			err = chunk.Decrypt(test.encryptionKey, "")
+			if err != nil {
+				t.Errorf("Failed to decrypt the %s chunk: %v", chunkEncryptionNames[test.expected], err)
+			} else if !bytes.Equal(chunk.GetBytes(), bytes.Repeat([]byte("duplicacy"), 100)) {
+				t.Errorf("The %s chunk was decrypted incorrectly", chunkEncryptionNames[test.expected])
+			}
+
+			// Encrypting the same data again uses a different random key
+			if test.expected == ChunkEncryptionWrappedKey && dataShards == 0 {
+				chunk.Reset(true)
+				chunk.Write(bytes.Repeat([]byte("duplicacy"), 100))
+				chunk.Encrypt(test.encryptionKey, "", false)
+				wrappedKeyEnd := len(ENCRYPTION_BANNER) + wrappedChunkKeyLength
+				key1, err1 := unwrapChunkKey(test.encryptionKey, encrypted[len(ENCRYPTION_BANNER):wrappedKeyEnd])
+				key2, err2 := unwrapChunkKey(test.encryptionKey, chunk.GetBytes()[len(ENCRYPTION_BANNER):wrappedKeyEnd])
+				if err1 != nil || err2 != nil || bytes.Equal(key1, key2) {
+					t.Errorf("The same chunk was encrypted with the same key twice (%v, %v)", err1, err2)
+				}
+			}
+		}
+	}
+}
+
+func TestChunkRewrapRSAKey(t *testing.T) {
+
+	key := []byte("duplicacydefault")
+
+	oldKey, err := rsa.GenerateKey(crypto_rand.Reader, 2048)
+	if err != nil {
+		t.Errorf("Failed to generate a random private key: %v", err)
+		return
+	}
+	newKey, err := rsa.GenerateKey(crypto_rand.Reader, 2048)
+	if err != nil {
+		t.Errorf("Failed to generate a random private key: %v", err)
+		return
+	}
+
+	config := CreateConfig()
+	config.HashKey = key
+	config.IDKey = key
+	config.CompressionLevel = DEFAULT_COMPRESSION_LEVEL
+	config.rsaPublicKey = oldKey.Public().(*rsa.PublicKey)
+
+	plainData := bytes.Repeat([]byte("duplicacy"), 1000)
+	chunk := CreateChunk(config, true)
+	chunk.Reset(true)
+	chunk.Write(plainData)
+	hash := chunk.GetHash()
+	err = chunk.Encrypt(key, hash, false)
+	if err != nil {
+		t.Errorf("Failed to encrypt the test data: %v", err)
+		return
+	}
+
+	err = chunk.RewrapRSAKey(oldKey, newKey.Public().(*rsa.PublicKey))
+	if err != nil {
+		t.Errorf("Failed to re-wrap the chunk key: %v", err)
+		return
+	}
+
+	config.rsaPrivateKey = newKey
+	err = chunk.Decrypt(key, hash)
+	if err != nil {
+		t.Errorf("Failed to decrypt the re-wrapped chunk: %v", err)
+		return
+	}
+
+	if !bytes.Equal(chunk.GetBytes(), plainData) {
+		t.Errorf("The re-wrapped chunk doesn't contain the original data")
+	}
+}
+
+func TestChunkBufferPool(t *testing.T) {
+
+	key := []byte("duplicacydefault")
+
+	for _, compressionLevel := range []int{DEFAULT_COMPRESSION_LEVEL, 6} {
+		config := CreateConfig()
+		config.HashKey = key
+		config.IDKey = key
+		config.CompressionLevel = compressionLevel
+		config.MinimumChunkSize = 100
+		config.MaximumChunkSize = 256 * 1024
+		bufferSize := config.chunkBufferSize()
+
+		// Incompressible data of the maximum chunk size
+		plainData := make([]byte, config.MaximumChunkSize)
+		crypto_rand.Read(plainData)
+
+		chunk := CreateChunk(config, true)
+		chunk.Reset(true)
+		chunk.Write(plainData)
+		hash := chunk.GetHash()
+
+		if err := chunk.Encrypt(key, "", false); err != nil {
+			t.Fatalf("Failed to encrypt the data: %v", err)
+		}
+		encryptedData := make([]byte, chunk.GetLength())
+		copy(encryptedData, chunk.GetBytes())
+
+		// Download the chunk the way storages do
+		chunk.Reset(false)
+		if _, err := RateLimitedCopy(chunk, bytes.NewReader(encryptedData), 0); err != nil {
+			t.Fatalf("Failed to copy the data: %v", err)
+		}
+		if chunk.buffer.Cap() != bufferSize {
+			t.Errorf("The chunk buffer has grown from %d to %d bytes for the encrypted data", bufferSize,
+				chunk.buffer.Cap())
+		}
+
+		if err := chunk.Decrypt(key, ""); err != nil {
+			t.Fatalf("Failed to decrypt the data: %v", err)
+		}
+		if chunk.buffer.Cap() != bufferSize {
+			t.Errorf("The chunk buffer has grown from %d to %d bytes for the decrypted data", bufferSize,
+				chunk.buffer.Cap())
+		}
+		if hash != chunk.GetHash() || bytes.Compare(plainData, chunk.GetBytes()) != 0 {
+			t.Errorf("The decrypted data doesn't match the original data")
+		}
+
+		// Data read by io.Copy is hashed like written data
+		chunk.Reset(true)
+		if _, err := io.Copy(chunk, bytes.NewReader(plainData)); err != nil {
+			t.Fatalf("Failed to copy the data: %v", err)
+		}
+		if hash != chunk.GetHash() {
+			t.Errorf("The hash of the copied data doesn't match the original hash")
+		}
+
+		hashOnly := CreateChunk(config, false)
+		hashOnly.Reset(true)
+		io.Copy(hashOnly, bytes.NewReader(plainData))
+		if hashOnly.GetLength() != len(plainData) || hash != hashOnly.GetHash() {
+			t.Errorf("The hash-only chunk has a length of %d and a different hash", hashOnly.GetLength())
+		}
+
+		// Only buffers that don't need to grow are kept
+		config.ReleaseChunkBuffer(new(bytes.Buffer))
+		for i := 0; i < 10; i++ {
+			if buffer := config.AllocateChunkBuffer(); buffer.Cap() < bufferSize {
+				t.Errorf("A buffer of %d bytes was allocated", buffer.Cap())
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// storageChecksumLister is implemented by storages, such as B2 and S3, whose file listings include a checksum
+// computed by the provider from the stored content.
+type storageChecksumLister interface {
+	// ComputeChecksum returns the checksum the provider will report for a file with the given content.
+	ComputeChecksum(content []byte) string
+
+	// ListChecksums returns the files under 'dir', recursively, and the checksums reported for them.  The checksum
+	// is empty if the provider doesn't have a usable one for the file, like the ETag of a multipart upload.
+	ListChecksums(threadIndex int, dir string) (files []string, checksums []string, err error)
+}
+
+// chunkChecksumsFile is the file in the snapshot cache that maps chunk ids to the checksums computed when the
+// chunks were uploaded.
+var chunkChecksumsFile = "chunk_checksums"
+
+// chunkChecksumRecorder collects the checksums of the chunks uploaded by a ChunkUploader.
+type chunkChecksumRecorder struct {
+	lister    storageChecksumLister
+	checksums map[string]string
+	lock      sync.Mutex
+}
+
+// createChunkChecksumRecorder returns nil if the storage doesn't report checksums, in which case nothing is
+// recorded.
+func createChunkChecksumRecorder(storage Storage) *chunkChecksumRecorder {
+	lister, ok := storage.(storageChecksumLister)
+	if !ok {
+		return nil
+	}
+	return &chunkChecksumRecorder{
+		lister:    lister,
+		checksums: make(map[string]string),
+	}
+}
+
+// record is called by the uploading goroutines after a chunk has been uploaded.
+func (recorder *chunkChecksumRecorder) record(chunkID string, content []byte) {
+	if recorder == nil {
+		return
+	}
+	checksum := recorder.lister.ComputeChecksum(content)
+	recorder.lock.Lock()
+	recorder.checksums[chunkID] = checksum
+	recorder.lock.Unlock()
+}
+
+// loadChunkChecksums reads the recorded checksums from the snapshot cache.
+func (manager *SnapshotManager) loadChunkChecksums() (map[string]string, error) {
+	checksums := make(map[string]string)
+	manager.fileChunk.Reset(false)
+	err := manager.snapshotCache.DownloadFile(0, chunkChecksumsFile, manager.fileChunk)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return checksums, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(manager.fileChunk.GetBytes(), &checksums)
+	if err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// saveChunkChecksums writes the checksums to the snapshot cache.
+func (manager *SnapshotManager) saveChunkChecksums(checksums map[string]string) error {
+	description, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	return manager.snapshotCache.UploadFile(0, chunkChecksumsFile, description)
+}
+
+// SaveRecordedChecksums adds the checksums collected by the recorder to those saved in the snapshot cache.  Failing
+// to save them is not an error; the chunks will only be reported as not recorded by check -checksums.
+func (manager *SnapshotManager) SaveRecordedChecksums(recorder *chunkChecksumRecorder) {
+	if recorder == nil || manager.snapshotCache == nil || len(recorder.checksums) == 0 {
+		return
+	}
+
+	checksums, err := manager.loadChunkChecksums()
+	if err != nil {
+		LOG_WARN("CHECKSUM_LOAD", "Failed to load the recorded chunk checksums: %v", err)
+		checksums = make(map[string]string)
+	}
+
+	recorder.lock.Lock()
+	for chunkID, checksum := range recorder.checksums {
+		checksums[chunkID] = checksum
+	}
+	numberOfChecksums := len(recorder.checksums)
+	recorder.checksums = make(map[string]string)
+	recorder.lock.Unlock()
+
+	err = manager.saveChunkChecksums(checksums)
+	if err != nil {
+		LOG_WARN("CHECKSUM_SAVE", "Failed to save the checksums of %d uploaded chunks: %v", numberOfChecksums, err)
+		return
+	}
+	LOG_DEBUG("CHECKSUM_SAVE", "Recorded the checksums of %d uploaded chunks", numberOfChecksums)
+}
+
+// CheckChunkChecksums compares the checksums the storage reports for every chunk against the checksums recorded
+// when the chunks were uploaded from this computer.  Only the listing of the chunks directory is downloaded, so this
+// is much faster than check -chunks, but it can only find chunks that were altered or replaced in the storage, and
+// only among the chunks uploaded with the checksum recorded.  Records of chunks that no longer exist are removed.
+func (manager *SnapshotManager) CheckChunkChecksums() bool {
+
+	lister, ok := manager.storage.(storageChecksumLister)
+	if !ok {
+		LOG_ERROR("CHECKSUM_UNSUPPORTED", "The storage doesn't report checksums for the files it stores")
+		return false
+	}
+
+	recordedChecksums, err := manager.loadChunkChecksums()
+	if err != nil {
+		LOG_ERROR("CHECKSUM_LOAD", "Failed to load the recorded chunk checksums: %v", err)
+		return false
+	}
+	if len(recordedChecksums) == 0 {
+		LOG_WARN("CHECKSUM_NONE", "No chunk checksums have been recorded on this computer")
+	}
+
+	LOG_INFO("CHECKSUM_LIST", "Listing the checksums of all chunks")
+	files, checksums, err := lister.ListChecksums(0, "chunks")
+	if err != nil {
+		LOG_ERROR("CHECKSUM_LIST", "Failed to list the checksums of the chunks: %v", err)
+		return false
+	}
+
+	verified := 0
+	unrecorded := 0
+	unavailable := 0
+	var mismatched []string
+	existing := make(map[string]bool)
+	for i, file := range files {
+		if strings.HasSuffix(file, "/") || strings.HasSuffix(file, ".fsl") || strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+		chunkID := strings.Replace(file, "/", "", -1)
+		existing[chunkID] = true
+
+		recordedChecksum, found := recordedChecksums[chunkID]
+		if !found {
+			unrecorded++
+		} else if checksums[i] == "" {
+			unavailable++
+		} else if checksums[i] != recordedChecksum {
+			LOG_WARN("CHECKSUM_MISMATCH", "The chunk %s has a checksum of %s in the storage instead of %s", chunkID,
+				checksums[i], recordedChecksum)
+			mismatched = append(mismatched, chunkID)
+		} else {
+			verified++
+		}
+	}
+
+	removed := 0
+	for chunkID := range recordedChecksums {
+		if !existing[chunkID] {
+			delete(recordedChecksums, chunkID)
+			removed++
+		}
+	}
+	if removed > 0 {
+		err = manager.saveChunkChecksums(recordedChecksums)
+		if err != nil {
+			LOG_WARN("CHECKSUM_SAVE", "Failed to save the recorded chunk checksums: %v", err)
+		} else {
+			LOG_INFO("CHECKSUM_CLEAN", "Removed the checksums of %d chunks no longer in the storage", removed)
+		}
+	}
+
+	LOG_INFO("CHECKSUM_CHECK", "%d chunks matched their recorded checksums, %d chunks had no recorded checksum, "+
+		"%d chunks had no checksum in the storage", verified, unrecorded, unavailable)
+	if len(mismatched) > 0 {
+		LOG_ERROR("CHECKSUM_MISMATCH", "%d chunks don't match their recorded checksums; run check -chunks to "+
+			"verify their content", len(mismatched))
+		return false
+	}
+	return true
+}
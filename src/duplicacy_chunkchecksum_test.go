@@ -0,0 +1,135 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+// checksumTestStorage is a file storage that reports the SHA1 of each file like B2.
+type checksumTestStorage struct {
+	*FileStorage
+}
+
+func (storage *checksumTestStorage) ComputeChecksum(content []byte) string {
+	hash := sha1.Sum(content)
+	return hex.EncodeToString(hash[:])
+}
+
+func (storage *checksumTestStorage) ListChecksums(threadIndex int, dir string) (files []string, checksums []string,
+	err error) {
+	root := filepath.Join(storage.storageDir, dir)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relativePath, _ := filepath.Rel(root, path)
+		files = append(files, filepath.ToSlash(relativePath))
+		checksums = append(checksums, storage.ComputeChecksum(content))
+		return nil
+	})
+	return files, checksums, err
+}
+
+func TestChunkChecksums(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "chunkchecksum")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+	createRandomFile(joinPath(repository, "file2"), 100000)
+
+	threads := 1
+	fileStorage, err := CreateFileStorage(filepath.Join(testDir, "storage"), false, threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage := &checksumTestStorage{FileStorage: fileStorage}
+	storage.DerivedStorage = storage
+	storage.SetDefaultNestingLevels([]int{2, 3}, 2)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	manager := backupManager.SnapshotManager
+	recorded, err := manager.loadChunkChecksums()
+	if err != nil {
+		t.Fatalf("Failed to load the recorded checksums: %v", err)
+	}
+	chunks, _ := manager.ListAllFiles(storage, "chunks/")
+	var chunkFiles []string
+	for _, chunk := range chunks {
+		if !strings.HasSuffix(chunk, "/") {
+			chunkFiles = append(chunkFiles, chunk)
+		}
+	}
+	if len(chunkFiles) == 0 || len(recorded) != len(chunkFiles) {
+		t.Fatalf("%d checksums were recorded for %d chunks", len(recorded), len(chunkFiles))
+	}
+
+	if !manager.CheckChunkChecksums() {
+		t.Errorf("The checksums of the uploaded chunks don't match")
+	}
+
+	// Removing a chunk removes its checksum, and replacing the content of another is reported as a mismatch
+	os.Remove(filepath.Join(testDir, "storage", "chunks", chunkFiles[0]))
+	ioutil.WriteFile(filepath.Join(testDir, "storage", "chunks", chunkFiles[1]), []byte("corrupted"), 0644)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(Exception); !ok || e.LogID != "CHECKSUM_MISMATCH" {
+					panic(r)
+				}
+			}
+		}()
+		setTestingT(nil)
+		defer setTestingT(t)
+		if manager.CheckChunkChecksums() {
+			t.Errorf("A corrupted chunk passed the checksum check")
+		}
+	}()
+
+	recorded, _ = manager.loadChunkChecksums()
+	if len(recorded) != len(chunkFiles)-1 {
+		t.Errorf("%d checksums remain after removing a chunk", len(recorded))
+	}
+}
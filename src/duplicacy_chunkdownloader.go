@@ -5,7 +5,10 @@
 package duplicacy
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"path"
 	"sync/atomic"
 	"time"
 )
@@ -18,6 +21,7 @@ type ChunkDownloadTask struct {
 	chunkLength   int    // The length of the chunk; may be zero
 	needed        bool   // Whether this chunk can be skipped if a local copy exists
 	isDownloading bool   // 'true' means the chunk has been downloaded or is being downloaded
+	isPlanned     bool   // Whether it is known if the chunk is needed; only used when prefetching
 }
 
 // ChunkDownloadCompletion represents the nofication when a chunk has been downloaded.
@@ -33,6 +37,7 @@ type ChunkDownloadCompletion struct {
 type ChunkDownloader struct {
 	totalChunkSize            int64 // Total chunk size
 	downloadedChunkSize       int64 // Downloaded chunk size
+	numberOfFailoverChunks    int64 // The number of chunks downloaded from the failover storages
 
 	config         *Config      // Associated config
 	storage        Storage      // Download from this storage
@@ -41,6 +46,9 @@ type ChunkDownloader struct {
 	threads        int          // Number of threads
 	allowFailures  bool         // Whether to failfast on download error, or continue
 
+	quarantine *ChunkQuarantine  // Handles corrupted chunks if not nil
+	failover   []failoverStorage // Other storages to download chunks from if they can't be downloaded from this one
+
 	taskList       []ChunkDownloadTask // The list of chunks to be downloaded
 	completedTasks map[int]bool        // Store downloaded chunks
 	lastChunkIndex int                 // a monotonically increasing number indicating the last chunk to be downloaded
@@ -54,10 +62,47 @@ type ChunkDownloader struct {
 	numberOfDownloadingChunks int   // The number of chunks still being downloaded
 	numberOfActiveChunks      int   // The number of chunks that is being downloaded or has been downloaded but not reclaimed
 
+	prefetchMemory  int64  // The maximum size of active chunks when prefetching for a restore; 0 if not prefetching
+	activeChunkSize int64  // The total length of the active chunks when prefetching
+	nextPrefetch    int    // Chunks before this index have been prefetched or are not needed
+	prefetchLimit   int    // Chunks from this index on are only in files that haven't been planned
+	prefetchFull    bool   // Whether the last call to schedulePrefetch stopped at the memory budget
+	fileReferences  []int  // The number of files using each chunk that haven't been released
+	restoringFile   *Entry // The file passed to Prefetch when prefetching, until it is released
+	releasedChunks  int    // Chunks of restoringFile before this index have been released
+
 	NumberOfFailedChunks      int   // The number of chunks that can't be downloaded
 }
 
 func CreateChunkDownloader(config *Config, storage Storage, snapshotCache *FileStorage, showStatistics bool, threads int, allowFailures bool) *ChunkDownloader {
+	return createChunkDownloader(config, storage, snapshotCache, showStatistics, threads, allowFailures, 0)
+}
+
+// CreatePrefetchingChunkDownloader creates a chunk downloader for restoring files.  Besides the chunks of the file
+// being restored, it downloads the chunks of the files given to PlanFile ahead of time, keeping up to
+// 'prefetchMemory' bytes of chunks that are being downloaded or haven't been released by ReleaseFile.
+func CreatePrefetchingChunkDownloader(config *Config, storage Storage, showStatistics bool, threads int, allowFailures bool,
+	prefetchMemory int64) *ChunkDownloader {
+	return createChunkDownloader(config, storage, nil, showStatistics, threads, allowFailures, prefetchMemory)
+}
+
+func createChunkDownloader(config *Config, storage Storage, snapshotCache *FileStorage, showStatistics bool, threads int,
+	allowFailures bool, prefetchMemory int64) *ChunkDownloader {
+
+	// When prefetching, the queues are long enough to hold all the chunks that fit in the memory budget, so that the
+	// downloading goroutines don't have to wait while files are being written
+	queueLength, completionLength := threads, 0
+	if prefetchMemory > 0 {
+		queueLength = int(prefetchMemory / int64(config.MinimumChunkSize))
+		if queueLength > maximumPrefetchedChunks {
+			queueLength = maximumPrefetchedChunks
+		}
+		if queueLength < threads {
+			queueLength = threads
+		}
+		completionLength = queueLength
+	}
+
 	downloader := &ChunkDownloader{
 		config:         config,
 		storage:        storage,
@@ -70,21 +115,24 @@ func CreateChunkDownloader(config *Config, storage Storage, snapshotCache *FileS
 		completedTasks: make(map[int]bool),
 		lastChunkIndex: 0,
 
-		taskQueue:         make(chan ChunkDownloadTask, threads),
+		taskQueue:         make(chan ChunkDownloadTask, queueLength),
 		stopChannel:       make(chan bool),
-		completionChannel: make(chan ChunkDownloadCompletion),
+		completionChannel: make(chan ChunkDownloadCompletion, completionLength),
 
 		startTime: time.Now().Unix(),
+
+		prefetchMemory: prefetchMemory,
 	}
 
 	// Start the downloading goroutines
+	tasks := getGoroutineTasks()
 	for i := 0; i < downloader.threads; i++ {
 		go func(threadIndex int) {
 			defer CatchLogException()
 			for {
 				select {
 				case task := <-downloader.taskQueue:
-					downloader.Download(threadIndex, task)
+					runGoroutineTask(tasks, func() { downloader.Download(threadIndex, task) })
 				case <-downloader.stopChannel:
 					return
 				}
@@ -99,6 +147,7 @@ func CreateChunkDownloader(config *Config, storage Storage, snapshotCache *FileS
 func (downloader *ChunkDownloader) AddFiles(snapshot *Snapshot, files []*Entry) {
 
 	downloader.taskList = nil
+	downloader.fileReferences = nil
 	lastChunkIndex := -1
 	maximumChunks := 0
 	downloader.totalChunkSize = 0
@@ -115,10 +164,12 @@ func (downloader *ChunkDownloader) AddFiles(snapshot *Snapshot, files []*Entry)
 					needed:      false,
 				}
 				downloader.taskList = append(downloader.taskList, task)
+				downloader.fileReferences = append(downloader.fileReferences, 0)
 				downloader.totalChunkSize += int64(snapshot.ChunkLengths[i])
 			} else {
 				downloader.taskList[len(downloader.taskList)-1].needed = true
 			}
+			downloader.fileReferences[len(downloader.taskList)-1]++
 			lastChunkIndex = i
 		}
 		file.StartChunk = len(downloader.taskList) - (file.EndChunk - file.StartChunk) - 1
@@ -152,6 +203,13 @@ func (downloader *ChunkDownloader) AddChunk(chunkHash string) int {
 // Prefetch adds up to 'threads' chunks needed by a file to the download list
 func (downloader *ChunkDownloader) Prefetch(file *Entry) {
 
+	if downloader.prefetchMemory > 0 {
+		downloader.restoringFile = file
+		downloader.releasedChunks = file.StartChunk
+		downloader.planChunks(file)
+		return
+	}
+
 	// Any chunks before the first chunk of this filea are not needed any more, so they can be reclaimed.
 	downloader.Reclaim(file.StartChunk)
 
@@ -216,6 +274,10 @@ func (downloader *ChunkDownloader) GetLastDownloadedChunk() (chunk *Chunk, chunk
 // WaitForChunk waits until the specified chunk is ready
 func (downloader *ChunkDownloader) WaitForChunk(chunkIndex int) (chunk *Chunk) {
 
+	if downloader.prefetchMemory > 0 {
+		return downloader.waitForPrefetchedChunk(chunkIndex)
+	}
+
 	// Reclaim any chunk not needed
 	downloader.Reclaim(chunkIndex)
 
@@ -250,7 +312,7 @@ func (downloader *ChunkDownloader) WaitForChunk(chunkIndex int) (chunk *Chunk) {
 
 	// Now wait until the chunk to be downloaded appears in the completed tasks
 	for _, found := downloader.completedTasks[chunkIndex]; !found; _, found = downloader.completedTasks[chunkIndex] {
-		completion := <-downloader.completionChannel
+		completion := downloader.receiveCompletion()
 		downloader.completedTasks[completion.chunkIndex] = true
 		downloader.taskList[completion.chunkIndex].chunk = completion.chunk
 		downloader.numberOfDownloadedChunks++
@@ -280,7 +342,7 @@ func (downloader *ChunkDownloader) WaitForCompletion() {
 
 		// Wait for a completion event first
 		if downloader.numberOfActiveChunks > 0 {
-			completion := <-downloader.completionChannel
+			completion := downloader.receiveCompletion()
 			downloader.config.PutChunk(completion.chunk)
 			downloader.numberOfActiveChunks--
 			downloader.numberOfDownloadedChunks++
@@ -309,7 +371,7 @@ func (downloader *ChunkDownloader) WaitForCompletion() {
 // Stop terminates all downloading goroutines
 func (downloader *ChunkDownloader) Stop() {
 	for downloader.numberOfDownloadingChunks > 0 {
-		completion := <-downloader.completionChannel
+		completion := downloader.receiveCompletion()
 		downloader.completedTasks[completion.chunkIndex] = true
 		downloader.taskList[completion.chunkIndex].chunk = completion.chunk
 		downloader.numberOfDownloadedChunks++
@@ -330,8 +392,32 @@ func (downloader *ChunkDownloader) Stop() {
 	}
 }
 
+// receiveCompletion waits for a chunk to be downloaded.  The chunks being downloaded may never arrive once the
+// operation is cancelled, in which case an exception is raised.
+func (downloader *ChunkDownloader) receiveCompletion() ChunkDownloadCompletion {
+	ctx := downloader.storage.GetContext()
+	select {
+	case completion := <-downloader.completionChannel:
+		return completion
+	case <-ctx.Done():
+		checkOperationCancelled(ctx)
+		return ChunkDownloadCompletion{}
+	}
+}
+
+// sendCompletion sends back a downloaded chunk.  Once the operation is cancelled, the chunk may no longer be waited
+// for, so it is dropped instead.
+func (downloader *ChunkDownloader) sendCompletion(completion ChunkDownloadCompletion) {
+	ctx := downloader.storage.GetContext()
+	select {
+	case downloader.completionChannel <- completion:
+	case <-ctx.Done():
+	}
+}
+
 // Download downloads a chunk from the storage.
 func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadTask) bool {
+	checkOperationCancelled(downloader.storage.GetContext())
 
 	cachedPath := ""
 	chunk := downloader.config.GetChunk()
@@ -360,7 +446,11 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 				} else {
 					LOG_DEBUG("CHUNK_CACHE", "Chunk %s has been loaded from the snapshot cache", chunkID)
 
-					downloader.completionChannel <- ChunkDownloadCompletion{chunk: chunk, chunkIndex: task.chunkIndex}
+					// Mark the chunk as recently used so it is the last to go when the cache is trimmed
+					now := time.Now()
+					os.Chtimes(path.Join(downloader.snapshotCache.storageDir, cachedPath), now, now)
+
+					downloader.sendCompletion(ChunkDownloadCompletion{chunk: chunk, chunkIndex: task.chunkIndex})
 					return false
 				}
 			}
@@ -375,7 +465,7 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 	completeFailedChunk := func(chunk *Chunk) {
 		if downloader.allowFailures {
 			chunk.isBroken = true
-			downloader.completionChannel <- ChunkDownloadCompletion{chunk: chunk, chunkIndex: task.chunkIndex}
+			downloader.sendCompletion(ChunkDownloadCompletion{chunk: chunk, chunkIndex: task.chunkIndex})
 		}
 	}
 
@@ -385,6 +475,9 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 		// Find the chunk by ID first.
 		chunkPath, exist, _, err := downloader.storage.FindChunk(threadIndex, chunkID, false)
 		if err != nil {
+			if downloader.downloadFromFailover(threadIndex, task.chunkHash, chunk, "can't be found") {
+				break
+			}
 			completeFailedChunk(chunk)
 			LOG_WERROR(downloader.allowFailures, "DOWNLOAD_CHUNK", "Failed to find the chunk %s: %v", chunkID, err)
 			return false
@@ -394,6 +487,9 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 			// No chunk is found.  Have to find it in the fossil pool again.
 			fossilPath, exist, _, err := downloader.storage.FindChunk(threadIndex, chunkID, true)
 			if err != nil {
+				if downloader.downloadFromFailover(threadIndex, task.chunkHash, chunk, "can't be found") {
+					break
+				}
 				completeFailedChunk(chunk)
 				LOG_WERROR(downloader.allowFailures, "DOWNLOAD_CHUNK", "Failed to find the chunk %s: %v", chunkID, err)
 				return false
@@ -417,8 +513,13 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 					continue
 				}
 
+				if downloader.downloadFromFailover(threadIndex, task.chunkHash, chunk, "is missing") {
+					break
+				}
+
 				completeFailedChunk(chunk)
 				// A chunk is not found.  This is a serious error and hopefully it will never happen.
+				SetExitCode(IntegrityExitCode)
 				if err != nil {
 					LOG_WERROR(downloader.allowFailures,  "DOWNLOAD_CHUNK", "Chunk %s can't be found: %v", chunkID, err)
 				} else {
@@ -431,6 +532,9 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 			// downloading again.
 			err = downloader.storage.MoveFile(threadIndex, fossilPath, chunkPath)
 			if err != nil {
+				if downloader.downloadFromFailover(threadIndex, task.chunkHash, chunk, "can't be resurrected") {
+					break
+				}
 				completeFailedChunk(chunk)
 				LOG_WERROR(downloader.allowFailures, "DOWNLOAD_CHUNK", "Failed to resurrect chunk %s: %v", chunkID, err)
 				return false
@@ -448,6 +552,8 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 				LOG_WARN("DOWNLOAD_RETRY", "Failed to download the chunk %s: %v; retrying", chunkID, err)
 				chunk.Reset(false)
 				continue
+			} else if downloader.downloadFromFailover(threadIndex, task.chunkHash, chunk, "can't be downloaded") {
+				break
 			} else {
 				completeFailedChunk(chunk)
 				LOG_WERROR(downloader.allowFailures, "DOWNLOAD_CHUNK", "Failed to download the chunk %s: %v", chunkID, err)
@@ -461,6 +567,11 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 				LOG_WARN("DOWNLOAD_RETRY", "Failed to decrypt the chunk %s: %v; retrying", chunkID, err)
 				chunk.Reset(false)
 				continue
+			} else if downloader.quarantine != nil &&
+				downloader.quarantine.Quarantine(threadIndex, chunkID, task.chunkHash, chunkPath, chunk, err) {
+				break
+			} else if downloader.downloadFromFailover(threadIndex, task.chunkHash, chunk, "can't be decrypted") {
+				break
 			} else {
 				completeFailedChunk(chunk)
 				LOG_WERROR(downloader.allowFailures, "DOWNLOAD_DECRYPT", "Failed to decrypt the chunk %s: %v", chunkID, err)
@@ -474,6 +585,12 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 				LOG_WARN("DOWNLOAD_RETRY", "The chunk %s has a hash id of %s; retrying", chunkID, actualChunkID)
 				chunk.Reset(false)
 				continue
+			} else if downloader.quarantine != nil &&
+				downloader.quarantine.Quarantine(threadIndex, chunkID, task.chunkHash, chunkPath, chunk,
+					fmt.Errorf("hash id %s", actualChunkID)) {
+				break
+			} else if downloader.downloadFromFailover(threadIndex, task.chunkHash, chunk, "is corrupted") {
+				break
 			} else {
 				completeFailedChunk(chunk)
 				LOG_WERROR(downloader.allowFailures, "DOWNLOAD_CORRUPTED", "The chunk %s has a hash id of %s", chunkID, actualChunkID)
@@ -513,6 +630,6 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 		LOG_DEBUG("CHUNK_DOWNLOAD", "Chunk %s has been downloaded", chunkID)
 	}
 
-	downloader.completionChannel <- ChunkDownloadCompletion{chunk: chunk, chunkIndex: task.chunkIndex}
+	downloader.sendCompletion(ChunkDownloadCompletion{chunk: chunk, chunkIndex: task.chunkIndex})
 	return true
 }
@@ -0,0 +1,88 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// failoverStorage is another storage, usually populated by the copy command, from which chunks that are missing or
+// corrupted on the primary storage can be downloaded.
+type failoverStorage struct {
+	name    string
+	manager *SnapshotManager
+}
+
+// AddFailoverStorage adds a storage to download chunks from when they can't be downloaded from the primary storage.
+// The storage must be copy-compatible with the primary storage.  Storages are tried in the order they are added.
+func (manager *SnapshotManager) AddFailoverStorage(name string, other *SnapshotManager) bool {
+	if !manager.config.IsCompatiableWith(other.config) {
+		LOG_ERROR("STORAGE_FAILOVER", "The storage %s is not copy-compatible with the primary storage", name)
+		return false
+	}
+	manager.failoverStorages = append(manager.failoverStorages, failoverStorage{name: name, manager: other})
+	return true
+}
+
+// downloadChunkCopy downloads the chunk with the specified hash from the storage of 'source' into 'chunk', verifying
+// the content against the chunk id computed by 'config'.  It returns false without an error if the chunk doesn't
+// exist on that storage.
+func downloadChunkCopy(threadIndex int, config *Config, source *SnapshotManager, chunkHash string,
+	chunk *Chunk) (bool, error) {
+
+	chunkID := config.GetChunkIDFromHash(chunkHash)
+	sourceChunkID := source.config.GetChunkIDFromHash(chunkHash)
+	sourceChunkPath, exist, _, err := source.storage.FindChunk(threadIndex, sourceChunkID, false)
+	if err != nil {
+		return false, fmt.Errorf("failed to find the chunk %s: %v", sourceChunkID, err)
+	} else if !exist {
+		return false, nil
+	}
+
+	sourceChunk := source.config.GetChunk()
+	defer source.config.PutChunk(sourceChunk)
+	sourceChunk.Reset(false)
+	err = source.storage.DownloadFile(threadIndex, sourceChunkPath, sourceChunk)
+	if err == nil {
+		err = sourceChunk.Decrypt(source.config.ChunkKey, chunkHash)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to download the chunk %s: %v", sourceChunkID, err)
+	}
+
+	if config.GetChunkIDFromHash(sourceChunk.GetHash()) != chunkID {
+		return false, fmt.Errorf("the chunk %s is also corrupted", sourceChunkID)
+	}
+
+	chunk.Reset(true)
+	chunk.Write(sourceChunk.GetBytes())
+	return true, nil
+}
+
+// downloadFromFailover tries to download the chunk from the failover storages after 'reason' prevented it from being
+// downloaded from the primary storage.  It returns true if 'chunk' now contains the correct content.
+func (downloader *ChunkDownloader) downloadFromFailover(threadIndex int, chunkHash string, chunk *Chunk,
+	reason string) bool {
+
+	chunkID := downloader.config.GetChunkIDFromHash(chunkHash)
+	for _, failover := range downloader.failover {
+		found, err := downloadChunkCopy(threadIndex, downloader.config, failover.manager, chunkHash, chunk)
+		if err != nil {
+			LOG_WARN("DOWNLOAD_FAILOVER", "Failed to download the chunk %s from the storage %s: %v", chunkID,
+				failover.name, err)
+			continue
+		} else if !found {
+			LOG_DEBUG("DOWNLOAD_FAILOVER", "The chunk %s does not exist in the storage %s", chunkID, failover.name)
+			continue
+		}
+
+		atomic.AddInt64(&downloader.numberOfFailoverChunks, 1)
+		LOG_INFO("DOWNLOAD_FAILOVER", "Chunk %s %s and has been downloaded from the storage %s", chunkID, reason,
+			failover.name)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	crypto_rand "crypto/rand"
+	"os"
+	"path"
+	"runtime/debug"
+	"testing"
+)
+
+func TestChunkFailover(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "failover")
+	os.RemoveAll(testDir)
+
+	var storages []*FileStorage
+	for _, name := range []string{"primary", "empty", "copy"} {
+		os.MkdirAll(path.Join(testDir, name, "chunks"), 0700)
+		storage, err := CreateFileStorage(path.Join(testDir, name), false, 1)
+		if err != nil {
+			t.Fatalf("Failed to create the storage %s: %v", name, err)
+		}
+		storages = append(storages, storage)
+	}
+
+	config := CreateConfig()
+	config.MinimumChunkSize = 100
+	config.chunkPool = make(chan *Chunk, 10)
+
+	var chunks []*Chunk
+	for i := 0; i < 3; i++ {
+		content := make([]byte, 1000)
+		crypto_rand.Read(content)
+		chunk := CreateChunk(config, true)
+		chunk.Reset(true)
+		chunk.Write(content)
+		chunks = append(chunks, chunk)
+	}
+
+	// The first chunk is only on the copy, the second one is corrupted on the primary storage, and the third one is
+	// on the primary storage only
+	upload := func(storage Storage, chunk *Chunk, content []byte) {
+		chunkPath, _, _, err := storage.FindChunk(0, chunk.GetID(), false)
+		if err != nil {
+			t.Fatalf("Failed to find the path for the chunk %s: %v", chunk.GetID(), err)
+		}
+		if err = storage.UploadFile(0, chunkPath, content); err != nil {
+			t.Fatalf("Failed to upload the chunk %s: %v", chunk.GetID(), err)
+		}
+	}
+	for i, chunk := range chunks {
+		encrypted := CreateChunk(config, true)
+		encrypted.Reset(true)
+		encrypted.Write(chunk.GetBytes())
+		if err := encrypted.Encrypt(config.ChunkKey, chunk.GetHash(), false); err != nil {
+			t.Fatalf("Failed to encrypt the chunk %s: %v", chunk.GetID(), err)
+		}
+		switch i {
+		case 0:
+			upload(storages[2], chunk, encrypted.GetBytes())
+		case 1:
+			upload(storages[0], chunk, []byte("corrupted"))
+			upload(storages[2], chunk, encrypted.GetBytes())
+		case 2:
+			upload(storages[0], chunk, encrypted.GetBytes())
+		}
+	}
+
+	manager := CreateSnapshotManager(config, storages[0])
+	for i, name := range []string{"empty", "copy"} {
+		if !manager.AddFailoverStorage(name, CreateSnapshotManager(config, storages[i+1])) {
+			t.Fatalf("Failed to add the failover storage %s", name)
+		}
+	}
+
+	chunkDownloader := CreateChunkDownloader(config, storages[0], nil, false, 1, false)
+	chunkDownloader.failover = manager.failoverStorages
+	for _, chunk := range chunks {
+		chunkDownloader.AddChunk(chunk.GetHash())
+	}
+	for i, chunk := range chunks {
+		downloaded := chunkDownloader.WaitForChunk(i)
+		if downloaded.GetID() != chunk.GetID() {
+			t.Errorf("Chunk %d has a hash id of %s instead of %s", i, downloaded.GetID(), chunk.GetID())
+		}
+	}
+	chunkDownloader.Stop()
+
+	if chunkDownloader.numberOfFailoverChunks != 2 {
+		t.Errorf("%d chunks were downloaded from the failover storages instead of 2",
+			chunkDownloader.numberOfFailoverChunks)
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChunkChange is a change to a file under the chunks directory read from a change feed.
+type ChunkChange struct {
+	File    string // the path relative to the chunks directory; fossils have the .fsl suffix
+	Size    int64
+	Deleted bool
+}
+
+// ChangeFeedStorage is implemented by storages that can read the changes to the chunks directory from an inventory
+// or a change feed offered by the storage service, so that check and prune don't have to list all chunks again.
+type ChangeFeedStorage interface {
+	// GetChangeFeedCursor returns the cursor marking the end of the feed at 'location' as of now.
+	GetChangeFeedCursor(threadIndex int, location string) (cursor string, err error)
+
+	// ReadChangeFeed calls 'handler' with each change after 'cursor' and returns the new cursor.  If 'complete' is
+	// true, the changes are a complete listing of the chunks directory replacing what was known before.
+	ReadChangeFeed(threadIndex int, location string, cursor string, handler func(change ChunkChange)) (
+		newCursor string, complete bool, err error)
+}
+
+// The chunk index is saved in the snapshot cache directory under this name.
+const chunkIndexFile = "chunk_index"
+
+// The chunk index is rebuilt from a full listing once it is this old, to recover from changes the feed has missed.
+var chunkIndexMaxAge = 30 * 24 * time.Hour
+
+// chunkIndex is the local copy of the listing of the chunks directory kept up to date by a change feed, along with
+// the changes made by the chunk operator of this process.
+type chunkIndex struct {
+	Location string    `json:"location"` // the change feed the index follows
+	Cursor   string    `json:"cursor"`   // where to continue reading the feed
+	Listed   time.Time `json:"listed"`   // when the index was last built from a full listing
+
+	lock     sync.Mutex
+	files    map[string]int64 // file paths relative to the chunks directory and their sizes
+	modified bool
+	isLoaded bool // the files come from the saved index and the feed rather than from a listing by this process
+}
+
+func createChunkIndex(location string, cursor string) *chunkIndex {
+	return &chunkIndex{
+		Location: location,
+		Cursor:   cursor,
+		Listed:   time.Now(),
+		files:    make(map[string]int64),
+		modified: true,
+	}
+}
+
+// apply records a change read from the feed.
+func (index *chunkIndex) apply(change ChunkChange) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	if change.Deleted {
+		delete(index.files, change.File)
+	} else {
+		index.files[change.File] = change.Size
+	}
+	index.modified = true
+}
+
+// removeFile and renameFile record the changes made by the chunk operator, whose paths start with the chunks
+// directory.  They do nothing on a nil index.
+func (index *chunkIndex) removeFile(filePath string) {
+	if index == nil || !strings.HasPrefix(filePath, chunkDir) {
+		return
+	}
+	index.apply(ChunkChange{File: filePath[len(chunkDir):], Deleted: true})
+}
+
+// addFile records a chunk that isn't in the index but has been found to exist, such as one uploaded after the
+// inventory the index was read from had been taken.
+func (index *chunkIndex) addFile(filePath string, size int64) {
+	if index == nil || !strings.HasPrefix(filePath, chunkDir) {
+		return
+	}
+	index.apply(ChunkChange{File: filePath[len(chunkDir):], Size: size})
+}
+
+// mayMissChunks returns true if the chunks listed from the index may not include all existing chunks.  A feed lags
+// behind the changes made by other clients, and a complete listing such as an inventory may have been taken a while
+// ago, so check has to look up every chunk not in the index.
+func (index *chunkIndex) mayMissChunks() bool {
+	return index != nil && index.isLoaded
+}
+
+func (index *chunkIndex) renameFile(from string, to string) {
+	if index == nil || !strings.HasPrefix(from, chunkDir) || !strings.HasPrefix(to, chunkDir) {
+		return
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	size := index.files[from[len(chunkDir):]]
+	delete(index.files, from[len(chunkDir):])
+	index.files[to[len(chunkDir):]] = size
+	index.modified = true
+}
+
+// save writes the index to the snapshot cache directory, replacing the previous one.
+func (index *chunkIndex) save(cacheDir string) error {
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	file, err := ioutil.TempFile(cacheDir, chunkIndexFile+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	header, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	writer.Write(header)
+	writer.WriteString("\n")
+	for name, size := range index.files {
+		fmt.Fprintf(writer, "%s\t%d\n", name, size)
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(file.Name(), path.Join(cacheDir, chunkIndexFile)); err != nil {
+		return err
+	}
+	index.modified = false
+	return nil
+}
+
+// loadChunkIndexFile reads the index saved in the snapshot cache directory.  It returns nil, nil if there is none.
+func loadChunkIndexFile(cacheDir string) (*chunkIndex, error) {
+
+	file, err := os.Open(path.Join(cacheDir, chunkIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("the chunk index is empty")
+	}
+
+	index := &chunkIndex{files: make(map[string]int64)}
+	if err = json.Unmarshal(scanner.Bytes(), index); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		separator := strings.LastIndex(line, "\t")
+		if separator < 0 {
+			return nil, fmt.Errorf("invalid entry '%s'", line)
+		}
+		size, err := strconv.ParseInt(line[separator+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry '%s'", line)
+		}
+		index.files[line[:separator]] = size
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// SetChangeFeed makes check and prune list the chunks from a local index updated by the change feed at 'location',
+// whose format depends on the storage type.  An empty location disables the index.
+func (manager *SnapshotManager) SetChangeFeed(location string) {
+	manager.changeFeed = location
+}
+
+// SetFullListing makes check and prune rebuild the chunk index from a full listing of the chunks directory.
+func (manager *SnapshotManager) SetFullListing(enabled bool) {
+	manager.fullListing = enabled
+}
+
+// getChangeFeedStorage returns the storage as a ChangeFeedStorage if the chunk index can be used.
+func (manager *SnapshotManager) getChangeFeedStorage() ChangeFeedStorage {
+	if manager.changeFeed == "" || manager.snapshotCache == nil {
+		return nil
+	}
+
+	feed, ok := manager.storage.(ChangeFeedStorage)
+	if !ok {
+		LOG_WARN("CHUNK_INDEX", "The storage doesn't support change feeds; all chunks will be listed")
+		manager.changeFeed = ""
+		return nil
+	}
+	return feed
+}
+
+// openChunkIndex loads the chunk index and applies the changes from the feed since the last run.  The chunk
+// operator then keeps the index up to date with what this process changes.  It returns nil if there is no index to
+// be updated, in which case the chunks need to be listed.  An index that can't be updated is removed, as it would
+// miss the changes made by this process.
+func (manager *SnapshotManager) openChunkIndex() *chunkIndex {
+	if manager.chunkIndex != nil {
+		return manager.chunkIndex
+	}
+
+	feed := manager.getChangeFeedStorage()
+	if feed == nil {
+		return nil
+	}
+
+	indexPath := path.Join(manager.snapshotCache.storageDir, chunkIndexFile)
+	if manager.fullListing {
+		os.Remove(indexPath)
+		return nil
+	}
+
+	index, err := loadChunkIndexFile(manager.snapshotCache.storageDir)
+	if err != nil {
+		LOG_WARN("CHUNK_INDEX", "Failed to load the chunk index: %v", err)
+		os.Remove(indexPath)
+		return nil
+	} else if index == nil {
+		return nil
+	} else if index.Location != manager.changeFeed {
+		LOG_INFO("CHUNK_INDEX", "The chunk index follows a different change feed and will be rebuilt")
+		os.Remove(indexPath)
+		return nil
+	} else if time.Since(index.Listed) > chunkIndexMaxAge {
+		LOG_INFO("CHUNK_INDEX", "The chunk index built on %s will be rebuilt", index.Listed.Format("2006-01-02"))
+		os.Remove(indexPath)
+		return nil
+	}
+
+	var changes []ChunkChange
+	cursor, complete, err := feed.ReadChangeFeed(0, manager.changeFeed, index.Cursor, func(change ChunkChange) {
+		changes = append(changes, change)
+	})
+	if err != nil {
+		LOG_WARN("CHUNK_INDEX", "Failed to read the change feed %s: %v", manager.changeFeed, err)
+		os.Remove(indexPath)
+		return nil
+	}
+
+	if complete {
+		index.files = make(map[string]int64)
+	}
+	for _, change := range changes {
+		index.apply(change)
+	}
+	if cursor != index.Cursor {
+		index.Cursor = cursor
+		index.modified = true
+	}
+	index.isLoaded = true
+	LOG_INFO("CHUNK_INDEX", "Applied %d changes from the change feed to the chunk index of %d files", len(changes),
+		len(index.files))
+
+	manager.setChunkIndex(index)
+	return index
+}
+
+func (manager *SnapshotManager) setChunkIndex(index *chunkIndex) {
+	manager.chunkIndex = index
+	if manager.chunkOperator != nil {
+		manager.chunkOperator.index = index
+	}
+}
+
+// listChunks calls 'handler' with each file and subdirectory under the chunks directory, like forEachFile does.  If
+// a change feed is set, the files come from the chunk index, which is first rebuilt from a full listing if needed.
+func (manager *SnapshotManager) listChunks(handler func(file string, size int64)) bool {
+
+	if index := manager.openChunkIndex(); index != nil {
+		type indexEntry struct {
+			file string
+			size int64
+		}
+
+		// The handler may change the index through the chunk operator
+		index.lock.Lock()
+		entries := make([]indexEntry, 0, len(index.files))
+		for file, size := range index.files {
+			entries = append(entries, indexEntry{file, size})
+		}
+		index.lock.Unlock()
+
+		LOG_INFO("CHUNK_INDEX", "Listing %d files from the chunk index", len(entries))
+		for _, entry := range entries {
+			handler(entry.file, entry.size)
+		}
+		return true
+	}
+
+	feed := manager.getChangeFeedStorage()
+	if feed == nil {
+		return manager.forEachFile(manager.storage, chunkDir, handler)
+	}
+
+	// Changes made during the listing will be read from the feed again next time
+	cursor, err := feed.GetChangeFeedCursor(0, manager.changeFeed)
+	if err != nil {
+		LOG_WARN("CHUNK_INDEX", "Failed to read the change feed %s: %v", manager.changeFeed, err)
+		return manager.forEachFile(manager.storage, chunkDir, handler)
+	}
+
+	// The index is set first so that changes made by the handler through the chunk operator are recorded after the
+	// files they change
+	index := createChunkIndex(manager.changeFeed, cursor)
+	manager.setChunkIndex(index)
+	if !manager.forEachFile(manager.storage, chunkDir, func(file string, size int64) {
+		if len(file) > 0 && file[len(file)-1] != '/' {
+			index.apply(ChunkChange{File: file, Size: size})
+		}
+		handler(file, size)
+	}) {
+		manager.setChunkIndex(nil)
+		return false
+	}
+
+	LOG_INFO("CHUNK_INDEX", "Built the chunk index of %d files", len(index.files))
+	manager.saveChunkIndex()
+	return true
+}
+
+// saveChunkIndex saves the chunk index if it has been changed.
+func (manager *SnapshotManager) saveChunkIndex() {
+	index := manager.chunkIndex
+	if index == nil || !index.modified {
+		return
+	}
+
+	if err := index.save(manager.snapshotCache.storageDir); err != nil {
+		LOG_WARN("CHUNK_INDEX", "Failed to save the chunk index: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testChangeFeedStorage is a file storage whose change feed is filled by the test.
+type testChangeFeedStorage struct {
+	*FileStorage
+	changes   []ChunkChange
+	inventory []ChunkChange // if not nil, read once as a complete listing, like an S3 inventory
+}
+
+func (storage *testChangeFeedStorage) GetChangeFeedCursor(threadIndex int, location string) (string, error) {
+	return strconv.Itoa(len(storage.changes)), nil
+}
+
+func (storage *testChangeFeedStorage) ReadChangeFeed(threadIndex int, location string, cursor string,
+	handler func(change ChunkChange)) (string, bool, error) {
+	if storage.inventory != nil {
+		for _, change := range storage.inventory {
+			handler(change)
+		}
+		storage.inventory = nil
+		return strconv.Itoa(len(storage.changes)), true, nil
+	}
+	start, _ := strconv.Atoi(cursor)
+	for _, change := range storage.changes[start:] {
+		handler(change)
+	}
+	return strconv.Itoa(len(storage.changes)), false, nil
+}
+
+func TestChunkIndex(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "chunkindex")
+	os.RemoveAll(testDir)
+
+	repository := joinPath(testDir, "repository1")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(testDir, "storage"), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+
+	fileStorage, err := CreateFileStorage(joinPath(testDir, "storage"), false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	fileStorage.SetDefaultNestingLevels([]int{2, 3}, 2)
+	storage := &testChangeFeedStorage{FileStorage: fileStorage}
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	backupManager.SnapshotManager.SetChangeFeed("test")
+	cacheDir := backupManager.snapshotCache.storageDir
+
+	if !backupManager.Backup(repository, true, 1, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	check := func() {
+		if !backupManager.SnapshotManager.CheckSnapshots("host1", nil, "", false, false, false, false, false, false,
+			1, false) {
+			t.Fatalf("The check failed")
+		}
+		// Each command starts without an index in memory
+		backupManager.SnapshotManager.setChunkIndex(nil)
+	}
+
+	// The files in the index, which must match those in the storage
+	compareIndex := func() map[string]int64 {
+		index, err := loadChunkIndexFile(cacheDir)
+		if err != nil || index == nil {
+			t.Fatalf("Failed to load the chunk index: %v", err)
+		}
+		files, sizes := backupManager.SnapshotManager.ListAllFiles(storage, chunkDir)
+		listed := 0
+		for i, file := range files {
+			if strings.HasSuffix(file, "/") {
+				continue
+			}
+			listed++
+			if size, found := index.files[file]; !found || size != sizes[i] {
+				t.Errorf("The chunk index has %s with a size of %d instead of %d", file, size, sizes[i])
+			}
+		}
+		if listed != len(index.files) {
+			t.Errorf("The chunk index has %d files but %d are listed", len(index.files), listed)
+		}
+		return index.files
+	}
+
+	// The first check builds the index from a full listing
+	check()
+	compareIndex()
+
+	// A chunk not referenced by any snapshot is uploaded by another client and reported by the feed
+	id := make([]byte, 32)
+	rand.Read(id)
+	chunkID := hex.EncodeToString(id)
+	chunkPath, _, _, _ := storage.FindChunk(0, chunkID, false)
+	if err = storage.UploadFile(0, chunkPath, []byte("unreferenced")); err != nil {
+		t.Fatalf("Failed to upload the unreferenced chunk: %v", err)
+	}
+	storage.changes = append(storage.changes, ChunkChange{File: chunkPath[len(chunkDir):], Size: 12})
+
+	check()
+	if files := compareIndex(); files[chunkPath[len(chunkDir):]] != 12 {
+		t.Errorf("The change from the feed hasn't been applied")
+	}
+
+	// The chunk index follows the chunk removed by prune without listing the chunks again
+	if !backupManager.SnapshotManager.PruneSnapshots("host1", "host1", nil, nil, nil, true, true, nil, false, false,
+		false, 1) {
+		t.Fatalf("The prune failed")
+	}
+	backupManager.SnapshotManager.setChunkIndex(nil)
+	if exist, _, _, _ := storage.GetFileInfo(0, chunkPath); exist {
+		t.Errorf("The unreferenced chunk wasn't removed")
+	}
+	compareIndex()
+
+	// A wrong entry added to the index is gone after a full listing
+	storage.changes = append(storage.changes, ChunkChange{File: "ff/ffff", Size: 1})
+	check()
+	if files, _ := loadChunkIndexFile(cacheDir); files.files["ff/ffff"] != 1 {
+		t.Errorf("The change from the feed hasn't been applied")
+	}
+	backupManager.SnapshotManager.SetFullListing(true)
+	check()
+	compareIndex()
+	backupManager.SnapshotManager.SetFullListing(false)
+
+	// A complete listing taken before the chunks of a new backup were uploaded replaces the index; all the chunks it
+	// misses must be confirmed to exist, not only the first 100, and are then added to the index
+	inventory := []ChunkChange{}
+	for file, size := range compareIndex() {
+		inventory = append(inventory, ChunkChange{File: file, Size: size})
+	}
+	createRandomFile(joinPath(repository, "file2"), 4*1024*1024)
+	if !backupManager.Backup(repository, true, 1, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+	storage.inventory = inventory
+	backupManager.SnapshotManager.SetLowMemoryCheck(true)
+	check()
+	if files := compareIndex(); len(files) <= len(inventory)+100 {
+		t.Errorf("Only %d chunks have been uploaded by the second backup", len(files)-len(inventory))
+	}
+}
+
+func TestS3InventoryFile(t *testing.T) {
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(`"bucket","dir/chunks/ab/cd","100","true","false"
+"bucket","dir/chunks/ab/ef","200","false","false"
+"bucket","dir/chunks/ab/gh","","true","true"
+"bucket","dir/snapshots/host1/1","300","true","false"
+"bucket","dir/chunks/a%2Bb/cd.fsl","400","true","false"
+`))
+	writer.Close()
+
+	changes := make(map[string]int64)
+	columns := strings.Split("Bucket, Key, Size, IsLatest, IsDeleteMarker", ",")
+	err := parseS3InventoryFile(&buffer, columns, "dir/chunks/", func(change ChunkChange) {
+		changes[change.File] = change.Size
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse the inventory: %v", err)
+	}
+	if len(changes) != 2 || changes["ab/cd"] != 100 || changes["a+b/cd.fsl"] != 400 {
+		t.Errorf("The inventory lists %v", changes)
+	}
+}
+
+func TestB2Events(t *testing.T) {
+
+	events, err := parseB2EventPayload([]byte(`{"events": [
+		{"eventType": "b2:HideMarkerCreated:Hide", "eventTimestamp": 3, "objectName": "dir/chunks/ab/cd"},
+		{"eventType": "b2:ObjectCreated:Upload", "eventTimestamp": 1, "objectName": "dir/chunks/ab/cd", "objectSize": 100},
+		{"eventType": "b2:ObjectCreated:Upload", "eventTimestamp": 2, "objectName": "dir/chunks/ab/ef", "objectSize": 200},
+		{"eventType": "b2:ObjectDeleted:Delete", "eventTimestamp": 4, "objectName": "dir/chunks/ab/ef"},
+		{"eventType": "b2:ObjectCreated:Upload", "eventTimestamp": 5, "objectName": "dir/snapshots/host1/1"}
+	]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse the events: %v", err)
+	}
+
+	files := make(map[string]int64)
+	deleted := applyB2Events(events, "dir/chunks/", func(change ChunkChange) {
+		if change.Deleted {
+			delete(files, change.File)
+		} else {
+			files[change.File] = change.Size
+		}
+	})
+
+	if len(files) != 2 || files["ab/ef"] != 200 || files["ab/cd.fsl"] != 0 {
+		t.Errorf("The events result in %v", files)
+	}
+	if len(deleted) != 1 || deleted[0] != "ab/ef" {
+		t.Errorf("The files with deleted versions are %v", deleted)
+	}
+}
@@ -28,6 +28,9 @@ type ChunkOperatorTask struct {
 // ChunkOperator is capable of performing multi-threaded operations on chunks.
 type ChunkOperator struct {
 	numberOfActiveTasks int64                  // The number of chunks that are being operated on
+	numberOfFossilized  int64                  // The number of chunks turned into fossils
+	numberOfDeleted     int64                  // The number of chunks, fossils, and temporary files deleted
+	numberOfResurrected int64                  // The number of fossils turned back into chunks
 	storage             Storage                // This storage
 	threads             int                    // Number of threads
 	taskQueue           chan ChunkOperatorTask // Operating goroutines are waiting on this channel for input
@@ -35,6 +38,8 @@ type ChunkOperator struct {
 
 	fossils     []string    // For fossilize operation, the paths of the fossils are stored in this slice
 	fossilsLock *sync.Mutex // The lock for 'fossils'
+
+	index *chunkIndex // Records the changes to the chunks directory if not nil
 }
 
 // CreateChunkOperator creates a new ChunkOperator.
@@ -51,13 +56,14 @@ func CreateChunkOperator(storage Storage, threads int) *ChunkOperator {
 	}
 
 	// Start the operator goroutines
+	tasks := getGoroutineTasks()
 	for i := 0; i < operator.threads; i++ {
 		go func(threadIndex int) {
 			defer CatchLogException()
 			for {
 				select {
 				case task := <-operator.taskQueue:
-					operator.Run(threadIndex, task)
+					runGoroutineTask(tasks, func() { operator.Run(threadIndex, task) })
 				case <-operator.stopChannel:
 					return
 				}
@@ -68,14 +74,22 @@ func CreateChunkOperator(storage Storage, threads int) *ChunkOperator {
 	return operator
 }
 
+// Wait blocks until all the tasks added so far have been completed, while keeping the goroutines running for
+// more tasks.
+func (operator *ChunkOperator) Wait() {
+	for atomic.LoadInt64(&operator.numberOfActiveTasks) > 0 {
+		// The tasks may never be completed once the operation is cancelled
+		checkOperationCancelled(operator.storage.GetContext())
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func (operator *ChunkOperator) Stop() {
 	if atomic.LoadInt64(&operator.numberOfActiveTasks) < 0 {
 		return
 	}
 
-	for atomic.LoadInt64(&operator.numberOfActiveTasks) > 0 {
-		time.Sleep(100 * time.Millisecond)
-	}
+	operator.Wait()
 	for i := 0; i < operator.threads; i++ {
 		operator.stopChannel <- false
 	}
@@ -91,8 +105,17 @@ func (operator *ChunkOperator) AddTask(operation int, chunkID string, filePath s
 		chunkID:   chunkID,
 		filePath:  filePath,
 	}
-	operator.taskQueue <- task
+	// Count the task before queuing it; otherwise a goroutine may finish it first and make Stop() see a negative
+	// number of active tasks
 	atomic.AddInt64(&operator.numberOfActiveTasks, int64(1))
+	operator.taskQueue <- task
+}
+
+// GetStatistics returns the number of chunks fossilized, the number of files deleted, and the number of fossils
+// resurrected so far.
+func (operator *ChunkOperator) GetStatistics() (fossilized int64, deleted int64, resurrected int64) {
+	return atomic.LoadInt64(&operator.numberOfFossilized), atomic.LoadInt64(&operator.numberOfDeleted),
+		atomic.LoadInt64(&operator.numberOfResurrected)
 }
 
 func (operator *ChunkOperator) Find(chunkID string) {
@@ -158,6 +181,8 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkOperatorTask) {
 		if err != nil {
 			LOG_WARN("CHUNK_DELETE", "Failed to remove the file %s: %v", task.filePath, err)
 		} else {
+			atomic.AddInt64(&operator.numberOfDeleted, 1)
+			operator.index.removeFile(task.filePath)
 			if task.chunkID != "" {
 				LOG_INFO("CHUNK_DELETE", "The chunk %s has been permanently removed", task.chunkID)
 			} else {
@@ -175,14 +200,22 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkOperatorTask) {
 				if err == nil {
 					LOG_TRACE("CHUNK_DELETE", "Deleted chunk file %s as the fossil already exists", task.chunkID)
 				}
+				operator.index.renameFile(task.filePath, fossilPath)
 				operator.fossilsLock.Lock()
 				operator.fossils = append(operator.fossils, fossilPath)
 				operator.fossilsLock.Unlock()
+			} else if _, exist, _, _ := operator.storage.FindChunk(threadIndex, task.chunkID, false); !exist &&
+				operator.index != nil {
+				// The chunk index may list a chunk deleted by another client since the feed was last read
+				LOG_WARN("CHUNK_FOSSILIZE", "Chunk %s listed in the chunk index no longer exists", task.chunkID)
+				operator.index.removeFile(task.filePath)
 			} else {
 				LOG_ERROR("CHUNK_DELETE", "Failed to fossilize the chunk %s: %v", task.chunkID, err)
 			}
 		} else {
+			operator.index.renameFile(task.filePath, fossilPath)
 			LOG_TRACE("CHUNK_FOSSILIZE", "The chunk %s has been marked as a fossil", task.chunkID)
+			atomic.AddInt64(&operator.numberOfFossilized, 1)
 			operator.fossilsLock.Lock()
 			operator.fossils = append(operator.fossils, fossilPath)
 			operator.fossilsLock.Unlock()
@@ -195,6 +228,7 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkOperatorTask) {
 
 		if exist {
 			operator.storage.DeleteFile(threadIndex, task.filePath)
+			operator.index.removeFile(task.filePath)
 			LOG_INFO("FOSSIL_RESURRECT", "The chunk %s already exists", task.chunkID)
 		} else {
 			err := operator.storage.MoveFile(threadIndex, task.filePath, chunkPath)
@@ -202,7 +236,9 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkOperatorTask) {
 				LOG_ERROR("FOSSIL_RESURRECT", "Failed to resurrect the chunk %s from the fossil %s: %v",
 					task.chunkID, task.filePath, err)
 			} else {
+				operator.index.renameFile(task.filePath, chunkPath)
 				LOG_INFO("FOSSIL_RESURRECT", "The chunk %s has been resurrected", task.filePath)
+				atomic.AddInt64(&operator.numberOfResurrected, 1)
 			}
 		}
 	}
@@ -0,0 +1,87 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkOperatorParallel(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "chunkoperator")
+	os.RemoveAll(testDir)
+	os.MkdirAll(filepath.Join(testDir, "chunks"), 0700)
+
+	threads := 4
+	storage, err := CreateFileStorage(testDir, false, threads)
+	if err != nil {
+		t.Fatalf("Failed to create the storage: %v", err)
+	}
+
+	numberOfChunks := 50
+	var chunkIDs, chunkPaths []string
+	for i := 0; i < numberOfChunks; i++ {
+		chunkID := fmt.Sprintf("%064x", i)
+		chunkPath, _, _, err := storage.FindChunk(0, chunkID, false)
+		if err != nil {
+			t.Fatalf("Failed to find the path for chunk %d: %v", i, err)
+		}
+		err = storage.UploadFile(0, chunkPath, []byte{byte(i)})
+		if err != nil {
+			t.Fatalf("Failed to upload chunk %d: %v", i, err)
+		}
+		chunkIDs = append(chunkIDs, chunkID)
+		chunkPaths = append(chunkPaths, chunkPath)
+	}
+
+	operator := CreateChunkOperator(storage, threads)
+	for i := 0; i < numberOfChunks; i++ {
+		operator.Fossilize(chunkIDs[i], chunkPaths[i])
+	}
+	operator.Wait()
+
+	if len(operator.fossils) != numberOfChunks {
+		t.Errorf("%d fossils were collected instead of %d", len(operator.fossils), numberOfChunks)
+	}
+	for i := 0; i < numberOfChunks; i++ {
+		if _, exist, _, _ := storage.FindChunk(0, chunkIDs[i], true); !exist {
+			t.Errorf("Chunk %d was not turned into a fossil", i)
+		}
+	}
+
+	// The goroutines keep running after Wait() so the same operator can process the fossils
+	for i := 0; i < numberOfChunks; i++ {
+		if i%5 == 0 {
+			operator.Resurrect(chunkIDs[i], chunkPaths[i]+".fsl")
+		} else {
+			operator.Delete(chunkIDs[i], chunkPaths[i]+".fsl")
+		}
+	}
+	operator.Stop()
+
+	fossilized, deleted, resurrected := operator.GetStatistics()
+	if fossilized != int64(numberOfChunks) || deleted != int64(numberOfChunks*4/5) ||
+		resurrected != int64(numberOfChunks/5) {
+		t.Errorf("The operator reported %d fossilized, %d deleted, and %d resurrected", fossilized, deleted,
+			resurrected)
+	}
+
+	for i := 0; i < numberOfChunks; i++ {
+		_, exist, _, _ := storage.FindChunk(0, chunkIDs[i], false)
+		_, fossilExist, _, _ := storage.FindChunk(0, chunkIDs[i], true)
+		if exist != (i%5 == 0) || fossilExist {
+			t.Errorf("Chunk %d exists: %t, fossil exists: %t", i, exist, fossilExist)
+		}
+	}
+
+	// Calling Stop() again must return immediately
+	operator.Stop()
+}
@@ -0,0 +1,342 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// SetChunkRepair makes CheckSnapshots try to recover every chunk that is missing or, with -chunks, corrupted, and
+// upload the recovered chunk to the storage.  'top' is the repository whose files can be chunked again if no copy of
+// a chunk can be found elsewhere; it may be empty.
+func (manager *SnapshotManager) SetChunkRepair(enabled bool, top string) {
+	manager.repairEnabled = enabled
+	manager.repairTop = top
+}
+
+// AddRepairStorage adds a storage, usually populated by the copy command, to look for copies of the chunks being
+// repaired.  The storage must be copy-compatible with the primary storage.
+func (manager *SnapshotManager) AddRepairStorage(name string, other *SnapshotManager) bool {
+	if !manager.config.IsCompatiableWith(other.config) {
+		LOG_ERROR("CHUNK_REPAIR", "The storage %s is not copy-compatible with the primary storage", name)
+		return false
+	}
+	manager.repairStorages = append(manager.repairStorages, failoverStorage{name: name, manager: other})
+	return true
+}
+
+// chunkLocation is where a chunk is referenced in a snapshot, which determines how the chunk can be recovered.
+type chunkLocation struct {
+	hash     string
+	snapshot *Snapshot
+	index    int // The index of the chunk in the chunk list of the snapshot, or -1 for a metadata chunk
+}
+
+// chunkRepairer recovers chunks from, in this order, the snapshot cache (metadata chunks only), the repair storages,
+// and the files in the repository, which are chunked again at the offsets recorded in the snapshot.  A recovered
+// chunk is only uploaded if its hash matches.
+type chunkRepairer struct {
+	manager   *SnapshotManager
+	snapshots []*Snapshot // The snapshots being checked
+
+	locations map[string]chunkLocation // Chunk ids found so far in the indexed snapshots
+	indexed   map[*Snapshot]bool
+
+	loadedSnapshot *Snapshot // The snapshot whose file list has been loaded for chunking files again
+
+	repairedChunks int
+	failedChunks   int
+}
+
+// createChunkRepairer returns a repairer for the chunks referenced by the snapshots being checked, or nil if repair
+// is not enabled.  The methods of chunkRepairer can be called on nil and then never repair anything.
+func (manager *SnapshotManager) createChunkRepairer(snapshotMap map[string][]*Snapshot) *chunkRepairer {
+	if !manager.repairEnabled {
+		return nil
+	}
+
+	repairer := &chunkRepairer{
+		manager:   manager,
+		locations: make(map[string]chunkLocation),
+		indexed:   make(map[*Snapshot]bool),
+	}
+	for _, snapshots := range snapshotMap {
+		repairer.snapshots = append(repairer.snapshots, snapshots...)
+	}
+	return repairer
+}
+
+// index records the location of every chunk referenced by the snapshot.
+func (repairer *chunkRepairer) index(snapshot *Snapshot) {
+	if repairer.indexed[snapshot] {
+		return
+	}
+	repairer.indexed[snapshot] = true
+
+	manager := repairer.manager
+	add := func(chunkHash string, index int) {
+		chunkID := manager.config.GetChunkIDFromHash(chunkHash)
+		if _, found := repairer.locations[chunkID]; !found {
+			repairer.locations[chunkID] = chunkLocation{hash: chunkHash, snapshot: snapshot, index: index}
+		}
+	}
+
+	for _, sequence := range [][]string{snapshot.FileSequence, snapshot.ChunkSequence, snapshot.LengthSequence} {
+		for _, chunkHash := range sequence {
+			add(chunkHash, -1)
+		}
+	}
+
+	chunkHashes := snapshot.ChunkHashes
+	if len(chunkHashes) == 0 {
+		var chunks Snapshot
+		err := chunks.LoadChunks(manager.DownloadSequence(snapshot.ChunkSequence))
+		if err != nil {
+			LOG_WARN("CHUNK_REPAIR", "Failed to load chunks for snapshot %s at revision %d: %v", snapshot.ID,
+				snapshot.Revision, err)
+			return
+		}
+		chunkHashes = chunks.ChunkHashes
+	}
+	for i, chunkHash := range chunkHashes {
+		add(chunkHash, i)
+	}
+}
+
+// locate finds where the chunk is referenced, looking in 'hint' first if it is not nil.
+func (repairer *chunkRepairer) locate(chunkID string, hint *Snapshot) (chunkLocation, bool) {
+	if hint != nil {
+		repairer.index(hint)
+	}
+	for _, snapshot := range repairer.snapshots {
+		if _, found := repairer.locations[chunkID]; found {
+			break
+		}
+		repairer.index(snapshot)
+	}
+	location, found := repairer.locations[chunkID]
+	return location, found
+}
+
+// repairMissingChunk tries to recover a chunk referenced by 'snapshot' that doesn't exist in the storage.  On
+// success the size of the uploaded chunk is recorded in 'chunkSizeMap'.
+func (repairer *chunkRepairer) repairMissingChunk(chunkID string, snapshot *Snapshot,
+	chunkSizeMap map[string]int64) bool {
+
+	if repairer == nil {
+		return false
+	}
+	size, repaired := repairer.repair(chunkID, snapshot)
+	if repaired {
+		chunkSizeMap[chunkID] = size
+	}
+	return repaired
+}
+
+// repairCorruptedChunk tries to recover a chunk that failed verification and to replace it in the storage.
+func (repairer *chunkRepairer) repairCorruptedChunk(chunkHash string) bool {
+	if repairer == nil {
+		return false
+	}
+	_, repaired := repairer.repair(repairer.manager.config.GetChunkIDFromHash(chunkHash), nil)
+	return repaired
+}
+
+// repair recovers the chunk and uploads it to the storage, returning the size of the uploaded chunk.
+func (repairer *chunkRepairer) repair(chunkID string, hint *Snapshot) (int64, bool) {
+
+	location, found := repairer.locate(chunkID, hint)
+	if !found {
+		LOG_WARN("CHUNK_REPAIR", "The chunk %s is not referenced by any snapshot being checked", chunkID)
+		repairer.failedChunks++
+		return 0, false
+	}
+
+	config := repairer.manager.config
+	chunk := config.GetChunk()
+	defer config.PutChunk(chunk)
+
+	source := repairer.findCopy(chunkID, location, chunk)
+	if source == "" {
+		LOG_WARN("CHUNK_REPAIR", "No good copy of the chunk %s can be found", chunkID)
+		repairer.failedChunks++
+		return 0, false
+	}
+
+	size, err := repairer.upload(chunkID, location, chunk)
+	if err != nil {
+		LOG_WARN("CHUNK_REPAIR", "Failed to upload the repaired chunk %s: %v", chunkID, err)
+		repairer.failedChunks++
+		return 0, false
+	}
+
+	LOG_INFO("CHUNK_REPAIR", "The chunk %s has been repaired with the copy from %s", chunkID, source)
+	repairer.repairedChunks++
+	return size, true
+}
+
+// findCopy stores a good copy of the chunk in 'chunk' and returns where it was found, or an empty string if there
+// isn't one.
+func (repairer *chunkRepairer) findCopy(chunkID string, location chunkLocation, chunk *Chunk) string {
+
+	manager := repairer.manager
+
+	// Only metadata chunks are stored in the snapshot cache, without encryption or compression
+	if location.index < 0 && manager.snapshotCache != nil {
+		cachedPath, exist, _, err := manager.snapshotCache.FindChunk(0, chunkID, false)
+		if err == nil && exist {
+			chunk.Reset(true)
+			err = manager.snapshotCache.DownloadFile(0, cachedPath, chunk)
+			if err == nil && chunk.GetID() == chunkID {
+				return "the snapshot cache"
+			}
+		}
+	}
+
+	for _, source := range manager.repairStorages {
+		found, err := downloadChunkCopy(0, manager.config, source.manager, location.hash, chunk)
+		if err != nil {
+			LOG_WARN("CHUNK_REPAIR", "Failed to download the chunk %s from the storage %s: %v", chunkID,
+				source.name, err)
+			continue
+		} else if found {
+			return fmt.Sprintf("the storage %s", source.name)
+		}
+		LOG_DEBUG("CHUNK_REPAIR", "The chunk %s does not exist in the storage %s", chunkID, source.name)
+	}
+
+	if location.index >= 0 && manager.repairTop != "" && repairer.chunkFiles(chunkID, location, chunk) {
+		return "the repository"
+	}
+
+	return ""
+}
+
+// chunkFiles rebuilds a file chunk from the parts of the files in the repository that it was made of.  It fails if
+// any of these files has changed since the backup.
+func (repairer *chunkRepairer) chunkFiles(chunkID string, location chunkLocation, chunk *Chunk) bool {
+
+	manager := repairer.manager
+	snapshot := location.snapshot
+	if repairer.loadedSnapshot != snapshot {
+		if repairer.loadedSnapshot != nil {
+			manager.ClearSnapshotContents(repairer.loadedSnapshot)
+		}
+		manager.DownloadSnapshotContents(snapshot, nil, false)
+		repairer.loadedSnapshot = snapshot
+	}
+
+	index := location.index
+	if index >= len(snapshot.ChunkLengths) {
+		return false
+	}
+
+	chunk.Reset(true)
+	for _, file := range snapshot.Files {
+		if !file.IsFile() || file.StartChunk > index || file.EndChunk < index {
+			continue
+		}
+		offset, length := getFilePartInChunk(file, index, snapshot.ChunkLengths)
+		if length <= 0 {
+			continue
+		}
+		err := readFilePart(joinRootPath(manager.repairTop, file.Path), offset, length, chunk)
+		if err != nil {
+			LOG_DEBUG("CHUNK_REPAIR", "Can't chunk the file %s again: %v", file.Path, err)
+			return false
+		}
+	}
+
+	if chunk.GetLength() != snapshot.ChunkLengths[index] || chunk.GetID() != chunkID {
+		LOG_DEBUG("CHUNK_REPAIR", "The files that made up the chunk %s have changed since the backup", chunkID)
+		return false
+	}
+	return true
+}
+
+// getFilePartInChunk returns the offset in the file and the length of the part of the file stored in the chunk at
+// 'index'.
+func getFilePartInChunk(file *Entry, index int, chunkLengths []int) (int64, int) {
+	start, end := 0, chunkLengths[index]
+	if index == file.StartChunk {
+		start = file.StartOffset
+	}
+	if index == file.EndChunk {
+		end = file.EndOffset
+	}
+
+	var offset int64
+	for i := file.StartChunk; i < index; i++ {
+		offset += int64(chunkLengths[i])
+	}
+	if index > file.StartChunk {
+		offset -= int64(file.StartOffset)
+	}
+	return offset, end - start
+}
+
+// readFilePart appends 'length' bytes at 'offset' in the file to the chunk.
+func readFilePart(fullPath string, offset int64, length int, chunk *Chunk) error {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(chunk, file, int64(length))
+	return err
+}
+
+// upload encrypts the recovered chunk and uploads it to where the chunk should be in the storage.
+func (repairer *chunkRepairer) upload(chunkID string, location chunkLocation, chunk *Chunk) (int64, error) {
+	return repairer.manager.uploadChunkContent(0, chunkID, location.hash, chunk.GetBytes(), location.index < 0)
+}
+
+// uploadChunkContent encrypts the unencrypted content of a chunk and uploads it to where the chunk should be in the
+// storage, overwriting any existing file.  It returns the size of the uploaded file.
+func (manager *SnapshotManager) uploadChunkContent(threadIndex int, chunkID string, chunkHash string, content []byte,
+	isMetadata bool) (int64, error) {
+
+	chunkPath, _, _, err := manager.storage.FindChunk(threadIndex, chunkID, false)
+	if err != nil {
+		return 0, err
+	}
+
+	uploadChunk := manager.config.GetChunk()
+	defer manager.config.PutChunk(uploadChunk)
+	uploadChunk.Reset(true)
+	uploadChunk.Write(content)
+
+	// Metadata chunks are never encrypted by the RSA key
+	err = uploadChunk.Encrypt(manager.config.ChunkKey, chunkHash, isMetadata)
+	if err != nil {
+		return 0, err
+	}
+
+	err = manager.storage.UploadFile(threadIndex, chunkPath, uploadChunk.GetBytes())
+	if err != nil {
+		return 0, err
+	}
+	return int64(uploadChunk.GetLength()), nil
+}
+
+// report logs the number of chunks repaired and not repaired.
+func (repairer *chunkRepairer) report() {
+	if repairer == nil || repairer.repairedChunks+repairer.failedChunks == 0 {
+		return
+	}
+	if repairer.loadedSnapshot != nil {
+		repairer.manager.ClearSnapshotContents(repairer.loadedSnapshot)
+		repairer.loadedSnapshot = nil
+	}
+	LOG_INFO("CHUNK_REPAIR", "%d chunks have been repaired; %d chunks could not be repaired", repairer.repairedChunks,
+		repairer.failedChunks)
+}
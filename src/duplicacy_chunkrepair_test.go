@@ -0,0 +1,97 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestCheckRepair(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "chunkrepair")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(repository, "dir1"), 0700)
+	for _, file := range []string{"file1", "file2", "dir1/file3"} {
+		createRandomFile(joinPath(repository, file), 100000)
+	}
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	manager := backupManager.SnapshotManager
+	snapshot := manager.DownloadSnapshot("host1", 1)
+	manager.DownloadSnapshotContents(snapshot, nil, false)
+	if len(snapshot.ChunkHashes) < 3 {
+		t.Fatalf("The backup created only %d file chunks", len(snapshot.ChunkHashes))
+	}
+
+	// The first chunk is deleted and the last one is corrupted
+	missingID := manager.config.GetChunkIDFromHash(snapshot.ChunkHashes[0])
+	missingPath, exist, _, err := storage.FindChunk(0, missingID, false)
+	if err != nil || !exist {
+		t.Fatalf("Failed to find the chunk %s: %v", missingID, err)
+	}
+	if err = storage.DeleteFile(0, missingPath); err != nil {
+		t.Fatalf("Failed to delete the chunk %s: %v", missingID, err)
+	}
+
+	corruptedID := manager.config.GetChunkIDFromHash(snapshot.ChunkHashes[len(snapshot.ChunkHashes)-1])
+	corruptedPath, exist, _, err := storage.FindChunk(0, corruptedID, false)
+	if err != nil || !exist {
+		t.Fatalf("Failed to find the chunk %s: %v", corruptedID, err)
+	}
+	if err = storage.UploadFile(0, corruptedPath, []byte("corrupted")); err != nil {
+		t.Fatalf("Failed to corrupt the chunk %s: %v", corruptedID, err)
+	}
+	manager.ClearSnapshotContents(snapshot)
+
+	manager.SetChunkRepair(true, repository)
+	if !manager.CheckSnapshots("host1", []int{1}, "", false, false, false, true, false, false, threads, false) {
+		t.Fatalf("The check with repair failed")
+	}
+
+	manager.SetChunkRepair(false, "")
+	os.Remove(joinPath(repository, DUPLICACY_DIRECTORY, "cache", "default", "verified_chunks"))
+	if !manager.CheckSnapshots("host1", []int{1}, "", false, false, false, true, false, false, threads, false) {
+		t.Errorf("The check after the repair failed")
+	}
+}
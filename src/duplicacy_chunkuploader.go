@@ -5,6 +5,7 @@
 package duplicacy
 
 import (
+	"runtime"
 	"sync/atomic"
 	"time"
 )
@@ -13,22 +14,48 @@ import (
 type ChunkUploadTask struct {
 	chunk      *Chunk
 	chunkIndex int
+	chunkSize  int    // The size of the chunk before encryption
+	chunkPath  string // Where the chunk will be uploaded to; only set after the existence check
+}
+
+// chunkUploadPathGetter is implemented by storages derived from StorageBase, which know where a chunk is uploaded to
+// without looking it up.
+type chunkUploadPathGetter interface {
+	getChunkUploadPath(chunkID string) string
 }
 
 // ChunkUploader uploads chunks to the storage using one or more uploading goroutines.  Chunks are added
 // by the call to StartChunk(), and then passed to the uploading goroutines.  The completion function is
 // called when the downloading is completed.  Note that ChunkUploader does not release chunks to the
 // chunk pool; instead
+//
+// Compression and encryption are performed by a separate pool of encoding goroutines, one per CPU core.  An
+// uploading goroutine checks if the chunk already exists and if not passes the chunk to the encoding goroutines,
+// so that it can upload other encoded chunks in the meantime rather than leaving the network idle, and a slow
+// (or rate-limited) upload doesn't leave the CPU idle either.  Chunks are hashed by the chunk maker as they are
+// created, before they are added to the uploader.
+//
+// Every chunk added is counted until it has been uploaded, skipped, or has failed, so that Stop() can wait for
+// the chunks in progress even when the errors don't end the process.
 type ChunkUploader struct {
-	config        *Config              // Associated config
-	storage       Storage              // Download from this storage
-	snapshotCache *FileStorage         // Used as cache if not nil; usually for uploading snapshot chunks
-	threads       int                  // Number of uploading goroutines
-	taskQueue     chan ChunkUploadTask // Uploading goroutines are listening on this channel for upload jobs
-	stopChannel   chan bool            // Used to terminate uploading goroutines
+	config          *Config              // Associated config
+	storage         Storage              // Download from this storage
+	snapshotCache   *FileStorage         // Used as cache if not nil; usually for uploading snapshot chunks
+	threads         int                  // Number of uploading goroutines
+	encodingThreads int                  // Number of encoding goroutines
+	taskQueue       chan ChunkUploadTask // Uploading goroutines are listening on this channel for upload jobs
+	encodingQueue   chan ChunkUploadTask // Encoding goroutines are listening on this channel for chunks to encrypt
+	encodedQueue    chan ChunkUploadTask // Encoded chunks are sent back to uploading goroutines via this channel
+	stopChannel     chan bool            // Used to terminate uploading and encoding goroutines
 
 	numberOfUploadingTasks int32 // The number of uploading tasks
 
+	checksums *chunkChecksumRecorder // Records the checksums of uploaded chunks if the storage reports checksums
+
+	skipExistenceCheck bool // Upload chunks without checking if they already exist in the storage
+
+	knownChunks *knownChunkFilter // Chunks not in this filter are uploaded without checking if they already exist
+
 	// Uploading goroutines call this function after having downloaded chunks
 	completionFunc func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int)
 }
@@ -37,37 +64,59 @@ type ChunkUploader struct {
 func CreateChunkUploader(config *Config, storage Storage, snapshotCache *FileStorage, threads int,
 	completionFunc func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int)) *ChunkUploader {
 	uploader := &ChunkUploader{
-		config:         config,
-		storage:        storage,
-		snapshotCache:  snapshotCache,
-		threads:        threads,
-		taskQueue:      make(chan ChunkUploadTask, 1),
-		stopChannel:    make(chan bool),
-		completionFunc: completionFunc,
+		config:          config,
+		storage:         storage,
+		snapshotCache:   snapshotCache,
+		threads:         threads,
+		encodingThreads: runtime.NumCPU(),
+		taskQueue:       make(chan ChunkUploadTask, 1),
+		encodingQueue:   make(chan ChunkUploadTask, runtime.NumCPU()),
+		encodedQueue:    make(chan ChunkUploadTask, threads),
+		stopChannel:     make(chan bool),
+		completionFunc:  completionFunc,
+		checksums:       createChunkChecksumRecorder(storage),
 	}
 
 	return uploader
 }
 
-// Starts starts uploading goroutines.
+// Starts starts uploading and encoding goroutines.
 func (uploader *ChunkUploader) Start() {
+	tasks := getGoroutineTasks()
 	for i := 0; i < uploader.threads; i++ {
 		go func(threadIndex int) {
 			defer CatchLogException()
 			for {
 				select {
 				case task := <-uploader.taskQueue:
-					uploader.Upload(threadIndex, task)
+					runGoroutineTask(tasks, func() { uploader.Upload(threadIndex, task) })
+				case task := <-uploader.encodedQueue:
+					runGoroutineTask(tasks, func() { uploader.UploadEncoded(threadIndex, task) })
 				case <-uploader.stopChannel:
 					return
 				}
 			}
 		}(i)
 	}
+
+	for i := 0; i < uploader.encodingThreads; i++ {
+		go func() {
+			defer CatchLogException()
+			for {
+				select {
+				case task := <-uploader.encodingQueue:
+					runGoroutineTask(tasks, func() { uploader.Encode(task) })
+				case <-uploader.stopChannel:
+					return
+				}
+			}
+		}()
+	}
 }
 
 // StartChunk sends a chunk to be uploaded to  a waiting uploading goroutine.  It may block if all uploading goroutines are busy.
 func (uploader *ChunkUploader) StartChunk(chunk *Chunk, chunkIndex int) {
+	checkOperationCancelled(uploader.storage.GetContext())
 	atomic.AddInt32(&uploader.numberOfUploadingTasks, 1)
 	uploader.taskQueue <- ChunkUploadTask{
 		chunk:      chunk,
@@ -78,9 +127,11 @@ func (uploader *ChunkUploader) StartChunk(chunk *Chunk, chunkIndex int) {
 // Stop stops all uploading goroutines.
 func (uploader *ChunkUploader) Stop() {
 	for atomic.LoadInt32(&uploader.numberOfUploadingTasks) > 0 {
+		// The chunks may never be uploaded once the operation is cancelled
+		checkOperationCancelled(uploader.storage.GetContext())
 		time.Sleep(100 * time.Millisecond)
 	}
-	for i := 0; i < uploader.threads; i++ {
+	for i := 0; i < uploader.threads+uploader.encodingThreads; i++ {
 		uploader.stopChannel <- false
 	}
 }
@@ -88,6 +139,16 @@ func (uploader *ChunkUploader) Stop() {
 // Upload is called by the uploading goroutines to perform the actual uploading
 func (uploader *ChunkUploader) Upload(threadIndex int, task ChunkUploadTask) bool {
 
+	// The chunk is no longer in progress unless it has been passed to the encoding goroutines
+	encoding := false
+	defer func() {
+		if !encoding {
+			atomic.AddInt32(&uploader.numberOfUploadingTasks, -1)
+		}
+	}()
+
+	checkOperationCancelled(uploader.storage.GetContext())
+
 	chunk := task.chunk
 	chunkSize := chunk.GetLength()
 	chunkID := chunk.GetID()
@@ -97,7 +158,7 @@ func (uploader *ChunkUploader) Upload(threadIndex int, task ChunkUploadTask) boo
 		chunk.VerifyID()
 	}
 
-	if uploader.snapshotCache != nil && uploader.storage.IsCacheNeeded() {
+	if uploader.snapshotCache != nil && uploader.storage.IsCacheNeeded() && !uploader.config.dryRun {
 		// Save a copy to the local snapshot.
 		chunkPath, exist, _, err := uploader.snapshotCache.FindChunk(threadIndex, chunkID, false)
 		if err != nil {
@@ -112,10 +173,23 @@ func (uploader *ChunkUploader) Upload(threadIndex int, task ChunkUploadTask) boo
 	}
 
 	// This returns the path the chunk file should be at.
-	chunkPath, exist, _, err := uploader.storage.FindChunk(threadIndex, chunkID, false)
-	if err != nil {
-		LOG_ERROR("UPLOAD_CHUNK", "Failed to find the path for the chunk %s: %v", chunkID, err)
-		return false
+	var chunkPath string
+	var exist bool
+	var err error
+	if uploader.config.dryRun {
+		// A dry run doesn't look up chunks in the storage; the chunks not known to the caller are counted as new
+	} else if getter, ok := uploader.storage.(chunkUploadPathGetter); ok &&
+		(uploader.skipExistenceCheck || !uploader.knownChunks.mayContain(chunkID)) {
+		chunkPath = getter.getChunkUploadPath(chunkID)
+	} else {
+		chunkPath, exist, _, err = uploader.storage.FindChunk(threadIndex, chunkID, false)
+		if err != nil {
+			LOG_ERROR("UPLOAD_CHUNK", "Failed to find the path for the chunk %s: %v", chunkID, err)
+			return false
+		}
+		if exist {
+			uploader.knownChunks.add(chunkID)
+		}
 	}
 
 	if exist {
@@ -123,29 +197,68 @@ func (uploader *ChunkUploader) Upload(threadIndex int, task ChunkUploadTask) boo
 		LOG_DEBUG("CHUNK_DUPLICATE", "Chunk %s already exists", chunkID)
 
 		uploader.completionFunc(chunk, task.chunkIndex, true, chunkSize, 0)
-		atomic.AddInt32(&uploader.numberOfUploadingTasks, -1)
 		return false
 	}
 
-	// Encrypt the chunk only after we know that it must be uploaded.
-	err = chunk.Encrypt(uploader.config.ChunkKey, chunk.GetHash(), uploader.snapshotCache != nil)
+	// Encrypt the chunk only after we know that it must be uploaded.  While waiting for an encoding goroutine to
+	// become available, upload chunks that have already been encoded; otherwise all goroutines could end up
+	// waiting for each other.
+	task.chunkSize = chunkSize
+	task.chunkPath = chunkPath
+	for {
+		select {
+		case uploader.encodingQueue <- task:
+			encoding = true
+			return true
+		case encodedTask := <-uploader.encodedQueue:
+			uploader.UploadEncoded(threadIndex, encodedTask)
+		}
+	}
+}
+
+// Encode is called by the encoding goroutines to compress and encrypt the chunk, which is then passed back to the
+// uploading goroutines.
+func (uploader *ChunkUploader) Encode(task ChunkUploadTask) {
+
+	encoded := false
+	defer func() {
+		if !encoded {
+			atomic.AddInt32(&uploader.numberOfUploadingTasks, -1)
+		}
+	}()
+
+	chunk := task.chunk
+	err := chunk.Encrypt(uploader.config.ChunkKey, chunk.GetHash(), uploader.snapshotCache != nil)
 	if err != nil {
-		LOG_ERROR("UPLOAD_CHUNK", "Failed to encrypt the chunk %s: %v", chunkID, err)
-		return false
+		LOG_ERROR("UPLOAD_CHUNK", "Failed to encrypt the chunk %s: %v", chunk.GetID(), err)
+		return
 	}
 
+	encoded = true
+	uploader.encodedQueue <- task
+}
+
+// UploadEncoded is called by the uploading goroutines to upload a chunk that has been encoded.
+func (uploader *ChunkUploader) UploadEncoded(threadIndex int, task ChunkUploadTask) bool {
+
+	defer atomic.AddInt32(&uploader.numberOfUploadingTasks, -1)
+
+	chunk := task.chunk
+	chunkID := chunk.GetID()
+
 	if !uploader.config.dryRun {
-		err = uploader.storage.UploadFile(threadIndex, chunkPath, chunk.GetBytes())
+		err := uploader.storage.UploadFile(threadIndex, task.chunkPath, chunk.GetBytes())
 		if err != nil {
 			LOG_ERROR("UPLOAD_CHUNK", "Failed to upload the chunk %s: %v", chunkID, err)
 			return false
 		}
+		uploader.checksums.record(chunkID, chunk.GetBytes())
+		uploader.knownChunks.add(chunkID)
 		LOG_DEBUG("CHUNK_UPLOAD", "Chunk %s has been uploaded", chunkID)
 	} else {
 		LOG_DEBUG("CHUNK_UPLOAD", "Uploading was skipped for chunk %s", chunkID)
 	}
 
-	uploader.completionFunc(chunk, task.chunkIndex, false, chunkSize, chunk.GetLength())
-	atomic.AddInt32(&uploader.numberOfUploadingTasks, -1)
+	uploader.completionFunc(chunk, task.chunkIndex, false, task.chunkSize, chunk.GetLength())
 	return true
 }
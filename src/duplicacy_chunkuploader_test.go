@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"runtime/debug"
+	"sync"
 	"testing"
 	"time"
 
@@ -126,3 +127,115 @@ func TestUploaderAndDownloader(t *testing.T) {
 	}
 
 }
+
+func TestChunkUploaderPipeline(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	removeMockStore("mocktest/uploader")
+	storage, err := CreateMockStorage("mocktest/uploader?latency=1ms", 4)
+	if err != nil {
+		t.Fatalf("Failed to create the mock storage: %v", err)
+	}
+	storage.CreateDirectory(0, "chunks")
+
+	config := CreateConfig()
+	config.MinimumChunkSize = 100
+	config.chunkPool = make(chan *Chunk, 100)
+
+	createChunks := func(numberOfChunks int) (chunks []*Chunk) {
+		for i := 0; i < numberOfChunks; i++ {
+			content := make([]byte, rand.Int()%(16*1024)+1)
+			crypto_rand.Read(content)
+			chunk := CreateChunk(config, true)
+			chunk.Reset(true)
+			chunk.Write(content)
+			chunks = append(chunks, chunk)
+		}
+		return chunks
+	}
+
+	// upload adds the chunks to a new uploader with several uploading and encoding goroutines and returns the
+	// indices of the chunks reported as completed, or fails the test if Stop() doesn't return
+	upload := func(storage Storage, chunks []*Chunk) map[int]bool {
+		var lock sync.Mutex
+		completed := make(map[int]bool)
+		uploader := CreateChunkUploader(config, storage, nil, 4,
+			func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int) {
+				lock.Lock()
+				completed[chunkIndex] = true
+				lock.Unlock()
+			})
+		uploader.encodingThreads = 3
+		uploader.Start()
+		for i, chunk := range chunks {
+			uploader.StartChunk(chunk, i)
+		}
+
+		stopped := make(chan bool)
+		go func() {
+			uploader.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("The uploader didn't stop")
+		}
+		return completed
+	}
+
+	chunks := createChunks(50)
+	completed := upload(storage, chunks)
+	for i, chunk := range chunks {
+		if !completed[i] {
+			t.Errorf("Chunk %d wasn't reported as uploaded", i)
+		}
+		if _, exist, _, err := storage.FindChunk(0, chunk.GetID(), false); err != nil || !exist {
+			t.Errorf("Chunk %d wasn't uploaded: %v", i, err)
+		}
+	}
+
+	// When the errors are passed to a handler instead of ending the process, as for operations run by Client, the
+	// chunks that failed, or were being uploaded by a goroutine that failed, are no longer waited for
+	var lock sync.Mutex
+	var failures []Exception
+	tasks := createGoroutineTasks(func(exception Exception) {
+		lock.Lock()
+		failures = append(failures, exception)
+		lock.Unlock()
+	})
+	setGoroutineTasks(tasks)
+	setTestingT(nil)
+	chunks = createChunks(10)
+	completed = upload(&failingUploadStorage{MockStorage: storage}, chunks)
+	setTestingT(t)
+	setGoroutineTasks(nil)
+	tasks.end()
+
+	if len(completed) != 0 {
+		t.Errorf("%d chunks were reported as uploaded", len(completed))
+	}
+
+	// The handler is called after the failed task has been counted as finished
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		numberOfFailures := len(failures)
+		lock.Unlock()
+		if numberOfFailures > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(failures) == 0 {
+		t.Errorf("No failures were passed to the handler")
+	}
+	for _, failure := range failures {
+		if failure.LogID != "UPLOAD_CHUNK" {
+			t.Errorf("An upload failed with %s %s", failure.LogID, failure.Message)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ClientOptions configures a Client.  Credentials other than the storage password, such as s3_id and s3_secret, are
+// given in Keys with the same names as in the preferences, and are never prompted for.
+type ClientOptions struct {
+	Repository  string // the directory to back up or restore to; the cache is kept in its .duplicacy directory
+	StorageURL  string
+	StorageName string // the name of the storage for the cache and the credentials, "default" if empty
+	SnapshotID  string
+	Password    string            // the storage password, if the storage is encrypted
+	Keys        map[string]string // other credentials, as in Preference.Keys
+	Threads     int               // the number of uploading or downloading threads, 1 if not set
+	FiltersFile string            // the filters for backups, if not the one in the .duplicacy directory
+
+	// Receives every log message; messages are discarded if it is nil
+	LogFunction func(level int, logID string, message string)
+
+	// Receives the periodic progress messages of backups and restores
+	ProgressFunction func(logID string, message string)
+}
+
+// Client performs the core operations on a storage for programs that embed duplicacy.  Failures are returned as
+// errors, which are Exception values carrying the log id, instead of terminating the process.
+//
+// As the package keeps global state such as the preference path, operations of all clients in a process run one at a
+// time.  An operation stops with an error as soon as its context is cancelled, aborting the requests in progress.
+type Client struct {
+	options    ClientOptions
+	preference Preference
+	manager    *BackupManager
+}
+
+// BackupOptions are the options of Client.Backup.
+type BackupOptions struct {
+	Tag  string
+	Hash bool // detect file differences by hashes instead of sizes and timestamps
+}
+
+// RestoreOptions are the options of Client.Restore.
+type RestoreOptions struct {
+	Revision  int
+	Patterns  []string // the files to restore, as in the include/exclude patterns; all files if empty
+	Overwrite bool
+	Delete    bool // delete files not in the revision
+	SetOwner  bool
+	Hash      bool
+}
+
+// CheckOptions are the options of Client.Check.
+type CheckOptions struct {
+	SnapshotID string // the snapshot id to check; the id of the client if empty
+	AllIDs     bool   // check all snapshot ids
+	Revisions  []int  // the revisions to check; all revisions if empty
+	Files      bool   // verify the content of files
+	Chunks     bool   // verify the content of chunks
+	Persist    bool   // continue after errors
+}
+
+// PruneOptions are the options of Client.Prune.
+type PruneOptions struct {
+	SnapshotID string   // the snapshot id to prune; the id of the client if empty
+	AllIDs     bool     // prune all snapshot ids
+	Revisions  []int    // the revisions to delete
+	Tags       []string // delete the revisions with these tags
+	Keep       []string // retention policies n:m, as in the -keep option
+	Exhaustive bool
+	Exclusive  bool
+	DryRun     bool
+}
+
+var clientMutex sync.Mutex
+
+// run runs the operation with log messages sent to the client's functions, turning the exceptions raised by
+// LOG_ERROR into errors.  'operation' is also used to create the log id of the error when the function fails
+// without raising an exception.  The operation is cancelled when 'ctx' is done, in which case the error of 'ctx' is
+// returned, or when a goroutine transferring chunks raises an exception, which is then the error returned.
+func (client *Client) run(ctx context.Context, operation string, function func() bool) (err error) {
+
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	savedLogFunction := LogFunction
+	savedRunInBackground := RunInBackground
+	LogFunction = client.log
+	RunInBackground = true // never prompt for passwords
+	defer func() {
+		LogFunction = savedLogFunction
+		RunInBackground = savedRunInBackground
+	}()
+
+	SetDuplicacyPreferencePath(path.Join(client.options.Repository, DUPLICACY_DIRECTORY))
+
+	operationContext, cancelOperation := context.WithCancel(ctx)
+	defer SetOperationContext(operationContext)()
+
+	// The error of a goroutine cancels the operation
+	var goroutineLock sync.Mutex
+	var goroutineError error
+	tasks := createGoroutineTasks(func(exception Exception) {
+		goroutineLock.Lock()
+		if goroutineError == nil {
+			goroutineError = exception
+		}
+		goroutineLock.Unlock()
+		cancelOperation()
+	})
+	setGoroutineTasks(tasks)
+	defer func() {
+		setGoroutineTasks(nil)
+		// The transfers still in progress if the operation has failed are aborted
+		cancelOperation()
+		tasks.end()
+		// The goroutines of the chunk downloader kept by the snapshot manager no longer run any tasks
+		if client.manager != nil {
+			client.manager.SnapshotManager.stopChunkDownloader()
+		}
+	}()
+
+	// The operation fails because of the cancellation or the error of a goroutine, rather than the errors that follow
+	getError := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		goroutineLock.Lock()
+		defer goroutineLock.Unlock()
+		if goroutineError != nil {
+			return goroutineError
+		}
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			exception, ok := r.(Exception)
+			if !ok {
+				panic(r)
+			}
+			// Save the incomplete snapshot, as CatchLogException would
+			RunAtError()
+			RunAtError = func() {}
+			err = getError(exception)
+		}
+	}()
+
+	if !function() {
+		return getError(Exception{Level: ERROR, LogID: strings.ToUpper(operation) + "_FAILED",
+			Message: fmt.Sprintf("The %s failed", operation)})
+	}
+	return getError(ctx.Err())
+}
+
+// log forwards log messages to the client's functions.  Like logf, it raises an exception for errors.
+func (client *Client) log(level int, logID string, message string) {
+	if client.options.LogFunction != nil {
+		client.options.LogFunction(level, logID, message)
+	}
+	if client.options.ProgressFunction != nil && getJSONRecordType(level, logID) == "progress" {
+		client.options.ProgressFunction(logID, message)
+	}
+	if level > WARN {
+		panic(Exception{Level: level, LogID: logID, Message: message})
+	}
+}
+
+// OpenClient connects to the storage and downloads its configuration.
+func OpenClient(ctx context.Context, options ClientOptions) (*Client, error) {
+
+	if options.StorageName == "" {
+		options.StorageName = "default"
+	}
+	if options.Threads <= 0 {
+		options.Threads = 1
+	}
+
+	client := &Client{
+		options: options,
+		preference: Preference{
+			Name:           options.StorageName,
+			SnapshotID:     options.SnapshotID,
+			RepositoryPath: options.Repository,
+			StorageURL:     options.StorageURL,
+			Encrypted:      options.Password != "",
+			Keys:           options.Keys,
+		},
+	}
+
+	if options.Repository == "" {
+		return nil, Exception{Level: ERROR, LogID: "REPOSITORY_PATH", Message: "The repository is not specified"}
+	}
+
+	err := client.run(ctx, "open", func() bool {
+		err := os.MkdirAll(path.Join(options.Repository, DUPLICACY_DIRECTORY), 0700)
+		if err != nil {
+			LOG_ERROR("REPOSITORY_PATH", "Failed to create the .duplicacy directory: %v", err)
+			return false
+		}
+
+		storage := CreateStorage(client.preference, false, options.Threads)
+		if storage == nil {
+			return false
+		}
+
+		client.manager = CreateBackupManager(options.SnapshotID, storage, options.Repository, options.Password, "",
+			options.FiltersFile, false)
+		if client.manager == nil {
+			return false
+		}
+		return client.manager.SetupSnapshotCache(options.StorageName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Backup backs up the repository and returns the statistics of the new revision.
+func (client *Client) Backup(ctx context.Context, options BackupOptions) (*OperationSummary, error) {
+	var summary OperationSummary
+	err := client.run(ctx, "backup", func() bool {
+		if !client.manager.Backup(client.options.Repository, !options.Hash, client.options.Threads, options.Tag,
+			false, false, 0, false) {
+			return false
+		}
+		summary = client.manager.GetSummary()
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// Restore restores the revision to the repository.  If some of the files can't be restored, the statistics are
+// returned along with the error.
+func (client *Client) Restore(ctx context.Context, options RestoreOptions) (*OperationSummary, error) {
+	var summary *OperationSummary
+	err := client.run(ctx, "restore", func() bool {
+		failed := client.manager.Restore(client.options.Repository, options.Revision, true, !options.Hash,
+			client.options.Threads, options.Overwrite, options.Delete, options.SetOwner, false, options.Patterns, false)
+		restored := client.manager.GetSummary()
+		summary = &restored
+		return failed == 0
+	})
+	return summary, err
+}
+
+// List returns the revisions of the snapshot id, or of the client's snapshot id if it is empty, sorted by revision
+// number.  The file lists of the revisions are not loaded.
+func (client *Client) List(ctx context.Context, snapshotID string) ([]*Snapshot, error) {
+	if snapshotID == "" {
+		snapshotID = client.options.SnapshotID
+	}
+	var snapshots []*Snapshot
+	err := client.run(ctx, "list", func() bool {
+		revisions, err := client.manager.SnapshotManager.ListSnapshotRevisions(snapshotID)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list the revisions of %s: %v", snapshotID, err)
+			return false
+		}
+		sort.Ints(revisions)
+		for _, revision := range revisions {
+			if ctx.Err() != nil {
+				return true
+			}
+			snapshots = append(snapshots, client.manager.SnapshotManager.DownloadSnapshot(snapshotID, revision))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// ListSnapshotIDs returns the snapshot ids in the storage.
+func (client *Client) ListSnapshotIDs(ctx context.Context) ([]string, error) {
+	var ids []string
+	err := client.run(ctx, "list", func() bool {
+		var err error
+		ids, err = client.manager.SnapshotManager.ListSnapshotIDs()
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list the snapshot ids: %v", err)
+			return false
+		}
+		return true
+	})
+	return ids, err
+}
+
+// Check verifies that all chunks referenced by the revisions exist, and optionally their content or the content of
+// files.  Missing or corrupted chunks are returned as an error.
+func (client *Client) Check(ctx context.Context, options CheckOptions) error {
+	snapshotID := options.SnapshotID
+	if options.AllIDs {
+		snapshotID = ""
+	} else if snapshotID == "" {
+		snapshotID = client.options.SnapshotID
+	}
+	return client.run(ctx, "check", func() bool {
+		return client.manager.SnapshotManager.CheckSnapshots(snapshotID, options.Revisions, "", false, false,
+			options.Files, options.Chunks, false, false, client.options.Threads, options.Persist)
+	})
+}
+
+// Prune deletes the revisions selected by the options and the chunks no longer referenced.
+func (client *Client) Prune(ctx context.Context, options PruneOptions) error {
+	snapshotID := options.SnapshotID
+	if options.AllIDs {
+		snapshotID = ""
+	} else if snapshotID == "" {
+		snapshotID = client.options.SnapshotID
+	}
+	return client.run(ctx, "prune", func() bool {
+		return client.manager.SnapshotManager.PruneSnapshots(client.options.SnapshotID, snapshotID, options.Revisions,
+			options.Tags, options.Keep, options.Exhaustive, options.Exclusive, nil, options.DryRun, false, false,
+			client.options.Threads)
+	})
+}
+
+// GetBackupManager returns the backup manager of the client, for operations not covered by the client.  Its methods
+// terminate the process on errors when called outside of the client.
+func (client *Client) GetBackupManager() *BackupManager {
+	return client.manager
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "client")
+	os.RemoveAll(testDir)
+	os.MkdirAll(filepath.Join(testDir, "repository1", "dir"), 0700)
+	os.MkdirAll(filepath.Join(testDir, "repository2"), 0700)
+	createRandomFile(filepath.Join(testDir, "repository1", "dir", "file1"), 100000)
+	createRandomFile(filepath.Join(testDir, "repository1", "file2"), 20000)
+
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	ctx := context.Background()
+	var progress []string
+	options := ClientOptions{
+		Repository: filepath.Join(testDir, "repository1"),
+		StorageURL: filepath.Join(testDir, "storage"),
+		SnapshotID: "host1",
+		ProgressFunction: func(logID string, message string) {
+			progress = append(progress, logID)
+		},
+	}
+	client, err := OpenClient(ctx, options)
+	if err != nil {
+		t.Fatalf("Failed to open the client: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		summary, err := client.Backup(ctx, BackupOptions{Tag: "library"})
+		if err != nil {
+			t.Fatalf("The backup failed: %v", err)
+		}
+		if summary.Revision != i+1 || summary.TotalFiles != 2 {
+			t.Errorf("The summary of backup %d is %+v", i+1, summary)
+		}
+	}
+
+	snapshots, err := client.List(ctx, "")
+	if err != nil || len(snapshots) != 2 || snapshots[1].Revision != 2 || snapshots[1].Tag != "library" {
+		t.Errorf("Listed %d snapshots: %v", len(snapshots), err)
+	}
+
+	if err := client.Check(ctx, CheckOptions{Files: true}); err != nil {
+		t.Errorf("The check failed: %v", err)
+	}
+
+	if err := client.Prune(ctx, PruneOptions{Revisions: []int{1}, Exclusive: true}); err != nil {
+		t.Errorf("The prune failed: %v", err)
+	}
+	if ids, err := client.ListSnapshotIDs(ctx); err != nil || len(ids) != 1 || ids[0] != "host1" {
+		t.Errorf("The snapshot ids are %v: %v", ids, err)
+	}
+
+	// Errors are returned instead of terminating the process
+	options.Repository = filepath.Join(testDir, "repository2")
+	restoreClient, err := OpenClient(ctx, options)
+	if err != nil {
+		t.Fatalf("Failed to open the client: %v", err)
+	}
+	_, err = restoreClient.Restore(ctx, RestoreOptions{Revision: 1})
+	if exception, ok := err.(Exception); !ok || exception.LogID != "SNAPSHOT_NOT_EXIST" {
+		t.Errorf("Restoring a deleted revision returned %v", err)
+	}
+
+	summary, err := restoreClient.Restore(ctx, RestoreOptions{Revision: 2})
+	if err != nil || summary.NewFiles != 2 {
+		t.Errorf("The restore returned %+v: %v", summary, err)
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "repository2", "dir", "file1")); err != nil {
+		t.Errorf("The file was not restored: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.Backup(cancelled, BackupOptions{}); err != context.Canceled {
+		t.Errorf("The cancelled backup returned %v", err)
+	}
+
+	if _, err := OpenClient(ctx, ClientOptions{Repository: filepath.Join(testDir, "repository1"),
+		StorageURL: filepath.Join(testDir, "nonexistent")}); err == nil {
+		t.Errorf("Opening a client for a storage that doesn't exist succeeded")
+	}
+
+	if LogFunction != nil || RunInBackground {
+		t.Errorf("The global settings were not restored")
+	}
+}
+
+// failingUploadStorage fails the uploads of chunks.
+type failingUploadStorage struct {
+	*MockStorage
+}
+
+func (storage *failingUploadStorage) UploadFile(threadIndex int, filePath string, content []byte) error {
+	if strings.HasPrefix(filePath, "chunks/") {
+		return fmt.Errorf("the upload is rejected")
+	}
+	return storage.MockStorage.UploadFile(threadIndex, filePath, content)
+}
+
+func TestClientCancellation(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "client_cancellation")
+	os.RemoveAll(testDir)
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(repository, 0700)
+	createRandomFile(filepath.Join(repository, "file1"), 4*1024*1024)
+
+	// Each request takes a while, so the backup takes seconds to upload all chunks
+	removeMockStore("mocktest/client")
+	storage, err := CreateMockStorage("mocktest/client?latency=20ms", 1)
+	if err != nil {
+		t.Fatalf("Failed to create the mock storage: %v", err)
+	}
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	options := ClientOptions{
+		Repository: repository,
+		StorageURL: "mock://mocktest/client?latency=20ms",
+		SnapshotID: "host1",
+		Threads:    2,
+	}
+	client, err := OpenClient(context.Background(), options)
+	if err != nil {
+		t.Fatalf("Failed to open the client: %v", err)
+	}
+
+	// Cancelling the context stops the backup in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := client.Backup(ctx, BackupOptions{}); err != context.Canceled {
+		t.Errorf("The cancelled backup returned %v", err)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("The backup was stopped after %s", time.Since(start))
+	}
+
+	// A failed upload in an uploading goroutine is returned as the error of the backup
+	manager := client.GetBackupManager()
+	manager.storage = &failingUploadStorage{MockStorage: manager.storage.(*MockStorage)}
+	_, err = client.Backup(context.Background(), BackupOptions{})
+	if exception, ok := err.(Exception); !ok || exception.LogID != "UPLOAD_CHUNK" {
+		t.Errorf("The backup with failed uploads returned %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// getCachedSnapshotDir returns the directory holding the snapshots of the storage in the local snapshot cache.
+func getCachedSnapshotDir(storageName string) string {
+	return path.Join(GetDuplicacyPreferencePath(), "cache", storageName, "snapshots")
+}
+
+// ListCachedSnapshotIDs returns the snapshot ids found in the local snapshot cache of the storage.  Unlike
+// ListSnapshotIDs it doesn't connect to the storage, so it is fast enough for shell completion, but it only knows
+// about the snapshots that have been downloaded before.
+func ListCachedSnapshotIDs(storageName string) (snapshotIDs []string) {
+	files, err := ioutil.ReadDir(getCachedSnapshotDir(storageName))
+	if err != nil {
+		return nil
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			snapshotIDs = append(snapshotIDs, file.Name())
+		}
+	}
+	sort.Strings(snapshotIDs)
+	return snapshotIDs
+}
+
+// ListCachedRevisions returns the revisions of the snapshot id found in the local snapshot cache of the storage, in
+// ascending order.
+func ListCachedRevisions(storageName string, snapshotID string) (revisions []int) {
+	files, err := ioutil.ReadDir(path.Join(getCachedSnapshotDir(storageName), snapshotID))
+	if err != nil {
+		return nil
+	}
+	for _, file := range files {
+		if revision, err := strconv.Atoi(file.Name()); err == nil && !file.IsDir() && revision > 0 {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Ints(revisions)
+	return revisions
+}
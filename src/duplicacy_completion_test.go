@@ -0,0 +1,42 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCachedSnapshots(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "completion")
+	os.RemoveAll(testDir)
+	savedPath := preferencePath
+	SetDuplicacyPreferencePath(testDir)
+	defer SetDuplicacyPreferencePath(savedPath)
+
+	snapshotDir := path.Join(testDir, "cache", "offsite", "snapshots")
+	for _, file := range []string{"host1/10", "host1/2", "host1/1", "host1/tmp", "host2/3"} {
+		os.MkdirAll(path.Dir(path.Join(snapshotDir, file)), 0700)
+		ioutil.WriteFile(path.Join(snapshotDir, file), []byte("{}"), 0600)
+	}
+	ioutil.WriteFile(path.Join(snapshotDir, "file"), nil, 0600)
+
+	if snapshotIDs := ListCachedSnapshotIDs("offsite"); strings.Join(snapshotIDs, ",") != "host1,host2" {
+		t.Errorf("The cached snapshot ids are %v", snapshotIDs)
+	}
+	if revisions := ListCachedRevisions("offsite", "host1"); len(revisions) != 3 || revisions[0] != 1 ||
+		revisions[1] != 2 || revisions[2] != 10 {
+		t.Errorf("The cached revisions are %v", revisions)
+	}
+	if snapshotIDs := ListCachedSnapshotIDs("default"); len(snapshotIDs) != 0 {
+		t.Errorf("The storage without a cache has the snapshot ids %v", snapshotIDs)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	blake2 "github.com/minio/blake2b-simd"
@@ -80,11 +81,24 @@ type Config struct {
 	DataShards   int `json:'data-shards'`
 	ParityShards int `json:'parity-shards'`
 
+	// incremented every time file chunks are re-wrapped under a new RSA key
+	RSAKeyGeneration int `json:"rsa-key-generation,omitempty"`
+
+	// encrypt every chunk with a random key instead of the key derived from the chunk hash, so that identical chunks
+	// don't have identical keys (the chunk ids still are)
+	RandomChunkKeys bool `json:"random-chunk-keys,omitempty"`
+
 	// for RSA encryption
 	rsaPrivateKey *rsa.PrivateKey
 	rsaPublicKey  *rsa.PublicKey
 
+	// for wrapping the master key with a key management service
+	kmsURI        string
+	kmsDataKey    []byte
+	kmsWrappedKey []byte
+
 	chunkPool      chan *Chunk
+	bufferPool     *sync.Pool // free chunk buffers; see AllocateChunkBuffer
 	numberOfChunks int32
 	dryRun         bool
 }
@@ -203,6 +217,15 @@ func (config *Config) Print() {
 		})
 
 		LOG_TRACE("CONFIG_INFO", "RSA public key: %s", publicKey)
+		LOG_TRACE("CONFIG_INFO", "RSA key generation: %d", config.RSAKeyGeneration)
+	}
+
+	if config.kmsURI != "" {
+		LOG_TRACE("CONFIG_INFO", "Storage key wrapped by %s", config.kmsURI)
+	}
+
+	if config.RandomChunkKeys {
+		LOG_TRACE("CONFIG_INFO", "Chunks are encrypted with random keys")
 	}
 
 }
@@ -256,6 +279,7 @@ func CreateConfigFromParameters(compressionLevel int, averageChunkSize int, maxi
 	}
 
 	config.chunkPool = make(chan *Chunk, runtime.NumCPU()*16)
+	config.bufferPool = &sync.Pool{}
 
 	return config
 }
@@ -266,6 +290,7 @@ func CreateConfig() (config *Config) {
 		IDKey:            DEFAULT_KEY,
 		CompressionLevel: DEFAULT_COMPRESSION_LEVEL,
 		chunkPool:        make(chan *Chunk, runtime.NumCPU()*16),
+		bufferPool:       &sync.Pool{},
 	}
 }
 
@@ -294,7 +319,8 @@ func (config *Config) PutChunk(chunk *Chunk) {
 	select {
 	case config.chunkPool <- chunk:
 	default:
-		LOG_INFO("CHUNK_BUFFER", "Discarding a free chunk due to a full pool")
+		// The buffer can still be reused by another chunk
+		config.ReleaseChunkBuffer(chunk.buffer)
 	}
 }
 
@@ -404,13 +430,34 @@ func DownloadConfig(storage Storage, password string) (config *Config, isEncrypt
 		return nil, false, fmt.Errorf("The storage has an invalid config file")
 	}
 
-	if string(configFile.GetBytes()[:len(ENCRYPTION_BANNER)-1]) == ENCRYPTION_BANNER[:len(ENCRYPTION_BANNER)-1] && len(password) == 0 {
-		return nil, true, fmt.Errorf("The storage is likely to have been initialized with a password before")
-	}
-
 	var masterKey []byte
+	var kmsHeader *kmsConfigHeader
+	var kmsDataKey []byte
 
-	if len(password) > 0 {
+	if bytes.HasPrefix(configFile.GetBytes(), []byte(KMS_CONFIG_BANNER)) {
+		// The master key is wrapped by a key management service, and may also be derived from a password
+		var encrypted []byte
+		kmsHeader, encrypted, err = parseKMSConfig(configFile.GetBytes())
+		if err != nil {
+			return nil, true, err
+		}
+		if len(kmsHeader.Salt) > 0 && len(password) == 0 {
+			return nil, true, fmt.Errorf("The storage requires a password in addition to the key in %s", kmsHeader.KMS)
+		}
+
+		kmsDataKey, masterKey, err = unwrapConfigKey(kmsHeader, password)
+		if err != nil {
+			return nil, true, err
+		}
+
+		var content bytes.Buffer
+		content.Write([]byte(ENCRYPTION_BANNER))
+		content.Write(encrypted)
+		configFile.Reset(false)
+		configFile.Write(content.Bytes())
+	} else if string(configFile.GetBytes()[:len(ENCRYPTION_BANNER)-1]) == ENCRYPTION_BANNER[:len(ENCRYPTION_BANNER)-1] && len(password) == 0 {
+		return nil, true, fmt.Errorf("The storage is likely to have been initialized with a password before")
+	} else if len(password) > 0 {
 
 		if string(configFile.GetBytes()[:len(ENCRYPTION_BANNER)]) == ENCRYPTION_BANNER {
 			// This is the old config format with a static salt and a fixed number of iterations
@@ -439,8 +486,10 @@ func DownloadConfig(storage Storage, password string) (config *Config, isEncrypt
 		} else {
 			return nil, true, fmt.Errorf("The config file has an invalid banner")
 		}
+	}
 
-		// Decrypt the config file.  masterKey == nil means no encryption.
+	// Decrypt the config file.  masterKey == nil means no encryption.
+	if masterKey != nil {
 		err = configFile.Decrypt(masterKey, "")
 		if err != nil {
 			return nil, false, fmt.Errorf("Failed to retrieve the config file: %v", err)
@@ -454,6 +503,12 @@ func DownloadConfig(storage Storage, password string) (config *Config, isEncrypt
 		return nil, false, fmt.Errorf("Failed to parse the config file: %v", err)
 	}
 
+	if kmsHeader != nil {
+		config.kmsURI = kmsHeader.KMS
+		config.kmsDataKey = kmsDataKey
+		config.kmsWrappedKey = kmsHeader.WrappedKey
+	}
+
 	storage.SetNestingLevels(config)
 
 	return config, false, nil
@@ -482,6 +537,16 @@ func UploadConfig(storage Storage, config *Config, password string, iterations i
 		masterKey = GenerateKeyFromPassword(password, salt, iterations)
 	}
 
+	var kmsHeader []byte
+	if config.kmsURI != "" {
+		var err error
+		masterKey, kmsHeader, err = config.wrapConfigKey(password, salt, iterations)
+		if err != nil {
+			LOG_ERROR("CONFIG_KMS", "Failed to wrap the storage key: %v", err)
+			return false
+		}
+	}
+
 	description, err := json.MarshalIndent(config, "", "    ")
 	if err != nil {
 		LOG_ERROR("CONFIG_MARSHAL", "Failed to marshal the config: %v", err)
@@ -493,7 +558,23 @@ func UploadConfig(storage Storage, config *Config, password string, iterations i
 	chunk := CreateChunk(CreateConfig(), true)
 	chunk.Write(description)
 
-	if len(password) > 0 {
+	if kmsHeader != nil {
+		err = chunk.Encrypt(masterKey, "", true)
+		if err != nil {
+			LOG_ERROR("CONFIG_CREATE", "Failed to create the config file: %v", err)
+			return false
+		}
+
+		// The format for config with a wrapped key is KMS_CONFIG_BANNER + header length + header + encrypted content
+		var encrypted bytes.Buffer
+		encrypted.Write([]byte(KMS_CONFIG_BANNER))
+		binary.Write(&encrypted, binary.LittleEndian, uint32(len(kmsHeader)))
+		encrypted.Write(kmsHeader)
+		encrypted.Write(chunk.GetBytes()[len(ENCRYPTION_BANNER):])
+
+		chunk.Reset(false)
+		chunk.Write(encrypted.Bytes())
+	} else if len(password) > 0 {
 		// Encrypt the config file with masterKey.  If masterKey is nil then no encryption is performed.
 		err = chunk.Encrypt(masterKey, "", true)
 		if err != nil {
@@ -543,6 +624,16 @@ func UploadConfig(storage Storage, config *Config, password string, iterations i
 // is enabled.
 func ConfigStorage(storage Storage, iterations int, compressionLevel int, averageChunkSize int, maximumChunkSize int,
 	minimumChunkSize int, password string, copyFrom *Config, bitCopy bool, keyFile string, dataShards int, parityShards int) bool {
+	return ConfigStorageWithKMS(storage, "", iterations, compressionLevel, averageChunkSize, maximumChunkSize,
+		minimumChunkSize, password, copyFrom, bitCopy, keyFile, dataShards, parityShards, false)
+}
+
+// ConfigStorageWithKMS is ConfigStorage with the master key wrapped by the key management service identified by kms
+// (see CreateKeyManagementService).  The storage is then encrypted even without a password.  If 'randomChunkKeys' is
+// true, chunks will be encrypted with random keys instead of keys derived from the chunk hashes.
+func ConfigStorageWithKMS(storage Storage, kms string, iterations int, compressionLevel int, averageChunkSize int,
+	maximumChunkSize int, minimumChunkSize int, password string, copyFrom *Config, bitCopy bool, keyFile string,
+	dataShards int, parityShards int, randomChunkKeys bool) bool {
 
 	exist, _, _, err := storage.GetFileInfo(0, "config")
 	if err != nil {
@@ -555,11 +646,12 @@ func ConfigStorage(storage Storage, iterations int, compressionLevel int, averag
 		return false
 	}
 
-	config := CreateConfigFromParameters(compressionLevel, averageChunkSize, maximumChunkSize, minimumChunkSize, len(password) > 0,
-		copyFrom, bitCopy)
+	config := CreateConfigFromParameters(compressionLevel, averageChunkSize, maximumChunkSize, minimumChunkSize,
+		len(password) > 0 || kms != "", copyFrom, bitCopy)
 	if config == nil {
 		return false
 	}
+	config.kmsURI = kms
 
 	if keyFile != "" {
 		config.loadRSAPublicKey(keyFile)
@@ -568,6 +660,14 @@ func ConfigStorage(storage Storage, iterations int, compressionLevel int, averag
 	config.DataShards = dataShards
 	config.ParityShards = parityShards
 
+	if randomChunkKeys {
+		if len(config.ChunkKey) == 0 {
+			LOG_ERROR("CONFIG_INIT", "Random chunk keys require the storage to be encrypted")
+			return false
+		}
+		config.RandomChunkKeys = true
+	}
+
 	return UploadConfig(storage, config, password, iterations)
 }
 
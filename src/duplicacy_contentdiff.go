@@ -0,0 +1,196 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aryann/difflib"
+)
+
+// Files larger than this are not reassembled for content diffs
+const maxContentDiffSize = 16 * 1024 * 1024
+
+// The number of unchanged lines shown around each change in a unified diff
+const unifiedDiffContext = 3
+
+// splitLines splits the content of a text file into lines, without the empty line after the final newline.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// isBinaryContent guesses whether the content is from a binary file by looking for a null byte near the beginning,
+// the same heuristic used by git.
+func isBinaryContent(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// formatUnifiedDiff returns the hunks of the unified diff between two lists of lines, each hunk with 'context'
+// unchanged lines before and after the changes.
+func formatUnifiedDiff(leftLines []string, rightLines []string, context int) []string {
+
+	records := difflib.Diff(leftLines, rightLines)
+
+	// The number of lines on each side before each record
+	leftBefore := make([]int, len(records)+1)
+	rightBefore := make([]int, len(records)+1)
+	for i, record := range records {
+		leftBefore[i+1], rightBefore[i+1] = leftBefore[i], rightBefore[i]
+		if record.Delta != difflib.RightOnly {
+			leftBefore[i+1]++
+		}
+		if record.Delta != difflib.LeftOnly {
+			rightBefore[i+1]++
+		}
+	}
+
+	var output []string
+	for i := 0; i < len(records); {
+		if records[i].Delta == difflib.Common {
+			i++
+			continue
+		}
+
+		// Extend the hunk until there are more than 2 * context unchanged lines after the last change
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(records) && j-end <= 2*context; j++ {
+			if records[j].Delta != difflib.Common {
+				end = j + 1
+			}
+		}
+		i = end
+		end += context
+		if end > len(records) {
+			end = len(records)
+		}
+
+		leftStart, leftCount := leftBefore[start], leftBefore[end]-leftBefore[start]
+		rightStart, rightCount := rightBefore[start], rightBefore[end]-rightBefore[start]
+		// Line numbers start from 1, except for an empty range where it is the line before the range
+		if leftCount > 0 {
+			leftStart++
+		}
+		if rightCount > 0 {
+			rightStart++
+		}
+		output = append(output, fmt.Sprintf("@@ -%d,%d +%d,%d @@", leftStart, leftCount, rightStart, rightCount))
+
+		for _, record := range records[start:end] {
+			switch record.Delta {
+			case difflib.Common:
+				output = append(output, " "+record.Payload)
+			case difflib.LeftOnly:
+				output = append(output, "-"+record.Payload)
+			default:
+				output = append(output, "+"+record.Payload)
+			}
+		}
+	}
+	return output
+}
+
+// readFileContent returns the content of the file in the snapshot, or in the repository if the snapshot was created
+// from the repository directory.
+func (manager *SnapshotManager) readFileContent(top string, snapshot *Snapshot, file *Entry) ([]byte, bool) {
+	if snapshot.Revision == 0 {
+		content, err := ioutil.ReadFile(joinRootPath(top, file.Path))
+		if err != nil {
+			LOG_WARN("SNAPSHOT_DIFF", "Failed to read %s from the repository: %v", file.Path, err)
+			return nil, false
+		}
+		return content, true
+	}
+
+	var content []byte
+	if !manager.RetrieveFile(snapshot, file, func(chunk []byte) { content = append(content, chunk...) }) {
+		LOG_WARN("SNAPSHOT_DIFF", "File %s is corrupted in snapshot %s at revision %d", file.Path, snapshot.ID,
+			snapshot.Revision)
+		return nil, false
+	}
+	return content, true
+}
+
+// describeRevision returns the label of the snapshot in the headers of a unified diff.
+func describeRevision(snapshot *Snapshot) string {
+	if snapshot == nil || snapshot.Revision == 0 {
+		return "(repository)"
+	}
+	return fmt.Sprintf("(revision %d)", snapshot.Revision)
+}
+
+// printUnifiedDiff prints the unified diff between two versions of a file, or a note if the file is binary.  The
+// lines are logged with the id SNAPSHOT_CONTENT_DIFF, or output as a single "diff" record in the JSON mode.
+func printUnifiedDiff(filePath string, leftSnapshot *Snapshot, leftContent []byte, rightSnapshot *Snapshot,
+	rightContent []byte) {
+
+	diff := &JSONContentDiff{
+		Path:  filePath,
+		Left:  describeRevision(leftSnapshot),
+		Right: describeRevision(rightSnapshot),
+	}
+	if isBinaryContent(leftContent) || isBinaryContent(rightContent) {
+		diff.Binary = true
+	} else {
+		diff.Lines = formatUnifiedDiff(splitLines(leftContent), splitLines(rightContent), unifiedDiffContext)
+		if len(diff.Lines) == 0 {
+			return
+		}
+	}
+	emitContentDiff(diff)
+}
+
+// emitContentDiff outputs the differences of a file.
+func emitContentDiff(diff *JSONContentDiff) {
+	if IsJSONOutput() {
+		EmitJSONRecord("diff", diff)
+		return
+	}
+
+	if diff.Binary {
+		LOG_INFO("SNAPSHOT_CONTENT_DIFF", "Binary file %s differs", diff.Path)
+	} else if diff.TooLarge {
+		LOG_INFO("SNAPSHOT_CONTENT_DIFF", "File %s is too large to show the differences", diff.Path)
+	} else {
+		LOG_INFO("SNAPSHOT_CONTENT_DIFF", "--- %s\t%s", diff.Path, diff.Left)
+		LOG_INFO("SNAPSHOT_CONTENT_DIFF", "+++ %s\t%s", diff.Path, diff.Right)
+		for _, line := range diff.Lines {
+			LOG_INFO("SNAPSHOT_CONTENT_DIFF", "%s", line)
+		}
+	}
+}
+
+// showContentDiff prints the unified diff between the two versions of a changed file.
+func (manager *SnapshotManager) showContentDiff(top string, leftSnapshot *Snapshot, left *Entry,
+	rightSnapshot *Snapshot, right *Entry) {
+
+	if left.Size > maxContentDiffSize || right.Size > maxContentDiffSize {
+		emitContentDiff(&JSONContentDiff{Path: left.Path, Left: describeRevision(leftSnapshot),
+			Right: describeRevision(rightSnapshot), TooLarge: true})
+		return
+	}
+
+	leftContent, ok := manager.readFileContent(top, leftSnapshot, left)
+	if !ok {
+		return
+	}
+	rightContent, ok := manager.readFileContent(top, rightSnapshot, right)
+	if !ok {
+		return
+	}
+	printUnifiedDiff(left.Path, leftSnapshot, leftContent, rightSnapshot, rightContent)
+}
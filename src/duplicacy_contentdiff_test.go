@@ -0,0 +1,104 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+
+	if lines := splitLines([]byte("a\nb\n")); len(lines) != 2 {
+		t.Errorf("'a\\nb\\n' is split into %d lines", len(lines))
+	}
+	if lines := splitLines(nil); len(lines) != 0 {
+		t.Errorf("An empty file is split into %d lines", len(lines))
+	}
+	if !isBinaryContent([]byte("a\x00b")) || isBinaryContent([]byte("text\n")) {
+		t.Errorf("Binary content is not detected correctly")
+	}
+
+	var left []string
+	for i := 1; i <= 20; i++ {
+		left = append(left, string(rune('a'+i-1)))
+	}
+	right := append([]string{}, left...)
+	right[1] = "B"
+	right[3] = "D"
+	right = append(right[:17], right[18:]...)
+
+	testCases := []struct {
+		left     []string
+		right    []string
+		expected string
+	}{
+		{left, left, ""},
+		{left, right, "@@ -1,7 +1,7 @@| a|-b|+B| c|-d|+D| e| f| g|@@ -15,6 +15,5 @@| o| p| q|-r| s| t"},
+		{nil, []string{"x"}, "@@ -0,0 +1,1 @@|+x"},
+		{[]string{"x"}, nil, "@@ -1,1 +0,0 @@|-x"},
+	}
+
+	for i, test := range testCases {
+		output := strings.Join(formatUnifiedDiff(test.left, test.right, 3), "|")
+		if output != test.expected {
+			t.Errorf("Test case %d: the diff is %s instead of %s", i, output, test.expected)
+		}
+	}
+}
+
+func TestContentDiffOutput(t *testing.T) {
+
+	SetLoggingLevel(INFO)
+
+	var buffer bytes.Buffer
+	SetLogOutput(&buffer)
+
+	// logf only writes to the output when not running under a test
+	setTestingT(nil)
+	defer func() {
+		setTestingT(t)
+		SetLogOutput(os.Stdout)
+		jsonOutput = false
+		jsonCommand = ""
+	}()
+
+	// The diff goes to the log output rather than the standard output
+	leftSnapshot := &Snapshot{Revision: 1}
+	printUnifiedDiff("file", leftSnapshot, []byte("a\nb\n"), nil, []byte("a\nc\n"))
+	expected := "--- file\t(revision 1)\n+++ file\t(repository)\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n"
+	if buffer.String() != expected {
+		t.Errorf("The diff is written as '%s'", buffer.String())
+	}
+
+	// In the JSON mode each file becomes a single record
+	buffer.Reset()
+	EnableJSONOutput("diff")
+	printUnifiedDiff("file", leftSnapshot, []byte("a\nb\n"), nil, []byte("a\nc\n"))
+	printUnifiedDiff("binary", leftSnapshot, []byte("a\x00"), nil, []byte("b\x00"))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d records were written: %s", len(lines), buffer.String())
+	}
+	var records [2]struct {
+		Type string          `json:"type"`
+		Data JSONContentDiff `json:"data"`
+	}
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatalf("'%s' is not a valid JSON record: %v", line, err)
+		}
+	}
+	if records[0].Type != "diff" || records[0].Data.Path != "file" || records[0].Data.Left != "(revision 1)" ||
+		strings.Join(records[0].Data.Lines, "|") != "@@ -1,2 +1,2 @@| a|-b|+c" {
+		t.Errorf("The diff was written as %s", lines[0])
+	}
+	if records[1].Type != "diff" || !records[1].Data.Binary || len(records[1].Data.Lines) != 0 {
+		t.Errorf("The binary diff was written as %s", lines[1])
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// copyProgressFile is the file in the snapshot cache of the destination storage that records the progress of a
+// copy, so that an interrupted copy of the same revisions can resume without listing the destination again.
+var copyProgressFile = "copy_progress"
+
+// copyProgress keeps track of the chunks a copy still has to copy.  It is saved when the copy starts and then
+// periodically, at the checkpoint interval of backups, as the chunks are copied.
+type copyProgress struct {
+	Revisions []string `json:"revisions"` // The revisions being copied, as 'id:revision'
+	Chunks    []string `json:"chunks"`    // The hashes of the chunks that were missing from the destination
+	Copied    []string `json:"copied"`    // The hashes of those chunks that have been copied since
+
+	interval time.Duration
+	lock     sync.Mutex
+	copied   map[string]bool
+	lastSave time.Time
+	saving   bool
+}
+
+// getCopyRevisions returns the revisions of the snapshots to be copied in the format used by copyProgress.
+func getCopyRevisions(snapshots []*Snapshot, revisionMap map[string]map[int]bool) (revisions []string) {
+	for _, snapshot := range snapshots {
+		if revisionMap[snapshot.ID][snapshot.Revision] {
+			revisions = append(revisions, fmt.Sprintf("%s:%d", snapshot.ID, snapshot.Revision))
+		}
+	}
+	return revisions
+}
+
+// createCopyProgress starts recording the progress of copying 'chunks' for the revisions.
+func createCopyProgress(revisions []string, chunks []string) *copyProgress {
+	checkpoint := createBackupCheckpoint()
+	return &copyProgress{
+		Revisions: revisions,
+		Chunks:    chunks,
+		interval:  checkpoint.interval,
+		copied:    make(map[string]bool),
+		lastSave:  time.Now(),
+	}
+}
+
+// loadCopyProgress returns the progress of an interrupted copy of the same revisions, or nil if there is none.
+func (manager *SnapshotManager) loadCopyProgress(revisions []string) *copyProgress {
+	if manager.snapshotCache == nil {
+		return nil
+	}
+
+	manager.fileChunk.Reset(false)
+	err := manager.snapshotCache.DownloadFile(0, copyProgressFile, manager.fileChunk)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("COPY_PROGRESS", "Failed to load the progress of the last copy: %v", err)
+		}
+		return nil
+	}
+
+	var saved copyProgress
+	err = json.Unmarshal(manager.fileChunk.GetBytes(), &saved)
+	if err != nil {
+		LOG_WARN("COPY_PROGRESS", "Failed to parse the progress of the last copy: %v", err)
+		return nil
+	}
+
+	if len(saved.Revisions) != len(revisions) {
+		return nil
+	}
+	for i := range revisions {
+		if saved.Revisions[i] != revisions[i] {
+			return nil
+		}
+	}
+
+	progress := createCopyProgress(saved.Revisions, saved.Chunks)
+	for _, chunkHash := range saved.Copied {
+		progress.copied[chunkHash] = true
+	}
+	return progress
+}
+
+// getRemainingChunks returns the chunks that have yet to be copied.
+func (progress *copyProgress) getRemainingChunks() (chunks []string) {
+	for _, chunkHash := range progress.Chunks {
+		if !progress.copied[chunkHash] {
+			chunks = append(chunks, chunkHash)
+		}
+	}
+	return chunks
+}
+
+// chunkCopied is called by the uploading threads after a chunk has been copied or found at the destination.  It
+// returns true if it is time to save the progress, in which case save must be called.
+func (progress *copyProgress) chunkCopied(chunkHash string) (due bool) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+
+	progress.copied[chunkHash] = true
+	if progress.saving || time.Since(progress.lastSave) < progress.interval {
+		return false
+	}
+	progress.saving = true
+	return true
+}
+
+// save writes the progress to the snapshot cache.  Failing to save it is not an error; the copy will only have to
+// list the destination again if it is interrupted.
+func (progress *copyProgress) save(manager *SnapshotManager) {
+	if manager.snapshotCache == nil {
+		return
+	}
+
+	progress.lock.Lock()
+	progress.Copied = make([]string, 0, len(progress.copied))
+	for chunkHash := range progress.copied {
+		progress.Copied = append(progress.Copied, chunkHash)
+	}
+	numberOfCopied := len(progress.Copied)
+	description, err := json.Marshal(progress)
+	progress.lock.Unlock()
+
+	if err == nil {
+		err = manager.snapshotCache.UploadFile(0, copyProgressFile, description)
+	}
+	if err != nil {
+		LOG_WARN("COPY_PROGRESS", "Failed to save the progress of the copy: %v", err)
+	} else {
+		LOG_DEBUG("COPY_PROGRESS", "Saved the progress of the copy: %d of %d chunks copied", numberOfCopied,
+			len(progress.Chunks))
+	}
+
+	progress.lock.Lock()
+	progress.saving = false
+	progress.lastSave = time.Now()
+	progress.lock.Unlock()
+}
+
+// removeCopyProgress deletes the progress once the copy has completed.
+func (manager *SnapshotManager) removeCopyProgress() {
+	if manager.snapshotCache == nil {
+		return
+	}
+	err := manager.snapshotCache.DeleteFile(0, copyProgressFile)
+	if err != nil && !os.IsNotExist(err) {
+		LOG_WARN("COPY_PROGRESS", "Failed to remove the progress of the copy: %v", err)
+	}
+}
+
+// SetSkipExistingVerify makes the copy trust the listing of the destination storage, or the recorded progress of
+// an interrupted copy, and upload the chunks missing from it without first looking each one up in the destination
+// storage.  A chunk copied after the progress was last saved may then be uploaded again, which is harmless.
+func (manager *BackupManager) SetSkipExistingVerify(skip bool) {
+	manager.skipExistingVerify = skip
+}
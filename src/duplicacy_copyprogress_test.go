@@ -0,0 +1,115 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestCopyProgress(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "copyprogress")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+	createRandomFile(joinPath(repository, "file2"), 100000)
+	if !backupManager.Backup(repository, true, threads, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+
+	otherStorage, err := loadStorage(filepath.Join(testDir, "other"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create the other storage: %v", err)
+	}
+	cleanStorage(otherStorage)
+	if !ConfigStorage(otherStorage, 16384, 100, 16*1024, 64*1024, 4*1024, "", backupManager.config, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the other storage")
+	}
+	otherManager := CreateBackupManager("host1", otherStorage, testDir, "", "", "", false)
+	otherManager.SetupSnapshotCache("other")
+
+	countChunks := func() (count int) {
+		files, _ := otherManager.SnapshotManager.ListAllFiles(otherStorage, "chunks/")
+		for _, file := range files {
+			if !strings.HasSuffix(file, "/") {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Chunks missing from the listing are uploaded without being looked up first
+	backupManager.SetSkipExistingVerify(true)
+	if !backupManager.CopySnapshots(otherManager, "host1", []int{1}, threads, threads) {
+		t.Fatalf("Failed to copy the first revision")
+	}
+	if !otherManager.SnapshotManager.CheckSnapshots("host1", []int{1}, "", false, false, true, false, false, false,
+		threads, false) {
+		t.Errorf("The copied revision failed the check")
+	}
+	if otherManager.SnapshotManager.loadCopyProgress([]string{"host1:1"}) != nil {
+		t.Errorf("The progress of the completed copy was not removed")
+	}
+	numberOfChunks := countChunks()
+
+	// An interrupted copy of the second revision that had already copied every chunk it found missing
+	progress := createCopyProgress([]string{"host1:2"}, nil)
+	progress.save(otherManager.SnapshotManager)
+	if otherManager.SnapshotManager.loadCopyProgress([]string{"host1:1", "host1:2"}) != nil {
+		t.Errorf("The progress of a copy of other revisions was loaded")
+	}
+
+	// The copy is resumed without listing the destination, so no chunks are copied
+	backupManager.SetSkipExistingVerify(false)
+	if !backupManager.CopySnapshots(otherManager, "host1", []int{2}, threads, threads) {
+		t.Fatalf("Failed to resume the copy of the second revision")
+	}
+	if countChunks() != numberOfChunks {
+		t.Errorf("The resumed copy uploaded %d chunks", countChunks()-numberOfChunks)
+	}
+	if otherManager.SnapshotManager.loadCopyProgress([]string{"host1:2"}) != nil {
+		t.Errorf("The progress of the resumed copy was not removed")
+	}
+}
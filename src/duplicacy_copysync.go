@@ -0,0 +1,118 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+// isSameBackup returns true if the two snapshots with the same id and revision number were created by the same
+// backup, possibly copied, rather than by independent backups to the two storages.  The tags are not compared since
+// they can be changed after the backup.
+func isSameBackup(snapshot *Snapshot, otherSnapshot *Snapshot) bool {
+	if snapshot.StartTime != otherSnapshot.StartTime || snapshot.EndTime != otherSnapshot.EndTime ||
+		snapshot.FileSize != otherSnapshot.FileSize || snapshot.NumberOfFiles != otherSnapshot.NumberOfFiles {
+		return false
+	}
+
+	sequences := [][]string{snapshot.FileSequence, snapshot.ChunkSequence, snapshot.LengthSequence}
+	otherSequences := [][]string{otherSnapshot.FileSequence, otherSnapshot.ChunkSequence, otherSnapshot.LengthSequence}
+	for i := range sequences {
+		if len(sequences[i]) != len(otherSequences[i]) {
+			return false
+		}
+		for j := range sequences[i] {
+			if sequences[i][j] != otherSequences[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FindDivergentRevisions returns, for each snapshot id, the revisions that exist in both storages but were created
+// by different backups.  Copy skips a revision that already exists at the destination, so without this check a
+// divergent revision would never be copied in either direction.
+func (manager *BackupManager) FindDivergentRevisions(otherManager *BackupManager, snapshotID string,
+	revisionsToCheck []int) (divergent map[string][]int, err error) {
+
+	var snapshotIDs []string
+	if snapshotID != "" {
+		snapshotIDs = []string{snapshotID}
+	} else {
+		snapshotIDs, err = manager.SnapshotManager.ListSnapshotIDs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	requested := make(map[int]bool)
+	for _, revision := range revisionsToCheck {
+		requested[revision] = true
+	}
+
+	divergent = make(map[string][]int)
+	for _, id := range snapshotIDs {
+		revisions, err := manager.SnapshotManager.ListSnapshotRevisions(id)
+		if err != nil {
+			return nil, err
+		}
+		otherRevisions, err := otherManager.SnapshotManager.ListSnapshotRevisions(id)
+		if err != nil {
+			return nil, err
+		}
+
+		existing := make(map[int]bool)
+		for _, revision := range otherRevisions {
+			existing[revision] = true
+		}
+
+		for _, revision := range revisions {
+			if !existing[revision] || (len(requested) > 0 && !requested[revision]) {
+				continue
+			}
+			snapshot := manager.SnapshotManager.DownloadSnapshot(id, revision)
+			otherSnapshot := otherManager.SnapshotManager.DownloadSnapshot(id, revision)
+			if !isSameBackup(snapshot, otherSnapshot) {
+				divergent[id] = append(divergent[id], revision)
+			}
+		}
+	}
+	return divergent, nil
+}
+
+// SyncSnapshots copies the revisions missing from the other storage to it, and then the revisions missing from
+// this storage back from the other storage, so that two storages that are copies of each other and have both received
+// backups end up with the same revisions.  Revisions that exist in both storages but were created by different
+// backups are reported and left alone.
+func (manager *BackupManager) SyncSnapshots(otherManager *BackupManager, snapshotID string, revisionsToBeCopied []int,
+	uploadingThreads int, downloadingThreads int) bool {
+
+	divergent, err := manager.FindDivergentRevisions(otherManager, snapshotID, revisionsToBeCopied)
+	if err != nil {
+		LOG_ERROR("SYNC_LIST", "Failed to compare the revisions in the two storages: %v", err)
+		return false
+	}
+
+	LOG_INFO("SYNC_COPY", "Copying the revisions missing from the destination storage")
+	if !manager.CopySnapshots(otherManager, snapshotID, revisionsToBeCopied, uploadingThreads, downloadingThreads) {
+		return false
+	}
+
+	LOG_INFO("SYNC_COPY", "Copying the revisions missing from the source storage")
+	if !otherManager.CopySnapshots(manager, snapshotID, revisionsToBeCopied, uploadingThreads, downloadingThreads) {
+		return false
+	}
+
+	numberOfDivergent := 0
+	for id, revisions := range divergent {
+		for _, revision := range revisions {
+			LOG_WARN("SNAPSHOT_DIVERGENT", "Snapshot %s at revision %d was created by different backups in the "+
+				"two storages and was not copied", id, revision)
+			numberOfDivergent++
+		}
+	}
+	if numberOfDivergent > 0 {
+		LOG_WARN("SYNC_DIVERGENT", "%d revisions have diverged; delete one copy of each to have them synced",
+			numberOfDivergent)
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestSyncSnapshots(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "copysync")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+
+	otherStorage, err := loadStorage(filepath.Join(testDir, "other"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create the other storage: %v", err)
+	}
+	cleanStorage(otherStorage)
+	if !ConfigStorage(otherStorage, 16384, 100, 16*1024, 64*1024, 4*1024, "", backupManager.config, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the other storage")
+	}
+	otherManager := CreateBackupManager("host1", otherStorage, testDir, "", "", "", false)
+	otherManager.SetupSnapshotCache("other")
+	if !backupManager.CopySnapshots(otherManager, "host1", nil, threads, threads) {
+		t.Fatalf("Failed to copy the first revision")
+	}
+
+	// Both storages receive a revision 2 from different backups, and only the first one a revision 3
+	createRandomFile(joinPath(repository, "file2"), 100000)
+	if !backupManager.Backup(repository, true, threads, "", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+	createRandomFile(joinPath(repository, "file3"), 100000)
+	if !otherManager.Backup(repository, true, threads, "", false, false, 0, false) {
+		t.Fatalf("The backup to the other storage failed")
+	}
+	if !backupManager.Backup(repository, true, threads, "", false, false, 0, false) {
+		t.Fatalf("The third backup failed")
+	}
+
+	// Another repository backs up only to the other storage
+	host2Manager := CreateBackupManager("host2", otherStorage, testDir, "", "", "", false)
+	host2Manager.SetupSnapshotCache("other")
+	if !host2Manager.Backup(repository, true, threads, "", false, false, 0, false) {
+		t.Fatalf("The backup of host2 failed")
+	}
+
+	divergent, err := backupManager.FindDivergentRevisions(otherManager, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to find divergent revisions: %v", err)
+	}
+	if len(divergent) != 1 || fmt.Sprintf("%v", divergent["host1"]) != "[2]" {
+		t.Errorf("The divergent revisions are %v", divergent)
+	}
+
+	if !backupManager.SyncSnapshots(otherManager, "", nil, threads, threads) {
+		t.Fatalf("Failed to sync the two storages")
+	}
+
+	managers := []*BackupManager{backupManager, otherManager}
+	for i, manager := range managers {
+		revisions, _ := manager.SnapshotManager.ListSnapshotRevisions("host1")
+		if fmt.Sprintf("%v", revisions) != "[1 2 3]" {
+			t.Errorf("Storage %d has revisions %v of host1 after the sync", i, revisions)
+		}
+		revisions, _ = manager.SnapshotManager.ListSnapshotRevisions("host2")
+		if fmt.Sprintf("%v", revisions) != "[1]" {
+			t.Errorf("Storage %d has revisions %v of host2 after the sync", i, revisions)
+		}
+	}
+
+	if !backupManager.SnapshotManager.CheckSnapshots("host2", []int{1}, "", false, false, true, false, false, false,
+		threads, false) {
+		t.Errorf("The revision copied back failed the check")
+	}
+	if !otherManager.SnapshotManager.CheckSnapshots("host1", []int{3}, "", false, false, true, false, false, false,
+		threads, false) {
+		t.Errorf("The revision copied to the other storage failed the check")
+	}
+
+	// The divergent revision is left as it is in both storages
+	if isSameBackup(backupManager.SnapshotManager.DownloadSnapshot("host1", 2),
+		otherManager.SnapshotManager.DownloadSnapshot("host1", 2)) {
+		t.Errorf("The divergent revision was copied")
+	}
+}
@@ -0,0 +1,716 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DaemonOptions configures the REST API served by RunDaemon.
+type DaemonOptions struct {
+	Address    string
+	Token      string // the token clients must send in the 'Authorization: Bearer' header
+	TokenFile  string // if Token is empty, a random token is generated and written to this file
+	Executable string // the duplicacy executable run with -json for each operation
+	Repository string // the directory where operations are run
+
+	// Called to get and set the upload rate limit applied to running operations (in kB/s, 0 for unlimited)
+	GetRateLimit func() (int, error)
+	SetRateLimit func(rate int) error
+}
+
+// DaemonCommands are the commands that can be started through the REST API.
+var DaemonCommands = []string{"backup", "restore", "check", "prune", "copy", "list", "history", "diff", "tag",
+	"annotate", "info", "benchmark"}
+
+// The number of log records kept for each operation
+var daemonLogSize = 100
+
+// The number of completed operations kept for their results to be queried; older ones are discarded
+var daemonOperationLimit = 100
+
+// The size of the longest record read from an operation; longer lines are skipped
+var daemonRecordSize = 16 * 1024 * 1024
+
+// How long running operations are given to save their state when the daemon shuts down before they are killed
+var daemonStopTimeout = 30 * time.Second
+
+// DaemonOperation is an operation started through the REST API, run as a separate duplicacy process whose JSON
+// records are parsed to track its progress and results.
+type DaemonOperation struct {
+	ID        int          `json:"id"`
+	Command   string       `json:"command"`
+	Arguments []string     `json:"arguments"`
+	State     string       `json:"state"` // running, succeeded, failed, or stopped
+	StartTime time.Time    `json:"start_time"`
+	EndTime   *time.Time   `json:"end_time,omitempty"`
+	Progress  string       `json:"progress,omitempty"` // the latest progress message
+	Error     string       `json:"error,omitempty"`
+	Result    interface{}  `json:"result,omitempty"` // the data of the result record, such as the backup statistics
+	Logs      []JSONRecord `json:"logs,omitempty"`
+	Records   []JSONRecord `json:"-"` // the records other than logs and progress, such as revisions listed
+
+	process *exec.Cmd
+	stopped bool
+	done    chan struct{}
+}
+
+// daemonServer serves the REST API.
+type daemonServer struct {
+	options    DaemonOptions
+	address    string // the address the server is bound to, which requests must be sent to
+	mutex      sync.Mutex
+	operations map[int]*DaemonOperation
+	nextID     int
+}
+
+func createDaemonServer(options DaemonOptions, address string) *daemonServer {
+	return &daemonServer{
+		options:    options,
+		address:    address,
+		operations: make(map[int]*DaemonOperation),
+		nextID:     1,
+	}
+}
+
+// writeDaemonResponse writes the value as the JSON body of the response.
+func writeDaemonResponse(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "    ")
+	encoder.Encode(value)
+}
+
+// writeDaemonError writes the error message as the JSON body of the response.
+func writeDaemonError(writer http.ResponseWriter, status int, format string, v ...interface{}) {
+	writeDaemonResponse(writer, status, map[string]string{"error": fmt.Sprintf(format, v...)})
+}
+
+// startOperation runs the command in a new process.  It returns when the process has started.
+func (server *daemonServer) startOperation(command string, arguments []string) (*DaemonOperation, error) {
+	process := exec.Command(server.options.Executable, append([]string{"-json", command}, arguments...)...)
+	process.Dir = server.options.Repository
+	var stderr bytes.Buffer
+	process.Stderr = &stderr
+	stdout, err := process.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = process.Start(); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	operation := &DaemonOperation{
+		ID:        server.nextID,
+		Command:   command,
+		Arguments: arguments,
+		State:     "running",
+		StartTime: time.Now(),
+		process:   process,
+		done:      make(chan struct{}),
+	}
+	server.operations[operation.ID] = operation
+	server.nextID++
+	server.mutex.Unlock()
+
+	LOG_INFO("DAEMON_OPERATION_START", "Operation %d started: %s %s", operation.ID, command, strings.Join(arguments, " "))
+
+	go func() {
+		server.readRecords(operation, stdout)
+		err := process.Wait()
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == WarningExitCode {
+			// Completed with skipped files; the result record tells if the operation succeeded
+			err = nil
+		}
+
+		server.mutex.Lock()
+		now := time.Now()
+		operation.EndTime = &now
+		if operation.stopped {
+			operation.State = "stopped"
+		} else if err != nil {
+			operation.State = "failed"
+			if operation.Error == "" {
+				operation.Error = strings.TrimSpace(stderr.String())
+			}
+			if operation.Error == "" {
+				operation.Error = err.Error()
+			}
+		} else if operation.State == "running" {
+			operation.State = "succeeded"
+		}
+		state := operation.State
+		server.pruneOperations()
+		server.mutex.Unlock()
+
+		LOG_INFO("DAEMON_OPERATION_END", "Operation %d %s", operation.ID, state)
+		close(operation.done)
+	}()
+
+	return operation, nil
+}
+
+// readRecords parses the JSON records written by the operation until it exits.
+func (server *daemonServer) readRecords(operation *DaemonOperation, stdout io.Reader) {
+	reader := bufio.NewReaderSize(stdout, 64*1024)
+	for {
+		line, tooLong, err := readDaemonLine(reader, daemonRecordSize)
+		if tooLong {
+			server.addRecord(operation, JSONRecord{Type: "log", Level: "WARN", ID: "DAEMON_RECORD",
+				Message: fmt.Sprintf("A record longer than %d bytes written by the operation was skipped", daemonRecordSize)})
+		} else if len(line) > 0 {
+			var record JSONRecord
+			if json.Unmarshal(line, &record) != nil {
+				// Not a record, such as a message from a library
+				record = JSONRecord{Type: "log", Level: "INFO", Message: string(line)}
+			}
+			server.addRecord(operation, record)
+		}
+
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			server.addRecord(operation, JSONRecord{Type: "log", Level: "ERROR", ID: "DAEMON_RECORD",
+				Message: fmt.Sprintf("Failed to read the output of the operation: %v", err)})
+			// Keep the process from blocking on writing its output
+			io.Copy(ioutil.Discard, stdout)
+			return
+		}
+	}
+}
+
+// readDaemonLine reads the next line without the line ending.  If the line is longer than 'limit', the rest of it is
+// discarded and 'tooLong' is true.
+func readDaemonLine(reader *bufio.Reader, limit int) (line []byte, tooLong bool, err error) {
+	for {
+		var fragment []byte
+		fragment, err = reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(fragment) > limit+len("\r\n") {
+			tooLong = true
+			line = nil
+		} else if !tooLong {
+			line = append(line, fragment...)
+		}
+		if err != bufio.ErrBufferFull {
+			return bytes.TrimRight(line, "\r\n"), tooLong, err
+		}
+	}
+}
+
+// addRecord updates the operation with a record it has written.
+func (server *daemonServer) addRecord(operation *DaemonOperation, record JSONRecord) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	switch record.Type {
+	case "progress":
+		operation.Progress = record.Message
+	case "log":
+		operation.Logs = append(operation.Logs, record)
+		if len(operation.Logs) > daemonLogSize {
+			operation.Logs = operation.Logs[len(operation.Logs)-daemonLogSize:]
+		}
+		if record.Level == "ERROR" || record.Level == "FATAL" {
+			operation.Error = record.Message
+		}
+	case "result":
+		if record.Success != nil && *record.Success {
+			operation.State = "succeeded"
+			operation.Result = record.Data
+		} else {
+			operation.State = "failed"
+			if failure, ok := record.Data.(map[string]interface{}); ok {
+				if message, ok := failure["message"].(string); ok && message != "" {
+					operation.Error = message
+				}
+			}
+		}
+	default:
+		operation.Records = append(operation.Records, record)
+	}
+}
+
+// pruneOperations discards the oldest completed operations beyond daemonOperationLimit.  The caller must hold the
+// lock.
+func (server *daemonServer) pruneOperations() {
+	var completed []int
+	for id, operation := range server.operations {
+		if operation.EndTime != nil {
+			completed = append(completed, id)
+		}
+	}
+	if len(completed) <= daemonOperationLimit {
+		return
+	}
+	sort.Ints(completed)
+	for _, id := range completed[:len(completed)-daemonOperationLimit] {
+		delete(server.operations, id)
+	}
+}
+
+// stopOperation interrupts the operation, which then saves its state as it does on Ctrl-C.
+func (server *daemonServer) stopOperation(operation *DaemonOperation) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if operation.EndTime != nil {
+		return fmt.Errorf("the operation has already completed")
+	}
+	operation.stopped = true
+	if runtime.GOOS == "windows" {
+		return operation.process.Process.Kill()
+	}
+	return operation.process.Process.Signal(os.Interrupt)
+}
+
+// stopOperations interrupts all running operations when the daemon shuts down, and kills those that haven't exited
+// after daemonStopTimeout.
+func (server *daemonServer) stopOperations() {
+	server.mutex.Lock()
+	var running []*DaemonOperation
+	for _, operation := range server.operations {
+		if operation.EndTime == nil {
+			running = append(running, operation)
+		}
+	}
+	server.mutex.Unlock()
+	if len(running) == 0 {
+		return
+	}
+
+	LOG_INFO("DAEMON_OPERATION_STOP", "Stopping %d running operations", len(running))
+	for _, operation := range running {
+		// An operation that has completed in the meantime needs no stopping
+		server.stopOperation(operation)
+	}
+
+	timeout := time.After(daemonStopTimeout)
+	expired := false
+	for _, operation := range running {
+		if !expired {
+			select {
+			case <-operation.done:
+				continue
+			case <-timeout:
+				expired = true
+			}
+		}
+		select {
+		case <-operation.done:
+		default:
+			LOG_WARN("DAEMON_OPERATION_STOP", "Operation %d is killed as it didn't stop in time", operation.ID)
+			operation.process.Process.Kill()
+			<-operation.done
+		}
+	}
+}
+
+// getOperation returns a copy of the operation that can be encoded without holding the lock.
+func (server *daemonServer) getOperation(id int) (DaemonOperation, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	operation, found := server.operations[id]
+	if !found {
+		return DaemonOperation{}, false
+	}
+	return copyDaemonOperation(operation), true
+}
+
+func copyDaemonOperation(operation *DaemonOperation) DaemonOperation {
+	result := *operation
+	result.Logs = append([]JSONRecord(nil), operation.Logs...)
+	result.Records = append([]JSONRecord(nil), operation.Records...)
+	return result
+}
+
+// runOperation runs the command to completion and returns its records, for the browsing requests.
+func (server *daemonServer) runOperation(command string, arguments []string) (DaemonOperation, error) {
+	operation, err := server.startOperation(command, arguments)
+	if err != nil {
+		return DaemonOperation{}, err
+	}
+	<-operation.done
+	// The operation may have been discarded already if many others have completed in the meantime
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return copyDaemonOperation(operation), nil
+}
+
+func (server *daemonServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if server.options.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(server.options.Token)) != 1 {
+		LOG_DEBUG("DAEMON_AUTH", "Unauthorized %s request for %s from %s", request.Method, request.URL.Path,
+			request.RemoteAddr)
+		writeDaemonError(writer, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Web pages can send requests to the daemon through the browser, or through a domain name resolving to the
+	// daemon's address, so requests must be sent to the bound address and not come from another origin
+	if !server.isDaemonHost(request.Host) {
+		LOG_DEBUG("DAEMON_HOST", "Rejected %s request for %s sent to %s", request.Method, request.URL.Path,
+			request.Host)
+		writeDaemonError(writer, http.StatusForbidden, "Invalid host %s", request.Host)
+		return
+	}
+	if origin := request.Header.Get("Origin"); origin != "" && origin != "http://"+request.Host {
+		LOG_DEBUG("DAEMON_ORIGIN", "Rejected %s request for %s from %s", request.Method, request.URL.Path, origin)
+		writeDaemonError(writer, http.StatusForbidden, "Invalid origin %s", origin)
+		return
+	}
+
+	// Unlike forms, requests with a JSON body can't be sent across origins without the browser asking first
+	if request.Method == http.MethodPost || request.Method == http.MethodPut {
+		contentType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+		if err != nil || contentType != "application/json" {
+			writeDaemonError(writer, http.StatusUnsupportedMediaType, "The request body must be application/json")
+			return
+		}
+	}
+
+	LOG_TRACE("DAEMON_REQUEST", "%s %s", request.Method, request.URL.Path)
+
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "api" {
+		writeDaemonError(writer, http.StatusNotFound, "Unknown path %s", request.URL.Path)
+		return
+	}
+
+	switch parts[1] {
+	case "status":
+		server.serveStatus(writer, request)
+	case "operations":
+		server.serveOperations(writer, request, parts[2:])
+	case "rate-limit":
+		server.serveRateLimit(writer, request)
+	case "snapshots":
+		server.serveSnapshots(writer, request, parts[2:])
+	default:
+		writeDaemonError(writer, http.StatusNotFound, "Unknown path %s", request.URL.Path)
+	}
+}
+
+// serveStatus handles GET /api/status.
+func (server *daemonServer) serveStatus(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writeDaemonError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	server.mutex.Lock()
+	running := []int{}
+	for id, operation := range server.operations {
+		if operation.EndTime == nil {
+			running = append(running, id)
+		}
+	}
+	server.mutex.Unlock()
+	sort.Ints(running)
+	writeDaemonResponse(writer, http.StatusOK, map[string]interface{}{
+		"repository": server.options.Repository,
+		"running":    running,
+	})
+}
+
+// serveOperations handles GET and POST /api/operations, GET /api/operations/<id>, and
+// POST /api/operations/<id>/stop.
+func (server *daemonServer) serveOperations(writer http.ResponseWriter, request *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch request.Method {
+		case http.MethodGet:
+			server.mutex.Lock()
+			operations := []DaemonOperation{}
+			for _, operation := range server.operations {
+				summary := copyDaemonOperation(operation)
+				summary.Logs = nil
+				operations = append(operations, summary)
+			}
+			server.mutex.Unlock()
+			sort.Slice(operations, func(i, j int) bool { return operations[i].ID < operations[j].ID })
+			writeDaemonResponse(writer, http.StatusOK, operations)
+		case http.MethodPost:
+			var body struct {
+				Command   string   `json:"command"`
+				Arguments []string `json:"arguments"`
+			}
+			if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+				writeDaemonError(writer, http.StatusBadRequest, "Invalid request: %v", err)
+				return
+			}
+			if !isDaemonCommand(body.Command) {
+				writeDaemonError(writer, http.StatusBadRequest, "Invalid command '%s'; must be one of %s", body.Command,
+					strings.Join(DaemonCommands, ", "))
+				return
+			}
+			if body.Arguments == nil {
+				body.Arguments = []string{}
+			}
+			operation, err := server.startOperation(body.Command, body.Arguments)
+			if err != nil {
+				writeDaemonError(writer, http.StatusInternalServerError, "Failed to start the operation: %v", err)
+				return
+			}
+			result, _ := server.getOperation(operation.ID)
+			writeDaemonResponse(writer, http.StatusCreated, result)
+		default:
+			writeDaemonError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	server.mutex.Lock()
+	operation := server.operations[id]
+	server.mutex.Unlock()
+	if err != nil || operation == nil {
+		writeDaemonError(writer, http.StatusNotFound, "No operation with id %s", parts[0])
+		return
+	}
+
+	if len(parts) == 1 && request.Method == http.MethodGet {
+		result, _ := server.getOperation(id)
+		writeDaemonResponse(writer, http.StatusOK, result)
+	} else if len(parts) == 2 && parts[1] == "stop" && request.Method == http.MethodPost {
+		if err := server.stopOperation(operation); err != nil {
+			writeDaemonError(writer, http.StatusConflict, "Failed to stop the operation: %v", err)
+			return
+		}
+		result, _ := server.getOperation(id)
+		writeDaemonResponse(writer, http.StatusOK, result)
+	} else {
+		writeDaemonError(writer, http.StatusNotFound, "Unknown path %s", request.URL.Path)
+	}
+}
+
+// isDaemonHost returns true if 'host', the Host header of a request, is the address the server is bound to.
+func (server *daemonServer) isDaemonHost(host string) bool {
+	return isBoundHost(server.address, host)
+}
+
+// isBoundHost returns true if 'host', the Host header of a request, is 'address', the address a server is bound to.
+// A loopback address can also be reached as localhost, and if the server listens on all addresses only the port must
+// match.
+func isBoundHost(address string, host string) bool {
+	boundHost, boundPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	requestHost, requestPort, err := net.SplitHostPort(host)
+	if err != nil || requestPort != boundPort {
+		return false
+	}
+
+	ip := net.ParseIP(boundHost)
+	if ip != nil && ip.IsUnspecified() {
+		return true
+	}
+	if requestHost == boundHost {
+		return true
+	}
+	return ip != nil && ip.IsLoopback() && strings.EqualFold(requestHost, "localhost")
+}
+
+// isLoopbackAddress returns true if a server listening on 'address' only accepts connections from this machine.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func isDaemonCommand(command string) bool {
+	for _, daemonCommand := range DaemonCommands {
+		if command == daemonCommand {
+			return true
+		}
+	}
+	return false
+}
+
+// serveRateLimit handles GET and PUT /api/rate-limit, with the body {"upload": <kB/s>}.
+func (server *daemonServer) serveRateLimit(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Upload int `json:"upload"`
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		if server.options.GetRateLimit == nil {
+			writeDaemonError(writer, http.StatusNotImplemented, "The dynamic rate limit is not available")
+			return
+		}
+		rate, err := server.options.GetRateLimit()
+		if err != nil {
+			writeDaemonError(writer, http.StatusInternalServerError, "Failed to get the rate limit: %v", err)
+			return
+		}
+		body.Upload = rate
+	case http.MethodPut:
+		if server.options.SetRateLimit == nil {
+			writeDaemonError(writer, http.StatusNotImplemented, "The dynamic rate limit is not available")
+			return
+		}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil || body.Upload < 0 {
+			writeDaemonError(writer, http.StatusBadRequest, "Invalid rate limit")
+			return
+		}
+		if err := server.options.SetRateLimit(body.Upload); err != nil {
+			writeDaemonError(writer, http.StatusInternalServerError, "Failed to set the rate limit: %v", err)
+			return
+		}
+		LOG_INFO("DAEMON_RATE_LIMIT", "The upload rate limit is set to %d kB/s", body.Upload)
+	default:
+		writeDaemonError(writer, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeDaemonResponse(writer, http.StatusOK, body)
+}
+
+// serveSnapshots handles GET /api/snapshots, which lists the revisions of the snapshot id given by the 'id' query
+// parameter (or all snapshot ids if 'all' is set), and GET /api/snapshots/<id>/<revision>, which lists the files in
+// the revision.  The 'storage' query parameter selects the storage.
+func (server *daemonServer) serveSnapshots(writer http.ResponseWriter, request *http.Request, parts []string) {
+	if request.Method != http.MethodGet || (len(parts) != 0 && len(parts) != 2) {
+		writeDaemonError(writer, http.StatusNotFound, "Unknown path %s", request.URL.Path)
+		return
+	}
+
+	query := request.URL.Query()
+	arguments := []string{}
+	if storage := query.Get("storage"); storage != "" {
+		arguments = append(arguments, "-storage", storage)
+	}
+
+	if len(parts) == 2 {
+		revision, err := strconv.Atoi(parts[1])
+		if err != nil || revision <= 0 {
+			writeDaemonError(writer, http.StatusBadRequest, "Invalid revision %s", parts[1])
+			return
+		}
+		arguments = append(arguments, "-id", parts[0], "-r", strconv.Itoa(revision), "-files")
+	} else if query.Get("all") != "" {
+		arguments = append(arguments, "-a")
+	} else if id := query.Get("id"); id != "" {
+		arguments = append(arguments, "-id", id)
+	}
+
+	operation, err := server.runOperation("list", arguments)
+	if err != nil {
+		writeDaemonError(writer, http.StatusInternalServerError, "Failed to list the snapshots: %v", err)
+		return
+	}
+	if operation.State != "succeeded" {
+		writeDaemonError(writer, http.StatusInternalServerError, "Failed to list the snapshots: %s", operation.Error)
+		return
+	}
+
+	if len(parts) == 2 {
+		files := []string{}
+		for _, record := range operation.Logs {
+			if record.ID == "SNAPSHOT_FILE" {
+				files = append(files, record.Message)
+			}
+		}
+		writeDaemonResponse(writer, http.StatusOK, files)
+		return
+	}
+
+	revisions := []interface{}{}
+	for _, record := range operation.Records {
+		if record.Type == "revision" {
+			revisions = append(revisions, record.Data)
+		}
+	}
+	writeDaemonResponse(writer, http.StatusOK, revisions)
+}
+
+// RunDaemon serves the REST API for starting and stopping operations, querying their progress and results, adjusting
+// the rate limit, and browsing snapshots, until the process is interrupted.  Operations still running then are stopped
+// as well.
+func RunDaemon(options DaemonOptions) bool {
+
+	listener, err := net.Listen("tcp", options.Address)
+	if err != nil {
+		LOG_ERROR("DAEMON_LISTEN", "Failed to listen on %s: %v", options.Address, err)
+		return false
+	}
+
+	if options.Token == "" {
+		options.Token, err = createDaemonToken(options.TokenFile)
+		if err != nil {
+			listener.Close()
+			LOG_ERROR("DAEMON_TOKEN", "Failed to create the token for accessing the REST API: %v", err)
+			return false
+		}
+		LOG_INFO("DAEMON_TOKEN", "Clients must send the token saved in %s", options.TokenFile)
+	}
+
+	daemon := createDaemonServer(options, listener.Addr().String())
+	server := &http.Server{Handler: daemon}
+	serverError := make(chan error, 1)
+	go func() { serverError <- server.Serve(listener) }()
+	// Operations are stopped after the server is closed, so that no new ones can start
+	defer daemon.stopOperations()
+	defer server.Close()
+
+	LOG_INFO("DAEMON_READY", "The REST API is available at http://%s/api/; press Ctrl-C to stop",
+		listener.Addr().String())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-signals:
+	case err = <-serverError:
+		LOG_ERROR("DAEMON_FAIL", "Failed to serve the REST API: %v", err)
+		return false
+	}
+
+	LOG_INFO("DAEMON_END", "The REST API is no longer served")
+	return true
+}
+
+// createDaemonToken generates a random token and writes it to 'path', readable only by the current user.
+func createDaemonToken(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("no token file is specified")
+	}
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buffer)
+	os.Remove(path)
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,300 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonServer(t *testing.T) {
+
+	setTestingT(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake executable is a shell script")
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "daemon")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	// A fake duplicacy that writes the records of a backup, or of a list command listing files
+	executable := filepath.Join(testDir, "duplicacy")
+	script := `#!/bin/sh
+if [ "$2" = "list" ]; then
+  echo '{"type":"log","level":"INFO","id":"SNAPSHOT_FILE","message":"100 2020-01-01 00:00:00 abcd dir/file1"}'
+  echo '{"type":"result","success":true}'
+  exit 0
+fi
+echo '{"type":"progress","level":"INFO","id":"UPLOAD_PROGRESS","message":"Uploaded chunk 1"}'
+echo '{"type":"log","level":"INFO","id":"BACKUP_END","message":"Backup for '"$PWD"' completed"}'
+echo '{"type":"result","command":"backup","success":true,"data":{"revision":7}}'
+`
+	if err := ioutil.WriteFile(executable, []byte(script), 0700); err != nil {
+		t.Fatalf("Failed to create the executable: %v", err)
+	}
+
+	rateLimit := 0
+	daemon := createDaemonServer(DaemonOptions{
+		Token:        "secret",
+		Executable:   executable,
+		Repository:   testDir,
+		GetRateLimit: func() (int, error) { return rateLimit, nil },
+		SetRateLimit: func(rate int) error { rateLimit = rate; return nil },
+	}, "")
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	daemon.address = server.Listener.Addr().String()
+
+	headers := map[string]string{}
+	send := func(method string, path string, token string, body string, value interface{}) int {
+		request, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		if method == "POST" || method == "PUT" {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		for name, value := range headers {
+			if name == "Host" {
+				request.Host = value
+			} else {
+				request.Header.Set(name, value)
+			}
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		defer response.Body.Close()
+		if value != nil {
+			json.NewDecoder(response.Body).Decode(value)
+		}
+		return response.StatusCode
+	}
+
+	if status := send("GET", "/api/status", "wrong", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("A request with the wrong token returned %d", status)
+	}
+
+	// Requests sent to another host name, such as one rebound to the daemon's address, or from a web page of another
+	// origin are rejected
+	headers["Host"] = "example.com:" + strings.Split(daemon.address, ":")[1]
+	if status := send("GET", "/api/status", "secret", "", nil); status != http.StatusForbidden {
+		t.Errorf("A request sent to another host returned %d", status)
+	}
+	delete(headers, "Host")
+	headers["Origin"] = "http://example.com"
+	if status := send("GET", "/api/status", "secret", "", nil); status != http.StatusForbidden {
+		t.Errorf("A request from another origin returned %d", status)
+	}
+	headers["Origin"] = "http://" + daemon.address
+	if status := send("GET", "/api/status", "secret", "", nil); status != http.StatusOK {
+		t.Errorf("A request from the same origin returned %d", status)
+	}
+	delete(headers, "Origin")
+
+	// Only JSON bodies are accepted, since web pages can send other types of bodies without the browser asking first
+	request, _ := http.NewRequest("POST", server.URL+"/api/operations", strings.NewReader(`{"command":"list"}`))
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("Content-Type", "text/plain")
+	if response, err := http.DefaultClient.Do(request); err != nil || response.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Starting an operation with a text body returned %v %v", response, err)
+	} else {
+		response.Body.Close()
+	}
+
+	if status := send("POST", "/api/operations", "secret", `{"command":"init"}`, nil); status != http.StatusBadRequest {
+		t.Errorf("Starting the init command returned %d", status)
+	}
+
+	var operation DaemonOperation
+	if status := send("POST", "/api/operations", "secret", `{"command":"backup","arguments":["-stats"]}`,
+		&operation); status != http.StatusCreated {
+		t.Fatalf("Starting the backup returned %d", status)
+	}
+
+	for i := 0; i < 100 && operation.State == "running"; i++ {
+		time.Sleep(100 * time.Millisecond)
+		send("GET", "/api/operations/1", "secret", "", &operation)
+	}
+	result, _ := operation.Result.(map[string]interface{})
+	if operation.State != "succeeded" || operation.Progress != "Uploaded chunk 1" || result["revision"] != float64(7) ||
+		len(operation.Logs) != 1 || !strings.Contains(operation.Logs[0].Message, testDir) {
+		t.Errorf("The operation is %+v", operation)
+	}
+
+	if status := send("POST", "/api/operations/1/stop", "secret", "", nil); status != http.StatusConflict {
+		t.Errorf("Stopping a completed operation returned %d", status)
+	}
+
+	var files []string
+	if status := send("GET", "/api/snapshots/host1/1", "secret", "", &files); status != http.StatusOK ||
+		len(files) != 1 || !strings.HasSuffix(files[0], "dir/file1") {
+		t.Errorf("Listing the files returned %d: %v", status, files)
+	}
+
+	var limit map[string]int
+	if status := send("PUT", "/api/rate-limit", "secret", `{"upload":2048}`, &limit); status != http.StatusOK ||
+		rateLimit != 2048 {
+		t.Errorf("Setting the rate limit returned %d and the rate limit is %d", status, rateLimit)
+	}
+	send("GET", "/api/rate-limit", "secret", "", &limit)
+	if limit["upload"] != 2048 {
+		t.Errorf("The rate limit is %v", limit)
+	}
+}
+
+func TestDaemonToken(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "daemontoken")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	tokenFile := filepath.Join(testDir, "daemon_token")
+	token, err := createDaemonToken(tokenFile)
+	if err != nil {
+		t.Fatalf("Failed to create the token: %v", err)
+	}
+	content, err := ioutil.ReadFile(tokenFile)
+	if err != nil || strings.TrimSpace(string(content)) != token || len(token) != 64 {
+		t.Errorf("The token file contains '%s' instead of '%s': %v", content, token, err)
+	}
+	if stat, err := os.Stat(tokenFile); err == nil && runtime.GOOS != "windows" && stat.Mode().Perm() != 0600 {
+		t.Errorf("The token file has the permissions %o", stat.Mode().Perm())
+	}
+	if another, _ := createDaemonToken(tokenFile); another == token {
+		t.Errorf("The same token was generated twice")
+	}
+
+	// A server without a token accepts no requests
+	server := httptest.NewServer(createDaemonServer(DaemonOptions{}, "127.0.0.1:0"))
+	defer server.Close()
+	response, err := http.Get(server.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("Failed to send the request: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("A request to a server without a token returned %d", response.StatusCode)
+	}
+}
+
+func TestDaemonOperations(t *testing.T) {
+
+	setTestingT(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake executable is a shell script")
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "daemonoperations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	// A fake duplicacy whose check writes a record too long to be read, whose backup saves its state and exits when
+	// interrupted, and whose prune ignores interrupts
+	executable := filepath.Join(testDir, "duplicacy")
+	script := `#!/bin/sh
+case "$2" in
+check)
+  printf '{"type":"log","level":"INFO","message":"%04000d"}\n' 0
+  echo '{"type":"log","level":"INFO","id":"CHECK_END","message":"All chunks exist"}'
+  echo '{"type":"result","success":true}'
+  ;;
+backup)
+  trap 'echo "{\"type\":\"log\",\"level\":\"INFO\",\"message\":\"interrupted\"}"; exit 1' INT
+  sleep 10 > /dev/null 2>&1 &
+  wait
+  ;;
+prune)
+  trap '' INT
+  sleep 10 > /dev/null 2>&1 &
+  wait; wait
+  ;;
+*)
+  echo '{"type":"result","success":true}'
+  ;;
+esac
+`
+	if err := ioutil.WriteFile(executable, []byte(script), 0700); err != nil {
+		t.Fatalf("Failed to create the executable: %v", err)
+	}
+
+	originalRecordSize, originalLimit, originalTimeout := daemonRecordSize, daemonOperationLimit, daemonStopTimeout
+	defer func() {
+		daemonRecordSize, daemonOperationLimit, daemonStopTimeout = originalRecordSize, originalLimit, originalTimeout
+	}()
+	daemonRecordSize = 1024
+	daemonOperationLimit = 2
+	daemonStopTimeout = 2 * time.Second
+
+	daemon := createDaemonServer(DaemonOptions{Executable: executable, Repository: testDir}, "127.0.0.1:0")
+
+	// A record that is too long is reported instead of ending the log of the operation
+	operation, err := daemon.runOperation("check", nil)
+	if err != nil {
+		t.Fatalf("Failed to run the operation: %v", err)
+	}
+	if operation.State != "succeeded" || len(operation.Logs) != 2 || operation.Logs[0].Level != "WARN" ||
+		operation.Logs[1].ID != "CHECK_END" {
+		t.Errorf("The operation is %+v", operation)
+	}
+
+	// Only the last completed operations are kept
+	for i := 0; i < 3; i++ {
+		if _, err := daemon.runOperation("list", nil); err != nil {
+			t.Fatalf("Failed to run the operation: %v", err)
+		}
+	}
+	daemon.mutex.Lock()
+	ids := []int{}
+	for id := range daemon.operations {
+		ids = append(ids, id)
+	}
+	daemon.mutex.Unlock()
+	sort.Ints(ids)
+	if fmt.Sprint(ids) != "[3 4]" {
+		t.Errorf("The operations kept are %v", ids)
+	}
+
+	// Running operations are stopped when the daemon shuts down, and killed if they don't exit in time
+	backup, err := daemon.startOperation("backup", nil)
+	if err != nil {
+		t.Fatalf("Failed to start the operation: %v", err)
+	}
+	prune, err := daemon.startOperation("prune", nil)
+	if err != nil {
+		t.Fatalf("Failed to start the operation: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	startTime := time.Now()
+	daemon.stopOperations()
+	if elapsed := time.Since(startTime); elapsed > 10*time.Second {
+		t.Errorf("Stopping the operations took %s", elapsed)
+	}
+	for _, operation := range []*DaemonOperation{backup, prune} {
+		result, found := daemon.getOperation(operation.ID)
+		if !found || result.State != "stopped" {
+			t.Errorf("The %s operation is %+v", result.Command, result)
+		}
+	}
+	if result, _ := daemon.getOperation(backup.ID); len(result.Logs) != 1 || result.Logs[0].Message != "interrupted" {
+		t.Errorf("The backup wasn't interrupted: %+v", result.Logs)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/trace"
+	"sync"
+	"time"
+)
+
+// The sampling rates of blocking events and mutex contention while the debug server is running, so that the block
+// and mutex profiles show where goroutines wait on the rate limiter, the chunk queues, and the locks around them.
+const (
+	debugBlockProfileRate     = 10000 // one sample per 10us spent blocked
+	debugMutexProfileFraction = 100   // one out of 100 contention events
+)
+
+// debugServer serves the pprof profiles and controls the execution trace.
+type debugServer struct {
+	traceLock  sync.Mutex
+	traceFile  *os.File // the file receiving the execution trace started by /debug/trace/start
+	traceStart time.Time
+}
+
+// StartDebugServer serves the net/http/pprof profiles at http://<address>/debug/pprof/ in the background, for
+// diagnosing performance problems on the machine where they happen.  An execution trace covering any part of a long
+// operation can be captured by requesting /debug/trace/start and later /debug/trace/stop, which returns the trace to
+// be opened by 'go tool trace'.  It returns the address actually listened on.
+func StartDebugServer(address string) (string, error) {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+
+	if host, _, err := net.SplitHostPort(address); err != nil || !net.ParseIP(host).IsLoopback() {
+		LOG_WARN("DEBUG_LISTEN", "Anyone who can connect to %s can read the memory and the command line of this "+
+			"process", listener.Addr().String())
+	}
+
+	runtime.SetBlockProfileRate(debugBlockProfileRate)
+	runtime.SetMutexProfileFraction(debugMutexProfileFraction)
+
+	server := &debugServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/trace/start", server.startTrace)
+	mux.HandleFunc("/debug/trace/stop", server.stopTrace)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		LOG_WARN("DEBUG_LISTEN", "The debug server stopped: %v", err)
+	}()
+
+	LOG_INFO("DEBUG_LISTEN", "Profiles are available at http://%s/debug/pprof/", listener.Addr().String())
+	return listener.Addr().String(), nil
+}
+
+// startTrace starts writing the execution trace to a temporary file.
+func (server *debugServer) startTrace(response http.ResponseWriter, request *http.Request) {
+	server.traceLock.Lock()
+	defer server.traceLock.Unlock()
+
+	if server.traceFile != nil {
+		http.Error(response, "The execution trace has already been started", http.StatusConflict)
+		return
+	}
+
+	file, err := ioutil.TempFile("", "duplicacy-trace-")
+	if err != nil {
+		http.Error(response, "Failed to create the trace file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = trace.Start(file); err != nil {
+		// Most likely a trace is being captured by /debug/pprof/trace
+		file.Close()
+		os.Remove(file.Name())
+		http.Error(response, "Failed to start the execution trace: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	server.traceFile = file
+	server.traceStart = time.Now()
+	LOG_INFO("DEBUG_TRACE", "Started the execution trace")
+	io.WriteString(response, "The execution trace has been started\n")
+}
+
+// stopTrace stops the execution trace and sends the trace file in the response.
+func (server *debugServer) stopTrace(response http.ResponseWriter, request *http.Request) {
+	server.traceLock.Lock()
+	defer server.traceLock.Unlock()
+
+	if server.traceFile == nil {
+		http.Error(response, "The execution trace has not been started", http.StatusConflict)
+		return
+	}
+
+	trace.Stop()
+	file := server.traceFile
+	server.traceFile = nil
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	LOG_INFO("DEBUG_TRACE", "Stopped the execution trace after %s", time.Since(server.traceStart).Round(time.Second))
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(response, "Failed to read the trace file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "application/octet-stream")
+	response.Header().Set("Content-Disposition", `attachment; filename="trace.out"`)
+	io.Copy(response, file)
+}
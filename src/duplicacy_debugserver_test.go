@@ -0,0 +1,52 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugServer(t *testing.T) {
+
+	setTestingT(t)
+
+	address, err := StartDebugServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start the debug server: %v", err)
+	}
+
+	get := func(path string) (int, string) {
+		response, err := http.Get("http://" + address + path)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", path, err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	if status, body := get("/debug/pprof/"); status != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("The pprof index returned %d: %s", status, body)
+	}
+	if status, _ := get("/debug/pprof/mutex"); status != http.StatusOK {
+		t.Errorf("The mutex profile returned %d", status)
+	}
+
+	if status, _ := get("/debug/trace/stop"); status != http.StatusConflict {
+		t.Errorf("Stopping the trace that wasn't started returned %d", status)
+	}
+	if status, body := get("/debug/trace/start"); status != http.StatusOK {
+		t.Fatalf("Starting the trace returned %d: %s", status, body)
+	}
+	if status, _ := get("/debug/trace/start"); status != http.StatusConflict {
+		t.Errorf("Starting the trace twice returned %d", status)
+	}
+	if status, body := get("/debug/trace/stop"); status != http.StatusOK || !strings.HasPrefix(body, "go ") {
+		t.Errorf("Stopping the trace returned %d with %d bytes", status, len(body))
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The table of the defaults file holding the defaults of preferences rather than options
+const defaultsPreferenceTable = "preferences"
+
+// DefaultOption is an option set by the defaults file.  The value is a string, an int64, a bool, or a slice of them.
+type DefaultOption struct {
+	Name  string
+	Value interface{}
+}
+
+// Defaults holds the options read from the defaults file, which lets hosts managed together share the same options
+// without wrapping every invocation.  Options outside of any table apply to the global options and to every command
+// that has them; options in a table named after a command apply to that command only.  Options given on the command
+// line and settings in the repository preferences take precedence.  The file is written in a subset of TOML:
+//
+//	threads = 4
+//	log = true
+//
+//	[backup]
+//	limit-rate = 2048
+//
+//	[preferences]
+//	filters = "/etc/duplicacy/filters"
+type Defaults struct {
+	Path   string
+	tables map[string]map[string]interface{}
+}
+
+// GetDefaultsFilePath returns the path of the defaults file, which is config.toml in the duplicacy directory under the
+// user configuration directory, unless the DUPLICACY_DEFAULTS_FILE environment variable is set.
+func GetDefaultsFilePath() string {
+	if path, found := os.LookupEnv("DUPLICACY_DEFAULTS_FILE"); found {
+		return path
+	}
+
+	configDirectory := os.Getenv("XDG_CONFIG_HOME")
+	if runtime.GOOS == "windows" {
+		configDirectory, _ = os.UserConfigDir()
+	} else if configDirectory == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configDirectory = filepath.Join(home, ".config")
+	}
+	if configDirectory == "" {
+		return ""
+	}
+	return filepath.Join(configDirectory, "duplicacy", "config.toml")
+}
+
+// LoadDefaults reads the defaults file.  It returns nil without an error if the file doesn't exist.
+func LoadDefaults(path string) (*Defaults, error) {
+	if path == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	tables, err := parseDefaults(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &Defaults{Path: path, tables: tables}, nil
+}
+
+// GetOptions returns the options in the table sorted by name; the table "" holds the options outside of any table.
+func (defaults *Defaults) GetOptions(table string) (options []DefaultOption) {
+	if defaults == nil {
+		return nil
+	}
+	for name, value := range defaults.tables[table] {
+		options = append(options, DefaultOption{Name: name, Value: value})
+	}
+	sort.Slice(options, func(i, j int) bool { return options[i].Name < options[j].Name })
+	return options
+}
+
+// GetTables returns the names of the tables in the file other than the one holding the preferences.
+func (defaults *Defaults) GetTables() (tables []string) {
+	if defaults == nil {
+		return nil
+	}
+	for table := range defaults.tables {
+		if table != "" && table != defaultsPreferenceTable {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// GetPreference returns the default of the preference with the given json name, or "" if it isn't set.
+func (defaults *Defaults) GetPreference(name string) string {
+	if defaults == nil {
+		return ""
+	}
+	if value, ok := defaults.tables[defaultsPreferenceTable][name].(string); ok {
+		return value
+	}
+	return ""
+}
+
+// GetArguments converts the option to command line arguments.  Every element of a list becomes a separate option.
+func (option DefaultOption) GetArguments() []string {
+	values, ok := option.Value.([]interface{})
+	if !ok {
+		values = []interface{}{option.Value}
+	}
+
+	var arguments []string
+	for _, value := range values {
+		switch value := value.(type) {
+		case bool:
+			arguments = append(arguments, fmt.Sprintf("-%s=%t", option.Name, value))
+		case int64:
+			arguments = append(arguments, "-"+option.Name, strconv.FormatInt(value, 10))
+		case string:
+			arguments = append(arguments, "-"+option.Name, value)
+		}
+	}
+	return arguments
+}
+
+// The default filters file, used when neither the preference nor the repository specifies one
+var defaultFiltersFile string
+
+// SetDefaultFiltersFile sets the filters file used by repositories without their own filters file.
+func SetDefaultFiltersFile(path string) {
+	defaultFiltersFile = path
+}
+
+// getFiltersFile returns the filters file to use given the one set by the preference, if any.  The one in the
+// preference comes first, then the one in the preference directory of the repository, and then the one from the
+// defaults file.
+func getFiltersFile(filtersFile string) string {
+	if filtersFile != "" {
+		return filtersFile
+	}
+	filtersFile = joinPath(GetDuplicacyPreferencePath(), "filters")
+	if defaultFiltersFile != "" {
+		if _, err := os.Stat(filtersFile); os.IsNotExist(err) {
+			return defaultFiltersFile
+		}
+	}
+	return filtersFile
+}
+
+// parseDefaults parses the subset of TOML used by the defaults file: tables, and keys set to strings, integers,
+// booleans, or single-line arrays of them.
+func parseDefaults(content string) (map[string]map[string]interface{}, error) {
+	tables := map[string]map[string]interface{}{"": {}}
+	table := ""
+
+	for number, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(stripDefaultsComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header %s", number+1, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			table = strings.Trim(table, `"`)
+			if _, found := tables[table]; found {
+				return nil, fmt.Errorf("line %d: table %s is defined twice", number+1, table)
+			}
+			tables[table] = make(map[string]interface{})
+			continue
+		}
+
+		equal := strings.Index(line, "=")
+		if equal <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", number+1)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:equal]), `"`)
+		if _, found := tables[table][key]; found {
+			return nil, fmt.Errorf("line %d: key %s is defined twice", number+1, key)
+		}
+
+		value, err := parseDefaultsValue(strings.TrimSpace(line[equal+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number+1, err)
+		}
+		tables[table][key] = value
+	}
+	return tables, nil
+}
+
+// stripDefaultsComment removes the comment at the end of the line, ignoring '#' inside quoted strings.
+func stripDefaultsComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote == 0 && line[i] == '#':
+			return line[:i]
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == '"' && line[i] == '\\':
+			i++
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+// parseDefaultsValue parses a string, an integer, a boolean, or an array of them.
+func parseDefaultsValue(text string) (interface{}, error) {
+	switch {
+	case text == "":
+		return nil, fmt.Errorf("missing value")
+	case text == "true" || text == "false":
+		return text == "true", nil
+	case strings.HasPrefix(text, `"`):
+		if len(text) < 2 || !strings.HasSuffix(text, `"`) {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		return text[1 : len(text)-1], nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("arrays must be on a single line")
+		}
+		var values []interface{}
+		for _, element := range splitDefaultsArray(text[1 : len(text)-1]) {
+			value, err := parseDefaultsValue(element)
+			if err != nil {
+				return nil, err
+			}
+			if _, isArray := value.([]interface{}); isArray {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	number, err := strconv.ParseInt(strings.Replace(text, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %s", text)
+	}
+	return number, nil
+}
+
+// splitDefaultsArray splits the elements of an array at the commas outside of quoted strings.
+func splitDefaultsArray(text string) (elements []string) {
+	quote := byte(0)
+	start := 0
+	for i := 0; i <= len(text); i++ {
+		if i == len(text) || (quote == 0 && text[i] == ',') {
+			if element := strings.TrimSpace(text[start:i]); element != "" {
+				elements = append(elements, element)
+			}
+			start = i + 1
+			continue
+		}
+		switch {
+		case quote == 0 && (text[i] == '"' || text[i] == '\''):
+			quote = text[i]
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote != 0 && text[i] == quote:
+			quote = 0
+		}
+	}
+	return elements
+}
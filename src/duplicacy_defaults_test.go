@@ -0,0 +1,76 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaults(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "defaults")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	defaultsPath := filepath.Join(testDir, "config.toml")
+
+	if defaults, err := LoadDefaults(defaultsPath); defaults != nil || err != nil {
+		t.Errorf("A missing defaults file was loaded as %v: %v", defaults, err)
+	}
+
+	content := `# defaults for all hosts
+threads = 4
+log = true  # log-style output
+suppress = ["STORAGE_SET", 'PACK_END', ]
+
+[backup]
+limit-rate = 1_024
+stats = false
+note = "weekly # 1 \"full\""
+
+[preferences]
+filters = '/etc/duplicacy/filters'
+`
+	ioutil.WriteFile(defaultsPath, []byte(content), 0600)
+	defaults, err := LoadDefaults(defaultsPath)
+	if err != nil {
+		t.Fatalf("Failed to load the defaults file: %v", err)
+	}
+
+	var arguments []string
+	for _, option := range defaults.GetOptions("") {
+		arguments = append(arguments, option.GetArguments()...)
+	}
+	if strings.Join(arguments, " ") != "-log=true -suppress STORAGE_SET -suppress PACK_END -threads 4" {
+		t.Errorf("The global defaults are %v", arguments)
+	}
+
+	arguments = nil
+	for _, option := range defaults.GetOptions("backup") {
+		arguments = append(arguments, option.GetArguments()...)
+	}
+	if strings.Join(arguments, "|") != `-limit-rate|1024|-note|weekly # 1 "full"|-stats=false` {
+		t.Errorf("The backup defaults are %v", arguments)
+	}
+
+	if tables := defaults.GetTables(); len(tables) != 1 || tables[0] != "backup" {
+		t.Errorf("The tables are %v", tables)
+	}
+	if filters := defaults.GetPreference("filters"); filters != "/etc/duplicacy/filters" {
+		t.Errorf("The default filters file is %s", filters)
+	}
+
+	for _, invalid := range []string{"threads", "threads = 4\nthreads = 8", "[backup\nstats = true", "note = \"open",
+		"suppress = [\"a\",\n\"b\"]", "threads = four", "[backup]\n[backup]"} {
+		if _, err := parseDefaults(invalid); err == nil {
+			t.Errorf("The invalid defaults file '%s' was parsed", invalid)
+		}
+	}
+}
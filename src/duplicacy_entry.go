@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -40,6 +41,8 @@ type Entry struct {
 	UID int
 	GID int
 
+	Device uint64 // the device number of a device node
+
 	StartChunk  int
 	StartOffset int
 	EndChunk    int
@@ -157,6 +160,13 @@ func (entry *Entry) UnmarshalJSON(description []byte) (err error) {
 		entry.Link = link
 	}
 
+	if value, ok = object["device"]; ok {
+		if _, ok = value.(float64); !ok {
+			return fmt.Errorf("Device is not a valid integer for file '%s' in the snapshot", entry.Path)
+		}
+		entry.Device = uint64(value.(float64))
+	}
+
 	entry.UID = -1
 	if value, ok = object["uid"]; ok {
 		if _, ok = value.(float64); ok {
@@ -234,6 +244,10 @@ func (entry *Entry) convertToObject(encodeName bool) map[string]interface{} {
 		object["link"] = entry.Link
 	}
 
+	if entry.IsSpecial() && entry.Device != 0 {
+		object["device"] = entry.Device
+	}
+
 	if entry.IsFile() && entry.Size > 0 {
 		object["content"] = fmt.Sprintf("%d:%d:%d:%d",
 			entry.StartChunk, entry.StartOffset, entry.EndChunk, entry.EndOffset)
@@ -271,6 +285,11 @@ func (entry *Entry) IsLink() bool {
 	return entry.Mode&uint32(os.ModeSymlink) != 0
 }
 
+// IsSpecial returns true if the entry is a named pipe, a socket, or a device node.
+func (entry *Entry) IsSpecial() bool {
+	return entry.Mode&uint32(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice) != 0
+}
+
 func (entry *Entry) GetPermissions() os.FileMode {
 	return os.FileMode(entry.Mode) & fileModeMask
 }
@@ -441,14 +460,57 @@ func (files FileInfoCompare) Less(i, j int) bool {
 	}
 }
 
+// The file marking a cache directory, as defined by the Cache Directory Tagging Specification
+// (https://bford.info/cachedir/).  It is only honored if it starts with CACHEDIR_TAG_SIGNATURE.
+var CACHEDIR_TAG = "CACHEDIR.TAG"
+var CACHEDIR_TAG_SIGNATURE = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// findMarkerFile returns the first of 'markerFiles' found among 'files', the content of the directory 'fullPath', or
+// an empty string if there is none.
+func findMarkerFile(fullPath string, files []os.FileInfo, markerFiles []string) string {
+	for _, markerFile := range markerFiles {
+		if markerFile == "" {
+			continue
+		}
+		// This binary search works because ioutil.ReadDir returns files sorted by Name() by default
+		ii := sort.Search(len(files), func(ii int) bool { return strings.Compare(files[ii].Name(), markerFile) >= 0 })
+		if ii >= len(files) || files[ii].Name() != markerFile {
+			continue
+		}
+		if markerFile == CACHEDIR_TAG && !isCacheDirectoryTag(joinPath(fullPath, markerFile)) {
+			LOG_DEBUG("LIST_CACHEDIR", "%s in %s does not have a valid signature", CACHEDIR_TAG, fullPath)
+			continue
+		}
+		return markerFile
+	}
+	return ""
+}
+
+// isCacheDirectoryTag returns true if the file starts with the signature required for a cache directory tag.
+func isCacheDirectoryTag(tagPath string) bool {
+	file, err := os.Open(tagPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	signature := make([]byte, len(CACHEDIR_TAG_SIGNATURE))
+	_, err = io.ReadFull(file, signature)
+	return err == nil && string(signature) == CACHEDIR_TAG_SIGNATURE
+}
+
 // ListEntries returns a list of entries representing file and subdirectories under the directory 'path'.  Entry paths
-// are normalized as relative to 'top'.  'patterns' are used to exclude or include certain files.
-func ListEntries(top string, path string, fileList *[]*Entry, patterns []string, nobackupFile string, discardAttributes bool, excludeByAttribute bool) (directoryList []*Entry,
+// are normalized as relative to 'top'.  'patterns' are used to exclude or include certain files.  Named pipes, sockets,
+// and device nodes are only included if 'specialFiles' is true.  Entries matched by 'ignoreRules', loaded from the
+// ignore files in 'path' and its parent directories, are excluded as well.  The directory is skipped entirely if it
+// contains any of 'markerFiles'.
+func ListEntries(top string, path string, fileList *[]*Entry, patterns []string, markerFiles []string, discardAttributes bool, excludeByAttribute bool,
+	specialFiles bool, ignoreRules IgnoreRules) (directoryList []*Entry,
 	skippedFiles []string, err error) {
 
 	LOG_DEBUG("LIST_ENTRIES", "Listing %s", path)
 
-	fullPath := joinPath(top, path)
+	fullPath := joinRootPath(top, path)
 
 	files := make([]os.FileInfo, 0, 1024)
 
@@ -457,13 +519,26 @@ func ListEntries(top string, path string, fileList *[]*Entry, patterns []string,
 		return directoryList, nil, err
 	}
 
-	// This binary search works because ioutil.ReadDir returns files sorted by Name() by default
-	if nobackupFile != "" {
-		ii := sort.Search(len(files), func(ii int) bool { return strings.Compare(files[ii].Name(), nobackupFile) >= 0 })
-		if ii < len(files) && files[ii].Name() == nobackupFile {
-			LOG_DEBUG("LIST_NOBACKUP", "%s is excluded due to nobackup file", path)
-			return directoryList, skippedFiles, nil
+	if markerFile := findMarkerFile(fullPath, files, markerFiles); markerFile != "" {
+		LOG_DEBUG("LIST_NOBACKUP", "%s is excluded due to the file %s", path, markerFile)
+		if traceFilters {
+			LOG_INFO("FILTER_TRACE", "%s: excluded by the file %s", path, markerFile)
+		}
+		return directoryList, skippedFiles, nil
+	}
+
+	// The source roots appear in the repository root in place of any files with the same names
+	if path == "" && len(sourceRoots) > 0 {
+		var roots []os.FileInfo
+		roots, skippedFiles = listSourceRoots()
+		for _, f := range files {
+			if isSourceRoot(f.Name()) {
+				LOG_WARN("LIST_ROOT", "%s in the repository is hidden by the source root with the same name", f.Name())
+			} else {
+				roots = append(roots, f)
+			}
 		}
+		files = roots
 	}
 
 	normalizedPath := path
@@ -485,12 +560,19 @@ func ListEntries(top string, path string, fileList *[]*Entry, patterns []string,
 			continue
 		}
 		entry := CreateEntryFromFileInfo(f, normalizedPath)
-		if len(patterns) > 0 && !MatchPath(entry.Path, patterns) {
+		if traceFilters {
+			_, reason := ExplainFilter(entry.Path, entry, patterns, ignoreRules)
+			LOG_INFO("FILTER_TRACE", "%s: %s", entry.Path, reason)
+		}
+		if len(patterns) > 0 && !MatchEntry(entry, patterns) {
+			continue
+		}
+		if len(ignoreRules) > 0 && ignoreRules.IsIgnored(entry.Path) {
 			continue
 		}
 		if entry.IsLink() {
 			isRegular := false
-			isRegular, entry.Link, err = Readlink(joinPath(top, entry.Path))
+			isRegular, entry.Link, err = Readlink(joinRootPath(top, entry.Path))
 			if err != nil {
 				LOG_WARN("LIST_LINK", "Failed to read the symlink %s: %v", entry.Path, err)
 				skippedFiles = append(skippedFiles, entry.Path)
@@ -500,7 +582,7 @@ func ListEntries(top string, path string, fileList *[]*Entry, patterns []string,
 			if isRegular {
 				entry.Mode ^= uint32(os.ModeSymlink)
 			} else if path == "" && (filepath.IsAbs(entry.Link) || filepath.HasPrefix(entry.Link, `\\`)) && !strings.HasPrefix(entry.Link, normalizedTop) {
-				stat, err := os.Stat(joinPath(top, entry.Path))
+				stat, err := os.Stat(joinRootPath(top, entry.Path))
 				if err != nil {
 					LOG_WARN("LIST_LINK", "Failed to read the symlink: %v", err)
 					skippedFiles = append(skippedFiles, entry.Path)
@@ -513,7 +595,7 @@ func ListEntries(top string, path string, fileList *[]*Entry, patterns []string,
 					// path from f.Name(); note that a "/" is append assuming a symbolic link is always a directory
 					newEntry.Path = filepath.Join(normalizedPath, f.Name()) + "/"
 				}
-				if len(patterns) > 0 && !MatchPath(newEntry.Path, patterns) {
+				if len(patterns) > 0 && !MatchEntry(newEntry, patterns) {
 					continue
 				}
 				entry = newEntry
@@ -530,9 +612,16 @@ func ListEntries(top string, path string, fileList *[]*Entry, patterns []string,
 		}
 
 		if f.Mode()&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice) != 0 {
-			LOG_WARN("LIST_SKIP", "Skipped non-regular file %s", entry.Path)
-			skippedFiles = append(skippedFiles, entry.Path)
-			continue
+			if !specialFiles {
+				LOG_WARN("LIST_SKIP", "Skipped non-regular file %s", entry.Path)
+				skippedFiles = append(skippedFiles, entry.Path)
+				continue
+			}
+			// The size of a device node is meaningless
+			entry.Size = 0
+			if f.Mode()&os.ModeDevice != 0 {
+				entry.Device = GetDeviceNumber(f)
+			}
 		}
 
 		entries = append(entries, entry)
@@ -177,7 +177,7 @@ func TestEntryList(t *testing.T) {
 		directory := directories[len(directories)-1]
 		directories = directories[:len(directories)-1]
 		entries = append(entries, directory)
-		subdirectories, _, err := ListEntries(testDir, directory.Path, &entries, nil, "", false, false)
+		subdirectories, _, err := ListEntries(testDir, directory.Path, &entries, nil, nil, false, false, false, nil)
 		if err != nil {
 			t.Errorf("ListEntries(%s, %s) returned an error: %s", testDir, directory.Path, err)
 		}
@@ -279,7 +279,7 @@ func TestEntryExcludeByAttribute(t *testing.T) {
 			directory := directories[len(directories)-1]
 			directories = directories[:len(directories)-1]
 			entries = append(entries, directory)
-			subdirectories, _, err := ListEntries(testDir, directory.Path, &entries, nil, "", false, excludeByAttribute)
+			subdirectories, _, err := ListEntries(testDir, directory.Path, &entries, nil, nil, false, excludeByAttribute, false, nil)
 			if err != nil {
 				t.Errorf("ListEntries(%s, %s) returned an error: %s", testDir, directory.Path, err)
 			}
@@ -327,3 +327,91 @@ func TestEntryExcludeByAttribute(t *testing.T) {
 	}
 
 }
+
+func TestEntrySpecialFiles(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("special files are not supported on Windows")
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	err := CreateSpecialFile(filepath.Join(testDir, "fifo"), CreateEntry("fifo", 0, 0, 0640|uint32(os.ModeNamedPipe)))
+	if err != nil {
+		t.Fatalf("Failed to create the named pipe: %v", err)
+	}
+	err = CreateSpecialFile(filepath.Join(testDir, "socket"), CreateEntry("socket", 0, 0, 0600|uint32(os.ModeSocket)))
+	if err != nil {
+		t.Fatalf("Failed to create the socket: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(testDir, "file"), []byte("content"), 0600)
+
+	for _, specialFiles := range []bool{false, true} {
+		var entries []*Entry
+		_, skipped, err := ListEntries(testDir, "", &entries, nil, nil, false, false, specialFiles, nil)
+		if err != nil {
+			t.Fatalf("ListEntries(%s) returned an error: %v", testDir, err)
+		}
+
+		expected := 1
+		if specialFiles {
+			expected = 3
+		}
+		if len(entries) != expected {
+			t.Errorf("%d entries listed with specialFiles = %t; expected %d", len(entries), specialFiles, expected)
+		}
+		if !specialFiles && len(skipped) != 2 {
+			t.Errorf("%d entries skipped; expected 2", len(skipped))
+		}
+
+		for _, entry := range entries {
+			if entry.Path != "file" && (!entry.IsSpecial() || entry.IsFile() || entry.Size != 0) {
+				t.Errorf("%s is not listed as a special file", entry.Path)
+			}
+		}
+	}
+
+	entry := CreateEntry("dev", 0, 0, 0600|uint32(os.ModeDevice|os.ModeCharDevice))
+	entry.Device = 0x0103
+	description, _ := entry.MarshalJSON()
+	newEntry := &Entry{}
+	err = newEntry.UnmarshalJSON(description)
+	if err != nil {
+		t.Fatalf("Failed to decode %s: %v", description, err)
+	}
+	if !newEntry.IsSpecial() || newEntry.Device != entry.Device {
+		t.Errorf("The device node %s was decoded as mode %o device %d", description, newEntry.Mode, newEntry.Device)
+	}
+
+	os.RemoveAll(testDir)
+}
+
+func TestEntryMarkerFiles(t *testing.T) {
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+
+	for _, file := range []string{"cache/a", "fake/b", "scratch/c", "keep/d"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(testDir, file)), 0700)
+		ioutil.WriteFile(filepath.Join(testDir, file), []byte(file), 0600)
+	}
+	ioutil.WriteFile(filepath.Join(testDir, "cache", CACHEDIR_TAG), []byte(CACHEDIR_TAG_SIGNATURE+"\n"), 0600)
+	ioutil.WriteFile(filepath.Join(testDir, "fake", CACHEDIR_TAG), []byte("no signature"), 0600)
+	ioutil.WriteFile(filepath.Join(testDir, "scratch", ".nobackup"), []byte{}, 0600)
+
+	for directory, excluded := range map[string]bool{"cache": true, "fake": false, "scratch": true, "keep": false} {
+		var entries []*Entry
+		_, _, err := ListEntries(testDir, directory, &entries, nil, []string{".nobackup", CACHEDIR_TAG}, false, false,
+			false, nil)
+		if err != nil {
+			t.Fatalf("ListEntries(%s, %s) returned an error: %v", testDir, directory, err)
+		}
+		if (len(entries) == 0) != excluded {
+			t.Errorf("%s: %d entries listed; excluded should be %t", directory, len(entries), excluded)
+		}
+	}
+
+	os.RemoveAll(testDir)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// The number of entries an entry list keeps in memory before moving them to a temporary file
+var entryListMemoryLimit = 100000
+
+// entryList holds the entries of a snapshot being created, in the order they are added.  Once there are more than
+// entryListMemoryLimit entries, all of them are written to a temporary file one json description per line, so that
+// the memory needed by a backup doesn't grow with the number of files in the repository.  Entries must not be
+// modified after they are added.
+type entryList struct {
+	entries []*Entry // all the entries if the list is still in memory
+	file    *os.File
+	writer  *bufio.Writer
+	length  int
+}
+
+// createEntryList creates an empty entry list.
+func createEntryList() *entryList {
+	return &entryList{}
+}
+
+// Len returns the number of entries added so far.
+func (list *entryList) Len() int {
+	return list.length
+}
+
+// Add appends 'entry' to the list.
+func (list *entryList) Add(entry *Entry) error {
+	if list.file == nil && len(list.entries) >= entryListMemoryLimit {
+		file, err := ioutil.TempFile("", "duplicacy_entries_")
+		if err != nil {
+			return fmt.Errorf("failed to create a temporary file for the file list: %v", err)
+		}
+		list.file = file
+		list.writer = bufio.NewWriterSize(file, 1024*1024)
+		for _, entry := range list.entries {
+			if err = list.write(entry); err != nil {
+				return err
+			}
+		}
+		list.entries = nil
+	}
+
+	list.length++
+	if list.file == nil {
+		list.entries = append(list.entries, entry)
+		return nil
+	}
+	return list.write(entry)
+}
+
+func (list *entryList) write(entry *Entry) error {
+	description, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode the entry %s: %v", entry.Path, err)
+	}
+	description = append(description, '\n')
+	if _, err = list.writer.Write(description); err != nil {
+		return fmt.Errorf("failed to write the file list to %s: %v", list.file.Name(), err)
+	}
+	return nil
+}
+
+// NewReader returns a reader of the entries added so far, which are not affected by entries added later, so the
+// reader may be used while the list is still being added to, as long as NewReader and Add aren't called at the same
+// time.
+func (list *entryList) NewReader() (*entryListReader, error) {
+	reader := &entryListReader{
+		entries:   list.entries,
+		remaining: list.length,
+	}
+	if list.file == nil {
+		return reader, nil
+	}
+
+	if err := list.writer.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write the file list to %s: %v", list.file.Name(), err)
+	}
+	file, err := os.Open(list.file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the file list %s: %v", list.file.Name(), err)
+	}
+	reader.file = file
+	reader.reader = bufio.NewReaderSize(file, 1024*1024)
+	return reader, nil
+}
+
+// Close removes the temporary file if there is one.
+func (list *entryList) Close() {
+	if list.file != nil {
+		list.file.Close()
+		os.Remove(list.file.Name())
+		list.file = nil
+	}
+	list.entries = nil
+}
+
+// entryListReader reads the entries of an entry list one at a time.
+type entryListReader struct {
+	entries   []*Entry
+	file      *os.File
+	reader    *bufio.Reader
+	remaining int
+}
+
+// Next returns the next entry, or nil after the last one.
+func (reader *entryListReader) Next() (*Entry, error) {
+	if reader.remaining == 0 {
+		return nil, nil
+	}
+	reader.remaining--
+
+	if reader.file == nil {
+		entry := reader.entries[0]
+		reader.entries = reader.entries[1:]
+		return entry, nil
+	}
+
+	description, err := reader.reader.ReadBytes('\n')
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the file list %s: %v", reader.file.Name(), err)
+	}
+	entry := &Entry{}
+	if err = json.Unmarshal(description, entry); err != nil {
+		return nil, fmt.Errorf("failed to decode the file list %s: %v", reader.file.Name(), err)
+	}
+	return entry, nil
+}
+
+// Close closes the temporary file of the list if it is read from there.
+func (reader *entryListReader) Close() {
+	if reader.file != nil {
+		reader.file.Close()
+		reader.file = nil
+	}
+}
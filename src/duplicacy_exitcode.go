@@ -0,0 +1,137 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The exit codes of the program.  Codes below 100 are set by commands that completed, or that were not run because
+// of invalid arguments; the others are set when a command fails.
+const (
+	SuccessExitCode         = 0
+	WarningExitCode         = 1 // completed, but some files or directories were skipped
+	CommandExitCode         = 2 // the command doesn't exist
+	ArgumentExitCode        = 3
+	duplicacyExitCode       = 100 // failed for a reason not covered by the codes below
+	otherExitCode           = 101 // failed because of an unexpected error, which is likely a bug
+	NothingToBackUpExitCode = 103
+	ConfigurationExitCode   = 104
+	StorageExitCode         = 105 // the storage could not be reached or accessed
+	IntegrityExitCode       = 106 // chunks or snapshots are missing or corrupted
+	LockedExitCode          = 107 // another operation holds the repository lock
+)
+
+// ExitCodeDescriptions documents every exit code; it is shown in the help.
+var ExitCodeDescriptions = []struct {
+	Code        int
+	Description string
+}{
+	{SuccessExitCode, "the command completed successfully"},
+	{WarningExitCode, "the command completed but some files or directories were skipped"},
+	{CommandExitCode, "the command doesn't exist"},
+	{ArgumentExitCode, "the arguments or options are invalid"},
+	{duplicacyExitCode, "the command failed"},
+	{otherExitCode, "the command failed because of an unexpected error"},
+	{InterruptedExitCode, "the command was interrupted"},
+	{NothingToBackUpExitCode, "there are no files to back up"},
+	{ConfigurationExitCode, "the repository or the storage is not configured correctly"},
+	{StorageExitCode, "the storage can't be reached or accessed"},
+	{IntegrityExitCode, "chunks or snapshots in the storage are missing or corrupted"},
+	{LockedExitCode, "another backup or prune is running in the repository"},
+}
+
+// The exit codes of the errors identified by their log ids.  Errors with other log ids exit with duplicacyExitCode,
+// unless a code has been set by SetExitCode.
+var errorExitCodes = map[string]int{
+	"SNAPSHOT_EMPTY": NothingToBackUpExitCode,
+
+	"PREFERENCE_PATH":        ConfigurationExitCode,
+	"PREFERENCE_OPEN":        ConfigurationExitCode,
+	"PREFERENCE_PARSE":       ConfigurationExitCode,
+	"PREFERENCE_NONE":        ConfigurationExitCode,
+	"PREFERENCE_INVALID":     ConfigurationExitCode,
+	"REPOSITORY_PATH":        ConfigurationExitCode,
+	"REPOSITORY_ERR":         ConfigurationExitCode,
+	"REPOSITORY_INIT":        ConfigurationExitCode,
+	"DOT_DUPLICACY_PATH":     ConfigurationExitCode,
+	"STORAGE_NONE":           ConfigurationExitCode,
+	"STORAGE_SET":            ConfigurationExitCode,
+	"STORAGE_NOT_CONFIGURED": ConfigurationExitCode,
+	"STORAGE_NESTING":        ConfigurationExitCode,
+	"STORAGE_FAILOVER":       ConfigurationExitCode,
+	"CONFIG_INCOMPATIBLE":    ConfigurationExitCode,
+	"RETENTION_INVALID":      ConfigurationExitCode,
+	"REGEX_ERROR":            ConfigurationExitCode,
+	"SNAPSHOT_FILTER":        ConfigurationExitCode,
+	"BACKUP_DISABLED":        ConfigurationExitCode,
+	"RESTORE_DISABLED":       ConfigurationExitCode,
+	"COPY_DISABLED":          ConfigurationExitCode,
+
+	"STORAGE_CREATE": StorageExitCode,
+	"STORAGE_CONFIG": StorageExitCode,
+	"UPLOAD_CHUNK":   StorageExitCode,
+	"DOWNLOAD_CHUNK": StorageExitCode,
+
+	"SNAPSHOT_CHECK":     IntegrityExitCode,
+	"SNAPSHOT_VERIFY":    IntegrityExitCode,
+	"SNAPSHOT_PARSE":     IntegrityExitCode,
+	"CHUNK_FIND":         IntegrityExitCode,
+	"CHUNK_DECRYPT":      IntegrityExitCode,
+	"CHECKSUM_MISMATCH":  IntegrityExitCode,
+	"BACKUP_VERIFY":      IntegrityExitCode,
+	"DOWNLOAD_CORRUPTED": IntegrityExitCode,
+	"DOWNLOAD_DECRYPT":   IntegrityExitCode,
+
+	"REPOSITORY_LOCKED": LockedExitCode,
+}
+
+var exitCode = SuccessExitCode
+var exitCodeLock sync.Mutex
+
+// SetExitCode records the outcome of the command when it can't be told from the log id of the error, or when the
+// command completes but shouldn't exit with SuccessExitCode.  Warnings don't replace errors, and only the first error
+// is recorded as it is usually the cause of the others.
+func SetExitCode(code int) {
+	exitCodeLock.Lock()
+	defer exitCodeLock.Unlock()
+	if exitCode >= duplicacyExitCode || (code < duplicacyExitCode && exitCode != SuccessExitCode) {
+		return
+	}
+	exitCode = code
+}
+
+// GetExitCode returns the exit code of a command that completed.
+func GetExitCode() int {
+	exitCodeLock.Lock()
+	defer exitCodeLock.Unlock()
+	return exitCode
+}
+
+// getErrorExitCode returns the exit code of a command that failed with the exception.
+func getErrorExitCode(exception *Exception) int {
+	if IsOperationCancelled() {
+		// The exception was caused by the cancellation, such as a chunk transfer that was stopped
+		return InterruptedExitCode
+	}
+	if code := GetExitCode(); code >= duplicacyExitCode {
+		return code
+	}
+	if code, found := errorExitCodes[exception.LogID]; found {
+		return code
+	}
+	return duplicacyExitCode
+}
+
+// GetExitCodeHelp returns the list of exit codes shown in the help.
+func GetExitCodeHelp() string {
+	var lines []string
+	for _, description := range ExitCodeDescriptions {
+		lines = append(lines, fmt.Sprintf("   %d\t%s", description.Code, description.Description))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
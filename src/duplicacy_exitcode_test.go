@@ -0,0 +1,49 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExitCodes(t *testing.T) {
+
+	setTestingT(t)
+
+	defer func() { exitCode = SuccessExitCode }()
+
+	exitCode = SuccessExitCode
+	if code := getErrorExitCode(&Exception{LogID: "STORAGE_CREATE"}); code != StorageExitCode {
+		t.Errorf("STORAGE_CREATE exits with %d", code)
+	}
+	if code := getErrorExitCode(&Exception{LogID: "SNAPSHOT_EMPTY"}); code != NothingToBackUpExitCode {
+		t.Errorf("SNAPSHOT_EMPTY exits with %d", code)
+	}
+	if code := getErrorExitCode(&Exception{LogID: "UNKNOWN_ERROR"}); code != duplicacyExitCode {
+		t.Errorf("An unknown error exits with %d", code)
+	}
+
+	// Warnings are kept until an error is recorded, and the first error wins
+	SetExitCode(WarningExitCode)
+	if code := GetExitCode(); code != WarningExitCode {
+		t.Errorf("The exit code is %d after skipping files", code)
+	}
+	if code := getErrorExitCode(&Exception{LogID: "PREFERENCE_PARSE"}); code != ConfigurationExitCode {
+		t.Errorf("PREFERENCE_PARSE exits with %d after a warning", code)
+	}
+	SetExitCode(IntegrityExitCode)
+	SetExitCode(StorageExitCode)
+	SetExitCode(WarningExitCode)
+	if code := getErrorExitCode(&Exception{LogID: "RESTORE_FAIL"}); code != IntegrityExitCode {
+		t.Errorf("RESTORE_FAIL exits with %d after a missing chunk", code)
+	}
+
+	help := GetExitCodeHelp()
+	if len(strings.Split(strings.TrimSpace(help), "\n")) != len(ExitCodeDescriptions) ||
+		!strings.Contains(help, "   102\tthe command was interrupted\n") {
+		t.Errorf("The exit codes are documented as:\n%s", help)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// The number of lines an external sorter keeps in memory before writing them to a sorted run file.  A line holding
+// a chunk id takes about 100 bytes in memory, so this caps each sorter at about 50MB.
+var externalSortRunSize = 500000
+
+// externalSorter sorts more lines than can be held in memory by writing sorted runs to temporary files and merging
+// them when the lines are read back.
+type externalSorter struct {
+	dir   string   // the temporary directory holding the run files
+	limit int      // the maximum number of lines kept in memory
+	lines []string // lines not yet written to a run file
+	runs  []string // paths of the run files
+}
+
+// createExternalSorter creates a sorter whose run files are saved in a new directory under 'tempDir'.
+func createExternalSorter(tempDir string) (*externalSorter, error) {
+	dir, err := ioutil.TempDir(tempDir, "duplicacy-sort")
+	if err != nil {
+		return nil, err
+	}
+	return &externalSorter{
+		dir:   dir,
+		limit: externalSortRunSize,
+	}, nil
+}
+
+// Add adds a line, which must not contain a newline.
+func (sorter *externalSorter) Add(line string) error {
+	sorter.lines = append(sorter.lines, line)
+	if len(sorter.lines) >= sorter.limit {
+		return sorter.flush()
+	}
+	return nil
+}
+
+// flush writes the lines in memory to a new run file.
+func (sorter *externalSorter) flush() error {
+	sort.Strings(sorter.lines)
+
+	runPath := path.Join(sorter.dir, fmt.Sprintf("%d", len(sorter.runs)))
+	file, err := os.OpenFile(runPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, line := range sorter.lines {
+		writer.WriteString(line)
+		writer.WriteByte('\n')
+	}
+	err = writer.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	sorter.runs = append(sorter.runs, runPath)
+	sorter.lines = sorter.lines[:0]
+	return nil
+}
+
+// Sorted returns the lines added so far in ascending order.  No more lines can be added afterwards.
+func (sorter *externalSorter) Sorted() (*sortedLines, error) {
+	if len(sorter.runs) == 0 {
+		sort.Strings(sorter.lines)
+		return &sortedLines{memory: sorter.lines}, nil
+	}
+
+	if len(sorter.lines) > 0 {
+		if err := sorter.flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	merged := &sortedLines{}
+	for _, runPath := range sorter.runs {
+		file, err := os.Open(runPath)
+		if err != nil {
+			merged.Close()
+			return nil, err
+		}
+		run := &sortedRun{file: file, scanner: bufio.NewScanner(file)}
+		merged.files = append(merged.files, file)
+		if run.advance() {
+			merged.runs = append(merged.runs, run)
+		} else if run.err != nil {
+			merged.Close()
+			return nil, run.err
+		}
+	}
+	heap.Init(&merged.runs)
+	return merged, nil
+}
+
+// Close removes the run files.
+func (sorter *externalSorter) Close() {
+	sorter.lines = nil
+	err := os.RemoveAll(sorter.dir)
+	if err != nil {
+		LOG_WARN("SORT_CLEANUP", "Failed to remove the temporary directory %s: %v", sorter.dir, err)
+	}
+}
+
+// sortedRun reads the lines from one run file.
+type sortedRun struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    string
+	err     error
+}
+
+func (run *sortedRun) advance() bool {
+	if run.scanner.Scan() {
+		run.line = run.scanner.Text()
+		return true
+	}
+	run.err = run.scanner.Err()
+	return false
+}
+
+// runHeap orders the runs by their current lines.
+type runHeap []*sortedRun
+
+func (runs runHeap) Len() int            { return len(runs) }
+func (runs runHeap) Less(i, j int) bool  { return runs[i].line < runs[j].line }
+func (runs runHeap) Swap(i, j int)       { runs[i], runs[j] = runs[j], runs[i] }
+func (runs *runHeap) Push(x interface{}) { *runs = append(*runs, x.(*sortedRun)) }
+func (runs *runHeap) Pop() interface{} {
+	old := *runs
+	run := old[len(old)-1]
+	*runs = old[:len(old)-1]
+	return run
+}
+
+// sortedLines iterates over the sorted lines, either from memory or by merging the run files.
+type sortedLines struct {
+	memory []string
+	runs   runHeap
+	files  []*os.File
+	err    error
+}
+
+// Next returns the next line, or false when there are no more lines or an error occurred.
+func (lines *sortedLines) Next() (string, bool) {
+	if lines.files == nil {
+		if len(lines.memory) == 0 {
+			return "", false
+		}
+		line := lines.memory[0]
+		lines.memory = lines.memory[1:]
+		return line, true
+	}
+
+	if len(lines.runs) == 0 {
+		return "", false
+	}
+	run := lines.runs[0]
+	line := run.line
+	if run.advance() {
+		heap.Fix(&lines.runs, 0)
+	} else {
+		if run.err != nil {
+			lines.err = run.err
+		}
+		heap.Pop(&lines.runs)
+	}
+	return line, true
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (lines *sortedLines) Err() error {
+	return lines.err
+}
+
+// Close closes the run files.
+func (lines *sortedLines) Close() {
+	for _, file := range lines.files {
+		file.Close()
+	}
+	lines.files = nil
+}
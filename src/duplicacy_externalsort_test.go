@@ -0,0 +1,120 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExternalSort(t *testing.T) {
+
+	setTestingT(t)
+
+	for _, runSize := range []int{1000, 7, 1} {
+		sorter, err := createExternalSorter(os.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create the sorter: %v", err)
+		}
+		sorter.limit = runSize
+
+		var expected []string
+		for i := 0; i < 100; i++ {
+			data := make([]byte, 8)
+			rand.Read(data)
+			line := hex.EncodeToString(data)
+			expected = append(expected, line)
+			if err = sorter.Add(line); err != nil {
+				t.Fatalf("Failed to add a line: %v", err)
+			}
+		}
+		// Duplicates must be kept
+		expected = append(expected, expected[0])
+		sorter.Add(expected[0])
+		sort.Strings(expected)
+
+		lines, err := sorter.Sorted()
+		if err != nil {
+			t.Fatalf("Failed to sort the lines: %v", err)
+		}
+		var sorted []string
+		for line, ok := lines.Next(); ok; line, ok = lines.Next() {
+			sorted = append(sorted, line)
+		}
+		if lines.Err() != nil {
+			t.Errorf("Failed to read the sorted lines: %v", lines.Err())
+		}
+		lines.Close()
+
+		if len(sorted) != len(expected) {
+			t.Errorf("%d lines were sorted instead of %d with a run size of %d", len(sorted), len(expected), runSize)
+		} else {
+			for i := range expected {
+				if sorted[i] != expected[i] {
+					t.Errorf("Line %d is %s instead of %s with a run size of %d", i, sorted[i], expected[i], runSize)
+					break
+				}
+			}
+		}
+
+		sorter.Close()
+		if _, err = os.Stat(sorter.dir); !os.IsNotExist(err) {
+			t.Errorf("The temporary directory %s was not removed", sorter.dir)
+		}
+	}
+}
+
+func TestCheckWithExternalSort(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	createTestSnapshot(snapshotManager, "repository1", 1, now-7200, now-3600, []string{chunkHash1, chunkHash2, chunkHash1}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-3600, now-60, []string{chunkHash2, chunkHash3}, "tag")
+	createTestSnapshot(snapshotManager, "repository2", 1, now-3600, now-60, []string{chunkHash3}, "tag")
+
+	externalSortRunSize = 2
+	defer func() { externalSortRunSize = 500000 }()
+
+	snapshotManager.SetLowMemoryCheck(true)
+	if !snapshotManager.CheckSnapshots("", nil, "", false, false, false, false, false, false, 1, false) {
+		t.Errorf("The check failed with all chunks present")
+	}
+
+	// Turning a chunk into a fossil makes it missing unless fossils are searched
+	chunkPath, _, _, _ := snapshotManager.storage.FindChunk(0, snapshotManager.config.GetChunkIDFromHash(chunkHash3), false)
+	snapshotManager.storage.MoveFile(0, chunkPath, chunkPath+".fsl")
+	if !snapshotManager.CheckSnapshots("", nil, "", false, false, false, false, true, false, 1, false) {
+		t.Errorf("The check failed with a fossil")
+	}
+
+	// The error is expected so it must not fail the test
+	func() {
+		setTestingT(nil)
+		defer func() {
+			setTestingT(t)
+			if r := recover(); r == nil {
+				t.Errorf("The check did not fail with a missing chunk")
+			} else if _, ok := r.(Exception); !ok {
+				panic(r)
+			}
+		}()
+		snapshotManager.CheckSnapshots("", nil, "", false, false, false, false, false, false, 1, false)
+	}()
+}
@@ -94,7 +94,7 @@ func CreateFileFabricStorage(endpoint string, token string, storageDir string, t
 
 		endpoint:       endpoint,
 		authToken:      token,
-		client:         http.DefaultClient,
+		client:         newStorageHTTPClient(),
 		threads:        threads,
 		directoryCache: make(map[string]string),
 		maxRetries:     12,
@@ -201,7 +201,7 @@ func (storage *FileFabricStorage) sendRequest(threadIndex int, method string, re
 			return nil, nil, 0, fmt.Errorf("Input type is not supported")
 		}
 
-		request, err := http.NewRequest(method, requestURL, inputReader)
+		request, err := http.NewRequestWithContext(storage.GetContext(), method, requestURL, inputReader)
 		if err != nil {
 			return nil, nil, 0, err
 		}
@@ -218,7 +218,7 @@ func (storage *FileFabricStorage) sendRequest(threadIndex int, method string, re
 
 		response, err = storage.client.Do(request)
 		if err != nil {
-			if !storage.shouldRetry(retries, "[%d] %s %s returned an error: %v", threadIndex, method, requestURL, err) {
+			if storage.GetContext().Err() != nil || !storage.shouldRetry(retries, "[%d] %s %s returned an error: %v", threadIndex, method, requestURL, err) {
 				return nil, nil, 0, err
 			}
 			continue
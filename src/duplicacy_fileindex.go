@@ -0,0 +1,356 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fileIndexDir is the directory in the snapshot cache where the file indexes are saved, one file per snapshot id.
+var fileIndexDir = "file_index"
+
+// fileIndex maps every path in the indexed revisions of a snapshot id to the revisions that contain it, so that
+// files can be found without downloading the snapshots again.
+type fileIndex struct {
+	snapshotID string
+	revisions  []int            // Indexed revisions in ascending order
+	files      map[string][]int // Revisions containing each path, in ascending order
+}
+
+// fileIndexDescription is how the index is saved.  To keep the file small, the revisions of a path are saved as
+// ranges of positions in the list of indexed revisions, such as "0-5,7".
+type fileIndexDescription struct {
+	SnapshotID string            `json:"id"`
+	Revisions  []int             `json:"revisions"`
+	Files      map[string]string `json:"files"`
+}
+
+func createFileIndex(snapshotID string) *fileIndex {
+	return &fileIndex{
+		snapshotID: snapshotID,
+		files:      make(map[string][]int),
+	}
+}
+
+// isIndexed returns true if the revision is already in the index.
+func (index *fileIndex) isIndexed(revision int) bool {
+	i := sort.SearchInts(index.revisions, revision)
+	return i < len(index.revisions) && index.revisions[i] == revision
+}
+
+// addRevision records the paths of all files in the revision.
+func (index *fileIndex) addRevision(revision int, files []*Entry) {
+	if index.isIndexed(revision) {
+		return
+	}
+	index.revisions = append(index.revisions, revision)
+	sort.Ints(index.revisions)
+
+	for _, file := range files {
+		revisions := index.files[file.Path]
+		if len(revisions) > 0 && revisions[len(revisions)-1] >= revision {
+			i := sort.SearchInts(revisions, revision)
+			revisions = append(revisions, 0)
+			copy(revisions[i+1:], revisions[i:])
+			revisions[i] = revision
+		} else {
+			revisions = append(revisions, revision)
+		}
+		index.files[file.Path] = revisions
+	}
+}
+
+// removeRevisions drops the indexed revisions for which 'keep' returns false, along with paths no longer found in
+// any revision.
+func (index *fileIndex) removeRevisions(keep func(revision int) bool) (removed int) {
+	var revisions []int
+	for _, revision := range index.revisions {
+		if keep(revision) {
+			revisions = append(revisions, revision)
+		} else {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	index.revisions = revisions
+
+	for file, fileRevisions := range index.files {
+		var kept []int
+		for _, revision := range fileRevisions {
+			if keep(revision) {
+				kept = append(kept, revision)
+			}
+		}
+		if len(kept) == 0 {
+			delete(index.files, file)
+		} else {
+			index.files[file] = kept
+		}
+	}
+	return removed
+}
+
+// find returns the paths matching the pattern in ascending order.  A pattern without a '/' is matched against the
+// file names, and otherwise against the full paths.  Wildcards like '*' and '?' may appear in the pattern.
+func (index *fileIndex) find(pattern string) (paths []string) {
+	matchName := !strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	for file := range index.files {
+		text := file
+		if matchName {
+			text = path.Base(file)
+			if strings.HasSuffix(file, "/") {
+				text += "/"
+			}
+		}
+		if matchPattern(text, pattern) || (matchName && matchPattern(text, pattern+"/")) {
+			paths = append(paths, file)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// encodeRevisionRanges converts the revisions of a path to ranges of positions in the indexed revisions.
+func (index *fileIndex) encodeRevisionRanges(revisions []int) string {
+	positions := make([]int, 0, len(revisions))
+	position := 0
+	for _, revision := range revisions {
+		for index.revisions[position] != revision {
+			position++
+		}
+		positions = append(positions, position)
+	}
+	return formatRanges(positions)
+}
+
+// formatRanges joins the sorted numbers with consecutive numbers shown as ranges, such as "0-5,7".
+func formatRanges(numbers []int) string {
+	var ranges []string
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(numbers[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// decodeRevisionRanges is the reverse of encodeRevisionRanges.
+func (index *fileIndex) decodeRevisionRanges(ranges string) ([]int, error) {
+	var revisions []int
+	for _, item := range strings.Split(ranges, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range '%s'", item)
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid range '%s'", item)
+			}
+		}
+		if start < 0 || end < start || end >= len(index.revisions) {
+			return nil, fmt.Errorf("the range '%s' is out of bounds", item)
+		}
+		for position := start; position <= end; position++ {
+			revisions = append(revisions, index.revisions[position])
+		}
+	}
+	return revisions, nil
+}
+
+// loadFileIndex reads the index of the snapshot id from the snapshot cache.  An empty index is returned if it
+// hasn't been created yet.
+func (manager *SnapshotManager) loadFileIndex(snapshotID string) (*fileIndex, error) {
+
+	index := createFileIndex(snapshotID)
+
+	manager.fileChunk.Reset(false)
+	err := manager.snapshotCache.DownloadFile(0, path.Join(fileIndexDir, snapshotID), manager.fileChunk)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(manager.fileChunk.GetBytes()))
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var description fileIndexDescription
+	err = json.Unmarshal(content, &description)
+	if err != nil {
+		return nil, err
+	}
+	if description.SnapshotID != snapshotID {
+		return nil, fmt.Errorf("the index belongs to snapshot %s", description.SnapshotID)
+	}
+
+	index.revisions = description.Revisions
+	sort.Ints(index.revisions)
+	for file, ranges := range description.Files {
+		index.files[file], err = index.decodeRevisionRanges(ranges)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revisions for %s: %v", file, err)
+		}
+	}
+	return index, nil
+}
+
+// saveFileIndex writes the index to the snapshot cache.
+func (manager *SnapshotManager) saveFileIndex(index *fileIndex) error {
+
+	description := fileIndexDescription{
+		SnapshotID: index.snapshotID,
+		Revisions:  index.revisions,
+		Files:      make(map[string]string, len(index.files)),
+	}
+	for file, revisions := range index.files {
+		description.Files[file] = index.encodeRevisionRanges(revisions)
+	}
+
+	content, err := json.Marshal(description)
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err = writer.Write(content); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	err = manager.snapshotCache.CreateDirectory(0, fileIndexDir)
+	if err != nil {
+		return err
+	}
+	return manager.snapshotCache.UploadFile(0, path.Join(fileIndexDir, index.snapshotID), buffer.Bytes())
+}
+
+// UpdateFileIndex brings the local file index of the snapshot id up to date with the storage: new revisions are
+// downloaded and added, and revisions that have been pruned are removed.
+func (manager *SnapshotManager) UpdateFileIndex(snapshotID string) bool {
+
+	index, err := manager.loadFileIndex(snapshotID)
+	if err != nil {
+		LOG_WARN("INDEX_LOAD", "Failed to load the file index for snapshot %s; rebuilding it: %v", snapshotID, err)
+		index = createFileIndex(snapshotID)
+	}
+
+	revisions, err := manager.ListSnapshotRevisions(snapshotID)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_LIST", "Failed to list all revisions for snapshot %s: %v", snapshotID, err)
+		return false
+	}
+
+	existing := make(map[int]bool)
+	for _, revision := range revisions {
+		existing[revision] = true
+	}
+	removed := index.removeRevisions(func(revision int) bool { return existing[revision] })
+
+	added := 0
+	for _, revision := range revisions {
+		if index.isIndexed(revision) {
+			continue
+		}
+		snapshot := manager.DownloadSnapshot(snapshotID, revision)
+		if snapshot == nil || !manager.DownloadSnapshotFileSequence(snapshot, nil, false) {
+			return false
+		}
+		index.addRevision(revision, snapshot.Files)
+		manager.ClearSnapshotContents(snapshot)
+		added++
+	}
+
+	if added == 0 && removed == 0 {
+		LOG_DEBUG("INDEX_UPDATE", "The file index for snapshot %s is up to date", snapshotID)
+		return true
+	}
+
+	err = manager.saveFileIndex(index)
+	if err != nil {
+		LOG_ERROR("INDEX_SAVE", "Failed to save the file index for snapshot %s: %v", snapshotID, err)
+		return false
+	}
+	LOG_INFO("INDEX_UPDATE", "Indexed %d new revisions and removed %d pruned revisions of snapshot %s", added,
+		removed, snapshotID)
+	return true
+}
+
+// FindFiles searches the local file indexes of the given snapshot ids (or all indexed ids if 'snapshotIDs' is
+// empty) for paths matching the pattern and lists the revisions containing each of them.  The storage is not
+// accessed, so the results are only as recent as the last update of the index.
+func (manager *SnapshotManager) FindFiles(snapshotIDs []string, pattern string) bool {
+
+	if len(snapshotIDs) == 0 {
+		files, _, err := manager.snapshotCache.ListFiles(0, fileIndexDir+"/")
+		if err != nil && !os.IsNotExist(err) {
+			LOG_ERROR("INDEX_LIST", "Failed to list the file indexes: %v", err)
+			return false
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file, "/") && !strings.HasSuffix(file, ".tmp") {
+				snapshotIDs = append(snapshotIDs, file)
+			}
+		}
+		sort.Strings(snapshotIDs)
+	}
+
+	found := 0
+	indexed := 0
+	for _, snapshotID := range snapshotIDs {
+		index, err := manager.loadFileIndex(snapshotID)
+		if err != nil {
+			LOG_ERROR("INDEX_LOAD", "Failed to load the file index for snapshot %s: %v", snapshotID, err)
+			return false
+		}
+		if len(index.revisions) == 0 {
+			LOG_WARN("INDEX_NONE", "Snapshot %s hasn't been indexed", snapshotID)
+			continue
+		}
+		indexed++
+
+		for _, file := range index.find(pattern) {
+			LOG_INFO("FIND_FILE", "%s: %s in revisions %s", snapshotID, file, formatRanges(index.files[file]))
+			found++
+		}
+	}
+
+	if indexed == 0 {
+		LOG_ERROR("INDEX_NONE", "No file index found; run find with -update to create it")
+		return false
+	}
+	LOG_INFO("FIND_END", "Found %d paths matching %s", found, pattern)
+	return true
+}
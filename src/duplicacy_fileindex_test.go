@@ -0,0 +1,70 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFileIndex(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "fileindex_test")
+	manager := createTestSnapshotManager(testDir)
+
+	createEntries := func(paths ...string) (entries []*Entry) {
+		for _, file := range paths {
+			entries = append(entries, CreateEntry(file, 0, 0, 0644))
+		}
+		return entries
+	}
+
+	index := createFileIndex("host1")
+	index.addRevision(1, createEntries("docs/", "docs/invoice-2023-01.pdf", "notes.txt"))
+	index.addRevision(2, createEntries("docs/", "docs/invoice-2023-01.pdf", "docs/invoice-2023-02.pdf"))
+	index.addRevision(5, createEntries("docs/", "docs/invoice-2023-02.pdf", "notes.txt"))
+	// Revisions may be indexed out of order
+	index.addRevision(3, createEntries("docs/", "docs/invoice-2023-01.pdf", "docs/invoice-2023-02.pdf"))
+
+	if err := manager.saveFileIndex(index); err != nil {
+		t.Fatalf("Failed to save the file index: %v", err)
+	}
+	index, err := manager.loadFileIndex("host1")
+	if err != nil {
+		t.Fatalf("Failed to load the file index: %v", err)
+	}
+
+	expected := map[string]string{
+		"docs/":                    "1-3,5",
+		"docs/invoice-2023-01.pdf": "1-3",
+		"docs/invoice-2023-02.pdf": "2-3,5",
+		"notes.txt":                "1,5",
+	}
+	for file, revisions := range expected {
+		if formatRanges(index.files[file]) != revisions {
+			t.Errorf("%s is in revisions %s instead of %s", file, formatRanges(index.files[file]), revisions)
+		}
+	}
+
+	if found := strings.Join(index.find("invoice*2023*"), ","); found != "docs/invoice-2023-01.pdf,docs/invoice-2023-02.pdf" {
+		t.Errorf("invoice*2023* matched %s", found)
+	}
+	if found := strings.Join(index.find("docs"), ","); found != "docs/" {
+		t.Errorf("docs matched %s", found)
+	}
+	if found := strings.Join(index.find("*/*-02.pdf"), ","); found != "docs/invoice-2023-02.pdf" {
+		t.Errorf("*/*-02.pdf matched %s", found)
+	}
+
+	// Pruning revisions 1 and 5 drops notes.txt from the index
+	index.removeRevisions(func(revision int) bool { return revision != 1 && revision != 5 })
+	if _, found := index.files["notes.txt"]; found || formatRanges(index.files["docs/"]) != "2-3" {
+		t.Errorf("The index contains %d paths after removing revisions", len(index.files))
+	}
+}
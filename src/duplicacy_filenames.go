@@ -0,0 +1,175 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The policies for restoring files whose names differ only in case, or in Unicode normalization, to a file system
+// that doesn't distinguish them.  Without a policy, one of the files would silently overwrite the other.
+const (
+	CollisionRename = "rename" // restore the later file under a new name such as 'name (1).ext'
+	CollisionSkip   = "skip"   // don't restore the later file, or the later directory and everything under it
+	CollisionFail   = "fail"   // abort the restore
+)
+
+// ParseNormalization checks that 'form' is one of the Unicode normalization forms supported by SetNormalization.
+func ParseNormalization(form string) (string, error) {
+	switch strings.ToLower(form) {
+	case "":
+		return "", nil
+	case "nfc":
+		return "nfc", nil
+	case "nfd":
+		return "nfd", nil
+	}
+	return "", fmt.Errorf("'%s' is not a valid normalization form (nfc or nfd)", form)
+}
+
+// ParseCollisionPolicy checks that 'policy' is one of the collision policies.
+func ParseCollisionPolicy(policy string) (string, error) {
+	switch policy {
+	case "", CollisionRename, CollisionSkip, CollisionFail:
+		return policy, nil
+	}
+	return "", fmt.Errorf("'%s' is not a valid collision policy (rename, skip, or fail)", policy)
+}
+
+// SetNormalization makes the restore convert the file names in the snapshot to the Unicode normalization form 'form'
+// ("nfc" or "nfd").  macOS usually stores file names in NFD while Linux and Windows keep them as they are created,
+// mostly in NFC.
+func (manager *BackupManager) SetNormalization(form string) {
+	manager.normalization = form
+}
+
+// SetCollisionPolicy sets the policy for files in the snapshot whose names would refer to the same file when
+// restored to a case-insensitive file system.  If no policy is set, collisions are only detected, and renamed, when
+// the restore destination is case-insensitive or when names are normalized.
+func (manager *BackupManager) SetCollisionPolicy(policy string) {
+	manager.collisionPolicy = policy
+}
+
+func normalizeName(form string, name string) string {
+	switch form {
+	case "nfc":
+		return norm.NFC.String(name)
+	case "nfd":
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// isCaseInsensitive returns true if the file system containing the directory 'top' doesn't distinguish the case of
+// file names, by looking up the preference directory created under it in upper case.
+func isCaseInsensitive(top string) bool {
+	lower, err := os.Stat(joinPath(top, DUPLICACY_DIRECTORY))
+	if err != nil {
+		return false
+	}
+	upper, err := os.Stat(joinPath(top, strings.ToUpper(DUPLICACY_DIRECTORY)))
+	return err == nil && os.SameFile(lower, upper)
+}
+
+// mapRestorePaths normalizes the paths of the files to be restored and then resolves the collisions according to the
+// collision policy.  Files under a renamed directory are moved along with it.  The returned files are sorted again as
+// the new paths may change the order.
+func (manager *BackupManager) mapRestorePaths(top string, files []*Entry) []*Entry {
+
+	policy := manager.collisionPolicy
+	caseInsensitive := policy != "" || isCaseInsensitive(top)
+	if manager.normalization == "" && !caseInsensitive {
+		return files
+	}
+	if policy == "" {
+		policy = CollisionRename
+	}
+	if caseInsensitive {
+		LOG_DEBUG("RESTORE_COLLISION", "Checking for file names that differ only in case")
+	}
+
+	// Two paths collide if their keys are the same
+	getKey := func(path string) string {
+		if caseInsensitive {
+			return strings.ToLower(norm.NFC.String(path))
+		}
+		return path
+	}
+
+	restored := make(map[string]string) // the paths restored so far, indexed by their keys
+	moved := make(map[string]string)    // the new paths of directories whose paths have changed
+	skipped := make(map[string]bool)    // directories not restored
+	var mapped []*Entry
+	changed := false
+
+	for _, entry := range files {
+
+		parent, name := SplitDir(strings.TrimSuffix(entry.Path, "/"))
+		if skipped[parent] {
+			if entry.IsDir() {
+				skipped[entry.Path] = true
+			}
+			continue
+		}
+		if newParent, found := moved[parent]; found {
+			parent = newParent
+		}
+
+		suffix := ""
+		if entry.IsDir() {
+			suffix = "/"
+		}
+		newPath := parent + normalizeName(manager.normalization, name) + suffix
+
+		if existing, found := restored[getKey(newPath)]; found {
+			switch policy {
+			case CollisionFail:
+				LOG_ERROR("RESTORE_COLLISION", "%s and %s can't both be restored to %s", existing, entry.Path, top)
+				return nil
+			case CollisionSkip:
+				LOG_WARN("RESTORE_COLLISION", "%s is not restored because it conflicts with %s", entry.Path, existing)
+				if entry.IsDir() {
+					skipped[entry.Path] = true
+				}
+				changed = true
+				continue
+			default:
+				extension := path.Ext(name)
+				if entry.IsDir() || extension == name {
+					extension = ""
+				}
+				base := normalizeName(manager.normalization, strings.TrimSuffix(name, extension))
+				for i := 1; found; i++ {
+					newPath = fmt.Sprintf("%s%s (%d)%s%s", parent, base, i, extension, suffix)
+					_, found = restored[getKey(newPath)]
+				}
+				LOG_WARN("RESTORE_COLLISION", "%s conflicts with %s and is restored as %s", entry.Path, existing,
+					newPath)
+			}
+		}
+
+		restored[getKey(newPath)] = newPath
+		if newPath != entry.Path {
+			LOG_TRACE("RESTORE_RENAME", "%s is restored as %s", entry.Path, newPath)
+			if entry.IsDir() {
+				moved[entry.Path] = newPath
+			}
+			entry.Path = newPath
+			changed = true
+		}
+		mapped = append(mapped, entry)
+	}
+
+	if changed {
+		sort.Sort(ByName(mapped))
+	}
+	return mapped
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMapRestorePaths(t *testing.T) {
+
+	createEntries := func(paths ...string) []*Entry {
+		var entries []*Entry
+		for _, path := range paths {
+			mode := uint32(0644)
+			if strings.HasSuffix(path, "/") {
+				mode = 0755 | uint32(1<<31) // os.ModeDir
+			}
+			entries = append(entries, CreateEntry(path, 0, 0, mode))
+		}
+		sort.Sort(ByName(entries))
+		return entries
+	}
+
+	getPaths := func(entries []*Entry) string {
+		var paths []string
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		return strings.Join(paths, ",")
+	}
+
+	nfd := "café"
+	nfc := "café"
+
+	for _, test := range []struct {
+		normalization string
+		policy        string
+		expected      string
+	}{
+		{"nfc", "", "Readme.txt," + nfc + ",DIR/,DIR/c,Dir/,Dir/a,Dir/b"},
+		{"", CollisionRename, "README.txt,Readme (1).txt," + nfd + ",DIR/,DIR/c,Dir (1)/,Dir (1)/a,Dir (1)/b"},
+		{"", CollisionSkip, "README.txt," + nfd + ",DIR/,DIR/c"},
+		{"nfc", CollisionRename, "README.txt,Readme (1).txt," + nfc + ",DIR/,DIR/c,Dir (1)/,Dir (1)/a,Dir (1)/b"},
+	} {
+		manager := &BackupManager{normalization: test.normalization, collisionPolicy: test.policy}
+		entries := createEntries("Dir/", "Dir/a", "Dir/b", "DIR/", "DIR/c", "Readme.txt", "README.txt", nfd)
+		if test.policy == "" {
+			// Without a policy, collisions on a case-sensitive file system are not resolved
+			entries = createEntries("Dir/", "Dir/a", "Dir/b", "DIR/", "DIR/c", "Readme.txt", nfd)
+		}
+
+		mapped := getPaths(manager.mapRestorePaths(t.TempDir(), entries))
+		if mapped != test.expected {
+			t.Errorf("normalization %q, policy %q: expected %s, got %s", test.normalization, test.policy,
+				test.expected, mapped)
+		}
+	}
+}
@@ -6,27 +6,62 @@ package duplicacy
 
 import (
 	"os"
+	"time"
 )
 
 // FileReader wraps a number of files and turns them into a series of readers.
 type FileReader struct {
-	top   string
-	files []*Entry
+	top  string
+	next func() *Entry // returns the next entry, or nil if there are no more
 
 	CurrentFile  *os.File
 	CurrentIndex int
 	CurrentEntry *Entry
 
-	SkippedFiles []string
+	SkippedFiles  []string
+	SkippedErrors []error // why each file in SkippedFiles couldn't be opened
+
+	retryOptions OpenRetryOptions
+}
+
+// OpenRetryOptions determine how to retry opening a file that is in use by another process.  This only happens on
+// Windows, where a file opened without sharing can't be read unless it is backed up from a shadow copy.
+type OpenRetryOptions struct {
+	Retries int           // how many times to retry opening the file
+	Delay   time.Duration // the delay before the first retry, which doubles after each retry
+}
+
+// The longest delay between two attempts to open a file in use
+const maximumOpenRetryDelay = time.Minute
+
+// openFileForReading and isFileInUse are replaced by tests to simulate files in use by other processes
+var openFileForReading = func(fullPath string) (*os.File, error) {
+	return os.OpenFile(fullPath, os.O_RDONLY, 0)
 }
+var isFileInUse = IsSharingViolation
 
 // CreateFileReader creates a file reader.
-func CreateFileReader(top string, files []*Entry) *FileReader {
+func CreateFileReader(top string, files []*Entry, retryOptions OpenRetryOptions) *FileReader {
+	next := 0
+	return CreateFileReaderFromSource(top, func() *Entry {
+		if next >= len(files) {
+			return nil
+		}
+		next++
+		return files[next-1]
+	}, retryOptions)
+}
+
+// CreateFileReaderFromSource creates a file reader for the entries returned one at a time by 'next', which returns
+// nil after the last entry.  Entries are requested only as the previous files have been read, so they don't all need
+// to be known in advance.
+func CreateFileReaderFromSource(top string, next func() *Entry, retryOptions OpenRetryOptions) *FileReader {
 
 	reader := &FileReader{
 		top:          top,
-		files:        files,
+		next:         next,
 		CurrentIndex: -1,
+		retryOptions: retryOptions,
 	}
 
 	reader.NextFile()
@@ -34,6 +69,17 @@ func CreateFileReader(top string, files []*Entry) *FileReader {
 	return reader
 }
 
+// CreateFileReaderFromFile creates a file reader for a single entry whose content comes from a file already opened,
+// such as the standard input.
+func CreateFileReaderFromFile(entry *Entry, file *os.File) *FileReader {
+	return &FileReader{
+		next:         func() *Entry { return nil },
+		CurrentFile:  file,
+		CurrentIndex: 0,
+		CurrentEntry: entry,
+	}
+}
+
 // NextFile switches to the next file in the file reader.
 func (reader *FileReader) NextFile() bool {
 
@@ -41,24 +87,25 @@ func (reader *FileReader) NextFile() bool {
 		reader.CurrentFile.Close()
 	}
 
-	reader.CurrentIndex++
-	for reader.CurrentIndex < len(reader.files) {
-
-		reader.CurrentEntry = reader.files[reader.CurrentIndex]
+	for {
+		reader.CurrentIndex++
+		reader.CurrentEntry = reader.next()
+		if reader.CurrentEntry == nil {
+			break
+		}
 		if !reader.CurrentEntry.IsFile() || reader.CurrentEntry.Size == 0 {
-			reader.CurrentIndex++
 			continue
 		}
 
 		var err error
 
-		fullPath := joinPath(reader.top, reader.CurrentEntry.Path)
-		reader.CurrentFile, err = os.OpenFile(fullPath, os.O_RDONLY, 0)
+		fullPath := joinRootPath(reader.top, reader.CurrentEntry.Path)
+		reader.CurrentFile, err = reader.openFile(fullPath)
 		if err != nil {
 			LOG_WARN("OPEN_FAILURE", "Failed to open file for reading: %v", err)
 			reader.CurrentEntry.Size = 0
 			reader.SkippedFiles = append(reader.SkippedFiles, reader.CurrentEntry.Path)
-			reader.CurrentIndex++
+			reader.SkippedErrors = append(reader.SkippedErrors, err)
 			continue
 		}
 
@@ -68,3 +115,23 @@ func (reader *FileReader) NextFile() bool {
 	reader.CurrentFile = nil
 	return false
 }
+
+// openFile opens a file for reading, retrying with an increasing delay if the file is in use by another process.
+func (reader *FileReader) openFile(fullPath string) (file *os.File, err error) {
+
+	delay := reader.retryOptions.Delay
+	for attempt := 0; ; attempt++ {
+		file, err = openFileForReading(fullPath)
+		if err == nil || attempt >= reader.retryOptions.Retries || !isFileInUse(err) {
+			return file, err
+		}
+
+		LOG_INFO("OPEN_RETRY", "%s is in use by another process; retrying in %s (%d/%d)", reader.CurrentEntry.Path,
+			delay, attempt+1, reader.retryOptions.Retries)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maximumOpenRetryDelay {
+			delay = maximumOpenRetryDelay
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errFileInUse = errors.New("the file is being used by another process")
+
+// simulateFilesInUse makes opening a file fail as if it were in use, for as many times as specified by 'attempts'
+// for its name, and returns the number of attempts to open each file.
+func simulateFilesInUse(t *testing.T, attempts map[string]int) map[string]int {
+	opened := make(map[string]int)
+	originalOpen, originalInUse := openFileForReading, isFileInUse
+	openFileForReading = func(fullPath string) (*os.File, error) {
+		name := filepath.Base(fullPath)
+		opened[name]++
+		if attempts[name] < 0 || opened[name] <= attempts[name] {
+			return nil, errFileInUse
+		}
+		return os.OpenFile(fullPath, os.O_RDONLY, 0)
+	}
+	isFileInUse = func(err error) bool { return err == errFileInUse }
+	t.Cleanup(func() { openFileForReading, isFileInUse = originalOpen, originalInUse })
+	return opened
+}
+
+func TestFileReaderOpenRetry(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "filereader")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	var entries []*Entry
+	for _, name := range []string{"free", "busy", "locked", "missing"} {
+		if name != "missing" {
+			createRandomFile(filepath.Join(testDir, name), 1000)
+		}
+		entries = append(entries, CreateEntry(name, 1000, 0, 0644))
+	}
+
+	// 'busy' is in use for two attempts, 'locked' for all of them, and 'missing' fails without being in use
+	opened := simulateFilesInUse(t, map[string]int{"busy": 2, "locked": -1})
+	fileReader := CreateFileReader(testDir, entries, OpenRetryOptions{Retries: 3, Delay: time.Millisecond})
+
+	var read []string
+	for fileReader.CurrentFile != nil {
+		read = append(read, fileReader.CurrentEntry.Path)
+		fileReader.NextFile()
+	}
+
+	if strings.Join(read, " ") != "free busy" {
+		t.Errorf("The files read are %v", read)
+	}
+	for name, expected := range map[string]int{"free": 1, "busy": 3, "locked": 4, "missing": 1} {
+		if opened[name] != expected {
+			t.Errorf("The file %s was opened %d times instead of %d", name, opened[name], expected)
+		}
+	}
+	if strings.Join(fileReader.SkippedFiles, " ") != "locked missing" {
+		t.Errorf("The files skipped are %v", fileReader.SkippedFiles)
+	} else if fileReader.SkippedErrors[0] != errFileInUse || !os.IsNotExist(fileReader.SkippedErrors[1]) {
+		t.Errorf("The files are skipped because of %v", fileReader.SkippedErrors)
+	}
+	if entries[2].Size != 0 || entries[3].Size != 0 {
+		t.Errorf("The skipped files have sizes of %d and %d", entries[2].Size, entries[3].Size)
+	}
+
+	// Without retries a file in use is skipped after the first attempt
+	opened = simulateFilesInUse(t, map[string]int{"free": 1})
+	fileReader = CreateFileReader(testDir, []*Entry{CreateEntry("free", 1000, 0, 0644)}, OpenRetryOptions{})
+	if fileReader.CurrentFile != nil || opened["free"] != 1 || len(fileReader.SkippedFiles) != 1 {
+		t.Errorf("The file in use was opened %d times and skipped: %v", opened["free"], fileReader.SkippedFiles)
+	}
+}
+
+func TestSkippedReport(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "skippedreport")
+	os.RemoveAll(testDir)
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(filepath.Join(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(filepath.Join(repository, "free"), 1000)
+	createRandomFile(filepath.Join(repository, "locked"), 1000)
+
+	removeMockStore("mocktest/skippedreport")
+	storage, err := CreateMockStorage("mocktest/skippedreport", 1)
+	if err != nil {
+		t.Fatalf("Failed to create the mock storage: %v", err)
+	}
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+	SetDuplicacyPreferencePath(filepath.Join(repository, DUPLICACY_DIRECTORY))
+
+	report := filepath.Join(testDir, "skipped")
+	backup := func(tag string) {
+		backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+		backupManager.SetupSnapshotCache("default")
+		backupManager.SetSkippedReport(report)
+		backupManager.SetOpenRetryOptions(OpenRetryOptions{Retries: 2, Delay: time.Millisecond})
+		if !backupManager.Backup(repository, true, 1, tag, false, false, 0, false) {
+			t.Fatalf("The backup failed")
+		}
+	}
+
+	opened := simulateFilesInUse(t, map[string]int{"locked": -1})
+	backup("first")
+	if opened["locked"] != 3 {
+		t.Errorf("The file in use was opened %d times", opened["locked"])
+	}
+	content, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("Failed to read the report: %v", err)
+	}
+	if string(content) != "locked\t"+errFileInUse.Error()+"\n" {
+		t.Errorf("The report contains %q", content)
+	}
+
+	// The report is removed once every file is backed up
+	simulateFilesInUse(t, map[string]int{"locked": 1})
+	backup("second")
+	if _, err := os.Stat(report); !os.IsNotExist(err) {
+		t.Errorf("The report still exists after a complete backup: %v", err)
+	}
+}
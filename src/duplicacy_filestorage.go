@@ -89,6 +89,38 @@ func (storage *FileStorage) ListFiles(threadIndex int, dir string) (files []stri
 	return files, sizes, nil
 }
 
+// ListFilesFunc calls 'handler' with each file and subdirectory under 'dir' (non-recursively), reading the directory
+// a batch of entries at a time.
+func (storage *FileStorage) ListFilesFunc(threadIndex int, dir string, handler func(file string, size int64) bool) (err error) {
+
+	directory, err := os.Open(path.Join(storage.storageDir, dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer directory.Close()
+
+	for {
+		list, err := directory.Readdir(1024)
+		for _, f := range list {
+			name := f.Name()
+			if (f.IsDir() || f.Mode()&os.ModeSymlink != 0) && name[len(name)-1] != '/' {
+				name += "/"
+			}
+			if !handler(name, f.Size()) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *FileStorage) DeleteFile(threadIndex int, filePath string) (err error) {
 	err = os.Remove(path.Join(storage.storageDir, filePath))
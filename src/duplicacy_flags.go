@@ -0,0 +1,44 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/binary"
+)
+
+// Metadata other than the extended attributes is saved in Entry.Attributes under these names, which are never
+// restored as extended attributes.
+const (
+	birthTimeAttribute  = "duplicacy:birthtime" // the creation time in nanoseconds since the Unix epoch
+	linuxFlagsAttribute = "linux:flags"         // the inode flags set by chattr
+	bsdFlagsAttribute   = "bsd:flags"           // the file flags set by chflags
+)
+
+func isMetadataAttribute(name string) bool {
+	return name == birthTimeAttribute || name == linuxFlagsAttribute || name == bsdFlagsAttribute
+}
+
+func (entry *Entry) setMetadataAttribute(name string, value uint64, size int) {
+	if entry.Attributes == nil {
+		entry.Attributes = make(map[string][]byte)
+	}
+	buffer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buffer, value)
+	entry.Attributes[name] = buffer[:size]
+}
+
+// getMetadataAttribute returns the value of the attribute saved by setMetadataAttribute.
+func (entry *Entry) getMetadataAttribute(name string) (value uint64, found bool) {
+	buffer, found := entry.Attributes[name]
+	switch {
+	case !found:
+		return 0, false
+	case len(buffer) == 4:
+		return uint64(binary.LittleEndian.Uint32(buffer)), true
+	case len(buffer) == 8:
+		return binary.LittleEndian.Uint64(buffer), true
+	}
+	return 0, false
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build darwin freebsd
+
+package duplicacy
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// The file flags that can be changed by chflags.  Others, such as the one for compressed files on macOS, are managed
+// by the file system.
+const bsdFlagMask = 0x00000001 | // UF_NODUMP
+	0x00000002 | // UF_IMMUTABLE
+	0x00000004 | // UF_APPEND
+	0x00000008 | // UF_OPAQUE
+	0x00008000 | // UF_HIDDEN
+	0x00010000 | // SF_ARCHIVED
+	0x00020000 | // SF_IMMUTABLE
+	0x00040000 // SF_APPEND
+
+// readFileFlags saves the file flags and the birth time of a regular file or a directory in its attributes.
+func (entry *Entry) readFileFlags(fullPath string) {
+
+	if !entry.IsFile() && !entry.IsDir() {
+		return
+	}
+
+	var stat syscall.Stat_t
+	if syscall.Lstat(fullPath, &stat) != nil {
+		return
+	}
+
+	if stat.Birthtimespec.Sec > 0 {
+		entry.setMetadataAttribute(birthTimeAttribute, uint64(stat.Birthtimespec.Nano()), 8)
+	}
+	if stat.Flags&bsdFlagMask != 0 {
+		entry.setMetadataAttribute(bsdFlagsAttribute, uint64(stat.Flags&bsdFlagMask), 4)
+	}
+}
+
+// restoreBirthTime sets the birth time by setting the modification time to it first, since the file system moves the
+// birth time back to any modification time earlier than it.  The modification time is then set back.
+func (entry *Entry) restoreBirthTime(fullPath string) {
+
+	birthTime, found := entry.getMetadataAttribute(birthTimeAttribute)
+	if !found || (!entry.IsFile() && !entry.IsDir()) {
+		return
+	}
+
+	var stat syscall.Stat_t
+	if syscall.Lstat(fullPath, &stat) != nil || uint64(stat.Birthtimespec.Nano()) <= birthTime {
+		return
+	}
+
+	creationTime := time.Unix(0, int64(birthTime))
+	modifiedTime := time.Unix(entry.Time, 0)
+	if creationTime.After(modifiedTime) {
+		return
+	}
+
+	err := os.Chtimes(fullPath, creationTime, creationTime)
+	if err == nil {
+		err = os.Chtimes(fullPath, modifiedTime, modifiedTime)
+	}
+	if err != nil {
+		LOG_WARN("RESTORE_BIRTHTIME", "Failed to restore the birth time of %s: %v", fullPath, err)
+	}
+}
+
+// restoreFileFlags sets the saved file flags.  This must be the last step in restoring a file as the immutable and
+// append-only flags prevent further changes.  The system flags can only be set by root.
+func (entry *Entry) restoreFileFlags(fullPath string) {
+
+	flags, found := entry.getMetadataAttribute(bsdFlagsAttribute)
+	if !found || (!entry.IsFile() && !entry.IsDir()) {
+		return
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(fullPath, &stat); err != nil {
+		LOG_WARN("RESTORE_FLAGS", "Failed to read the flags of %s: %v", fullPath, err)
+		return
+	}
+
+	newFlags := (stat.Flags &^ bsdFlagMask) | (uint32(flags) & bsdFlagMask)
+	if newFlags != stat.Flags {
+		if err := syscall.Chflags(fullPath, int(newFlags)); err != nil {
+			LOG_WARN("RESTORE_FLAGS", "Failed to restore the flags of %s: %v", fullPath, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// The inode flags that can be changed by chattr.  Other flags, such as the one for extents, are managed by the file
+// system.
+const linuxFlagMask = 0x00000001 | // FS_SECRM_FL
+	0x00000002 | // FS_UNRM_FL
+	0x00000004 | // FS_COMPR_FL
+	0x00000008 | // FS_SYNC_FL
+	0x00000010 | // FS_IMMUTABLE_FL
+	0x00000020 | // FS_APPEND_FL
+	0x00000040 | // FS_NODUMP_FL
+	0x00000080 | // FS_NOATIME_FL
+	0x00004000 | // FS_JOURNAL_DATA_FL
+	0x00008000 | // FS_NOTAIL_FL
+	0x00010000 | // FS_DIRSYNC_FL
+	0x00020000 | // FS_TOPDIR_FL
+	0x00800000 // FS_NOCOW_FL
+
+// FS_IOC_SETFLAGS is _IOW('f', 2, long) while FS_IOC_GETFLAGS is _IOR('f', 1, long), so it is derived by swapping the
+// read and write direction bits, whose positions differ between architectures.
+const fsIocSetFlags = unix.FS_IOC_GETFLAGS ^ 0xc0000000 + 1
+
+// readFileFlags saves the inode flags and the birth time of a regular file or a directory in its attributes.
+func (entry *Entry) readFileFlags(fullPath string) {
+
+	if !entry.IsFile() && !entry.IsDir() {
+		return
+	}
+
+	var stat unix.Statx_t
+	if unix.Statx(unix.AT_FDCWD, fullPath, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stat) == nil &&
+		stat.Mask&unix.STATX_BTIME != 0 {
+		entry.setMetadataAttribute(birthTimeAttribute, uint64(stat.Btime.Sec*1e9+int64(stat.Btime.Nsec)), 8)
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	flags, err := unix.IoctlGetUint32(int(file.Fd()), unix.FS_IOC_GETFLAGS)
+	if err == nil && flags&linuxFlagMask != 0 {
+		entry.setMetadataAttribute(linuxFlagsAttribute, uint64(flags&linuxFlagMask), 4)
+	}
+}
+
+// restoreBirthTime does nothing since Linux doesn't allow the birth time to be changed.
+func (entry *Entry) restoreBirthTime(fullPath string) {
+}
+
+// restoreFileFlags sets the saved inode flags.  This must be the last step in restoring a file as the immutable and
+// append-only flags prevent further changes.  Setting these two flags requires the CAP_LINUX_IMMUTABLE capability.
+func (entry *Entry) restoreFileFlags(fullPath string) {
+
+	flags, found := entry.getMetadataAttribute(linuxFlagsAttribute)
+	if !found || (!entry.IsFile() && !entry.IsDir()) {
+		return
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		LOG_WARN("RESTORE_FLAGS", "Failed to open %s to restore the flags: %v", fullPath, err)
+		return
+	}
+	defer file.Close()
+
+	oldFlags, err := unix.IoctlGetUint32(int(file.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		LOG_WARN("RESTORE_FLAGS", "Failed to read the flags of %s: %v", fullPath, err)
+		return
+	}
+
+	newFlags := (oldFlags &^ linuxFlagMask) | (uint32(flags) & linuxFlagMask)
+	if newFlags != oldFlags {
+		err = unix.IoctlSetPointerInt(int(file.Fd()), fsIocSetFlags, int(newFlags))
+		if err != nil {
+			LOG_WARN("RESTORE_FLAGS", "Failed to restore the flags of %s: %v", fullPath, err)
+		}
+	}
+}
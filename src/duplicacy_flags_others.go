@@ -0,0 +1,17 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build !windows,!linux,!darwin,!freebsd
+
+package duplicacy
+
+// File flags and birth times are not supported on this platform.
+func (entry *Entry) readFileFlags(fullPath string) {
+}
+
+func (entry *Entry) restoreBirthTime(fullPath string) {
+}
+
+func (entry *Entry) restoreFileFlags(fullPath string) {
+}
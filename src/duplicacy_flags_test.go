@@ -0,0 +1,49 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMetadataAttributes(t *testing.T) {
+
+	entry := CreateEntry("file", 0, 0, 0644)
+	entry.setMetadataAttribute(birthTimeAttribute, 1500000000123456789, 8)
+	entry.setMetadataAttribute(linuxFlagsAttribute, 0x10, 4)
+
+	description, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("Failed to encode the entry: %v", err)
+	}
+	var restored Entry
+	if err = json.Unmarshal(description, &restored); err != nil {
+		t.Fatalf("Failed to decode the entry: %v", err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		value uint64
+	}{
+		{birthTimeAttribute, 1500000000123456789},
+		{linuxFlagsAttribute, 0x10},
+	} {
+		value, found := restored.getMetadataAttribute(test.name)
+		if !found || value != test.value {
+			t.Errorf("Attribute %s: expected %d, got %d (found: %t)", test.name, test.value, value, found)
+		}
+		if !isMetadataAttribute(test.name) {
+			t.Errorf("Attribute %s is not a metadata attribute", test.name)
+		}
+	}
+
+	if _, found := restored.getMetadataAttribute(bsdFlagsAttribute); found {
+		t.Errorf("Attribute %s should not be present", bsdFlagsAttribute)
+	}
+	if isMetadataAttribute("user.flags") {
+		t.Errorf("Extended attribute user.flags is treated as a metadata attribute")
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The directory on the storage where run reports are uploaded, with a subdirectory for each snapshot id
+const runReportDir = "reports"
+
+// The number of reports kept for each snapshot id; older ones are removed when a new one is uploaded
+var runReportsKept = 100
+
+// RunReport is the result of a command uploaded to the storage when Notifications.Report is set, so that the
+// fleet-status command run on any machine can tell which repositories haven't been backed up recently.
+type RunReport struct {
+	NotificationEvent
+	Repository string `json:"repository"`
+}
+
+// signedRunReport is the content of a report file.  The signature is the HMAC-SHA256 of the report computed with the
+// hash key of the storage, so a report can't be forged or altered without access to the storage configuration.  On
+// an encrypted storage the file is also encrypted like the snapshot files.
+type signedRunReport struct {
+	Report    json.RawMessage `json:"report"`
+	Signature string          `json:"signature"`
+}
+
+// The storage the run report is uploaded to, set by the first backup manager created by the command
+var reportStorage Storage
+var reportConfig *Config
+var reportRepository string
+
+// setReportStorage sets the storage for the run report.  Only the first call takes effect, like EnableNotifications.
+func setReportStorage(storage Storage, config *Config, repository string) {
+	notificationMutex.Lock()
+	defer notificationMutex.Unlock()
+	if reportStorage == nil {
+		reportStorage = storage
+		reportConfig = config
+		reportRepository = repository
+	}
+}
+
+// getRunReportSignature returns the signature of the encoded report.
+func getRunReportSignature(config *Config, report []byte) string {
+	hasher := hmac.New(sha256.New, config.HashKey)
+	hasher.Write(report)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// encodeRunReport returns the content of the report file.
+func encodeRunReport(config *Config, report *RunReport) ([]byte, error) {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&signedRunReport{Report: encoded, Signature: getRunReportSignature(config, encoded)})
+}
+
+// decodeRunReport parses the content of a report file and verifies its signature.
+func decodeRunReport(config *Config, content []byte) (*RunReport, error) {
+	var signed signedRunReport
+	if err := json.Unmarshal(content, &signed); err != nil {
+		return nil, err
+	}
+	expected := getRunReportSignature(config, signed.Report)
+	if !hmac.Equal([]byte(expected), []byte(signed.Signature)) {
+		return nil, fmt.Errorf("the signature doesn't match")
+	}
+	report := &RunReport{}
+	if err := json.Unmarshal(signed.Report, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+var invalidReportNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// getRunReportPath returns where the report is uploaded to.  Files are named after the time the command ended so
+// they sort chronologically.
+func getRunReportPath(report *RunReport) string {
+	hostname := invalidReportNameCharacters.ReplaceAllString(report.Hostname, "_")
+	return fmt.Sprintf("%s/%s/%s-%s-%s", runReportDir, report.SnapshotID,
+		report.EndTime.UTC().Format("20060102-150405"), hostname, report.Command)
+}
+
+// uploadRunReport uploads the report of the command to the storage set by setReportStorage.  It is called by
+// SendNotifications, possibly while a failure is being handled, so errors are only reported as warnings.
+func uploadRunReport(event *NotificationEvent) {
+	notificationMutex.Lock()
+	storage, config, repository := reportStorage, reportConfig, reportRepository
+	notificationMutex.Unlock()
+
+	if storage == nil {
+		LOG_DEBUG("NOTIFICATION_REPORT", "No storage was opened to upload the run report to")
+		return
+	}
+	if config.dryRun {
+		return
+	}
+
+	report := &RunReport{NotificationEvent: *event, Repository: repository}
+	content, err := encodeRunReport(config, report)
+	if err != nil {
+		LOG_WARN("NOTIFICATION_REPORT", "Failed to encode the run report: %v", err)
+		return
+	}
+
+	reportPath := getRunReportPath(report)
+	derivationKey := reportPath
+	if len(derivationKey) > 64 {
+		derivationKey = derivationKey[len(derivationKey)-64:]
+	}
+	chunk := CreateChunk(config, true)
+	chunk.Reset(false)
+	chunk.Write(content)
+	if err = chunk.Encrypt(config.FileKey, derivationKey, true); err != nil {
+		LOG_WARN("NOTIFICATION_REPORT", "Failed to encrypt the run report: %v", err)
+		return
+	}
+
+	reportDir := runReportDir + "/" + event.SnapshotID
+	storage.CreateDirectory(0, runReportDir)
+	storage.CreateDirectory(0, reportDir)
+	if err = storage.UploadFile(0, reportPath, chunk.GetBytes()); err != nil {
+		LOG_WARN("NOTIFICATION_REPORT", "Failed to upload the run report %s: %v", reportPath, err)
+		return
+	}
+	LOG_DEBUG("NOTIFICATION_REPORT", "Uploaded the run report %s", reportPath)
+
+	pruneRunReports(storage, reportDir)
+}
+
+// pruneRunReports removes the oldest reports in the directory beyond runReportsKept.
+func pruneRunReports(storage Storage, reportDir string) {
+	files, _, err := storage.ListFiles(0, reportDir+"/")
+	if err != nil {
+		LOG_WARN("NOTIFICATION_REPORT", "Failed to list the run reports in %s: %v", reportDir, err)
+		return
+	}
+	var reports []string
+	for _, file := range files {
+		if file != "" && !strings.HasSuffix(file, "/") {
+			reports = append(reports, file)
+		}
+	}
+	sort.Strings(reports)
+	for i := 0; i < len(reports)-runReportsKept; i++ {
+		if err := storage.DeleteFile(0, reportDir+"/"+reports[i]); err != nil {
+			LOG_WARN("NOTIFICATION_REPORT", "Failed to remove the run report %s/%s: %v", reportDir, reports[i], err)
+		} else {
+			LOG_DEBUG("NOTIFICATION_REPORT", "Removed the run report %s/%s", reportDir, reports[i])
+		}
+	}
+}
+
+// ListRunReports downloads all run reports in the storage.  Reports that can't be downloaded, decrypted, or verified
+// are skipped with a warning, and counted as invalid.
+func ListRunReports(storage Storage, config *Config) (reports []*RunReport, invalid int) {
+	dirs, _, err := storage.ListFiles(0, runReportDir+"/")
+	if err != nil {
+		// The directory doesn't exist if no reports have been uploaded
+		LOG_DEBUG("FLEET_LIST", "Failed to list the run reports: %v", err)
+		return nil, 0
+	}
+
+	chunk := CreateChunk(config, true)
+	for _, dir := range dirs {
+		if !strings.HasSuffix(dir, "/") {
+			continue
+		}
+		files, _, err := storage.ListFiles(0, runReportDir+"/"+dir)
+		if err != nil {
+			LOG_WARN("FLEET_LIST", "Failed to list the run reports in %s%s: %v", runReportDir+"/", dir, err)
+			continue
+		}
+		for _, file := range files {
+			if file == "" || strings.HasSuffix(file, "/") {
+				continue
+			}
+			reportPath := runReportDir + "/" + dir + file
+			derivationKey := reportPath
+			if len(derivationKey) > 64 {
+				derivationKey = derivationKey[len(derivationKey)-64:]
+			}
+
+			chunk.Reset(false)
+			if err = storage.DownloadFile(0, reportPath, chunk); err == nil {
+				err = chunk.Decrypt(config.FileKey, derivationKey)
+			}
+			var report *RunReport
+			if err == nil {
+				report, err = decodeRunReport(config, chunk.GetBytes())
+			}
+			if err != nil {
+				LOG_WARN("FLEET_REPORT", "Skipped the run report %s: %v", reportPath, err)
+				invalid++
+				continue
+			}
+			reports = append(reports, report)
+		}
+	}
+	return reports, invalid
+}
+
+// FleetStatus is the latest state of a snapshot id backed up from a host, as derived from the run reports.
+type FleetStatus struct {
+	Hostname    string     `json:"hostname"`
+	SnapshotID  string     `json:"snapshot_id"`
+	Repository  string     `json:"repository"`
+	LastRun     time.Time  `json:"last_run"`
+	LastCommand string     `json:"last_command"`
+	LastResult  string     `json:"last_result"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastBackup  *time.Time `json:"last_backup,omitempty"` // when the last successful backup ended
+	Revision    int        `json:"revision,omitempty"`    // the revision created by the last successful backup
+	Stale       bool       `json:"stale"`                 // there has been no successful backup in the stale period
+}
+
+// GetFleetStatus summarizes the reports for each pair of host and snapshot id, sorted by host and snapshot id.  A
+// status is stale if there has been no successful backup since 'staleAfter' before 'now'.
+func GetFleetStatus(reports []*RunReport, now time.Time, staleAfter time.Duration) (statuses []*FleetStatus) {
+	sort.Slice(reports, func(i, j int) bool { return reports[i].EndTime.Before(reports[j].EndTime) })
+
+	byHost := make(map[string]*FleetStatus)
+	for _, report := range reports {
+		key := report.Hostname + "\x00" + report.SnapshotID
+		status := byHost[key]
+		if status == nil {
+			status = &FleetStatus{Hostname: report.Hostname, SnapshotID: report.SnapshotID}
+			byHost[key] = status
+			statuses = append(statuses, status)
+		}
+		status.Repository = report.Repository
+		status.LastRun = report.EndTime
+		status.LastCommand = report.Command
+		status.LastResult = report.Result
+		status.LastError = report.Error
+		if report.Command == "backup" && report.Success {
+			endTime := report.EndTime
+			status.LastBackup = &endTime
+			status.Revision = 0
+			if summary, ok := report.Summary.(map[string]interface{}); ok {
+				if revision, ok := summary["revision"].(float64); ok {
+					status.Revision = int(revision)
+				}
+			}
+		}
+	}
+
+	for _, status := range statuses {
+		status.Stale = status.LastBackup == nil || now.Sub(*status.LastBackup) > staleAfter
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Hostname != statuses[j].Hostname {
+			return statuses[i].Hostname < statuses[j].Hostname
+		}
+		return statuses[i].SnapshotID < statuses[j].SnapshotID
+	})
+	return statuses
+}
+
+// ShowFleetStatus lists the latest state of every host and snapshot id that has uploaded run reports to the storage,
+// warning about those that haven't been backed up successfully in the stale period.
+func (manager *SnapshotManager) ShowFleetStatus(staleAfter time.Duration) []*FleetStatus {
+
+	reports, invalid := ListRunReports(manager.storage, manager.config)
+	if len(reports) == 0 {
+		LOG_INFO("FLEET_STATUS", "No run reports found in the storage; enable them with 'set -notify-report'")
+		return nil
+	}
+
+	now := time.Now()
+	statuses := GetFleetStatus(reports, now, staleAfter)
+
+	hostWidth, idWidth := len("Host"), len("Snapshot")
+	for _, status := range statuses {
+		if len(status.Hostname) > hostWidth {
+			hostWidth = len(status.Hostname)
+		}
+		if len(status.SnapshotID) > idWidth {
+			idWidth = len(status.SnapshotID)
+		}
+	}
+
+	LOG_INFO("FLEET_STATUS", "%-*s %-*s %-16s %-10s %-8s %-16s %8s", hostWidth, "Host", idWidth, "Snapshot",
+		"Last run", "Command", "Result", "Last backup", "Revision")
+	stale := 0
+	for _, status := range statuses {
+		lastBackup, revision := "never", ""
+		if status.LastBackup != nil {
+			lastBackup = status.LastBackup.Local().Format("2006-01-02 15:04")
+			revision = fmt.Sprintf("%d", status.Revision)
+		}
+		LOG_INFO("FLEET_STATUS", "%-*s %-*s %-16s %-10s %-8s %-16s %8s", hostWidth, status.Hostname, idWidth,
+			status.SnapshotID, status.LastRun.Local().Format("2006-01-02 15:04"), status.LastCommand,
+			status.LastResult, lastBackup, revision)
+		if status.Stale {
+			stale++
+		}
+	}
+
+	for _, status := range statuses {
+		if !status.Stale {
+			continue
+		}
+		if status.LastBackup == nil {
+			LOG_WARN("FLEET_STALE", "%s on %s has no successful backup in the reports", status.SnapshotID,
+				status.Hostname)
+		} else {
+			LOG_WARN("FLEET_STALE", "%s on %s was last backed up %s ago", status.SnapshotID, status.Hostname,
+				PrettyTime(int64(now.Sub(*status.LastBackup).Seconds())))
+		}
+	}
+	if invalid > 0 {
+		LOG_WARN("FLEET_REPORT", "%d run reports were skipped as they couldn't be read or verified", invalid)
+	}
+	LOG_INFO("FLEET_STATUS", "%d snapshot ids reported, %d not backed up in the last %g days", len(statuses), stale,
+		staleAfter.Hours()/24)
+	return statuses
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFleetReport(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "fleetreport")
+	os.RemoveAll(testDir)
+
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+	config, _, err := DownloadConfig(storage, "")
+	if err != nil || config == nil {
+		t.Fatalf("Failed to download the config: %v", err)
+	}
+
+	savedStorage, savedKept := reportStorage, runReportsKept
+	defer func() { reportStorage, runReportsKept = savedStorage, savedKept }()
+	reportStorage = nil
+	runReportsKept = 2
+	setReportStorage(storage, config, "/home/user")
+
+	now := time.Now()
+	events := []NotificationEvent{
+		{Command: "backup", SnapshotID: "laptop", Hostname: "host 1", Success: true, Result: "success",
+			EndTime: now.Add(-72 * time.Hour), Summary: map[string]interface{}{"revision": 3}},
+		{Command: "backup", SnapshotID: "laptop", Hostname: "host 1", Success: true, Result: "success",
+			EndTime: now.Add(-50 * time.Hour), Summary: map[string]interface{}{"revision": 4}},
+		{Command: "backup", SnapshotID: "laptop", Hostname: "host 1", Result: "failure", Error: "disk full",
+			EndTime: now.Add(-time.Hour)},
+		{Command: "backup", SnapshotID: "server", Hostname: "host2", Success: true, Result: "success",
+			EndTime: now.Add(-2 * time.Hour), Summary: map[string]interface{}{"revision": 10}},
+	}
+	for i := range events {
+		uploadRunReport(&events[i])
+	}
+
+	// Only the last two reports of 'laptop' are kept
+	reports, invalid := ListRunReports(storage, config)
+	if len(reports) != 3 || invalid != 0 {
+		t.Fatalf("Listed %d reports and %d invalid ones", len(reports), invalid)
+	}
+
+	statuses := GetFleetStatus(reports, now, 48*time.Hour)
+	if len(statuses) != 2 {
+		t.Fatalf("The fleet status has %d entries", len(statuses))
+	}
+	laptop, server := statuses[0], statuses[1]
+	if laptop.Hostname != "host 1" || laptop.LastResult != "failure" || laptop.LastError != "disk full" ||
+		laptop.Revision != 4 || !laptop.Stale || laptop.Repository != "/home/user" {
+		t.Errorf("The status of laptop is %+v", laptop)
+	}
+	if server.SnapshotID != "server" || server.Revision != 10 || server.Stale {
+		t.Errorf("The status of server is %+v", server)
+	}
+
+	// A report altered without the hash key is rejected
+	report := &RunReport{NotificationEvent: events[3]}
+	content, _ := encodeRunReport(config, report)
+	if _, err := decodeRunReport(config, content); err != nil {
+		t.Errorf("Failed to decode the report: %v", err)
+	}
+	altered := []byte(strings.Replace(string(content), "host2", "host3", 1))
+	if _, err := decodeRunReport(config, altered); err == nil {
+		t.Errorf("The altered report was accepted")
+	}
+}
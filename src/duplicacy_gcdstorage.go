@@ -70,6 +70,9 @@ func (storage *GCDStorage) shouldRetry(threadIndex int, err error) (bool, error)
 		storage.backoffs[threadIndex] = 1
 		storage.attempts[threadIndex] = 0
 		return false, nil
+	} else if storage.GetContext().Err() != nil {
+		// The operation has been cancelled
+		return false, err
 	} else if e, ok := err.(*googleapi.Error); ok {
 		if 500 <= e.Code && e.Code < 600 {
 			// Retry for 5xx response codes.
@@ -204,7 +207,7 @@ func (storage *GCDStorage) listFiles(threadIndex int, parentID string, listFiles
 			if storage.driveID != GCDUserDrive {
 				q = q.DriveId(storage.driveID).IncludeItemsFromAllDrives(true).Corpora("drive").SupportsAllDrives(true)
 			}
-			fileList, err = q.Do()
+			fileList, err = q.Context(storage.GetContext()).Do()
 			if retry, e := storage.shouldRetry(threadIndex, err); e == nil && !retry {
 				break
 			} else if retry {
@@ -236,7 +239,7 @@ func (storage *GCDStorage) listByName(threadIndex int, parentID string, name str
 		if storage.driveID != GCDUserDrive {
 			q = q.DriveId(storage.driveID).IncludeItemsFromAllDrives(true).Corpora("drive").SupportsAllDrives(true)
 		}
-		fileList, err = q.Do()
+		fileList, err = q.Context(storage.GetContext()).Do()
 
 		if retry, e := storage.shouldRetry(threadIndex, err); e == nil && !retry {
 			break
@@ -265,7 +268,7 @@ func (storage *GCDStorage) findSharedFolder(threadIndex int, name string) (strin
 		q = q.DriveId(storage.driveID).IncludeItemsFromAllDrives(true).Corpora("drive").SupportsAllDrives(true)
 	}
 
-	fileList, err := q.Do()
+	fileList, err := q.Context(storage.GetContext()).Do()
 	if err != nil {
 		return "", err
 	}
@@ -619,7 +622,7 @@ func (storage *GCDStorage) DeleteFile(threadIndex int, filePath string) (err err
 	}
 
 	for {
-		err = storage.service.Files.Delete(fileID).SupportsAllDrives(true).Fields("id").Do()
+		err = storage.service.Files.Delete(fileID).SupportsAllDrives(true).Fields("id").Context(storage.GetContext()).Do()
 		if retry, err := storage.shouldRetry(threadIndex, err); err == nil && !retry {
 			storage.deletePathID(filePath)
 			return nil
@@ -665,7 +668,7 @@ func (storage *GCDStorage) MoveFile(threadIndex int, from string, to string) (er
 	}
 
 	for {
-		_, err = storage.service.Files.Update(fileID, nil).SupportsAllDrives(true).AddParents(toParentID).RemoveParents(fromParentID).Do()
+		_, err = storage.service.Files.Update(fileID, nil).SupportsAllDrives(true).AddParents(toParentID).RemoveParents(fromParentID).Context(storage.GetContext()).Do()
 		if retry, err := storage.shouldRetry(threadIndex, err); err == nil && !retry {
 			break
 		} else if retry {
@@ -716,7 +719,7 @@ func (storage *GCDStorage) CreateDirectory(threadIndex int, dir string) (err err
 			Parents:  []string{parentID},
 		}
 
-		file, err = storage.service.Files.Create(file).SupportsAllDrives(true).Fields("id").Do()
+		file, err = storage.service.Files.Create(file).SupportsAllDrives(true).Fields("id").Context(storage.GetContext()).Do()
 		if retry, err := storage.shouldRetry(threadIndex, err); err == nil && !retry {
 			break
 		} else {
@@ -794,7 +797,7 @@ func (storage *GCDStorage) DownloadFile(threadIndex int, filePath string, chunk
 				req = req.AcknowledgeAbuse(true)
 			}
 		}
-		response, err = req.Download()
+		response, err = req.Context(storage.GetContext()).Download()
 		if retry, retry_err := storage.shouldRetry(threadIndex, err); retry_err == nil && !retry {
 			break
 		} else if retry {
@@ -833,7 +836,7 @@ func (storage *GCDStorage) UploadFile(threadIndex int, filePath string, content
 
 	for {
 		reader := CreateRateLimitedReader(content, storage.UploadRateLimit()/storage.numberOfThreads)
-		_, err = storage.service.Files.Create(file).SupportsAllDrives(true).Media(reader).Fields("id").Do()
+		_, err = storage.service.Files.Create(file).SupportsAllDrives(true).Media(reader).Fields("id").Context(storage.GetContext()).Do()
 		if retry, err := storage.shouldRetry(threadIndex, err); err == nil && !retry {
 			break
 		} else if retry {
@@ -168,7 +168,7 @@ func (storage *GCSStorage) ListFiles(threadIndex int, dir string) ([]string, []i
 
 	files := []string{}
 	sizes := []int64{}
-	iter := storage.bucket.Objects(context.Background(), &query)
+	iter := storage.bucket.Objects(storage.GetContext(), &query)
 	for {
 		attributes, err := iter.Next()
 		if err == iterator.Done {
@@ -196,7 +196,7 @@ func (storage *GCSStorage) ListFiles(threadIndex int, dir string) ([]string, []i
 
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *GCSStorage) DeleteFile(threadIndex int, filePath string) (err error) {
-	err = storage.bucket.Object(storage.storageDir + filePath).Delete(context.Background())
+	err = storage.bucket.Object(storage.storageDir + filePath).Delete(storage.GetContext())
 	if err == gcs.ErrObjectNotExist {
 		return nil
 	}
@@ -209,7 +209,7 @@ func (storage *GCSStorage) MoveFile(threadIndex int, from string, to string) (er
 	source := storage.bucket.Object(storage.storageDir + from)
 	destination := storage.bucket.Object(storage.storageDir + to)
 
-	_, err = destination.CopierFrom(source).Run(context.Background())
+	_, err = destination.CopierFrom(source).Run(storage.GetContext())
 	if err != nil {
 		return err
 	}
@@ -226,7 +226,7 @@ func (storage *GCSStorage) CreateDirectory(threadIndex int, dir string) (err err
 func (storage *GCSStorage) GetFileInfo(threadIndex int, filePath string) (exist bool, isDir bool, size int64, err error) {
 	object := storage.bucket.Object(storage.storageDir + filePath)
 
-	attributes, err := object.Attrs(context.Background())
+	attributes, err := object.Attrs(storage.GetContext())
 
 	if err != nil {
 		if err == gcs.ErrObjectNotExist {
@@ -241,7 +241,7 @@ func (storage *GCSStorage) GetFileInfo(threadIndex int, filePath string) (exist
 
 // DownloadFile reads the file at 'filePath' into the chunk.
 func (storage *GCSStorage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
-	readCloser, err := storage.bucket.Object(storage.storageDir + filePath).NewReader(context.Background())
+	readCloser, err := storage.bucket.Object(storage.storageDir + filePath).NewReader(storage.GetContext())
 	if err != nil {
 		return err
 	}
@@ -255,7 +255,7 @@ func (storage *GCSStorage) UploadFile(threadIndex int, filePath string, content
 
 	backoff := 1
 	for {
-		writeCloser := storage.bucket.Object(storage.storageDir + filePath).NewWriter(context.Background())
+		writeCloser := storage.bucket.Object(storage.storageDir + filePath).NewWriter(storage.GetContext())
 		defer writeCloser.Close()
 		reader := CreateRateLimitedReader(content, storage.UploadRateLimit()/storage.numberOfThreads)
 		_, err = io.Copy(writeCloser, reader)
@@ -0,0 +1,163 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GFSRule keeps the latest snapshot in each of the 'Count' most recent periods (hours, days, weeks, months, or
+// years) that have snapshots.
+type GFSRule struct {
+	Period string // hourly, daily, weekly, monthly, or yearly
+	Count  int
+}
+
+// GFSRetention is a grandfather-father-son retention policy such as "7 daily, 4 weekly, 12 monthly, 5 yearly".  A
+// snapshot is kept if any of the rules keeps it; all other snapshots are deleted, except the latest one.
+type GFSRetention struct {
+	Rules []GFSRule
+}
+
+var gfsPeriods = map[string]string{
+	"h": "hourly", "hourly": "hourly",
+	"d": "daily", "daily": "daily",
+	"w": "weekly", "weekly": "weekly",
+	"m": "monthly", "monthly": "monthly",
+	"y": "yearly", "yearly": "yearly",
+}
+
+// ParseGFSRetention parses a policy given as a list of counts and periods separated by commas, such as
+// "7 daily, 4 weekly, 12 monthly, 5 yearly" or "7d,4w,12m,5y".
+func ParseGFSRetention(spec string) (*GFSRetention, error) {
+
+	ruleRegex := regexp.MustCompile(`^([0-9]+)\s*([a-z]+)$`)
+	retention := &GFSRetention{}
+	seen := make(map[string]bool)
+	for _, text := range strings.Split(spec, ",") {
+		text = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(text), "keep")))
+		matched := ruleRegex.FindStringSubmatch(text)
+		if matched == nil {
+			return nil, fmt.Errorf("'%s' is not in the format of <count> <period>", text)
+		}
+		period, found := gfsPeriods[matched[2]]
+		if !found {
+			return nil, fmt.Errorf("'%s' is not a valid period (hourly, daily, weekly, monthly, or yearly)",
+				matched[2])
+		}
+		count, _ := strconv.Atoi(matched[1])
+		if count < 1 {
+			return nil, fmt.Errorf("the number of %s snapshots to keep must be positive", period)
+		}
+		if seen[period] {
+			return nil, fmt.Errorf("the %s snapshots are specified more than once", period)
+		}
+		seen[period] = true
+		retention.Rules = append(retention.Rules, GFSRule{Period: period, Count: count})
+	}
+	return retention, nil
+}
+
+func (retention *GFSRetention) String() string {
+	var rules []string
+	for _, rule := range retention.Rules {
+		rules = append(rules, fmt.Sprintf("%d %s", rule.Count, rule.Period))
+	}
+	return strings.Join(rules, ", ")
+}
+
+// getPeriodKey returns a key that is the same for all times in the same period.
+func getPeriodKey(period string, t time.Time) string {
+	switch period {
+	case "hourly":
+		return t.Format("2006-01-02 15")
+	case "daily":
+		return t.Format("2006-01-02")
+	case "weekly":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "monthly":
+		return t.Format("2006-01")
+	default:
+		return t.Format("2006")
+	}
+}
+
+// selectSnapshots returns the slots filled by each snapshot to be kept, such as "daily 1/7".  'snapshots' must be
+// sorted by revision; the latest snapshot in each period is the one kept for that period.
+func (retention *GFSRetention) selectSnapshots(snapshots []*Snapshot) map[*Snapshot][]string {
+
+	slots := make(map[*Snapshot][]string)
+	for _, rule := range retention.Rules {
+		lastKey := ""
+		filled := 0
+		for i := len(snapshots) - 1; i >= 0 && filled < rule.Count; i-- {
+			key := getPeriodKey(rule.Period, time.Unix(snapshots[i].StartTime, 0))
+			if key == lastKey {
+				continue
+			}
+			lastKey = key
+			filled++
+			slots[snapshots[i]] = append(slots[snapshots[i]], fmt.Sprintf("%s %d/%d", rule.Period, filled, rule.Count))
+		}
+	}
+	return slots
+}
+
+// SetGFSRetention makes PruneSnapshots select the snapshots to delete by the grandfather-father-son policy instead
+// of the -keep policies.
+func (manager *SnapshotManager) SetGFSRetention(retention *GFSRetention) {
+	manager.gfsRetention = retention
+}
+
+// flagGFSSnapshots marks the snapshots of one snapshot id not kept by the GFS policy for deletion and returns the
+// number of them.  Only snapshots with tags matching the given patterns, if any, are considered.  In a dry run the retention slots that
+// each kept snapshot satisfies are listed.
+func (manager *SnapshotManager) flagGFSSnapshots(snapshots []*Snapshot, tags []string, exclusive bool,
+	dryRun bool) int {
+
+	var candidates []*Snapshot
+	for _, snapshot := range snapshots {
+		if len(tags) > 0 && !snapshot.MatchTags(tags) {
+			continue
+		}
+		candidates = append(candidates, snapshot)
+	}
+
+	slots := manager.gfsRetention.selectSnapshots(candidates)
+
+	toBeDeleted := 0
+	for _, snapshot := range candidates {
+		startTime := time.Unix(snapshot.StartTime, 0).Format("2006-01-02 15:04")
+		if labels, found := slots[snapshot]; found {
+			if dryRun {
+				LOG_INFO("RETENTION_KEEP", "Snapshot %s at revision %d (%s) is kept as %s", snapshot.ID,
+					snapshot.Revision, startTime, strings.Join(labels, ", "))
+			} else {
+				LOG_DEBUG("RETENTION_KEEP", "Snapshot %s at revision %d (%s) is kept as %s", snapshot.ID,
+					snapshot.Revision, startTime, strings.Join(labels, ", "))
+			}
+			continue
+		}
+
+		if !exclusive && snapshot == snapshots[len(snapshots)-1] {
+			if dryRun {
+				LOG_INFO("RETENTION_KEEP", "Snapshot %s at revision %d (%s) is kept as the latest revision",
+					snapshot.ID, snapshot.Revision, startTime)
+			}
+			continue
+		}
+
+		LOG_DEBUG("SNAPSHOT_DELETE", "Snapshot %s at revision %d to be deleted - not in any retention slot",
+			snapshot.ID, snapshot.Revision)
+		snapshot.Flag = true
+		toBeDeleted++
+	}
+	return toBeDeleted
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGFSRetention(t *testing.T) {
+
+	for _, spec := range []string{"", "7", "daily", "0 daily", "3 fortnightly", "1d,2d"} {
+		if _, err := ParseGFSRetention(spec); err == nil {
+			t.Errorf("'%s' is accepted as a GFS policy", spec)
+		}
+	}
+
+	retention, err := ParseGFSRetention("keep 3 daily, 2w,2 monthly, 1y")
+	if err != nil {
+		t.Fatalf("Failed to parse the GFS policy: %v", err)
+	}
+	if retention.String() != "3 daily, 2 weekly, 2 monthly, 1 yearly" {
+		t.Errorf("The GFS policy is parsed as %s", retention)
+	}
+
+	// Two snapshots a day, at 1am and 1pm, for 60 days ending on Wednesday 2020-03-04
+	end := time.Date(2020, 3, 4, 13, 0, 0, 0, time.Local)
+	var snapshots []*Snapshot
+	for i := 119; i >= 0; i-- {
+		snapshots = append(snapshots, &Snapshot{
+			ID:        "host1",
+			Revision:  len(snapshots) + 1,
+			StartTime: end.Add(-time.Duration(i) * 12 * time.Hour).Unix(),
+		})
+	}
+
+	slots := retention.selectSnapshots(snapshots)
+	var kept []string
+	for snapshot, labels := range slots {
+		kept = append(kept, time.Unix(snapshot.StartTime, 0).Format("01-02 15")+" "+strings.Join(labels, "+"))
+	}
+	sort.Strings(kept)
+
+	expected := []string{
+		"02-29 13 monthly 2/2",
+		"03-01 13 weekly 2/2",
+		"03-02 13 daily 3/3",
+		"03-03 13 daily 2/3",
+		"03-04 13 daily 1/3+weekly 1/2+monthly 1/2+yearly 1/1",
+	}
+	if strings.Join(kept, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("The kept snapshots are %s instead of %s", strings.Join(kept, ", "), strings.Join(expected, ", "))
+	}
+
+	manager := &SnapshotManager{}
+	manager.SetGFSRetention(retention)
+	if deleted := manager.flagGFSSnapshots(snapshots, nil, false, false); deleted != len(snapshots)-len(expected) {
+		t.Errorf("%d snapshots are to be deleted instead of %d", deleted, len(snapshots)-len(expected))
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// RunHook runs the command configured in the preference for 'phase', one of HookPhases.  'revision' is the revision to
+// be restored, if known, 'summary' contains the results of the operation for post hooks, and 'failure' is the error
+// that ended the operation, if it failed.  A failure of the hook aborts the command as configured by OnFailure, except
+// when the operation has already failed, in which case it is only reported as a warning.  It returns true if the hook
+// was run and succeeded.
+func RunHook(preference *Preference, repository string, phase string, revision int, summary *OperationSummary,
+	failure string) bool {
+
+	hook, found := preference.Hooks[phase]
+	if !found || hook.Command == "" {
+		return false
+	}
+
+	abort := strings.HasPrefix(phase, "pre-")
+	switch hook.OnFailure {
+	case "abort":
+		abort = true
+	case "warn":
+		abort = false
+	}
+	if failure != "" {
+		abort = false
+	}
+
+	environment := append(os.Environ(),
+		"DUPLICACY_PHASE="+phase,
+		"DUPLICACY_SNAPSHOT_ID="+preference.SnapshotID,
+		"DUPLICACY_STORAGE_NAME="+preference.Name,
+		"DUPLICACY_STORAGE_URL="+preference.StorageURL,
+		"DUPLICACY_REPOSITORY="+repository)
+	if summary != nil {
+		if summary.Revision > 0 {
+			revision = summary.Revision
+		}
+		result := "success"
+		if summary.FailedFiles > 0 {
+			result = "failure"
+		}
+		environment = append(environment,
+			"DUPLICACY_RESULT="+result,
+			fmt.Sprintf("DUPLICACY_TOTAL_FILES=%d", summary.TotalFiles),
+			fmt.Sprintf("DUPLICACY_TOTAL_FILE_SIZE=%d", summary.TotalFileSize),
+			fmt.Sprintf("DUPLICACY_NEW_FILES=%d", summary.NewFiles),
+			fmt.Sprintf("DUPLICACY_NEW_FILE_SIZE=%d", summary.NewFileSize),
+			fmt.Sprintf("DUPLICACY_TRANSFERRED_BYTES=%d", summary.TransferredBytes),
+			fmt.Sprintf("DUPLICACY_SKIPPED_FILES=%d", summary.SkippedFiles),
+			fmt.Sprintf("DUPLICACY_FAILED_FILES=%d", summary.FailedFiles))
+	}
+	if failure != "" {
+		environment = append(environment, "DUPLICACY_RESULT=failure", "DUPLICACY_ERROR="+failure)
+	}
+	if revision > 0 {
+		environment = append(environment, fmt.Sprintf("DUPLICACY_REVISION=%d", revision))
+	}
+
+	var command *exec.Cmd
+	if runtime.GOOS == "windows" {
+		command = exec.Command("cmd", "/C", hook.Command)
+	} else {
+		command = exec.Command("sh", "-c", hook.Command)
+	}
+	command.Env = environment
+
+	LOG_INFO("HOOK_RUN", "Running the %s hook: %s", phase, hook.Command)
+
+	output, err := command.CombinedOutput()
+	for _, line := range strings.Split(string(output), "\n") {
+		line := strings.TrimSpace(line)
+		if line != "" {
+			LOG_INFO("HOOK_OUTPUT", "%s", line)
+		}
+	}
+
+	if err != nil {
+		if abort {
+			LOG_ERROR("HOOK_ERROR", "The %s hook failed: %v", phase, err)
+		} else {
+			LOG_WARN("HOOK_ERROR", "The %s hook failed: %v", phase, err)
+		}
+		return false
+	}
+
+	return true
+}
+
+// RunWithHooks runs the pre hook of 'operation' ("backup" or "restore"), then 'run', and then the post hook.  The post
+// hook receives the summary returned by 'run', or a failure result if 'run' returns nil or the command is ended by an
+// error, in which case the post hook is run through RunAtFailure.  A pre hook aborting the command skips the rest.
+func RunWithHooks(preference *Preference, repository string, operation string, revision int,
+	run func() *OperationSummary) *OperationSummary {
+
+	RunHook(preference, repository, "pre-"+operation, revision, nil, "")
+	RunAtFailure = func(failure *Exception) {
+		RunHook(preference, repository, "post-"+operation, revision, nil, failure.Message)
+	}
+	summary := run()
+	RunAtFailure = func(failure *Exception) {}
+
+	if summary != nil {
+		RunHook(preference, repository, "post-"+operation, revision, summary, "")
+	} else {
+		RunHook(preference, repository, "post-"+operation, revision, nil,
+			fmt.Sprintf("the %s didn't complete", operation))
+	}
+	return summary
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRunWithHooks(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The hooks in this test are shell commands")
+	}
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "hook")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	// Each hook appends its phase and result to the log, and the operation appends 'run', to check the order
+	logFile := filepath.Join(testDir, "log")
+	logCommand := `echo "$DUPLICACY_PHASE $DUPLICACY_RESULT $DUPLICACY_REVISION $DUPLICACY_ERROR" >> ` + logFile
+	preference := &Preference{
+		Name:       "default",
+		SnapshotID: "host1",
+		Hooks: map[string]Hook{
+			"pre-backup":  {Command: logCommand},
+			"post-backup": {Command: logCommand},
+		},
+	}
+	readLog := func() string {
+		content, _ := ioutil.ReadFile(logFile)
+		os.Remove(logFile)
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			lines = append(lines, strings.Join(strings.Fields(line), " "))
+		}
+		return strings.Join(lines, "\n")
+	}
+	run := func(summary *OperationSummary) func() *OperationSummary {
+		return func() *OperationSummary {
+			file, _ := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			file.WriteString("run\n")
+			file.Close()
+			return summary
+		}
+	}
+
+	RunWithHooks(preference, testDir, "backup", 0, run(&OperationSummary{Revision: 5}))
+	if log := readLog(); log != "pre-backup\nrun\npost-backup success 5" {
+		t.Errorf("The hooks of a successful backup logged %q", log)
+	}
+
+	RunWithHooks(preference, testDir, "backup", 0, run(nil))
+	if log := readLog(); log != "pre-backup\nrun\npost-backup failure the backup didn't complete" {
+		t.Errorf("The hooks of an incomplete backup logged %q", log)
+	}
+
+	// An error ending the command runs the post hook with the error, as CatchLogException does
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				exception, ok := r.(Exception)
+				if !ok {
+					panic(r)
+				}
+				runAtFailure(&exception)
+			}
+		}()
+		RunWithHooks(preference, testDir, "backup", 0, func() *OperationSummary {
+			panic(Exception{Level: ERROR, LogID: "BACKUP_FAIL", Message: "no space left"})
+		})
+	}()
+	if log := readLog(); log != "pre-backup\npost-backup failure no space left" {
+		t.Errorf("The hooks of a failed backup logged %q", log)
+	}
+
+	// A failing pre hook aborts the command before the operation is run
+	preference.Hooks["pre-backup"] = Hook{Command: logCommand + "; exit 3"}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(Exception); !ok || e.LogID != "HOOK_ERROR" {
+					panic(r)
+				} else {
+					runAtFailure(&e)
+				}
+			}
+		}()
+		setTestingT(nil)
+		defer setTestingT(t)
+		RunWithHooks(preference, testDir, "backup", 0, run(&OperationSummary{}))
+		t.Errorf("The failing pre hook didn't abort the command")
+	}()
+	if log := readLog(); log != "pre-backup" {
+		t.Errorf("The hooks of an aborted backup logged %q", log)
+	}
+
+	// Unless it is configured to only give a warning
+	preference.Hooks["pre-backup"] = Hook{Command: logCommand + "; exit 3", OnFailure: "warn"}
+	RunWithHooks(preference, testDir, "backup", 0, run(&OperationSummary{}))
+	if log := readLog(); log != "pre-backup\nrun\npost-backup success" {
+		t.Errorf("The hooks of a backup with a failing pre hook logged %q", log)
+	}
+
+	// A failing post hook only gives a warning by default
+	if RunHook(&Preference{Hooks: map[string]Hook{"post-restore": {Command: "exit 1"}}}, testDir, "post-restore", 0,
+		&OperationSummary{}, "") {
+		t.Errorf("A failing post hook succeeded")
+	}
+	if !RunHook(&Preference{Hooks: map[string]Hook{"post-restore": {Command: "exit 0"}}}, testDir, "post-restore", 0,
+		&OperationSummary{}, "") {
+		t.Errorf("A successful post hook failed")
+	}
+	if RunHook(&Preference{}, testDir, "post-restore", 0, nil, "") {
+		t.Errorf("A hook that isn't configured was run")
+	}
+}
+
+func TestHookOutput(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The hook in this test is a shell command")
+	}
+
+	var messages []string
+	LogFunction = func(level int, logID string, message string) {
+		if logID == "HOOK_OUTPUT" {
+			messages = append(messages, message)
+		}
+	}
+	defer func() { LogFunction = nil }()
+
+	preference := &Preference{Hooks: map[string]Hook{"pre-backup": {Command: `echo "100%d done"; echo "%s %v"`}}}
+	if !RunHook(preference, os.TempDir(), "pre-backup", 0, nil, "") {
+		t.Errorf("The hook failed")
+	}
+	if strings.Join(messages, "\n") != "100%d done\n%s %v" {
+		t.Errorf("The output of the hook was logged as %q", messages)
+	}
+}
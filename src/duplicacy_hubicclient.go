@@ -6,12 +6,12 @@ package duplicacy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
-	"net"
 	"net/http"
 	net_url "net/url"
 	"strings"
@@ -50,6 +50,9 @@ type HubicClient struct {
 	CredentialLock *sync.Mutex
 
 	TestMode bool
+
+	// Returns the context of the requests; the context of the running operation is used if it is nil
+	ContextFunction func() context.Context
 }
 
 func NewHubicClient(tokenFile string) (*HubicClient, error) {
@@ -67,10 +70,7 @@ func NewHubicClient(tokenFile string) (*HubicClient, error) {
 	client := &HubicClient{
 		HTTPClient: &http.Client{
 			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   30 * time.Second,
-					KeepAlive: 30 * time.Second,
-				}).Dial,
+				DialContext:           getStorageNetwork().DialContext,
 				TLSHandshakeTimeout:   60 * time.Second,
 				ResponseHeaderTimeout: 300 * time.Second,
 				ExpectContinueTimeout: 10 * time.Second,
@@ -99,6 +99,7 @@ func (client *HubicClient) call(url string, method string, input interface{}, ex
 
 	var response *http.Response
 
+	ctx := getRequestContext(client.ContextFunction)
 	backoff := 1
 	for i := 0; i < 11; i++ {
 
@@ -126,7 +127,7 @@ func (client *HubicClient) call(url string, method string, input interface{}, ex
 			inputReader = input.(*RateLimitedReader)
 		}
 
-		request, err := http.NewRequest(method, url, inputReader)
+		request, err := http.NewRequestWithContext(ctx, method, url, inputReader)
 		if err != nil {
 			return nil, 0, "", err
 		}
@@ -151,7 +152,7 @@ func (client *HubicClient) call(url string, method string, input interface{}, ex
 
 		response, err = client.HTTPClient.Do(request)
 		if err != nil {
-			if url != HubicCredentialURL {
+			if url != HubicCredentialURL && ctx.Err() == nil {
 				retryAfter := time.Duration((0.5 + rand.Float32()) * 1000.0 * float32(backoff))
 				LOG_INFO("HUBIC_CALL", "%s %s returned an error: %v; retry after %d milliseconds", method, url, err, retryAfter)
 				time.Sleep(retryAfter * time.Millisecond)
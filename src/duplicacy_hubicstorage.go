@@ -47,6 +47,7 @@ func CreateHubicStorage(tokenFile string, storagePath string, threads int) (stor
 		storageDir:      storagePath,
 		numberOfThreads: threads,
 	}
+	client.ContextFunction = storage.GetContext
 
 	for _, path := range []string{"chunks", "snapshots"} {
 		dir := storagePath + "/" + path
@@ -0,0 +1,174 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The name of the per-directory ignore file.  Its patterns follow the .gitignore syntax and apply to the directory
+// containing it and all its subdirectories.
+var DUPLICACY_IGNORE_FILE = ".duplicacyignore"
+
+// IgnoreRule is a pattern from an ignore file.
+type IgnoreRule struct {
+	Pattern string         // the pattern as it appears in the ignore file
+	Source  string         // the path of the ignore file, relative to the repository root
+	negate  bool           // the pattern starts with '!', so matching files are included again
+	dirOnly bool           // the pattern ends with '/', so it only matches directories
+	regex   *regexp.Regexp // the pattern translated into a regular expression matching entry paths
+}
+
+// IgnoreRules is the list of rules that apply to a directory, in the order of precedence from lowest to highest.
+// Rules from an ignore file in a subdirectory come after those from its parent directories.
+type IgnoreRules []*IgnoreRule
+
+// LoadIgnoreFile reads the ignore file, if any, in the directory 'path' under 'top'.
+func LoadIgnoreFile(top string, path string) (rules IgnoreRules) {
+
+	content, err := ioutil.ReadFile(joinRootPath(top, path+DUPLICACY_IGNORE_FILE))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("IGNORE_FILE", "Failed to read the ignore file in %s: %v", path, err)
+		}
+		return nil
+	}
+
+	base := path
+	if base != "" && !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	rules = ParseIgnoreRules(base, strings.Split(string(content), "\n"))
+	LOG_DEBUG("IGNORE_FILE", "Loaded %d pattern(s) from %s%s", len(rules), base, DUPLICACY_IGNORE_FILE)
+	return rules
+}
+
+// ParseIgnoreRules parses the lines of an ignore file located in the directory 'base' (which must be empty or end
+// with '/').
+func ParseIgnoreRules(base string, lines []string) (rules IgnoreRules) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		// Trailing spaces are ignored unless escaped
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		rule := &IgnoreRule{Pattern: line, Source: base + DUPLICACY_IGNORE_FILE}
+		pattern := line
+		if pattern[0] == '!' {
+			rule.negate = true
+			pattern = pattern[1:]
+		} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+			pattern = pattern[1:]
+		}
+
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		if pattern == "" {
+			continue
+		}
+
+		// A pattern containing a slash other than a trailing one is relative to the directory of the ignore file;
+		// otherwise it matches at any level below that directory
+		expression := "^" + regexp.QuoteMeta(base)
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+		} else {
+			expression += "(?:.*/)?"
+		}
+		expression += translateIgnorePattern(pattern) + "$"
+
+		regex, err := regexp.Compile(expression)
+		if err != nil {
+			LOG_WARN("IGNORE_PATTERN", "Invalid pattern '%s' in %s: %v", line, rule.Source, err)
+			continue
+		}
+		rule.regex = regex
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// translateIgnorePattern converts the wildcards in a .gitignore pattern into a regular expression.
+func translateIgnorePattern(pattern string) string {
+
+	var expression strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			// Leading "**/" or "/**/" matches zero or more directories
+			expression.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && pattern[i:] == "**" && i > 0 && pattern[i-1] == '/':
+			// Trailing "/**" matches everything inside
+			expression.WriteString(".+")
+			i++
+		case c == '*' && strings.HasPrefix(pattern[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case c == '*':
+			expression.WriteString("[^/]*")
+		case c == '?':
+			expression.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expression.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return expression.String()
+}
+
+// Match returns the last rule that matches the entry path, or nil if none matches.  As in .gitignore, the last
+// matching rule decides whether the entry is ignored.
+func (rules IgnoreRules) Match(entryPath string) *IgnoreRule {
+
+	isDir := strings.HasSuffix(entryPath, "/")
+	entryPath = strings.TrimSuffix(entryPath, "/")
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.regex.MatchString(entryPath) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// IsIgnored returns true if the entry path is excluded by the rules.
+func (rules IgnoreRules) IsIgnored(entryPath string) bool {
+	rule := rules.Match(entryPath)
+	if rule == nil || rule.negate {
+		return false
+	}
+	LOG_DEBUG("IGNORE_EXCLUDE", "%s is excluded by pattern %s in %s", entryPath, rule.Pattern, rule.Source)
+	return true
+}
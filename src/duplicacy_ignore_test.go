@@ -0,0 +1,129 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+
+	rules := ParseIgnoreRules("", []string{
+		"# comment",
+		"*.o",
+		"build/",
+		"/top.txt",
+		"docs/*.pdf",
+		"**/cache/**",
+		"!keep.o",
+		"\\#hash",
+	})
+	rules = append(rules, ParseIgnoreRules("src/", []string{"*.tmp", "!important.tmp", "/generated/"})...)
+
+	for path, ignored := range map[string]bool{
+		"main.o":                 true,
+		"lib/util.o":             true,
+		"keep.o":                 false,
+		"lib/keep.o":             false,
+		"build/":                 true,
+		"lib/build/":             true,
+		"build":                  false,
+		"top.txt":                true,
+		"lib/top.txt":            false,
+		"docs/manual.pdf":        true,
+		"docs/old/manual.pdf":    false,
+		"a/cache/b/c":            true,
+		"cache/x":                true,
+		"cache/":                 false,
+		"#hash":                  true,
+		"src/a.tmp":              true,
+		"src/lib/a.tmp":          true,
+		"a.tmp":                  false,
+		"src/important.tmp":      false,
+		"src/generated/":         true,
+		"src/lib/generated/":     false,
+		"src/lib/important.tmp":  false,
+		"src/lib/unimportant.tx": false,
+	} {
+		if rules.IsIgnored(path) != ignored {
+			t.Errorf("%s: ignored should be %t", path, ignored)
+		}
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test")
+	os.RemoveAll(testDir)
+
+	for _, file := range []string{"a.log", "b.txt", "sub/c.log", "sub/d.txt", "sub/deeper/e.txt", "sub/deeper/f.log"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(testDir, file)), 0700)
+		ioutil.WriteFile(filepath.Join(testDir, file), []byte(file), 0600)
+	}
+	ioutil.WriteFile(filepath.Join(testDir, DUPLICACY_IGNORE_FILE), []byte("*.log\n"), 0600)
+	ioutil.WriteFile(filepath.Join(testDir, "sub", DUPLICACY_IGNORE_FILE), []byte("!c.log\nd.txt\n"), 0600)
+
+	snapshot, _, _, err := CreateSnapshotFromDirectory("test", testDir, nil, filepath.Join(testDir, "nofilters"), false,
+		false, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to list the directory: %v", err)
+	}
+
+	var listed []string
+	for _, file := range snapshot.Files {
+		listed = append(listed, file.Path)
+	}
+
+	expected := []string{DUPLICACY_IGNORE_FILE, "b.txt", "sub/", "sub/" + DUPLICACY_IGNORE_FILE, "sub/c.log",
+		"sub/deeper/", "sub/deeper/e.txt"}
+	if len(listed) != len(expected) {
+		t.Fatalf("Listed %v; expected %v", listed, expected)
+	}
+	for i := range listed {
+		if listed[i] != expected[i] {
+			t.Errorf("Listed %v; expected %v", listed, expected)
+			break
+		}
+	}
+
+	os.RemoveAll(testDir)
+}
+
+func TestExplainFilter(t *testing.T) {
+
+	patterns := []string{"-*.log", "+docs/", "+docs/*"}
+	rules := ParseIgnoreRules("docs/", []string{"draft.txt", "!keep.log"})
+
+	for path, expected := range map[string]string{
+		"a.txt":          "included as no pattern matches and there are exclude patterns",
+		"a.log":          "excluded by pattern -*.log",
+		"docs/":          "included by pattern +docs/",
+		"docs/a.txt":     "included by pattern +docs/*",
+		"docs/draft.txt": "included by pattern +docs/*, but excluded by draft.txt in docs/" + DUPLICACY_IGNORE_FILE,
+	} {
+		included, reason := ExplainFilter(path, nil, patterns, rules)
+		if reason != expected {
+			t.Errorf("%s: reason is '%s'; expected '%s'", path, reason, expected)
+		}
+		if included != (strings.HasPrefix(reason, "included") && !strings.Contains(reason, "but excluded")) {
+			t.Errorf("%s: included is %t for '%s'", path, included, reason)
+		}
+	}
+
+	included, reason := ExplainFilter("a.txt", nil, []string{"+docs/"}, nil)
+	if included || reason != "excluded as no pattern matches and all patterns are include patterns" {
+		t.Errorf("a.txt: included is %t for '%s'", included, reason)
+	}
+
+	included, reason = ExplainFilter("docs/keep.log", nil, nil, rules)
+	if !included || reason != "included as no pattern is defined, and included again by !keep.log in docs/"+
+		DUPLICACY_IGNORE_FILE {
+		t.Errorf("docs/keep.log: included is %t for '%s'", included, reason)
+	}
+}
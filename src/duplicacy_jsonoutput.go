@@ -0,0 +1,131 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JSONRecord is a line of output in the JSON mode.  Every log message becomes a record of the type "log", or
+// "progress" for the periodic progress messages of backup, restore, and copy, with the log id as the event code and
+// the subsystem it comes from.
+// Some commands output their results as additional records, such as "revision" for each revision listed or "diff"
+// for the differences of each file, and a single "result" record is always output last.
+type JSONRecord struct {
+	Type      string      `json:"type"`
+	Time      string      `json:"time"`
+	Level     string      `json:"level,omitempty"`
+	Subsystem string      `json:"subsystem,omitempty"`
+	ID        string      `json:"id,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Command   string      `json:"command,omitempty"`
+	Success   *bool       `json:"success,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// JSONRevision is the data of a "revision" record.
+type JSONRevision struct {
+	ID            string   `json:"id"`
+	Revision      int      `json:"revision"`
+	StartTime     int64    `json:"start_time"`
+	EndTime       int64    `json:"end_time"`
+	Tags          []string `json:"tags,omitempty"`
+	Note          string   `json:"note,omitempty"`
+	Options       string   `json:"options,omitempty"`
+	FileSize      int64    `json:"file_size"`
+	NumberOfFiles int64    `json:"number_of_files"`
+}
+
+// JSONContentDiff is the data of a "diff" record, with the unified diff between two versions of a file.
+type JSONContentDiff struct {
+	Path     string   `json:"path"`
+	Left     string   `json:"left"`
+	Right    string   `json:"right"`
+	Binary   bool     `json:"binary,omitempty"`
+	TooLarge bool     `json:"too_large,omitempty"`
+	Lines    []string `json:"lines,omitempty"`
+}
+
+// JSONError is the data of a "result" record when the command fails.
+type JSONError struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+var jsonOutput = false
+var jsonCommand string         // the command being run, included in the "result" record
+var jsonResultData interface{} // the results of the command, included in the "result" record
+var jsonResultWritten = false
+
+// EnableJSONOutput makes all output JSON records, one per line.
+func EnableJSONOutput(command string) {
+	jsonOutput = true
+	jsonCommand = command
+}
+
+// IsJSONOutput returns true if the output is in the JSON mode.
+func IsJSONOutput() bool {
+	return jsonOutput
+}
+
+// SetJSONResult sets the data to be included in the "result" record, such as the summary of a backup.
+func SetJSONResult(data interface{}) {
+	jsonResultData = data
+}
+
+// getJSONRecordType returns "progress" for the messages that report the progress of a long operation.
+func getJSONRecordType(level int, logID string) string {
+	if level == INFO && strings.HasSuffix(logID, "_PROGRESS") {
+		return "progress"
+	}
+	return "log"
+}
+
+// writeJSONRecord outputs the record.  The caller must hold logMutex.
+func writeJSONRecord(record *JSONRecord) {
+	record.Time = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(&JSONRecord{Type: "log", Time: record.Time, Level: getLevelName(WARN),
+			ID: "JSON_ENCODE", Message: fmt.Sprintf("Failed to encode a %s record: %v", record.Type, err)})
+	}
+	fmt.Fprintf(logOutput, "%s\n", line)
+}
+
+// EmitJSONRecord outputs a record with command-specific data if the output is in the JSON mode.
+func EmitJSONRecord(recordType string, data interface{}) {
+	if !jsonOutput {
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	writeJSONRecord(&JSONRecord{Type: recordType, Data: data})
+}
+
+// EmitJSONResult outputs the "result" record, unless it has already been output, if the output is in the JSON mode.
+// The data set by SetJSONResult is included if the command succeeded.  It is called when the command completes, and
+// by CatchLogException on failures.
+func EmitJSONResult(success bool, failure *Exception) {
+	if !jsonOutput {
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if jsonResultWritten {
+		return
+	}
+	jsonResultWritten = true
+
+	record := &JSONRecord{Type: "result", Command: jsonCommand, Success: &success}
+	if failure != nil {
+		record.Data = &JSONError{ID: failure.LogID, Message: failure.Message}
+	} else if success {
+		record.Data = jsonResultData
+	}
+	writeJSONRecord(record)
+}
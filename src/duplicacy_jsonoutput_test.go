@@ -0,0 +1,75 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJSONOutput(t *testing.T) {
+
+	SetLoggingLevel(INFO)
+
+	var buffer bytes.Buffer
+	SetLogOutput(&buffer)
+	EnableJSONOutput("backup")
+
+	// logf only writes to the output when not running under a test
+	setTestingT(nil)
+	defer func() {
+		setTestingT(t)
+		SetLogOutput(os.Stdout)
+		jsonOutput = false
+		jsonCommand = ""
+		jsonResultData = nil
+		jsonResultWritten = false
+	}()
+
+	LOG_INFO("UPLOAD_PROGRESS", "Uploaded chunk %d", 1)
+	LOG_WARN("UPLOAD_RETRY", "Retrying \"chunk\"")
+	LOG_DEBUG("UPLOAD_CHUNK", "Not shown at the INFO level")
+	EmitJSONRecord("revision", &JSONRevision{ID: "host1", Revision: 3, Tags: []string{"a", "b"}})
+	SetJSONResult(&OperationSummary{Revision: 3, NewFiles: 2})
+	EmitJSONResult(true, nil)
+	EmitJSONResult(false, &Exception{LogID: "LATE", Message: "A second result is not written"})
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d records were written: %s", len(lines), buffer.String())
+	}
+
+	var records []map[string]interface{}
+	for _, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("'%s' is not a valid JSON record: %v", line, err)
+		}
+		if record["time"] == "" {
+			t.Errorf("The record '%s' has no time", line)
+		}
+		records = append(records, record)
+	}
+
+	if records[0]["type"] != "progress" || records[0]["id"] != "UPLOAD_PROGRESS" ||
+		records[0]["message"] != "Uploaded chunk 1" {
+		t.Errorf("The progress message was written as %s", lines[0])
+	}
+	if records[1]["type"] != "log" || records[1]["level"] != "WARN" || records[1]["message"] != "Retrying \"chunk\"" {
+		t.Errorf("The warning was written as %s", lines[1])
+	}
+	revision, _ := records[2]["data"].(map[string]interface{})
+	if records[2]["type"] != "revision" || revision["revision"] != float64(3) {
+		t.Errorf("The revision was written as %s", lines[2])
+	}
+	summary, _ := records[3]["data"].(map[string]interface{})
+	if records[3]["type"] != "result" || records[3]["command"] != "backup" || records[3]["success"] != true ||
+		summary["new_files"] != float64(2) {
+		t.Errorf("The result was written as %s", lines[3])
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+// SetKeepLast makes prune keep the latest 'n' revisions of every snapshot id no matter which revisions the
+// retention policies, tags, or revision numbers select, so that a storage never ends up with fewer than 'n'
+// revisions of any id even if backups stop running while prune keeps running.
+func (manager *SnapshotManager) SetKeepLast(n int) {
+	manager.keepLast = n
+}
+
+// unflagLastSnapshots removes the deletion marks from the latest revisions of each snapshot id protected by
+// SetKeepLast and returns the number of snapshots affected.
+func (manager *SnapshotManager) unflagLastSnapshots(allSnapshots map[string][]*Snapshot) int {
+
+	if manager.keepLast <= 0 {
+		return 0
+	}
+
+	unflagged := 0
+	for _, snapshots := range allSnapshots {
+		// Snapshots are sorted by revision
+		for i := len(snapshots) - 1; i >= 0 && i >= len(snapshots)-manager.keepLast; i-- {
+			snapshot := snapshots[i]
+			if snapshot.Flag {
+				LOG_INFO("SNAPSHOT_KEEP", "Snapshot %s at revision %d is one of the latest %d revisions and will not "+
+					"be deleted", snapshot.ID, snapshot.Revision, manager.keepLast)
+				snapshot.Flag = false
+				unflagged++
+			}
+		}
+	}
+	return unflagged
+}
@@ -0,0 +1,47 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPruneKeepLast(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	// Backups stopped running 100 days ago
+	chunkSize := 1024
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	for i := 0; i < 5; i++ {
+		startTime := now - int64(105-i)*day
+		createTestSnapshot(snapshotManager, "vm1@host1", i+1, startTime, startTime+60,
+			[]string{uploadRandomChunk(snapshotManager, chunkSize)}, "")
+	}
+	checkTestSnapshots(snapshotManager, 5, 0)
+
+	t.Logf("Removing all snapshots older than 30 days while keeping the last 2")
+	snapshotManager.SetKeepLast(2)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{"0:30"}, false, true,
+		[]string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 0)
+
+	t.Logf("Removing revision 5 explicitly")
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{5}, []string{}, []string{}, false, true,
+		[]string{}, false, false, false, 1)
+
+	revisions, _ := snapshotManager.ListSnapshotRevisions("vm1@host1")
+	if len(revisions) != 2 || revisions[0] != 4 || revisions[1] != 5 {
+		t.Errorf("Revisions %v are left instead of 4, 5", revisions)
+	}
+}
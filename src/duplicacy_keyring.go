@@ -10,11 +10,24 @@ import (
 	"github.com/gilbertchen/keyring"
 )
 
+// Passwords are saved in the keychain on macOS or the Secret Service on Linux unless another keyring is selected.
+const defaultKeyring = KeyringSystem
+
 func SetKeyringFile(path string) {
 	// We only use keyring file on Windows
 }
 
-func keyringGet(key string) (value string) {
+func fileKeyringGet(key string) (value string) {
+	LOG_DEBUG("KEYRING_FILE", "The keyring file is only available on Windows")
+	return ""
+}
+
+func fileKeyringSet(key string, value string) bool {
+	LOG_DEBUG("KEYRING_FILE", "The keyring file is only available on Windows")
+	return false
+}
+
+func systemKeyringGet(key string) (value string) {
 	value, err := keyring.Get("duplicacy", key)
 	if err != nil {
 		LOG_DEBUG("KEYRING_GET", "Failed to get the value from the keyring: %v", err)
@@ -22,9 +35,11 @@ func keyringGet(key string) (value string) {
 	return value
 }
 
-func keyringSet(key string, value string) {
+func systemKeyringSet(key string, value string) bool {
 	err := keyring.Set("duplicacy", key, value)
 	if err != nil {
 		LOG_DEBUG("KEYRING_GET", "Failed to store the value to the keyring: %v", err)
+		return false
 	}
+	return true
 }
@@ -11,6 +11,10 @@ import (
 	"unsafe"
 )
 
+// Passwords are saved in the keyring file unless another keyring is selected, as they were before the Credential
+// Manager was supported.
+const defaultKeyring = KeyringFile
+
 var keyringFile string
 
 var (
@@ -20,6 +24,11 @@ var (
 	procEncryptData = dllcrypt32.NewProc("CryptProtectData")
 	procDecryptData = dllcrypt32.NewProc("CryptUnprotectData")
 	procLocalFree   = dllkernel32.NewProc("LocalFree")
+
+	procCredRead   = modAdvapi32.NewProc("CredReadW")
+	procCredWrite  = modAdvapi32.NewProc("CredWriteW")
+	procCredDelete = modAdvapi32.NewProc("CredDeleteW")
+	procCredFree   = modAdvapi32.NewProc("CredFree")
 )
 
 type DATA_BLOB struct {
@@ -27,6 +36,29 @@ type DATA_BLOB struct {
 	pbData *byte
 }
 
+const (
+	CRED_TYPE_GENERIC          = 1
+	CRED_PERSIST_LOCAL_MACHINE = 2
+
+	ERROR_NOT_FOUND = 1168
+)
+
+// CREDENTIALW
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
 func SetKeyringFile(path string) {
 	keyringFile = path
 }
@@ -80,7 +112,7 @@ func keyringDecrypt(value []byte) ([]byte, error) {
 	return decryptedData, nil
 }
 
-func keyringGet(key string) (value string) {
+func fileKeyringGet(key string) (value string) {
 	if keyringFile == "" {
 		LOG_DEBUG("KEYRING_NOT_INITIALIZED", "Keyring file not set")
 		return ""
@@ -114,7 +146,7 @@ func keyringGet(key string) (value string) {
 	return string(valueInBytes)
 }
 
-func keyringSet(key string, value string) bool {
+func fileKeyringSet(key string, value string) bool {
 	if value == "" {
 		return false
 	}
@@ -168,3 +200,71 @@ func keyringSet(key string, value string) bool {
 
 	return true
 }
+
+// getCredentialTarget returns the name under which the value is saved in the Credential Manager.
+func getCredentialTarget(key string) string {
+	return "duplicacy:" + key
+}
+
+func systemKeyringGet(key string) (value string) {
+	target, err := syscall.UTF16PtrFromString(getCredentialTarget(key))
+	if err != nil {
+		return ""
+	}
+
+	var result *credential
+	r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), CRED_TYPE_GENERIC, 0,
+		uintptr(unsafe.Pointer(&result)))
+	if r == 0 {
+		if errno, ok := err.(syscall.Errno); !ok || errno != ERROR_NOT_FOUND {
+			LOG_DEBUG("KEYRING_GET", "Failed to get the value from the Credential Manager: %v", err)
+		}
+		return ""
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(result)))
+
+	if result.CredentialBlobSize == 0 {
+		return ""
+	}
+	valueInBytes := make([]byte, result.CredentialBlobSize)
+	address := uintptr(unsafe.Pointer(result.CredentialBlob))
+	for i := 0; i < len(valueInBytes); i++ {
+		valueInBytes[i] = *(*byte)(unsafe.Pointer(address + uintptr(i)))
+	}
+	return string(valueInBytes)
+}
+
+func systemKeyringSet(key string, value string) bool {
+	target, err := syscall.UTF16PtrFromString(getCredentialTarget(key))
+	if err != nil {
+		return false
+	}
+
+	if value == "" {
+		r, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(target)), CRED_TYPE_GENERIC, 0)
+		if r == 0 {
+			if errno, ok := err.(syscall.Errno); !ok || errno != ERROR_NOT_FOUND {
+				LOG_DEBUG("KEYRING_SET", "Failed to remove the value from the Credential Manager: %v", err)
+				return false
+			}
+		}
+		return true
+	}
+
+	userName, _ := syscall.UTF16PtrFromString(key)
+	valueInBytes := []byte(value)
+	cred := credential{
+		Type:               CRED_TYPE_GENERIC,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(valueInBytes)),
+		CredentialBlob:     &valueInBytes[0],
+		Persist:            CRED_PERSIST_LOCAL_MACHINE,
+		UserName:           userName,
+	}
+	r, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if r == 0 {
+		LOG_DEBUG("KEYRING_SET", "Failed to store the value to the Credential Manager: %v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"runtime"
+)
+
+// The keyrings where passwords and tokens are saved, selected by Preference.Keyring.
+const (
+	KeyringSystem = "system" // the macOS Keychain, the Windows Credential Manager, or the freedesktop Secret Service
+	KeyringFile   = "file"   // the keyring file in the .duplicacy directory, encrypted for the Windows user
+	KeyringNone   = "none"   // passwords are never saved, so they must be provided by the preferences or env
+)
+
+// GetKeyringNames returns the keyrings available on this platform.
+func GetKeyringNames() []string {
+	if runtime.GOOS == "windows" {
+		return []string{KeyringSystem, KeyringFile, KeyringNone}
+	}
+	return []string{KeyringSystem, KeyringNone}
+}
+
+// getKeyring returns the keyring selected for the storage.
+func getKeyring(preference Preference) string {
+	if preference.Keyring == "" {
+		return defaultKeyring
+	}
+	return preference.Keyring
+}
+
+func keyringGet(keyring string, key string) (value string) {
+	switch keyring {
+	case KeyringNone:
+		return ""
+	case KeyringFile:
+		return fileKeyringGet(key)
+	default:
+		return systemKeyringGet(key)
+	}
+}
+
+func keyringSet(keyring string, key string, value string) bool {
+	switch keyring {
+	case KeyringNone:
+		return false
+	case KeyringFile:
+		return fileKeyringSet(key, value)
+	default:
+		return systemKeyringSet(key, value)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"testing"
+)
+
+func TestKeyringSelection(t *testing.T) {
+
+	setTestingT(t)
+
+	if keyring := getKeyring(Preference{}); keyring != defaultKeyring {
+		t.Errorf("The default keyring is %s", keyring)
+	}
+	if keyring := getKeyring(Preference{Keyring: KeyringNone}); keyring != KeyringNone {
+		t.Errorf("The selected keyring is %s", keyring)
+	}
+
+	if keyringSet(KeyringNone, "test_password", "secret") || keyringGet(KeyringNone, "test_password") != "" {
+		t.Errorf("A password was saved without a keyring")
+	}
+
+	savedRunInBackground := RunInBackground
+	RunInBackground = true
+	defer func() { RunInBackground = savedRunInBackground }()
+
+	preference := Preference{Name: "offsite", Keyring: KeyringNone, Keys: map[string]string{"password": "stored"}}
+	if password := GetPassword(preference, "password", "", false, false); password != "stored" {
+		t.Errorf("The password from the preferences is '%s'", password)
+	}
+	preference.Keys = nil
+	if password := GetPassword(preference, "password", "", false, false); password != "" {
+		t.Errorf("The password without a keyring is '%s'", password)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// The file in the snapshot cache that keeps track of chunks that have been re-wrapped, so an interrupted rotation
+// can be resumed.  Note that it contains the chunk ids not chunk hashes.
+var rotatedChunksFile = "rotated_chunks"
+
+// RotateRSAKey re-wraps the random key of every RSA encrypted file chunk under the public key in 'newKeyFile'.  The
+// private key of the current key pair must have been loaded.  Each chunk file has to be rewritten since the wrapped
+// key is stored in the chunk itself, but the chunk ids don't change, so existing snapshots remain restorable with the
+// new private key.  Once all chunks have been processed the config is uploaded with the new public key and an
+// incremented key generation.
+func (manager *SnapshotManager) RotateRSAKey(newKeyFile string, password string, iterations int, threads int) bool {
+
+	if manager.config.rsaPublicKey == nil {
+		LOG_ERROR("KEY_ROTATE", "The storage was not encrypted by an RSA key")
+		return false
+	}
+
+	if manager.config.rsaPrivateKey == nil {
+		LOG_ERROR("KEY_ROTATE", "The current private key is required to rotate the RSA key")
+		return false
+	}
+
+	newConfig := *manager.config
+	newConfig.rsaPublicKey = nil
+	newConfig.loadRSAPublicKey(newKeyFile)
+	if newConfig.rsaPublicKey == nil {
+		return false
+	}
+	newConfig.RSAKeyGeneration++
+
+	if threads < 1 {
+		threads = 1
+	}
+
+	rotatedChunks := make(map[string]int)
+	if manager.snapshotCache != nil {
+		description, err := ioutil.ReadFile(path.Join(manager.snapshotCache.storageDir, rotatedChunksFile))
+		if err == nil {
+			err = json.Unmarshal(description, &rotatedChunks)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			LOG_WARN("KEY_ROTATE", "Failed to load the list of re-wrapped chunks: %v", err)
+		}
+	}
+
+	var lock sync.Mutex
+	saveRotatedChunks := func() {
+		if manager.snapshotCache == nil {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		description, err := json.Marshal(rotatedChunks)
+		if err == nil {
+			err = manager.snapshotCache.UploadFile(0, rotatedChunksFile, description)
+		}
+		if err != nil {
+			LOG_WARN("KEY_ROTATE", "Failed to save the list of re-wrapped chunks: %v", err)
+		}
+	}
+	defer saveRotatedChunks()
+	RunAtError = saveRotatedChunks
+
+	LOG_INFO("KEY_ROTATE", "Listing all chunks")
+	allChunks, _ := manager.ListAllFiles(manager.storage, chunkDir)
+
+	chunkQueue := make(chan string, threads)
+	var wait sync.WaitGroup
+	numberOfRotatedChunks := 0
+	numberOfFailedChunks := 0
+
+	for i := 0; i < threads; i++ {
+		wait.Add(1)
+		go func(threadIndex int) {
+			defer CatchLogException()
+			defer wait.Done()
+			chunk := CreateChunk(manager.config, true)
+			newChunk := CreateChunk(&newConfig, true)
+			for file := range chunkQueue {
+				chunkID := strings.Replace(strings.TrimSuffix(file, ".fsl"), "/", "", -1)
+				rotated := manager.rotateChunk(threadIndex, chunkDir+file, chunkID, chunk, newChunk)
+
+				lock.Lock()
+				if rotated {
+					rotatedChunks[chunkID] = newConfig.RSAKeyGeneration
+					numberOfRotatedChunks++
+				} else {
+					numberOfFailedChunks++
+				}
+				lock.Unlock()
+			}
+		}(i)
+	}
+
+	skippedChunks := 0
+	for _, file := range allChunks {
+		if len(file) == 0 || file[len(file)-1] == '/' || strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+		chunkID := strings.Replace(strings.TrimSuffix(file, ".fsl"), "/", "", -1)
+		if generation, found := rotatedChunks[chunkID]; found && generation == newConfig.RSAKeyGeneration {
+			skippedChunks++
+			continue
+		}
+		chunkQueue <- file
+	}
+	close(chunkQueue)
+	wait.Wait()
+
+	if skippedChunks > 0 {
+		LOG_INFO("KEY_ROTATE", "Skipped %d chunks that have already been re-wrapped", skippedChunks)
+	}
+	LOG_INFO("KEY_ROTATE", "Processed %d chunks", numberOfRotatedChunks)
+
+	if numberOfFailedChunks > 0 {
+		LOG_ERROR("KEY_ROTATE", "%d chunks could not be re-wrapped; run the command again to retry", numberOfFailedChunks)
+		return false
+	}
+
+	if !manager.replaceConfig(&newConfig, password, iterations) {
+		return false
+	}
+
+	if manager.snapshotCache != nil {
+		os.Remove(path.Join(manager.snapshotCache.storageDir, rotatedChunksFile))
+	}
+	rotatedChunks = nil
+
+	manager.config.rsaPublicKey = newConfig.rsaPublicKey
+	manager.config.rsaPrivateKey = nil
+	manager.config.RSAKeyGeneration = newConfig.RSAKeyGeneration
+	LOG_INFO("KEY_ROTATE", "The RSA key has been rotated to generation %d", newConfig.RSAKeyGeneration)
+	return true
+}
+
+// replaceConfig replaces the config in the storage with 'newConfig'.  A local copy of the old config is kept until the
+// new one has been uploaded, in case the upload fails after the old config has been deleted.
+func (manager *SnapshotManager) replaceConfig(newConfig *Config, password string, iterations int) bool {
+
+	description, err := json.MarshalIndent(manager.config, "", "    ")
+	if err != nil {
+		LOG_ERROR("CONFIG_MARSHAL", "Failed to marshal the config: %v", err)
+		return false
+	}
+	configPath := path.Join(GetDuplicacyPreferencePath(), "config")
+	err = ioutil.WriteFile(configPath, description, 0600)
+	if err != nil {
+		LOG_ERROR("CONFIG_SAVE", "Failed to save the old config to %s: %v", configPath, err)
+		return false
+	}
+
+	err = manager.storage.DeleteFile(0, "config")
+	if err != nil {
+		LOG_ERROR("CONFIG_DELETE", "Failed to delete the old config from the storage: %v", err)
+		return false
+	}
+
+	if !UploadConfig(manager.storage, newConfig, password, iterations) {
+		LOG_ERROR("CONFIG_UPLOAD", "Failed to upload the new config; the old config has been saved to %s", configPath)
+		return false
+	}
+
+	os.Remove(configPath)
+	return true
+}
+
+// rotateChunk re-wraps the key of a single chunk.  Chunks not encrypted by RSA, such as metadata chunks, are left
+// as they are.
+func (manager *SnapshotManager) rotateChunk(threadIndex int, chunkPath string, chunkID string, chunk *Chunk, newChunk *Chunk) bool {
+
+	chunk.Reset(false)
+	err := manager.storage.DownloadFile(threadIndex, chunkPath, chunk)
+	if err != nil {
+		LOG_WARN("KEY_ROTATE", "Failed to download the chunk %s: %v", chunkID, err)
+		return false
+	}
+
+	if GetChunkEncryption(chunk.GetBytes()) != ChunkEncryptionRSAKey {
+		LOG_DEBUG("KEY_ROTATE", "Chunk %s is not encrypted by the RSA key", chunkID)
+		return true
+	}
+
+	content := chunk.GetBytes()
+	if len(content) > len(ERASURE_CODING_BANNER) && string(content[:len(ERASURE_CODING_BANNER)]) == ERASURE_CODING_BANNER {
+		// The wrapped key is protected by erasure coding, so the chunk must be decrypted and encoded again
+		err = chunk.Decrypt(manager.config.ChunkKey, "")
+		if err == nil && chunk.GetID() != chunkID {
+			LOG_WARN("KEY_ROTATE", "The chunk %s has a hash id of %s", chunkID, chunk.GetID())
+			return false
+		}
+		if err == nil {
+			newChunk.Reset(true)
+			newChunk.Write(chunk.GetBytes())
+			err = newChunk.Encrypt(newChunk.config.ChunkKey, newChunk.GetHash(), false)
+		}
+		content = newChunk.GetBytes()
+	} else {
+		err = chunk.RewrapRSAKey(manager.config.rsaPrivateKey, newChunk.config.rsaPublicKey)
+		content = chunk.GetBytes()
+	}
+
+	if err != nil {
+		LOG_WARN("KEY_ROTATE", "Failed to re-wrap the chunk %s: %v", chunkID, err)
+		return false
+	}
+
+	err = manager.storage.UploadFile(threadIndex, chunkPath, content)
+	if err != nil {
+		LOG_WARN("KEY_ROTATE", "Failed to upload the chunk %s: %v", chunkID, err)
+		return false
+	}
+
+	LOG_DEBUG("KEY_ROTATE", "The key of chunk %s has been re-wrapped", chunkID)
+	return true
+}
@@ -0,0 +1,356 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// The banner of the config file whose master key is wrapped by a key management service.  It is followed by the
+// length of the header, the header in json, and the encrypted content.
+var KMS_CONFIG_BANNER = "duplicacy\002"
+
+// The length of the random data key wrapped by the key management service
+var KMS_DATA_KEY_LENGTH = 32
+
+// KeyManagementService wraps and unwraps the data key from which the master key of the storage is derived, so that
+// the storage can't be decrypted once access to the key in the service is revoked.
+type KeyManagementService interface {
+	WrapKey(key []byte) (wrapped []byte, err error)
+	UnwrapKey(wrapped []byte) (key []byte, err error)
+}
+
+// CreateKeyManagementService returns the service identified by the uri, which is one of:
+//
+//	vault://<mount>/<key>    HashiCorp Vault transit, located by VAULT_ADDR and authenticated by VAULT_TOKEN
+//	awskms://<key>           AWS KMS, where the key is a key id, an alias, or an arn
+//	gcpkms://projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>    GCP Cloud KMS
+//
+// AWS and GCP credentials are found the same way as by their own command line tools.
+func CreateKeyManagementService(uri string) (KeyManagementService, error) {
+	switch {
+	case strings.HasPrefix(uri, "vault://"):
+		path := strings.Trim(uri[len("vault://"):], "/")
+		separator := strings.LastIndex(path, "/")
+		if separator <= 0 {
+			return nil, fmt.Errorf("The vault key '%s' must be in the form of vault://<mount>/<key>", uri)
+		}
+		return createVaultTransit(path[:separator], path[separator+1:])
+	case strings.HasPrefix(uri, "awskms://"):
+		return createAWSKMS(uri[len("awskms://"):])
+	case strings.HasPrefix(uri, "gcpkms://"):
+		return createGCPKMS(uri[len("gcpkms://"):])
+	default:
+		return nil, fmt.Errorf("Unsupported key management service '%s'", uri)
+	}
+}
+
+// The header of the config file stored after KMS_CONFIG_BANNER.  If the storage is also encrypted with a password,
+// the salt and the iterations are those used for deriving the key from the password.
+type kmsConfigHeader struct {
+	KMS        string `json:"kms"`
+	WrappedKey []byte `json:"wrapped-key"`
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+}
+
+// getKMSMasterKey returns the key that encrypts the config file.  Without a password it is the data key itself;
+// otherwise it is derived from both the data key and the password, so neither the service nor the password alone
+// can decrypt the storage.
+func getKMSMasterKey(dataKey []byte, password string, salt []byte, iterations int) []byte {
+	if password == "" {
+		return dataKey
+	}
+	hasher := hmac.New(sha256.New, dataKey)
+	hasher.Write(GenerateKeyFromPassword(password, salt, iterations))
+	return hasher.Sum(nil)
+}
+
+// wrapConfigKey returns the master key and the header of a config file wrapped by the key management service of the
+// config.  The data key is generated and wrapped the first time; after that the same data key is kept so that a
+// password change doesn't need the service to wrap a new one.
+func (config *Config) wrapConfigKey(password string, salt []byte, iterations int) (masterKey []byte, header []byte, err error) {
+
+	if config.kmsDataKey == nil {
+		service, err := CreateKeyManagementService(config.kmsURI)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dataKey := make([]byte, KMS_DATA_KEY_LENGTH)
+		if _, err = rand.Read(dataKey); err != nil {
+			return nil, nil, fmt.Errorf("Failed to generate the data key: %v", err)
+		}
+
+		wrappedKey, err := service.WrapKey(dataKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to wrap the data key with %s: %v", config.kmsURI, err)
+		}
+		config.kmsDataKey = dataKey
+		config.kmsWrappedKey = wrappedKey
+	}
+
+	configHeader := kmsConfigHeader{
+		KMS:        config.kmsURI,
+		WrappedKey: config.kmsWrappedKey,
+	}
+	if password != "" {
+		configHeader.Salt = salt
+		configHeader.Iterations = iterations
+	}
+
+	header, err = json.Marshal(configHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return getKMSMasterKey(config.kmsDataKey, password, salt, iterations), header, nil
+}
+
+// parseKMSConfig splits a config file starting with KMS_CONFIG_BANNER into the header and the encrypted content.
+func parseKMSConfig(content []byte) (header *kmsConfigHeader, encrypted []byte, err error) {
+	content = content[len(KMS_CONFIG_BANNER):]
+	if len(content) < 4 {
+		return nil, nil, fmt.Errorf("The config file has an invalid header")
+	}
+
+	headerLength := int(binary.LittleEndian.Uint32(content[:4]))
+	if headerLength > len(content)-4 {
+		return nil, nil, fmt.Errorf("The config file has an invalid header")
+	}
+
+	header = &kmsConfigHeader{}
+	if err = json.Unmarshal(content[4:4+headerLength], header); err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse the config header: %v", err)
+	}
+
+	return header, content[4+headerLength:], nil
+}
+
+// unwrapConfigKey asks the key management service in the header to unwrap the data key, and returns the data key along
+// with the master key that decrypts the config file.
+func unwrapConfigKey(header *kmsConfigHeader, password string) (dataKey []byte, masterKey []byte, err error) {
+	service, err := CreateKeyManagementService(header.KMS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	LOG_DEBUG("CONFIG_KMS", "Unwrapping the storage key with %s", header.KMS)
+	dataKey, err = service.UnwrapKey(header.WrappedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to unwrap the storage key with %s: %v", header.KMS, err)
+	}
+
+	return dataKey, getKMSMasterKey(dataKey, password, header.Salt, header.Iterations), nil
+}
+
+// vaultTransit wraps keys with the transit secrets engine of HashiCorp Vault.
+type vaultTransit struct {
+	address   string
+	token     string
+	namespace string
+	mount     string
+	key       string
+	client    *http.Client
+}
+
+func createVaultTransit(mount string, key string) (*vaultTransit, error) {
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		address = "https://127.0.0.1:8200"
+	}
+
+	// Like the vault command, read the token saved by 'vault login' if it isn't in the environment
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			content, _ := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(content))
+		}
+	}
+	if token == "" {
+		return nil, fmt.Errorf("No vault token is set in VAULT_TOKEN")
+	}
+
+	return &vaultTransit{
+		address:   strings.TrimRight(address, "/"),
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		mount:     mount,
+		key:       key,
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// call sends the request to the encrypt or decrypt endpoint of the transit key and returns the named field of the
+// response data.
+func (vault *vaultTransit) call(operation string, request map[string]string, field string) (string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", vault.address, vault.mount, operation, vault.key)
+	httpRequest, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpRequest.Header.Set("X-Vault-Token", vault.token)
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if vault.namespace != "" {
+		httpRequest.Header.Set("X-Vault-Namespace", vault.namespace)
+	}
+
+	response, err := vault.client.Do(httpRequest)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var output struct {
+		Errors []string          `json:"errors"`
+		Data   map[string]string `json:"data"`
+	}
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	json.Unmarshal(content, &output)
+
+	if response.StatusCode != http.StatusOK {
+		if len(output.Errors) > 0 {
+			return "", fmt.Errorf("%s", strings.Join(output.Errors, "; "))
+		}
+		return "", fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
+	value, found := output.Data[field]
+	if !found {
+		return "", fmt.Errorf("%s returned no %s", url, field)
+	}
+	return value, nil
+}
+
+func (vault *vaultTransit) WrapKey(key []byte) ([]byte, error) {
+	ciphertext, err := vault.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}, "ciphertext")
+	if err != nil {
+		return nil, err
+	}
+	// The ciphertext is a string like 'vault:v1:...' so it is stored as is
+	return []byte(ciphertext), nil
+}
+
+func (vault *vaultTransit) UnwrapKey(wrapped []byte) ([]byte, error) {
+	plaintext, err := vault.call("decrypt", map[string]string{"ciphertext": string(wrapped)}, "plaintext")
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+// awsKMS wraps keys with a symmetric key in AWS KMS.
+type awsKMS struct {
+	keyID  string
+	client *kms.KMS
+}
+
+func createAWSKMS(keyID string) (*awsKMS, error) {
+	config := aws.NewConfig()
+
+	// An arn names the region of the key; otherwise the region comes from AWS_REGION or the shared config
+	if strings.HasPrefix(keyID, "arn:") {
+		if fields := strings.Split(keyID, ":"); len(fields) > 3 && fields[3] != "" {
+			config.Region = aws.String(fields[3])
+		}
+	}
+
+	awsSession, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsKMS{keyID: keyID, client: kms.New(awsSession)}, nil
+}
+
+func (service *awsKMS) WrapKey(key []byte) ([]byte, error) {
+	output, err := service.client.Encrypt(&kms.EncryptInput{
+		KeyId:     aws.String(service.keyID),
+		Plaintext: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.CiphertextBlob, nil
+}
+
+func (service *awsKMS) UnwrapKey(wrapped []byte) ([]byte, error) {
+	// The ciphertext identifies the key used to encrypt it
+	output, err := service.client.Decrypt(&kms.DecryptInput{
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
+
+// gcpKMS wraps keys with a symmetric key in GCP Cloud KMS, using the application default credentials.
+type gcpKMS struct {
+	name    string
+	service *cloudkms.Service
+}
+
+func createGCPKMS(name string) (*gcpKMS, error) {
+	if !strings.HasPrefix(name, "projects/") || !strings.Contains(name, "/cryptoKeys/") {
+		return nil, fmt.Errorf("The key '%s' must be in the form of projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>", name)
+	}
+
+	service, err := cloudkms.NewService(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcpKMS{name: name, service: service}, nil
+}
+
+func (service *gcpKMS) WrapKey(key []byte) ([]byte, error) {
+	response, err := service.service.Projects.Locations.KeyRings.CryptoKeys.Encrypt(service.name,
+		&cloudkms.EncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(key)}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.Ciphertext)
+}
+
+func (service *gcpKMS) UnwrapKey(wrapped []byte) ([]byte, error) {
+	response, err := service.service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(service.name,
+		&cloudkms.DecryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(wrapped)}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.Plaintext)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKMSConfig(t *testing.T) {
+
+	setTestingT(t)
+
+	// A fake vault transit engine that keeps the plaintexts by ciphertext, and denies access once revoked
+	var mutex sync.Mutex
+	plaintexts := make(map[string]string)
+	revoked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if r.Header.Get("X-Vault-Token") != "test-token" || revoked {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		response := make(map[string]string)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/duplicacy":
+			ciphertext := "vault:v1:" + string(rune('a'+len(plaintexts)))
+			plaintexts[ciphertext] = request["plaintext"]
+			response["ciphertext"] = ciphertext
+		case "/v1/transit/decrypt/duplicacy":
+			response["plaintext"] = plaintexts[request["ciphertext"]]
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": response})
+	}))
+	defer server.Close()
+
+	for name, value := range map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"} {
+		saved, found := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if found {
+			defer os.Setenv(name, saved)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "kms")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	storage, err := CreateFileStorage(testDir, false, 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	// Without a password the storage is still encrypted, with the key unwrapped by vault
+	if !ConfigStorageWithKMS(storage, "vault://transit/duplicacy", 16384, 100, 64*1024, 256*1024, 16*1024, "", nil,
+		false, "", 0, 0, false) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	content := CreateChunk(CreateConfig(), true)
+	if err = storage.DownloadFile(0, "config", content); err != nil {
+		t.Fatalf("Failed to download the config: %v", err)
+	}
+	if !bytes.HasPrefix(content.GetBytes(), []byte(KMS_CONFIG_BANNER)) || bytes.Contains(content.GetBytes(), []byte("chunk-key")) {
+		t.Errorf("The config file isn't wrapped by the key management service")
+	}
+
+	config, _, err := DownloadConfig(storage, "")
+	if err != nil || config == nil {
+		t.Fatalf("Failed to download the config: %v", err)
+	}
+	if len(config.ChunkKey) == 0 {
+		t.Errorf("The storage isn't encrypted")
+	}
+	chunkKey := config.ChunkKey
+
+	// Adding a password keeps the wrapped key, and then both are needed
+	storage.DeleteFile(0, "config")
+	if !UploadConfig(storage, config, "test-password", 16384) {
+		t.Fatalf("Failed to change the password")
+	}
+	if len(plaintexts) != 1 {
+		t.Errorf("The data key was wrapped %d times", len(plaintexts))
+	}
+
+	if _, isEncrypted, err := DownloadConfig(storage, ""); err == nil || !isEncrypted {
+		t.Errorf("The config was downloaded without the password")
+	}
+	if _, _, err := DownloadConfig(storage, "wrong-password"); err == nil {
+		t.Errorf("The config was downloaded with a wrong password")
+	}
+	config, _, err = DownloadConfig(storage, "test-password")
+	if err != nil || config == nil {
+		t.Fatalf("Failed to download the config with the password: %v", err)
+	}
+	if !bytes.Equal(config.ChunkKey, chunkKey) {
+		t.Errorf("The chunk key was changed by the password")
+	}
+
+	// Revoking access to the key makes the storage undecryptable
+	mutex.Lock()
+	revoked = true
+	mutex.Unlock()
+	if _, _, err := DownloadConfig(storage, "test-password"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("The config was downloaded after the key was revoked: %v", err)
+	}
+
+	if _, err := CreateKeyManagementService("vault://duplicacy"); err == nil {
+		t.Errorf("A vault key without a mount was accepted")
+	}
+	if _, err := CreateKeyManagementService("azurekv://duplicacy"); err == nil {
+		t.Errorf("An unknown key management service was accepted")
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// The known chunk filter is saved in the snapshot cache directory under this name.
+const knownChunksFile = "known_chunks"
+
+var knownChunksMagic = [8]byte{'D', 'U', 'P', 'B', 'L', 'O', 'O', 'M'}
+
+// The false positive rate of a filter holding as many chunks as its capacity.  With 1%, about 10 bits are needed for
+// each chunk.
+const knownChunksFalsePositiveRate = 0.01
+
+// knownChunksHeader is the fixed-size header preceding the bits of a saved filter.
+type knownChunksHeader struct {
+	Magic    [8]byte
+	Hashes   uint32
+	Bits     uint64
+	Capacity uint64
+	Count    uint64
+}
+
+// knownChunkFilter is a bloom filter of the chunks present in the storage, rebuilt from the chunk listing by the
+// check command and updated by backups with the chunks they upload or find.  A chunk not in the filter was not in
+// the storage when the filter was rebuilt, so backups upload it without looking it up first.  A chunk in the filter
+// is still looked up, because of the false positives and because the chunk may have been pruned since.  A chunk
+// uploaded by another repository after the rebuild may then be uploaded again, which is harmless as chunks are
+// named after their content.
+type knownChunkFilter struct {
+	lock     sync.Mutex
+	hashes   uint32
+	bits     []uint64
+	capacity uint64 // the number of chunks the filter is sized for
+	count    uint64 // the number of chunks added, not counting those already appearing to be in the filter
+	modified bool   // whether chunks have been added since the filter was loaded
+}
+
+// createKnownChunkFilter creates an empty filter sized for 'capacity' chunks.
+func createKnownChunkFilter(capacity int) *knownChunkFilter {
+	if capacity < 1024 {
+		capacity = 1024
+	}
+
+	numberOfBits := uint64(math.Ceil(-float64(capacity) * math.Log(knownChunksFalsePositiveRate) /
+		(math.Ln2 * math.Ln2)))
+	hashes := uint32(math.Round(float64(numberOfBits) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	return &knownChunkFilter{
+		hashes:   hashes,
+		bits:     make([]uint64, (numberOfBits+63)/64),
+		capacity: uint64(capacity),
+	}
+}
+
+// positions calls 'handler' with the index of each bit representing the chunk.
+func (filter *knownChunkFilter) positions(chunkID string, handler func(word int, mask uint64)) {
+	sum := sha256.Sum256([]byte(chunkID))
+	h1 := binary.LittleEndian.Uint64(sum[0:8])
+	h2 := binary.LittleEndian.Uint64(sum[8:16]) | 1
+	numberOfBits := uint64(len(filter.bits)) * 64
+	for i := uint64(0); i < uint64(filter.hashes); i++ {
+		bit := (h1 + i*h2) % numberOfBits
+		handler(int(bit/64), uint64(1)<<(bit%64))
+	}
+}
+
+// add records that the chunk exists in the storage.  It does nothing on a nil filter.
+func (filter *knownChunkFilter) add(chunkID string) {
+	if filter == nil {
+		return
+	}
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+
+	added := false
+	filter.positions(chunkID, func(word int, mask uint64) {
+		if filter.bits[word]&mask == 0 {
+			filter.bits[word] |= mask
+			added = true
+		}
+	})
+	if added {
+		filter.count++
+		filter.modified = true
+	}
+}
+
+// mayContain returns false if the chunk is certainly not in the filter.  A nil filter may contain any chunk.
+func (filter *knownChunkFilter) mayContain(chunkID string) bool {
+	if filter == nil {
+		return true
+	}
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+
+	found := true
+	filter.positions(chunkID, func(word int, mask uint64) {
+		if filter.bits[word]&mask == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// save writes the filter to the snapshot cache directory, replacing the previous one.
+func (filter *knownChunkFilter) save(cacheDir string) error {
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+
+	file, err := ioutil.TempFile(cacheDir, knownChunksFile+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	header := knownChunksHeader{
+		Magic:    knownChunksMagic,
+		Hashes:   filter.hashes,
+		Bits:     uint64(len(filter.bits)) * 64,
+		Capacity: filter.capacity,
+		Count:    filter.count,
+	}
+
+	writer := bufio.NewWriter(file)
+	if err = binary.Write(writer, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err = binary.Write(writer, binary.LittleEndian, filter.bits); err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(file.Name(), path.Join(cacheDir, knownChunksFile)); err != nil {
+		return err
+	}
+	filter.modified = false
+	return nil
+}
+
+// loadKnownChunkFilter reads the filter saved in the snapshot cache directory.  It returns nil, nil if there is none.
+func loadKnownChunkFilter(cacheDir string) (*knownChunkFilter, error) {
+
+	file, err := os.Open(path.Join(cacheDir, knownChunksFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var header knownChunksHeader
+	if err = binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != knownChunksMagic || header.Hashes == 0 || header.Bits == 0 || header.Bits%64 != 0 {
+		return nil, fmt.Errorf("invalid header")
+	}
+	if info, err := file.Stat(); err == nil && uint64(info.Size()) < header.Bits/8 {
+		return nil, fmt.Errorf("the file is truncated")
+	}
+
+	filter := &knownChunkFilter{
+		hashes:   header.Hashes,
+		bits:     make([]uint64, header.Bits/64),
+		capacity: header.Capacity,
+		count:    header.Count,
+	}
+	if err = binary.Read(reader, binary.LittleEndian, filter.bits); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("the file is truncated")
+		}
+		return nil, err
+	}
+	return filter, nil
+}
+
+// loadKnownChunks loads the known chunk filter for a backup to the snapshot cache, if the check command has built
+// one.
+func (manager *BackupManager) loadKnownChunks() *knownChunkFilter {
+	if manager.snapshotCache == nil {
+		return nil
+	}
+
+	filter, err := loadKnownChunkFilter(manager.snapshotCache.storageDir)
+	if err != nil {
+		LOG_WARN("KNOWN_CHUNKS", "Failed to load the known chunk filter: %v", err)
+		return nil
+	} else if filter == nil {
+		return nil
+	}
+
+	LOG_DEBUG("KNOWN_CHUNKS", "Loaded the filter of %d known chunks", filter.count)
+	if filter.count > filter.capacity {
+		LOG_INFO("KNOWN_CHUNKS", "The known chunk filter is over its capacity; run the check command to rebuild it")
+	}
+	return filter
+}
+
+// saveKnownChunks saves the filter updated with the chunks uploaded or found by a backup.
+func (manager *BackupManager) saveKnownChunks(filter *knownChunkFilter) {
+	if filter == nil || !filter.modified || manager.config.dryRun {
+		return
+	}
+
+	if err := filter.save(manager.snapshotCache.storageDir); err != nil {
+		LOG_WARN("KNOWN_CHUNKS", "Failed to save the known chunk filter: %v", err)
+	}
+}
+
+// rebuildKnownChunks replaces the known chunk filter in the snapshot cache with one built from the chunks listed by
+// the check command.  The filter is sized for twice as many chunks so that it stays accurate while backups add more.
+func (manager *SnapshotManager) rebuildKnownChunks(chunkSizeMap map[string]int64) {
+	if manager.snapshotCache == nil {
+		return
+	}
+
+	filter := createKnownChunkFilter(2 * len(chunkSizeMap))
+	for chunk := range chunkSizeMap {
+		if !strings.HasSuffix(chunk, ".tmp") {
+			filter.add(chunk)
+		}
+	}
+
+	if err := filter.save(manager.snapshotCache.storageDir); err != nil {
+		LOG_WARN("KNOWN_CHUNKS", "Failed to save the known chunk filter: %v", err)
+		return
+	}
+	LOG_DEBUG("KNOWN_CHUNKS", "Saved the filter of %d known chunks", filter.count)
+}
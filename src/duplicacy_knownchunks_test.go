@@ -0,0 +1,161 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestKnownChunkFilter(t *testing.T) {
+
+	filter := createKnownChunkFilter(10000)
+	for i := 0; i < 10000; i++ {
+		filter.add(fmt.Sprintf("chunk%d", i))
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "knownchunks_filter")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	if err := filter.save(testDir); err != nil {
+		t.Fatalf("Failed to save the filter: %v", err)
+	}
+	loaded, err := loadKnownChunkFilter(testDir)
+	if err != nil || loaded == nil {
+		t.Fatalf("Failed to load the filter: %v", err)
+	}
+
+	for i := 0; i < 10000; i++ {
+		if !loaded.mayContain(fmt.Sprintf("chunk%d", i)) {
+			t.Fatalf("The loaded filter doesn't contain chunk%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if loaded.mayContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 200 {
+		t.Errorf("%d false positives out of 10000", falsePositives)
+	}
+
+	os.Truncate(filepath.Join(testDir, knownChunksFile), 100)
+	if _, err := loadKnownChunkFilter(testDir); err == nil {
+		t.Errorf("The truncated filter was loaded")
+	}
+
+	var nilFilter *knownChunkFilter
+	nilFilter.add("chunk")
+	if !nilFilter.mayContain("chunk") {
+		t.Errorf("The nil filter doesn't contain every chunk")
+	}
+}
+
+func TestKnownChunksBackup(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "knownchunks")
+	os.RemoveAll(testDir)
+
+	repository := joinPath(testDir, "repository1")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+
+	// Without a check there is no filter
+	cacheDir := backupManager.snapshotCache.storageDir
+	if filter, _ := loadKnownChunkFilter(cacheDir); filter != nil {
+		t.Errorf("A known chunk filter was created by the backup")
+	}
+
+	if !backupManager.SnapshotManager.CheckSnapshots("host1", nil, "", false, false, false, false, false, false,
+		threads, false) {
+		t.Fatalf("The check failed")
+	}
+
+	listChunks := func() (chunks []string) {
+		files, _ := backupManager.SnapshotManager.ListAllFiles(storage, "chunks/")
+		for _, file := range files {
+			if !strings.HasSuffix(file, "/") {
+				chunks = append(chunks, strings.Replace(file, "/", "", -1))
+			}
+		}
+		return chunks
+	}
+
+	filter, err := loadKnownChunkFilter(cacheDir)
+	if err != nil || filter == nil {
+		t.Fatalf("Failed to load the filter rebuilt by the check: %v", err)
+	}
+	chunks := listChunks()
+	for _, chunk := range chunks {
+		if !filter.mayContain(chunk) {
+			t.Errorf("Chunk %s is missing from the rebuilt filter", chunk)
+		}
+	}
+
+	// The chunks uploaded by the next backup are added to the filter
+	createRandomFile(joinPath(repository, "file2"), 200000)
+	if !backupManager.Backup(repository, true, threads, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+
+	filter, err = loadKnownChunkFilter(cacheDir)
+	if err != nil || filter == nil {
+		t.Fatalf("Failed to load the filter updated by the backup: %v", err)
+	}
+	newChunks := listChunks()
+	if len(newChunks) <= len(chunks) {
+		t.Errorf("The second backup didn't upload any chunks")
+	}
+	for _, chunk := range newChunks {
+		if !filter.mayContain(chunk) {
+			t.Errorf("Chunk %s is missing from the updated filter", chunk)
+		}
+	}
+
+	if !backupManager.SnapshotManager.CheckSnapshots("host1", nil, "", false, false, true, false, false, false,
+		threads, false) {
+		t.Errorf("The check after the second backup failed")
+	}
+}
@@ -6,6 +6,7 @@ package duplicacy
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"log"
 	"runtime/debug"
@@ -35,6 +36,14 @@ func EnableLogHeader() {
 
 var printStackTrace = false
 
+// The writer that logs are printed to; it is changed to the standard error when the standard output is used for
+// file contents
+var logOutput io.Writer = os.Stdout
+
+func SetLogOutput(output io.Writer) {
+	logOutput = output
+}
+
 func EnableStackTrace() {
 	printStackTrace = true
 }
@@ -76,11 +85,22 @@ func getLevelName(level int) string {
 var loggingLevel int
 
 func IsDebugging() bool {
-	return loggingLevel <= DEBUG
+	return getMinimumLoggingLevel() <= DEBUG
 }
 
 func IsTracing() bool {
-	return loggingLevel <= TRACE
+	return getMinimumLoggingLevel() <= TRACE
+}
+
+// getMinimumLoggingLevel returns the lowest logging level in effect for any subsystem.
+func getMinimumLoggingLevel() int {
+	minimum := loggingLevel
+	for _, level := range subsystemLevels {
+		if level < minimum {
+			minimum = level
+		}
+	}
+	return minimum
 }
 
 func SetLoggingLevel(level int) {
@@ -130,12 +150,22 @@ type Exception struct {
 	Message string
 }
 
+// Error returns the message, so that an Exception can be returned as an error.
+func (exception Exception) Error() string {
+	return exception.Message
+}
+
 var logMutex sync.Mutex
 
 func logf(level int, logID string, format string, v ...interface{}) {
 
 	message := fmt.Sprintf(format, v...)
 
+	subsystem := ""
+	if len(subsystemLevels) > 0 || jsonOutput || journalEnabled {
+		subsystem = getLogSubsystem()
+	}
+
 	if LogFunction != nil {
 		LogFunction(level, logID, message)
 		return
@@ -160,18 +190,33 @@ func logf(level int, logID string, format string, v ...interface{}) {
 		logMutex.Lock()
 		defer logMutex.Unlock()
 
-		if level >= loggingLevel {
+		if level >= getSubsystemLevel(subsystem) {
 			if level <= ERROR && len(suppressedLogs) > 0 {
 				if _, found := suppressedLogs[logID]; found {
 					return
 				}
 			}
 
-			if printLogHeader {
-				fmt.Printf("%s %s %s %s\n",
+			writeLogFiles(now, level, logID, message)
+
+			if systemdEnabled && getJSONRecordType(level, logID) == "progress" {
+				updateSystemdStatus(message)
+			}
+
+			if jsonOutput {
+				writeJSONRecord(&JSONRecord{Type: getJSONRecordType(level, logID), Level: getLevelName(level),
+					Subsystem: subsystem, ID: logID, Message: message})
+			} else if journalEnabled && writeJournalRecord(level, logID, subsystem, message) {
+				// Sent to journald with the log id and the subsystem as structured fields
+			} else if eventLogEnabled && writeEventLogRecord(level, logID, message) {
+				// Written to the event log of the Windows service
+			} else if activeProgressBar != nil {
+				printAboveProgressBar(level, logID, message)
+			} else if printLogHeader {
+				fmt.Fprintf(logOutput, "%s %s %s %s\n",
 					now.Format("2006-01-02 15:04:05.000"), getLevelName(level), logID, message)
 			} else {
-				fmt.Printf("%s\n", message)
+				fmt.Fprintf(logOutput, "%s\n", message)
 			}
 		}
 	}
@@ -211,14 +256,94 @@ func init() {
 	log.SetOutput(&Logger{ formatRegex: regexp.MustCompile(`^\[(.+)\]\s*(.+)`) })
 }
 
-const (
-	duplicacyExitCode = 100
-	otherExitCode     = 101
-)
-
 // This is the function to be called before exiting when an error occurs.
 var RunAtError func() = func() {}
 
+// This is the function to be called with the exception that ends the command, after RunAtError, so that the command
+// can report its failure; it is reset before being called, so it only runs once.
+var RunAtFailure func(failure *Exception) = func(failure *Exception) {}
+
+func runAtFailure(failure *Exception) {
+	run := RunAtFailure
+	RunAtFailure = func(failure *Exception) {}
+	run(failure)
+}
+
+// goroutineTasks tracks the tasks of the goroutines transferring chunks during an operation run by Client.  The
+// exceptions raised by the tasks are passed to 'handler' instead of the process being terminated by
+// CatchLogException, and once the operation has ended no more tasks are run, so that goroutines left running by a
+// failed operation don't interfere with the next one.
+type goroutineTasks struct {
+	handler func(exception Exception)
+	lock    sync.Mutex
+	idle    *sync.Cond
+	running int
+	ended   bool
+}
+
+func createGoroutineTasks(handler func(exception Exception)) *goroutineTasks {
+	tasks := &goroutineTasks{handler: handler}
+	tasks.idle = sync.NewCond(&tasks.lock)
+	return tasks
+}
+
+// end waits for the tasks in progress to finish and stops new ones from being run.
+func (tasks *goroutineTasks) end() {
+	tasks.lock.Lock()
+	defer tasks.lock.Unlock()
+	tasks.ended = true
+	for tasks.running > 0 {
+		tasks.idle.Wait()
+	}
+}
+
+// The tasks of the operation being run by Client, if any
+var currentGoroutineTasks *goroutineTasks
+var currentGoroutineTasksLock sync.RWMutex
+
+func setGoroutineTasks(tasks *goroutineTasks) {
+	currentGoroutineTasksLock.Lock()
+	defer currentGoroutineTasksLock.Unlock()
+	currentGoroutineTasks = tasks
+}
+
+// getGoroutineTasks is called when the goroutines are started to find out which operation they belong to.
+func getGoroutineTasks() *goroutineTasks {
+	currentGoroutineTasksLock.RLock()
+	defer currentGoroutineTasksLock.RUnlock()
+	return currentGoroutineTasks
+}
+
+// runGoroutineTask runs a task of a goroutine transferring chunks.  If 'tasks' is not nil, an exception raised by the
+// task is passed to its handler and the goroutine can carry on with the next task.
+func runGoroutineTask(tasks *goroutineTasks, task func()) {
+	if tasks != nil {
+		tasks.lock.Lock()
+		if tasks.ended {
+			tasks.lock.Unlock()
+			return
+		}
+		tasks.running++
+		tasks.lock.Unlock()
+
+		defer func() {
+			r := recover()
+			tasks.lock.Lock()
+			tasks.running--
+			tasks.idle.Broadcast()
+			tasks.lock.Unlock()
+			if r != nil {
+				exception, ok := r.(Exception)
+				if !ok {
+					panic(r)
+				}
+				tasks.handler(exception)
+			}
+		}()
+	}
+	task()
+}
+
 func CatchLogException() {
 	if r := recover(); r != nil {
 		switch e := r.(type) {
@@ -227,11 +352,18 @@ func CatchLogException() {
 				debug.PrintStack()
 			}
 			RunAtError()
-			os.Exit(duplicacyExitCode)
+			runAtFailure(&e)
+			EmitJSONResult(false, &e)
+			SendNotifications(false, &e)
+			os.Exit(getErrorExitCode(&e))
 		default:
 			fmt.Fprintf(os.Stderr, "%v\n", e)
 			debug.PrintStack()
 			RunAtError()
+			failure := &Exception{Level: FATAL, LogID: "PANIC", Message: fmt.Sprintf("%v", e)}
+			runAtFailure(failure)
+			EmitJSONResult(false, failure)
+			SendNotifications(false, failure)
 			os.Exit(otherExitCode)
 		}
 	}
@@ -0,0 +1,253 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The format of the timestamp starting every line in a log file, and the suffix added to the name of a rotated log
+const logFileTimeFormat = "2006-01-02 15:04:05.000"
+const logFileRotateFormat = "20060102-150405"
+
+// LogFileOptions controls when a log file is rotated and what happens to the rotated files.
+type LogFileOptions struct {
+	MaxSize  int64         // rotate when the file would grow beyond this many bytes; 0 means no limit
+	MaxAge   time.Duration // rotate when the first line of the file is older than this; 0 means no limit
+	Keep     int           // the number of rotated files to keep; 0 means all of them
+	Compress bool          // whether rotated files are compressed with gzip
+}
+
+// LogFile is a log file that is appended to by every run and rotated once it becomes too large or too old, so
+// scheduled backups can log to a file without external tools like logrotate.
+type LogFile struct {
+	path     string
+	options  LogFileOptions
+	file     *os.File
+	size     int64
+	created  time.Time
+	disabled bool
+}
+
+// The log file receiving all logs, and the one receiving only errors
+var logFile *LogFile
+var errorLogFile *LogFile
+
+// OpenLogFile opens the log file for appending, creating the file and its directory if needed.
+func OpenLogFile(path string, options LogFileOptions) (*LogFile, error) {
+	file := &LogFile{path: path, options: options}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// EnableLogFile writes all logs to the log file in addition to the console.
+func EnableLogFile(path string, options LogFileOptions) (err error) {
+	logFile, err = OpenLogFile(path, options)
+	return err
+}
+
+// EnableErrorLogFile writes the errors to a separate log file, so failures of scheduled runs are easy to spot.
+func EnableErrorLogFile(path string, options LogFileOptions) (err error) {
+	errorLogFile, err = OpenLogFile(path, options)
+	return err
+}
+
+// open opens the file and finds out when it was started from the timestamp on its first line, since the creation
+// time of a file isn't available on every platform and the modification time changes with every run.
+func (logFile *LogFile) open() error {
+	file, err := os.OpenFile(logFile.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	logFile.file = file
+	logFile.size = stat.Size()
+	logFile.created = time.Now()
+	if logFile.size == 0 {
+		return nil
+	}
+
+	logFile.created = stat.ModTime()
+	if existing, err := os.Open(logFile.path); err == nil {
+		header := make([]byte, len(logFileTimeFormat))
+		if _, err := io.ReadFull(existing, header); err == nil {
+			if created, err := time.ParseInLocation(logFileTimeFormat, string(header), time.Local); err == nil {
+				logFile.created = created
+			}
+		}
+		existing.Close()
+	}
+	return nil
+}
+
+// needsRotation returns true if writing this many more bytes would exceed the maximum size, or if the file has
+// reached the maximum age.  An empty file is never rotated.
+func (logFile *LogFile) needsRotation(length int) bool {
+	if logFile.size == 0 {
+		return false
+	}
+	if logFile.options.MaxSize > 0 && logFile.size+int64(length) > logFile.options.MaxSize {
+		return true
+	}
+	if logFile.options.MaxAge > 0 && time.Since(logFile.created) >= logFile.options.MaxAge {
+		return true
+	}
+	return false
+}
+
+// rotate renames the current file with a timestamp suffix, compresses it if requested, removes the rotated files
+// that exceed the number to keep, and then starts a new file.
+func (logFile *LogFile) rotate() error {
+	logFile.file.Close()
+	logFile.file = nil
+
+	rotatedPath := logFile.path + "." + time.Now().Format(logFileRotateFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedPath); os.IsNotExist(err) {
+			if _, err := os.Stat(rotatedPath + ".gz"); os.IsNotExist(err) {
+				break
+			}
+		}
+		rotatedPath = fmt.Sprintf("%s.%s-%d", logFile.path, time.Now().Format(logFileRotateFormat), i)
+	}
+
+	if err := os.Rename(logFile.path, rotatedPath); err != nil {
+		return err
+	}
+
+	if logFile.options.Compress {
+		if err := compressLogFile(rotatedPath); err != nil {
+			// The rotated file is kept uncompressed
+			fmt.Fprintf(os.Stderr, "Failed to compress the log file %s: %v\n", rotatedPath, err)
+		}
+	}
+
+	logFile.removeRotatedFiles()
+	return logFile.open()
+}
+
+// compressLogFile replaces the file with its gzip-compressed copy.
+func compressLogFile(path string) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(output)
+	_, err = io.Copy(writer, input)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	input.Close()
+	return os.Remove(path)
+}
+
+// getRotatedLogFiles returns the rotated files of the log file, oldest first.  The timestamp suffix makes the
+// alphabetical order the chronological order.
+func (logFile *LogFile) getRotatedLogFiles() []string {
+	candidates, _ := filepath.Glob(logFile.path + ".*")
+	prefix := logFile.path + "."
+
+	var rotated []string
+	for _, candidate := range candidates {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(candidate, prefix), ".gz")
+		if len(suffix) < len(logFileRotateFormat) {
+			continue
+		}
+		if _, err := time.Parse(logFileRotateFormat, suffix[:len(logFileRotateFormat)]); err != nil {
+			continue
+		}
+		rotated = append(rotated, candidate)
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+// removeRotatedFiles removes the oldest rotated files beyond the number to keep.
+func (logFile *LogFile) removeRotatedFiles() {
+	if logFile.options.Keep <= 0 {
+		return
+	}
+	rotated := logFile.getRotatedLogFiles()
+	for i := 0; i < len(rotated)-logFile.options.Keep; i++ {
+		os.Remove(rotated[i])
+	}
+}
+
+// writeLine appends a line to the log file, rotating the file first if needed.  A log file that can't be written to
+// is disabled after reporting the error to the standard error, because the failure can't be logged anywhere else.
+func (logFile *LogFile) writeLine(line string) {
+	if logFile.disabled {
+		return
+	}
+
+	var err error
+	if logFile.needsRotation(len(line)) {
+		err = logFile.rotate()
+	}
+	if err == nil && logFile.file != nil {
+		var n int
+		n, err = logFile.file.WriteString(line)
+		logFile.size += int64(n)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write to the log file %s: %v\n", logFile.path, err)
+		logFile.disabled = true
+	}
+}
+
+// Close closes the log file.
+func (logFile *LogFile) Close() {
+	if logFile.file != nil {
+		logFile.file.Close()
+		logFile.file = nil
+	}
+}
+
+// writeLogFiles is called by logf with the log mutex held to send the log to the log files.
+func writeLogFiles(now time.Time, level int, logID string, message string) {
+	if logFile == nil && (errorLogFile == nil || level < ERROR) {
+		return
+	}
+	line := fmt.Sprintf("%s %s %s %s\n", now.Format(logFileTimeFormat), getLevelName(level), logID, message)
+	if logFile != nil {
+		logFile.writeLine(line)
+	}
+	if errorLogFile != nil && level >= ERROR {
+		errorLogFile.writeLine(line)
+	}
+}
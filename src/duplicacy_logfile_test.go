@@ -0,0 +1,76 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFile(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "logfile")
+	os.RemoveAll(testDir)
+	logPath := filepath.Join(testDir, "logs", "duplicacy.log")
+
+	file, err := OpenLogFile(logPath, LogFileOptions{MaxSize: 100, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("Failed to open the log file: %v", err)
+	}
+
+	// Each line takes up 60 bytes, so every line after the first one causes a rotation
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		file.writeLine(now.Format(logFileTimeFormat) + " INFO LOG_TEST " + strings.Repeat("x", 21) + "\n")
+	}
+	file.Close()
+
+	rotated := file.getRotatedLogFiles()
+	if len(rotated) != 2 {
+		t.Fatalf("%d rotated log files were kept: %v", len(rotated), rotated)
+	}
+	for _, path := range rotated {
+		if !strings.HasSuffix(path, ".gz") {
+			t.Errorf("The rotated log file %s was not compressed", path)
+			continue
+		}
+		input, _ := os.Open(path)
+		reader, err := gzip.NewReader(input)
+		if err != nil {
+			t.Errorf("Failed to decompress %s: %v", path, err)
+			input.Close()
+			continue
+		}
+		content, _ := ioutil.ReadAll(reader)
+		input.Close()
+		if !strings.Contains(string(content), "LOG_TEST") {
+			t.Errorf("The rotated log file %s contains '%s'", path, content)
+		}
+	}
+
+	// Reopening the file finds out when it was started from its first line
+	file, err = OpenLogFile(logPath, LogFileOptions{MaxSize: 100, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to reopen the log file: %v", err)
+	}
+	if file.size != 60 || file.created.Unix() != now.Unix() {
+		t.Errorf("The reopened log file has %d bytes and was started at %s", file.size, file.created)
+	}
+	if !file.needsRotation(41) || file.needsRotation(40) {
+		t.Errorf("The size-based rotation doesn't happen at the maximum size")
+	}
+	file.created = now.Add(-2 * time.Hour)
+	if !file.needsRotation(1) {
+		t.Errorf("The age-based rotation doesn't happen at the maximum age")
+	}
+	file.Close()
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// The logging levels of individual subsystems, which override the global logging level.  A subsystem is identified
+// by the name of the source file the log comes from, without the 'duplicacy_' prefix, a platform suffix, and the
+// extension, such as 'b2client' or 'chunkuploader'.
+var subsystemLevels = map[string]int{}
+
+// The platform suffixes removed from file names to get the subsystem name
+var subsystemPlatformSuffixes = []string{"_windows", "_darwin", "_linux", "_freebsd", "_bsd", "_others", "_test"}
+
+// parseLoggingLevel converts a level name such as 'debug' or 'WARN' into a logging level.
+func parseLoggingLevel(name string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return DEBUG, nil
+	case "trace":
+		return TRACE, nil
+	case "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	default:
+		return 0, fmt.Errorf("unknown logging level '%s'", name)
+	}
+}
+
+// SetSubsystemLoggingLevels parses a list of levels separated by commas, such as 'b2client=debug,chunkuploader=info'.
+// An entry without a subsystem name sets the logging level of all other subsystems.
+func SetSubsystemLoggingLevels(spec string) error {
+	levels := make(map[string]int)
+	defaultLevel := loggingLevel
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, levelName := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			name, levelName = strings.ToLower(strings.TrimSpace(entry[:i])), entry[i+1:]
+			if name == "" {
+				return fmt.Errorf("no subsystem is specified in '%s'", entry)
+			}
+		}
+		level, err := parseLoggingLevel(levelName)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			defaultLevel = level
+		} else {
+			levels[name] = level
+		}
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	loggingLevel = defaultLevel
+	subsystemLevels = levels
+	return nil
+}
+
+// getSubsystemName returns the subsystem of the source file, whose path always uses slashes as reported by the runtime.
+func getSubsystemName(file string) string {
+	name := strings.TrimSuffix(path.Base(file), ".go")
+	name = strings.TrimPrefix(name, "duplicacy_")
+	for _, suffix := range subsystemPlatformSuffixes {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
+
+// getLogSubsystem returns the subsystem of the code that called one of the LOG_* functions, which called logf.
+func getLogSubsystem() string {
+	_, file, _, ok := runtime.Caller(3)
+	if !ok {
+		return ""
+	}
+	return getSubsystemName(file)
+}
+
+// getSubsystemLevel returns the logging level in effect for the subsystem.
+func getSubsystemLevel(subsystem string) int {
+	if level, found := subsystemLevels[subsystem]; found {
+		return level
+	}
+	return loggingLevel
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSubsystemLoggingLevels(t *testing.T) {
+
+	names := map[string]string{
+		"/src/duplicacy_b2client.go":         "b2client",
+		"duplicacy_shadowcopy_windows.go":    "shadowcopy",
+		"src/duplicacy_logsubsystem_test.go": "logsubsystem",
+		"/usr/local/go/src/log/log.go":       "log",
+		"C:/src/duplicacy_chunkuploader.go":  "chunkuploader",
+	}
+	for file, expected := range names {
+		if name := getSubsystemName(file); name != expected {
+			t.Errorf("The subsystem of %s is '%s' instead of '%s'", file, name, expected)
+		}
+	}
+
+	for _, spec := range []string{"b2client=loud", "=debug", "verbose"} {
+		if err := SetSubsystemLoggingLevels(spec); err == nil {
+			t.Errorf("The levels '%s' were accepted", spec)
+		}
+	}
+
+	var buffer bytes.Buffer
+	SetLogOutput(&buffer)
+	setTestingT(nil)
+	defer func() {
+		setTestingT(t)
+		SetLogOutput(os.Stdout)
+		SetSubsystemLoggingLevels("info")
+	}()
+
+	// Messages logged from this file belong to the 'logsubsystem' subsystem
+	if err := SetSubsystemLoggingLevels("warn, logsubsystem=debug"); err != nil {
+		t.Fatalf("Failed to set the logging levels: %v", err)
+	}
+	if !IsDebugging() || loggingLevel != WARN {
+		t.Errorf("The logging level is %d", loggingLevel)
+	}
+	LOG_DEBUG("TEST_DEBUG", "debug message")
+
+	if err := SetSubsystemLoggingLevels("logsubsystem=error"); err != nil {
+		t.Fatalf("Failed to set the logging levels: %v", err)
+	}
+	LOG_WARN("TEST_WARN", "warning message")
+
+	if err := SetSubsystemLoggingLevels("info,b2client=debug"); err != nil {
+		t.Fatalf("Failed to set the logging levels: %v", err)
+	}
+	LOG_INFO("TEST_INFO", "info message")
+	LOG_DEBUG("TEST_DEBUG", "hidden debug message")
+
+	output := buffer.String()
+	if !strings.Contains(output, "debug message\n") || strings.Contains(output, "warning message") ||
+		!strings.Contains(output, "info message") || strings.Contains(output, "hidden") {
+		t.Errorf("The output is '%s'", output)
+	}
+}
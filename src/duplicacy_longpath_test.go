@@ -0,0 +1,90 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+// TestLongPaths backs up and restores a deeply nested node_modules tree whose paths are well beyond MAX_PATH, which is
+// only possible on Windows with extended-length paths.
+func TestLongPaths(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "longpath")
+	os.RemoveAll(testDir)
+
+	var deepest []string
+	for i := 0; i < 12; i++ {
+		deepest = append(deepest, "node_modules", "package-with-a-rather-long-name")
+	}
+	relativePath := strings.Join(deepest, "/") + "/index.js"
+	if len(relativePath) < 300 {
+		t.Fatalf("The path %s is not long enough", relativePath)
+	}
+
+	for _, repository := range []string{"repository1", "repository2"} {
+		err := os.MkdirAll(joinPath(testDir, repository, DUPLICACY_DIRECTORY), 0700)
+		if err != nil {
+			t.Fatalf("Failed to create the repository: %v", err)
+		}
+	}
+	err := os.MkdirAll(joinPath(testDir, "repository1", strings.Join(deepest, "/")), 0700)
+	if err != nil {
+		t.Fatalf("Failed to create the nested directories: %v", err)
+	}
+	createRandomFile(joinPath(testDir, "repository1", relativePath), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(filepath.Join(testDir, "repository1", DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(filepath.Join(testDir, "repository1"), true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+	if summary := backupManager.GetSummary(); summary.TotalFiles != 1 || summary.SkippedFiles != 0 {
+		t.Errorf("%d files were backed up and %d were skipped", summary.TotalFiles, summary.SkippedFiles)
+	}
+
+	SetDuplicacyPreferencePath(filepath.Join(testDir, "repository2", DUPLICACY_DIRECTORY))
+	failedFiles := backupManager.Restore(filepath.Join(testDir, "repository2"), 1, true, false, threads, true, false,
+		false, false, nil, false)
+	assertRestoreFailures(t, failedFiles, 0)
+
+	hash1 := getFileHash(joinPath(testDir, "repository1", relativePath))
+	hash2 := getFileHash(joinPath(testDir, "repository2", relativePath))
+	if hash1 != hash2 {
+		t.Errorf("The restored file %s has a different hash", relativePath)
+	}
+}
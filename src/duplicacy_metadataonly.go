@@ -0,0 +1,174 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// SetMetadataOnly makes the backup record the file tree without uploading the contents of the files.  The snapshot
+// created can be listed, checked, and compared like any other snapshot, but not restored.  The next regular backup
+// after a metadata-only snapshot uploads all files as if it were the initial backup.
+func (manager *BackupManager) SetMetadataOnly(metadataOnly bool) {
+	manager.metadataOnly = metadataOnly
+}
+
+// backupMetadataOnly uploads 'localSnapshot', as listed from the repository, without any file chunks.  If 'hashFiles'
+// is true, every file is read to compute its hash; otherwise only the hashes of files unchanged since the previous
+// snapshot are copied and other files are recorded without hashes.
+func (manager *BackupManager) backupMetadataOnly(top string, shadowTop string, remoteSnapshot *Snapshot,
+	localSnapshot *Snapshot, hashFiles bool, tag string, shadowCopy bool, threads int, showStatistics bool,
+	startTime int64, skippedDirectories []string, skippedFiles []string) bool {
+
+	LOG_INFO("BACKUP_METADATA", "Recording the file tree without uploading file contents")
+
+	localSnapshot.Revision = remoteSnapshot.Revision + 1
+
+	var fileSize int64
+	var numberOfFiles int64
+	var hashedFiles int64
+	var modifiedEntries []*Entry
+
+	var i int
+	for _, local := range localSnapshot.Files {
+		if !local.IsFile() {
+			continue
+		}
+		numberOfFiles++
+		if local.Size == 0 {
+			continue
+		}
+		fileSize += local.Size
+
+		if hashFiles {
+			modifiedEntries = append(modifiedEntries, local)
+			continue
+		}
+
+		for i < len(remoteSnapshot.Files) && remoteSnapshot.Files[i].Compare(local) < 0 {
+			i++
+		}
+		if i < len(remoteSnapshot.Files) && remoteSnapshot.Files[i].Path == local.Path {
+			remote := remoteSnapshot.Files[i]
+			if local.IsSameAs(remote) && remote.Hash != "" {
+				local.Hash = remote.Hash
+				hashedFiles++
+			}
+		}
+	}
+
+	sizes := make(map[string]int64)
+	for _, entry := range modifiedEntries {
+		sizes[entry.Path] = entry.Size
+	}
+
+	fileReader := CreateFileReader(shadowTop, modifiedEntries, manager.openRetryOptions)
+	for fileReader.CurrentFile != nil {
+		entry := fileReader.CurrentEntry
+		LOG_TRACE("HASH_START", "Hashing %s", entry.Path)
+		hasher := manager.config.NewFileHasher()
+		if _, err := io.Copy(hasher, fileReader.CurrentFile); err != nil {
+			LOG_WARN("HASH_FAILURE", "Failed to read %s: %v", entry.Path, err)
+			skippedFiles = append(skippedFiles, entry.Path)
+		} else {
+			entry.Hash = hex.EncodeToString(hasher.Sum(nil))
+			hashedFiles++
+		}
+		fileReader.NextFile()
+	}
+
+	// Files that can't be opened are still recorded, with their sizes but without hashes
+	for i, file := range fileReader.SkippedFiles {
+		LOG_WARN("SKIP_FILE", "File %s cannot be opened: %v", file, fileReader.SkippedErrors[i])
+	}
+	for _, entry := range modifiedEntries {
+		entry.Size = sizes[entry.Path]
+	}
+	manager.writeSkippedReport(skippedDirectories, skippedFiles, fileReader)
+	skippedFiles = append(skippedFiles, fileReader.SkippedFiles...)
+
+	localSnapshot.EndTime = time.Now().Unix()
+	localSnapshot.Tag = tag
+	localSnapshot.Options = "-metadata-only"
+	if hashFiles {
+		localSnapshot.Options += " -hash"
+	}
+	if shadowCopy {
+		localSnapshot.Options += " -vss"
+	}
+	localSnapshot.FileSize = fileSize
+	localSnapshot.NumberOfFiles = numberOfFiles
+
+	err := manager.SnapshotManager.CheckSnapshot(localSnapshot)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_CHECK", "The snapshot contains an error: %v", err)
+		return false
+	}
+
+	// Metadata chunks unchanged since the previous snapshot don't need to be uploaded again
+	chunkCache := make(map[string]bool)
+	if remoteSnapshot.Revision > 0 {
+		for _, chunkID := range manager.SnapshotManager.GetSnapshotChunks(remoteSnapshot, true) {
+			chunkCache[chunkID] = true
+		}
+	}
+
+	if threads < 1 {
+		threads = 1
+	}
+	chunkMaker := CreateChunkMaker(manager.config, false)
+	chunkUploader := CreateChunkUploader(manager.config, manager.storage, nil, threads, nil)
+	totalSnapshotChunkLength, numberOfNewSnapshotChunks,
+		totalUploadedSnapshotChunkLength, totalUploadedSnapshotChunkBytes :=
+		manager.UploadSnapshot(chunkMaker, chunkUploader, top, localSnapshot, chunkCache)
+
+	for _, dir := range skippedDirectories {
+		LOG_WARN("SKIP_DIRECTORY", "Subdirectory %s cannot be listed", dir)
+	}
+
+	if !manager.config.dryRun {
+		manager.SnapshotManager.CleanSnapshotCache(localSnapshot, nil)
+	}
+	LOG_INFO("BACKUP_END", "Metadata-only backup for %s at revision %d completed", top, localSnapshot.Revision)
+
+	if !manager.verifyUploadedChunks(threads) {
+		return false
+	}
+
+	if showStatistics {
+		LOG_INFO("BACKUP_STATS", "Files: %d total, %s bytes; %d with hashes", numberOfFiles, PrettyNumber(fileSize),
+			hashedFiles)
+
+		totalSnapshotChunks := len(localSnapshot.FileSequence) + len(localSnapshot.ChunkSequence) +
+			len(localSnapshot.LengthSequence)
+		LOG_INFO("BACKUP_STATS", "Metadata chunks: %d total, %s bytes; %d new, %s bytes, %s bytes uploaded",
+			totalSnapshotChunks, PrettyNumber(totalSnapshotChunkLength),
+			numberOfNewSnapshotChunks, PrettyNumber(totalUploadedSnapshotChunkLength),
+			PrettyNumber(totalUploadedSnapshotChunkBytes))
+
+		now := time.Now().Unix()
+		if now == startTime {
+			now = startTime + 1
+		}
+		LOG_INFO("BACKUP_STATS", "Total running time: %s", PrettyTime(now-startTime))
+	}
+
+	if len(skippedDirectories)+len(skippedFiles) > 0 {
+		LOG_WARN("BACKUP_SKIPPED", "%d directories and files were not included or hashed due to access errors",
+			len(skippedDirectories)+len(skippedFiles))
+	}
+
+	manager.summary = OperationSummary{
+		Revision:         localSnapshot.Revision,
+		TotalFiles:       int(numberOfFiles),
+		TotalFileSize:    fileSize,
+		TransferredBytes: totalUploadedSnapshotChunkBytes,
+		SkippedFiles:     len(skippedDirectories) + len(skippedFiles),
+	}
+
+	return true
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+// TestMetadataOnlyBackup creates a metadata-only snapshot with hashes, followed by a regular backup that must upload
+// all files and record the same hashes.
+func TestMetadataOnlyBackup(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "metadataonly")
+	os.RemoveAll(testDir)
+
+	for _, repository := range []string{"repository1", "repository2"} {
+		err := os.MkdirAll(joinPath(testDir, repository, DUPLICACY_DIRECTORY), 0700)
+		if err != nil {
+			t.Fatalf("Failed to create the repository: %v", err)
+		}
+	}
+	os.MkdirAll(joinPath(testDir, "repository1", "dir"), 0700)
+	createRandomFile(joinPath(testDir, "repository1", "file1"), 100000)
+	createRandomFile(joinPath(testDir, "repository1", "dir", "file2"), 200000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 64*1024, 256*1024, 16*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(filepath.Join(testDir, "repository1", DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+
+	backupManager.SetMetadataOnly(true)
+	if !backupManager.Backup(filepath.Join(testDir, "repository1"), false, threads, "inventory", false, false, 0, false) {
+		t.Fatalf("The metadata-only backup failed")
+	}
+	if summary := backupManager.GetSummary(); summary.TotalFiles != 2 || summary.NewFiles != 0 {
+		t.Errorf("The metadata-only snapshot has %d files with %d uploaded", summary.TotalFiles, summary.NewFiles)
+	}
+
+	snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 1)
+	backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, false)
+	if !snapshot.IsMetadataOnly() || len(snapshot.ChunkHashes) != 0 {
+		t.Fatalf("Revision 1 has options '%s' and %d file chunks", snapshot.Options, len(snapshot.ChunkHashes))
+	}
+	hashes := make(map[string]string)
+	for _, file := range snapshot.Files {
+		if file.IsFile() {
+			if file.Hash == "" {
+				t.Errorf("The file %s has no hash", file.Path)
+			}
+			hashes[file.Path] = file.Hash
+		}
+	}
+
+	backupManager.SetMetadataOnly(false)
+	if !backupManager.Backup(filepath.Join(testDir, "repository1"), true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+	if summary := backupManager.GetSummary(); summary.NewFiles != 2 {
+		t.Errorf("%d files were uploaded after the metadata-only snapshot", summary.NewFiles)
+	}
+
+	snapshot = backupManager.SnapshotManager.DownloadSnapshot("host1", 2)
+	backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, false)
+	for _, file := range snapshot.Files {
+		if file.IsFile() && file.Hash != hashes[file.Path] {
+			t.Errorf("The file %s has a hash of %s in the metadata-only snapshot but %s in the backup", file.Path,
+				hashes[file.Path], file.Hash)
+		}
+	}
+
+	SetDuplicacyPreferencePath(filepath.Join(testDir, "repository2", DUPLICACY_DIRECTORY))
+	failedFiles := backupManager.Restore(filepath.Join(testDir, "repository2"), 2, true, false, threads, true, false,
+		false, false, nil, false)
+	assertRestoreFailures(t, failedFiles, 0)
+
+	for _, file := range []string{"file1", "dir/file2"} {
+		hash1 := getFileHash(joinPath(testDir, "repository1", file))
+		hash2 := getFileHash(joinPath(testDir, "repository2", file))
+		if hash1 != hash2 {
+			t.Errorf("The restored file %s has a different hash", file)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockStorage is an in-memory storage for reproducing and testing the handling of storage failures.  It is created
+// from an undocumented URL of the form mock://<name>?<option>=<value>&..., where the options are:
+//
+//	latency=<duration>      the time each request takes, such as 50ms
+//	throttle=<probability>  the chance of a request being rejected with a 429 status
+//	retry-after=<duration>  the delay throttled requests are told to wait before retrying
+//	errors=<probability>    the chance of a request failing with a 5xx status; half of the failed uploads, moves and
+//	                        deletions are carried out anyway, as happens when a response is lost
+//	consistency=<duration>  how long changes take to show up in listings, and overwritten or deleted files to stop
+//	                        being read, while new files can be read right after being uploaded
+//	truncate=<probability>  the chance of a download returning only part of the file without any error
+//	seed=<number>           the seed of the random faults
+//
+// Storages with the same name share their files for the lifetime of the process.  Throttled and failed requests are
+// retried by the retry policy of the storage, whose log ID is MOCK_RETRY.
+type MockStorage struct {
+	StorageBase
+
+	name            string
+	store           *mockStore
+	numberOfThreads int
+	retryPolicy     *RetryPolicy
+
+	latency     time.Duration
+	throttle    float64
+	retryAfter  time.Duration
+	errors      float64
+	consistency time.Duration
+	truncate    float64
+
+	randomLock sync.Mutex
+	random     *rand.Rand
+
+	faultLock sync.Mutex
+	faults    map[string]int // the number of faults injected of each kind
+}
+
+// MockStorageError is the error returned by a mock storage for a failed request.
+type MockStorageError struct {
+	Status     int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (err *MockStorageError) Error() string {
+	return fmt.Sprintf("status %d: %s", err.Status, err.Message)
+}
+
+// mockFile is one version of a file.  A deletion is recorded as a version that doesn't exist, and 'previous' is the
+// version seen by requests that don't see this one yet.
+type mockFile struct {
+	content  []byte
+	exists   bool
+	modified time.Time
+	previous *mockFile
+}
+
+// mockStore holds the files of all mock storages with the same name.
+type mockStore struct {
+	lock        sync.Mutex
+	files       map[string]*mockFile
+	directories map[string]bool
+}
+
+var mockStores = make(map[string]*mockStore)
+var mockStoresLock sync.Mutex
+
+// getMockStore returns the store with the given name, creating it if it doesn't exist.
+func getMockStore(name string) *mockStore {
+	mockStoresLock.Lock()
+	defer mockStoresLock.Unlock()
+
+	store, found := mockStores[name]
+	if !found {
+		store = &mockStore{
+			files:       make(map[string]*mockFile),
+			directories: make(map[string]bool),
+		}
+		mockStores[name] = store
+	}
+	return store
+}
+
+// removeMockStore discards the files of the store with the given name.
+func removeMockStore(name string) {
+	mockStoresLock.Lock()
+	defer mockStoresLock.Unlock()
+	delete(mockStores, name)
+}
+
+// CreateMockStorage creates a mock storage from the part of the URL after mock://.
+func CreateMockStorage(location string, threads int) (storage *MockStorage, err error) {
+
+	name, query := location, ""
+	if index := strings.Index(location, "?"); index >= 0 {
+		name, query = location[:index], location[index+1:]
+	}
+	name = strings.TrimSuffix(name, "/")
+	if name == "" {
+		return nil, fmt.Errorf("The mock storage must have a name")
+	}
+
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mock storage options '%s': %v", query, err)
+	}
+
+	storage = &MockStorage{
+		name:            name,
+		store:           getMockStore(name),
+		numberOfThreads: threads,
+		retryPolicy:     CreateRetryPolicy(8, 0.1, 5, 0.5),
+		faults:          make(map[string]int),
+	}
+
+	seed := time.Now().UnixNano()
+	for option := range options {
+		value := options.Get(option)
+		switch option {
+		case "latency":
+			storage.latency, err = time.ParseDuration(value)
+		case "retry-after":
+			storage.retryAfter, err = time.ParseDuration(value)
+		case "consistency":
+			storage.consistency, err = time.ParseDuration(value)
+		case "throttle":
+			storage.throttle, err = parseMockProbability(value)
+		case "errors":
+			storage.errors, err = parseMockProbability(value)
+		case "truncate":
+			storage.truncate, err = parseMockProbability(value)
+		case "seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("Unknown mock storage option '%s'", option)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value '%s' for the mock storage option %s: %v", value, option, err)
+		}
+	}
+	storage.random = rand.New(rand.NewSource(seed))
+
+	LOG_INFO("MOCK_STORAGE", "Mock storage %s: latency=%s throttle=%g errors=%g consistency=%s truncate=%g seed=%d",
+		name, storage.latency, storage.throttle, storage.errors, storage.consistency, storage.truncate, seed)
+
+	storage.DerivedStorage = storage
+	storage.SetDefaultNestingLevels([]int{1}, 1)
+	return storage, nil
+}
+
+func parseMockProbability(value string) (float64, error) {
+	probability, err := strconv.ParseFloat(value, 64)
+	if err == nil && (probability < 0 || probability > 1) {
+		err = fmt.Errorf("the probability must be between 0 and 1")
+	}
+	return probability, err
+}
+
+// SetRetryPolicy replaces the settings of the default retry policy with the non-zero ones of 'policy'.
+func (storage *MockStorage) SetRetryPolicy(policy *RetryPolicy) {
+	storage.retryPolicy = storage.retryPolicy.override(policy)
+}
+
+// InjectedFaults returns the number of faults injected so far of each kind: throttle, error, lost (an error after the
+// request was carried out) and truncate.
+func (storage *MockStorage) InjectedFaults() map[string]int {
+	storage.faultLock.Lock()
+	defer storage.faultLock.Unlock()
+
+	faults := make(map[string]int)
+	for kind, count := range storage.faults {
+		faults[kind] = count
+	}
+	return faults
+}
+
+func (storage *MockStorage) countFault(kind string) {
+	storage.faultLock.Lock()
+	storage.faults[kind]++
+	storage.faultLock.Unlock()
+}
+
+// chance returns true with the given probability.
+func (storage *MockStorage) chance(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	storage.randomLock.Lock()
+	defer storage.randomLock.Unlock()
+	return storage.random.Float64() < probability
+}
+
+func (storage *MockStorage) randomInt(n int) int {
+	storage.randomLock.Lock()
+	defer storage.randomLock.Unlock()
+	return storage.random.Intn(n)
+}
+
+// request calls 'apply' to carry out a request of 'class', injecting faults and retrying the failed attempts by the
+// retry policy.
+func (storage *MockStorage) request(class string, operation string, apply func() error) error {
+
+	retryState := storage.retryPolicy.startRequest(storage.GetContext(), "MOCK", class, operation)
+	for {
+		err := storage.attempt(class, apply)
+		if err == nil {
+			return nil
+		}
+		mockError, ok := err.(*MockStorageError)
+		if !ok || mockError.Status < 429 || mockError.Status == 501 || !retryState.retry(err, mockError.RetryAfter) {
+			return err
+		}
+	}
+}
+
+func (storage *MockStorage) attempt(class string, apply func() error) error {
+
+	// Like a real request, waiting for the response ends when the request is cancelled
+	if storage.latency > 0 {
+		ctx := storage.GetContext()
+		select {
+		case <-time.After(storage.latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if storage.chance(storage.throttle) {
+		storage.countFault("throttle")
+		return &MockStorageError{Status: 429, Message: "Too many requests", RetryAfter: storage.retryAfter}
+	}
+
+	if storage.chance(storage.errors) {
+		statuses := []int{500, 502, 503}
+		failure := &MockStorageError{Status: statuses[storage.randomInt(len(statuses))], Message: "Injected failure"}
+		isChange := class == RetryClassUpload || class == RetryClassDelete || class == RetryClassOther
+		if isChange && storage.chance(0.5) {
+			storage.countFault("lost")
+			if err := apply(); err != nil {
+				return err
+			}
+			return failure
+		}
+		storage.countFault("error")
+		return failure
+	}
+
+	return apply()
+}
+
+// get returns the version of the file at 'filePath' seen by a listing if 'isListing' is true, or by other requests
+// otherwise, or nil if the file doesn't exist for them.
+func (storage *MockStorage) get(filePath string, isListing bool, now time.Time) *mockFile {
+	file := storage.store.files[filePath]
+	for file != nil && now.Before(file.modified.Add(storage.consistency)) {
+		isCreation := file.exists && (file.previous == nil || !file.previous.exists)
+		if !isListing && isCreation {
+			break
+		}
+		file = file.previous
+	}
+	if file == nil || !file.exists {
+		return nil
+	}
+	return file
+}
+
+// put records a new version of the file at 'filePath', or its deletion if 'content' is nil.
+func (storage *MockStorage) put(filePath string, content []byte, now time.Time) {
+	previous := storage.store.files[filePath]
+
+	// Versions older than the first one seen by all requests are no longer needed
+	for version := previous; version != nil; version = version.previous {
+		if !now.Before(version.modified.Add(storage.consistency)) {
+			version.previous = nil
+			break
+		}
+	}
+	if previous != nil && previous.previous == nil && !previous.exists {
+		previous = nil
+	}
+
+	if content == nil && previous == nil {
+		delete(storage.store.files, filePath)
+		return
+	}
+	storage.store.files[filePath] = &mockFile{
+		content:  content,
+		exists:   content != nil,
+		modified: now,
+		previous: previous,
+	}
+}
+
+// ListFiles return the list of files and subdirectories under 'dir' (non-recursively).
+func (storage *MockStorage) ListFiles(threadIndex int, dir string) (files []string, sizes []int64, err error) {
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	err = storage.request(RetryClassList, "LIST "+dir, func() error {
+		store := storage.store
+		store.lock.Lock()
+		defer store.lock.Unlock()
+
+		now := time.Now()
+		entries := make(map[string]int64)
+		addEntry := func(name string, size int64) {
+			if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+				return
+			}
+			name = name[len(prefix):]
+			if index := strings.Index(name, "/"); index >= 0 {
+				entries[name[:index+1]] = 0
+			} else if dir != "snapshots" && dir != "snapshots/" {
+				entries[name] = size
+			}
+		}
+		for filePath := range store.files {
+			if file := storage.get(filePath, true, now); file != nil {
+				addEntry(filePath, int64(len(file.content)))
+			}
+		}
+		for directory := range store.directories {
+			addEntry(directory+"/", 0)
+		}
+
+		files, sizes = nil, nil
+		for name := range entries {
+			files = append(files, name)
+		}
+		sort.Strings(files)
+		for _, name := range files {
+			sizes = append(sizes, entries[name])
+		}
+		return nil
+	})
+	return files, sizes, err
+}
+
+// DeleteFile deletes the file or directory at 'filePath'.
+func (storage *MockStorage) DeleteFile(threadIndex int, filePath string) (err error) {
+	return storage.request(RetryClassDelete, "DELETE "+filePath, func() error {
+		store := storage.store
+		store.lock.Lock()
+		defer store.lock.Unlock()
+
+		delete(store.directories, strings.TrimSuffix(filePath, "/"))
+		if _, found := store.files[filePath]; found {
+			storage.put(filePath, nil, time.Now())
+		}
+		return nil
+	})
+}
+
+// MoveFile renames the file.
+func (storage *MockStorage) MoveFile(threadIndex int, from string, to string) (err error) {
+	return storage.request(RetryClassOther, "MOVE "+from, func() error {
+		store := storage.store
+		store.lock.Lock()
+		defer store.lock.Unlock()
+
+		now := time.Now()
+		file := storage.get(from, false, now)
+		if file == nil {
+			return &MockStorageError{Status: 404, Message: fmt.Sprintf("%s not found", from)}
+		}
+		storage.put(to, file.content, now)
+		storage.put(from, nil, now)
+		return nil
+	})
+}
+
+// CreateDirectory creates a new directory.
+func (storage *MockStorage) CreateDirectory(threadIndex int, dir string) (err error) {
+	return storage.request(RetryClassOther, "MKDIR "+dir, func() error {
+		store := storage.store
+		store.lock.Lock()
+		defer store.lock.Unlock()
+
+		store.directories[strings.TrimSuffix(dir, "/")] = true
+		return nil
+	})
+}
+
+// GetFileInfo returns the information about the file or directory at 'filePath'.
+func (storage *MockStorage) GetFileInfo(threadIndex int, filePath string) (exist bool, isDir bool, size int64, err error) {
+	err = storage.request(RetryClassOther, "STAT "+filePath, func() error {
+		store := storage.store
+		store.lock.Lock()
+		defer store.lock.Unlock()
+
+		now := time.Now()
+		exist, isDir, size = false, false, 0
+		if file := storage.get(filePath, false, now); file != nil {
+			exist, size = true, int64(len(file.content))
+			return nil
+		}
+
+		dir := strings.TrimSuffix(filePath, "/")
+		if store.directories[dir] {
+			exist, isDir = true, true
+			return nil
+		}
+		for path := range store.files {
+			if strings.HasPrefix(path, dir+"/") && storage.get(path, false, now) != nil {
+				exist, isDir = true, true
+				return nil
+			}
+		}
+		return nil
+	})
+	return exist, isDir, size, err
+}
+
+// DownloadFile reads the file at 'filePath' into the chunk.
+func (storage *MockStorage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
+	return storage.request(RetryClassDownload, "GET "+filePath, func() error {
+		store := storage.store
+		store.lock.Lock()
+		file := storage.get(filePath, false, time.Now())
+		store.lock.Unlock()
+
+		if file == nil {
+			return &MockStorageError{Status: 404, Message: fmt.Sprintf("%s not found", filePath)}
+		}
+
+		content := file.content
+		if len(content) > 0 && storage.chance(storage.truncate) {
+			storage.countFault("truncate")
+			content = content[:storage.randomInt(len(content))]
+		}
+
+		_, err := RateLimitedCopy(chunk, bytes.NewReader(content), storage.DownloadRateLimit/storage.numberOfThreads)
+		return err
+	})
+}
+
+// UploadFile writes 'content' to the file at 'filePath'.
+func (storage *MockStorage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
+	return storage.request(RetryClassUpload, "PUT "+filePath, func() error {
+		reader := CreateRateLimitedReader(content, storage.UploadRateLimit()/storage.numberOfThreads)
+		stored, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+
+		store := storage.store
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		storage.put(filePath, stored, time.Now())
+		return nil
+	})
+}
+
+// If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
+// managing snapshots.
+func (storage *MockStorage) IsCacheNeeded() bool { return true }
+
+// If the 'MoveFile' method is implemented.
+func (storage *MockStorage) IsMoveFileImplemented() bool { return true }
+
+// If the storage can guarantee strong consistency.
+func (storage *MockStorage) IsStrongConsistent() bool { return storage.consistency == 0 }
+
+// If the storage supports fast listing of files names.
+func (storage *MockStorage) IsFastListing() bool { return false }
+
+// Enable the test mode.
+func (storage *MockStorage) EnableTestMode() {}
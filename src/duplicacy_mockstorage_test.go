@@ -0,0 +1,192 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+func TestMockStorage(t *testing.T) {
+
+	setTestingT(t)
+
+	listFiles := func(storage Storage, dir string) string {
+		files, _, err := storage.ListFiles(0, dir)
+		if err != nil {
+			t.Errorf("Failed to list %s: %v", dir, err)
+		}
+		return fmt.Sprintf("%v", files)
+	}
+
+	removeMockStore("mocktest/consistency")
+	storage, err := CreateMockStorage("mocktest/consistency?consistency=200ms", 1)
+	if err != nil {
+		t.Fatalf("Failed to create the mock storage: %v", err)
+	}
+	storage.CreateDirectory(0, "snapshots/host1")
+	storage.UploadFile(0, "snapshots/host1/1", []byte("revision"))
+	storage.UploadFile(0, "chunks/aa/bb", []byte("old"))
+
+	// New files can be read at once but aren't listed yet
+	if exist, isDir, size, err := storage.GetFileInfo(0, "chunks/aa/bb"); !exist || isDir || size != 3 || err != nil {
+		t.Errorf("The new file has exist=%t isDir=%t size=%d: %v", exist, isDir, size, err)
+	}
+	if files := listFiles(storage, "chunks/aa/"); files != "[]" {
+		t.Errorf("The new file is listed: %s", files)
+	}
+	if files := listFiles(storage, "snapshots/"); files != "[host1/]" {
+		t.Errorf("The snapshot directories are %s", files)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if files := listFiles(storage, "chunks"); files != "[aa/]" {
+		t.Errorf("The chunk directories are %s", files)
+	}
+
+	// Overwritten and deleted files are still seen as they were for a while
+	storage.UploadFile(0, "chunks/aa/bb", []byte("new content"))
+	storage.MoveFile(0, "snapshots/host1/1", "snapshots/host1/2")
+	chunk := CreateChunk(CreateConfig(), true)
+	if err = storage.DownloadFile(0, "chunks/aa/bb", chunk); err != nil || string(chunk.GetBytes()) != "old" {
+		t.Errorf("The overwritten file was read as '%s': %v", chunk.GetBytes(), err)
+	}
+	if files := listFiles(storage, "snapshots/host1"); files != "[1]" {
+		t.Errorf("The moved file is listed as %s", files)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	chunk.Reset(false)
+	if err = storage.DownloadFile(0, "chunks/aa/bb", chunk); err != nil || string(chunk.GetBytes()) != "new content" {
+		t.Errorf("The overwritten file was read as '%s': %v", chunk.GetBytes(), err)
+	}
+	if files := listFiles(storage, "snapshots/host1"); files != "[2]" {
+		t.Errorf("The moved file is listed as %s", files)
+	}
+
+	// Storages with the same name share their files
+	other, _ := CreateMockStorage("mocktest/consistency", 1)
+	if exist, _, _, _ := other.GetFileInfo(0, "snapshots/host1/2"); !exist {
+		t.Errorf("The file uploaded to one mock storage can't be found in the other")
+	}
+
+	// Injected failures are retried, although some of the lost responses are for requests carried out
+	removeMockStore("mocktest/faults")
+	storage, _ = CreateMockStorage("mocktest/faults?errors=0.3&throttle=0.2&seed=1", 1)
+	storage.SetRetryPolicy(CreateRetryPolicy(50, 0.0001, 0, 0))
+	for i := 0; i < 50; i++ {
+		if err = storage.UploadFile(0, fmt.Sprintf("chunks/%d", i), []byte(fmt.Sprintf("content%d", i))); err != nil {
+			t.Errorf("Failed to upload file %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		chunk.Reset(false)
+		err = storage.DownloadFile(0, fmt.Sprintf("chunks/%d", i), chunk)
+		if err != nil || string(chunk.GetBytes()) != fmt.Sprintf("content%d", i) {
+			t.Errorf("File %d was downloaded as '%s': %v", i, chunk.GetBytes(), err)
+		}
+	}
+	faults := storage.InjectedFaults()
+	if faults["error"] == 0 || faults["lost"] == 0 || faults["throttle"] == 0 {
+		t.Errorf("The injected faults are %v", faults)
+	}
+
+	// Without retries the failures reach the caller
+	storage, _ = CreateMockStorage("mocktest/faults?errors=0.5&seed=1", 1)
+	storage.SetRetryPolicy(CreateRetryPolicy(1, 0, 0, 0))
+	failures := 0
+	for i := 0; i < 20; i++ {
+		err = storage.UploadFile(0, fmt.Sprintf("chunks/%d", i), []byte("content"))
+		if mockError, ok := err.(*MockStorageError); ok && mockError.Status >= 500 {
+			failures++
+		} else if err != nil {
+			t.Errorf("Uploading file %d returned %v", i, err)
+		}
+	}
+	if failures == 0 || failures == 20 {
+		t.Errorf("%d out of 20 uploads failed", failures)
+	}
+
+	storage, _ = CreateMockStorage("mocktest/faults?truncate=1", 1)
+	chunk.Reset(false)
+	if err = storage.DownloadFile(0, "chunks/0", chunk); err != nil || len(chunk.GetBytes()) >= len("content0") {
+		t.Errorf("The truncated download is '%s': %v", chunk.GetBytes(), err)
+	}
+
+	if _, err = CreateMockStorage("mocktest/faults?errors=2", 1); err == nil {
+		t.Errorf("An invalid probability was accepted")
+	}
+	if _, err = CreateMockStorage("mocktest/faults?outage=1h", 1); err == nil {
+		t.Errorf("An unknown option was accepted")
+	}
+}
+
+func TestMockStorageBackup(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "mockstorage")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(repository, "dir1"), 0700)
+	for _, file := range []string{"file1", "file2", "dir1/file3"} {
+		createRandomFile(joinPath(repository, file), 100000)
+	}
+
+	// The backup and the restore succeed despite the failed and throttled requests
+	removeMockStore("mocktest/backup")
+	storage, err := CreateMockStorage("mocktest/backup?errors=0.2&throttle=0.1&seed=7", 1)
+	if err != nil {
+		t.Fatalf("Failed to create the mock storage: %v", err)
+	}
+	storage.SetRetryPolicy(CreateRetryPolicy(20, 0.0001, 0, 0))
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, 1, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	restored := filepath.Join(testDir, "restored")
+	os.MkdirAll(restored, 0700)
+	if failures := backupManager.Restore(restored, 1, true, false, 1, false, false, false, false, nil, false); failures != 0 {
+		t.Errorf("%d files failed to be restored", failures)
+	}
+	for _, file := range []string{"file1", "file2", "dir1/file3"} {
+		if hash1, hash2 := getFileHash(joinPath(repository, file)), getFileHash(joinPath(restored, file)); hash1 != hash2 {
+			t.Errorf("File %s has a hash of %s after being restored instead of %s", file, hash2, hash1)
+		}
+	}
+
+	faults := storage.InjectedFaults()
+	if faults["error"] == 0 || faults["throttle"] == 0 {
+		t.Errorf("The injected faults are %v", faults)
+	}
+}
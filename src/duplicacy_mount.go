@@ -0,0 +1,67 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// MountSnapshots serves the snapshots in the storage as a read-only WebDAV share on the loopback address 'address',
+// and maps the share to the drive 'mountPoint' on Windows ("*" for the first available drive letter), until the
+// process is interrupted.  On other platforms the share is only served and can be connected to by any WebDAV client.
+// The share requires no credentials, so other addresses are rejected.
+func MountSnapshots(manager *SnapshotManager, address string, mountPoint string) bool {
+
+	if !isLoopbackAddress(address) {
+		LOG_ERROR("MOUNT_ADDRESS", "The snapshots can only be mounted on a loopback address, not %s", address)
+		return false
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		LOG_ERROR("MOUNT_LISTEN", "Failed to listen on %s: %v", address, err)
+		return false
+	}
+
+	server := &http.Server{Handler: createMountHandler(manager, listener.Addr().String())}
+	go server.Serve(listener)
+	defer server.Close()
+
+	url := fmt.Sprintf("http://%s/", listener.Addr().String())
+	drive, unmount, err := mountWebDAV(url, mountPoint)
+	if err != nil {
+		LOG_ERROR("MOUNT_DRIVE", "Failed to mount %s: %v", url, err)
+		return false
+	}
+	if drive != "" {
+		LOG_INFO("MOUNT_READY", "Snapshots are available at %s (served from %s); press Ctrl-C to unmount", drive, url)
+	} else {
+		LOG_INFO("MOUNT_READY", "Snapshots are available at %s; press Ctrl-C to stop", url)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	signal.Stop(signals)
+
+	unmount()
+	LOG_INFO("MOUNT_END", "Snapshots are no longer available")
+	return true
+}
+
+// createMountHandler creates the WebDAV handler for the share, which only accepts requests sent to 'address'.
+func createMountHandler(manager *SnapshotManager, address string) http.Handler {
+	handler := createSnapshotHandler(CreateSnapshotFileSystem(manager), "MOUNT_REQUEST")
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if checkRequestHost(writer, request, address, "MOUNT_HOST") {
+			handler.ServeHTTP(writer, request)
+		}
+	})
+}
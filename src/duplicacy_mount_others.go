@@ -0,0 +1,20 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build !windows
+
+package duplicacy
+
+import (
+	"fmt"
+)
+
+// mountWebDAV does nothing as there isn't a WebDAV client available on every platform; the share can be mounted with
+// davfs2 on Linux, or from the Finder on macOS.
+func mountWebDAV(url string, mountPoint string) (drive string, unmount func(), err error) {
+	if mountPoint != "" {
+		return "", nil, fmt.Errorf("mapping to a drive is only supported on Windows")
+	}
+	return "", func() {}, nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestMountHandler(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "mount")
+	os.RemoveAll(testDir)
+
+	os.MkdirAll(joinPath(testDir, "repository1", DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(testDir, "repository1", "file1"), 10000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(filepath.Join(testDir, "repository1", DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(filepath.Join(testDir, "repository1"), true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	server := httptest.NewUnstartedServer(nil)
+	server.Config.Handler = createMountHandler(backupManager.SnapshotManager, server.Listener.Addr().String())
+	server.Start()
+	defer server.Close()
+
+	send := func(host string) int {
+		request, _ := http.NewRequest("PROPFIND", server.URL+"/host1/1/", nil)
+		request.Header.Set("Depth", "1")
+		if host != "" {
+			request.Host = host
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	if status := send(""); status != http.StatusMultiStatus {
+		t.Errorf("A request sent to the share returned %d", status)
+	}
+	port := strings.Split(server.Listener.Addr().String(), ":")[1]
+	if status := send("localhost:" + port); status != http.StatusMultiStatus {
+		t.Errorf("A request sent to localhost returned %d", status)
+	}
+	if status := send("example.com:" + port); status != http.StatusForbidden {
+		t.Errorf("A request sent to another host returned %d", status)
+	}
+
+	// The share requires no credentials, so it can't be served on all addresses
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(Exception); !ok || e.LogID != "MOUNT_ADDRESS" {
+					panic(r)
+				}
+			}
+		}()
+		setTestingT(nil)
+		defer setTestingT(t)
+		if MountSnapshots(backupManager.SnapshotManager, ":0", "") {
+			t.Errorf("The snapshots were mounted on all addresses")
+		}
+	}()
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// The drive letter assigned by 'net use *'
+var mappedDriveRegex = regexp.MustCompile(`\b([A-Za-z]:)`)
+
+// mountWebDAV maps the WebDAV share at 'url' to the drive 'mountPoint' using the WebClient service, which makes the
+// share accessible from the Explorer like any other network drive.  Files larger than the limit set by the
+// FileSizeLimitInBytes registry value of the WebClient service (50MB by default) can't be opened from the drive.
+func mountWebDAV(url string, mountPoint string) (drive string, unmount func(), err error) {
+
+	if mountPoint == "" {
+		mountPoint = "*"
+	}
+
+	output, err := exec.Command("net", "use", mountPoint, url).CombinedOutput()
+	if err != nil {
+		return "", nil, fmt.Errorf("%v: %s (the WebClient service must be running)", err,
+			strings.TrimSpace(string(output)))
+	}
+
+	drive = mountPoint
+	if mountPoint == "*" {
+		match := mappedDriveRegex.FindStringSubmatch(string(output))
+		if match == nil {
+			return "", nil, fmt.Errorf("unrecognized output from 'net use': %s", strings.TrimSpace(string(output)))
+		}
+		drive = strings.ToUpper(match[1])
+	}
+
+	unmount = func() {
+		output, err := exec.Command("net", "use", drive, "/delete", "/y").CombinedOutput()
+		if err != nil {
+			LOG_WARN("MOUNT_DELETE", "Failed to unmap the drive %s: %v: %s", drive, err,
+				strings.TrimSpace(string(output)))
+		}
+	}
+	return drive, unmount, nil
+}
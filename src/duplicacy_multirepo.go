@@ -0,0 +1,256 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The option that limits the transfer rate of each command, used to share the bandwidth budget of the 'all' command
+// among the repositories.  Commands not listed here run without a limit.
+var multiRepositoryRateLimitOptions = map[string]string{
+	"backup":  "-limit-rate",
+	"restore": "-limit-rate",
+	"copy":    "-upload-limit-rate",
+}
+
+// MultiRepositoryOptions configures RunInRepositories.
+type MultiRepositoryOptions struct {
+	Executable string   // the duplicacy executable run with -json in each repository
+	Arguments  []string // the command and its options, such as 'backup -stats'
+	Parallel   int      // the number of repositories processed at the same time
+	RateLimit  int      // the total transfer rate in kB/s shared by the running commands; 0 means unlimited
+}
+
+// MultiRepositoryResult is the outcome of the command in one repository, as shown in the summary report.
+type MultiRepositoryResult struct {
+	Repository string  `json:"repository"`
+	Success    bool    `json:"success"`
+	ExitCode   int     `json:"exit_code"`
+	Warnings   int     `json:"warnings"`
+	Message    string  `json:"message,omitempty"`
+	StartTime  int64   `json:"start_time"`
+	Duration   float64 `json:"duration"`
+}
+
+// ListRepositories returns the repositories configured in the directory, in the order of the file names.  Each
+// subdirectory (or a link to one) is a repository, and each file lists repositories one path per line, where empty
+// lines and lines starting with '#' are ignored.  Relative paths in files are relative to the directory.
+func ListRepositories(directory string) (repositories []string, err error) {
+
+	directory, err = filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(directory)
+	if err != nil {
+		return nil, err
+	}
+	names, err := file.Readdirnames(0)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	listed := make(map[string]bool)
+	add := func(repository string) {
+		if !filepath.IsAbs(repository) {
+			repository = filepath.Join(directory, repository)
+		}
+		repository = filepath.Clean(repository)
+		if !listed[repository] {
+			listed[repository] = true
+			repositories = append(repositories, repository)
+		}
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(directory, name)
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if stat.IsDir() {
+			add(name)
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				add(line)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+		}
+	}
+
+	return repositories, nil
+}
+
+// getRepositoryArguments returns the arguments of the command run in each repository.  When the bandwidth budget is
+// set, each of the commands that run at the same time gets an equal share of it.
+func getRepositoryArguments(options MultiRepositoryOptions, numberOfRepositories int) []string {
+	arguments := append([]string{"-json"}, options.Arguments...)
+	if options.RateLimit <= 0 || len(options.Arguments) == 0 {
+		return arguments
+	}
+
+	rateOption, found := multiRepositoryRateLimitOptions[options.Arguments[0]]
+	if !found {
+		return arguments
+	}
+
+	running := options.Parallel
+	if running > numberOfRepositories {
+		running = numberOfRepositories
+	}
+	if running < 1 {
+		running = 1
+	}
+	rate := options.RateLimit / running
+	if rate < 1 {
+		rate = 1
+	}
+
+	// The option goes right after the command so that it applies to the command rather than the global options
+	return append([]string{"-json", options.Arguments[0], rateOption, strconv.Itoa(rate)}, options.Arguments[1:]...)
+}
+
+// RunInRepositories runs the command in each repository, options.Parallel at a time, and returns the results in the
+// order of the repositories.  Warnings and errors of the commands are logged with the repository they come from.
+func RunInRepositories(repositories []string, options MultiRepositoryOptions) []MultiRepositoryResult {
+
+	if options.Parallel < 1 {
+		options.Parallel = 1
+	}
+	arguments := getRepositoryArguments(options, len(repositories))
+	command := strings.Join(options.Arguments, " ")
+
+	results := make([]MultiRepositoryResult, len(repositories))
+	indices := make(chan int, len(repositories))
+	for i := range repositories {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	for i := 0; i < options.Parallel && i < len(repositories); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				if IsOperationCancelled() {
+					results[index] = MultiRepositoryResult{Repository: repositories[index],
+						ExitCode: InterruptedExitCode, Message: "Not run because the command was interrupted"}
+					continue
+				}
+				results[index] = runInRepository(repositories[index], options.Executable, arguments, command)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runInRepository runs the command in the repository and waits for it to exit.
+func runInRepository(repository string, executable string, arguments []string, command string) (result MultiRepositoryResult) {
+	result = MultiRepositoryResult{Repository: repository, StartTime: time.Now().Unix()}
+	startTime := time.Now()
+	defer func() {
+		result.Duration = time.Since(startTime).Seconds()
+	}()
+
+	process := exec.Command(executable, arguments...)
+	process.Dir = repository
+	stdout, err := process.StdoutPipe()
+	if err == nil {
+		err = process.Start()
+	}
+	if err != nil {
+		result.ExitCode = otherExitCode
+		result.Message = err.Error()
+		LOG_WARN("ALL_RUN", "Failed to run %s in %s: %v", command, repository, err)
+		return result
+	}
+	LOG_INFO("ALL_RUN_START", "Running %s in %s", command, repository)
+
+	success, message, warnings := readCommandRecords(stdout, func(record *JSONRecord) {
+		LOG_WARN("ALL_COMMAND", "%s: %s %s", repository, record.ID, record.Message)
+	})
+	err = process.Wait()
+
+	result.Warnings = warnings
+	result.Message = message
+	if exitError, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitError.ExitCode()
+	} else if err != nil {
+		result.ExitCode = otherExitCode
+		if result.Message == "" {
+			result.Message = err.Error()
+		}
+	}
+	// Skipped files make the command exit with WarningExitCode, but it still completed
+	result.Success = success && (result.ExitCode == SuccessExitCode || result.ExitCode == WarningExitCode)
+
+	if result.Success {
+		LOG_INFO("ALL_RUN_END", "%s completed in %s", command, repository)
+	} else {
+		if result.Message == "" {
+			result.Message = fmt.Sprintf("Exited with code %d", result.ExitCode)
+		}
+		LOG_WARN("ALL_RUN_FAIL", "%s failed in %s: %s", command, repository, result.Message)
+	}
+	return result
+}
+
+// PrintRepositoryReport logs the summary of the results and returns the number of repositories where the command
+// failed.
+func PrintRepositoryReport(results []MultiRepositoryResult) (failed int) {
+
+	width := len("Repository")
+	for _, result := range results {
+		if len(result.Repository) > width {
+			width = len(result.Repository)
+		}
+	}
+
+	LOG_INFO("ALL_REPORT", "%-*s  %-9s %4s %8s %9s  %s", width, "Repository", "Status", "Exit", "Warnings", "Time", "Message")
+	for _, result := range results {
+		status := "succeeded"
+		if !result.Success {
+			status = "failed"
+			failed++
+		}
+		line := fmt.Sprintf("%-*s  %-9s %4d %8d %9s  %s", width, result.Repository, status, result.ExitCode,
+			result.Warnings, PrettyTime(int64(result.Duration)), result.Message)
+		LOG_INFO("ALL_REPORT", "%s", strings.TrimRight(line, " "))
+	}
+	LOG_INFO("ALL_REPORT", "%d repositories, %d succeeded, %d failed", len(results), len(results)-failed, failed)
+
+	return failed
+}
@@ -0,0 +1,103 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMultiRepository(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "multirepo")
+	os.RemoveAll(testDir)
+	reposDir := filepath.Join(testDir, "repos.d")
+	for _, name := range []string{"home", "srv", "broken", "repos.d/b-local"} {
+		os.MkdirAll(filepath.Join(testDir, name), 0700)
+	}
+	list := "# repositories listed by path\n" + filepath.Join(testDir, "home") + "\n\n../srv\n" +
+		filepath.Join(testDir, "broken") + "\n" + filepath.Join(testDir, "home") + "\n"
+	ioutil.WriteFile(filepath.Join(reposDir, "a.conf"), []byte(list), 0600)
+	ioutil.WriteFile(filepath.Join(reposDir, ".hidden"), []byte("/nonexistent\n"), 0600)
+
+	repositories, err := ListRepositories(reposDir)
+	if err != nil {
+		t.Fatalf("Failed to list the repositories: %v", err)
+	}
+	expected := []string{filepath.Join(testDir, "home"), filepath.Join(testDir, "srv"), filepath.Join(testDir, "broken"),
+		filepath.Join(reposDir, "b-local")}
+	if strings.Join(repositories, ",") != strings.Join(expected, ",") {
+		t.Errorf("The repositories are listed as %v", repositories)
+	}
+
+	// The bandwidth budget is split among the commands running at the same time
+	arguments := getRepositoryArguments(MultiRepositoryOptions{Arguments: []string{"backup", "-stats"}, Parallel: 2,
+		RateLimit: 1000}, 4)
+	if strings.Join(arguments, " ") != "-json backup -limit-rate 500 -stats" {
+		t.Errorf("The command is run as '%s'", strings.Join(arguments, " "))
+	}
+	arguments = getRepositoryArguments(MultiRepositoryOptions{Arguments: []string{"copy"}, Parallel: 4, RateLimit: 900}, 3)
+	if strings.Join(arguments, " ") != "-json copy -upload-limit-rate 300" {
+		t.Errorf("The command is run as '%s'", strings.Join(arguments, " "))
+	}
+	arguments = getRepositoryArguments(MultiRepositoryOptions{Arguments: []string{"check", "-a"}, Parallel: 2,
+		RateLimit: 1000}, 4)
+	if strings.Join(arguments, " ") != "-json check -a" {
+		t.Errorf("The command is run as '%s'", strings.Join(arguments, " "))
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// A fake duplicacy that fails in the 'broken' repository and skips a file elsewhere
+	executable := filepath.Join(testDir, "duplicacy")
+	script := `#!/bin/sh
+echo "$@" > runs
+case "$PWD" in
+*/broken)
+  echo '{"type":"log","level":"ERROR","id":"STORAGE_CREATE","message":"Failed to load the storage"}'
+  echo '{"type":"result","success":false}'
+  exit 105;;
+esac
+echo '{"type":"log","level":"WARN","id":"BACKUP_SKIPPED","message":"Skipped a file"}'
+echo '{"type":"result","command":"backup","success":true}'
+exit 1
+`
+	if err := ioutil.WriteFile(executable, []byte(script), 0700); err != nil {
+		t.Fatalf("Failed to create the executable: %v", err)
+	}
+
+	results := RunInRepositories(repositories, MultiRepositoryOptions{Executable: executable,
+		Arguments: []string{"backup", "-stats"}, Parallel: 3})
+	if len(results) != len(repositories) {
+		t.Fatalf("%d results for %d repositories", len(results), len(repositories))
+	}
+	for i, result := range results {
+		if result.Repository != repositories[i] {
+			t.Errorf("Result %d is for %s", i, result.Repository)
+		}
+		runs, _ := ioutil.ReadFile(filepath.Join(repositories[i], "runs"))
+		if strings.TrimSpace(string(runs)) != "-json backup -stats" {
+			t.Errorf("The command was run in %s as '%s'", repositories[i], strings.TrimSpace(string(runs)))
+		}
+		broken := strings.HasSuffix(result.Repository, "broken")
+		if broken && (result.Success || result.ExitCode != StorageExitCode || result.Message != "Failed to load the storage") {
+			t.Errorf("The failed command was reported as %+v", result)
+		} else if !broken && (!result.Success || result.Warnings != 1) {
+			t.Errorf("The command in %s was reported as %+v", result.Repository, result)
+		}
+	}
+
+	if failed := PrintRepositoryReport(results); failed != 1 {
+		t.Errorf("%d repositories were reported as failed", failed)
+	}
+}
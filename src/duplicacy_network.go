@@ -0,0 +1,246 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetworkOptions control how the clients of a storage connect to its servers.  By default both IPv4 and IPv6
+// addresses are tried, with a connection to the other family started if the first one hasn't succeeded after
+// FallbackDelay (happy eyeballs), so that a broken IPv6 path doesn't stall every connection.  Pins replace the DNS
+// lookup of a host with fixed addresses, and Resolvers replace the DNS servers of the system for the other hosts.
+type NetworkOptions struct {
+	IPVersion     int                 `json:"ip_version,omitempty"`     // 4 or 6 to use only that family; both if 0
+	FallbackDelay float64             `json:"fallback_delay,omitempty"` // in seconds; the default of 0.3 if 0, disabled if negative
+	Resolvers     []string            `json:"resolvers,omitempty"`      // DNS servers as host:port, tried in order
+	Pins          map[string][]string `json:"pins,omitempty"`           // addresses of hosts, tried in order
+}
+
+// ParseNetworkOptions parses options given as comma separated settings, such as
+// 'ip=4,fallback-delay=100ms,resolver=1.1.1.1,pin.api.backblazeb2.com=104.153.233.177'.  The resolver and pin
+// settings can be repeated to add more servers or addresses.
+func ParseNetworkOptions(settings string) (*NetworkOptions, error) {
+
+	options := &NetworkOptions{}
+	for _, setting := range strings.Split(settings, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		equal := strings.Index(setting, "=")
+		if equal <= 0 {
+			return nil, fmt.Errorf("the setting '%s' isn't in the form of <name>=<value>", setting)
+		}
+		name, value := setting[:equal], setting[equal+1:]
+
+		var err error
+		switch {
+		case name == "ip":
+			switch value {
+			case "4", "6":
+				options.IPVersion, _ = strconv.Atoi(value)
+			case "any":
+				options.IPVersion = 0
+			default:
+				err = fmt.Errorf("must be 4, 6, or any")
+			}
+		case name == "fallback-delay":
+			if value == "off" {
+				options.FallbackDelay = -1
+			} else if options.FallbackDelay, err = parseRetryDelay(value); err == nil && options.FallbackDelay == 0 {
+				err = fmt.Errorf("use 'off' to disable the fallback")
+			}
+		case name == "resolver":
+			var resolver string
+			if resolver, err = normalizeNetworkAddress(value, "53"); err == nil {
+				options.Resolvers = append(options.Resolvers, resolver)
+			}
+		case strings.HasPrefix(name, "pin."):
+			host := strings.ToLower(name[len("pin."):])
+			if host == "" {
+				return nil, fmt.Errorf("no host given for the pinned address %s", value)
+			}
+			if net.ParseIP(value) == nil {
+				err = fmt.Errorf("not an IP address")
+			} else {
+				if options.Pins == nil {
+					options.Pins = make(map[string][]string)
+				}
+				options.Pins[host] = append(options.Pins[host], value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown setting '%s'", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value '%s' for %s: %v", value, name, err)
+		}
+	}
+	return options, nil
+}
+
+// normalizeNetworkAddress returns 'address' as host:port, adding 'defaultPort' if there is no port.
+func normalizeNetworkAddress(address string, defaultPort string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), defaultPort
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("not an IP address")
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port %s", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// String returns the options in the format accepted by ParseNetworkOptions.
+func (options *NetworkOptions) String() string {
+	var settings []string
+	if options.IPVersion != 0 {
+		settings = append(settings, fmt.Sprintf("ip=%d", options.IPVersion))
+	}
+	if options.FallbackDelay < 0 {
+		settings = append(settings, "fallback-delay=off")
+	} else if options.FallbackDelay > 0 {
+		settings = append(settings, fmt.Sprintf("fallback-delay=%g", options.FallbackDelay))
+	}
+	for _, resolver := range options.Resolvers {
+		settings = append(settings, "resolver="+resolver)
+	}
+	var hosts []string
+	for host := range options.Pins {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		for _, address := range options.Pins[host] {
+			settings = append(settings, fmt.Sprintf("pin.%s=%s", host, address))
+		}
+	}
+	return strings.Join(settings, ",")
+}
+
+// dialer returns the dialer for the options; 'options' may be nil for the defaults.
+func (options *NetworkOptions) dialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if options == nil {
+		return dialer
+	}
+
+	if options.FallbackDelay != 0 {
+		dialer.FallbackDelay = time.Duration(options.FallbackDelay * float64(time.Second))
+	}
+
+	if len(options.Resolvers) > 0 {
+		resolvers := options.Resolvers
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (connection net.Conn, err error) {
+				var resolverDialer net.Dialer
+				for _, resolver := range resolvers {
+					connection, err = resolverDialer.DialContext(ctx, network, resolver)
+					if err == nil {
+						return connection, nil
+					}
+				}
+				return nil, err
+			},
+		}
+	}
+	return dialer
+}
+
+// DialContext connects to 'address' by the options; 'options' may be nil for the defaults.
+func (options *NetworkOptions) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+
+	dialer := options.dialer()
+	if options == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	if network == "tcp" && options.IPVersion != 0 {
+		network = fmt.Sprintf("tcp%d", options.IPVersion)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	pinned, found := options.Pins[strings.ToLower(host)]
+	if !found {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	err = fmt.Errorf("no pinned address of %s is an IPv%d address", host, options.IPVersion)
+	for _, ip := range pinned {
+		if isIPv4 := net.ParseIP(ip).To4() != nil; (network == "tcp4" && !isIPv4) || (network == "tcp6" && isIPv4) {
+			continue
+		}
+		var connection net.Conn
+		connection, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return connection, nil
+		}
+		LOG_DEBUG("NETWORK_PIN", "Failed to connect to %s at %s: %v", host, ip, err)
+	}
+	return nil, err
+}
+
+// httpClient returns an HTTP client connecting by the options; 'options' may be nil for the default client.
+func (options *NetworkOptions) httpClient() *http.Client {
+	if options == nil {
+		return http.DefaultClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = options.DialContext
+	return &http.Client{Transport: transport}
+}
+
+// The network options of the storage being created by CreateStorage, which are picked up by the clients of the
+// storage as they are created.  Storages are created one at a time to keep the options apart.
+var storageNetworkLock sync.Mutex
+var storageNetwork *NetworkOptions
+var storageNetworkUsed bool
+
+// setStorageNetwork makes 'options' the network options of storage clients until clearStorageNetwork is called.
+func setStorageNetwork(options *NetworkOptions) {
+	storageNetworkLock.Lock()
+	storageNetwork = options
+	storageNetworkUsed = false
+}
+
+// clearStorageNetwork restores the default network options and returns true if any storage client used the ones
+// being cleared.
+func clearStorageNetwork() bool {
+	used := storageNetworkUsed
+	storageNetwork = nil
+	storageNetworkUsed = false
+	storageNetworkLock.Unlock()
+	return used
+}
+
+// getStorageNetwork returns the network options for a storage client being created, which may be nil.  It must only
+// be called by storages, while they are being created.
+func getStorageNetwork() *NetworkOptions {
+	storageNetworkUsed = true
+	return storageNetwork
+}
+
+// newStorageHTTPClient returns the HTTP client for a storage being created.
+func newStorageHTTPClient() *http.Client {
+	return getStorageNetwork().httpClient()
+}
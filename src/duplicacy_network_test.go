@@ -0,0 +1,169 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseNetworkOptions(t *testing.T) {
+
+	settings := "ip=4,fallback-delay=100ms,resolver=1.1.1.1,resolver=[2606:4700::1111]:5353," +
+		"pin.API.example.com=192.0.2.1,pin.api.example.com=2001:db8::1"
+	options, err := ParseNetworkOptions(settings)
+	if err != nil {
+		t.Fatalf("Failed to parse the network options: %v", err)
+	}
+	if options.IPVersion != 4 || options.FallbackDelay != 0.1 || len(options.Resolvers) != 2 ||
+		options.Resolvers[0] != "1.1.1.1:53" || options.Resolvers[1] != "[2606:4700::1111]:5353" ||
+		len(options.Pins["api.example.com"]) != 2 {
+		t.Errorf("The network options are %+v", options)
+	}
+
+	expected := "ip=4,fallback-delay=0.1,resolver=1.1.1.1:53,resolver=[2606:4700::1111]:5353," +
+		"pin.api.example.com=192.0.2.1,pin.api.example.com=2001:db8::1"
+	if options.String() != expected {
+		t.Errorf("The network options are shown as %s", options.String())
+	}
+	if reparsed, err := ParseNetworkOptions(options.String()); err != nil || reparsed.String() != expected {
+		t.Errorf("The network options are reparsed as %v: %v", reparsed, err)
+	}
+
+	if options, _ := ParseNetworkOptions("fallback-delay=off"); options.FallbackDelay >= 0 {
+		t.Errorf("The fallback delay is %g after being turned off", options.FallbackDelay)
+	}
+
+	for _, invalid := range []string{"ip=5", "fallback-delay=0", "resolver=dns.example.com", "resolver=1.1.1.1:99999",
+		"pin.example.com=example.net", "pin.=192.0.2.1", "dns=1.1.1.1", "ip"} {
+		if _, err := ParseNetworkOptions(invalid); err == nil {
+			t.Errorf("The network options '%s' were accepted", invalid)
+		}
+	}
+}
+
+func TestNetworkDial(t *testing.T) {
+
+	setTestingT(t)
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connection.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// The pinned addresses are tried in order, skipping those of the wrong IP version
+	options, _ := ParseNetworkOptions("pin.storage.invalid=::1,pin.storage.invalid=127.0.0.1")
+	connection, err := options.DialContext(context.Background(), "tcp", "storage.invalid:"+port)
+	if err != nil {
+		t.Errorf("Failed to connect to the pinned addresses: %v", err)
+	} else {
+		connection.Close()
+	}
+
+	options.IPVersion = 6
+	options.Pins["storage.invalid"] = []string{"127.0.0.1"}
+	if _, err = options.DialContext(context.Background(), "tcp", "storage.invalid:"+port); err == nil {
+		t.Errorf("An IPv4 address was used when only IPv6 is allowed")
+	}
+
+	// DNS queries go to the given resolver
+	resolver, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer resolver.Close()
+	queries := make(chan bool, 16)
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			if _, _, err := resolver.ReadFrom(buffer); err != nil {
+				return
+			}
+			queries <- true
+		}
+	}()
+
+	options, _ = ParseNetworkOptions("resolver=" + resolver.LocalAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	options.dialer().Resolver.LookupHost(ctx, "storage.example.com")
+	select {
+	case <-queries:
+	case <-time.After(time.Second):
+		t.Errorf("The resolver didn't receive any query")
+	}
+}
+
+func TestStorageNetwork(t *testing.T) {
+
+	setTestingT(t)
+
+	var lock sync.Mutex
+	var hosts []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		hosts = append(hosts, request.Host)
+		lock.Unlock()
+		_, port, _ := net.SplitHostPort(request.Host)
+		switch request.URL.Path {
+		case "/b2api/v1/b2_authorize_account":
+			json.NewEncoder(writer).Encode(map[string]string{"accountId": "account", "authorizationToken": "token",
+				"apiUrl": "http://api.b2.invalid:" + port, "downloadUrl": "http://download.b2.invalid:" + port})
+		case "/b2api/v1/b2_list_buckets":
+			json.NewEncoder(writer).Encode(map[string][]ListBucketOutput{"buckets": {{BucketName: "bucket",
+				BucketID: "id"}}})
+		default:
+			writer.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	authorizationURL := B2AuthorizationURL
+	B2AuthorizationURL = "http://auth.b2.invalid:" + port + "/b2api/v1/b2_authorize_account"
+	defer func() { B2AuthorizationURL = authorizationURL }()
+
+	// The hosts of the storage can only be reached by their pinned addresses
+	network, _ := ParseNetworkOptions("pin.auth.b2.invalid=127.0.0.1,pin.api.b2.invalid=127.0.0.1")
+	preference := Preference{
+		Name:              "default",
+		StorageURL:        "b2://bucket",
+		Keys:              map[string]string{"b2_id": "id", "b2_key": "key"},
+		DoNotSavePassword: true,
+		Network:           network,
+	}
+	storage := CreateStorage(preference, false, 1)
+	if storage == nil {
+		t.Fatalf("Failed to create the storage")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(hosts) != 2 || !strings.HasPrefix(hosts[0], "auth.b2.invalid:") || !strings.HasPrefix(hosts[1], "api.b2.invalid:") {
+		t.Errorf("The requests were sent to %v", hosts)
+	}
+
+	// Clients created outside CreateStorage aren't affected by the options
+	if client := NewB2Client("id", "key", "", "", 1); client.HTTPClient != http.DefaultClient {
+		t.Errorf("The B2 client created outside CreateStorage doesn't use the default HTTP client")
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notifications are the built-in ways of reporting the results of commands run on a storage, saved in
+// Preference.Notifications.  Each notification is sent when the command completes or fails, unless its On field is
+// "success" or "failure", in which case it is only sent on the corresponding result.
+type Notifications struct {
+	Webhook      *WebhookNotification `json:"webhook,omitempty"`
+	Healthchecks string               `json:"healthchecks,omitempty"` // the ping url of a healthchecks.io check
+	Email        *EmailNotification   `json:"email,omitempty"`
+	Report       bool                 `json:"report,omitempty"` // upload a RunReport to the storage
+}
+
+// WebhookNotification posts a JSON payload to a url.  The payload is the NotificationEvent itself, or the output of
+// Template, a text/template executed on the NotificationEvent where the function 'json' encodes any value.
+type WebhookNotification struct {
+	URL      string            `json:"url"`
+	Template string            `json:"template,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	On       string            `json:"on,omitempty"`
+}
+
+// EmailNotification sends an email through an SMTP server.  Subject is a text/template executed on the
+// NotificationEvent, like the template of a webhook.
+type EmailNotification struct {
+	Server   string   `json:"server"` // host:port of the SMTP server
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject,omitempty"`
+	On       string   `json:"on,omitempty"`
+}
+
+// NotificationEvent describes the result of a command, as sent in notifications.
+type NotificationEvent struct {
+	Command    string      `json:"command"`
+	SnapshotID string      `json:"snapshot_id"`
+	Storage    string      `json:"storage"`
+	Hostname   string      `json:"hostname"`
+	Success    bool        `json:"success"`
+	Result     string      `json:"result"` // "success" or "failure"
+	Error      string      `json:"error,omitempty"`
+	StartTime  time.Time   `json:"start_time"`
+	EndTime    time.Time   `json:"end_time"`
+	Duration   float64     `json:"duration"` // in seconds
+	Summary    interface{} `json:"summary,omitempty"`
+}
+
+// NotificationOnValues are the valid values of the On field of a notification.
+var NotificationOnValues = []string{"always", "success", "failure"}
+
+const defaultEmailSubject = "Duplicacy {{.Command}} of {{.SnapshotID}} on {{.Storage}}: {{.Result}}"
+
+const defaultEmailBody = `Command:  {{.Command}}
+Snapshot: {{.SnapshotID}}
+Storage:  {{.Storage}}
+Host:     {{.Hostname}}
+Result:   {{.Result}}
+{{if .Error}}Error:    {{.Error}}
+{{end}}Started:  {{.StartTime.Format "2006-01-02 15:04:05"}}
+Duration: {{printf "%.0f" .Duration}} seconds
+{{if .Summary}}
+{{json .Summary}}
+{{end}}`
+
+var notificationTimeout = 30 * time.Second
+
+var notificationMutex sync.Mutex
+var activeNotifications *Notifications // the notifications of the command being run, nil if none
+var notificationEvent NotificationEvent
+var notificationsSent = false
+
+// EnableNotifications sets up the notifications to be sent when the command completes, and pings the start endpoint
+// of healthchecks.io.  Only the first call takes effect, so commands working on two storages notify the first one.
+func EnableNotifications(notifications *Notifications, command string, snapshotID string, storageName string) {
+	if notifications == nil {
+		return
+	}
+
+	notificationMutex.Lock()
+	if activeNotifications != nil {
+		notificationMutex.Unlock()
+		return
+	}
+	activeNotifications = notifications
+	hostname, _ := os.Hostname()
+	notificationEvent = NotificationEvent{
+		Command:    command,
+		SnapshotID: snapshotID,
+		Storage:    storageName,
+		Hostname:   hostname,
+		StartTime:  time.Now(),
+	}
+	notificationMutex.Unlock()
+
+	if notifications.Healthchecks != "" {
+		pingHealthchecks(notifications.Healthchecks, "/start", "")
+	}
+}
+
+// SendNotifications sends the notifications set up by EnableNotifications, unless they have already been sent.  The
+// data set by SetJSONResult is included as the summary of the command if it succeeded.  It is called when the command
+// completes, and by CatchLogException on failures.
+func SendNotifications(success bool, failure *Exception) {
+	notificationMutex.Lock()
+	if activeNotifications == nil || notificationsSent {
+		notificationMutex.Unlock()
+		return
+	}
+	notificationsSent = true
+	notifications := activeNotifications
+	event := notificationEvent
+	notificationMutex.Unlock()
+
+	event.Success = success
+	event.Result = "success"
+	if !success {
+		event.Result = "failure"
+	}
+	if failure != nil {
+		event.Error = failure.Message
+	} else if success {
+		event.Summary = jsonResultData
+	}
+	event.EndTime = time.Now()
+	event.Duration = event.EndTime.Sub(event.StartTime).Seconds()
+
+	if notifications.Webhook != nil && shouldNotify(notifications.Webhook.On, success) {
+		sendWebhook(notifications.Webhook, &event)
+	}
+
+	if notifications.Healthchecks != "" {
+		if success {
+			pingHealthchecks(notifications.Healthchecks, "", "")
+		} else {
+			pingHealthchecks(notifications.Healthchecks, "/fail", event.Error)
+		}
+	}
+
+	if notifications.Email != nil && shouldNotify(notifications.Email.On, success) {
+		sendEmail(notifications.Email, &event)
+	}
+
+	if notifications.Report {
+		uploadRunReport(&event)
+	}
+}
+
+// shouldNotify returns true if a notification with the given 'on' value is to be sent on the result.
+func shouldNotify(on string, success bool) bool {
+	switch on {
+	case "success":
+		return success
+	case "failure":
+		return !success
+	default:
+		return true
+	}
+}
+
+// executeNotificationTemplate executes a template on the event.
+func executeNotificationTemplate(name string, text string, event *NotificationEvent) (string, error) {
+	functions := template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+	}
+	parsed, err := template.New(name).Funcs(functions).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	err = parsed.Execute(&buffer, event)
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// getWebhookPayload returns the body to be posted to the webhook.
+func getWebhookPayload(webhook *WebhookNotification, event *NotificationEvent) ([]byte, error) {
+	if webhook.Template == "" {
+		return json.Marshal(event)
+	}
+	payload, err := executeNotificationTemplate("webhook", webhook.Template, event)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid([]byte(payload)) {
+		return nil, fmt.Errorf("the template did not produce valid JSON")
+	}
+	return []byte(payload), nil
+}
+
+func sendWebhook(webhook *WebhookNotification, event *NotificationEvent) {
+	payload, err := getWebhookPayload(webhook, event)
+	if err != nil {
+		LOG_WARN("NOTIFICATION_WEBHOOK", "Failed to create the webhook payload: %v", err)
+		return
+	}
+
+	request, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		LOG_WARN("NOTIFICATION_WEBHOOK", "Failed to create the webhook request: %v", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range webhook.Headers {
+		request.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: notificationTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		LOG_WARN("NOTIFICATION_WEBHOOK", "Failed to notify %s: %v", webhook.URL, err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		LOG_WARN("NOTIFICATION_WEBHOOK", "Failed to notify %s: %s", webhook.URL, response.Status)
+		return
+	}
+	LOG_DEBUG("NOTIFICATION_WEBHOOK", "Notified %s", webhook.URL)
+}
+
+// pingHealthchecks pings the success, /start, or /fail endpoint of a healthchecks.io check, with an optional message
+// to be shown in the log of the check.
+func pingHealthchecks(url string, endpoint string, message string) {
+	url = strings.TrimSuffix(url, "/") + endpoint
+	client := &http.Client{Timeout: notificationTimeout}
+	response, err := client.Post(url, "text/plain; charset=utf-8", strings.NewReader(message))
+	if err != nil {
+		LOG_WARN("NOTIFICATION_HEALTHCHECKS", "Failed to ping %s: %v", url, err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		LOG_WARN("NOTIFICATION_HEALTHCHECKS", "Failed to ping %s: %s", url, response.Status)
+		return
+	}
+	LOG_DEBUG("NOTIFICATION_HEALTHCHECKS", "Pinged %s", url)
+}
+
+// getEmailMessage returns the message to be sent, including the headers.
+func getEmailMessage(email *EmailNotification, event *NotificationEvent) ([]byte, error) {
+	subjectTemplate := email.Subject
+	if subjectTemplate == "" {
+		subjectTemplate = defaultEmailSubject
+	}
+	subject, err := executeNotificationTemplate("subject", subjectTemplate, event)
+	if err != nil {
+		return nil, err
+	}
+	body, err := executeNotificationTemplate("body", defaultEmailBody, event)
+	if err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", email.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(email.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", strings.Replace(strings.TrimSpace(subject), "\n", " ", -1))
+	fmt.Fprintf(&message, "Date: %s\r\n", event.EndTime.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return message.Bytes(), nil
+}
+
+func sendEmail(email *EmailNotification, event *NotificationEvent) {
+	message, err := getEmailMessage(email, event)
+	if err != nil {
+		LOG_WARN("NOTIFICATION_EMAIL", "Failed to create the email: %v", err)
+		return
+	}
+
+	var auth smtp.Auth
+	if email.Username != "" {
+		host := email.Server
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", email.Username, email.Password, host)
+	}
+
+	err = smtp.SendMail(email.Server, auth, email.From, email.To, message)
+	if err != nil {
+		LOG_WARN("NOTIFICATION_EMAIL", "Failed to send the email to %s: %v", strings.Join(email.To, ", "), err)
+		return
+	}
+	LOG_DEBUG("NOTIFICATION_EMAIL", "Sent the email to %s", strings.Join(email.To, ", "))
+}
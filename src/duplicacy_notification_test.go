@@ -0,0 +1,97 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNotifications(t *testing.T) {
+
+	setTestingT(t)
+
+	var mutex sync.Mutex
+	requests := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		mutex.Lock()
+		requests[request.URL.Path] = string(body)
+		if request.URL.Path == "/webhook" && request.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("The webhook header is '%s'", request.Header.Get("Authorization"))
+		}
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	defer func() {
+		activeNotifications = nil
+		notificationsSent = false
+		jsonResultData = nil
+	}()
+
+	notifications := &Notifications{
+		Webhook: &WebhookNotification{
+			URL:      server.URL + "/webhook",
+			Template: `{"text": "{{.Command}} {{.Result}}", "files": {{.Summary.NewFiles}}, "summary": {{json .Summary}}}`,
+			Headers:  map[string]string{"Authorization": "Bearer token"},
+		},
+		Healthchecks: server.URL + "/ping/",
+		Email:        &EmailNotification{Server: "localhost:0", From: "backup@example.com", To: []string{"a@example.com"}, On: "failure"},
+	}
+
+	EnableNotifications(notifications, "backup", "host1", "default")
+	EnableNotifications(&Notifications{Healthchecks: server.URL + "/other"}, "backup", "host1", "offsite")
+	SetJSONResult(&OperationSummary{Revision: 5, NewFiles: 3})
+	SendNotifications(true, nil)
+	SendNotifications(false, &Exception{LogID: "LATE", Message: "Notifications are only sent once"})
+
+	if _, found := requests["/ping/start"]; !found {
+		t.Errorf("The start endpoint was not pinged")
+	}
+	if _, found := requests["/ping"]; !found {
+		t.Errorf("The success endpoint was not pinged")
+	}
+	if _, found := requests["/ping/fail"]; found {
+		t.Errorf("The fail endpoint was pinged")
+	}
+	if _, found := requests["/other/start"]; found {
+		t.Errorf("The notifications of the second storage were enabled")
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(requests["/webhook"]), &payload); err != nil {
+		t.Fatalf("The webhook payload '%s' is invalid: %v", requests["/webhook"], err)
+	}
+	summary, _ := payload["summary"].(map[string]interface{})
+	if payload["text"] != "backup success" || payload["files"] != float64(3) || summary["revision"] != float64(5) {
+		t.Errorf("The webhook payload is %s", requests["/webhook"])
+	}
+
+	if _, err := getWebhookPayload(&WebhookNotification{Template: `{"text": {{.Command}}}`},
+		&NotificationEvent{Command: "backup"}); err == nil {
+		t.Errorf("A template producing invalid JSON was accepted")
+	}
+
+	if shouldNotify("failure", true) || !shouldNotify("failure", false) || !shouldNotify("", true) {
+		t.Errorf("The notification conditions are not respected")
+	}
+
+	event := &NotificationEvent{Command: "prune", SnapshotID: "host1", Storage: "default", Result: "failure",
+		Error: "Failed to list the chunks"}
+	message, err := getEmailMessage(notifications.Email, event)
+	if err != nil {
+		t.Fatalf("Failed to create the email: %v", err)
+	}
+	if !strings.Contains(string(message), "Subject: Duplicacy prune of host1 on default: failure\r\n") ||
+		!strings.Contains(string(message), "Error:    Failed to list the chunks\r\n") {
+		t.Errorf("The email is %s", message)
+	}
+}
@@ -6,6 +6,7 @@ package duplicacy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,7 +15,7 @@ import (
 	"net/http"
 	"strings"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 	"path/filepath"
 
@@ -38,15 +39,17 @@ type OneDriveClient struct {
 	HTTPClient *http.Client
 
 	TokenFile string
-	Token     *oauth2.Token
-	TokenLock *sync.Mutex
+	token     *tokenSource // holds an *oauth2.Token shared by all threads
 
-	IsConnected bool
-	TestMode    bool
+	connected int32 // set to 1 atomically after the first successful request
+	TestMode  bool
 
 	IsBusiness bool
 	RefreshTokenURL string
 	APIURL string
+
+	// Returns the context of the requests; the context of the running operation is used if it is nil
+	ContextFunction func() context.Context
 }
 
 func NewOneDriveClient(tokenFile string, isBusiness bool) (*OneDriveClient, error) {
@@ -62,10 +65,9 @@ func NewOneDriveClient(tokenFile string, isBusiness bool) (*OneDriveClient, erro
 	}
 
 	client := &OneDriveClient{
-		HTTPClient: http.DefaultClient,
+		HTTPClient: newStorageHTTPClient(),
 		TokenFile:  tokenFile,
-		Token:      token,
-		TokenLock:  &sync.Mutex{},
+		token:      newTokenSource(token),
 		IsBusiness: isBusiness,
 	}
 
@@ -86,6 +88,7 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 
 	var response *http.Response
 
+	ctx := getRequestContext(client.ContextFunction)
 	backoff := 1
 	for i := 0; i < 12; i++ {
 
@@ -111,7 +114,7 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 			inputReader = input.(*RateLimitedReader)
 		}
 
-		request, err := http.NewRequest(method, url, inputReader)
+		request, err := http.NewRequestWithContext(ctx, method, url, inputReader)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -121,10 +124,16 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 			request.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", reader.Length() - 1, reader.Length()))
 		}
 
+		token, generation := client.token.Get()
 		if url != client.RefreshTokenURL {
-			client.TokenLock.Lock()
-			request.Header.Set("Authorization", "Bearer "+client.Token.AccessToken)
-			client.TokenLock.Unlock()
+			// Renew an expired token before it is rejected
+			if !token.(*oauth2.Token).Valid() {
+				token, generation, err = client.token.Refresh(generation, client.refreshToken)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			request.Header.Set("Authorization", "Bearer "+token.(*oauth2.Token).AccessToken)
 		}
 		if contentType != "" {
 			request.Header.Set("Content-Type", contentType)
@@ -134,7 +143,7 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 
 		response, err = client.HTTPClient.Do(request)
 		if err != nil {
-			if client.IsConnected {
+			if atomic.LoadInt32(&client.connected) != 0 && ctx.Err() == nil {
 				if strings.Contains(err.Error(), "TLS handshake timeout") {
 					// Give a long timeout regardless of backoff when a TLS timeout happens, hoping that
 					// idle connections are not to be reused on reconnect.
@@ -156,7 +165,7 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 			return nil, 0, err
 		}
 
-		client.IsConnected = true
+		atomic.StoreInt32(&client.connected, 1)
 
 		if response.StatusCode < 400 {
 			return response.Body, response.ContentLength, nil
@@ -174,7 +183,7 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 				return nil, 0, OneDriveError{Status: response.StatusCode, Message: "Authorization error when refreshing token"}
 			}
 
-			err = client.RefreshToken(true)
+			_, _, err = client.token.Refresh(generation, client.refreshToken)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -210,36 +219,44 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 	return nil, 0, fmt.Errorf("Maximum number of retries reached")
 }
 
+// RefreshToken renews the access token if it has expired, or always if 'force' is true.
 func (client *OneDriveClient) RefreshToken(force bool) (err error) {
-	client.TokenLock.Lock()
-	defer client.TokenLock.Unlock()
-
-	if !force && client.Token.Valid() {
+	token, generation := client.token.Get()
+	if !force && token.(*oauth2.Token).Valid() {
 		return nil
 	}
 
-	readCloser, _, err := client.call(client.RefreshTokenURL, "POST", client.Token, "")
+	_, _, err = client.token.Refresh(generation, client.refreshToken)
+	return err
+}
+
+// refreshToken obtains a new token to replace 'current' in the token source and saves it to the token file.
+func (client *OneDriveClient) refreshToken(current interface{}) (interface{}, error) {
+
+	readCloser, _, err := client.call(client.RefreshTokenURL, "POST", current, "")
 	if err != nil {
-		return fmt.Errorf("failed to refresh the access token: %v", err)
+		return nil, fmt.Errorf("failed to refresh the access token: %v", err)
 	}
 
 	defer readCloser.Close()
 
-	if err = json.NewDecoder(readCloser).Decode(client.Token); err != nil {
-		return err
+	// Fields not in the response, such as the refresh token, are kept from the current token
+	token := *current.(*oauth2.Token)
+	if err = json.NewDecoder(readCloser).Decode(&token); err != nil {
+		return nil, err
 	}
 
-	description, err := json.Marshal(client.Token)
+	description, err := json.Marshal(&token)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = ioutil.WriteFile(client.TokenFile, description, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &token, nil
 }
 
 type OneDriveEntry struct {
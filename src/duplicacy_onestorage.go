@@ -48,6 +48,7 @@ func CreateOneDriveStorage(tokenFile string, isBusiness bool, storagePath string
 		storageDir:     storagePath,
 		numberOfThread: threads,
 	}
+	client.ContextFunction = storage.GetContext
 
 	for _, path := range []string{"chunks", "fossils", "snapshots"} {
 		dir := storagePath + "/" + path
@@ -0,0 +1,210 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// storageFileVersion is an old version of a file in a storage that keeps file versions.
+type storageFileVersion struct {
+	path string
+	id   string
+	size int64
+}
+
+// storageVersionLister is implemented by storages, such as B2, that keep old versions of files which are not listed
+// by ListFiles but still take up space.
+type storageVersionLister interface {
+	ListOldVersions(threadIndex int, dir string) (versions []storageFileVersion, err error)
+	DeleteOldVersion(threadIndex int, version storageFileVersion) (err error)
+}
+
+// orphanCategory is a group of files in the chunks directory that waste space.
+type orphanCategory struct {
+	files []string // Paths relative to the chunks directory
+	bytes int64
+}
+
+func (category *orphanCategory) add(file string, size int64) {
+	category.files = append(category.files, file)
+	category.bytes += size
+}
+
+// orphanReport lists the files in the storage that are not needed by any snapshot.
+type orphanReport struct {
+	unreferencedChunks orphanCategory // Chunks not referenced by any snapshot
+	fossils            orphanCategory // Fossils not referenced by any snapshot
+	temporaries        orphanCategory // Temporary files left by interrupted uploads
+	redundantCopies    orphanCategory // Chunks that also exist at another nesting level
+
+	oldVersions     []storageFileVersion // Old versions kept by the storage, such as hidden versions in B2
+	oldVersionBytes int64
+
+	referencedFossils int // Fossils still referenced, which need to be resurrected rather than removed
+}
+
+// getWastedBytes returns the total size of all the files in the report.
+func (report *orphanReport) getWastedBytes() int64 {
+	return report.unreferencedChunks.bytes + report.fossils.bytes + report.temporaries.bytes +
+		report.redundantCopies.bytes + report.oldVersionBytes
+}
+
+// findOrphans lists the chunks directory and classifies every file not needed by the snapshots of all ids.
+func (manager *SnapshotManager) findOrphans() *orphanReport {
+
+	snapshotIDs, err := manager.ListSnapshotIDs()
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_LIST", "Failed to list all snapshots: %v", err)
+		return nil
+	}
+
+	referencedChunks := make(map[string]bool)
+	for _, snapshotID := range snapshotIDs {
+		revisions, err := manager.ListSnapshotRevisions(snapshotID)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list all revisions for snapshot %s: %v", snapshotID, err)
+			return nil
+		}
+		for _, revision := range revisions {
+			snapshot := manager.DownloadSnapshot(snapshotID, revision)
+			for _, chunkID := range manager.GetSnapshotChunks(snapshot, false) {
+				referencedChunks[chunkID] = true
+			}
+		}
+	}
+
+	report := &orphanReport{}
+	chunkRegex := regexp.MustCompile(`^[0-9a-f]+$`)
+	foundChunks := make(map[string]bool)
+
+	LOG_INFO("ORPHAN_LIST", "Listing all chunks")
+	allFiles, allSizes := manager.ListAllFiles(manager.storage, chunkDir)
+	for i, file := range allFiles {
+		if len(file) == 0 || file[len(file)-1] == '/' {
+			continue
+		}
+
+		if strings.HasSuffix(file, ".tmp") {
+			report.temporaries.add(file, allSizes[i])
+			continue
+		}
+
+		if strings.HasSuffix(file, ".fsl") {
+			chunk := strings.Replace(strings.TrimSuffix(file, ".fsl"), "/", "", -1)
+			if referencedChunks[chunk] {
+				LOG_WARN("FOSSIL_REFERENCED", "Fossil %s is referenced; run check -fossils -resurrect to turn it "+
+					"back into a chunk", file)
+				report.referencedFossils++
+			} else {
+				report.fossils.add(file, allSizes[i])
+			}
+			continue
+		}
+
+		chunk := strings.Replace(file, "/", "", -1)
+		if !chunkRegex.MatchString(chunk) {
+			LOG_WARN("CHUNK_UNKNOWN_FILE", "File %s is not a chunk", file)
+			continue
+		}
+
+		if foundChunks[chunk] {
+			report.redundantCopies.add(file, allSizes[i])
+		} else if !referencedChunks[chunk] {
+			report.unreferencedChunks.add(file, allSizes[i])
+		}
+		foundChunks[chunk] = true
+	}
+
+	if lister, ok := manager.storage.(storageVersionLister); ok {
+		LOG_INFO("ORPHAN_LIST", "Listing old versions of chunks")
+		report.oldVersions, err = lister.ListOldVersions(0, strings.TrimSuffix(chunkDir, "/"))
+		if err != nil {
+			LOG_ERROR("ORPHAN_LIST", "Failed to list old versions of chunks: %v", err)
+			return nil
+		}
+		for _, version := range report.oldVersions {
+			report.oldVersionBytes += version.size
+		}
+	}
+
+	return report
+}
+
+// ReportOrphans lists chunks not referenced by any snapshot, leftover fossils, temporary files, and redundant copies
+// or versions of chunks, along with the space they take up.  With 'cleanup', the redundant copies and versions are
+// deleted, and an exhaustive prune is run to remove the rest in the same two steps that prune always uses, so that
+// chunks uploaded by backups in progress are not lost.
+func (manager *SnapshotManager) ReportOrphans(selfID string, cleanup bool, threads int) bool {
+
+	report := manager.findOrphans()
+	if report == nil {
+		return false
+	}
+
+	for _, file := range report.unreferencedChunks.files {
+		LOG_INFO("CHUNK_UNREFERENCED", "Found unreferenced chunk %s", file)
+	}
+	for _, file := range report.fossils.files {
+		LOG_INFO("FOSSIL_UNREFERENCED", "Found unreferenced fossil %s", file)
+	}
+	for _, file := range report.temporaries.files {
+		LOG_INFO("CHUNK_TEMPORARY", "Found temporary file %s", file)
+	}
+	for _, file := range report.redundantCopies.files {
+		LOG_INFO("CHUNK_REDUNDANT", "Found redundant chunk %s", file)
+	}
+	for _, version := range report.oldVersions {
+		LOG_INFO("CHUNK_VERSION", "Found old version %s of %s", version.id, version.path)
+	}
+
+	LOG_INFO("ORPHAN_REPORT", "Unreferenced chunks: %d (%s)", len(report.unreferencedChunks.files),
+		PrettySize(report.unreferencedChunks.bytes))
+	LOG_INFO("ORPHAN_REPORT", "Unreferenced fossils: %d (%s)", len(report.fossils.files),
+		PrettySize(report.fossils.bytes))
+	LOG_INFO("ORPHAN_REPORT", "Temporary files: %d (%s)", len(report.temporaries.files),
+		PrettySize(report.temporaries.bytes))
+	LOG_INFO("ORPHAN_REPORT", "Redundant chunk copies: %d (%s)", len(report.redundantCopies.files),
+		PrettySize(report.redundantCopies.bytes))
+	if _, ok := manager.storage.(storageVersionLister); ok {
+		LOG_INFO("ORPHAN_REPORT", "Old chunk versions: %d (%s)", len(report.oldVersions),
+			PrettySize(report.oldVersionBytes))
+	}
+	LOG_INFO("ORPHAN_REPORT", "Total wasted space: %s", PrettySize(report.getWastedBytes()))
+
+	if !cleanup {
+		return true
+	}
+
+	for _, file := range report.redundantCopies.files {
+		err := manager.storage.DeleteFile(0, chunkDir+file)
+		if err != nil {
+			LOG_WARN("ORPHAN_CLEANUP", "Failed to delete the redundant chunk %s: %v", file, err)
+		} else {
+			LOG_DEBUG("ORPHAN_CLEANUP", "Deleted the redundant chunk %s", file)
+		}
+	}
+	if lister, ok := manager.storage.(storageVersionLister); ok {
+		for _, version := range report.oldVersions {
+			err := lister.DeleteOldVersion(0, version)
+			if err != nil {
+				LOG_WARN("ORPHAN_CLEANUP", "Failed to delete the old version %s of %s: %v", version.id, version.path,
+					err)
+			} else {
+				LOG_DEBUG("ORPHAN_CLEANUP", "Deleted the old version %s of %s", version.id, version.path)
+			}
+		}
+	}
+	LOG_INFO("ORPHAN_CLEANUP", "Deleted %d redundant chunk copies and %d old chunk versions",
+		len(report.redundantCopies.files), len(report.oldVersions))
+
+	if len(report.unreferencedChunks.files)+len(report.fossils.files)+len(report.temporaries.files) == 0 {
+		return true
+	}
+
+	LOG_INFO("ORPHAN_CLEANUP", "Running an exhaustive prune to remove unreferenced chunks, fossils, and temporary files")
+	return manager.PruneSnapshots(selfID, "", nil, nil, nil, true, false, nil, false, false, false, threads)
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// versionedTestStorage pretends that the file storage keeps one old version of a chunk.
+type versionedTestStorage struct {
+	*FileStorage
+	versions []storageFileVersion
+	deleted  []storageFileVersion
+}
+
+func (storage *versionedTestStorage) ListOldVersions(threadIndex int, dir string) ([]storageFileVersion, error) {
+	return storage.versions, nil
+}
+
+func (storage *versionedTestStorage) DeleteOldVersion(threadIndex int, version storageFileVersion) error {
+	storage.deleted = append(storage.deleted, version)
+	return nil
+}
+
+func TestOrphanReport(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash4 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	createTestSnapshot(snapshotManager, "repository1", 1, now-day-3600, now-day-60, []string{chunkHash1, chunkHash2}, "tag")
+
+	storage := snapshotManager.storage
+
+	// The fourth chunk becomes an unreferenced fossil
+	chunkID4 := snapshotManager.config.GetChunkIDFromHash(chunkHash4)
+	chunkPath4, _, _, _ := storage.FindChunk(0, chunkID4, false)
+	if err := storage.MoveFile(0, chunkPath4, chunkPath4+".fsl"); err != nil {
+		t.Fatalf("Failed to turn the chunk %s into a fossil: %v", chunkID4, err)
+	}
+
+	// A left-over temporary file and a copy of the first chunk at a different nesting level
+	if err := storage.UploadFile(0, "chunks/upload.tmp", []byte("temporary")); err != nil {
+		t.Fatalf("Failed to create the temporary file: %v", err)
+	}
+	chunkID1 := snapshotManager.config.GetChunkIDFromHash(chunkHash1)
+	chunkPath1, _, _, _ := storage.FindChunk(0, chunkID1, false)
+	content, err := ioutil.ReadFile(path.Join(testDir, chunkPath1))
+	if err != nil {
+		t.Fatalf("Failed to read the chunk %s: %v", chunkID1, err)
+	}
+	if err = storage.UploadFile(0, "chunks/"+chunkID1, content); err != nil {
+		t.Fatalf("Failed to copy the chunk %s: %v", chunkID1, err)
+	}
+
+	versionedStorage := &versionedTestStorage{
+		FileStorage: storage.(*FileStorage),
+		versions:    []storageFileVersion{{path: chunkPath1, id: "1", size: 100}},
+	}
+	snapshotManager.storage = versionedStorage
+
+	report := snapshotManager.findOrphans()
+	if report == nil {
+		t.Fatalf("Failed to find orphans")
+	}
+
+	if len(report.unreferencedChunks.files) != 1 || len(report.fossils.files) != 1 ||
+		len(report.temporaries.files) != 1 || len(report.redundantCopies.files) != 1 || len(report.oldVersions) != 1 {
+		t.Errorf("Found %d unreferenced chunks, %d fossils, %d temporaries, %d redundant copies, and %d old "+
+			"versions; expected one of each", len(report.unreferencedChunks.files), len(report.fossils.files),
+			len(report.temporaries.files), len(report.redundantCopies.files), len(report.oldVersions))
+	}
+	if report.temporaries.bytes != int64(len("temporary")) || report.oldVersionBytes != 100 {
+		t.Errorf("The temporary file has %d bytes and the old version has %d bytes", report.temporaries.bytes,
+			report.oldVersionBytes)
+	}
+	if report.getWastedBytes() <= report.temporaries.bytes+report.oldVersionBytes {
+		t.Errorf("The total wasted space of %d bytes doesn't include the chunks", report.getWastedBytes())
+	}
+
+	if !snapshotManager.ReportOrphans("repository1", true, 1) {
+		t.Fatalf("Failed to clean up the orphans")
+	}
+	if len(versionedStorage.deleted) != 1 {
+		t.Errorf("%d old versions were deleted instead of 1", len(versionedStorage.deleted))
+	}
+
+	report = snapshotManager.findOrphans()
+	if len(report.unreferencedChunks.files) != 0 || len(report.redundantCopies.files) != 0 ||
+		len(report.fossils.files) != 2 {
+		t.Errorf("Found %d unreferenced chunks, %d redundant copies, and %d fossils after the cleanup; expected 0, "+
+			"0, and 2", len(report.unreferencedChunks.files), len(report.redundantCopies.files),
+			len(report.fossils.files))
+	}
+
+	// The temporary file and the two fossils wait for the next prune
+	checkTestSnapshots(snapshotManager, 1, 3)
+}
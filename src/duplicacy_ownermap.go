@@ -0,0 +1,158 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// OwnerMapping translates the uids and gids recorded in a snapshot to the ones to be set on restored files, for
+// restores performed on a different machine where the same users have different ids.
+type OwnerMapping struct {
+	UIDs map[int]int
+	GIDs map[int]int
+
+	// If not -1, all restored files are owned by this user or group
+	UID int
+	GID int
+}
+
+// CreateOwnerMapping creates a mapping that keeps all uids and gids unchanged.
+func CreateOwnerMapping() *OwnerMapping {
+	return &OwnerMapping{
+		UIDs: make(map[int]int),
+		GIDs: make(map[int]int),
+		UID:  -1,
+		GID:  -1,
+	}
+}
+
+// lookupOwnerID converts a user or group name on this machine to its id; a numeric id is returned as is.
+func lookupOwnerID(name string, isGroup bool) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+
+	var id string
+	if isGroup {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = group.Gid
+	} else {
+		account, err := user.Lookup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = account.Uid
+	}
+
+	value, err := strconv.Atoi(id)
+	if err != nil {
+		return -1, fmt.Errorf("%s doesn't have a numeric id", name)
+	}
+	return value, nil
+}
+
+// SetOwner parses an owner specified as <user>, <user>:<group>, or :<group>, by names or ids, that all restored files
+// will be owned by.
+func (mapping *OwnerMapping) SetOwner(owner string) (err error) {
+	userName, groupName := owner, ""
+	if separator := strings.Index(owner, ":"); separator >= 0 {
+		userName, groupName = owner[:separator], owner[separator+1:]
+	}
+	if userName == "" && groupName == "" {
+		return fmt.Errorf("'%s' is not in the format of <user>[:<group>]", owner)
+	}
+
+	if userName != "" {
+		if mapping.UID, err = lookupOwnerID(userName, false); err != nil {
+			return err
+		}
+	}
+	if groupName != "" {
+		if mapping.GID, err = lookupOwnerID(groupName, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddIDMapping parses a translation specified as <from>=<to>, where <from> is the uid (or gid if 'isGroup' is true)
+// in the snapshot and <to> is the id or the name of the user (or group) on this machine.
+func (mapping *OwnerMapping) AddIDMapping(text string, isGroup bool) error {
+	separator := strings.Index(text, "=")
+	if separator <= 0 || separator == len(text)-1 {
+		return fmt.Errorf("'%s' is not in the format of <from>=<to>", text)
+	}
+
+	from, err := strconv.Atoi(text[:separator])
+	if err != nil || from < 0 {
+		return fmt.Errorf("'%s' is not a valid id", text[:separator])
+	}
+	to, err := lookupOwnerID(text[separator+1:], isGroup)
+	if err != nil {
+		return err
+	}
+
+	if isGroup {
+		mapping.GIDs[from] = to
+	} else {
+		mapping.UIDs[from] = to
+	}
+	return nil
+}
+
+// apply changes the uid and gid of the entry according to the mapping.  Entries without an owner (with an id of -1,
+// as in snapshots created on Windows) are not changed unless an owner for all files is given.
+func (mapping *OwnerMapping) apply(entry *Entry) {
+	if mapping == nil {
+		return
+	}
+
+	if mapping.UID >= 0 {
+		entry.UID = mapping.UID
+	} else if uid, found := mapping.UIDs[entry.UID]; found {
+		entry.UID = uid
+	}
+
+	if mapping.GID >= 0 {
+		entry.GID = mapping.GID
+	} else if gid, found := mapping.GIDs[entry.GID]; found {
+		entry.GID = gid
+	}
+}
+
+// SetOwnerMapping sets the translation of uids and gids applied to restored files.
+func (manager *BackupManager) SetOwnerMapping(mapping *OwnerMapping) {
+	manager.ownerMapping = mapping
+}
+
+// Whether a failure to set the owner of a restored file is reported as a warning instead of an error that aborts the
+// restore
+var ownerErrorsAsWarnings = false
+
+func SetOwnerErrorsAsWarnings(enabled bool) {
+	ownerErrorsAsWarnings = enabled
+}
+
+// ParseOwnerPolicy parses the value of the -restore-owner option: 'yes' (restore the owners and fail if they can't be
+// set), 'try' (restore the owners but only warn on failures), or 'no'.
+func ParseOwnerPolicy(policy string) (setOwner bool, warnOnErrors bool, err error) {
+	switch strings.ToLower(policy) {
+	case "", "yes":
+		return true, false, nil
+	case "try":
+		return true, true, nil
+	case "no":
+		return false, false, nil
+	default:
+		return false, false, fmt.Errorf("invalid owner policy '%s' (must be yes, try, or no)", policy)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"testing"
+)
+
+func TestOwnerMapping(t *testing.T) {
+
+	mapping := CreateOwnerMapping()
+	for _, text := range []string{"1000=1001", "0=2000"} {
+		if err := mapping.AddIDMapping(text, false); err != nil {
+			t.Errorf("Failed to parse the uid mapping %s: %v", text, err)
+		}
+	}
+	if err := mapping.AddIDMapping("100=200", true); err != nil {
+		t.Errorf("Failed to parse the gid mapping: %v", err)
+	}
+	for _, text := range []string{"1000", "=1000", "a=1000", "-1=1000", "1000="} {
+		if err := mapping.AddIDMapping(text, false); err == nil {
+			t.Errorf("The mapping %s is accepted", text)
+		}
+	}
+
+	testCases := []struct {
+		uid, gid             int
+		mappedUID, mappedGID int
+	}{
+		{1000, 100, 1001, 200},
+		{0, 0, 2000, 0},
+		{500, 500, 500, 500},
+		{-1, -1, -1, -1},
+	}
+	for _, testCase := range testCases {
+		entry := &Entry{UID: testCase.uid, GID: testCase.gid}
+		mapping.apply(entry)
+		if entry.UID != testCase.mappedUID || entry.GID != testCase.mappedGID {
+			t.Errorf("%d:%d is mapped to %d:%d", testCase.uid, testCase.gid, entry.UID, entry.GID)
+		}
+	}
+
+	// A group given by -chown overrides the gid mapping but the uid mapping still applies
+	if err := mapping.SetOwner(":300"); err != nil {
+		t.Errorf("Failed to set the owner: %v", err)
+	}
+	entry := &Entry{UID: 1000, GID: 100}
+	mapping.apply(entry)
+	if entry.UID != 1001 || entry.GID != 300 {
+		t.Errorf("1000:100 is mapped to %d:%d", entry.UID, entry.GID)
+	}
+	if err := mapping.SetOwner(":"); err == nil {
+		t.Errorf("An empty owner is accepted")
+	}
+
+	var noMapping *OwnerMapping
+	noMapping.apply(entry)
+
+	for policy, expected := range map[string][2]bool{"": {true, false}, "try": {true, true}, "NO": {false, false}} {
+		setOwner, warnOnErrors, err := ParseOwnerPolicy(policy)
+		if err != nil || setOwner != expected[0] || warnOnErrors != expected[1] {
+			t.Errorf("Policy %s is parsed as %t, %t, %v", policy, setOwner, warnOnErrors, err)
+		}
+	}
+	if _, _, err := ParseOwnerPolicy("maybe"); err == nil {
+		t.Errorf("An invalid policy is accepted")
+	}
+}
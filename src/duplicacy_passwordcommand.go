@@ -0,0 +1,69 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The values printed by password commands, indexed by the command and the password id, so that each command is run
+// once per password.  Empty values are cached too, as the command has nothing to provide for them.
+var passwordCommandResults = make(map[string]string)
+var passwordCommandLock sync.Mutex
+
+// getPasswordFromCommand runs the password command of the storage and returns the first line of its output as the
+// password.  The command learns which password is needed from DUPLICACY_PASSWORD_TYPE, such as 'password' or
+// 's3_secret', and can use the storage name to find the entry, as in 'pass show
+// duplicacy/$DUPLICACY_STORAGE_NAME/$DUPLICACY_PASSWORD_TYPE'.  An empty string is returned if the command fails or
+// prints nothing, so the password is then read from the keyring or the keyboard.
+func getPasswordFromCommand(preference Preference, passwordType string, passwordID string) string {
+	if preference.PasswordCommand == "" {
+		return ""
+	}
+
+	passwordCommandLock.Lock()
+	defer passwordCommandLock.Unlock()
+
+	cacheKey := preference.PasswordCommand + "\x00" + passwordID
+	if password, found := passwordCommandResults[cacheKey]; found {
+		return password
+	}
+
+	var command *exec.Cmd
+	if runtime.GOOS == "windows" {
+		command = exec.Command("cmd", "/C", preference.PasswordCommand)
+	} else {
+		command = exec.Command("sh", "-c", preference.PasswordCommand)
+	}
+	command.Env = append(os.Environ(),
+		"DUPLICACY_PASSWORD_TYPE="+passwordType,
+		"DUPLICACY_STORAGE_NAME="+preference.Name,
+		"DUPLICACY_STORAGE_URL="+preference.StorageURL,
+		"DUPLICACY_SNAPSHOT_ID="+preference.SnapshotID)
+	// Let the command ask for the master password of the password manager if needed
+	command.Stdin = os.Stdin
+	command.Stderr = os.Stderr
+	var output bytes.Buffer
+	command.Stdout = &output
+
+	LOG_DEBUG("PASSWORD_COMMAND", "Running the password command for %s", passwordID)
+	password := ""
+	if err := command.Run(); err != nil {
+		LOG_INFO("PASSWORD_COMMAND", "The password command failed to provide %s: %v", passwordID, err)
+	} else {
+		password = strings.TrimRight(strings.SplitN(output.String(), "\n", 2)[0], "\r")
+		if password == "" {
+			LOG_DEBUG("PASSWORD_COMMAND", "The password command provided no value for %s", passwordID)
+		}
+	}
+
+	passwordCommandResults[cacheKey] = password
+	return password
+}
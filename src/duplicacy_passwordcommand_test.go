@@ -0,0 +1,54 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPasswordCommand(t *testing.T) {
+
+	setTestingT(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The password command is a shell command")
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "password_command")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	runs := filepath.Join(testDir, "runs")
+
+	preference := Preference{
+		Name:            "offsite",
+		PasswordCommand: `echo run >> ` + runs + `; [ "$DUPLICACY_PASSWORD_TYPE" = "ssh_key_file" ] && exit 1; printf '%s-%s\nignored\n' "$DUPLICACY_STORAGE_NAME" "$DUPLICACY_PASSWORD_TYPE"`,
+	}
+
+	if password := GetPasswordFromPreference(preference, "s3_secret"); password != "offsite-s3_secret" {
+		t.Errorf("The password command printed '%s'", password)
+	}
+	if password := GetPasswordFromPreference(preference, "s3_secret"); password != "offsite-s3_secret" {
+		t.Errorf("The cached password is '%s'", password)
+	}
+	if password := GetPasswordFromPreference(preference, "ssh_key_file"); password != "" {
+		t.Errorf("The failed password command provided '%s'", password)
+	}
+
+	content, _ := ioutil.ReadFile(runs)
+	if count := strings.Count(string(content), "run"); count != 2 {
+		t.Errorf("The password command was run %d times", count)
+	}
+
+	// Passwords in the preferences take precedence
+	preference.Keys = map[string]string{"password": "stored"}
+	if password := GetPasswordFromPreference(preference, "password"); password != "stored" {
+		t.Errorf("The password is '%s' instead of the one in the preferences", password)
+	}
+}
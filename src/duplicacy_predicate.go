@@ -0,0 +1,163 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A filter pattern may start with a list of predicates in braces, such as "-{size>1G}*.iso" or
+// "e:{mtime<2015-01-01}\.log$", in which case the pattern only matches files that also satisfy all the predicates.
+// Predicates are separated by commas.  A pattern consisting only of predicates, such as "-{size>1G}", matches any
+// file.  Directories never satisfy a predicate, so they are not excluded this way.  The supported predicates are:
+//
+//	size<op><size>       the file size, with an optional suffix k, m, g, or t (powers of 1024)
+//	mtime<op><date>      the modification time, as 2006-01-02 or 2006-01-02T15:04:05 in local time
+//	age<op><duration>    the time since the last modification, as a number followed by s, h, d, w, or y
+//
+// where <op> is one of <, <=, >, >=, and =.
+type FilterPredicate struct {
+	Attribute string // size, mtime, or age
+	Operator  string
+	Value     int64 // the size in bytes, the modification time as a Unix time, or the age in seconds
+}
+
+var predicateRegex = regexp.MustCompile(`^(size|mtime|age)\s*(<=|>=|<|>|=)\s*(\S+)$`)
+
+// The parsed predicates, indexed by the text between the braces
+var PredicateMap = make(map[string][]FilterPredicate)
+
+// SplitFilterPredicates separates the predicates from the rest of a pattern, which must not include the '+', '-',
+// 'i:', or 'e:' prefix.  'predicates' is empty if the pattern does not start with predicates.
+func SplitFilterPredicates(pattern string) (predicates string, rest string) {
+	if !strings.HasPrefix(pattern, "{") {
+		return "", pattern
+	}
+	end := strings.Index(pattern, "}")
+	if end < 0 || !predicateRegex.MatchString(strings.TrimSpace(strings.Split(pattern[1:end], ",")[0])) {
+		// Braces are allowed in file names and regular expressions
+		return "", pattern
+	}
+	return pattern[1:end], pattern[end+1:]
+}
+
+// ParseFilterPredicates parses the comma-separated predicates found between the braces.
+func ParseFilterPredicates(text string) (predicates []FilterPredicate, err error) {
+
+	if predicates, found := PredicateMap[text]; found {
+		return predicates, nil
+	}
+
+	for _, item := range strings.Split(text, ",") {
+		matched := predicateRegex.FindStringSubmatch(strings.TrimSpace(item))
+		if matched == nil {
+			return nil, fmt.Errorf("invalid predicate '%s'", item)
+		}
+
+		predicate := FilterPredicate{Attribute: matched[1], Operator: matched[2]}
+		switch predicate.Attribute {
+		case "size":
+			predicate.Value, err = parsePredicateSize(matched[3])
+		case "mtime":
+			predicate.Value, err = parsePredicateTime(matched[3])
+		case "age":
+			predicate.Value, err = parsePredicateAge(matched[3])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid predicate '%s': %v", item, err)
+		}
+		predicates = append(predicates, predicate)
+	}
+
+	PredicateMap[text] = predicates
+	return predicates, nil
+}
+
+func parsePredicateSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1024
+	case "m":
+		multiplier = 1024 * 1024
+	case "g":
+		multiplier = 1024 * 1024 * 1024
+	case "t":
+		multiplier = 1024 * 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("'%s' is not a valid size", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+func parsePredicateTime(value string) (int64, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("'%s' is not a valid date", value)
+}
+
+func parsePredicateAge(value string) (int64, error) {
+	units := map[string]int64{"s": 1, "h": 3600, "d": 86400, "w": 7 * 86400, "y": 365 * 86400}
+	unit, found := units[strings.ToLower(value[len(value)-1:])]
+	if !found {
+		return 0, fmt.Errorf("'%s' does not end with s, h, d, w, or y", value)
+	}
+	age, err := strconv.ParseFloat(value[:len(value)-1], 64)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("'%s' is not a valid age", value)
+	}
+	return int64(age * float64(unit)), nil
+}
+
+// MatchFilterPredicates returns true if the entry satisfies all the predicates.  It returns false if the entry is nil,
+// meaning only the path is known, or is a directory.
+func MatchFilterPredicates(predicates []FilterPredicate, entry *Entry) bool {
+
+	if entry == nil || entry.IsDir() {
+		return false
+	}
+
+	for _, predicate := range predicates {
+		var value int64
+		switch predicate.Attribute {
+		case "size":
+			value = entry.Size
+		case "mtime":
+			value = entry.Time
+		case "age":
+			value = time.Now().Unix() - entry.Time
+		}
+
+		var satisfied bool
+		switch predicate.Operator {
+		case "<":
+			satisfied = value < predicate.Value
+		case "<=":
+			satisfied = value <= predicate.Value
+		case ">":
+			satisfied = value > predicate.Value
+		case ">=":
+			satisfied = value >= predicate.Value
+		case "=":
+			satisfied = value == predicate.Value
+		}
+		if !satisfied {
+			return false
+		}
+	}
+	return true
+}
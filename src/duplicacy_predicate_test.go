@@ -0,0 +1,59 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFilterPredicates(t *testing.T) {
+
+	for pattern, expected := range map[string]string{
+		"{size>1G}*.iso":    "size>1G",
+		"{size>1G,age>1y}":  "size>1G,age>1y",
+		"{braces}.txt":      "",
+		"{mtime<2015-01-01": "",
+		"*.iso":             "",
+	} {
+		predicates, _ := SplitFilterPredicates(pattern)
+		if predicates != expected {
+			t.Errorf("%s: predicates are '%s'; expected '%s'", pattern, predicates, expected)
+		}
+	}
+
+	for _, text := range []string{"size>1x", "mtime<2015-13-01", "age>3m", "size!1G"} {
+		if _, err := ParseFilterPredicates(text); err == nil {
+			t.Errorf("%s should be an invalid predicate", text)
+		}
+	}
+
+	old := time.Date(2014, 6, 1, 0, 0, 0, 0, time.Local).Unix()
+	patterns := []string{"-{size>1G}*.iso", "-{mtime<2015-01-01}", "+{size<=1k}big/*", "-big/*",
+		"e:{age<1h}\\.tmp$"}
+	for _, test := range []struct {
+		entry    *Entry
+		included bool
+	}{
+		{CreateEntry("small.iso", 1024, time.Now().Unix(), 0600), true},
+		{CreateEntry("large.iso", 2<<30, time.Now().Unix(), 0600), false},
+		{CreateEntry("ancient.txt", 100, old, 0600), false},
+		{CreateEntry("ancient/", 0, old, 0700|uint32(os.ModeDir)), true},
+		{CreateEntry("big/small", 1024, time.Now().Unix(), 0600), true},
+		{CreateEntry("big/large", 1025, time.Now().Unix(), 0600), false},
+		{CreateEntry("new.tmp", 0, time.Now().Unix(), 0600), false},
+		{CreateEntry("old.tmp", 0, time.Now().Unix()-7200, 0600), true},
+	} {
+		if MatchEntry(test.entry, patterns) != test.included {
+			t.Errorf("%s: included should be %t", test.entry.Path, test.included)
+		}
+	}
+
+	// Predicates never match when only the path is known
+	if !MatchPath("large.iso", patterns) {
+		t.Errorf("large.iso should be included by path")
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 )
 
 // Preference stores options for each storage.
@@ -27,8 +29,32 @@ type Preference struct {
 	Keys              map[string]string `json:"keys"`
 	FiltersFile       string            `json:"filters"`
 	ExcludeByAttribute bool             `json:"exclude_by_attribute"`
+	SnapshotMethod    string            `json:"snapshot_method,omitempty"`
+	SnapshotSize      string            `json:"snapshot_size,omitempty"`
+	ExcludeCaches     bool              `json:"exclude_caches,omitempty"`
+	ExcludeIfPresent  []string          `json:"exclude_if_present,omitempty"`
+	Hooks             map[string]Hook   `json:"hooks,omitempty"`
+	Roots             []SourceRoot      `json:"roots,omitempty"`
+	CacheSize         string            `json:"cache_size,omitempty"`
+	Notifications     *Notifications    `json:"notifications,omitempty"`
+	Keyring           string            `json:"keyring,omitempty"` // where passwords are saved, the default keyring of the platform if empty
+	PasswordCommand   string            `json:"password_command,omitempty"` // prints the password named by DUPLICACY_PASSWORD_TYPE
+	ChangeFeed        string            `json:"change_feed,omitempty"` // the inventory or change feed check and prune list chunks from
+	Retry             *RetryPolicy      `json:"retry,omitempty"` // overrides the default retry policy of the storage
+	Network           *NetworkOptions   `json:"network,omitempty"` // how the storage clients connect to the servers
 }
 
+// Hook is a command run by the shell before or after a backup or restore, indexed in Preference.Hooks by one of
+// HookPhases.  The command receives information about the operation in environment variables starting with
+// DUPLICACY_.  If the command fails, the operation is aborted when OnFailure is "abort", the default for pre hooks,
+// or a warning is given when it is "warn", the default for post hooks.
+type Hook struct {
+	Command   string `json:"command"`
+	OnFailure string `json:"on_failure,omitempty"`
+}
+
+var HookPhases = []string{"pre-backup", "post-backup", "pre-restore", "post-restore"}
+
 var preferencePath string
 var Preferences []Preference
 
@@ -102,7 +128,77 @@ func SetDuplicacyPreferencePath(p string) {
 	preferencePath = p
 }
 
+// SavePreferences writes the preferences in memory to the preference file, replacing whatever is there.  Unlike
+// UpdatePreferences, changes saved by other processes since the preferences were loaded are lost.
 func SavePreferences() bool {
+	lock := lockPreferences()
+	if lock == nil {
+		return false
+	}
+	defer unlockPreferences(lock)
+
+	return writePreferences()
+}
+
+// UpdatePreferences reloads the preferences from the preference file, calls 'update' to change them, and saves them
+// if 'update' returns true, while holding an exclusive lock so that concurrent commands such as 'set' and 'add' don't
+// overwrite each other's changes.  If the preference file doesn't exist yet, 'update' starts from the preferences in
+// memory.  Pointers returned by FindPreference before the call are no longer valid.
+func UpdatePreferences(update func() bool) bool {
+	lock := lockPreferences()
+	if lock == nil {
+		return false
+	}
+	defer unlockPreferences(lock)
+
+	preferenceFile := path.Join(GetDuplicacyPreferencePath(), "preferences")
+	description, err := ioutil.ReadFile(preferenceFile)
+	if err == nil {
+		var preferences []Preference
+		err = json.Unmarshal(description, &preferences)
+		if err != nil {
+			LOG_ERROR("PREFERENCE_PARSE", "Failed to parse the preference file %s: %v", preferenceFile, err)
+			return false
+		}
+		Preferences = preferences
+	} else if !os.IsNotExist(err) {
+		LOG_ERROR("PREFERENCE_OPEN", "Failed to read the preference file %s: %v", preferenceFile, err)
+		return false
+	}
+
+	if !update() {
+		return false
+	}
+	return writePreferences()
+}
+
+// lockPreferences waits for the exclusive lock on the preference file, which is a separate file so that it isn't
+// lost when the preference file is replaced.
+func lockPreferences() *os.File {
+	lockPath := path.Join(GetDuplicacyPreferencePath(), "preferences.lock")
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		LOG_ERROR("PREFERENCE_LOCK", "Failed to open the lock file %s: %v", lockPath, err)
+		return nil
+	}
+
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		LOG_ERROR("PREFERENCE_LOCK", "Failed to lock the preference file: %v", err)
+		return nil
+	}
+	return file
+}
+
+func unlockPreferences(file *os.File) {
+	unlockFile(file)
+	file.Close()
+}
+
+// writePreferences saves the preferences to a temporary file that then replaces the preference file, so that the
+// preference file is never seen or left partially written.
+func writePreferences() bool {
 	description, err := json.MarshalIndent(Preferences, "", "    ")
 	if err != nil {
 		LOG_ERROR("PREFERENCE_MARSHAL", "Failed to marshal the repository preferences: %v", err)
@@ -110,8 +206,40 @@ func SavePreferences() bool {
 	}
 	preferenceFile := path.Join(GetDuplicacyPreferencePath(), "preferences")
 
-	err = ioutil.WriteFile(preferenceFile, description, 0600)
+	// A symbolic link is kept and its target replaced instead
+	if target, err := filepath.EvalSymlinks(preferenceFile); err == nil {
+		preferenceFile = target
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(preferenceFile), "preferences.")
+	if err != nil {
+		LOG_ERROR("PREFERENCE_WRITE", "Failed to create a temporary preference file: %v", err)
+		return false
+	}
+	temporaryFile := file.Name()
+
+	_, err = file.Write(description)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temporaryFile, 0600)
+	}
+	if err == nil {
+		// On Windows the preference file can't be replaced while another process is reading it
+		for i := 0; ; i++ {
+			err = os.Rename(temporaryFile, preferenceFile)
+			if err == nil || i >= 10 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
 	if err != nil {
+		os.Remove(temporaryFile)
 		LOG_ERROR("PREFERENCE_WRITE", "Failed to save the preference file %s: %v", preferenceFile, err)
 		return false
 	}
@@ -0,0 +1,72 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestUpdatePreferences(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "preferences")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	SetDuplicacyPreferencePath(testDir)
+
+	Preferences = []Preference{{Name: "default", StorageURL: "/storage"}}
+	if !SavePreferences() {
+		t.Fatalf("Failed to save the preferences")
+	}
+
+	// Each update starts from the preferences saved by the previous ones
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			UpdatePreferences(func() bool {
+				Preferences = append(Preferences, Preference{Name: fmt.Sprintf("storage%d", i)})
+				return true
+			})
+		}(i)
+	}
+	wait.Wait()
+
+	description, err := ioutil.ReadFile(filepath.Join(testDir, "preferences"))
+	if err != nil {
+		t.Fatalf("Failed to read the preference file: %v", err)
+	}
+	var preferences []Preference
+	if err = json.Unmarshal(description, &preferences); err != nil {
+		t.Fatalf("Failed to parse the preference file: %v", err)
+	}
+	if len(preferences) != 21 {
+		t.Errorf("The preference file has %d storages instead of 21", len(preferences))
+	}
+
+	// An update that isn't saved leaves the file unchanged
+	UpdatePreferences(func() bool {
+		Preferences = nil
+		return false
+	})
+	if content, _ := ioutil.ReadFile(filepath.Join(testDir, "preferences")); string(content) != string(description) {
+		t.Errorf("The preference file was changed by an update not to be saved")
+	}
+
+	files, _ := ioutil.ReadDir(testDir)
+	for _, file := range files {
+		if file.Name() != "preferences" && file.Name() != "preferences.lock" {
+			t.Errorf("The file %s was left in the preference directory", file.Name())
+		}
+	}
+}
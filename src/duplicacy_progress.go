@@ -0,0 +1,157 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Files at least this large have their own percentages shown in the progress
+const progressLargeFileSize = 64 * 1024 * 1024
+
+// The default interval between two progress messages
+const defaultProgressInterval = 5 * time.Second
+
+// BackupProgress periodically reports the file being packed, the portion of the file read so far if it is large, and
+// the overall progress against the total size of the modified files found by the listing, along with the estimated
+// remaining time.
+type BackupProgress struct {
+	totalBytes     int64 // the total size of the files to be packed
+	processedBytes int64 // the size of the chunks uploaded or skipped, updated atomically
+	uploadedBytes  int64 // the bytes actually uploaded after compression and encryption, updated atomically
+
+	startTime time.Time
+	interval  time.Duration
+	storage   Storage
+
+	lock        sync.Mutex
+	current     *Entry // the file being read by the chunk maker
+	currentRead int64  // the bytes of the current file read so far
+	lastReport  time.Time
+}
+
+// CreateBackupProgress creates a progress reporter for packing files with a total size of 'totalBytes', which may be
+// zero if the size is unknown.  The upload rate limit of 'storage' is taken into account when estimating the remaining
+// time, as it may be changed during the backup.
+func CreateBackupProgress(totalBytes int64, storage Storage) *BackupProgress {
+	now := time.Now()
+	return &BackupProgress{
+		totalBytes: totalBytes,
+		startTime:  now,
+		interval:   defaultProgressInterval,
+		storage:    storage,
+		lastReport: now,
+	}
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *BackupProgress
+}
+
+func (reader *progressReader) Read(buffer []byte) (n int, err error) {
+	n, err = reader.reader.Read(buffer)
+	if n > 0 {
+		reader.progress.lock.Lock()
+		reader.progress.currentRead += int64(n)
+		reader.progress.lock.Unlock()
+		reader.progress.report()
+	}
+	return n, err
+}
+
+// StartFile records that the chunk maker starts reading 'entry' and returns a reader that tracks how much of the file
+// has been read.  It does nothing if 'progress' is nil.
+func (progress *BackupProgress) StartFile(entry *Entry, reader io.Reader) io.Reader {
+	if progress == nil {
+		return reader
+	}
+	progress.lock.Lock()
+	progress.current = entry
+	progress.currentRead = 0
+	progress.lock.Unlock()
+	return &progressReader{reader: reader, progress: progress}
+}
+
+// ChunkCompleted is called when a chunk has been uploaded or skipped.  'uploadSize' is zero if the chunk wasn't
+// uploaded.
+func (progress *BackupProgress) ChunkCompleted(chunkSize int, uploadSize int) {
+	if progress == nil {
+		return
+	}
+	atomic.AddInt64(&progress.processedBytes, int64(chunkSize))
+	atomic.AddInt64(&progress.uploadedBytes, int64(uploadSize))
+	progress.report()
+}
+
+// getRemainingTime estimates the remaining time in seconds from the average speed so far.  If an upload rate limit is
+// set, the estimate is no less than the time needed to upload the remaining files at the limit, assuming they need to
+// be uploaded in the same proportion as the files processed so far.
+func (progress *BackupProgress) getRemainingTime(processed int64, uploaded int64, elapsed float64) (int64, bool) {
+	if progress.totalBytes <= 0 || processed <= 0 || elapsed <= 0 {
+		return 0, false
+	}
+
+	remaining := float64(progress.totalBytes - processed)
+	if remaining < 0 {
+		remaining = 0
+	}
+	remainingTime := remaining / (float64(processed) / elapsed)
+
+	if limiter, ok := progress.storage.(interface{ UploadRateLimit() int }); ok && limiter.UploadRateLimit() > 0 {
+		limitedTime := remaining * float64(uploaded) / float64(processed) / (float64(limiter.UploadRateLimit()) * 1024)
+		if limitedTime > remainingTime {
+			remainingTime = limitedTime
+		}
+	}
+	return int64(remainingTime) + 1, true
+}
+
+func (progress *BackupProgress) report() {
+
+	progress.lock.Lock()
+	now := time.Now()
+	if now.Sub(progress.lastReport) < progress.interval {
+		progress.lock.Unlock()
+		return
+	}
+	progress.lastReport = now
+	current, currentRead := progress.current, progress.currentRead
+	progress.lock.Unlock()
+
+	processed := atomic.LoadInt64(&progress.processedBytes)
+	uploaded := atomic.LoadInt64(&progress.uploadedBytes)
+	elapsed := now.Sub(progress.startTime).Seconds()
+
+	message := ""
+	if current != nil {
+		message = "Packing " + current.Path
+		if current.Size >= progressLargeFileSize {
+			message += fmt.Sprintf(" (%.1f%% of %s)", float64(currentRead)*100/float64(current.Size),
+				PrettySize(current.Size))
+		}
+		message += "; "
+	}
+
+	if progress.totalBytes > 0 {
+		message += fmt.Sprintf("%s of %s bytes done (%.1f%%)", PrettyNumber(processed),
+			PrettyNumber(progress.totalBytes), float64(processed)*100/float64(progress.totalBytes))
+	} else {
+		message += fmt.Sprintf("%s bytes done", PrettyNumber(processed))
+	}
+
+	if elapsed > 0 {
+		message += fmt.Sprintf(", %sB/s", PrettySize(int64(float64(processed)/elapsed)))
+	}
+	if remainingTime, ok := progress.getRemainingTime(processed, uploaded, elapsed); ok {
+		message += fmt.Sprintf(", %s remaining", PrettyTime(remainingTime))
+	}
+
+	LOG_INFO("FILE_PROGRESS", "%s", message)
+}
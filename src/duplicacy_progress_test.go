@@ -0,0 +1,55 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestBackupProgress(t *testing.T) {
+
+	setTestingT(t)
+
+	storage := &FileStorage{}
+	progress := CreateBackupProgress(1000*1024*1024, storage)
+
+	// 100M processed in 10 seconds, of which 10M were uploaded
+	if remaining, ok := progress.getRemainingTime(100*1024*1024, 10*1024*1024, 10); !ok || remaining != 91 {
+		t.Errorf("The remaining time without a rate limit is %d seconds", remaining)
+	}
+
+	// Uploading the remaining 90M at 1M/s takes longer than processing the remaining files at the current speed
+	storage.SetRateLimits(0, 1024)
+	if remaining, ok := progress.getRemainingTime(100*1024*1024, 10*1024*1024, 10); !ok || remaining != 91 {
+		t.Errorf("The remaining time with a rate limit of 1M/s is %d seconds", remaining)
+	}
+	storage.SetRateLimits(0, 512)
+	if remaining, ok := progress.getRemainingTime(100*1024*1024, 10*1024*1024, 10); !ok || remaining != 181 {
+		t.Errorf("The remaining time with a rate limit of 512K/s is %d seconds", remaining)
+	}
+
+	if _, ok := CreateBackupProgress(0, storage).getRemainingTime(100, 10, 10); ok {
+		t.Errorf("The remaining time can't be estimated without the total size")
+	}
+
+	// The percentage of the current file is based on the bytes read from it
+	entry := CreateEntry("large", progressLargeFileSize, 0, 0644)
+	reader := progress.StartFile(entry, bytes.NewReader(make([]byte, 1024)))
+	progress.interval = 0
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Errorf("Failed to read the file: %v", err)
+	}
+	if progress.current != entry || progress.currentRead != 1024 {
+		t.Errorf("%d bytes of %s have been read", progress.currentRead, progress.current.Path)
+	}
+
+	var nilProgress *BackupProgress
+	nilProgress.ChunkCompleted(100, 100)
+	if nilProgress.StartFile(entry, reader) != reader {
+		t.Errorf("A nil progress should not wrap the reader")
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// The minimum interval between two redraws of a progress bar
+const progressBarInterval = 200 * time.Millisecond
+
+// The width assumed when the width of the terminal can't be found, and the limits of the bar itself
+const progressBarDefaultWidth = 80
+const progressBarMinimumWidth = 10
+const progressBarMaximumWidth = 40
+
+// Whether progress bars may be shown, which requires the plain log output
+var progressBarsEnabled = false
+
+// The progress bar being shown on the last line of the terminal, guarded by logMutex
+var activeProgressBar *ProgressBar
+
+// EnableProgressBars shows progress bars in place of the progress logs when the logs go to a terminal.  Progress bars
+// are never shown with log-style or JSON output, so that the output can be parsed.
+func EnableProgressBars() {
+	progressBarsEnabled = !printLogHeader && !jsonOutput && !journalEnabled && os.Getenv("TERM") != "dumb"
+}
+
+// ProgressBar shows the progress of one phase of an operation, such as scanning, uploading, or verifying, on a line
+// that is redrawn in place.  Other logs are printed above it.  All methods do nothing if the bar is nil, which is
+// what StartProgressBar returns when the output isn't a terminal.
+type ProgressBar struct {
+	phase       string
+	unit        string // the unit of 'done' and 'total'; bytes if empty
+	total       int64  // zero if the total isn't known
+	done        int64  // updated atomically
+	transferred int64  // the bytes transferred for progress not measured in bytes, updated atomically
+
+	startTime  time.Time
+	lastDraw   time.Time // guarded by logMutex
+	lastLength int       // the length of the line last drawn, guarded by logMutex
+	width      int
+}
+
+// StartProgressBar shows a progress bar for the phase if progress bars are enabled and the logs go to a terminal.
+// 'unit' names what the progress counts, such as files or chunks; the progress is in bytes if 'unit' is empty.
+func StartProgressBar(phase string, total int64, unit string) *ProgressBar {
+	if !progressBarsEnabled {
+		return nil
+	}
+	file, ok := logOutput.(*os.File)
+	if !ok || !terminal.IsTerminal(int(file.Fd())) {
+		return nil
+	}
+
+	width, _, err := terminal.GetSize(int(file.Fd()))
+	if err != nil || width <= 0 {
+		width = progressBarDefaultWidth
+	}
+
+	bar := &ProgressBar{
+		phase:     phase,
+		unit:      unit,
+		total:     total,
+		startTime: time.Now(),
+		width:     width,
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if activeProgressBar != nil {
+		activeProgressBar.finish()
+	}
+	activeProgressBar = bar
+	bar.draw(time.Now())
+	return bar
+}
+
+// Add records the progress made and redraws the bar if it hasn't been redrawn recently.  'transferred' is the number
+// of bytes transferred, used for the throughput when the progress isn't measured in bytes.
+func (bar *ProgressBar) Add(done int64, transferred int64) {
+	if bar == nil {
+		return
+	}
+	atomic.AddInt64(&bar.done, done)
+	atomic.AddInt64(&bar.transferred, transferred)
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	now := time.Now()
+	if activeProgressBar == bar && now.Sub(bar.lastDraw) >= progressBarInterval {
+		bar.draw(now)
+	}
+}
+
+// Finish draws the bar for the last time and leaves it on the screen as the summary of the phase.
+func (bar *ProgressBar) Finish() {
+	if bar == nil {
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if activeProgressBar == bar {
+		bar.finish()
+		activeProgressBar = nil
+	}
+}
+
+// finish draws the final line.  The caller must hold logMutex.
+func (bar *ProgressBar) finish() {
+	bar.draw(time.Now())
+	fmt.Fprintf(logOutput, "\n")
+	bar.lastLength = 0
+}
+
+// draw redraws the bar in place.  The caller must hold logMutex.
+func (bar *ProgressBar) draw(now time.Time) {
+	line := bar.format(now)
+	if len(line) >= bar.width {
+		line = line[:bar.width-1]
+	}
+	padding := ""
+	if len(line) < bar.lastLength {
+		padding = strings.Repeat(" ", bar.lastLength-len(line))
+	}
+	fmt.Fprintf(logOutput, "\r%s%s", line, padding)
+	bar.lastDraw = now
+	bar.lastLength = len(line)
+}
+
+// clear erases the bar so a log can be printed on its line.  The caller must hold logMutex.
+func (bar *ProgressBar) clear() {
+	if bar.lastLength > 0 {
+		fmt.Fprintf(logOutput, "\r%s\r", strings.Repeat(" ", bar.lastLength))
+		bar.lastLength = 0
+	}
+}
+
+// formatAmount formats the amount in the unit of the bar.
+func (bar *ProgressBar) formatAmount(amount int64) string {
+	if bar.unit == "" {
+		return PrettySize(amount)
+	}
+	return fmt.Sprintf("%d", amount)
+}
+
+// format returns the line showing the phase, the bar, the percentage, the amounts, the throughput, and the estimated
+// remaining time, fitted to the width of the terminal.  If the total isn't known only the amount and the throughput
+// are shown.
+func (bar *ProgressBar) format(now time.Time) string {
+	done := atomic.LoadInt64(&bar.done)
+	transferred := atomic.LoadInt64(&bar.transferred)
+	elapsed := now.Sub(bar.startTime).Seconds()
+
+	amount := bar.formatAmount(done)
+	if bar.total > 0 {
+		amount += "/" + bar.formatAmount(bar.total)
+	}
+	if bar.unit != "" {
+		amount += " " + bar.unit
+	}
+
+	throughput := ""
+	if elapsed > 0 {
+		if bar.unit == "" {
+			throughput = fmt.Sprintf(" %sB/s", PrettySize(int64(float64(done)/elapsed)))
+		} else if transferred > 0 {
+			throughput = fmt.Sprintf(" %sB/s", PrettySize(int64(float64(transferred)/elapsed)))
+		} else {
+			throughput = fmt.Sprintf(" %d %s/s", int64(float64(done)/elapsed), bar.unit)
+		}
+	}
+
+	if bar.total <= 0 {
+		return fmt.Sprintf("%s %s%s", bar.phase, amount, throughput)
+	}
+
+	fraction := float64(done) / float64(bar.total)
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	eta := ""
+	if done >= bar.total {
+		eta = " in " + PrettyTime(int64(elapsed))
+	} else if done > 0 && elapsed > 0 {
+		eta = " ETA " + PrettyTime(int64(float64(bar.total-done)/(float64(done)/elapsed))+1)
+	}
+
+	suffix := fmt.Sprintf(" %5.1f%% %s%s%s", fraction*100, amount, throughput, eta)
+
+	// Leave the last column empty, as writing to it moves the cursor to the next line on some terminals
+	barWidth := bar.width - 1 - len(bar.phase) - len(" []") - len(suffix)
+	if barWidth > progressBarMaximumWidth {
+		barWidth = progressBarMaximumWidth
+	}
+	if barWidth < progressBarMinimumWidth {
+		return bar.phase + suffix
+	}
+
+	filled := int(fraction * float64(barWidth))
+	graphic := strings.Repeat("=", filled)
+	if filled < barWidth {
+		graphic += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("%s [%s]%s", bar.phase, graphic, suffix)
+}
+
+// printAboveProgressBar is called by logf with logMutex held to print a log while a bar is shown.  Progress logs are
+// not printed as the bar already shows the progress; other logs are printed above the bar, which is then redrawn
+// unless the log is an error that ends the program.
+func printAboveProgressBar(level int, logID string, message string) {
+	if getJSONRecordType(level, logID) == "progress" {
+		return
+	}
+	activeProgressBar.clear()
+	fmt.Fprintf(logOutput, "%s\n", message)
+	if level <= WARN {
+		activeProgressBar.draw(time.Now())
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressBar(t *testing.T) {
+
+	setTestingT(t)
+
+	now := time.Now()
+	bar := &ProgressBar{phase: "Upload", total: 100 * 1024 * 1024, done: 25 * 1024 * 1024, startTime: now.Add(-10 * time.Second),
+		width: 80}
+	line := bar.format(now)
+	if !strings.HasPrefix(line, "Upload [======>                   ]") || !strings.Contains(line, " 25.0% 25.00M/100.00M 2.50MB/s ETA 00:00:31") {
+		t.Errorf("The upload progress is shown as '%s'", line)
+	}
+	if len(line) >= bar.width {
+		t.Errorf("The progress bar takes up %d columns out of %d", len(line), bar.width)
+	}
+
+	bar.done = bar.total
+	if line = bar.format(now); !strings.Contains(line, "[=========================] 100.0%") ||
+		!strings.HasSuffix(line, " in 00:00:10") {
+		t.Errorf("The completed upload is shown as '%s'", line)
+	}
+
+	// The bar is left out if the terminal is too narrow
+	bar.width = 50
+	if line = bar.format(now); strings.Contains(line, "[") || !strings.HasPrefix(line, "Upload 100.0%") {
+		t.Errorf("The upload progress on a narrow terminal is shown as '%s'", line)
+	}
+
+	bar = &ProgressBar{phase: "Scan", unit: "files", done: 12345, startTime: now.Add(-5 * time.Second), width: 80}
+	if line = bar.format(now); line != "Scan 12345 files 2469 files/s" {
+		t.Errorf("The scanning progress is shown as '%s'", line)
+	}
+
+	bar = &ProgressBar{phase: "Verify", unit: "chunks", total: 10, done: 5, transferred: 20 * 1024 * 1024,
+		startTime: now.Add(-2 * time.Second), width: 100}
+	if line = bar.format(now); !strings.Contains(line, " 50.0% 5/10 chunks 10.00MB/s ETA 00:00:03") {
+		t.Errorf("The verification progress is shown as '%s'", line)
+	}
+
+	// Progress logs are dropped while a bar is shown, and other logs are printed above the bar
+	var output bytes.Buffer
+	savedOutput := logOutput
+	logOutput = &output
+	defer func() {
+		logOutput = savedOutput
+		activeProgressBar = nil
+	}()
+
+	activeProgressBar = bar
+	bar.draw(now)
+	printAboveProgressBar(INFO, "VERIFY_PROGRESS", "Verified chunk 5")
+	printAboveProgressBar(WARN, "CHUNK_RETRY", "Retrying")
+	content := output.String()
+	if strings.Contains(content, "Verified chunk") {
+		t.Errorf("A progress log was printed with the progress bar")
+	}
+	if !strings.Contains(content, "\r"+strings.Repeat(" ", len(line))+"\rRetrying\n\rVerify [") {
+		t.Errorf("A log was printed with the progress bar as %q", content)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"strings"
+)
+
+// pruneEstimate accumulates the chunks and fossils that a dry-run prune would remove, along with the storage space
+// they occupy.
+type pruneEstimate struct {
+	chunks  int   // unreferenced chunks that would be turned into fossils (or deleted in exclusive mode)
+	fossils int   // unreferenced fossils left by earlier prunes that would be collected
+	bytes   int64 // total size of the chunks and fossils on the storage
+	unknown int   // chunks that were not found on the storage, so their sizes aren't included
+}
+
+// addChunk records an unreferenced chunk; a negative size means the chunk couldn't be found on the storage.
+func (estimate *pruneEstimate) addChunk(size int64) {
+	estimate.chunks++
+	if size < 0 {
+		estimate.unknown++
+		return
+	}
+	estimate.bytes += size
+}
+
+// addFossil records an unreferenced fossil of the given size.
+func (estimate *pruneEstimate) addFossil(size int64) {
+	estimate.fossils++
+	estimate.bytes += size
+}
+
+// report prints the estimate at the end of a dry run.
+func (estimate *pruneEstimate) report() {
+	if estimate.chunks == 0 && estimate.fossils == 0 {
+		LOG_INFO("PRUNE_ESTIMATE", "No chunks would become unreferenced")
+		return
+	}
+
+	if estimate.fossils > 0 {
+		LOG_INFO("PRUNE_ESTIMATE", "%d chunks and %d fossils would be removed, reclaiming %s", estimate.chunks,
+			estimate.fossils, PrettySize(estimate.bytes))
+	} else {
+		LOG_INFO("PRUNE_ESTIMATE", "%d chunks would become unreferenced, reclaiming %s", estimate.chunks,
+			PrettySize(estimate.bytes))
+	}
+	if estimate.unknown > 0 {
+		LOG_WARN("PRUNE_ESTIMATE", "%d unreferenced chunks were not found in the storage so their sizes are unknown",
+			estimate.unknown)
+	}
+}
+
+// listChunkSizes returns the size of every chunk on the storage, indexed by chunk id.  Listing the chunk directory
+// takes far fewer API calls than looking up each unreferenced chunk when there are many of them.
+func (manager *SnapshotManager) listChunkSizes() map[string]int64 {
+	chunkSizes := make(map[string]int64)
+	allFiles, allSizes := manager.ListAllFiles(manager.storage, chunkDir)
+	for i, file := range allFiles {
+		if len(file) == 0 || file[len(file)-1] == '/' || strings.HasSuffix(file, ".tmp") ||
+			strings.HasSuffix(file, ".fsl") {
+			continue
+		}
+		chunkSizes[strings.Replace(file, "/", "", -1)] = allSizes[i]
+	}
+	return chunkSizes
+}
+
+// estimateUnreferencedChunks computes the space taken by the chunks that would be unreferenced after the flagged
+// snapshots are deleted.
+func (manager *SnapshotManager) estimateUnreferencedChunks(chunks []string) *pruneEstimate {
+	estimate := &pruneEstimate{}
+	if len(chunks) == 0 {
+		return estimate
+	}
+
+	LOG_INFO("PRUNE_ESTIMATE", "Listing all chunks to estimate the reclaimable space")
+	chunkSizes := manager.listChunkSizes()
+	for _, chunk := range chunks {
+		if size, found := chunkSizes[chunk]; found {
+			estimate.addChunk(size)
+		} else {
+			estimate.addChunk(-1)
+		}
+	}
+	return estimate
+}
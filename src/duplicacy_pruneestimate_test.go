@@ -0,0 +1,57 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneEstimate(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, 2*chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	createTestSnapshot(snapshotManager, "repository1", 1, now-2*day-3600, now-2*day-60, []string{chunkHash1, chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-1*day-3600, now-1*day-60, []string{chunkHash2, chunkHash3}, "tag")
+	checkTestSnapshots(snapshotManager, 2, 0)
+
+	chunkID1 := snapshotManager.config.GetChunkIDFromHash(chunkHash1)
+	_, exist, size1, err := snapshotManager.storage.FindChunk(0, chunkID1, false)
+	if err != nil || !exist {
+		t.Fatalf("Failed to find the chunk %s: %v", chunkID1, err)
+	}
+
+	missingChunkID := strings.Repeat("0", len(chunkID1))
+	estimate := snapshotManager.estimateUnreferencedChunks([]string{chunkID1, missingChunkID})
+	if estimate.chunks != 2 || estimate.unknown != 1 || estimate.bytes != size1 {
+		t.Errorf("The estimate is %d chunks, %d unknown, and %d bytes; expected 2 chunks, 1 unknown, and %d bytes",
+			estimate.chunks, estimate.unknown, estimate.bytes, size1)
+	}
+
+	estimate = &pruneEstimate{}
+	estimate.addFossil(100)
+	estimate.addChunk(50)
+	if estimate.chunks != 1 || estimate.fossils != 1 || estimate.bytes != 150 {
+		t.Errorf("The estimate is %d chunks, %d fossils, and %d bytes", estimate.chunks, estimate.fossils, estimate.bytes)
+	}
+
+	t.Logf("Estimating the space reclaimed by removing revision 1")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1}, []string{}, []string{}, false, false, []string{}, true, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 0)
+}
@@ -0,0 +1,223 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The path of the prune journal in the snapshot cache.  It is in the same directory as the fossil collections but
+// isn't mistaken for one because its name is not a number.
+const pruneJournalFile = "fossils/journal"
+
+// pruneJournal records the progress of a prune in the local cache.  It is saved before any chunk is turned into a
+// fossil and removed after all snapshot files to be deleted have been removed, so if the prune is interrupted in
+// between, the next prune can complete it instead of leaving snapshots that reference fossils, or fossils that only an
+// exhaustive prune can find.
+type pruneJournal struct {
+	StartTime int64 `json:"start_time"`
+	Exclusive bool  `json:"exclusive"`
+
+	// The snapshots being deleted
+	DeletedRevisions map[string][]int `json:"deleted_revisions"`
+
+	// Fossils created so far; only known once all chunks have been fossilized
+	Fossils     []string `json:"fossils"`
+	Temporaries []string `json:"temporaries"`
+
+	// Set once the fossil collection has been saved (or turned out to be empty); from then on only snapshot files
+	// remain to be deleted
+	Collected        bool `json:"collected"`
+	CollectionNumber int  `json:"collection_number"`
+}
+
+// createPruneJournal creates a journal for the snapshots flagged for deletion.
+func createPruneJournal(allSnapshots map[string][]*Snapshot, exclusive bool) *pruneJournal {
+	journal := &pruneJournal{
+		StartTime:        time.Now().Unix(),
+		Exclusive:        exclusive,
+		DeletedRevisions: make(map[string][]int),
+	}
+	for id, snapshots := range allSnapshots {
+		for _, snapshot := range snapshots {
+			if snapshot.Flag {
+				journal.DeletedRevisions[id] = append(journal.DeletedRevisions[id], snapshot.Revision)
+			}
+		}
+	}
+	return journal
+}
+
+// savePruneJournal writes the journal to the snapshot cache.  The file storage writes to a temporary file first so
+// an interruption never leaves a partial journal.
+func (manager *SnapshotManager) savePruneJournal(journal *pruneJournal) bool {
+	description, err := json.Marshal(journal)
+	if err != nil {
+		LOG_ERROR("PRUNE_JOURNAL", "Failed to create a json file for the prune journal: %v", err)
+		return false
+	}
+
+	err = manager.snapshotCache.UploadFile(0, pruneJournalFile, description)
+	if err != nil {
+		LOG_ERROR("PRUNE_JOURNAL", "Failed to save the prune journal: %v", err)
+		return false
+	}
+	return true
+}
+
+// loadPruneJournal returns the journal left by an interrupted prune, or nil if the last prune completed.
+func (manager *SnapshotManager) loadPruneJournal() *pruneJournal {
+	exist, _, _, err := manager.snapshotCache.GetFileInfo(0, pruneJournalFile)
+	if err != nil || !exist {
+		return nil
+	}
+
+	manager.fileChunk.Reset(false)
+	err = manager.snapshotCache.DownloadFile(0, pruneJournalFile, manager.fileChunk)
+	if err != nil {
+		LOG_ERROR("PRUNE_JOURNAL", "Failed to read the prune journal: %v", err)
+		return nil
+	}
+
+	journal := &pruneJournal{}
+	err = json.Unmarshal(manager.fileChunk.GetBytes(), journal)
+	if err != nil {
+		LOG_WARN("PRUNE_JOURNAL", "The prune journal is corrupted and will be ignored: %v", err)
+		manager.removePruneJournal()
+		return nil
+	}
+	return journal
+}
+
+// removePruneJournal removes the journal once the prune has completed.
+func (manager *SnapshotManager) removePruneJournal() {
+	err := manager.snapshotCache.DeleteFile(0, pruneJournalFile)
+	if err != nil {
+		LOG_WARN("PRUNE_JOURNAL", "Failed to remove the prune journal: %v", err)
+	}
+}
+
+// finishPruneJournal completes the part of an interrupted prune that can be done without computing unreferenced
+// chunks again: deleting the remaining snapshot files once the fossil collection has been saved, or at any point in
+// exclusive mode where chunks are deleted right away.  The deleted snapshots are removed from 'allSnapshots'.  It
+// returns the journal if the interrupted prune must instead be merged into the current one.
+func (manager *SnapshotManager) finishPruneJournal(journal *pruneJournal, allSnapshots map[string][]*Snapshot,
+	logFile io.Writer) *pruneJournal {
+
+	if journal.Collected {
+		LOG_INFO("PRUNE_RESUME", "Resuming the prune started at %s after fossil collection %d was saved",
+			time.Unix(journal.StartTime, 0).Format("2006-01-02 15:04:05"), journal.CollectionNumber)
+	} else if journal.Exclusive {
+		LOG_INFO("PRUNE_RESUME", "Resuming the exclusive prune started at %s",
+			time.Unix(journal.StartTime, 0).Format("2006-01-02 15:04:05"))
+		LOG_WARN("PRUNE_RESUME", "Some unreferenced chunks may remain; run an exhaustive exclusive prune to remove them")
+	} else {
+		return journal
+	}
+
+	for id, revisions := range journal.DeletedRevisions {
+		deleted := make(map[int]bool)
+		for _, revision := range revisions {
+			deleted[revision] = true
+		}
+
+		var remaining []*Snapshot
+		for _, snapshot := range allSnapshots[id] {
+			if !deleted[snapshot.Revision] {
+				remaining = append(remaining, snapshot)
+				continue
+			}
+			if !manager.deletePrunedSnapshot(snapshot, logFile) {
+				return nil
+			}
+		}
+		if len(remaining) > 0 {
+			allSnapshots[id] = remaining
+		} else {
+			delete(allSnapshots, id)
+		}
+	}
+
+	manager.removePruneJournal()
+	return nil
+}
+
+// flagJournalSnapshots flags the snapshots that an interrupted prune was deleting, so the current prune collects
+// their chunks again and deletes them.  It returns the number of snapshots that weren't already flagged.
+func (journal *pruneJournal) flagJournalSnapshots(allSnapshots map[string][]*Snapshot) int {
+	if journal == nil {
+		return 0
+	}
+
+	LOG_INFO("PRUNE_RESUME", "Resuming the prune started at %s",
+		time.Unix(journal.StartTime, 0).Format("2006-01-02 15:04:05"))
+	flagged := 0
+	for id, revisions := range journal.DeletedRevisions {
+		deleted := make(map[int]bool)
+		for _, revision := range revisions {
+			deleted[revision] = true
+		}
+		for _, snapshot := range allSnapshots[id] {
+			if deleted[snapshot.Revision] && !snapshot.Flag {
+				LOG_DEBUG("SNAPSHOT_DELETE", "Snapshot %s at revision %d to be deleted - interrupted prune",
+					snapshot.ID, snapshot.Revision)
+				snapshot.Flag = true
+				flagged++
+			}
+		}
+	}
+	return flagged
+}
+
+// addToCollection adds the fossils and temporaries recorded by an interrupted prune to the fossil collection.
+func (journal *pruneJournal) addToCollection(collection *FossilCollection) {
+	if journal == nil {
+		return
+	}
+
+	existing := make(map[string]bool)
+	for _, fossil := range collection.Fossils {
+		existing[fossil] = true
+	}
+	for _, fossil := range journal.Fossils {
+		if !existing[fossil] {
+			collection.AddFossil(fossil)
+			existing[fossil] = true
+		}
+	}
+
+	for _, temporary := range journal.Temporaries {
+		if !existing[temporary] {
+			collection.AddTemporary(temporary)
+			existing[temporary] = true
+		}
+	}
+}
+
+// deletePrunedSnapshot removes the file of a snapshot being pruned from the storage and the snapshot cache.
+func (manager *SnapshotManager) deletePrunedSnapshot(snapshot *Snapshot, logFile io.Writer) bool {
+	snapshotPath := fmt.Sprintf("snapshots/%s/%d", snapshot.ID, snapshot.Revision)
+	err := manager.storage.DeleteFile(0, snapshotPath)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_DELETE", "Failed to delete the snapshot %s at revision %d: %v",
+			snapshot.ID, snapshot.Revision, err)
+		return false
+	}
+	LOG_INFO("SNAPSHOT_DELETE", "The snapshot %s at revision %d has been removed",
+		snapshot.ID, snapshot.Revision)
+	err = manager.snapshotCache.DeleteFile(0, snapshotPath)
+	if err != nil {
+		LOG_WARN("SNAPSHOT_DELETE", "The cached snapshot %s at revision %d could not be removed: %v",
+			snapshot.ID, snapshot.Revision, err)
+		fmt.Fprintf(logFile, "Cached snapshot %s at revision %d could not be removed: %v",
+			snapshot.ID, snapshot.Revision, err)
+	} else {
+		fmt.Fprintf(logFile, "Deleted cached snapshot %s at revision %d\n", snapshot.ID, snapshot.Revision)
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPruneJournal(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+	snapshotManager.snapshotCache.CreateDirectory(0, "fossils")
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash4 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	createTestSnapshot(snapshotManager, "repository1", 1, now-3*day-3600, now-3*day-60, []string{chunkHash1, chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-2*day-3600, now-2*day-60, []string{chunkHash2, chunkHash3}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 3, now-1*day-3600, now-1*day-60, []string{chunkHash3, chunkHash4}, "tag")
+	checkTestSnapshots(snapshotManager, 3, 0)
+
+	t.Logf("Simulating a prune of revision 1 interrupted while turning chunks into fossils")
+	chunkPath, _, _, _ := snapshotManager.storage.FindChunk(0, snapshotManager.config.GetChunkIDFromHash(chunkHash1), false)
+	snapshotManager.storage.MoveFile(0, chunkPath, chunkPath+".fsl")
+	journal := &pruneJournal{
+		StartTime:        now,
+		DeletedRevisions: map[string][]int{"repository1": {1}},
+	}
+	snapshotManager.savePruneJournal(journal)
+	checkTestSnapshots(snapshotManager, 3, 1)
+
+	t.Logf("Pruning without removing any snapshots -- revision 1 will be removed")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 2)
+	if snapshotManager.loadPruneJournal() != nil {
+		t.Errorf("The prune journal was not removed after the prune completed")
+	}
+
+	t.Logf("Simulating a prune of revision 2 interrupted after the fossil collection was saved")
+	snapshotPath := path.Join(testDir, "snapshots", "repository1", "2")
+	description, err := ioutil.ReadFile(snapshotPath)
+	if err != nil {
+		t.Fatalf("Failed to read the snapshot file: %v", err)
+	}
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{2}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	err = ioutil.WriteFile(snapshotPath, description, 0644)
+	if err != nil {
+		t.Fatalf("Failed to restore the snapshot file: %v", err)
+	}
+	journal = &pruneJournal{
+		StartTime:        now,
+		DeletedRevisions: map[string][]int{"repository1": {2}},
+		Collected:        true,
+		CollectionNumber: 2,
+	}
+	snapshotManager.savePruneJournal(journal)
+
+	t.Logf("Pruning without removing any snapshots -- the fossil collection will be kept")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 1, 4)
+	if exist, _, _, _ := snapshotManager.snapshotCache.GetFileInfo(0, "fossils/2"); !exist {
+		t.Errorf("The fossil collection was discarded as having ghost snapshots")
+	}
+	if snapshotManager.loadPruneJournal() != nil {
+		t.Errorf("The prune journal was not removed after the prune completed")
+	}
+}
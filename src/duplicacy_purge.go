@@ -0,0 +1,297 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sort"
+	"strings"
+)
+
+// filePiece is the part of a file stored in one chunk.
+type filePiece struct {
+	entry  *Entry
+	start  int // The offset in the chunk
+	end    int
+	purged bool
+}
+
+// PurgeFiles removes the files matched by 'patterns' from the revisions of the snapshot id (or all snapshot ids if
+// 'snapshotID' is empty), or only from the given revisions.  The revisions are rewritten in place, and then an
+// exhaustive prune removes the chunks no longer referenced.  Unless 'exclusive' is true, these chunks are only
+// turned into fossils and will be deleted by the next prune, as usual.  A matched directory is purged along with
+// everything under it.
+func (manager *BackupManager) PurgeFiles(snapshotID string, revisions []int, patterns []string, exclusive bool,
+	dryRun bool, threads int) bool {
+
+	LOG_DEBUG("PURGE_PARAMETERS", "id: %s, revisions: %v, patterns: %v, exclusive: %t, dryrun: %t", snapshotID,
+		revisions, patterns, exclusive, dryRun)
+
+	var snapshotIDs []string
+	if snapshotID == "" {
+		var err error
+		snapshotIDs, err = manager.SnapshotManager.ListSnapshotIDs()
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list all snapshots: %v", err)
+			return false
+		}
+	} else {
+		snapshotIDs = []string{snapshotID}
+	}
+
+	if threads < 1 {
+		threads = 1
+	}
+
+	rewrittenRevisions := 0
+	for _, id := range snapshotIDs {
+		revisionsToPurge := revisions
+		if len(revisionsToPurge) == 0 {
+			var err error
+			revisionsToPurge, err = manager.SnapshotManager.ListSnapshotRevisions(id)
+			if err != nil {
+				LOG_ERROR("SNAPSHOT_LIST", "Failed to list all revisions for snapshot %s: %v", id, err)
+				return false
+			}
+		}
+
+		for _, revision := range revisionsToPurge {
+			snapshot := manager.SnapshotManager.DownloadSnapshot(id, revision)
+			manager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, true)
+
+			purged := findPurgedFiles(snapshot.Files, patterns)
+			if len(purged) == 0 {
+				LOG_DEBUG("PURGE_NONE", "No files to purge in snapshot %s at revision %d", id, revision)
+				manager.SnapshotManager.ClearSnapshotContents(snapshot)
+				continue
+			}
+
+			for _, file := range snapshot.Files {
+				if purged[file] {
+					LOG_INFO("PURGE_FILE", "Purging %s from snapshot %s at revision %d", file.Path, id, revision)
+				}
+			}
+			LOG_INFO("PURGE_REVISION", "%d files and directories to purge from snapshot %s at revision %d",
+				len(purged), id, revision)
+
+			if !dryRun {
+				if !manager.purgeSnapshotFiles(snapshot, purged, threads) {
+					return false
+				}
+			}
+			manager.SnapshotManager.ClearSnapshotContents(snapshot)
+			rewrittenRevisions++
+		}
+	}
+
+	if rewrittenRevisions == 0 {
+		LOG_INFO("PURGE_NONE", "No files matched the patterns")
+		return true
+	}
+
+	if dryRun {
+		LOG_INFO("PURGE_END", "%d revisions would be rewritten", rewrittenRevisions)
+		return true
+	}
+
+	LOG_INFO("PURGE_END", "%d revisions have been rewritten; removing chunks no longer referenced",
+		rewrittenRevisions)
+	return manager.SnapshotManager.PruneSnapshots(manager.snapshotID, "", nil, nil, nil, true, exclusive, nil, false,
+		false, false, threads)
+}
+
+// findPurgedFiles returns the entries matched by the patterns, including all entries under a matched directory.
+func findPurgedFiles(files []*Entry, patterns []string) map[*Entry]bool {
+
+	purged := make(map[*Entry]bool)
+	var purgedDirectories []string
+	for _, file := range files {
+		matched := MatchEntry(file, patterns)
+		for _, directory := range purgedDirectories {
+			if strings.HasPrefix(file.Path, directory) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		purged[file] = true
+		if file.IsDir() {
+			purgedDirectories = append(purgedDirectories, file.Path)
+		}
+	}
+	return purged
+}
+
+// purgeSnapshotFiles removes the purged entries from the snapshot and uploads the snapshot again under the same
+// revision.  Chunks containing only purged files are dropped from the chunk list; chunks shared by purged and other
+// files are replaced by new chunks with the data of the other files only, so no purged data remains referenced.
+func (manager *BackupManager) purgeSnapshotFiles(snapshot *Snapshot, purged map[*Entry]bool, threads int) bool {
+
+	var files []*Entry
+	for _, file := range snapshot.Files {
+		if !purged[file] {
+			files = append(files, file)
+			continue
+		}
+		if file.IsFile() {
+			snapshot.NumberOfFiles--
+			snapshot.FileSize -= file.Size
+		}
+	}
+
+	if !snapshot.IsMetadataOnly() && !manager.rewriteChunks(snapshot, purged, threads) {
+		return false
+	}
+	snapshot.Files = files
+
+	err := manager.SnapshotManager.CheckSnapshot(snapshot)
+	if err != nil {
+		LOG_ERROR("PURGE_CHECK", "Snapshot %s at revision %d would contain an error after purging: %v", snapshot.ID,
+			snapshot.Revision, err)
+		return false
+	}
+
+	chunkMaker := CreateChunkMaker(manager.config, false)
+	chunkUploader := CreateChunkUploader(manager.config, manager.storage, nil, threads, nil)
+	manager.UploadSnapshot(chunkMaker, chunkUploader, "", snapshot, make(map[string]bool))
+	LOG_INFO("PURGE_REVISION", "Snapshot %s at revision %d has been rewritten", snapshot.ID, snapshot.Revision)
+	return true
+}
+
+// rewriteChunks rebuilds the chunk list of the snapshot without the data of the purged files and updates the chunk
+// offsets of the other files.
+func (manager *BackupManager) rewriteChunks(snapshot *Snapshot, purged map[*Entry]bool, threads int) bool {
+
+	entries := make([]*Entry, 0, len(snapshot.Files))
+	for _, file := range snapshot.Files {
+		if file.IsFile() && file.Size > 0 {
+			entries = append(entries, file)
+		}
+	}
+	sort.Sort(ByChunk(entries))
+
+	numberOfChunks := len(snapshot.ChunkHashes)
+	pieces := make([][]filePiece, numberOfChunks)
+	for _, entry := range entries {
+		for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+			start, end := 0, snapshot.ChunkLengths[i]
+			if i == entry.StartChunk {
+				start = entry.StartOffset
+			}
+			if i == entry.EndChunk {
+				end = entry.EndOffset
+			}
+			pieces[i] = append(pieces[i], filePiece{entry: entry, start: start, end: end, purged: purged[entry]})
+		}
+	}
+
+	chunkDownloader := CreateChunkDownloader(manager.config, manager.storage, nil, false, threads, false)
+	defer chunkDownloader.Stop()
+
+	var chunkHashes []string
+	var chunkLengths []int
+	newIndex := make([]int, numberOfChunks)
+
+	// The new offsets of the first and last pieces of files in rebuilt chunks
+	startOffsets := make(map[*Entry]int)
+	endOffsets := make(map[*Entry]int)
+
+	for i := 0; i < numberOfChunks; i++ {
+		kept, dropped := 0, 0
+		for _, piece := range pieces[i] {
+			if piece.purged {
+				dropped++
+			} else {
+				kept++
+			}
+		}
+
+		if dropped == 0 {
+			newIndex[i] = len(chunkHashes)
+			chunkHashes = append(chunkHashes, snapshot.ChunkHashes[i])
+			chunkLengths = append(chunkLengths, snapshot.ChunkLengths[i])
+			continue
+		} else if kept == 0 {
+			newIndex[i] = -1
+			continue
+		}
+
+		chunk := chunkDownloader.WaitForChunk(chunkDownloader.AddChunk(snapshot.ChunkHashes[i]))
+		content := chunk.GetBytes()
+
+		newChunk := manager.config.GetChunk()
+		newChunk.Reset(true)
+		for _, piece := range pieces[i] {
+			if piece.purged {
+				continue
+			}
+			if piece.end > len(content) {
+				manager.config.PutChunk(newChunk)
+				LOG_ERROR("PURGE_CHUNK", "The chunk %s is shorter than the file %s needs", chunk.GetID(),
+					piece.entry.Path)
+				return false
+			}
+			offset := newChunk.GetLength()
+			if i == piece.entry.StartChunk {
+				startOffsets[piece.entry] = offset
+			}
+			if i == piece.entry.EndChunk {
+				endOffsets[piece.entry] = offset + piece.end - piece.start
+			}
+			newChunk.Write(content[piece.start:piece.end])
+		}
+
+		chunkHash := newChunk.GetHash()
+		chunkID := newChunk.GetID()
+		_, err := manager.SnapshotManager.uploadChunkContent(0, chunkID, chunkHash, newChunk.GetBytes(), false)
+		length := newChunk.GetLength()
+		manager.config.PutChunk(newChunk)
+		if err != nil {
+			LOG_ERROR("PURGE_CHUNK", "Failed to upload the chunk %s: %v", chunkID, err)
+			return false
+		}
+		LOG_DEBUG("PURGE_CHUNK", "Chunk %s has been replaced by %s", chunk.GetID(), chunkID)
+
+		newIndex[i] = len(chunkHashes)
+		chunkHashes = append(chunkHashes, chunkHash)
+		chunkLengths = append(chunkLengths, length)
+	}
+
+	for _, entry := range snapshot.Files {
+		if purged[entry] || !entry.IsFile() {
+			continue
+		}
+
+		if entry.Size == 0 {
+			// Empty files don't read any chunk
+			index := 0
+			for i := 0; i < entry.StartChunk && i < numberOfChunks; i++ {
+				if newIndex[i] >= 0 {
+					index++
+				}
+			}
+			entry.StartChunk, entry.StartOffset, entry.EndChunk, entry.EndOffset = index, 0, index, 0
+			continue
+		}
+
+		if newIndex[entry.StartChunk] < 0 || newIndex[entry.EndChunk] < 0 {
+			LOG_ERROR("PURGE_CHUNK", "The chunks of the file %s have been dropped", entry.Path)
+			return false
+		}
+		if offset, found := startOffsets[entry]; found {
+			entry.StartOffset = offset
+		}
+		if offset, found := endOffsets[entry]; found {
+			entry.EndOffset = offset
+		}
+		entry.StartChunk = newIndex[entry.StartChunk]
+		entry.EndChunk = newIndex[entry.EndChunk]
+	}
+
+	snapshot.ChunkHashes = chunkHashes
+	snapshot.ChunkLengths = chunkLengths
+	return true
+}
@@ -0,0 +1,117 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestPurgeFiles(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "purge")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(repository, "dir1", "leaked"), 0700)
+
+	// Small files are packed into the same chunks, so purging the secrets requires rebuilding chunks
+	files := []string{"file1", "secrets.env", "dir1/file2", "dir1/secrets.env", "dir1/leaked/file3", "file4"}
+	for _, file := range files {
+		createRandomFile(joinPath(repository, file), 3000)
+	}
+	createRandomFile(joinPath(repository, "file5"), 100000)
+	ioutil.WriteFile(joinPath(repository, "empty"), nil, 0600)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+	createRandomFile(joinPath(repository, "file1"), 3000)
+	if !backupManager.Backup(repository, true, threads, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+
+	patterns := []string{"+secrets.env", "+*/secrets.env", "+dir1/leaked/"}
+
+	// A dry run doesn't change anything
+	if !backupManager.PurgeFiles("host1", nil, patterns, true, true, threads) {
+		t.Fatalf("The dry run failed")
+	}
+	manager := backupManager.SnapshotManager
+	numberOfFiles := make(map[int]int64)
+	for revision := 1; revision <= 2; revision++ {
+		snapshot := manager.DownloadSnapshot("host1", revision)
+		manager.DownloadSnapshotContents(snapshot, nil, false)
+		if len(snapshot.Files) != 10 {
+			t.Errorf("Revision %d has %d files and directories after the dry run", revision, len(snapshot.Files))
+		}
+		numberOfFiles[revision] = snapshot.NumberOfFiles
+	}
+
+	if !backupManager.PurgeFiles("host1", nil, patterns, true, false, threads) {
+		t.Fatalf("Failed to purge the files")
+	}
+
+	for revision := 1; revision <= 2; revision++ {
+		snapshot := manager.DownloadSnapshot("host1", revision)
+		manager.DownloadSnapshotContents(snapshot, nil, false)
+		var paths []string
+		for _, file := range snapshot.Files {
+			paths = append(paths, file.Path)
+		}
+		if strings.Join(paths, ",") != "empty,file1,file4,file5,dir1/,dir1/file2" {
+			t.Errorf("Revision %d contains %s after the purge", revision, strings.Join(paths, ","))
+		}
+		if snapshot.NumberOfFiles != numberOfFiles[revision]-3 {
+			t.Errorf("Revision %d has %d files after the purge instead of %d", revision, snapshot.NumberOfFiles,
+				numberOfFiles[revision]-3)
+		}
+	}
+
+	// Every file left must still be restorable, and no chunk with the purged data remains
+	if !manager.CheckSnapshots("host1", nil, "", false, false, true, false, false, false, threads, false) {
+		t.Errorf("The check after the purge failed")
+	}
+	report := manager.findOrphans()
+	if len(report.unreferencedChunks.files) != 0 || len(report.fossils.files) != 0 {
+		t.Errorf("%d unreferenced chunks and %d fossils are left after the purge",
+			len(report.unreferencedChunks.files), len(report.fossils.files))
+	}
+}
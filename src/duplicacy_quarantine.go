@@ -0,0 +1,191 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// The directory on the storage where corrupted chunks are moved to.
+var QUARANTINE_DIRECTORY = "quarantine"
+
+// ChunkQuarantine takes care of chunks that fail decryption or hash verification.  A corrupted chunk is moved out of
+// the chunks directory, because otherwise a later backup would find the chunk by name and skip uploading it again.
+// If a good copy can be found in the local snapshot cache or in a mirror storage, it is uploaded in place of the
+// corrupted one.  Every event is recorded in .duplicacy/logs/quarantine-log.
+type ChunkQuarantine struct {
+	config        *Config            // Associated config
+	storage       Storage            // The storage where the corrupted chunks are found
+	snapshotCache *FileStorage       // May hold a good copy of a metadata chunk; may be nil
+	mirrors       []*SnapshotManager // Other storages that may hold a good copy of the chunk
+
+	directoryCreated bool       // Whether the quarantine directory has been created on the storage
+	lock             sync.Mutex // Downloading goroutines may report corrupted chunks at the same time
+}
+
+// CreateChunkQuarantine creates a chunk quarantine for the specified storage.
+func CreateChunkQuarantine(config *Config, storage Storage, snapshotCache *FileStorage, mirrors []*SnapshotManager) *ChunkQuarantine {
+	return &ChunkQuarantine{
+		config:        config,
+		storage:       storage,
+		snapshotCache: snapshotCache,
+		mirrors:       mirrors,
+	}
+}
+
+// Quarantine moves the corrupted chunk at 'chunkPath' to the quarantine directory and then looks for a good copy
+// of the chunk.  If one is found, its content is stored in 'chunk' and the good copy is uploaded to the storage
+// again.  It returns true if 'chunk' now contains the correct content.
+func (quarantine *ChunkQuarantine) Quarantine(threadIndex int, chunkID string, chunkHash string, chunkPath string,
+	chunk *Chunk, reason error) bool {
+
+	quarantinePath := QUARANTINE_DIRECTORY + "/" + chunkID
+	moved := quarantine.moveChunk(threadIndex, chunkPath, quarantinePath)
+	if moved {
+		LOG_WARN("CHUNK_QUARANTINE", "The corrupted chunk %s has been moved to %s", chunkID, quarantinePath)
+	}
+
+	source := quarantine.findGoodCopy(threadIndex, chunkID, chunkHash, chunk)
+	if source == "" {
+		quarantine.report(chunkID, chunkPath, quarantinePath, moved, reason, "no good copy found")
+		return false
+	}
+
+	result := fmt.Sprintf("good copy found in %s", source)
+	if quarantine.reupload(threadIndex, chunkID, chunkHash, chunkPath, chunk, source == "the snapshot cache") {
+		result += " and uploaded"
+	}
+	quarantine.report(chunkID, chunkPath, quarantinePath, moved, reason, result)
+	return true
+}
+
+// moveChunk moves the corrupted chunk to the quarantine directory.
+func (quarantine *ChunkQuarantine) moveChunk(threadIndex int, chunkPath string, quarantinePath string) bool {
+
+	if !quarantine.storage.IsMoveFileImplemented() {
+		LOG_WARN("CHUNK_QUARANTINE", "The storage does not support moving the chunk %s to the quarantine directory",
+			chunkPath)
+		return false
+	}
+
+	quarantine.lock.Lock()
+	if !quarantine.directoryCreated {
+		err := quarantine.storage.CreateDirectory(threadIndex, QUARANTINE_DIRECTORY)
+		if err != nil {
+			LOG_WARN("CHUNK_QUARANTINE", "Failed to create the quarantine directory: %v", err)
+		} else {
+			quarantine.directoryCreated = true
+		}
+	}
+	quarantine.lock.Unlock()
+
+	err := quarantine.storage.MoveFile(threadIndex, chunkPath, quarantinePath)
+	if err != nil {
+		LOG_WARN("CHUNK_QUARANTINE", "Failed to move the chunk %s to the quarantine directory: %v", chunkPath, err)
+		return false
+	}
+	return true
+}
+
+// findGoodCopy looks for a good copy of the chunk in the snapshot cache and then in the mirrors.  It returns a
+// description of where the copy is found, or an empty string if there isn't one.
+func (quarantine *ChunkQuarantine) findGoodCopy(threadIndex int, chunkID string, chunkHash string, chunk *Chunk) string {
+
+	if quarantine.snapshotCache != nil {
+		cachedPath, exist, _, err := quarantine.snapshotCache.FindChunk(threadIndex, chunkID, false)
+		if err == nil && exist {
+			// Chunks in the snapshot cache are not encrypted or compressed
+			chunk.Reset(true)
+			err = quarantine.snapshotCache.DownloadFile(threadIndex, cachedPath, chunk)
+			if err == nil && chunk.GetID() == chunkID {
+				LOG_INFO("CHUNK_QUARANTINE", "Found a good copy of the chunk %s in the snapshot cache", chunkID)
+				return "the snapshot cache"
+			}
+		}
+	}
+
+	for _, mirror := range quarantine.mirrors {
+		found, err := downloadChunkCopy(threadIndex, quarantine.config, mirror, chunkHash, chunk)
+		if err != nil {
+			LOG_WARN("CHUNK_QUARANTINE", "No good copy of the chunk %s in the mirror storage: %v", chunkID, err)
+			continue
+		} else if !found {
+			LOG_DEBUG("CHUNK_QUARANTINE", "The chunk %s does not exist in the mirror storage", chunkID)
+			continue
+		}
+
+		LOG_INFO("CHUNK_QUARANTINE", "Found a good copy of the chunk %s in the mirror storage", chunkID)
+		return "the mirror storage"
+	}
+
+	return ""
+}
+
+// reupload encrypts the good copy and uploads it to where the corrupted chunk was.
+func (quarantine *ChunkQuarantine) reupload(threadIndex int, chunkID string, chunkHash string, chunkPath string,
+	chunk *Chunk, isSnapshot bool) bool {
+
+	// Only metadata chunks are stored in the snapshot cache.  For chunks from a mirror there is no way to tell if
+	// they are metadata chunks, which must not be encrypted by the RSA key.
+	if quarantine.config.rsaPublicKey != nil && !isSnapshot {
+		LOG_WARN("CHUNK_QUARANTINE", "The chunk %s is not uploaded again as the storage is encrypted by an RSA key",
+			chunkID)
+		return false
+	}
+
+	uploadChunk := quarantine.config.GetChunk()
+	defer quarantine.config.PutChunk(uploadChunk)
+	uploadChunk.Reset(true)
+	uploadChunk.Write(chunk.GetBytes())
+
+	err := uploadChunk.Encrypt(quarantine.config.ChunkKey, chunkHash, isSnapshot)
+	if err != nil {
+		LOG_WARN("CHUNK_QUARANTINE", "Failed to encrypt the chunk %s: %v", chunkID, err)
+		return false
+	}
+
+	err = quarantine.storage.UploadFile(threadIndex, chunkPath, uploadChunk.GetBytes())
+	if err != nil {
+		LOG_WARN("CHUNK_QUARANTINE", "Failed to upload the chunk %s: %v", chunkID, err)
+		return false
+	}
+
+	LOG_INFO("CHUNK_QUARANTINE", "The chunk %s has been uploaded again", chunkID)
+	return true
+}
+
+// report appends a line describing the quarantine event to the local report file.
+func (quarantine *ChunkQuarantine) report(chunkID string, chunkPath string, quarantinePath string, moved bool,
+	reason error, result string) {
+
+	quarantine.lock.Lock()
+	defer quarantine.lock.Unlock()
+
+	logDir := path.Join(GetDuplicacyPreferencePath(), "logs")
+	err := os.MkdirAll(logDir, 0700)
+	if err != nil {
+		LOG_WARN("CHUNK_QUARANTINE", "Could not open log directory %s: %v", logDir, err)
+		return
+	}
+
+	reportFileName := path.Join(logDir, "quarantine-log")
+	reportFile, err := os.OpenFile(reportFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		LOG_WARN("CHUNK_QUARANTINE", "Could not open log file %s: %v", reportFileName, err)
+		return
+	}
+	defer reportFile.Close()
+
+	location := chunkPath
+	if moved {
+		location = quarantinePath
+	}
+	fmt.Fprintf(reportFile, "%s Chunk %s is corrupted (%v); stored at %s; %s\n",
+		time.Now().Format("2006-01-02 15:04:05"), chunkID, reason, location, result)
+}
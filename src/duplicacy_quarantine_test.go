@@ -0,0 +1,221 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	crypto_rand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+// copyMockStore copies all the files of the mock storage 'from' to the mock storage 'to', like a bit-identical copy.
+func copyMockStore(from string, to string) {
+	source := getMockStore(from)
+	destination := getMockStore(to)
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	destination.lock.Lock()
+	defer destination.lock.Unlock()
+	for filePath, file := range source.files {
+		destination.files[filePath] = &mockFile{content: append([]byte(nil), file.content...), exists: file.exists,
+			modified: file.modified}
+	}
+	for directory := range source.directories {
+		destination.directories[directory] = true
+	}
+}
+
+// listMockFiles returns the paths of the existing files under 'dir' in the mock storage.
+func listMockFiles(name string, dir string) (files []string) {
+	store := getMockStore(name)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for filePath, file := range store.files {
+		if file.exists && strings.HasPrefix(filePath, dir+"/") {
+			files = append(files, filePath)
+		}
+	}
+	return files
+}
+
+// corruptMockFiles flips a byte in every file under 'dir' in the mock storage.
+func corruptMockFiles(name string, dir string) {
+	store := getMockStore(name)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for filePath, file := range store.files {
+		if file.exists && strings.HasPrefix(filePath, dir+"/") {
+			content := append([]byte(nil), file.content...)
+			content[len(content)/2] ^= 0xff
+			store.files[filePath] = &mockFile{content: content, exists: true, modified: file.modified}
+		}
+	}
+}
+
+// createTestRSAKeys returns a PEM encoded RSA public key and its private key.
+func createTestRSAKeys(t *testing.T) (string, string) {
+	privateKey, err := rsa.GenerateKey(crypto_rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate the RSA key: %v", err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to encode the RSA public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}))
+}
+
+func TestChunkQuarantine(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	publicKey, privateKey := createTestRSAKeys(t)
+
+	for _, rsaEncrypted := range []bool{false, true} {
+
+		name := fmt.Sprintf("mocktest/quarantine_%t", rsaEncrypted)
+		mirrorName := name + "_mirror"
+		removeMockStore(name)
+		removeMockStore(mirrorName)
+
+		testDir := filepath.Join(os.TempDir(), "duplicacy_test", "quarantine")
+		os.RemoveAll(testDir)
+		repository := filepath.Join(testDir, "repository")
+		os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+		for i := 0; i < 3; i++ {
+			createRandomFile(joinPath(repository, fmt.Sprintf("file%d", i)), 100000)
+		}
+
+		keyFile := ""
+		if rsaEncrypted {
+			keyFile = publicKey
+		}
+		password := "duplicacy"
+		storage, err := CreateMockStorage(name, 1)
+		if err != nil {
+			t.Fatalf("Failed to create the mock storage: %v", err)
+		}
+		if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, password, nil, false, keyFile, 0, 0) {
+			t.Fatalf("Failed to initialize the storage")
+		}
+
+		SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+		backupManager := CreateBackupManager("host1", storage, testDir, password, "", "", false)
+		if rsaEncrypted {
+			backupManager.LoadRSAPrivateKey(privateKey, "")
+		}
+		backupManager.SetupSnapshotCache("default")
+		if !backupManager.Backup(repository, true, 1, "first", false, false, 0, false) {
+			t.Fatalf("The backup failed")
+		}
+
+		// The mirror has good copies of all chunks, while every chunk in the storage is corrupted
+		copyMockStore(name, mirrorName)
+		corruptMockFiles(name, "chunks")
+
+		mirrorStorage, _ := CreateMockStorage(mirrorName, 1)
+		mirrorManager := CreateBackupManager("host1", mirrorStorage, testDir, password, "", "", false)
+		if mirrorManager.IsRSAEncrypted() != rsaEncrypted {
+			t.Errorf("The mirror is RSA encrypted: %t", mirrorManager.IsRSAEncrypted())
+		}
+		if rsaEncrypted {
+			mirrorManager.LoadRSAPrivateKey(privateKey, "")
+		}
+		backupManager.SnapshotManager.EnableQuarantine(mirrorManager.SnapshotManager)
+
+		restored := joinPath(testDir, "restored")
+		os.MkdirAll(restored, 0700)
+		if failures := backupManager.Restore(restored, 1, true, false, 1, false, false, false, false, nil,
+			false); failures != 0 {
+			t.Errorf("%d files failed to be restored", failures)
+		}
+		for i := 0; i < 3; i++ {
+			file := fmt.Sprintf("file%d", i)
+			if hash1, hash2 := getFileHash(joinPath(repository, file)), getFileHash(joinPath(restored, file)); hash1 != hash2 {
+				t.Errorf("File %s has a hash of %s after being restored instead of %s", file, hash2, hash1)
+			}
+		}
+
+		// The corrupted chunks are moved to the quarantine directory, and each event is in the quarantine log
+		quarantined := listMockFiles(name, QUARANTINE_DIRECTORY)
+		if len(quarantined) == 0 {
+			t.Fatalf("No chunks were quarantined")
+		}
+		content, err := ioutil.ReadFile(path.Join(GetDuplicacyPreferencePath(), "logs", "quarantine-log"))
+		if err != nil {
+			t.Fatalf("Failed to read the quarantine log: %v", err)
+		}
+		log := strings.TrimSpace(string(content))
+		if len(strings.Split(log, "\n")) != len(quarantined) {
+			t.Errorf("The quarantine log has %d lines for %d quarantined chunks:\n%s", len(strings.Split(log, "\n")),
+				len(quarantined), log)
+		}
+		fromMirror := 0
+		for _, line := range strings.Split(log, "\n") {
+			if strings.Contains(line, "good copy found in the mirror storage") {
+				fromMirror++
+			} else if !strings.Contains(line, "good copy found in the snapshot cache") {
+				t.Errorf("No good copy was found: %s", line)
+			}
+			// With an RSA key there is no way to tell if a chunk from the mirror must be encrypted by the key
+			uploaded := strings.HasSuffix(line, " and uploaded")
+			if uploaded == (rsaEncrypted && strings.Contains(line, "mirror")) {
+				t.Errorf("Uploaded: %t; %s", uploaded, line)
+			}
+		}
+		for _, quarantinedPath := range quarantined {
+			chunkID := strings.TrimPrefix(quarantinedPath, QUARANTINE_DIRECTORY+"/")
+			if !strings.Contains(log, "Chunk "+chunkID+" is corrupted") {
+				t.Errorf("The chunk %s is not in the quarantine log", chunkID)
+			}
+		}
+		if fromMirror == 0 {
+			t.Errorf("No good copies were found in the mirror")
+		}
+
+		// The good copies of the file chunks weren't uploaded, so there is nothing more to check
+		if rsaEncrypted {
+			continue
+		}
+
+		// The chunks uploaded again are good, so restoring again needs no more quarantine
+		os.Remove(path.Join(GetDuplicacyPreferencePath(), "logs", "quarantine-log"))
+		os.RemoveAll(restored)
+		os.MkdirAll(restored, 0700)
+		backupManager = CreateBackupManager("host1", storage, testDir, password, "", "", false)
+		backupManager.SetupSnapshotCache("default")
+		if failures := backupManager.Restore(restored, 1, true, false, 1, false, false, false, false, nil,
+			false); failures != 0 {
+			t.Errorf("%d files failed to be restored again", failures)
+		}
+		if _, err := os.Stat(path.Join(GetDuplicacyPreferencePath(), "logs", "quarantine-log")); !os.IsNotExist(err) {
+			t.Errorf("Chunks were quarantined again: %v", err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// The advisory lock held by a backup or a prune, in the preference directory of the repository
+const repositoryLockFile = "lock"
+
+var (
+	// How often the holder of the repository lock updates it
+	repositoryLockHeartbeat = time.Minute
+
+	// A lock not updated for this long is considered abandoned, even if a process with the same pid is running
+	repositoryLockExpiry = 10 * time.Minute
+
+	// How often a command waiting for the lock checks whether it has been released
+	repositoryLockPollInterval = 5 * time.Second
+)
+
+// RepositoryLock keeps overlapping runs in the same repository, such as cron jobs that take longer than their
+// interval, from running a backup or a prune at the same time and overwriting each other's incomplete snapshot and
+// caches.  Unlike the storage lock it is created atomically, as it is a local file.
+type RepositoryLock struct {
+	PID       int    `json:"pid"`
+	Host      string `json:"host"`
+	Operation string `json:"operation"`
+	StartTime int64  `json:"start_time"`
+	Heartbeat int64  `json:"heartbeat"`
+
+	path        string
+	stopChannel chan bool
+	stopped     sync.WaitGroup
+}
+
+func (lock *RepositoryLock) String() string {
+	return fmt.Sprintf("%s (pid %d on %s) started at %s", lock.Operation, lock.PID, lock.Host,
+		time.Unix(lock.StartTime, 0).Format("2006-01-02 15:04:05"))
+}
+
+// isStale returns true if the holder of the lock is presumed to have exited without removing it: the lock hasn't been
+// updated for too long, or it was created on this host by a process that is no longer running.
+func (lock *RepositoryLock) isStale(now time.Time) bool {
+	if now.Unix() >= lock.Heartbeat+int64(repositoryLockExpiry/time.Second) {
+		return true
+	}
+	host, _ := os.Hostname()
+	return lock.Host == host && !isProcessRunning(lock.PID)
+}
+
+// readRepositoryLock returns the lock at 'lockPath', or nil if there isn't one.  A lock that has been created but not
+// yet written is reported with only the heartbeat set, from the modification time of the file.
+func readRepositoryLock(lockPath string) (*RepositoryLock, error) {
+	stat, err := os.Stat(lockPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	description, err := ioutil.ReadFile(lockPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	lock := &RepositoryLock{}
+	if err = json.Unmarshal(description, lock); err != nil || lock.Heartbeat == 0 {
+		lock = &RepositoryLock{Operation: "an unknown operation", Heartbeat: stat.ModTime().Unix(),
+			StartTime: stat.ModTime().Unix()}
+	}
+	return lock, nil
+}
+
+// save writes the lock with an updated heartbeat.  Updates are written to a temporary file first so that another
+// process never reads a partially written lock.
+func (lock *RepositoryLock) save() error {
+	lock.Heartbeat = time.Now().Unix()
+	description, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	temporaryPath := lock.path + ".tmp"
+	if err = ioutil.WriteFile(temporaryPath, description, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, lock.path)
+}
+
+// create creates the lock file, failing if it already exists.
+func (lock *RepositoryLock) create() error {
+	file, err := os.OpenFile(lock.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	lock.Heartbeat = time.Now().Unix()
+	description, err := json.Marshal(lock)
+	if err == nil {
+		_, err = file.Write(description)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(lock.path)
+	}
+	return err
+}
+
+// AcquireRepositoryLock locks the repository whose preference directory is 'preferencePath' for 'operation', and
+// keeps the lock updated until it is released.  If another process holds the lock, it waits up to 'wait' for the lock
+// to be released before giving up.  Stale locks left by processes that have exited are removed.
+func AcquireRepositoryLock(preferencePath string, operation string, wait time.Duration) *RepositoryLock {
+
+	host, _ := os.Hostname()
+	lock := &RepositoryLock{
+		PID:         os.Getpid(),
+		Host:        host,
+		Operation:   operation,
+		StartTime:   time.Now().Unix(),
+		path:        path.Join(preferencePath, repositoryLockFile),
+		stopChannel: make(chan bool),
+	}
+
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		err := lock.create()
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			LOG_ERROR("REPOSITORY_LOCK", "Failed to create the lock %s: %v", lock.path, err)
+			return nil
+		}
+
+		existing, err := readRepositoryLock(lock.path)
+		if err != nil {
+			LOG_ERROR("REPOSITORY_LOCK", "Failed to read the lock %s: %v", lock.path, err)
+			return nil
+		} else if existing == nil {
+			continue
+		}
+
+		if existing.isStale(time.Now()) {
+			LOG_INFO("REPOSITORY_LOCK", "Removing the stale lock held by %s", existing)
+			if err = os.Remove(lock.path); err != nil && !os.IsNotExist(err) {
+				LOG_ERROR("REPOSITORY_LOCK", "Failed to remove the stale lock %s: %v", lock.path, err)
+				return nil
+			}
+			continue
+		}
+
+		if time.Now().Add(repositoryLockPollInterval).After(deadline) {
+			LOG_ERROR("REPOSITORY_LOCKED", "The repository is locked by %s; remove %s if that process is no longer "+
+				"running", existing, lock.path)
+			return nil
+		}
+		if !waiting {
+			LOG_INFO("REPOSITORY_LOCK", "Waiting for %s to finish", existing)
+			waiting = true
+		}
+		time.Sleep(repositoryLockPollInterval)
+	}
+
+	LOG_DEBUG("REPOSITORY_LOCK", "Acquired the lock %s", lock.path)
+	lock.stopped.Add(1)
+	go lock.keepAlive()
+	return lock
+}
+
+// keepAlive updates the heartbeat of the lock until the lock is released.
+func (lock *RepositoryLock) keepAlive() {
+	defer lock.stopped.Done()
+	ticker := time.NewTicker(repositoryLockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stopChannel:
+			return
+		case <-ticker.C:
+			err := lock.save()
+			if err != nil {
+				LOG_WARN("REPOSITORY_LOCK", "Failed to update the lock %s: %v", lock.path, err)
+			} else {
+				LOG_TRACE("REPOSITORY_LOCK", "Updated the lock %s", lock.path)
+			}
+		}
+	}
+}
+
+// Release stops updating the lock and removes it, unless it has been taken over by another process.
+func (lock *RepositoryLock) Release() {
+	if lock == nil {
+		return
+	}
+
+	close(lock.stopChannel)
+	lock.stopped.Wait()
+
+	current, err := readRepositoryLock(lock.path)
+	if err != nil {
+		LOG_WARN("REPOSITORY_LOCK", "Failed to read the lock %s: %v", lock.path, err)
+		return
+	} else if current != nil && (current.PID != lock.PID || current.StartTime != lock.StartTime) {
+		LOG_WARN("REPOSITORY_LOCK", "The lock %s is now held by %s", lock.path, current)
+		return
+	}
+
+	err = os.Remove(lock.path)
+	if err != nil && !os.IsNotExist(err) {
+		LOG_WARN("REPOSITORY_LOCK", "Failed to remove the lock %s: %v", lock.path, err)
+		return
+	}
+	LOG_DEBUG("REPOSITORY_LOCK", "Released the lock %s", lock.path)
+}
@@ -0,0 +1,21 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build !windows
+
+package duplicacy
+
+import (
+	"syscall"
+)
+
+// isProcessRunning returns true if a process with the pid exists.  Sending the signal 0 only checks whether the
+// process could be signaled.
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
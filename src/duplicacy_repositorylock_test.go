@@ -0,0 +1,103 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// acquireLockedRepository tries to acquire the lock that is expected to be held by another process.
+func acquireLockedRepository(t *testing.T, preferencePath string) {
+	setTestingT(nil)
+	defer func() {
+		setTestingT(t)
+		if r := recover(); r == nil {
+			t.Errorf("The repository lock was acquired twice")
+		} else if exception, ok := r.(Exception); !ok {
+			panic(r)
+		} else if exception.LogID != "REPOSITORY_LOCKED" {
+			t.Errorf("Failed to acquire the lock: %s", exception.Message)
+		}
+	}()
+	AcquireRepositoryLock(preferencePath, "prune", 0)
+}
+
+func TestRepositoryLock(t *testing.T) {
+
+	setTestingT(t)
+
+	savedInterval := repositoryLockPollInterval
+	repositoryLockPollInterval = 10 * time.Millisecond
+	defer func() { repositoryLockPollInterval = savedInterval }()
+
+	preferencePath := path.Join(os.TempDir(), "duplicacy_test", "repositorylock")
+	os.RemoveAll(preferencePath)
+	os.MkdirAll(preferencePath, 0700)
+	lockPath := path.Join(preferencePath, repositoryLockFile)
+
+	lock := AcquireRepositoryLock(preferencePath, "backup", 0)
+	if lock == nil {
+		t.Fatalf("Failed to acquire the lock")
+	}
+	existing, err := readRepositoryLock(lockPath)
+	if err != nil || existing == nil || existing.PID != os.Getpid() || existing.Operation != "backup" ||
+		existing.isStale(time.Now()) {
+		t.Fatalf("The lock read back is %+v: %v", existing, err)
+	}
+
+	// A second run fails right away, or waits for the lock to be released
+	acquireLockedRepository(t, preferencePath)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Release()
+	}()
+	second := AcquireRepositoryLock(preferencePath, "prune", 10*time.Second)
+	if second == nil {
+		t.Fatalf("Failed to acquire the lock after it was released")
+	}
+	second.Release()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("The lock was not removed: %v", err)
+	}
+
+	host, _ := os.Hostname()
+	writeLock := func(host string, pid int, heartbeat int64) {
+		description := fmt.Sprintf(`{"pid":%d,"host":"%s","operation":"backup","start_time":%d,"heartbeat":%d}`,
+			pid, host, heartbeat, heartbeat)
+		if err := ioutil.WriteFile(lockPath, []byte(description), 0644); err != nil {
+			t.Fatalf("Failed to write the lock: %v", err)
+		}
+	}
+
+	// The lock of a process on this host that is no longer running is removed
+	writeLock(host, 0, time.Now().Unix())
+	lock = AcquireRepositoryLock(preferencePath, "backup", 0)
+	if lock == nil {
+		t.Fatalf("Failed to acquire the lock left by a process that exited")
+	}
+	lock.Release()
+
+	// The lock of a process on another host is respected until it expires
+	writeLock("other", 1, time.Now().Unix())
+	acquireLockedRepository(t, preferencePath)
+
+	writeLock("other", 1, time.Now().Add(-repositoryLockExpiry).Unix())
+	lock = AcquireRepositoryLock(preferencePath, "backup", 0)
+	if lock == nil {
+		t.Fatalf("Failed to acquire the expired lock")
+	}
+	lock.Release()
+
+	// A lock that has just been created and not yet written is respected
+	ioutil.WriteFile(lockPath, nil, 0644)
+	acquireLockedRepository(t, preferencePath)
+	os.Remove(lockPath)
+}
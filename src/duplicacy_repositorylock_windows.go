@@ -0,0 +1,31 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// The exit code of a process that hasn't exited
+const processStillActive = 259
+
+// isProcessRunning returns true if a process with the pid exists and hasn't exited.
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// The process doesn't exist, unless it belongs to another user
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(handle)
+
+	var exitCode uint32
+	if err = windows.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return true
+	}
+	return exitCode == processStillActive
+}
@@ -0,0 +1,242 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// archiveWriter writes restored files into an archive.
+type archiveWriter interface {
+	// AddEntry adds a directory, a symlink, or a file whose content is then written to the returned writer.
+	AddEntry(entry *Entry) (io.Writer, error)
+	Close() error
+}
+
+// tarArchiveWriter writes a tar stream, optionally compressed by gzip.
+type tarArchiveWriter struct {
+	writer     *tar.Writer
+	compressor *gzip.Writer
+}
+
+func (archive *tarArchiveWriter) AddEntry(entry *Entry) (io.Writer, error) {
+	header := &tar.Header{
+		Name:    entry.Path,
+		Mode:    int64(entry.GetPermissions().Perm()),
+		Uid:     entry.UID,
+		Gid:     entry.GID,
+		ModTime: time.Unix(entry.Time, 0),
+	}
+	if entry.IsLink() {
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = entry.Link
+	} else if entry.IsDir() {
+		header.Typeflag = tar.TypeDir
+	} else {
+		header.Typeflag = tar.TypeReg
+		header.Size = entry.Size
+	}
+	return archive.writer, archive.writer.WriteHeader(header)
+}
+
+func (archive *tarArchiveWriter) Close() error {
+	err := archive.writer.Close()
+	if archive.compressor != nil {
+		if compressorErr := archive.compressor.Close(); err == nil {
+			err = compressorErr
+		}
+	}
+	return err
+}
+
+// zipArchiveWriter writes a zip file.
+type zipArchiveWriter struct {
+	writer *zip.Writer
+}
+
+func (archive *zipArchiveWriter) AddEntry(entry *Entry) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     entry.Path,
+		Method:   zip.Deflate,
+		Modified: time.Unix(entry.Time, 0),
+	}
+	header.SetMode(os.FileMode(entry.Mode))
+	if entry.IsDir() && !entry.IsLink() {
+		header.Method = zip.Store
+	}
+	writer, err := archive.writer.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	// The target of a symlink is stored as its content
+	if entry.IsLink() {
+		_, err = writer.Write([]byte(entry.Link))
+	}
+	return writer, err
+}
+
+func (archive *zipArchiveWriter) Close() error {
+	return archive.writer.Close()
+}
+
+// createArchiveWriter creates the archive writer for the format indicated by the extension of 'archivePath': .zip,
+// .tar, or .tar.gz/.tgz.  A path of '-' means a tar stream written to 'output'.
+func createArchiveWriter(archivePath string, output io.Writer) (archiveWriter, error) {
+	name := strings.ToLower(archivePath)
+	switch {
+	case name == "-" || strings.HasSuffix(name, ".tar"):
+		return &tarArchiveWriter{writer: tar.NewWriter(output)}, nil
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		compressor := gzip.NewWriter(output)
+		return &tarArchiveWriter{writer: tar.NewWriter(compressor), compressor: compressor}, nil
+	case strings.HasSuffix(name, ".zip"):
+		return &zipArchiveWriter{writer: zip.NewWriter(output)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format for %s (must be .zip, .tar, .tar.gz, or .tgz)", archivePath)
+	}
+}
+
+// RestoreToArchive writes the files in the snapshot at the given revision that match 'patterns' into an archive,
+// instead of restoring them to the local file system.  If 'archivePath' is '-', a tar stream is written to the
+// standard output.  Special files are skipped.  It returns the number of files that failed to be restored.
+func (manager *BackupManager) RestoreToArchive(revision int, archivePath string, threads int, showStatistics bool,
+	patterns []string) int {
+
+	startTime := time.Now().Unix()
+
+	LOG_DEBUG("RESTORE_PARAMETERS", "revision: %d, archive: %s", revision, archivePath)
+
+	output := os.Stdout
+	temporaryPath := ""
+	if archivePath != "-" {
+		temporaryPath = archivePath + ".tmp"
+		file, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			LOG_ERROR("RESTORE_ARCHIVE", "Failed to create the archive %s: %v", archivePath, err)
+			return 0
+		}
+		output = file
+		defer func() {
+			file.Close()
+			os.Remove(temporaryPath)
+		}()
+	}
+
+	buffer := bufio.NewWriterSize(output, 1024*1024)
+	archive, err := createArchiveWriter(archivePath, buffer)
+	if err != nil {
+		LOG_ERROR("RESTORE_ARCHIVE", "%v", err)
+		return 0
+	}
+
+	snapshot := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, revision)
+	if snapshot.IsMetadataOnly() {
+		LOG_ERROR("RESTORE_METADATA", "Revision %d is a metadata-only snapshot with no file contents to restore",
+			revision)
+		return 0
+	}
+	manager.SnapshotManager.DownloadSnapshotContents(snapshot, patterns, true)
+	if manager.restoreDeletedOnly {
+		var ok bool
+		if snapshot.Files, ok = manager.filterDeletedFiles(revision, snapshot.Files); !ok {
+			return 0
+		}
+	}
+	manager.SnapshotManager.SetDownloadThreads(threads)
+
+	LOG_INFO("RESTORE_START", "Restoring revision %d to %s", revision, archivePath)
+
+	var totalFiles, failedFiles int
+	var totalFileSize int64
+	for _, entry := range snapshot.Files {
+		if len(patterns) > 0 && !MatchEntry(entry, patterns) {
+			continue
+		}
+		if entry.IsSpecial() {
+			LOG_WARN("RESTORE_SPECIAL", "Special file %s can't be stored in the archive", entry.Path)
+			continue
+		}
+		manager.ownerMapping.apply(entry)
+
+		writer, err := archive.AddEntry(entry)
+		if err != nil {
+			LOG_ERROR("RESTORE_ARCHIVE", "Failed to add %s to the archive: %v", entry.Path, err)
+			return 0
+		}
+		if !entry.IsFile() {
+			continue
+		}
+
+		if !manager.SnapshotManager.RetrieveFile(snapshot, entry, func(chunk []byte) {
+			if _, err := writer.Write(chunk); err != nil {
+				LOG_ERROR("RESTORE_ARCHIVE", "Failed to write %s to the archive: %v", entry.Path, err)
+			}
+		}) {
+			LOG_WARN("DOWNLOAD_FAIL", "Failed to restore %s", entry.Path)
+			failedFiles++
+		}
+
+		if showStatistics {
+			LOG_INFO("DOWNLOAD_DONE", "Downloaded %s (%d)", entry.Path, entry.Size)
+		} else {
+			LOG_TRACE("DOWNLOAD_DONE", "Downloaded %s (%d)", entry.Path, entry.Size)
+		}
+		totalFiles++
+		totalFileSize += entry.Size
+	}
+
+	if err = archive.Close(); err == nil {
+		err = buffer.Flush()
+	}
+	if err != nil {
+		LOG_ERROR("RESTORE_ARCHIVE", "Failed to complete the archive: %v", err)
+		return 0
+	}
+
+	manager.summary = OperationSummary{
+		Revision:      revision,
+		TotalFiles:    totalFiles,
+		TotalFileSize: totalFileSize,
+		NewFiles:      totalFiles - failedFiles,
+		NewFileSize:   totalFileSize,
+		FailedFiles:   failedFiles,
+	}
+
+	if temporaryPath != "" {
+		if err = output.Sync(); err == nil {
+			err = output.Close()
+		}
+		if err == nil {
+			err = os.Rename(temporaryPath, archivePath)
+		}
+		if err != nil {
+			LOG_ERROR("RESTORE_ARCHIVE", "Failed to save the archive %s: %v", archivePath, err)
+			return 0
+		}
+	}
+
+	if failedFiles > 0 {
+		return failedFiles
+	}
+
+	LOG_INFO("RESTORE_END", "Restored revision %d to %s", revision, archivePath)
+	if showStatistics {
+		LOG_INFO("RESTORE_STATS", "Files: %d total, %s bytes", totalFiles, PrettySize(totalFileSize))
+		runningTime := time.Now().Unix() - startTime
+		if runningTime == 0 {
+			runningTime = 1
+		}
+		LOG_INFO("RESTORE_STATS", "Total running time: %s", PrettyTime(runningTime))
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestRestoreToArchive(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "restorearchive")
+	os.RemoveAll(testDir)
+
+	repository := joinPath(testDir, "repository1")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(repository, "dir"), 0700)
+	createRandomFile(joinPath(repository, "dir", "file1"), 100000)
+	createRandomFile(joinPath(repository, "file2"), 1000)
+
+	threads := 2
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	original := make(map[string][]byte)
+	for _, name := range []string{"dir/file1", "file2"} {
+		original[name], _ = ioutil.ReadFile(joinPath(repository, name))
+	}
+
+	compare := func(format string, name string, content io.Reader) {
+		data, _ := ioutil.ReadAll(content)
+		if expected, found := original[name]; found {
+			if !bytes.Equal(data, expected) {
+				t.Errorf("%s in the %s archive is different", name, format)
+			}
+			delete(original, name)
+		} else if name != "dir/" {
+			t.Errorf("Unexpected entry %s in the %s archive", name, format)
+		}
+	}
+
+	zipPath := joinPath(testDir, "restore.zip")
+	if failed := backupManager.RestoreToArchive(1, zipPath, threads, false, nil); failed != 0 {
+		t.Fatalf("%d files failed to be written to the zip archive", failed)
+	}
+	zipReader, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to open the zip archive: %v", err)
+	}
+	for _, file := range zipReader.File {
+		content, _ := file.Open()
+		compare("zip", file.Name, content)
+		content.Close()
+	}
+	zipReader.Close()
+	if len(original) != 0 {
+		t.Errorf("%d files are missing from the zip archive", len(original))
+	}
+
+	// Only files under 'dir' are included
+	tarPath := joinPath(testDir, "restore.tar.gz")
+	if failed := backupManager.RestoreToArchive(1, tarPath, threads, false, []string{"+dir/*"}); failed != 0 {
+		t.Fatalf("%d files failed to be written to the tar archive", failed)
+	}
+	original["dir/file1"], _ = ioutil.ReadFile(joinPath(repository, "dir", "file1"))
+	file, _ := os.Open(tarPath)
+	defer file.Close()
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Failed to open the tar archive: %v", err)
+	}
+	tarReader := tar.NewReader(decompressor)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read the tar archive: %v", err)
+		}
+		compare("tar", header.Name, tarReader)
+	}
+	if len(original) != 0 {
+		t.Errorf("%d files are missing from the tar archive", len(original))
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// The policies for restoring a file that already exists and differs from the version in the snapshot.  Without a
+// policy, the restore fails on such files unless the -overwrite option is given.
+const (
+	ConflictOverwrite = "overwrite" // replace the existing file
+	ConflictSkip      = "skip"      // keep the existing file and don't restore the one in the snapshot
+	ConflictKeepBoth  = "keep-both" // keep the existing file and restore the one in the snapshot as 'name (restored).ext'
+	ConflictNewer     = "newer"     // replace the existing file only if the one in the snapshot has a later timestamp
+)
+
+// errFileKept is returned by RestoreFile when the existing file is kept according to the conflict policy.
+var errFileKept = errors.New("the existing file is kept")
+
+// ParseConflictPolicy checks that 'policy' is one of the conflict policies.
+func ParseConflictPolicy(policy string) (string, error) {
+	switch policy {
+	case "", ConflictOverwrite, ConflictSkip, ConflictKeepBoth, ConflictNewer:
+		return policy, nil
+	}
+	return "", fmt.Errorf("'%s' is not a valid conflict policy (overwrite, skip, keep-both, or newer)", policy)
+}
+
+// SetConflictPolicy sets the policy for files that already exist and differ from the versions in the snapshot.
+func (manager *BackupManager) SetConflictPolicy(policy string) {
+	manager.conflictPolicy = policy
+}
+
+// resolveConflict decides what to do with the existing file described by 'fileInfo' that differs from 'entry': it
+// returns ConflictOverwrite, ConflictSkip, ConflictKeepBoth, or an empty string if the restore should fail.
+func (manager *BackupManager) resolveConflict(entry *Entry, fileInfo os.FileInfo) string {
+	if manager.conflictPolicy != ConflictNewer {
+		return manager.conflictPolicy
+	}
+	if fileInfo != nil && fileInfo.ModTime().Unix() >= entry.Time {
+		return ConflictSkip
+	}
+	return ConflictOverwrite
+}
+
+// getKeepBothPath returns the path in the snapshot under which 'entry' is restored next to an existing file, such as
+// 'dir/name (restored).ext', or 'dir/name (restored 2).ext' if that one exists too.
+func (manager *BackupManager) getKeepBothPath(top string, entry *Entry) string {
+	parent, name := SplitDir(entry.Path)
+	extension := path.Ext(name)
+	if extension == name {
+		extension = ""
+	}
+	base := strings.TrimSuffix(name, extension)
+
+	for i := 1; ; i++ {
+		newPath := fmt.Sprintf("%s%s (restored)%s", parent, base, extension)
+		if i > 1 {
+			newPath = fmt.Sprintf("%s%s (restored %d)%s", parent, base, i, extension)
+		}
+		fullPath, _ := manager.getRestorePath(top, newPath)
+		if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+			return newPath
+		}
+	}
+}
+
+// describeConflict returns the message logged when the existing copy of 'entry' is kept.
+func (manager *BackupManager) describeConflict(entry *Entry) string {
+	if manager.conflictPolicy == ConflictNewer {
+		return fmt.Sprintf("%s is kept because it is not older than the version in the snapshot", entry.Path)
+	}
+	return fmt.Sprintf("%s already exists and is kept", entry.Path)
+}
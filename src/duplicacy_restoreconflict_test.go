@@ -0,0 +1,68 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreConflictPolicy(t *testing.T) {
+
+	for _, policy := range []string{"replace", "Skip", "both"} {
+		if _, err := ParseConflictPolicy(policy); err == nil {
+			t.Errorf("'%s' is accepted as a conflict policy", policy)
+		}
+	}
+
+	top := filepath.Join(os.TempDir(), "duplicacy_test", "conflict")
+	os.RemoveAll(top)
+	os.MkdirAll(filepath.Join(top, "dir"), 0700)
+	for _, name := range []string{"a.txt", "a (restored).txt", "b"} {
+		ioutil.WriteFile(filepath.Join(top, "dir", name), []byte("local"), 0600)
+	}
+
+	manager := &BackupManager{}
+	for _, test := range []struct {
+		path     string
+		expected string
+	}{
+		{"dir/a.txt", "dir/a (restored 2).txt"},
+		{"dir/b", "dir/b (restored)"},
+		{"dir/.profile", "dir/.profile (restored)"},
+	} {
+		entry := CreateEntry(test.path, 5, 0, 0644)
+		if newPath := manager.getKeepBothPath(top, entry); newPath != test.expected {
+			t.Errorf("%s is restored as %s instead of %s", test.path, newPath, test.expected)
+		}
+	}
+
+	stat, err := os.Stat(filepath.Join(top, "dir", "b"))
+	if err != nil {
+		t.Fatalf("Failed to stat the local file: %v", err)
+	}
+	older := CreateEntry("dir/b", 5, stat.ModTime().Add(-time.Hour).Unix(), 0644)
+	newer := CreateEntry("dir/b", 5, stat.ModTime().Add(time.Hour).Unix(), 0644)
+
+	for _, test := range []struct {
+		policy   string
+		entry    *Entry
+		expected string
+	}{
+		{"", newer, ""},
+		{ConflictSkip, newer, ConflictSkip},
+		{ConflictKeepBoth, older, ConflictKeepBoth},
+		{ConflictNewer, older, ConflictSkip},
+		{ConflictNewer, newer, ConflictOverwrite},
+	} {
+		manager.SetConflictPolicy(test.policy)
+		if action := manager.resolveConflict(test.entry, stat); action != test.expected {
+			t.Errorf("The policy '%s' resolves to '%s' instead of '%s'", test.policy, action, test.expected)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+// SetRestoreDeletedOnly makes the restore include only the files and directories in the revision being restored
+// that no longer exist in the latest revision, in order to recover files deleted since that revision.
+func (manager *BackupManager) SetRestoreDeletedOnly(enabled bool) {
+	manager.restoreDeletedOnly = enabled
+}
+
+// filterDeletedFiles returns the entries in 'files', from the snapshot at 'revision', whose paths are not in the
+// latest revision.  It returns false if 'revision' is the latest revision or the revisions can't be listed.
+func (manager *BackupManager) filterDeletedFiles(revision int, files []*Entry) ([]*Entry, bool) {
+
+	revisions, err := manager.SnapshotManager.ListSnapshotRevisions(manager.snapshotID)
+	if err != nil {
+		LOG_ERROR("RESTORE_DELETED", "Failed to list the revisions of the snapshot %s: %v", manager.snapshotID, err)
+		return nil, false
+	}
+
+	latest := 0
+	for _, r := range revisions {
+		if r > latest {
+			latest = r
+		}
+	}
+	if latest <= revision {
+		LOG_ERROR("RESTORE_DELETED", "Revision %d is the latest revision so no files have been deleted since",
+			revision)
+		return nil, false
+	}
+
+	latestSnapshot := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, latest)
+	manager.SnapshotManager.DownloadSnapshotContents(latestSnapshot, nil, false)
+
+	existing := make(map[string]bool, len(latestSnapshot.Files))
+	for _, file := range latestSnapshot.Files {
+		existing[file.Path] = true
+	}
+
+	var deleted []*Entry
+	var deletedFiles int
+	for _, file := range files {
+		if existing[file.Path] {
+			continue
+		}
+		LOG_TRACE("RESTORE_DELETED", "%s does not exist in revision %d", file.Path, latest)
+		deleted = append(deleted, file)
+		if !file.IsDir() {
+			deletedFiles++
+		}
+	}
+
+	LOG_INFO("RESTORE_DELETED", "%d files and %d directories in revision %d have been deleted by revision %d",
+		deletedFiles, len(deleted)-deletedFiles, revision, latest)
+	return deleted, true
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRestoreDeletedOnly(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "restoredeleted")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository1")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(repository, "dir1", "dir2"), 0700)
+	os.MkdirAll(joinPath(repository, "dir3"), 0700)
+	for _, file := range []string{"file1", "dir1/file2", "dir1/dir2/file3", "dir3/file4"} {
+		createRandomFile(joinPath(repository, file), 1000)
+	}
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The first backup failed")
+	}
+
+	os.RemoveAll(joinPath(repository, "dir1"))
+	os.Remove(joinPath(repository, "dir3", "file4"))
+	createRandomFile(joinPath(repository, "file1"), 2000)
+	if !backupManager.Backup(repository, true, threads, "second", false, false, 0, false) {
+		t.Fatalf("The second backup failed")
+	}
+
+	snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 1)
+	backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, false)
+	deleted, ok := backupManager.filterDeletedFiles(1, snapshot.Files)
+	if !ok {
+		t.Fatalf("Failed to find the deleted files")
+	}
+
+	var paths []string
+	for _, file := range deleted {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+	expected := "dir1/ dir1/dir2/ dir1/dir2/file3 dir1/file2 dir3/file4"
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("The deleted files are %s instead of %s", strings.Join(paths, " "), expected)
+	}
+}
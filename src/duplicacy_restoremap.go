@@ -0,0 +1,114 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// RestoreMapping redirects the files under a directory to another location when they are restored.  'From' is either
+// a path in the snapshot, or an absolute path matched against the location where the file would otherwise be
+// restored, which makes it possible to remap files under source roots too.  Each component of 'From' may be a
+// wildcard pattern, and the components matched by wildcards can be referred to as $1, $2, ... in 'To'.
+type RestoreMapping struct {
+	From string
+	To   string
+
+	absolute   bool
+	components []string
+}
+
+// ParseRestoreMapping parses a mapping specified as <from>=<to>, such as "C:/Users/alice=D:/restored/alice" or
+// "home/*/Documents=/mnt/restored/$1".
+func ParseRestoreMapping(text string) (mapping RestoreMapping, err error) {
+	separator := strings.Index(text, "=")
+	if separator <= 0 || separator == len(text)-1 {
+		return mapping, fmt.Errorf("'%s' is not in the format of <from>=<to>", text)
+	}
+
+	mapping.From = strings.TrimSuffix(filepath.ToSlash(text[:separator]), "/")
+	mapping.absolute = filepath.IsAbs(text[:separator]) || strings.HasPrefix(mapping.From, "/") ||
+		filepath.VolumeName(text[:separator]) != ""
+	if mapping.From == "" {
+		mapping.From = "/"
+	}
+	for _, component := range strings.Split(mapping.From, "/") {
+		if _, err := path.Match(component, ""); err != nil {
+			return mapping, fmt.Errorf("'%s' is not a valid pattern: %v", mapping.From, err)
+		}
+		mapping.components = append(mapping.components, component)
+	}
+
+	mapping.To, err = filepath.Abs(text[separator+1:])
+	if err != nil {
+		return mapping, err
+	}
+	return mapping, nil
+}
+
+// apply returns the new location of 'filePath' (a path in the snapshot when the mapping is relative, or a full path
+// with '/' as the separator otherwise) if it is under the directory matched by the mapping.
+func (mapping *RestoreMapping) apply(filePath string) (string, bool) {
+
+	components := strings.Split(strings.TrimSuffix(filePath, "/"), "/")
+	if len(components) < len(mapping.components) {
+		return "", false
+	}
+
+	var captured []string
+	for i, pattern := range mapping.components {
+		component := components[i]
+		if mapping.absolute && runtime.GOOS == "windows" {
+			pattern, component = strings.ToLower(pattern), strings.ToLower(component)
+		}
+		if matched, _ := path.Match(pattern, component); !matched {
+			return "", false
+		}
+		if strings.ContainsAny(pattern, "*?[") {
+			captured = append(captured, components[i])
+		}
+	}
+
+	target := mapping.To
+	for i := len(captured); i > 0; i-- {
+		target = strings.Replace(target, "$"+strconv.Itoa(i), captured[i-1], -1)
+	}
+	return joinPath(append([]string{target}, components[len(mapping.components):]...)...), true
+}
+
+// SetRestoreMappings sets the mappings used by the restore to relocate files.  When multiple mappings match a file,
+// the first one wins.
+func (manager *BackupManager) SetRestoreMappings(mappings []RestoreMapping) {
+	manager.restoreMappings = mappings
+}
+
+// getRestorePath returns the full path of the file or directory 'filePath' in the snapshot to be restored to, and
+// whether it has been relocated by a mapping.
+func (manager *BackupManager) getRestorePath(top string, filePath string) (fullPath string, mapped bool) {
+
+	fullPath = joinRootPath(top, filePath)
+	if len(manager.restoreMappings) == 0 {
+		return fullPath, false
+	}
+
+	normalPath := filepath.ToSlash(getNormalPath(fullPath))
+	for i := range manager.restoreMappings {
+		mapping := &manager.restoreMappings[i]
+		source := filePath
+		if mapping.absolute {
+			source = normalPath
+		}
+		if target, found := mapping.apply(source); found {
+			LOG_TRACE("RESTORE_MAP", "%s is restored to %s", filePath, target)
+			return target, true
+		}
+	}
+	return fullPath, false
+}
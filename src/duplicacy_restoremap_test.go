@@ -0,0 +1,60 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreMapping(t *testing.T) {
+
+	for _, text := range []string{"", "=", "a=", "=b", "a[=b"} {
+		if _, err := ParseRestoreMapping(text); err == nil {
+			t.Errorf("'%s' is accepted as a mapping", text)
+		}
+	}
+
+	top := filepath.Join(os.TempDir(), "repository")
+	target := filepath.Join(os.TempDir(), "restored")
+
+	var mappings []RestoreMapping
+	for _, text := range []string{
+		"home/*/Documents=" + target + "/$1",
+		"home/alice=" + target + "/alice",
+		filepath.Join(top, "shared") + "=" + target + "/shared",
+	} {
+		mapping, err := ParseRestoreMapping(text)
+		if err != nil {
+			t.Fatalf("Failed to parse the mapping '%s': %v", text, err)
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	manager := &BackupManager{}
+	manager.SetRestoreMappings(mappings)
+
+	testCases := []struct {
+		path     string
+		expected string
+		mapped   bool
+	}{
+		{"home/bob/Documents/a.txt", joinPath(target, "bob", "a.txt"), true},
+		{"home/alice/Documents/", joinPath(target, "alice"), true},
+		{"home/alice/b.txt", joinPath(target, "alice", "b.txt"), true},
+		{"home/bob/b.txt", joinPath(top, "home/bob/b.txt"), false},
+		{"shared/c.txt", joinPath(target, "shared", "c.txt"), true},
+		{"sharedfile", joinPath(top, "sharedfile"), false},
+	}
+
+	for _, testCase := range testCases {
+		fullPath, mapped := manager.getRestorePath(top, testCase.path)
+		if fullPath != testCase.expected || mapped != testCase.mapped {
+			t.Errorf("%s is restored to %s (mapped: %t); expected: %s", testCase.path, fullPath, mapped,
+				testCase.expected)
+		}
+	}
+}
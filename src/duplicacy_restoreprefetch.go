@@ -0,0 +1,310 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// DefaultRestorePrefetchMemory is the default size of the chunks a restore can download ahead of the files being
+// restored.
+const DefaultRestorePrefetchMemory = 256 * 1024 * 1024
+
+// maximumPrefetchedChunks limits the number of chunks being downloaded ahead, which determines the length of the
+// download queues, when the memory budget allows for many small chunks.
+const maximumPrefetchedChunks = 4096
+
+// restoreLookahead is the most files after the one being restored that are checked for being ready to be restored
+// ahead of it.
+const restoreLookahead = 1024
+
+// SetRestorePrefetchMemory sets the size of the chunks that a restore can keep in memory while downloading the chunks
+// of upcoming files ahead of the file being written.  If 'memory' is 0, only the chunks of the file being written
+// are prefetched, up to the number of threads.
+func (manager *BackupManager) SetRestorePrefetchMemory(memory int64) {
+	manager.restorePrefetchMemory = memory
+}
+
+// PlanFile marks all chunks of 'file' as needed so they can be downloaded before the file's turn comes; it is
+// called for files that don't exist yet and will therefore be restored from the downloaded chunks only.
+func (downloader *ChunkDownloader) PlanFile(file *Entry) {
+	for i := file.StartChunk; i <= file.EndChunk; i++ {
+		downloader.taskList[i].needed = true
+	}
+	downloader.planChunks(file)
+}
+
+// planChunks records that the needed chunks of 'file' are known, and starts downloading them as long as the memory
+// budget allows.
+func (downloader *ChunkDownloader) planChunks(file *Entry) {
+	for i := file.StartChunk; i <= file.EndChunk; i++ {
+		downloader.taskList[i].isPlanned = true
+	}
+	if file.StartChunk < downloader.nextPrefetch {
+		downloader.nextPrefetch = file.StartChunk
+	}
+	if file.EndChunk >= downloader.prefetchLimit {
+		downloader.prefetchLimit = file.EndChunk + 1
+	}
+	downloader.schedulePrefetch()
+}
+
+// schedulePrefetch sends the needed chunks of the planned files to the downloading goroutines in order, until the
+// memory budget is reached.  Chunks that haven't been planned are skipped, as the files using them may still find
+// them in the existing files.
+func (downloader *ChunkDownloader) schedulePrefetch() {
+
+	downloader.prefetchFull = false
+	resolved := true
+	for i := downloader.nextPrefetch; i < downloader.prefetchLimit; i++ {
+		task := &downloader.taskList[i]
+		if task.isPlanned && task.needed && !task.isDownloading && downloader.fileReferences[i] > 0 {
+			if downloader.numberOfDownloadingChunks >= cap(downloader.taskQueue) ||
+				(downloader.numberOfActiveChunks > 0 &&
+					downloader.activeChunkSize+int64(task.chunkLength) > downloader.prefetchMemory) {
+				downloader.prefetchFull = true
+				return
+			}
+			LOG_DEBUG("DOWNLOAD_PREFETCH", "Prefetching chunk %s", downloader.config.GetChunkIDFromHash(task.chunkHash))
+			downloader.startDownload(task)
+		}
+
+		if !task.isPlanned {
+			resolved = false
+		} else if resolved {
+			downloader.nextPrefetch = i + 1
+		}
+	}
+}
+
+// startDownload sends a chunk to the downloading goroutines when prefetching.
+func (downloader *ChunkDownloader) startDownload(task *ChunkDownloadTask) {
+	downloader.taskQueue <- *task
+	task.isDownloading = true
+	downloader.numberOfDownloadingChunks++
+	downloader.numberOfActiveChunks++
+	downloader.activeChunkSize += int64(task.chunkLength)
+}
+
+// completePrefetch records a downloaded chunk when prefetching.  The chunk is returned to the pool at once if all
+// files using it have been released while it was being downloaded.
+func (downloader *ChunkDownloader) completePrefetch(completion ChunkDownloadCompletion) {
+	downloader.numberOfDownloadedChunks++
+	downloader.numberOfDownloadingChunks--
+	if completion.chunk.isBroken {
+		downloader.NumberOfFailedChunks++
+	}
+
+	if downloader.fileReferences[completion.chunkIndex] == 0 {
+		downloader.releaseChunk(completion.chunkIndex, completion.chunk)
+		return
+	}
+	downloader.completedTasks[completion.chunkIndex] = true
+	downloader.taskList[completion.chunkIndex].chunk = completion.chunk
+}
+
+// releaseChunk returns a downloaded chunk to the pool when prefetching.
+func (downloader *ChunkDownloader) releaseChunk(chunkIndex int, chunk *Chunk) {
+	downloader.config.PutChunk(chunk)
+	downloader.numberOfActiveChunks--
+	downloader.activeChunkSize -= int64(downloader.taskList[chunkIndex].chunkLength)
+}
+
+// collectPrefetched records the chunks that have been downloaded so far without waiting for more.
+func (downloader *ChunkDownloader) collectPrefetched() {
+	for {
+		select {
+		case completion := <-downloader.completionChannel:
+			downloader.completePrefetch(completion)
+		default:
+			downloader.schedulePrefetch()
+			return
+		}
+	}
+}
+
+// waitForPrefetchedChunk is WaitForChunk when prefetching.  Since the chunks of the file passed to Prefetch are read
+// in order, the chunks before 'chunkIndex' are released for that file; other chunks are kept until the files using
+// them are released, as files may be restored out of order.
+func (downloader *ChunkDownloader) waitForPrefetchedChunk(chunkIndex int) *Chunk {
+
+	if file := downloader.restoringFile; file != nil && chunkIndex >= file.StartChunk && chunkIndex <= file.EndChunk {
+		for ; downloader.releasedChunks < chunkIndex; downloader.releasedChunks++ {
+			downloader.releaseReference(downloader.releasedChunks)
+		}
+	}
+
+	task := &downloader.taskList[chunkIndex]
+	downloader.schedulePrefetch()
+	if !task.isDownloading {
+		// The chunk is needed now, so it doesn't wait for the memory budget, only for room in the download queue
+		for downloader.numberOfDownloadingChunks >= cap(downloader.taskQueue) {
+			downloader.completePrefetch(downloader.receiveCompletion())
+		}
+		LOG_DEBUG("DOWNLOAD_FETCH", "Fetching chunk %s", downloader.config.GetChunkIDFromHash(task.chunkHash))
+		downloader.startDownload(task)
+		downloader.schedulePrefetch()
+	}
+
+	for !downloader.completedTasks[chunkIndex] {
+		downloader.completePrefetch(downloader.receiveCompletion())
+		downloader.schedulePrefetch()
+	}
+	return task.chunk
+}
+
+// isFileDownloaded returns true if all the needed chunks of 'file' have been downloaded.
+func (downloader *ChunkDownloader) isFileDownloaded(file *Entry) bool {
+	for i := file.StartChunk; i <= file.EndChunk; i++ {
+		if downloader.taskList[i].needed && !downloader.completedTasks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ReleaseFile is called when prefetching after 'file' has been restored or skipped.  The chunks not used by the
+// files yet to be restored are returned to the pool, making room for more chunks to be prefetched.
+func (downloader *ChunkDownloader) ReleaseFile(file *Entry) {
+
+	if downloader.prefetchMemory == 0 || file.Size == 0 {
+		return
+	}
+
+	start := file.StartChunk
+	if file == downloader.restoringFile {
+		start = downloader.releasedChunks
+		downloader.restoringFile = nil
+	}
+	for i := start; i <= file.EndChunk; i++ {
+		downloader.releaseReference(i)
+	}
+	downloader.schedulePrefetch()
+}
+
+// releaseReference drops the reference of a file to a chunk, returning the chunk to the pool if no other files
+// to be restored use it.
+func (downloader *ChunkDownloader) releaseReference(chunkIndex int) {
+	task := &downloader.taskList[chunkIndex]
+	// A skipped file may have never been planned
+	task.isPlanned = true
+	downloader.fileReferences[chunkIndex]--
+	if downloader.fileReferences[chunkIndex] > 0 {
+		return
+	}
+	if downloader.completedTasks[chunkIndex] {
+		delete(downloader.completedTasks, chunkIndex)
+		downloader.releaseChunk(chunkIndex, task.chunk)
+		task.chunk = nil
+	} else if !task.isDownloading {
+		// This chunk will never be downloaded
+		atomic.AddInt64(&downloader.totalChunkSize, -int64(task.chunkLength))
+	}
+}
+
+// restorePlanner looks ahead of the file being restored for files that don't exist yet, so that all their chunks
+// can be prefetched, and picks those whose chunks have all arrived to be restored while the file being restored is
+// still waiting for its chunks.
+type restorePlanner struct {
+	manager    *BackupManager
+	downloader *ChunkDownloader
+	top        string
+	files      []*Entry
+	queue      *restoreQueue
+	planned    int    // files before this index have been looked at
+	isPlanned  []bool // whether each file has been given to PlanFile
+	isRestored []bool // whether each file has been restored ahead of its turn
+}
+
+// createRestorePlanner returns the planner for restoring 'files' to 'top', or nil if the downloader doesn't
+// prefetch.
+func (manager *BackupManager) createRestorePlanner(top string, files []*Entry, queue *restoreQueue,
+	downloader *ChunkDownloader) *restorePlanner {
+
+	if downloader.prefetchMemory == 0 {
+		return nil
+	}
+
+	return &restorePlanner{
+		manager:    manager,
+		downloader: downloader,
+		top:        top,
+		files:      files,
+		queue:      queue,
+		isPlanned:  make([]bool, len(files)),
+		isRestored: make([]bool, len(files)),
+	}
+}
+
+// plan is called before the file at 'index' is restored.  It plans the files from the one at 'index' on until
+// chunks worth the memory budget can be prefetched.
+func (planner *restorePlanner) plan(index int) {
+	if planner == nil {
+		return
+	}
+
+	if planner.planned < index {
+		planner.planned = index
+	}
+	for planner.planned < len(planner.files) && !planner.downloader.prefetchFull {
+		file := planner.files[planner.planned]
+		if file.Size > 0 {
+			fullPath, _ := planner.manager.getRestorePath(planner.top, file.Path)
+			if stat, _ := os.Stat(fullPath); stat == nil {
+				planner.downloader.PlanFile(file)
+				planner.isPlanned[planner.planned] = true
+			}
+		}
+		planner.planned++
+	}
+}
+
+// next returns the first file from 'start' on that can be restored before the file at 'index', because all its
+// chunks have been downloaded while those of the file at 'index' haven't, or -1 if there is none.  Files are only
+// restored early within the same priority group.
+func (planner *restorePlanner) next(index int, start int) int {
+	if planner == nil || !planner.isPlanned[index] {
+		return -1
+	}
+
+	planner.downloader.collectPrefetched()
+	if planner.downloader.isFileDownloaded(planner.files[index]) {
+		return -1
+	}
+
+	end := planner.planned
+	if planner.queue != nil {
+		for _, groupEnd := range planner.queue.ends {
+			if index < groupEnd {
+				if groupEnd < end {
+					end = groupEnd
+				}
+				break
+			}
+		}
+	}
+	if end > index+1+restoreLookahead {
+		end = index + 1 + restoreLookahead
+	}
+
+	for i := start; i < end; i++ {
+		if planner.isPlanned[i] && !planner.isRestored[i] && planner.downloader.isFileDownloaded(planner.files[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// restored records that the file at 'index' has been restored ahead of its turn and releases its chunks.
+func (planner *restorePlanner) restored(index int) {
+	planner.isRestored[index] = true
+	planner.downloader.ReleaseFile(planner.files[index])
+}
+
+// isRestoredEarly returns true if the file at 'index' has already been restored ahead of its turn.
+func (planner *restorePlanner) isRestoredEarly(index int) bool {
+	return planner != nil && planner.isRestored[index]
+}
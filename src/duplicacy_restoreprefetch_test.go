@@ -0,0 +1,168 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"testing"
+)
+
+func TestRestorePrefetch(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "restoreprefetch")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	var files []string
+	for i := 0; i < 4; i++ {
+		os.MkdirAll(joinPath(repository, fmt.Sprintf("dir%d", i)), 0700)
+		for j := 0; j < 6; j++ {
+			file := fmt.Sprintf("dir%d/file%d", i, j)
+			createRandomFile(joinPath(repository, file), 60000)
+			files = append(files, file)
+		}
+		os.WriteFile(joinPath(repository, fmt.Sprintf("dir%d/empty", i)), nil, 0644)
+	}
+
+	// Throttled requests are retried later, so chunks don't arrive in order
+	removeMockStore("mocktest/prefetch")
+	storage, err := CreateMockStorage("mocktest/prefetch?latency=2ms&throttle=0.2&retry-after=30ms&seed=3", 1)
+	if err != nil {
+		t.Fatalf("Failed to create the mock storage: %v", err)
+	}
+	storage.SetRetryPolicy(CreateRetryPolicy(20, 0.001, 0, 0))
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, 2, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	// The chunks being downloaded or not yet released stay within the memory budget, exceeded only by a chunk
+	// needed at once
+	snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 1)
+	backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, true)
+	var entries []*Entry
+	maximumChunkLength := 0
+	for _, entry := range snapshot.Files {
+		if entry.IsFile() && entry.Size > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	for _, length := range snapshot.ChunkLengths {
+		if length > maximumChunkLength {
+			maximumChunkLength = length
+		}
+	}
+	sort.Sort(ByChunk(entries))
+
+	const budget = 64 * 1024
+	config := backupManager.config
+	downloader := CreatePrefetchingChunkDownloader(config, storage, false, 4, false, budget)
+	downloader.AddFiles(snapshot, entries)
+	checkBudget := func(when string) {
+		if downloader.activeChunkSize > int64(budget+maximumChunkLength) {
+			t.Errorf("%d bytes of chunks are active %s", downloader.activeChunkSize, when)
+		}
+	}
+	for _, entry := range entries {
+		downloader.PlanFile(entry)
+		checkBudget("after planning " + entry.Path)
+	}
+	for _, entry := range entries {
+		// Like RestoreFile, announce the file before waiting for its chunks
+		downloader.Prefetch(entry)
+		hasher := config.NewFileHasher()
+		for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+			chunk := downloader.WaitForChunk(i)
+			start, end := 0, chunk.GetLength()
+			if i == entry.StartChunk {
+				start = entry.StartOffset
+			}
+			if i == entry.EndChunk {
+				end = entry.EndOffset
+			}
+			hasher.Write(chunk.GetBytes()[start:end])
+			checkBudget("while restoring " + entry.Path)
+		}
+		if hash := hex.EncodeToString(hasher.Sum(nil)); hash != entry.Hash {
+			t.Errorf("File %s has a hash of %s instead of %s", entry.Path, hash, entry.Hash)
+		}
+		downloader.ReleaseFile(entry)
+	}
+	if downloader.numberOfActiveChunks != 0 || downloader.activeChunkSize != 0 || len(downloader.completedTasks) != 0 ||
+		downloader.numberOfDownloadedChunks != len(downloader.taskList) {
+		t.Errorf("%d chunks (%d bytes) are still active, %d completed and %d out of %d downloaded",
+			downloader.numberOfActiveChunks, downloader.activeChunkSize, len(downloader.completedTasks),
+			downloader.numberOfDownloadedChunks, len(downloader.taskList))
+	}
+	downloader.Stop()
+
+	// Restores with and without prefetching, including one that can only keep one chunk at a time, and one into a
+	// directory where some files already exist and can't be planned ahead
+	restores := []struct {
+		name     string
+		memory   int64
+		existing bool
+	}{
+		{"default", DefaultRestorePrefetchMemory, false},
+		{"sequential", 0, false},
+		{"onechunk", 1, false},
+		{"existing", budget, true},
+	}
+	for _, restore := range restores {
+		restored := filepath.Join(testDir, restore.name)
+		for i := 0; i < 4; i++ {
+			os.MkdirAll(joinPath(restored, fmt.Sprintf("dir%d", i)), 0700)
+		}
+		if restore.existing {
+			for i, file := range files {
+				if i%3 == 0 {
+					createRandomFile(joinPath(restored, file), 60000)
+				}
+			}
+		}
+		backupManager.SetRestorePrefetchMemory(restore.memory)
+		backupManager.SetRestorePriorities([]string{"dir2/*"}, []string{"dir0/*"})
+		if failures := backupManager.Restore(restored, 1, true, false, 4, true, false, false, false, nil,
+			false); failures != 0 {
+			t.Errorf("%d files failed to be restored with the %s restore", failures, restore.name)
+		}
+		for _, file := range files {
+			if hash1, hash2 := getFileHash(joinPath(repository, file)), getFileHash(joinPath(restored, file)); hash1 != hash2 {
+				t.Errorf("File %s has a hash of %s after the %s restore instead of %s", file, hash2, restore.name, hash1)
+			}
+		}
+		if _, err := os.Stat(joinPath(restored, "dir3/empty")); err != nil {
+			t.Errorf("The empty file wasn't restored by the %s restore: %v", restore.name, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// SetRestoreDiff sets whether a dry-run restore shows the size and hash differences of the files to be overwritten.
+func (manager *BackupManager) SetRestoreDiff(showDiff bool) {
+	manager.restoreDiff = showDiff
+}
+
+// hashLocalFile computes the hash of a local file the same way the backup does.
+func (manager *BackupManager) hashLocalFile(fullPath string) (string, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := manager.config.NewFileHasher()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// previewRestore lists the files that a restore with the same options would create, overwrite, or delete, without
+// touching the local directory.  Files are compared the way the restore does: by size and timestamp in quick mode,
+// and then by hash.  It returns the number of files that would fail to be restored.
+func (manager *BackupManager) previewRestore(top string, remoteSnapshot *Snapshot, localSnapshot *Snapshot,
+	quickMode bool, overwrite bool, deleteMode bool, patterns []string) int {
+
+	var createdFiles, overwrittenFiles, deletedFiles, unchangedFiles, conflictingFiles int
+	var createdSize, overwrittenSize int64
+
+	localFiles := make(map[string]*Entry)
+	for _, local := range localSnapshot.Files {
+		localFiles[local.Path] = local
+	}
+
+	for _, entry := range remoteSnapshot.Files {
+		delete(localFiles, entry.Path)
+
+		fullPath, _ := manager.getRestorePath(top, entry.Path)
+		stat, err := os.Lstat(fullPath)
+		if err != nil {
+			if entry.IsDir() {
+				LOG_INFO("RESTORE_CREATE", "Create directory %s", entry.Path)
+			} else if entry.IsFile() {
+				LOG_INFO("RESTORE_CREATE", "Create %s (%s)", entry.Path, PrettyNumber(entry.Size))
+				createdSize += entry.Size
+			} else {
+				LOG_INFO("RESTORE_CREATE", "Create %s", entry.Path)
+			}
+			createdFiles++
+			continue
+		}
+
+		if entry.IsLink() {
+			if stat.Mode()&os.ModeSymlink != 0 {
+				if isRegular, link, err := Readlink(fullPath); err == nil && link == entry.Link && !isRegular {
+					unchangedFiles++
+					continue
+				}
+			}
+			LOG_INFO("RESTORE_OVERWRITE", "Replace %s with a symlink to %s", entry.Path, entry.Link)
+			overwrittenFiles++
+			continue
+		} else if entry.IsSpecial() {
+			if stat.Mode()&os.ModeType == os.FileMode(entry.Mode)&os.ModeType && GetDeviceNumber(stat) == entry.Device {
+				unchangedFiles++
+				continue
+			}
+			LOG_INFO("RESTORE_OVERWRITE", "Replace %s with a special file", entry.Path)
+			overwrittenFiles++
+			continue
+		} else if entry.IsDir() {
+			if !stat.IsDir() {
+				LOG_WARN("RESTORE_NOTDIR", "The path %s is not a directory", fullPath)
+				conflictingFiles++
+			}
+			continue
+		}
+
+		if stat.IsDir() {
+			LOG_WARN("RESTORE_NOTFILE", "The path %s is a directory", fullPath)
+			conflictingFiles++
+			continue
+		}
+
+		if (quickMode || entry.Size == 0) && entry.IsSameAsFileInfo(stat) {
+			unchangedFiles++
+			continue
+		}
+
+		localHash, err := manager.hashLocalFile(fullPath)
+		if err != nil {
+			LOG_WARN("RESTORE_HASH", "Failed to read %s: %v", fullPath, err)
+		} else if localHash == entry.Hash {
+			LOG_DEBUG("RESTORE_UNCHANGED", "%s unchanged (by hash)", entry.Path)
+			unchangedFiles++
+			continue
+		}
+
+		if !overwrite {
+			switch manager.resolveConflict(entry, stat) {
+			case ConflictOverwrite:
+			case ConflictSkip:
+				LOG_INFO("RESTORE_CONFLICT", "%s", manager.describeConflict(entry))
+				unchangedFiles++
+				continue
+			case ConflictKeepBoth:
+				LOG_INFO("RESTORE_CREATE", "Create %s (%s) next to the existing %s", manager.getKeepBothPath(top, entry),
+					PrettyNumber(entry.Size), entry.Path)
+				createdFiles++
+				createdSize += entry.Size
+				continue
+			default:
+				LOG_WARN("RESTORE_CONFLICT", "%s already exists; specify the -overwrite option to overwrite it",
+					entry.Path)
+				conflictingFiles++
+				continue
+			}
+		}
+
+		if manager.restoreDiff {
+			LOG_INFO("RESTORE_OVERWRITE", "Overwrite %s: size %s -> %s (%+d), hash %s -> %s", entry.Path,
+				PrettyNumber(stat.Size()), PrettyNumber(entry.Size), entry.Size-stat.Size(), localHash, entry.Hash)
+		} else {
+			LOG_INFO("RESTORE_OVERWRITE", "Overwrite %s (%s)", entry.Path, PrettyNumber(entry.Size))
+		}
+		overwrittenFiles++
+		overwrittenSize += entry.Size
+	}
+
+	// Extra files are deleted only when the entire snapshot is restored
+	if deleteMode && len(patterns) == 0 {
+		for i := len(localSnapshot.Files) - 1; i >= 0; i-- {
+			if local, found := localFiles[localSnapshot.Files[i].Path]; found {
+				if manager.restoreDiff && local.IsFile() {
+					LOG_INFO("RESTORE_DELETE", "Delete %s (%s)", local.Path, PrettyNumber(local.Size))
+				} else {
+					LOG_INFO("RESTORE_DELETE", "Delete %s", local.Path)
+				}
+				deletedFiles++
+			}
+		}
+	}
+
+	LOG_INFO("RESTORE_PREVIEW", "%d files to create (%s bytes), %d to overwrite (%s bytes), %d to delete, %d unchanged",
+		createdFiles, PrettySize(createdSize), overwrittenFiles, PrettySize(overwrittenSize), deletedFiles,
+		unchangedFiles)
+	return conflictingFiles
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestRestorePreview(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "restorepreview")
+	os.RemoveAll(testDir)
+
+	repository := joinPath(testDir, "repository1")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 1000)
+	createRandomFile(joinPath(repository, "file2"), 1000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	os.Remove(joinPath(repository, "file1"))
+	ioutil.WriteFile(joinPath(repository, "file2"), []byte("modified"), 0644)
+
+	backupManager.SetDryRun(true)
+	backupManager.SetRestoreDiff(true)
+
+	// file2 can't be restored without -overwrite
+	if failed := backupManager.Restore(repository, 1, true, true, threads, false, false, false, false, nil, true); failed != 1 {
+		t.Errorf("%d files can't be restored", failed)
+	}
+	if failed := backupManager.Restore(repository, 1, true, true, threads, true, false, false, false, nil, true); failed != 0 {
+		t.Errorf("%d files can't be restored with -overwrite", failed)
+	}
+
+	if _, err := os.Stat(joinPath(repository, "file1")); !os.IsNotExist(err) {
+		t.Errorf("The dry-run restore created a file: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(joinPath(repository, "file2")); string(content) != "modified" {
+		t.Errorf("The dry-run restore overwrote a file")
+	}
+}
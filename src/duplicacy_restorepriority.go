@@ -0,0 +1,124 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseRestorePriority converts a priority pattern to an include pattern.  A pattern without a prefix, such as
+// 'Documents/*', is a wildcard pattern; patterns with the '+' or 'i:' prefix are also accepted, while exclude patterns
+// are not since they can't select the files in a group.
+func ParseRestorePriority(pattern string) (string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return "", fmt.Errorf("the priority pattern is empty")
+	}
+	if pattern[0] == '-' || strings.HasPrefix(pattern, "e:") {
+		return "", fmt.Errorf("'%s' is an exclude pattern and can't be used as a priority", pattern)
+	}
+	if pattern[0] != '+' && !strings.HasPrefix(pattern, "i:") {
+		pattern = "+" + pattern
+	}
+	return pattern, nil
+}
+
+// SetRestorePriorities sets the order in which files are restored: files matching the patterns in 'first' are
+// restored before the others, group by group in the given order, and files matching those in 'last' after all other
+// files.  A file belongs to the first group that it matches.
+func (manager *BackupManager) SetRestorePriorities(first []string, last []string) {
+	manager.restoreFirst = first
+	manager.restoreLast = last
+}
+
+// restoreQueue tracks the priority groups of the files being restored so that the completion of each group can be
+// reported while the remaining files are still being downloaded.
+type restoreQueue struct {
+	labels []string // the pattern of each group, or empty for the files not matching any pattern
+	ends   []int    // the index after the last file of each group
+	group  int      // the group of the file being restored
+}
+
+// prioritizeRestoreFiles reorders 'files' (already sorted by chunk) by their priority groups, keeping the order of
+// the files within each group.  It returns nil if no priorities have been set.
+func (manager *BackupManager) prioritizeRestoreFiles(files []*Entry) *restoreQueue {
+
+	if len(manager.restoreFirst) == 0 && len(manager.restoreLast) == 0 {
+		return nil
+	}
+
+	var patterns []string
+	patterns = append(patterns, manager.restoreFirst...)
+	patterns = append(patterns, "")
+	patterns = append(patterns, manager.restoreLast...)
+	rest := len(manager.restoreFirst)
+
+	groups := make([][]*Entry, len(patterns))
+	for _, file := range files {
+		rank := rest
+		for i, pattern := range patterns {
+			if pattern == "" {
+				continue
+			}
+			if included, matched := MatchPathPattern(file.Path, file, []string{pattern}); included && matched != "" {
+				rank = i
+				break
+			}
+		}
+		groups[rank] = append(groups[rank], file)
+	}
+
+	queue := &restoreQueue{group: -1}
+	files = files[:0]
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		files = append(files, group...)
+		queue.labels = append(queue.labels, patterns[i])
+		queue.ends = append(queue.ends, len(files))
+		LOG_DEBUG("RESTORE_PRIORITY", "Group %d (%s): %d files", len(queue.labels), queue.describe(len(queue.labels)-1),
+			len(group))
+	}
+	return queue
+}
+
+func (queue *restoreQueue) describe(group int) string {
+	if queue.labels[group] == "" {
+		return "files not matching any priority"
+	}
+	return "files matching " + strings.TrimPrefix(queue.labels[group], "+")
+}
+
+// next is called before the file at 'index' is restored; it reports the completion of the previous group and the
+// start of a new one.
+func (queue *restoreQueue) next(index int) {
+	if queue == nil {
+		return
+	}
+	for queue.group < 0 || (queue.group < len(queue.ends) && index >= queue.ends[queue.group]) {
+		if queue.group >= 0 {
+			LOG_INFO("RESTORE_PRIORITY", "Restored all %s", queue.describe(queue.group))
+		}
+		queue.group++
+		if queue.group < len(queue.ends) {
+			start := 0
+			if queue.group > 0 {
+				start = queue.ends[queue.group-1]
+			}
+			LOG_INFO("RESTORE_PRIORITY", "Restoring %d %s", queue.ends[queue.group]-start,
+				queue.describe(queue.group))
+		}
+	}
+}
+
+// done reports the completion of the last group.
+func (queue *restoreQueue) done() {
+	if queue == nil || len(queue.ends) == 0 {
+		return
+	}
+	queue.next(queue.ends[len(queue.ends)-1])
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRestorePriorities(t *testing.T) {
+
+	for _, text := range []string{"", "-media/*", "e:\\.mp4$"} {
+		if _, err := ParseRestorePriority(text); err == nil {
+			t.Errorf("'%s' is accepted as a priority", text)
+		}
+	}
+
+	parse := func(texts ...string) (patterns []string) {
+		for _, text := range texts {
+			pattern, err := ParseRestorePriority(text)
+			if err != nil {
+				t.Fatalf("Failed to parse the priority '%s': %v", text, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+		return patterns
+	}
+
+	manager := &BackupManager{}
+	var files []*Entry
+	for _, path := range []string{"a", "media/1.mp4", "docs/1", "b", "docs/keys/1", "media/2", "docs/2"} {
+		files = append(files, CreateEntry(path, 1, 0, 0644))
+	}
+	if queue := manager.prioritizeRestoreFiles(files); queue != nil {
+		t.Errorf("The files are prioritized without any priorities")
+	}
+
+	manager.SetRestorePriorities(parse("docs/keys/*", "docs/*"), parse("i:\\.mp4$", "media/*"))
+	queue := manager.prioritizeRestoreFiles(files)
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	expected := "docs/keys/1 docs/1 docs/2 a b media/1.mp4 media/2"
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("The files are restored in the order of %s instead of %s", strings.Join(paths, " "), expected)
+	}
+
+	expectedEnds := []int{1, 3, 5, 6, 7}
+	if len(queue.ends) != len(expectedEnds) {
+		t.Fatalf("There are %d groups instead of %d", len(queue.ends), len(expectedEnds))
+	}
+	for i, end := range expectedEnds {
+		if queue.ends[i] != end {
+			t.Errorf("Group %d ends at %d instead of %d", i, queue.ends[i], end)
+		}
+	}
+
+	for i := range files {
+		queue.next(i)
+	}
+	queue.done()
+	if queue.group != len(expectedEnds) {
+		t.Errorf("The queue stopped at group %d", queue.group)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+)
+
+// restoreProgressHeader identifies the restore that a progress file belongs to.
+type restoreProgressHeader struct {
+	SnapshotID string `json:"id"`
+	Revision   int    `json:"revision"`
+	Top        string `json:"top"`
+}
+
+// restoreProgress records the files that have been completely restored, so that a restore interrupted for whatever
+// reason can continue where it stopped without reading or rewriting these files again.  The progress file resides in
+// the preference directory; it consists of a header followed by the paths of completed files, one per line, and is
+// removed once the restore finishes without failures.
+type restoreProgress struct {
+	path      string
+	file      *os.File
+	completed map[string]bool
+	lastSync  time.Time
+}
+
+// How often the progress file is flushed to the disk
+const restoreProgressSyncInterval = 10 * time.Second
+
+// loadRestoreProgress loads the progress file left by a previous restore of the same revision to the same directory,
+// or starts a new one.  It returns nil if the progress can't be tracked, in which case the restore simply proceeds
+// without it.
+func loadRestoreProgress(snapshotID string, revision int, top string) *restoreProgress {
+
+	progress := &restoreProgress{
+		path:      path.Join(GetDuplicacyPreferencePath(), "restore_progress"),
+		completed: make(map[string]bool),
+		lastSync:  time.Now(),
+	}
+	header := restoreProgressHeader{SnapshotID: snapshotID, Revision: revision, Top: top}
+
+	if file, err := os.Open(progress.path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		var previous restoreProgressHeader
+		if scanner.Scan() && json.Unmarshal(scanner.Bytes(), &previous) == nil && previous == header {
+			for scanner.Scan() {
+				var filePath string
+				// The last line may be incomplete if the restore was killed while writing it
+				if json.Unmarshal(scanner.Bytes(), &filePath) == nil {
+					progress.completed[filePath] = true
+				}
+			}
+		}
+		file.Close()
+	}
+
+	var err error
+	if len(progress.completed) > 0 {
+		LOG_INFO("RESTORE_RESUME", "Resuming the previous restore with %d files already restored",
+			len(progress.completed))
+		progress.file, err = os.OpenFile(progress.path, os.O_WRONLY|os.O_APPEND, 0600)
+	} else {
+		progress.file, err = os.OpenFile(progress.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err == nil {
+			description, _ := json.Marshal(header)
+			_, err = progress.file.Write(append(description, '\n'))
+		}
+	}
+	if err != nil {
+		LOG_WARN("RESTORE_PROGRESS", "Failed to open the restore progress file %s: %v", progress.path, err)
+		if progress.file != nil {
+			progress.file.Close()
+		}
+		return nil
+	}
+	return progress
+}
+
+// isCompleted returns true if the file was restored by the previous restore and hasn't been changed since then.
+func (progress *restoreProgress) isCompleted(entry *Entry, fileInfo os.FileInfo) bool {
+	if progress == nil || fileInfo == nil {
+		return false
+	}
+	return progress.completed[entry.Path] && entry.IsSameAsFileInfo(fileInfo)
+}
+
+// fileCompleted records that a file has been restored, including its metadata.
+func (progress *restoreProgress) fileCompleted(filePath string) {
+	if progress == nil || progress.file == nil {
+		return
+	}
+
+	description, _ := json.Marshal(filePath)
+	if _, err := progress.file.Write(append(description, '\n')); err != nil {
+		LOG_WARN("RESTORE_PROGRESS", "Failed to update the restore progress file: %v", err)
+		progress.file.Close()
+		progress.file = nil
+		return
+	}
+
+	if time.Since(progress.lastSync) >= restoreProgressSyncInterval {
+		progress.file.Sync()
+		progress.lastSync = time.Now()
+	}
+}
+
+// finish closes the progress file, and removes it if the restore has completed.
+func (progress *restoreProgress) finish(completed bool) {
+	if progress == nil {
+		return
+	}
+	if progress.file != nil {
+		progress.file.Close()
+		progress.file = nil
+	}
+	if completed {
+		os.Remove(progress.path)
+	}
+}
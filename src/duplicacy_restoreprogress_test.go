@@ -0,0 +1,66 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreProgress(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "restoreprogress")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	SetDuplicacyPreferencePath(testDir)
+
+	modifiedTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var entries []*Entry
+	for _, name := range []string{"file1", "file2"} {
+		fullPath := filepath.Join(testDir, name)
+		ioutil.WriteFile(fullPath, []byte(name), 0644)
+		os.Chtimes(fullPath, modifiedTime, modifiedTime)
+		entries = append(entries, CreateEntry(name, int64(len(name)), modifiedTime.Unix(), 0644))
+	}
+
+	progress := loadRestoreProgress("host1", 1, testDir)
+	if progress == nil {
+		t.Fatalf("Failed to create the restore progress")
+	}
+	progress.fileCompleted("file1")
+	progress.finish(false)
+
+	progress = loadRestoreProgress("host1", 1, testDir)
+	for i, expected := range []bool{true, false} {
+		stat, _ := os.Stat(filepath.Join(testDir, entries[i].Path))
+		if progress.isCompleted(entries[i], stat) != expected {
+			t.Errorf("%s completed: %t", entries[i].Path, !expected)
+		}
+	}
+
+	// The file has been changed after it was restored
+	entries[0].Time += 60
+	stat, _ := os.Stat(filepath.Join(testDir, "file1"))
+	if progress.isCompleted(entries[0], stat) {
+		t.Errorf("A changed file is considered completed")
+	}
+	progress.finish(false)
+
+	// The progress of another revision doesn't apply
+	progress = loadRestoreProgress("host1", 2, testDir)
+	if len(progress.completed) != 0 {
+		t.Errorf("%d files completed for a different revision", len(progress.completed))
+	}
+	progress.finish(true)
+
+	if _, err := os.Stat(progress.path); !os.IsNotExist(err) {
+		t.Errorf("The progress file still exists: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const restoreReportSignaturePrefix = "signature: "
+
+// SetRestoreVerification makes the restore re-hash every restored file after all files have been written and compare
+// the hashes with those recorded in the snapshot.  The results are written to 'reportPath', or to a report under the
+// logs directory if it is empty.
+func (manager *BackupManager) SetRestoreVerification(enabled bool, reportPath string) {
+	manager.restoreVerify = enabled
+	manager.verifyReport = reportPath
+}
+
+// signRestoreReport computes the signature of a report using the hash key of the storage, so the report can only be
+// produced or validated by someone with access to the storage.
+func (manager *BackupManager) signRestoreReport(content []byte) string {
+	hasher := manager.config.NewKeyedHasher(manager.config.HashKey)
+	hasher.Write(content)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// verifyRestoredFiles hashes the restored files and writes the signed report.  It returns the number of files that
+// don't match the snapshot.
+func (manager *BackupManager) verifyRestoredFiles(top string, revision int, files []*Entry) int {
+
+	if SkipFileHash {
+		LOG_WARN("RESTORE_VERIFY", "File hashes are not verified because DUPLICACY_SKIP_FILE_HASH is set")
+		return 0
+	}
+
+	LOG_INFO("RESTORE_VERIFY", "Verifying the restored files")
+
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "Restore verification report\n")
+	fmt.Fprintf(&report, "snapshot: %s\n", manager.snapshotID)
+	fmt.Fprintf(&report, "revision: %d\n", revision)
+	fmt.Fprintf(&report, "directory: %s\n", top)
+	fmt.Fprintf(&report, "time: %s\n", time.Now().Format(time.RFC3339))
+
+	verifiedFiles, failedFiles, uncheckedFiles := 0, 0, 0
+	for _, file := range files {
+		if !file.IsFile() {
+			continue
+		}
+
+		fullPath, _ := manager.getRestorePath(top, file.Path)
+		status := "ok"
+		if file.Hash == "" || strings.HasPrefix(file.Hash, "#") {
+			// There is no hash of the file content to compare with
+			status = "unchecked"
+			uncheckedFiles++
+		} else if hash, err := manager.hashLocalFile(fullPath); err != nil {
+			LOG_WARN("RESTORE_VERIFY", "Failed to read %s: %v", file.Path, err)
+			status = "unreadable"
+			failedFiles++
+		} else if hash != file.Hash {
+			LOG_WARN("RESTORE_VERIFY", "%s has a hash of %s instead of %s", file.Path, hash, file.Hash)
+			status = "mismatch"
+			failedFiles++
+		} else {
+			verifiedFiles++
+		}
+		fmt.Fprintf(&report, "%s\t%d\t%s\t%s\n", status, file.Size, file.Hash, file.Path)
+	}
+	fmt.Fprintf(&report, "summary: %d verified, %d failed, %d unchecked\n", verifiedFiles, failedFiles,
+		uncheckedFiles)
+	fmt.Fprintf(&report, "%s%s\n", restoreReportSignaturePrefix, manager.signRestoreReport(report.Bytes()))
+
+	reportPath := manager.verifyReport
+	if reportPath == "" {
+		logDir := path.Join(GetDuplicacyPreferencePath(), "logs")
+		os.MkdirAll(logDir, 0700)
+		reportPath = path.Join(logDir, fmt.Sprintf("restore-verify-%s-%d-%s", manager.snapshotID, revision,
+			time.Now().Format("20060102-150405")))
+	}
+	if bytes.Equal(manager.config.HashKey, DEFAULT_KEY) {
+		LOG_WARN("RESTORE_VERIFY", "The storage is not encrypted so the report can be signed by anyone")
+	}
+	if err := ioutil.WriteFile(reportPath, report.Bytes(), 0644); err != nil {
+		LOG_WARN("RESTORE_VERIFY", "Failed to write the verification report %s: %v", reportPath, err)
+	} else {
+		LOG_INFO("RESTORE_VERIFY", "The verification report has been saved to %s", reportPath)
+	}
+
+	if failedFiles > 0 {
+		LOG_WARN("RESTORE_VERIFY", "%d restored files don't match the snapshot", failedFiles)
+	} else {
+		LOG_INFO("RESTORE_VERIFY", "All %d restored files match the snapshot", verifiedFiles)
+	}
+	return failedFiles
+}
+
+// CheckRestoreReport validates the signature of a verification report written by a restore from the same storage.
+func (manager *BackupManager) CheckRestoreReport(reportPath string) bool {
+
+	content, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		LOG_ERROR("RESTORE_REPORT", "Failed to read the report %s: %v", reportPath, err)
+		return false
+	}
+
+	index := bytes.LastIndex(content, []byte("\n"+restoreReportSignaturePrefix))
+	if index < 0 {
+		LOG_ERROR("RESTORE_REPORT", "The report %s is not signed", reportPath)
+		return false
+	}
+	body := content[:index+1]
+	signature := strings.TrimSpace(string(content[index+1+len(restoreReportSignaturePrefix):]))
+
+	if signature != manager.signRestoreReport(body) {
+		LOG_ERROR("RESTORE_REPORT", "The report %s has been modified or was not created with this storage",
+			reportPath)
+		return false
+	}
+	LOG_INFO("RESTORE_REPORT", "The report %s has a valid signature", reportPath)
+	return true
+}
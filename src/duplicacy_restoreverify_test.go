@@ -0,0 +1,87 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestRestoreVerification(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "restoreverify")
+	os.RemoveAll(testDir)
+
+	repository := joinPath(testDir, "repository1")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+	createRandomFile(joinPath(repository, "file2"), 1000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(repository, true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	os.Remove(joinPath(repository, "file1"))
+	reportPath := joinPath(testDir, "report")
+	backupManager.SetRestoreVerification(true, reportPath)
+	if failed := backupManager.Restore(repository, 1, true, true, threads, false, false, false, false, nil, false); failed != 0 {
+		t.Errorf("%d files failed to be restored", failed)
+	}
+	if !backupManager.CheckRestoreReport(reportPath) {
+		t.Errorf("The report has an invalid signature")
+	}
+
+	report, _ := ioutil.ReadFile(reportPath)
+	index := bytes.LastIndex(report, []byte("\n"+restoreReportSignaturePrefix))
+	if index < 0 || !bytes.Contains(report, []byte("summary: 2 verified, 0 failed")) {
+		t.Fatalf("Unexpected report:\n%s", report)
+	}
+	modified := bytes.Replace(report[:index+1], []byte("ok\t"), []byte("ok \t"), 1)
+	if string(report[index+1+len(restoreReportSignaturePrefix):len(report)-1]) == backupManager.signRestoreReport(modified) {
+		t.Errorf("The modified report has a valid signature")
+	}
+
+	// A file changed after being restored doesn't match the snapshot
+	remoteSnapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 1)
+	backupManager.SnapshotManager.DownloadSnapshotContents(remoteSnapshot, nil, false)
+	ioutil.WriteFile(joinPath(repository, "file2"), []byte("modified"), 0644)
+	if failed := backupManager.verifyRestoredFiles(repository, 1, remoteSnapshot.Files); failed != 1 {
+		t.Errorf("%d files don't match the snapshot", failed)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// retentionPeriodRegex matches a number of days, or of weeks, months (30 days), or years (365 days) with a unit.
+var retentionPeriodRegex = regexp.MustCompile(`^([0-9]+)([dwmy]?)$`)
+
+// parseRetentionPeriod converts a period such as '7', '7d', '4w', '12m', or '1y' into days.
+func parseRetentionPeriod(period string) (int, error) {
+	matched := retentionPeriodRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(period)))
+	if matched == nil {
+		return 0, fmt.Errorf("invalid period '%s'", period)
+	}
+	days, _ := strconv.Atoi(matched[1])
+	switch matched[2] {
+	case "w":
+		days *= 7
+	case "m":
+		days *= 30
+	case "y":
+		days *= 365
+	}
+	return days, nil
+}
+
+// ExpandRetentions converts the -keep options of prune into the 'n:m' rules PruneSnapshots takes, where 'n' is the
+// interval and 'm' the age in days.  Each option may be a single rule or a list of rules separated by commas, such
+// as "1d:7,7d:4w,30d:12m", and the interval and the age may have a unit: d for days (the default), w for weeks,
+// m for months of 30 days, or y for years of 365 days.  The rules are returned sorted by age from the oldest, the
+// order in which PruneSnapshots needs them.
+func ExpandRetentions(options []string) (retentions []string, err error) {
+
+	type rule struct {
+		interval int
+		age      int
+	}
+	var rules []rule
+	ages := make(map[int]string)
+
+	for _, option := range options {
+		for _, text := range strings.Split(option, ",") {
+			text = strings.TrimSpace(text)
+			if text == "" {
+				continue
+			}
+			parts := strings.Split(text, ":")
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid retention rule '%s'; must be <interval>:<age>", text)
+			}
+			interval, err := parseRetentionPeriod(parts[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention rule '%s': %v", text, err)
+			}
+			age, err := parseRetentionPeriod(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention rule '%s': %v", text, err)
+			}
+			if age < 1 {
+				return nil, fmt.Errorf("invalid retention rule '%s': the age must be at least 1 day", text)
+			}
+			if other, found := ages[age]; found {
+				return nil, fmt.Errorf("the retention rules '%s' and '%s' have the same age", other, text)
+			}
+			ages[age] = text
+			rules = append(rules, rule{interval: interval, age: age})
+		}
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].age > rules[j].age })
+	for _, rule := range rules {
+		retentions = append(retentions, fmt.Sprintf("%d:%d", rule.interval, rule.age))
+	}
+	return retentions, nil
+}
+
+// SetExplainRetention makes prune log, for every revision it considers, which retention rule applies to the
+// revision and whether the rule keeps or deletes it.
+func (manager *SnapshotManager) SetExplainRetention(explain bool) {
+	manager.explainRetention = explain
+}
+
+// explainRetentionDecision logs the reason for keeping or deleting a revision if SetExplainRetention is on.
+func (manager *SnapshotManager) explainRetentionDecision(snapshot *Snapshot, age int, format string,
+	args ...interface{}) {
+	if !manager.explainRetention {
+		return
+	}
+	action := "kept"
+	if snapshot.Flag {
+		action = "deleted"
+	}
+	LOG_INFO("RETENTION_EXPLAIN", "Snapshot %s revision %d (%d days old) %s: %s", snapshot.ID, snapshot.Revision, age,
+		action, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandRetentions(t *testing.T) {
+
+	testCases := map[string]string{
+		"1d:7,7d:4w,30d:12m": "30:360,7:28,1:7",
+		"0:1y, 7:30":         "0:365,7:30",
+		"1:1":                "1:1",
+	}
+	for expression, expected := range testCases {
+		retentions, err := ExpandRetentions([]string{expression})
+		if err != nil || strings.Join(retentions, ",") != expected {
+			t.Errorf("%s was expanded to %v instead of %s: %v", expression, retentions, expected, err)
+		}
+	}
+
+	// Separate options are merged and sorted together
+	retentions, err := ExpandRetentions([]string{"1:7", "0:1y", "7d:1m"})
+	if err != nil || strings.Join(retentions, ",") != "0:365,7:30,1:7" {
+		t.Errorf("The options were expanded to %v: %v", retentions, err)
+	}
+
+	for _, expression := range []string{"1d", "1x:7", "1:0", "1:7,2:1w", "1:7:9"} {
+		if _, err := ExpandRetentions([]string{expression}); err == nil {
+			t.Errorf("%s was accepted", expression)
+		}
+	}
+}
+
+func TestPruneWithRetentionExpression(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	// One revision a day for the last 20 days
+	chunkSize := 1024
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	for i := 0; i < 20; i++ {
+		startTime := now - int64(20-i)*day + 3600
+		createTestSnapshot(snapshotManager, "vm1@host1", i+1, startTime, startTime+60,
+			[]string{uploadRandomChunk(snapshotManager, chunkSize)}, "")
+	}
+	checkTestSnapshots(snapshotManager, 20, 0)
+
+	retentions, err := ExpandRetentions([]string{"0:2w,2d:1w"})
+	if err != nil {
+		t.Fatalf("Failed to expand the retention rules: %v", err)
+	}
+
+	t.Logf("Explaining the retention rules doesn't delete anything")
+	snapshotManager.SetExplainRetention(true)
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, retentions, false, true,
+		[]string{}, true, false, false, 1)
+	snapshotManager.SetExplainRetention(false)
+	checkTestSnapshots(snapshotManager, 20, 0)
+
+	// Revisions 1-7 are at least 2 weeks old, 8-14 at least a week old, and one in every 2 days of those is kept
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, retentions, false, true,
+		[]string{}, false, false, false, 1)
+	revisions, _ := snapshotManager.ListSnapshotRevisions("vm1@host1")
+	if fmt.Sprintf("%v", revisions) != "[8 10 12 14 15 16 17 18 19 20]" {
+		t.Errorf("Revisions %v are left after pruning", revisions)
+	}
+}
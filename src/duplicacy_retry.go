@@ -0,0 +1,292 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The classes of storage operations, each of which can have its own retry budget.
+const (
+	RetryClassList     = "list"
+	RetryClassDownload = "download"
+	RetryClassUpload   = "upload"
+	RetryClassDelete   = "delete"
+	RetryClassOther    = "other"
+)
+
+var RetryClasses = []string{RetryClassList, RetryClassDownload, RetryClassUpload, RetryClassDelete, RetryClassOther}
+
+// RetryPolicy decides how the B2, S3, SFTP and WebDAV storages retry failed requests.  The delay before the n-th
+// retry is BaseDelay * 2^(n-1) seconds, capped at MaximumDelay, with the fraction given by Jitter randomized.  A
+// budget limits the number of retries of a class of operations for the whole run, so that a storage failing most
+// requests doesn't slow down the run by retrying each of them.  Zero fields in the policy of a preference keep the
+// defaults of the storage.
+type RetryPolicy struct {
+	MaximumAttempts int            `json:"max_attempts,omitempty"` // attempts of each request, including the first
+	BaseDelay       float64        `json:"base_delay,omitempty"`   // in seconds
+	MaximumDelay    float64        `json:"max_delay,omitempty"`    // in seconds; no cap if 0
+	Jitter          float64        `json:"jitter,omitempty"`       // from 0 to 1
+	Budgets         map[string]int `json:"budgets,omitempty"`      // retries allowed for each operation class
+
+	lock    sync.Mutex
+	retries map[string]int // retries made so far for each operation class
+}
+
+// CreateRetryPolicy creates a policy without retry budgets.
+func CreateRetryPolicy(maximumAttempts int, baseDelay float64, maximumDelay float64, jitter float64) *RetryPolicy {
+	return &RetryPolicy{
+		MaximumAttempts: maximumAttempts,
+		BaseDelay:       baseDelay,
+		MaximumDelay:    maximumDelay,
+		Jitter:          jitter,
+	}
+}
+
+// ParseRetryPolicy parses a policy given as comma separated settings, such as
+// 'attempts=8,delay=1,max-delay=60,jitter=0.5,budget.upload=100'.  The budget of each class in RetryClasses is set
+// by budget.<class>.
+func ParseRetryPolicy(settings string) (*RetryPolicy, error) {
+
+	policy := &RetryPolicy{}
+	for _, setting := range strings.Split(settings, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		equal := strings.Index(setting, "=")
+		if equal <= 0 {
+			return nil, fmt.Errorf("the setting '%s' isn't in the form of <name>=<value>", setting)
+		}
+		name, value := setting[:equal], setting[equal+1:]
+
+		var err error
+		switch {
+		case name == "attempts":
+			policy.MaximumAttempts, err = strconv.Atoi(value)
+			if err == nil && policy.MaximumAttempts < 1 {
+				err = fmt.Errorf("there must be at least one attempt")
+			}
+		case name == "delay":
+			policy.BaseDelay, err = parseRetryDelay(value)
+		case name == "max-delay":
+			policy.MaximumDelay, err = parseRetryDelay(value)
+		case name == "jitter":
+			policy.Jitter, err = strconv.ParseFloat(value, 64)
+			if err == nil && (policy.Jitter < 0 || policy.Jitter > 1) {
+				err = fmt.Errorf("the jitter must be between 0 and 1")
+			}
+		case strings.HasPrefix(name, "budget."):
+			class := name[len("budget."):]
+			if !isRetryClass(class) {
+				return nil, fmt.Errorf("unknown operation class '%s'; must be one of %s", class,
+					strings.Join(RetryClasses, ", "))
+			}
+			budget, err := strconv.Atoi(value)
+			if err != nil || budget < 0 {
+				return nil, fmt.Errorf("invalid budget '%s' for %s", value, class)
+			}
+			if policy.Budgets == nil {
+				policy.Budgets = make(map[string]int)
+			}
+			policy.Budgets[class] = budget
+		default:
+			return nil, fmt.Errorf("unknown setting '%s'", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value '%s' for %s: %v", value, name, err)
+		}
+	}
+	return policy, nil
+}
+
+// parseRetryDelay parses a delay in seconds, or a duration such as 500ms.
+func parseRetryDelay(value string) (float64, error) {
+	if delay, err := strconv.ParseFloat(value, 64); err == nil {
+		if delay < 0 {
+			return 0, fmt.Errorf("the delay can't be negative")
+		}
+		return delay, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("the delay can't be negative")
+	}
+	return duration.Seconds(), nil
+}
+
+func isRetryClass(class string) bool {
+	for _, retryClass := range RetryClasses {
+		if class == retryClass {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the policy in the format accepted by ParseRetryPolicy.
+func (policy *RetryPolicy) String() string {
+	var settings []string
+	if policy.MaximumAttempts > 0 {
+		settings = append(settings, fmt.Sprintf("attempts=%d", policy.MaximumAttempts))
+	}
+	if policy.BaseDelay > 0 {
+		settings = append(settings, fmt.Sprintf("delay=%g", policy.BaseDelay))
+	}
+	if policy.MaximumDelay > 0 {
+		settings = append(settings, fmt.Sprintf("max-delay=%g", policy.MaximumDelay))
+	}
+	if policy.Jitter > 0 {
+		settings = append(settings, fmt.Sprintf("jitter=%g", policy.Jitter))
+	}
+	var budgets []string
+	for class, budget := range policy.Budgets {
+		budgets = append(budgets, fmt.Sprintf("budget.%s=%d", class, budget))
+	}
+	sort.Strings(budgets)
+	return strings.Join(append(settings, budgets...), ",")
+}
+
+// override returns a new policy with the non-zero settings of 'preference' replacing those of this policy.  The
+// retries made so far are not carried over.
+func (policy *RetryPolicy) override(preference *RetryPolicy) *RetryPolicy {
+	result := CreateRetryPolicy(policy.MaximumAttempts, policy.BaseDelay, policy.MaximumDelay, policy.Jitter)
+	result.Budgets = policy.Budgets
+	if preference == nil {
+		return result
+	}
+
+	if preference.MaximumAttempts > 0 {
+		result.MaximumAttempts = preference.MaximumAttempts
+	}
+	if preference.BaseDelay > 0 {
+		result.BaseDelay = preference.BaseDelay
+	}
+	if preference.MaximumDelay > 0 {
+		result.MaximumDelay = preference.MaximumDelay
+	}
+	if preference.Jitter > 0 && preference.Jitter <= 1 {
+		result.Jitter = preference.Jitter
+	}
+	if len(preference.Budgets) > 0 {
+		result.Budgets = preference.Budgets
+	}
+	return result
+}
+
+// getDelay returns the delay before the retry following the given number of failed attempts.
+func (policy *RetryPolicy) getDelay(attempts int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < attempts && (policy.MaximumDelay <= 0 || delay < policy.MaximumDelay); i++ {
+		delay *= 2
+	}
+	if policy.MaximumDelay > 0 && delay > policy.MaximumDelay {
+		delay = policy.MaximumDelay
+	}
+	delay *= 1 - policy.Jitter*rand.Float64()
+	return time.Duration(delay * float64(time.Second))
+}
+
+// takeRetry uses one retry from the budget of 'class' and returns false if there is none left.
+func (policy *RetryPolicy) takeRetry(class string) bool {
+	policy.lock.Lock()
+	defer policy.lock.Unlock()
+
+	budget, found := policy.Budgets[class]
+	if found && policy.retries[class] >= budget {
+		return false
+	}
+	if policy.retries == nil {
+		policy.retries = make(map[string]int)
+	}
+	policy.retries[class]++
+	return true
+}
+
+// retryState follows the attempts of one request under a policy.
+type retryState struct {
+	ctx       context.Context // the backoff delay ends early when it is done
+	policy    *RetryPolicy
+	logID     string // such as B2_RETRY
+	class     string
+	operation string // the request shown in the log messages
+	attempts  int    // failed attempts so far
+}
+
+// startRequest returns the state of a request of 'class' made with 'ctx', to be repeated while its retry method
+// returns true.  'backend' is the prefix of the log ID.
+func (policy *RetryPolicy) startRequest(ctx context.Context, backend string, class string,
+	operation string) *retryState {
+	return &retryState{
+		ctx:       ctx,
+		policy:    policy,
+		logID:     backend + "_RETRY",
+		class:     class,
+		operation: operation,
+	}
+}
+
+// retry is called after a failed attempt.  It waits for the backoff delay and returns true if the request should be
+// tried again, or returns false if the request should fail with 'err'.  A positive 'retryAfter', usually from the
+// Retry-After header, replaces the backoff delay.
+func (state *retryState) retry(err error, retryAfter time.Duration) bool {
+	if !state.allowRetry(err) {
+		return false
+	}
+
+	timer := time.NewTimer(state.nextDelay(err, retryAfter))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-state.ctx.Done():
+		return false
+	}
+}
+
+// allowRetry counts a failed attempt and returns true if the attempts and the budget allow another one.
+func (state *retryState) allowRetry(err error) bool {
+	state.attempts++
+	policy := state.policy
+
+	reason := ""
+	if state.attempts >= policy.MaximumAttempts {
+		reason = "attempts"
+	} else if !policy.takeRetry(state.class) {
+		reason = "budget"
+	} else {
+		return true
+	}
+	LOG_INFO(state.logID, "Giving up %s: class=%s attempt=%d/%d reason=%s error=%v", state.operation, state.class,
+		state.attempts, policy.MaximumAttempts, reason, err)
+	return false
+}
+
+// nextDelay returns the delay before the next attempt, or 'retryAfter' if it is positive, and logs the retry.
+func (state *retryState) nextDelay(err error, retryAfter time.Duration) time.Duration {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = state.policy.getDelay(state.attempts)
+	}
+	LOG_INFO(state.logID, "Retrying %s: class=%s attempt=%d/%d delay=%s error=%v", state.operation, state.class,
+		state.attempts, state.policy.MaximumAttempts, delay.Round(time.Millisecond), err)
+	return delay
+}
+
+// RetryPolicyStorage is implemented by the storages whose retries follow a RetryPolicy.
+type RetryPolicyStorage interface {
+	// SetRetryPolicy replaces the settings of the default policy of the storage with the non-zero ones of 'policy'.
+	SetRetryPolicy(policy *RetryPolicy)
+}
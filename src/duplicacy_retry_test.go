@@ -0,0 +1,132 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestRetryPolicy(t *testing.T) {
+
+	setTestingT(t)
+
+	settings := "attempts=5,delay=0.5,max-delay=2,jitter=0.5,budget.list=0,budget.upload=3"
+	policy, err := ParseRetryPolicy(settings)
+	if err != nil {
+		t.Fatalf("Failed to parse the retry policy: %v", err)
+	}
+	if policy.String() != settings {
+		t.Errorf("The policy %s was parsed as %s", settings, policy)
+	}
+
+	for _, invalid := range []string{"attempts=0", "delay=-1", "jitter=2", "budget.move=1", "budget.list=-1", "tries=3",
+		"attempts"} {
+		if _, err := ParseRetryPolicy(invalid); err == nil {
+			t.Errorf("The invalid policy %s was parsed", invalid)
+		}
+	}
+
+	// Zero settings keep the defaults
+	defaults := CreateRetryPolicy(8, 1, 0, 0)
+	preference, _ := ParseRetryPolicy("delay=250ms,budget.download=1")
+	policy = defaults.override(preference)
+	if policy.MaximumAttempts != 8 || policy.BaseDelay != 0.25 || policy.MaximumDelay != 0 || policy.Budgets["download"] != 1 {
+		t.Errorf("The overridden policy is %s", policy)
+	}
+
+	policy = CreateRetryPolicy(10, 1, 4, 0.5)
+	for attempts, maximum := range []float64{1, 1, 2, 4, 4, 4} {
+		if attempts == 0 {
+			continue
+		}
+		for i := 0; i < 100; i++ {
+			delay := policy.getDelay(attempts).Seconds()
+			if delay < maximum/2 || delay > maximum {
+				t.Errorf("The delay after %d attempts is %f seconds", attempts, delay)
+				break
+			}
+		}
+	}
+
+	// The budget is shared by all requests of a class
+	policy, _ = ParseRetryPolicy("attempts=3,delay=1ms,budget.upload=3")
+	failures := 0
+	for i := 0; i < 3; i++ {
+		state := policy.startRequest(context.Background(), "TEST", RetryClassUpload, fmt.Sprintf("upload of chunk%d", i))
+		for state.retry(fmt.Errorf("failed"), 0) {
+			failures++
+		}
+	}
+	if failures != 3 {
+		t.Errorf("%d retries were made with a budget of 3", failures)
+	}
+	state := policy.startRequest(context.Background(), "TEST", RetryClassDownload, "download of chunk")
+	if !state.retry(fmt.Errorf("failed"), 0) || !state.retry(fmt.Errorf("failed"), 0) || state.retry(fmt.Errorf("failed"), 0) {
+		t.Errorf("The download wasn't retried twice")
+	}
+}
+
+func TestWebDAVRetry(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "webdav_retry")
+	os.RemoveAll(testDir)
+	os.MkdirAll(filepath.Join(testDir, "storage"), 0700)
+
+	// The server fails the given number of requests with a 503
+	var failures int32
+	handler := &webdav.Handler{FileSystem: webdav.Dir(testDir), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverURL.Port())
+	storage, err := CreateWebDAVStorage(serverURL.Hostname(), port, "user", "", "storage", true, 1)
+	if err != nil {
+		t.Fatalf("Failed to create the WebDAV storage: %v", err)
+	}
+	policy, _ := ParseRetryPolicy("attempts=3,delay=1ms,budget.upload=2")
+	storage.SetRetryPolicy(policy)
+
+	atomic.StoreInt32(&failures, 2)
+	if err = storage.UploadFile(0, "chunks/file1", []byte("content")); err != nil {
+		t.Errorf("The upload wasn't retried: %v", err)
+	}
+
+	// No more retries are left in the budget
+	atomic.StoreInt32(&failures, 1)
+	start := time.Now()
+	if err = storage.UploadFile(0, "chunks/file2", []byte("content")); err == nil {
+		t.Errorf("The upload was retried beyond the budget")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("The failed upload took %s", time.Since(start))
+	}
+
+	atomic.StoreInt32(&failures, 2)
+	if exist, _, size, err := storage.GetFileInfo(0, "chunks/file1"); err != nil || !exist || size != 7 {
+		t.Errorf("Failed to look up the uploaded file: %t %d %v", exist, size, err)
+	}
+}
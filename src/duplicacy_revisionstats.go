@@ -0,0 +1,97 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+)
+
+// revisionStatistics describes how much data a revision references and how much of it first appeared in that
+// revision.  Chunk sizes are the lengths recorded in the snapshot, which are the sizes before compression and
+// encryption.
+type revisionStatistics struct {
+	chunks    int   // distinct file chunks referenced by the revision
+	chunkSize int64 // total length of these chunks
+	newChunks int   // chunks not referenced by any earlier revision of the same snapshot id
+	newSize   int64 // total length of the new chunks
+}
+
+// dedupRatio is the logical size of the revision divided by the bytes it added to the storage.
+func (stats *revisionStatistics) dedupRatio(fileSize int64) string {
+	if stats.newSize == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1fx", float64(fileSize)/float64(stats.newSize))
+}
+
+// computeRevisionStatistics walks the revisions of the snapshot id in ascending order, up to the highest revision
+// in 'revisionsToShow' (or all revisions if it is empty), and returns the statistics of each.  Only the snapshot
+// files and the chunk hash and length sequences are needed, and those are normally found in the snapshot cache.
+func (manager *SnapshotManager) computeRevisionStatistics(snapshotID string,
+	revisionsToShow []int) (map[int]*revisionStatistics, error) {
+
+	revisions, err := manager.ListSnapshotRevisions(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+
+	lastRevision := 0
+	for _, revision := range revisionsToShow {
+		if revision > lastRevision {
+			lastRevision = revision
+		}
+	}
+
+	statistics := make(map[int]*revisionStatistics)
+	seenChunks := make(map[string]bool)
+	for _, revision := range revisions {
+		if len(revisionsToShow) > 0 && revision > lastRevision {
+			break
+		}
+
+		snapshot := manager.DownloadSnapshot(snapshotID, revision)
+		if snapshot.IsMetadataOnly() {
+			// A metadata-only revision references no file chunks
+			statistics[revision] = &revisionStatistics{}
+			continue
+		}
+		if !manager.DownloadSnapshotSequence(snapshot, "chunks") || !manager.DownloadSnapshotSequence(snapshot, "lengths") {
+			return nil, fmt.Errorf("failed to load the chunks of revision %d", revision)
+		}
+		if len(snapshot.ChunkHashes) != len(snapshot.ChunkLengths) {
+			return nil, fmt.Errorf("revision %d has %d chunks but %d chunk lengths", revision,
+				len(snapshot.ChunkHashes), len(snapshot.ChunkLengths))
+		}
+
+		stats := &revisionStatistics{}
+		revisionChunks := make(map[string]bool)
+		for i, chunkHash := range snapshot.ChunkHashes {
+			if revisionChunks[chunkHash] {
+				continue
+			}
+			revisionChunks[chunkHash] = true
+			stats.chunks++
+			stats.chunkSize += int64(snapshot.ChunkLengths[i])
+			if !seenChunks[chunkHash] {
+				seenChunks[chunkHash] = true
+				stats.newChunks++
+				stats.newSize += int64(snapshot.ChunkLengths[i])
+			}
+		}
+		statistics[revision] = stats
+		manager.ClearSnapshotContents(snapshot)
+	}
+	return statistics, nil
+}
+
+// showRevisionStatistics prints the statistics computed by computeRevisionStatistics for one revision.
+func (manager *SnapshotManager) showRevisionStatistics(snapshot *Snapshot, stats *revisionStatistics) {
+	if stats == nil {
+		return
+	}
+	LOG_INFO("SNAPSHOT_STATS", "Files: %d, total size: %s, chunks: %d (%s bytes), new chunks: %d (%s bytes), "+
+		"dedup ratio: %s", snapshot.NumberOfFiles, PrettyNumber(snapshot.FileSize), stats.chunks,
+		PrettyNumber(stats.chunkSize), stats.newChunks, PrettyNumber(stats.newSize), stats.dedupRatio(snapshot.FileSize))
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestRevisionStatistics(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "revisionstats")
+	os.RemoveAll(testDir)
+
+	repository := filepath.Join(testDir, "repository")
+	os.MkdirAll(joinPath(repository, DUPLICACY_DIRECTORY), 0700)
+	createRandomFile(joinPath(repository, "file1"), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(joinPath(repository, DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+
+	// The second revision adds a file and the third adds nothing
+	for i, file := range []string{"", "file2", ""} {
+		if file != "" {
+			createRandomFile(joinPath(repository, file), 50000)
+		}
+		if !backupManager.Backup(repository, true, threads, "", false, false, 0, false) {
+			t.Fatalf("Backup %d failed", i+1)
+		}
+	}
+
+	statistics, err := backupManager.SnapshotManager.computeRevisionStatistics("host1", nil)
+	if err != nil {
+		t.Fatalf("Failed to compute the statistics: %v", err)
+	}
+	if len(statistics) != 3 {
+		t.Fatalf("Statistics were computed for %d revisions", len(statistics))
+	}
+
+	first, second, third := statistics[1], statistics[2], statistics[3]
+	firstSize := backupManager.SnapshotManager.DownloadSnapshot("host1", 1).FileSize
+	secondSize := backupManager.SnapshotManager.DownloadSnapshot("host1", 2).FileSize
+	if first.newChunks != first.chunks || first.newSize != first.chunkSize || first.chunkSize != firstSize {
+		t.Errorf("Revision 1 has %d of %d chunks new, %d of %d bytes", first.newChunks, first.chunks, first.newSize,
+			first.chunkSize)
+	}
+	if second.chunkSize != secondSize || second.newSize < secondSize-firstSize || second.newSize >= second.chunkSize {
+		t.Errorf("Revision 2 has %d new bytes of %d", second.newSize, second.chunkSize)
+	}
+	if third.newChunks != 0 || third.newSize != 0 || third.chunks != second.chunks {
+		t.Errorf("Revision 3 has %d new chunks of %d", third.newChunks, third.chunks)
+	}
+	if ratio := third.dedupRatio(secondSize); ratio != "n/a" {
+		t.Errorf("Revision 3 has a dedup ratio of %s", ratio)
+	}
+
+	// Revisions after the highest one requested are not loaded
+	statistics, err = backupManager.SnapshotManager.computeRevisionStatistics("host1", []int{2})
+	if err != nil || len(statistics) != 2 || statistics[2].newSize != second.newSize {
+		t.Errorf("Statistics were computed for %d revisions up to revision 2: %v", len(statistics), err)
+	}
+}
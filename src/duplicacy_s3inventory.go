@@ -0,0 +1,218 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3InventoryManifest is the part of the manifest.json of an S3 inventory needed to read it.
+type s3InventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	Files        []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// splitS3InventoryLocation splits the change feed location of an S3 storage, '<bucket>/<prefix>', where <prefix> is
+// where the inventory configuration saves its manifests, that is, the destination prefix, the source bucket, and the
+// configuration id joined by slashes.
+func splitS3InventoryLocation(location string) (bucket string, prefix string, err error) {
+	location = strings.Trim(location, "/")
+	slash := strings.Index(location, "/")
+	if slash <= 0 {
+		return "", "", fmt.Errorf("the inventory location '%s' isn't in the form of <bucket>/<prefix>", location)
+	}
+	return location[:slash], location[slash+1:] + "/", nil
+}
+
+// listS3Inventories returns the dates of the inventories delivered to the location that are complete, the latest
+// first.  An inventory is complete once its manifest.checksum has been written.
+func (storage *S3Storage) listS3Inventories(bucket string, prefix string) (dates []string, err error) {
+
+	marker := ""
+	for {
+		output, err := storage.client.ListObjectsWithContext(storage.GetContext(), &s3.ListObjectsInput{
+			Bucket:    aws.String(bucket),
+			Prefix:    aws.String(prefix),
+			Delimiter: aws.String("/"),
+			Marker:    aws.String(marker),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, subDir := range output.CommonPrefixes {
+			date := strings.TrimSuffix((*subDir.Prefix)[len(prefix):], "/")
+			// Other directories such as hive/ don't have dates as their names
+			if _, err := time.Parse("2006-01-02T15-04Z", date); err == nil {
+				dates = append(dates, date)
+			}
+		}
+
+		if !*output.IsTruncated || output.NextMarker == nil {
+			break
+		}
+		marker = *output.NextMarker
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	for i, date := range dates {
+		_, err := storage.client.HeadObjectWithContext(storage.GetContext(), &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(prefix + date + "/manifest.checksum"),
+		})
+		if err == nil {
+			return dates[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// GetChangeFeedCursor returns the date of the latest inventory delivered to the location.
+func (storage *S3Storage) GetChangeFeedCursor(threadIndex int, location string) (cursor string, err error) {
+	bucket, prefix, err := splitS3InventoryLocation(location)
+	if err != nil {
+		return "", err
+	}
+
+	dates, err := storage.listS3Inventories(bucket, prefix)
+	if err != nil || len(dates) == 0 {
+		return "", err
+	}
+	return dates[0], nil
+}
+
+// ReadChangeFeed reads the latest inventory if it is newer than the one marked by the cursor.  An inventory is a
+// complete listing of the bucket as of its date, so it replaces the chunk index.
+func (storage *S3Storage) ReadChangeFeed(threadIndex int, location string, cursor string,
+	handler func(change ChunkChange)) (newCursor string, complete bool, err error) {
+
+	bucket, prefix, err := splitS3InventoryLocation(location)
+	if err != nil {
+		return "", false, err
+	}
+
+	dates, err := storage.listS3Inventories(bucket, prefix)
+	if err != nil {
+		return "", false, err
+	}
+	if len(dates) == 0 || dates[0] <= cursor {
+		return cursor, false, nil
+	}
+
+	object, err := storage.client.GetObjectWithContext(storage.GetContext(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(prefix + dates[0] + "/manifest.json"),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	defer object.Body.Close()
+
+	var manifest s3InventoryManifest
+	if err = json.NewDecoder(object.Body).Decode(&manifest); err != nil {
+		return "", false, fmt.Errorf("invalid manifest for the inventory of %s: %v", dates[0], err)
+	}
+	if manifest.SourceBucket != storage.bucket {
+		return "", false, fmt.Errorf("the inventory is for the bucket %s", manifest.SourceBucket)
+	}
+	if manifest.FileFormat != "CSV" {
+		return "", false, fmt.Errorf("the inventory format %s is not supported; only CSV is", manifest.FileFormat)
+	}
+
+	columns := strings.Split(manifest.FileSchema, ",")
+	for _, file := range manifest.Files {
+		object, err := storage.client.GetObjectWithContext(storage.GetContext(), &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(file.Key),
+		})
+		if err != nil {
+			return "", false, err
+		}
+
+		err = parseS3InventoryFile(object.Body, columns, storage.storageDir+chunkDir, handler)
+		object.Body.Close()
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read the inventory file %s: %v", file.Key, err)
+		}
+	}
+
+	LOG_DEBUG("CHUNK_INDEX", "Read the inventory of %s from %d files", dates[0], len(manifest.Files))
+	return dates[0], true, nil
+}
+
+// parseS3InventoryFile calls 'handler' with each current object under 'chunkPrefix' listed in the gzipped CSV file
+// of an inventory whose columns are named by 'columns'.
+func parseS3InventoryFile(reader io.Reader, columns []string, chunkPrefix string, handler func(change ChunkChange)) error {
+
+	keyColumn, sizeColumn, latestColumn, deleteMarkerColumn := -1, -1, -1, -1
+	for i, column := range columns {
+		switch strings.TrimSpace(column) {
+		case "Key":
+			keyColumn = i
+		case "Size":
+			sizeColumn = i
+		case "IsLatest":
+			latestColumn = i
+		case "IsDeleteMarker":
+			deleteMarkerColumn = i
+		}
+	}
+	if keyColumn < 0 || sizeColumn < 0 {
+		return fmt.Errorf("the inventory doesn't include the Key and Size fields")
+	}
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	csvReader := csv.NewReader(gzipReader)
+	csvReader.FieldsPerRecord = len(columns)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Only the current versions are listed by the storage
+		if (latestColumn >= 0 && record[latestColumn] != "true") ||
+			(deleteMarkerColumn >= 0 && record[deleteMarkerColumn] == "true") {
+			continue
+		}
+
+		key, err := url.QueryUnescape(record[keyColumn])
+		if err != nil {
+			return fmt.Errorf("invalid key '%s'", record[keyColumn])
+		}
+		if !strings.HasPrefix(key, chunkPrefix) || len(key) == len(chunkPrefix) {
+			continue
+		}
+
+		size, err := strconv.ParseInt(record[sizeColumn], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid size '%s' for %s", record[sizeColumn], key)
+		}
+		handler(ChunkChange{File: key[len(chunkPrefix):], Size: size})
+	}
+}
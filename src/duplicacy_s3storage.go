@@ -10,12 +10,16 @@
 package duplicacy
 
 import (
-	"reflect"
+	"crypto/md5"
+	"encoding/hex"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -27,6 +31,7 @@ type S3Storage struct {
 	bucket          string
 	storageDir      string
 	numberOfThreads int
+	retryPolicy     *RetryPolicy
 }
 
 // CreateS3Storage creates a amazon s3 storage object.
@@ -35,6 +40,7 @@ func CreateS3Storage(regionName string, endpoint string, bucketName string, stor
 	isSSLSupported bool, isMinioCompatible bool) (storage *S3Storage, err error) {
 
 	token := ""
+	httpClient := newStorageHTTPClient()
 
 	auth := credentials.NewStaticCredentials(accessKey, secretKey, token)
 
@@ -42,6 +48,7 @@ func CreateS3Storage(regionName string, endpoint string, bucketName string, stor
 		defaultRegionConfig := &aws.Config{
 			Region:      aws.String("us-east-1"),
 			Credentials: auth,
+			HTTPClient:  httpClient,
 		}
 
 		s3Client := s3.New(session.New(defaultRegionConfig))
@@ -64,6 +71,7 @@ func CreateS3Storage(regionName string, endpoint string, bucketName string, stor
 		Endpoint:         aws.String(endpoint),
 		S3ForcePathStyle: aws.Bool(isMinioCompatible),
 		DisableSSL:       aws.Bool(!isSSLSupported),
+		HTTPClient:       httpClient,
 	}
 
 	if len(storageDir) > 0 && storageDir[len(storageDir)-1] != '/' {
@@ -71,17 +79,80 @@ func CreateS3Storage(regionName string, endpoint string, bucketName string, stor
 	}
 
 	storage = &S3Storage{
-		client:          s3.New(session.New(s3Config)),
 		bucket:          bucketName,
 		storageDir:      storageDir,
 		numberOfThreads: threads,
+		retryPolicy:     CreateRetryPolicy(4, 0.5, 30, 0.5),
 	}
 
+	// The SDK still decides which errors can be retried
+	s3Config.Retryer = s3Retryer{storage: storage}
+	storage.client = s3.New(session.New(s3Config))
+	storage.client.Handlers.Retry.PushBack(storage.checkRetry)
+
 	storage.DerivedStorage = storage
 	storage.SetDefaultNestingLevels([]int{0}, 0)
 	return storage, nil
 }
 
+// SetRetryPolicy replaces the settings of the default retry policy with the non-zero ones of 'policy'.
+func (storage *S3Storage) SetRetryPolicy(policy *RetryPolicy) {
+	storage.retryPolicy = storage.retryPolicy.override(policy)
+}
+
+// s3Retryer makes the SDK retry requests by the retry policy of the storage.
+type s3Retryer struct {
+	client.DefaultRetryer
+	storage *S3Storage
+}
+
+func (retryer s3Retryer) MaxRetries() int {
+	return retryer.storage.retryPolicy.MaximumAttempts - 1
+}
+
+func (retryer s3Retryer) RetryRules(r *request.Request) time.Duration {
+	state := retryer.storage.getRetryState(r)
+	state.attempts++
+	return state.nextDelay(r.Error, 0)
+}
+
+// getRetryState returns the state of the request in the retry policy before its latest attempt failed.
+func (storage *S3Storage) getRetryState(r *request.Request) *retryState {
+	class := RetryClassOther
+	switch r.Operation.Name {
+	case "ListObjects", "ListObjectsV2", "ListObjectVersions":
+		class = RetryClassList
+	case "GetObject":
+		class = RetryClassDownload
+	case "PutObject", "CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload":
+		class = RetryClassUpload
+	case "DeleteObject", "DeleteObjects":
+		class = RetryClassDelete
+	}
+
+	state := storage.retryPolicy.startRequest(r.Context(), "S3", class, r.Operation.Name+" "+r.HTTPRequest.URL.Path)
+	state.attempts = r.RetryCount
+	return state
+}
+
+// checkRetry is the retry handler deciding if a failed request that can be retried is within the attempts and the
+// budget of the retry policy.
+func (storage *S3Storage) checkRetry(r *request.Request) {
+	if r.Error == nil {
+		return
+	}
+	if r.Retryable == nil {
+		r.Retryable = aws.Bool(r.ShouldRetry(r))
+	}
+	if !aws.BoolValue(r.Retryable) {
+		return
+	}
+
+	if !storage.getRetryState(r).allowRetry(r.Error) {
+		r.Retryable = aws.Bool(false)
+	}
+}
+
 // ListFiles return the list of files and subdirectories under 'dir' (non-recursively)
 func (storage *S3Storage) ListFiles(threadIndex int, dir string) (files []string, sizes []int64, err error) {
 	if len(dir) > 0 && dir[len(dir)-1] != '/' {
@@ -97,7 +168,7 @@ func (storage *S3Storage) ListFiles(threadIndex int, dir string) (files []string
 			MaxKeys:   aws.Int64(1000),
 		}
 
-		output, err := storage.client.ListObjects(&input)
+		output, err := storage.client.ListObjectsWithContext(storage.GetContext(), &input)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -107,35 +178,56 @@ func (storage *S3Storage) ListFiles(threadIndex int, dir string) (files []string
 		}
 		return files, nil, nil
 	} else {
-		dir = storage.storageDir + dir
-		marker := ""
-		for {
-			input := s3.ListObjectsInput{
-				Bucket:  aws.String(storage.bucket),
-				Prefix:  aws.String(dir),
-				MaxKeys: aws.Int64(1000),
-				Marker:  aws.String(marker),
-			}
+		err = storage.ListFilesFunc(threadIndex, dir, func(file string, size int64) bool {
+			files = append(files, file)
+			sizes = append(sizes, size)
+			return true
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return files, sizes, nil
+	}
 
-			output, err := storage.client.ListObjects(&input)
-			if err != nil {
-				return nil, nil, err
-			}
+}
 
-			for _, object := range output.Contents {
-				files = append(files, (*object.Key)[len(dir):])
-				sizes = append(sizes, *object.Size)
-			}
+// ListFilesFunc calls 'handler' with each file under 'dir' (recursively), one page of objects at a time.
+func (storage *S3Storage) ListFilesFunc(threadIndex int, dir string, handler func(file string, size int64) bool) (err error) {
+	if len(dir) > 0 && dir[len(dir)-1] != '/' {
+		dir += "/"
+	}
 
-			if !*output.IsTruncated {
-				break
+	if dir == "snapshots/" {
+		return storage.StorageBase.ListFilesFunc(threadIndex, dir, handler)
+	}
+
+	dir = storage.storageDir + dir
+	marker := ""
+	for {
+		input := s3.ListObjectsInput{
+			Bucket:  aws.String(storage.bucket),
+			Prefix:  aws.String(dir),
+			MaxKeys: aws.Int64(1000),
+			Marker:  aws.String(marker),
+		}
+
+		output, err := storage.client.ListObjectsWithContext(storage.GetContext(), &input)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range output.Contents {
+			if !handler((*object.Key)[len(dir):], *object.Size) {
+				return nil
 			}
+		}
 
-			marker = *output.Contents[len(output.Contents)-1].Key
+		if !*output.IsTruncated || len(output.Contents) == 0 {
+			return nil
 		}
-		return files, sizes, nil
-	}
 
+		marker = *output.Contents[len(output.Contents)-1].Key
+	}
 }
 
 // DeleteFile deletes the file or directory at 'filePath'.
@@ -144,7 +236,7 @@ func (storage *S3Storage) DeleteFile(threadIndex int, filePath string) (err erro
 		Bucket: aws.String(storage.bucket),
 		Key:    aws.String(storage.storageDir + filePath),
 	}
-	_, err = storage.client.DeleteObject(input)
+	_, err = storage.client.DeleteObjectWithContext(storage.GetContext(), input)
 	return err
 }
 
@@ -157,7 +249,7 @@ func (storage *S3Storage) MoveFile(threadIndex int, from string, to string) (err
 		Key:        aws.String(storage.storageDir + to),
 	}
 
-	_, err = storage.client.CopyObject(input)
+	_, err = storage.client.CopyObjectWithContext(storage.GetContext(), input)
 	if err != nil {
 		return err
 	}
@@ -179,7 +271,7 @@ func (storage *S3Storage) GetFileInfo(threadIndex int, filePath string) (exist b
 		Key:    aws.String(storage.storageDir + filePath),
 	}
 
-	output, err := storage.client.HeadObject(input)
+	output, err := storage.client.HeadObjectWithContext(storage.GetContext(), input)
 	if err != nil {
 		if e, ok := err.(awserr.RequestFailure); ok && (e.StatusCode() == 403 || e.StatusCode() == 404) {
 			return false, false, 0, nil
@@ -203,7 +295,7 @@ func (storage *S3Storage) DownloadFile(threadIndex int, filePath string, chunk *
 		Key:    aws.String(storage.storageDir + filePath),
 	}
 
-	output, err := storage.client.GetObject(input)
+	output, err := storage.client.GetObjectWithContext(storage.GetContext(), input)
 	if err != nil {
 		return err
 	}
@@ -218,8 +310,7 @@ func (storage *S3Storage) DownloadFile(threadIndex int, filePath string, chunk *
 // UploadFile writes 'content' to the file at 'filePath'.
 func (storage *S3Storage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
 
-	attempts := 0
-
+	retryState := storage.retryPolicy.startRequest(storage.GetContext(), "S3", RetryClassUpload, "upload of "+filePath)
 	for {
 		input := &s3.PutObjectInput{
 			Bucket:      aws.String(storage.bucket),
@@ -229,14 +320,54 @@ func (storage *S3Storage) UploadFile(threadIndex int, filePath string, content [
 			ContentType: aws.String("application/duplicacy"),
 		}
 
-		_, err = storage.client.PutObject(input)
-		if err == nil || attempts >= 3 || !strings.Contains(err.Error(), "XAmzContentSHA256Mismatch") {
+		// A corrupted upload isn't retried by the SDK
+		_, err = storage.client.PutObjectWithContext(storage.GetContext(), input)
+		if err == nil || !strings.Contains(err.Error(), "XAmzContentSHA256Mismatch") || !retryState.retry(err, 0) {
 			return err
 		}
+	}
+}
+
+// ComputeChecksum returns the ETag of an object with the given content uploaded in a single part, which is its MD5.
+func (storage *S3Storage) ComputeChecksum(content []byte) string {
+	hash := md5.Sum(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// ListChecksums returns the objects under 'dir' and their ETags.  The ETag of an object uploaded in parts isn't its
+// MD5 and is reported as empty.  Note that with SSE-KMS or SSE-C encryption no ETag is the MD5 of the content.
+func (storage *S3Storage) ListChecksums(threadIndex int, dir string) (files []string, checksums []string, err error) {
+	dir = storage.storageDir + strings.TrimSuffix(dir, "/") + "/"
+	marker := ""
+	for {
+		input := s3.ListObjectsInput{
+			Bucket:  aws.String(storage.bucket),
+			Prefix:  aws.String(dir),
+			MaxKeys: aws.Int64(1000),
+			Marker:  aws.String(marker),
+		}
+
+		output, err := storage.client.ListObjectsWithContext(storage.GetContext(), &input)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, object := range output.Contents {
+			checksum := strings.Trim(aws.StringValue(object.ETag), "\"")
+			if strings.Contains(checksum, "-") {
+				checksum = ""
+			}
+			files = append(files, (*object.Key)[len(dir):])
+			checksums = append(checksums, checksum)
+		}
+
+		if !*output.IsTruncated {
+			break
+		}
 
-		LOG_INFO("S3_RETRY", "Retrying on %s: %v", reflect.TypeOf(err), err)
-		attempts += 1
+		marker = *output.Contents[len(output.Contents)-1].Key
 	}
+	return files, checksums, nil
 }
 
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
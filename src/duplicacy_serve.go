@@ -0,0 +1,167 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/net/webdav"
+)
+
+// ServeOptions configures how ServeSnapshots exposes the snapshots.
+type ServeOptions struct {
+	Address  string
+	Username string // if not empty, clients must authenticate with this username and Password
+	Password string
+	HTTPOnly bool   // serve plain HTTP only (directory listings and downloads) without the WebDAV methods
+	CertFile string // if not empty, serve HTTPS with this certificate and KeyFile
+	KeyFile  string
+}
+
+// httpFileSystem adapts SnapshotFileSystem to http.FileSystem for browsers and tools like curl or wget.
+type httpFileSystem struct {
+	fs *SnapshotFileSystem
+}
+
+func (httpFS httpFileSystem) Open(name string) (http.File, error) {
+	return httpFS.fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+}
+
+// createSnapshotHandler creates the read-only WebDAV handler for the snapshots, logging requests with 'logID'.
+func createSnapshotHandler(fs *SnapshotFileSystem, logID string) *webdav.Handler {
+	return &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(request *http.Request, err error) {
+			if err != nil {
+				LOG_DEBUG(logID, "%s %s: %v", request.Method, request.URL.Path, err)
+			} else {
+				LOG_TRACE(logID, "%s %s", request.Method, request.URL.Path)
+			}
+		},
+	}
+}
+
+// snapshotServer serves GET and HEAD requests as plain HTTP with directory listings, and the others as WebDAV
+// requests, after checking the credentials.
+type snapshotServer struct {
+	options ServeOptions
+	address string // the address the server is bound to, which requests must be sent to
+	files   http.Handler
+	webdav  http.Handler
+}
+
+// checkRequestHost rejects a request not sent to 'address', the address the server is bound to, or sent from a web
+// page of another origin.  Any web page the user opens can send requests to a server on this machine through the
+// browser, or through a domain name resolving to the server's address, and read the responses if not rejected.
+func checkRequestHost(writer http.ResponseWriter, request *http.Request, address string, logID string) bool {
+	if !isBoundHost(address, request.Host) {
+		LOG_DEBUG(logID, "Rejected %s request for %s sent to %s", request.Method, request.URL.Path, request.Host)
+		http.Error(writer, "Invalid host", http.StatusForbidden)
+		return false
+	}
+
+	scheme := "http://"
+	if request.TLS != nil {
+		scheme = "https://"
+	}
+	if origin := request.Header.Get("Origin"); origin != "" && origin != scheme+request.Host {
+		LOG_DEBUG(logID, "Rejected %s request for %s from %s", request.Method, request.URL.Path, origin)
+		http.Error(writer, "Invalid origin", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (server *snapshotServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !checkRequestHost(writer, request, server.address, "SERVE_HOST") {
+		return
+	}
+
+	if server.options.Username != "" {
+		username, password, ok := request.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(server.options.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(server.options.Password)) != 1 {
+			LOG_DEBUG("SERVE_AUTH", "Unauthorized %s request for %s from %s", request.Method, request.URL.Path,
+				request.RemoteAddr)
+			writer.Header().Set("WWW-Authenticate", `Basic realm="duplicacy"`)
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		LOG_TRACE("SERVE_REQUEST", "%s %s", request.Method, request.URL.Path)
+		server.files.ServeHTTP(writer, request)
+	default:
+		if server.options.HTTPOnly {
+			http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		server.webdav.ServeHTTP(writer, request)
+	}
+}
+
+// ServeSnapshots exposes the snapshots in the storage read-only over HTTP and WebDAV, with the files decrypted on the
+// fly, until the process is interrupted.  Snapshots are laid out as /<snapshot id>/<revision>/<path>.  Credentials
+// are required unless the server only accepts connections from this machine.
+func ServeSnapshots(manager *SnapshotManager, options ServeOptions) bool {
+
+	if options.Username == "" && !isLoopbackAddress(options.Address) {
+		LOG_ERROR("SERVE_AUTH", "A username and password are required to serve the snapshots on %s, which "+
+			"accepts connections from other machines", options.Address)
+		return false
+	}
+
+	listener, err := net.Listen("tcp", options.Address)
+	if err != nil {
+		LOG_ERROR("SERVE_LISTEN", "Failed to listen on %s: %v", options.Address, err)
+		return false
+	}
+
+	fs := CreateSnapshotFileSystem(manager)
+	server := &http.Server{
+		Handler: &snapshotServer{
+			options: options,
+			address: listener.Addr().String(),
+			files:   http.FileServer(httpFileSystem{fs: fs}),
+			webdav:  createSnapshotHandler(fs, "SERVE_REQUEST"),
+		},
+	}
+
+	scheme := "http"
+	serverError := make(chan error, 1)
+	if options.CertFile != "" {
+		scheme = "https"
+		go func() { serverError <- server.ServeTLS(listener, options.CertFile, options.KeyFile) }()
+	} else {
+		go func() { serverError <- server.Serve(listener) }()
+	}
+	defer server.Close()
+
+	LOG_INFO("SERVE_READY", "Snapshots are available at %s://%s/; press Ctrl-C to stop", scheme,
+		listener.Addr().String())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-signals:
+	case err = <-serverError:
+		LOG_ERROR("SERVE_FAIL", "Failed to serve the snapshots: %v", err)
+		return false
+	}
+
+	LOG_INFO("SERVE_END", "Snapshots are no longer served")
+	return true
+}
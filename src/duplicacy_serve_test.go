@@ -0,0 +1,142 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotServer(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "serve")
+	os.RemoveAll(testDir)
+
+	os.MkdirAll(joinPath(testDir, "repository1", DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(testDir, "repository1", "dir"), 0700)
+	createRandomFile(joinPath(testDir, "repository1", "dir", "file1"), 100000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(filepath.Join(testDir, "repository1", DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(filepath.Join(testDir, "repository1"), true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	options := ServeOptions{Username: "user", Password: "secret", HTTPOnly: true}
+	fs := CreateSnapshotFileSystem(backupManager.SnapshotManager)
+	server := httptest.NewServer(&snapshotServer{
+		options: options,
+		files:   http.FileServer(httpFileSystem{fs: fs}),
+		webdav:  createSnapshotHandler(fs, "SERVE_REQUEST"),
+	})
+	defer server.Close()
+	server.Config.Handler.(*snapshotServer).address = server.Listener.Addr().String()
+
+	headers := map[string]string{}
+	send := func(method string, path string, username string, password string) (int, []byte) {
+		request, _ := http.NewRequest(method, server.URL+path, nil)
+		if username != "" {
+			request.SetBasicAuth(username, password)
+		}
+		for name, value := range headers {
+			if name == "Host" {
+				request.Host = value
+			} else {
+				request.Header.Set(name, value)
+			}
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, body
+	}
+
+	if status, _ := send("GET", "/host1/1/dir/file1", "", ""); status != http.StatusUnauthorized {
+		t.Errorf("A request without credentials returned %d", status)
+	}
+	if status, _ := send("GET", "/host1/1/dir/file1", "user", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("A request with a wrong password returned %d", status)
+	}
+
+	expected, _ := ioutil.ReadFile(joinPath(testDir, "repository1", "dir", "file1"))
+	status, body := send("GET", "/host1/1/dir/file1", "user", "secret")
+	if status != http.StatusOK || string(body) != string(expected) {
+		t.Errorf("The served file has a status of %d and %d bytes instead of %d", status, len(body), len(expected))
+	}
+
+	// Requests sent to another host name, such as one rebound to the server's address, or from a web page of another
+	// origin are rejected even with the right credentials
+	headers["Host"] = "example.com:" + strings.Split(server.Listener.Addr().String(), ":")[1]
+	if status, _ := send("GET", "/host1/1/dir/file1", "user", "secret"); status != http.StatusForbidden {
+		t.Errorf("A request sent to another host returned %d", status)
+	}
+	delete(headers, "Host")
+	headers["Origin"] = "http://example.com"
+	if status, _ := send("GET", "/host1/1/dir/file1", "user", "secret"); status != http.StatusForbidden {
+		t.Errorf("A request from another origin returned %d", status)
+	}
+	headers["Origin"] = server.URL
+	if status, _ := send("GET", "/host1/1/dir/file1", "user", "secret"); status != http.StatusOK {
+		t.Errorf("A request from the same origin returned %d", status)
+	}
+	delete(headers, "Origin")
+
+	if status, _ := send("PROPFIND", "/host1/1/", "user", "secret"); status != http.StatusMethodNotAllowed {
+		t.Errorf("A WebDAV request in the HTTP only mode returned %d", status)
+	}
+}
+
+func TestIsLoopbackAddress(t *testing.T) {
+	for address, expected := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"localhost:8080": true,
+		"[::1]:8080":     true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+		"example.com:80": false,
+	} {
+		if isLoopbackAddress(address) != expected {
+			t.Errorf("%s is loopback: %t", address, !expected)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultServiceName is the name of the service if none is given, also used as the event log source.
+const DefaultServiceName = "duplicacy"
+
+// ServiceOptions configures the service installed by InstallService and run by RunService.
+type ServiceOptions struct {
+	Name       string
+	Executable string        // the duplicacy executable run with -json for each scheduled run
+	Repository string        // the directory where the command is run
+	Arguments  []string      // the command run on schedule and its options, such as 'backup -stats'
+	Interval   time.Duration // the time between the end of a run and the start of the next one
+
+	PauseOnBattery bool // skip scheduled runs while the computer is running on battery
+	PauseOnMetered bool // skip scheduled runs while the network connection is metered
+}
+
+// Whether logs are written to the event log, when running as a Windows service
+var eventLogEnabled = false
+
+// How often the pause conditions are checked again while scheduled runs are paused
+var servicePauseCheckInterval = time.Minute
+
+// ServiceScheduler runs the command of a service periodically.  Runs are skipped while the pause conditions hold,
+// and the running command is stopped when they start to hold, so that it can resume from where it left off in the
+// next run.
+type ServiceScheduler struct {
+	options        ServiceOptions
+	getPauseReason func() string // returns why runs are paused, or an empty string if they are not
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	mutex   sync.Mutex
+	process *exec.Cmd
+}
+
+// CreateServiceScheduler creates a scheduler for the service.  'getPauseReason' is called before each run and when
+// the scheduler is woken up, such as on power events.
+func CreateServiceScheduler(options ServiceOptions, getPauseReason func() string) *ServiceScheduler {
+	if getPauseReason == nil {
+		getPauseReason = func() string { return "" }
+	}
+	return &ServiceScheduler{
+		options:        options,
+		getPauseReason: getPauseReason,
+		wake:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// Start starts the first run immediately and schedules the following ones.
+func (scheduler *ServiceScheduler) Start() {
+	go scheduler.loop()
+}
+
+// Wake makes the scheduler check the pause conditions again.
+func (scheduler *ServiceScheduler) Wake() {
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the scheduler and the running command, and waits for them to exit.
+func (scheduler *ServiceScheduler) Stop() {
+	close(scheduler.stop)
+	scheduler.interrupt()
+	<-scheduler.done
+}
+
+// wait waits for the duration or until the scheduler is woken up.  It returns false if the scheduler is stopped.
+func (scheduler *ServiceScheduler) wait(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-scheduler.stop:
+		return false
+	case <-scheduler.wake:
+		return true
+	case <-timer.C:
+		return true
+	}
+}
+
+func (scheduler *ServiceScheduler) loop() {
+	defer close(scheduler.done)
+
+	paused := false
+	next := time.Now()
+	for {
+		if reason := scheduler.getPauseReason(); reason != "" {
+			if !paused {
+				LOG_INFO("SERVICE_PAUSE", "Scheduled runs are paused because %s", reason)
+				paused = true
+			}
+			if !scheduler.wait(servicePauseCheckInterval) {
+				return
+			}
+			continue
+		}
+		if paused {
+			LOG_INFO("SERVICE_RESUME", "Scheduled runs are resumed")
+			paused = false
+		}
+
+		if delay := time.Until(next); delay > 0 {
+			if !scheduler.wait(delay) {
+				return
+			}
+			continue
+		}
+
+		scheduler.run()
+		next = time.Now().Add(scheduler.options.Interval)
+
+		select {
+		case <-scheduler.stop:
+			return
+		default:
+		}
+	}
+}
+
+// run runs the command once.  The warnings and errors of the command are logged by the service, so they end up in
+// the event log.
+func (scheduler *ServiceScheduler) run() bool {
+	process := exec.Command(scheduler.options.Executable, append([]string{"-json"}, scheduler.options.Arguments...)...)
+	process.Dir = scheduler.options.Repository
+	stdout, err := process.StdoutPipe()
+	if err != nil {
+		LOG_WARN("SERVICE_RUN", "Failed to run %s: %v", strings.Join(scheduler.options.Arguments, " "), err)
+		return false
+	}
+
+	scheduler.mutex.Lock()
+	select {
+	case <-scheduler.stop:
+		// Stopped before the command could be interrupted
+		scheduler.mutex.Unlock()
+		return false
+	default:
+	}
+	err = process.Start()
+	if err == nil {
+		scheduler.process = process
+	}
+	scheduler.mutex.Unlock()
+	if err != nil {
+		LOG_WARN("SERVICE_RUN", "Failed to run %s: %v", strings.Join(scheduler.options.Arguments, " "), err)
+		return false
+	}
+	LOG_INFO("SERVICE_RUN_START", "Running %s", strings.Join(scheduler.options.Arguments, " "))
+
+	// Stop the command if the pause conditions start to hold while it is running
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		for {
+			select {
+			case <-exited:
+				return
+			case <-scheduler.wake:
+				if reason := scheduler.getPauseReason(); reason != "" {
+					LOG_INFO("SERVICE_PAUSE", "Stopping the running command because %s", reason)
+					scheduler.interrupt()
+					scheduler.Wake()
+					return
+				}
+			}
+		}
+	}()
+
+	success, message := readServiceRecords(stdout)
+	err = process.Wait()
+
+	scheduler.mutex.Lock()
+	scheduler.process = nil
+	scheduler.mutex.Unlock()
+
+	if exitError, ok := err.(*exec.ExitError); ok && success && exitError.ExitCode() == WarningExitCode {
+		// Completed with skipped files, which have been logged as warnings
+		err = nil
+	}
+
+	if err != nil || !success {
+		if message == "" && err != nil {
+			message = err.Error()
+		}
+		LOG_WARN("SERVICE_RUN_FAIL", "%s failed: %s", strings.Join(scheduler.options.Arguments, " "), message)
+		return false
+	}
+	LOG_INFO("SERVICE_RUN_END", "%s completed", strings.Join(scheduler.options.Arguments, " "))
+	return true
+}
+
+// interrupt stops the running command, if any.  The command saves its state as it does on Ctrl-C, except on Windows
+// where processes can't be interrupted.
+func (scheduler *ServiceScheduler) interrupt() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.process == nil {
+		return
+	}
+	if runtime.GOOS == "windows" {
+		scheduler.process.Process.Kill()
+	} else {
+		scheduler.process.Process.Signal(os.Interrupt)
+	}
+}
+
+// readServiceRecords logs the warnings and errors among the JSON records written by the command until it exits, and
+// returns the result of the command with the error message if it failed.
+func readServiceRecords(stdout io.Reader) (success bool, message string) {
+	success, message, _ = readCommandRecords(stdout, func(record *JSONRecord) {
+		// Errors of the command are not errors of the service, which keeps running
+		LOG_WARN("SERVICE_COMMAND", "%s %s", record.ID, record.Message)
+	})
+	return success, message
+}
+
+// readCommandRecords reads the JSON records written by a command run with -json until it exits, passing warnings and
+// errors to logProblem.  It returns the result of the command, the error message if it failed, and the number of
+// warnings.
+func readCommandRecords(stdout io.Reader, logProblem func(record *JSONRecord)) (success bool, message string, warnings int) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record JSONRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		switch record.Type {
+		case "log":
+			if record.Level == "WARN" || record.Level == "ERROR" || record.Level == "FATAL" {
+				logProblem(&record)
+			}
+			if record.Level == "WARN" {
+				warnings++
+			} else if record.Level == "ERROR" || record.Level == "FATAL" {
+				message = record.Message
+			}
+		case "result":
+			success = record.Success != nil && *record.Success
+			if failure, ok := record.Data.(map[string]interface{}); ok && !success {
+				if text, ok := failure["message"].(string); ok && text != "" {
+					message = text
+				}
+			}
+		}
+	}
+	return success, message, warnings
+}
+
+// getServicePauseReason returns why scheduled runs are to be skipped, or an empty string if they are not.
+func getServicePauseReason(options ServiceOptions) string {
+	if options.PauseOnBattery && isOnBattery() {
+		return "the computer is running on battery"
+	}
+	if options.PauseOnMetered && isNetworkMetered() {
+		return "the network connection is metered"
+	}
+	return ""
+}
+
+// getServiceArguments returns the arguments with which the service manager starts the executable to run the service.
+func getServiceArguments(options ServiceOptions) []string {
+	arguments := []string{"service", "run", "-name", options.Name, "-repository", options.Repository,
+		"-interval", options.Interval.String()}
+	if options.PauseOnBattery {
+		arguments = append(arguments, "-pause-on-battery")
+	}
+	if options.PauseOnMetered {
+		arguments = append(arguments, "-pause-on-metered")
+	}
+	return append(arguments, options.Arguments...)
+}
+
+// runServiceInForeground runs the scheduler until the process is interrupted, when the service is not started by
+// the service manager.
+func runServiceInForeground(options ServiceOptions) bool {
+	scheduler := CreateServiceScheduler(options, func() string { return getServicePauseReason(options) })
+	scheduler.Start()
+
+	LOG_INFO("SERVICE_READY", "Running %s every %s; press Ctrl-C to stop", strings.Join(options.Arguments, " "),
+		options.Interval)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	<-signals
+
+	scheduler.Stop()
+	LOG_INFO("SERVICE_END", "The scheduler has stopped")
+	return true
+}
@@ -0,0 +1,44 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build !windows
+
+package duplicacy
+
+import (
+	"runtime"
+)
+
+// InstallService fails as services can only be installed on Windows.
+func InstallService(options ServiceOptions) bool {
+	LOG_ERROR("SERVICE_UNSUPPORTED", "Services can't be installed on %s; use the service manager of the system to run 'duplicacy service run' instead",
+		runtime.GOOS)
+	return false
+}
+
+// UninstallService fails as services can only be installed on Windows.
+func UninstallService(name string) bool {
+	LOG_ERROR("SERVICE_UNSUPPORTED", "Services can't be installed on %s", runtime.GOOS)
+	return false
+}
+
+// RunService runs the scheduler in the foreground.
+func RunService(options ServiceOptions) bool {
+	return runServiceInForeground(options)
+}
+
+// There is no event log on this platform.
+func writeEventLogRecord(level int, logID string, message string) bool {
+	return false
+}
+
+// The power source is not checked on this platform.
+func isOnBattery() bool {
+	return false
+}
+
+// The network cost is not checked on this platform.
+func isNetworkMetered() bool {
+	return false
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServiceScheduler(t *testing.T) {
+
+	setTestingT(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake executable is a shell script")
+	}
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "service")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	// A fake duplicacy that records each run, and sleeps on the third run until it is interrupted
+	executable := filepath.Join(testDir, "duplicacy")
+	script := `#!/bin/sh
+echo "$@" >> runs
+if [ $(wc -l < runs) -eq 3 ]; then
+  trap 'echo interrupted >> runs; exit 102' INT
+  sleep 10 > /dev/null &
+  wait
+fi
+echo '{"type":"log","level":"WARN","id":"BACKUP_SKIPPED","message":"Skipped a file"}'
+echo '{"type":"result","command":"backup","success":true}'
+`
+	if err := ioutil.WriteFile(executable, []byte(script), 0700); err != nil {
+		t.Fatalf("Failed to create the executable: %v", err)
+	}
+
+	readRuns := func() []string {
+		content, _ := ioutil.ReadFile(filepath.Join(testDir, "runs"))
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+
+	waitFor := func(condition func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if condition() {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+
+	var mutex sync.Mutex
+	pauseReason := ""
+	getPauseReason := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return pauseReason
+	}
+	setPauseReason := func(reason string) {
+		mutex.Lock()
+		pauseReason = reason
+		mutex.Unlock()
+	}
+
+	savedPauseCheckInterval := servicePauseCheckInterval
+	servicePauseCheckInterval = time.Hour
+	defer func() { servicePauseCheckInterval = savedPauseCheckInterval }()
+
+	scheduler := CreateServiceScheduler(ServiceOptions{
+		Executable: executable,
+		Repository: testDir,
+		Arguments:  []string{"backup", "-stats"},
+		Interval:   200 * time.Millisecond,
+	}, getPauseReason)
+	scheduler.Start()
+
+	if !waitFor(func() bool { return len(readRuns()) >= 2 }) {
+		t.Fatalf("The command was run %d times", len(readRuns()))
+	}
+	if runs := readRuns(); runs[0] != "-json backup -stats" {
+		t.Errorf("The command was run with '%s'", runs[0])
+	}
+
+	// The third run is stopped when the pause conditions start to hold, and no run is started while they hold
+	if !waitFor(func() bool { return len(readRuns()) >= 3 }) {
+		t.Fatalf("The command was run %d times", len(readRuns()))
+	}
+	setPauseReason("the test paused it")
+	scheduler.Wake()
+	if !waitFor(func() bool { return len(readRuns()) >= 4 }) || readRuns()[3] != "interrupted" {
+		t.Fatalf("The running command was not interrupted: %v", readRuns())
+	}
+	time.Sleep(500 * time.Millisecond)
+	if len(readRuns()) != 4 {
+		t.Errorf("The command was run while paused: %v", readRuns())
+	}
+
+	setPauseReason("")
+	scheduler.Wake()
+	if !waitFor(func() bool { return len(readRuns()) >= 5 }) {
+		t.Errorf("The command was not run after resuming: %v", readRuns())
+	}
+	scheduler.Stop()
+
+	success, message := readServiceRecords(strings.NewReader(`{"type":"log","level":"ERROR","id":"STORAGE_CREATE","message":"Failed to load the storage"}
+not a record
+{"type":"result","success":false}
+`))
+	if success || message != "Failed to load the storage" {
+		t.Errorf("The result of the command was read as %t with '%s'", success, message)
+	}
+
+	arguments := getServiceArguments(ServiceOptions{Name: "offsite", Repository: testDir, Interval: time.Hour,
+		PauseOnMetered: true, Arguments: []string{"backup", "-threads", "4"}})
+	expected := "service run -name offsite -repository " + testDir + " -interval 1h0m0s -pause-on-metered backup -threads 4"
+	if strings.Join(arguments, " ") != expected {
+		t.Errorf("The service is started with '%s'", strings.Join(arguments, " "))
+	}
+}
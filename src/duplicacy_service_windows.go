@@ -0,0 +1,227 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+var (
+	procGetSystemPowerStatus       = modKernel32.NewProc("GetSystemPowerStatus")
+	procGetNetworkConnectivityHint = syscall.NewLazyDLL("iphlpapi.dll").NewProc("GetNetworkConnectivityHint")
+)
+
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+type networkConnectivityHint struct {
+	ConnectivityLevel    int32
+	ConnectivityCost     int32
+	ApproachingDataLimit byte
+	OverDataLimit        byte
+	Roaming              byte
+}
+
+const (
+	NetworkConnectivityCostHintFixed    = 2
+	NetworkConnectivityCostHintVariable = 3
+)
+
+// The event log of the service, opened by RunService
+var serviceEventLog *eventlog.Log
+
+// InstallService registers a service that starts automatically and runs the scheduler with the options, and an event
+// log source with the same name.
+func InstallService(options ServiceOptions) bool {
+	manager, err := mgr.Connect()
+	if err != nil {
+		LOG_ERROR("SERVICE_INSTALL", "Failed to connect to the service manager: %v", err)
+		return false
+	}
+	defer manager.Disconnect()
+
+	if service, err := manager.OpenService(options.Name); err == nil {
+		service.Close()
+		LOG_ERROR("SERVICE_INSTALL", "The service %s already exists", options.Name)
+		return false
+	}
+
+	config := mgr.Config{
+		DisplayName: fmt.Sprintf("Duplicacy (%s)", options.Name),
+		Description: fmt.Sprintf("Runs 'duplicacy %s' in %s every %s", strings.Join(options.Arguments, " "),
+			options.Repository, options.Interval),
+		StartType: mgr.StartAutomatic,
+	}
+	service, err := manager.CreateService(options.Name, options.Executable, config, getServiceArguments(options)...)
+	if err != nil {
+		LOG_ERROR("SERVICE_INSTALL", "Failed to create the service %s: %v", options.Name, err)
+		return false
+	}
+	defer service.Close()
+
+	err = eventlog.InstallAsEventCreate(options.Name, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		LOG_WARN("SERVICE_EVENTLOG", "Failed to register the event log source %s: %v", options.Name, err)
+	}
+
+	LOG_INFO("SERVICE_INSTALL", "The service %s has been installed; run 'sc start %s' or restart the computer to start it",
+		options.Name, options.Name)
+	return true
+}
+
+// UninstallService stops and removes the service and its event log source.
+func UninstallService(name string) bool {
+	manager, err := mgr.Connect()
+	if err != nil {
+		LOG_ERROR("SERVICE_UNINSTALL", "Failed to connect to the service manager: %v", err)
+		return false
+	}
+	defer manager.Disconnect()
+
+	service, err := manager.OpenService(name)
+	if err != nil {
+		LOG_ERROR("SERVICE_UNINSTALL", "The service %s is not installed: %v", name, err)
+		return false
+	}
+	defer service.Close()
+
+	if _, err := service.Control(svc.Stop); err != nil {
+		LOG_DEBUG("SERVICE_UNINSTALL", "The service %s could not be stopped: %v", name, err)
+	}
+	if err = service.Delete(); err != nil {
+		LOG_ERROR("SERVICE_UNINSTALL", "Failed to remove the service %s: %v", name, err)
+		return false
+	}
+	if err = eventlog.Remove(name); err != nil {
+		LOG_WARN("SERVICE_EVENTLOG", "Failed to remove the event log source %s: %v", name, err)
+	}
+
+	LOG_INFO("SERVICE_UNINSTALL", "The service %s has been removed", name)
+	return true
+}
+
+// windowsService runs the scheduler under the service manager.
+type windowsService struct {
+	options ServiceOptions
+}
+
+func (service *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest,
+	status chan<- svc.Status) (bool, uint32) {
+
+	status <- svc.Status{State: svc.StartPending}
+
+	scheduler := CreateServiceScheduler(service.options, func() string { return getServicePauseReason(service.options) })
+	scheduler.Start()
+
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPowerEvent | svc.AcceptSessionChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	LOG_INFO("SERVICE_READY", "Running %s every %s", strings.Join(service.options.Arguments, " "),
+		service.options.Interval)
+
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			scheduler.Stop()
+			LOG_INFO("SERVICE_END", "The service has stopped")
+			return false, 0
+		case svc.PowerEvent, svc.SessionChange:
+			// The power source, the network, or the logged on users may have changed
+			LOG_DEBUG("SERVICE_EVENT", "Received the control code %d with the event type %d", request.Cmd,
+				request.EventType)
+			scheduler.Wake()
+		}
+	}
+
+	scheduler.Stop()
+	return false, 0
+}
+
+// RunService runs the scheduler as a Windows service, with logs written to the event log.  If the process is not
+// started by the service manager, the scheduler runs in the foreground.
+func RunService(options ServiceOptions) bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		LOG_ERROR("SERVICE_RUN", "Failed to determine if the process is running as a service: %v", err)
+		return false
+	}
+	if interactive {
+		return runServiceInForeground(options)
+	}
+
+	serviceEventLog, err = eventlog.Open(options.Name)
+	if err == nil {
+		eventLogEnabled = true
+		defer func() {
+			logMutex.Lock()
+			eventLogEnabled = false
+			logMutex.Unlock()
+			serviceEventLog.Close()
+		}()
+	}
+
+	err = svc.Run(options.Name, &windowsService{options: options})
+	if err != nil {
+		LOG_ERROR("SERVICE_RUN", "Failed to run the service %s: %v", options.Name, err)
+		return false
+	}
+	return true
+}
+
+// writeEventLogRecord writes a log message to the event log, returning false if it can't be written so the caller
+// can write it to the standard output instead.  Progress messages are not written.  The caller must hold logMutex.
+func writeEventLogRecord(level int, logID string, message string) bool {
+	if getJSONRecordType(level, logID) == "progress" {
+		return true
+	}
+	message = logID + " " + message
+	var err error
+	switch {
+	case level >= ERROR:
+		err = serviceEventLog.Error(1, message)
+	case level == WARN:
+		err = serviceEventLog.Warning(1, message)
+	default:
+		err = serviceEventLog.Info(1, message)
+	}
+	return err == nil
+}
+
+// isOnBattery returns true if the computer is not connected to AC power.
+func isOnBattery() bool {
+	var status systemPowerStatus
+	result, _, _ := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status)))
+	return result != 0 && status.ACLineStatus == 0
+}
+
+// isNetworkMetered returns true if the network connection has a fixed or variable cost, as reported by
+// GetNetworkConnectivityHint, which is only available on Windows 10 version 2004 and later.
+func isNetworkMetered() bool {
+	if procGetNetworkConnectivityHint.Find() != nil {
+		return false
+	}
+	var hint networkConnectivityHint
+	result, _, _ := procGetNetworkConnectivityHint.Call(uintptr(unsafe.Pointer(&hint)))
+	if result != 0 {
+		return false
+	}
+	return hint.ConnectivityCost == NetworkConnectivityCostHintFixed ||
+		hint.ConnectivityCost == NetworkConnectivityCostHintVariable
+}
@@ -5,6 +5,7 @@
 package duplicacy
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math/rand"
@@ -28,9 +29,10 @@ type SFTPStorage struct {
 	minimumNesting  int // The minimum level of directories to dive into before searching for the chunk file.
 	storageDir      string
 	numberOfThreads int
-	numberOfTries   int
+	retryPolicy     *RetryPolicy
 	serverAddress   string
 	sftpConfig      *ssh.ClientConfig
+	network         *NetworkOptions
 }
 
 func CreateSFTPStorageWithPassword(server string, port int, username string, storageDir string,
@@ -75,7 +77,8 @@ func CreateSFTPStorage(compatibilityMode bool, server string, port int, username
 	}
 
 	serverAddress := fmt.Sprintf("%s:%d", server, port)
-	connection, err := ssh.Dial("tcp", serverAddress, sftpConfig)
+	network := getStorageNetwork()
+	connection, err := dialSSH(network, serverAddress, sftpConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -104,9 +107,10 @@ func CreateSFTPStorage(compatibilityMode bool, server string, port int, username
 		storageDir:      storageDir,
 		minimumNesting:  minimumNesting,
 		numberOfThreads: threads,
-		numberOfTries:   8,
+		retryPolicy:     CreateRetryPolicy(9, 1, 0, 0),
 		serverAddress:   serverAddress,
 		sftpConfig:      sftpConfig,
+		network:         network,
 	}
 
 	// Random number fo generating the temporary chunk file suffix.
@@ -119,6 +123,20 @@ func CreateSFTPStorage(compatibilityMode bool, server string, port int, username
 	return storage, nil
 }
 
+// dialSSH connects to the SFTP server at 'address' by the network options, which may be nil.
+func dialSSH(network *NetworkOptions, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	connection, err := network.DialContext(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	sshConnection, channels, requests, err := ssh.NewClientConn(connection, address, config)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConnection, channels, requests), nil
+}
+
 func CloseSFTPStorage(storage *SFTPStorage) {
 	if storage.client != nil {
 		storage.client.Close()
@@ -132,35 +150,38 @@ func (storage *SFTPStorage) getSFTPClient() *sftp.Client {
 	return storage.client
 }
 
-func (storage *SFTPStorage) retry(f func() error) error {
-	delay := time.Second
-	for i := 0; ; i++ {
+// SetRetryPolicy replaces the settings of the default retry policy with the non-zero ones of 'policy'.
+func (storage *SFTPStorage) SetRetryPolicy(policy *RetryPolicy) {
+	storage.retryPolicy = storage.retryPolicy.override(policy)
+}
+
+// retry calls 'f' until it succeeds or fails with an error other than a lost connection, which is restored before
+// each retry.
+func (storage *SFTPStorage) retry(class string, operation string, f func() error) error {
+	retryState := storage.retryPolicy.startRequest(storage.GetContext(), "SFTP", class, operation)
+	for {
 		err := f()
-		if err != nil && strings.Contains(err.Error(), "EOF") && i < storage.numberOfTries {
-			LOG_WARN("SFTP_RETRY", "Encountered an error (%v); retry after %d second(s)", err, delay/time.Second)
-			time.Sleep(delay)
-			delay *= 2
-
-			storage.clientLock.Lock()
-			connection, err := ssh.Dial("tcp", storage.serverAddress, storage.sftpConfig)
-			if err != nil {
-				LOG_WARN("SFT_RECONNECT", "Failed to connect to %s: %v; retrying", storage.serverAddress, err)
-				storage.clientLock.Unlock()
-				continue
-			}
+		if err == nil || !strings.Contains(err.Error(), "EOF") || !retryState.retry(err, 0) {
+			return err
+		}
 
-			client, err := sftp.NewClient(connection)
-			if err != nil {
-				LOG_WARN("SFT_RECONNECT", "Failed to create a new SFTP client to %s: %v; retrying", storage.serverAddress, err)
-				connection.Close()
-				storage.clientLock.Unlock()
-				continue
-			}
-			storage.client = client
+		storage.clientLock.Lock()
+		connection, err := dialSSH(storage.network, storage.serverAddress, storage.sftpConfig)
+		if err != nil {
+			LOG_WARN("SFT_RECONNECT", "Failed to connect to %s: %v; retrying", storage.serverAddress, err)
 			storage.clientLock.Unlock()
 			continue
 		}
-		return err
+
+		client, err := sftp.NewClient(connection)
+		if err != nil {
+			LOG_WARN("SFT_RECONNECT", "Failed to create a new SFTP client to %s: %v; retrying", storage.serverAddress, err)
+			connection.Close()
+			storage.clientLock.Unlock()
+			continue
+		}
+		storage.client = client
+		storage.clientLock.Unlock()
 	}
 }
 
@@ -168,7 +189,7 @@ func (storage *SFTPStorage) retry(f func() error) error {
 func (storage *SFTPStorage) ListFiles(threadIndex int, dirPath string) (files []string, sizes []int64, err error) {
 
 	var entries []os.FileInfo
-	err = storage.retry(func() error {
+	err = storage.retry(RetryClassList, "listing of "+dirPath, func() error {
 		entries, err = storage.getSFTPClient().ReadDir(path.Join(storage.storageDir, dirPath))
 		return err
 	})
@@ -193,7 +214,7 @@ func (storage *SFTPStorage) ListFiles(threadIndex int, dirPath string) (files []
 func (storage *SFTPStorage) DeleteFile(threadIndex int, filePath string) (err error) {
 	fullPath := path.Join(storage.storageDir, filePath)
 	var fileInfo os.FileInfo
-	err = storage.retry(func() error {
+	err = storage.retry(RetryClassOther, "stat of "+filePath, func() error {
 		fileInfo, err = storage.getSFTPClient().Stat(fullPath)
 		return err
 	})
@@ -207,21 +228,21 @@ func (storage *SFTPStorage) DeleteFile(threadIndex int, filePath string) (err er
 	if fileInfo == nil {
 		return nil
 	}
-	return storage.retry(func() error { return storage.getSFTPClient().Remove(path.Join(storage.storageDir, filePath)) })
+	return storage.retry(RetryClassDelete, "deletion of "+filePath, func() error { return storage.getSFTPClient().Remove(path.Join(storage.storageDir, filePath)) })
 }
 
 // MoveFile renames the file.
 func (storage *SFTPStorage) MoveFile(threadIndex int, from string, to string) (err error) {
 	toPath := path.Join(storage.storageDir, to)
 	var fileInfo os.FileInfo
-	err = storage.retry(func() error {
+	err = storage.retry(RetryClassOther, "stat of "+to, func() error {
 		fileInfo, err = storage.getSFTPClient().Stat(toPath)
 		return err
 	})
 	if fileInfo != nil {
 		return fmt.Errorf("The destination file %s already exists", toPath)
 	}
-	err = storage.retry(func() error {
+	err = storage.retry(RetryClassOther, "renaming of "+from, func() error {
 		return storage.getSFTPClient().Rename(path.Join(storage.storageDir, from),
 			path.Join(storage.storageDir, to))
 	})
@@ -232,20 +253,20 @@ func (storage *SFTPStorage) MoveFile(threadIndex int, from string, to string) (e
 func (storage *SFTPStorage) CreateDirectory(threadIndex int, dirPath string) (err error) {
 	fullPath := path.Join(storage.storageDir, dirPath)
 	var fileInfo os.FileInfo
-	err = storage.retry(func() error {
+	err = storage.retry(RetryClassOther, "stat of "+dirPath, func() error {
 		fileInfo, err = storage.getSFTPClient().Stat(fullPath)
 		return err
 	})
 	if fileInfo != nil && fileInfo.IsDir() {
 		return nil
 	}
-	return storage.retry(func() error { return storage.getSFTPClient().Mkdir(path.Join(storage.storageDir, dirPath)) })
+	return storage.retry(RetryClassOther, "creation of "+dirPath, func() error { return storage.getSFTPClient().Mkdir(path.Join(storage.storageDir, dirPath)) })
 }
 
 // GetFileInfo returns the information about the file or directory at 'filePath'.
 func (storage *SFTPStorage) GetFileInfo(threadIndex int, filePath string) (exist bool, isDir bool, size int64, err error) {
 	var fileInfo os.FileInfo
-	err = storage.retry(func() error {
+	err = storage.retry(RetryClassOther, "stat of "+filePath, func() error {
 		fileInfo, err = storage.getSFTPClient().Stat(path.Join(storage.storageDir, filePath))
 		return err
 	})
@@ -267,7 +288,7 @@ func (storage *SFTPStorage) GetFileInfo(threadIndex int, filePath string) (exist
 
 // DownloadFile reads the file at 'filePath' into the chunk.
 func (storage *SFTPStorage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
-	return storage.retry(func() error {
+	return storage.retry(RetryClassDownload, "download of "+filePath, func() error {
 		file, err := storage.getSFTPClient().Open(path.Join(storage.storageDir, filePath))
 
 		if err != nil {
@@ -289,7 +310,7 @@ func (storage *SFTPStorage) UploadFile(threadIndex int, filePath string, content
 
 	dirs := strings.Split(filePath, "/")
 	fullDir := path.Dir(fullPath)
-	return storage.retry(func() error {
+	return storage.retry(RetryClassUpload, "upload of "+filePath, func() error {
 
 		if len(dirs) > 1 {
 			_, err := storage.getSFTPClient().Stat(fullDir)
@@ -4,10 +4,12 @@
 
 // +build !windows
 // +build !darwin
+// +build !linux
 
 package duplicacy
 
-func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int) (shadowTop string) {
+func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int,
+	options ShadowCopyOptions) (shadowTop string) {
 	return top
 }
 
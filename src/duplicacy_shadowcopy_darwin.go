@@ -10,16 +10,19 @@ package duplicacy
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"regexp"
+	"strings"
 	"syscall"
 	"time"
 )
 
 var snapshotPath string
 var snapshotDate string
+var snapshotMounted bool
 
 // Converts char array to string
 func CharsToString(ca []int8) string {
@@ -74,63 +77,107 @@ func DeleteShadowCopy() {
 		return
 	}
 
-	err := exec.Command("/sbin/umount", "-f", snapshotPath).Run()
-	if err != nil {
-		LOG_WARN("VSS_DELETE", "Error while unmounting snapshot: %v", err)
-		return
+	mounted := snapshotMounted
+	if snapshotMounted {
+		err := exec.Command("/sbin/umount", "-f", snapshotPath).Run()
+		if err != nil {
+			LOG_WARN("VSS_DELETE", "Error while unmounting snapshot: %v", err)
+			return
+		}
+		snapshotMounted = false
 	}
 
-	err = exec.Command("tmutil", "deletelocalsnapshots", snapshotDate).Run()
-	if err != nil {
-		LOG_WARN("VSS_DELETE", "Error while deleting local snapshot: %v", err)
-		return
+	if snapshotDate != "" {
+		err := exec.Command("tmutil", "deletelocalsnapshots", snapshotDate).Run()
+		if err != nil {
+			LOG_WARN("VSS_DELETE", "Error while deleting local snapshot: %v", err)
+			return
+		}
+		snapshotDate = ""
 	}
 
-	err = os.RemoveAll(snapshotPath)
+	err := os.RemoveAll(snapshotPath)
 	if err != nil {
 		LOG_WARN("VSS_DELETE", "Error while deleting temporary mount directory: %v", err)
 		return
 	}
 
-	LOG_INFO("VSS_DELETE", "Shadow copy unmounted and deleted at %s", snapshotPath)
+	if mounted {
+		LOG_INFO("VSS_DELETE", "Shadow copy unmounted and deleted at %s", snapshotPath)
+	}
 
 	snapshotPath = ""
 }
 
-func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int) (shadowTop string) {
+// getVolumeMountPoint returns the mount point of the volume containing the path.  On macOS 10.15 or later, paths
+// such as /Users are firmlinks into the data volume mounted at /System/Volumes/Data.
+func getVolumeMountPoint(path string) (mountPoint string, fileSystem string, err error) {
+	stat := syscall.Statfs_t{}
+	err = syscall.Statfs(path, &stat)
+	if err != nil {
+		return "", "", err
+	}
+	return CharsToString(stat.Mntonname[:]), CharsToString(stat.Fstypename[:]), nil
+}
+
+// createLocalSnapshot takes an APFS local snapshot with tmutil and returns the snapshot date.
+func createLocalSnapshot(timeoutInSeconds int, retries int) (date string, err error) {
+
+	snapshotDateRegex := regexp.MustCompile(`:\s+([0-9\-]+)`)
+	for attempt := 0; ; attempt++ {
+		var tmutilOutput string
+		tmutilOutput, err = CommandWithTimeout(timeoutInSeconds, "tmutil", "snapshot")
+		if err != nil {
+			err = fmt.Errorf("Error while calling tmutil: %v", err)
+		} else if matched := snapshotDateRegex.FindStringSubmatch(tmutilOutput); matched == nil {
+			err = fmt.Errorf("Snapshot creation failed: %s", tmutilOutput)
+		} else {
+			return matched[1], nil
+		}
+
+		if attempt >= retries {
+			return "", err
+		}
+		delay := 10 * (attempt + 1)
+		LOG_WARN("VSS_RETRY", "%v; retrying in %d seconds", err, delay)
+		time.Sleep(time.Duration(delay) * time.Second)
+	}
+}
+
+// CreateShadowCopy creates an APFS local snapshot of the volume containing the repository, mounts it read-only, and
+// returns the path of the repository in the mounted snapshot.  The snapshot is unmounted and deleted by
+// DeleteShadowCopy.
+func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int,
+	options ShadowCopyOptions) (shadowTop string) {
 
 	if !shadowCopy {
 		return top
 	}
 
 	// Check repository filesystem is APFS
-	stat := syscall.Statfs_t{}
-	err := syscall.Statfs(top, &stat)
+	mountPoint, fileSystem, err := getVolumeMountPoint(top)
 	if err != nil {
 		LOG_ERROR("VSS_INIT", "Unable to determine filesystem of repository path")
 		return top
 	}
-	if CharsToString(stat.Fstypename[:]) != "apfs" {
+	if fileSystem != "apfs" {
 		LOG_WARN("VSS_INIT", "VSS requires APFS filesystem")
 		return top
 	}
 
-	// Check path is local as tmutil snapshots will not support APFS formatted external drives
-	deviceIdLocal, err := GetPathDeviceId("/")
-	if err != nil {
-		LOG_ERROR("VSS_INIT", "Unable to get device ID of path: /")
-		return top
-	}
-	deviceIdRepository, err := GetPathDeviceId(top)
-	if err != nil {
-		LOG_ERROR("VSS_INIT", "Unable to get device ID of path: %s", top)
-		return top
-	}
-	if deviceIdLocal != deviceIdRepository {
+	// tmutil only creates local snapshots for the boot volume group, so snapshots of APFS formatted external
+	// drives are not supported
+	if mountPoint != "/" && mountPoint != "/System/Volumes/Data" {
 		LOG_WARN("VSS_PATH", "VSS not supported for non-local repository path: %s", top)
 		return top
 	}
 
+	// The path of the repository relative to the root of the snapshot
+	relativeTop := top
+	if mountPoint != "/" && strings.HasPrefix(top, mountPoint+"/") {
+		relativeTop = top[len(mountPoint):]
+	}
+
 	if timeoutInSeconds <= 60 {
 		timeoutInSeconds = 60
 	}
@@ -143,44 +190,40 @@ func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int) (shadow
 	}
 
 	// Use tmutil to create snapshot
-	tmutilOutput, err := CommandWithTimeout(timeoutInSeconds, "tmutil", "snapshot")
+	snapshotDate, err = createLocalSnapshot(timeoutInSeconds, options.Retries)
 	if err != nil {
-		LOG_ERROR("VSS_CREATE", "Error while calling tmutil: %v", err)
-		return top
-	}
-
-	snapshotDateRegex := regexp.MustCompile(`:\s+([0-9\-]+)`)
-	matched := snapshotDateRegex.FindStringSubmatch(tmutilOutput)
-	if matched == nil {
-		LOG_ERROR("VSS_CREATE", "Snapshot creation failed: %s", tmutilOutput)
+		DeleteShadowCopy()
+		LOG_ERROR("VSS_CREATE", "%v", err)
 		return top
 	}
-	snapshotDate = matched[1]
 
-	tmutilOutput, err = CommandWithTimeout(timeoutInSeconds, "tmutil", "listlocalsnapshots", ".")
+	tmutilOutput, err := CommandWithTimeout(timeoutInSeconds, "tmutil", "listlocalsnapshots", mountPoint)
 	if err != nil {
+		DeleteShadowCopy()
 		LOG_ERROR("VSS_CREATE", "Error while calling 'tmutil listlocalsnapshots': %v", err)
 		return top
 	}
 	snapshotName := "com.apple.TimeMachine." + snapshotDate
- 
+
 	snapshotNameRegex := regexp.MustCompile(`(?m)^(.+` + snapshotDate + `.*)$`)
-	matched = snapshotNameRegex.FindStringSubmatch(tmutilOutput)
+	matched := snapshotNameRegex.FindStringSubmatch(tmutilOutput)
 	if len(matched) > 0 {
-		snapshotName = matched[0]
+		snapshotName = strings.TrimSpace(matched[0])
 	} else {
 		LOG_INFO("VSS_CREATE", "Can't find the snapshot name with 'tmutil listlocalsnapshots'; fallback to %s", snapshotName)
 	}
- 
+
 	// Mount snapshot as readonly and hide from GUI i.e. Finder
 	_, err = CommandWithTimeout(timeoutInSeconds,
-		"/sbin/mount", "-t", "apfs", "-o", "nobrowse,-r,-s="+snapshotName, "/System/Volumes/Data", snapshotPath)
+		"/sbin/mount", "-t", "apfs", "-o", "nobrowse,-r,-s="+snapshotName, mountPoint, snapshotPath)
 	if err != nil {
+		DeleteShadowCopy()
 		LOG_ERROR("VSS_CREATE", "Error while mounting snapshot: %v", err)
 		return top
 	}
+	snapshotMounted = true
 
 	LOG_INFO("VSS_DONE", "Shadow copy created and mounted at %s", snapshotPath)
 
-	return snapshotPath + top
+	return snapshotPath + relativeTop
 }
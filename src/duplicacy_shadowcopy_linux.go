@@ -0,0 +1,332 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linuxSnapshot describes the snapshot created for the backup, so it can be removed afterwards.
+type linuxSnapshot struct {
+	method     string // lvm, btrfs, or zfs
+	name       string // the snapshot as known to the tool that created it
+	mountPoint string // where the snapshot is mounted, if mounted by us
+	path       string // the directory where the snapshot is accessible
+}
+
+var currentSnapshot *linuxSnapshot
+
+// mountInfo is a line in /proc/self/mountinfo.
+type mountInfo struct {
+	mountPoint string
+	root       string // the path of the mount point within the file system
+	fileSystem string
+	source     string
+}
+
+// unescapeMountPath decodes the octal escapes, such as \040 for a space, used by the mount table.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var result []byte
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				result = append(result, byte(c))
+				i += 3
+				continue
+			}
+		}
+		result = append(result, path[i])
+	}
+	return string(result)
+}
+
+// findMount returns the mount that contains the path.
+func findMount(path string) (*mountInfo, error) {
+
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var found *mountInfo
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+2 >= len(fields) {
+			continue
+		}
+
+		mount := &mountInfo{
+			root:       unescapeMountPath(fields[3]),
+			mountPoint: unescapeMountPath(fields[4]),
+			fileSystem: fields[separator+1],
+			source:     unescapeMountPath(fields[separator+2]),
+		}
+
+		if mount.mountPoint != "/" && path != mount.mountPoint && !strings.HasPrefix(path, mount.mountPoint+"/") {
+			continue
+		}
+		// Later entries override earlier ones mounted at the same place
+		if found == nil || len(mount.mountPoint) >= len(found.mountPoint) {
+			found = mount
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no mount point found for %s", path)
+	}
+	return found, scanner.Err()
+}
+
+// runSnapshotCommand runs the command with a timeout and returns its output.
+func runSnapshotCommand(timeoutInSeconds int, name string, arg ...string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutInSeconds)*time.Second)
+	defer cancel()
+
+	LOG_DEBUG("VSS_COMMAND", "Running %s %s", name, strings.Join(arg, " "))
+	output, err := exec.CommandContext(ctx, name, arg...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return string(output), fmt.Errorf("command '%s' timed out", name)
+	}
+	if err != nil {
+		return string(output), fmt.Errorf("command '%s' failed: %v %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// detectSnapshotMethod selects the snapshot method according to the file system and the device of the mount.
+func detectSnapshotMethod(mount *mountInfo) string {
+	switch {
+	case mount.fileSystem == "btrfs":
+		return "btrfs"
+	case mount.fileSystem == "zfs":
+		return "zfs"
+	case strings.HasPrefix(mount.source, "/dev/mapper/") || strings.HasPrefix(mount.source, "/dev/dm-"):
+		return "lvm"
+	}
+	return ""
+}
+
+func DeleteShadowCopy() {
+
+	snapshot := currentSnapshot
+	if snapshot == nil {
+		return
+	}
+	currentSnapshot = nil
+
+	timeout := 60
+	if snapshot.mountPoint != "" {
+		_, err := runSnapshotCommand(timeout, "umount", snapshot.mountPoint)
+		if err != nil {
+			LOG_WARN("VSS_DELETE", "Error while unmounting the snapshot: %v", err)
+			return
+		}
+		os.Remove(snapshot.mountPoint)
+	}
+
+	var err error
+	switch snapshot.method {
+	case "lvm":
+		_, err = runSnapshotCommand(timeout, "lvremove", "-f", snapshot.name)
+	case "btrfs":
+		_, err = runSnapshotCommand(timeout, "btrfs", "subvolume", "delete", snapshot.name)
+		if err == nil {
+			os.Remove(filepath.Dir(snapshot.name))
+		}
+	case "zfs":
+		_, err = runSnapshotCommand(timeout, "zfs", "destroy", snapshot.name)
+	}
+	if err != nil {
+		LOG_WARN("VSS_DELETE", "Error while deleting the %s snapshot %s: %v", snapshot.method, snapshot.name, err)
+		return
+	}
+
+	LOG_INFO("VSS_DELETE", "The %s snapshot %s has been deleted", snapshot.method, snapshot.name)
+}
+
+// CreateShadowCopy creates a snapshot of the volume containing the repository with LVM, btrfs, or ZFS, and returns
+// the path of the repository in the snapshot.  The method is taken from options.Method, or detected from the file
+// system if not specified.  LVM snapshots are mounted read-only in a temporary directory, btrfs snapshots are
+// created as read-only subvolumes, and ZFS snapshots are accessed through the .zfs/snapshot directory.
+func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int,
+	options ShadowCopyOptions) (shadowTop string) {
+
+	if !shadowCopy || options.Method == "none" {
+		return top
+	}
+
+	if timeoutInSeconds <= 60 {
+		timeoutInSeconds = 60
+	}
+
+	resolvedTop, err := filepath.EvalSymlinks(top)
+	if err != nil {
+		LOG_ERROR("VSS_PATH", "Invalid repository path: %v", err)
+		return top
+	}
+
+	mount, err := findMount(resolvedTop)
+	if err != nil {
+		LOG_ERROR("VSS_INIT", "Unable to find the volume containing the repository: %v", err)
+		return top
+	}
+	LOG_DEBUG("VSS_INIT", "%s is on %s mounted at %s (%s)", resolvedTop, mount.source, mount.mountPoint,
+		mount.fileSystem)
+
+	method := options.Method
+	if method == "" {
+		method = detectSnapshotMethod(mount)
+		if method == "" {
+			LOG_WARN("VSS_INIT", "Snapshots are not supported for the %s file system on %s", mount.fileSystem,
+				mount.source)
+			return top
+		}
+	}
+
+	// The path of the repository relative to the root of the snapshot
+	relativeTop := strings.TrimPrefix(resolvedTop, mount.mountPoint)
+	if mount.mountPoint == "/" {
+		relativeTop = resolvedTop
+	}
+
+	snapshotName := fmt.Sprintf("duplicacy-%d-%d", time.Now().Unix(), os.Getpid())
+
+	for attempt := 0; ; attempt++ {
+		var snapshot *linuxSnapshot
+		snapshot, err = createLinuxSnapshot(method, mount, snapshotName, timeoutInSeconds, options.SnapshotSize)
+		if err == nil {
+			currentSnapshot = snapshot
+			LOG_INFO("VSS_DONE", "The %s snapshot %s has been created at %s", method, snapshot.name, snapshot.path)
+			return filepath.Join(snapshot.path, relativeTop)
+		}
+
+		if attempt >= options.Retries {
+			LOG_ERROR("VSS_CREATE", "Failed to create the %s snapshot: %v", method, err)
+			return top
+		}
+		delay := 10 * (attempt + 1)
+		LOG_WARN("VSS_RETRY", "Failed to create the %s snapshot: %v; retrying in %d seconds", method, err, delay)
+		time.Sleep(time.Duration(delay) * time.Second)
+	}
+}
+
+// createLinuxSnapshot makes one attempt to create the snapshot with the specified method.  Anything created is cleaned
+// up if the attempt fails.
+func createLinuxSnapshot(method string, mount *mountInfo, name string, timeoutInSeconds int,
+	size string) (*linuxSnapshot, error) {
+
+	snapshot := &linuxSnapshot{method: method}
+
+	switch method {
+	case "btrfs":
+		// The snapshot must be on the same file system; it only contains the subvolume mounted at the mount point
+		directory := filepath.Join(mount.mountPoint, ".duplicacy-snapshot")
+		err := os.MkdirAll(directory, 0700)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.name = filepath.Join(directory, name)
+		_, err = runSnapshotCommand(timeoutInSeconds, "btrfs", "subvolume", "snapshot", "-r", mount.mountPoint,
+			snapshot.name)
+		if err != nil {
+			os.Remove(directory)
+			return nil, err
+		}
+		snapshot.path = snapshot.name
+
+	case "zfs":
+		snapshot.name = mount.source + "@" + name
+		_, err := runSnapshotCommand(timeoutInSeconds, "zfs", "snapshot", snapshot.name)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.path = filepath.Join(mount.mountPoint, ".zfs", "snapshot", name)
+		if _, err = os.Stat(snapshot.path); err != nil {
+			currentSnapshot = snapshot
+			DeleteShadowCopy()
+			return nil, fmt.Errorf("the snapshot is not accessible at %s: %v", snapshot.path, err)
+		}
+
+	case "lvm":
+		output, err := runSnapshotCommand(timeoutInSeconds, "lvs", "--noheadings", "--separator", "|",
+			"-o", "vg_name,lv_name,pool_lv", mount.source)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Split(strings.TrimSpace(output), "|")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s is not a logical volume", mount.source)
+		}
+		volumeGroup, logicalVolume := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		thin := len(fields) > 2 && strings.TrimSpace(fields[2]) != ""
+
+		arguments := []string{"-s", "-n", name}
+		if thin {
+			// Thin snapshots are not activated by default
+			arguments = append(arguments, "-kn")
+		} else if size != "" {
+			arguments = append(arguments, "-L", size)
+		} else {
+			arguments = append(arguments, "-l", "10%ORIGIN")
+		}
+		arguments = append(arguments, volumeGroup+"/"+logicalVolume)
+		_, err = runSnapshotCommand(timeoutInSeconds, "lvcreate", arguments...)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.name = volumeGroup + "/" + name
+
+		snapshot.mountPoint, err = ioutil.TempDir("", "duplicacy_snapshot_")
+		if err != nil {
+			currentSnapshot = snapshot
+			DeleteShadowCopy()
+			return nil, err
+		}
+
+		mountOptions := "ro"
+		if mount.fileSystem == "xfs" {
+			// The snapshot has the same uuid as the origin
+			mountOptions += ",nouuid"
+		}
+		_, err = runSnapshotCommand(timeoutInSeconds, "mount", "-o", mountOptions, "/dev/"+snapshot.name,
+			snapshot.mountPoint)
+		if err != nil {
+			os.Remove(snapshot.mountPoint)
+			snapshot.mountPoint = ""
+			currentSnapshot = snapshot
+			DeleteShadowCopy()
+			return nil, err
+		}
+		// The mount may be a bind mount of a directory in the file system
+		snapshot.path = filepath.Join(snapshot.mountPoint, mount.root)
+
+	default:
+		return nil, fmt.Errorf("unknown snapshot method '%s'", method)
+	}
+
+	return snapshot, nil
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"testing"
+)
+
+func TestUnescapeMountPath(t *testing.T) {
+	for escaped, expected := range map[string]string{
+		"/mnt/data":           "/mnt/data",
+		`/mnt/my\040disk`:     "/mnt/my disk",
+		`/mnt/tab\011and\134`: "/mnt/tab\tand\\",
+		`/mnt/not\08escaped`:  `/mnt/not\08escaped`,
+	} {
+		if unescaped := unescapeMountPath(escaped); unescaped != expected {
+			t.Errorf("%s was unescaped to %s; expected %s", escaped, unescaped, expected)
+		}
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	mount, err := findMount("/")
+	if err != nil {
+		t.Fatalf("Failed to find the mount for /: %v", err)
+	}
+	if mount.mountPoint != "/" {
+		t.Errorf("The mount point of / is %s", mount.mountPoint)
+	}
+}
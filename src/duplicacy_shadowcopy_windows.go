@@ -5,8 +5,12 @@
 package duplicacy
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
@@ -221,6 +225,22 @@ func (vss *IVSS) DoSnapshotSet() (int, *IVSSAsync) {
 	}
 }
 
+func (vss *IVSS) AbortBackup() int {
+	ret, _, _ := syscall.Syscall(vss.VTable().abortBackup, 1, uintptr(unsafe.Pointer(vss)), 0, 0)
+	return int(ret)
+}
+
+func (vss *IVSS) DisableWriterClasses(writerClassIDs []ole.GUID) int {
+	if len(writerClassIDs) == 0 {
+		return 0
+	}
+	ret, _, _ := syscall.Syscall(vss.VTable().disableWriterClasses, 3,
+		uintptr(unsafe.Pointer(vss)),
+		uintptr(unsafe.Pointer(&writerClassIDs[0])),
+		uintptr(len(writerClassIDs)))
+	return int(ret)
+}
+
 type SnapshotProperties struct {
 	SnapshotID           ole.GUID
 	SnapshotSetID        ole.GUID
@@ -327,33 +347,189 @@ func getIVSS(unknown *ole.IUnknown, iid *ole.GUID) (ivss *IVSS) {
 }
 
 var vssBackupComponent *IVSS
-var snapshotID ole.GUID
-var shadowLink string
+var snapshotIDs []ole.GUID
+var shadowLinks []string
+
+// Top-level symbolic links and junctions are followed by the backup.  When their targets are on other volumes, paths
+// under them are redirected to the shadow copies of those volumes; see redirectToShadowCopy.
+var shadowCopyTop string
+var shadowCopyRedirects map[string]string
+
+const E_ACCESSDENIED = 0x80070005
+
+// shadowCopyVolume is a volume to be included in the snapshot set, along with the top-level links that point into it.
+type shadowCopyVolume struct {
+	path  string            // the volume path name, such as C:\ or \\?\Volume{...}\
+	links map[string]string // link name => path of the link target relative to the volume path
+}
 
 func DeleteShadowCopy() {
-	if vssBackupComponent != nil {
-		defer vssBackupComponent.Release()
+	releaseShadowCopy()
+	ole.CoUninitialize()
+}
 
-		LOG_TRACE("VSS_DELETE", "Deleting the shadow copy used for this backup")
-		ret, _, _ := vssBackupComponent.DeleteSnapshots(snapshotID)
-		if ret != 0 {
-			LOG_WARN("VSS_DELETE", "Failed to delete the shadow copy: %x\n", uint(ret))
-		} else {
-			LOG_INFO("VSS_DELETE", "The shadow copy has been successfully deleted")
+// releaseShadowCopy deletes all shadow copies in the snapshot set and removes the symbolic links to them.
+func releaseShadowCopy() {
+	if vssBackupComponent != nil {
+		for _, snapshotID := range snapshotIDs {
+			LOG_TRACE("VSS_DELETE", "Deleting the shadow copy used for this backup")
+			ret, _, _ := vssBackupComponent.DeleteSnapshots(snapshotID)
+			if ret != 0 {
+				LOG_WARN("VSS_DELETE", "Failed to delete the shadow copy: %x\n", uint(ret))
+			} else {
+				LOG_INFO("VSS_DELETE", "The shadow copy has been successfully deleted")
+			}
 		}
+		vssBackupComponent.Release()
+		vssBackupComponent = nil
 	}
+	snapshotIDs = nil
 
-	if shadowLink != "" {
+	for _, shadowLink := range shadowLinks {
 		err := os.Remove(shadowLink)
 		if err != nil {
 			LOG_WARN("VSS_SYMLINK", "Failed to remove the symbolic link for the shadow copy: %v", err)
 		}
 	}
+	shadowLinks = nil
+	shadowCopyTop = ""
+	shadowCopyRedirects = nil
+}
 
-	ole.CoUninitialize()
+// redirectToShadowCopy is called by joinPath to replace a path under a top-level link with the corresponding path in
+// the shadow copy of the volume the link points to.  The link itself is not redirected, so that it can still be read.
+func redirectToShadowCopy(components []string) []string {
+	if len(shadowCopyRedirects) == 0 || len(components) < 2 || components[0] != shadowCopyTop {
+		return components
+	}
+
+	relativePath := components[1]
+	i := strings.IndexAny(relativePath, `/\`)
+	if i <= 0 {
+		return components
+	}
+
+	target, found := shadowCopyRedirects[strings.ToLower(relativePath[:i])]
+	if !found {
+		return components
+	}
+
+	return append([]string{target, relativePath[i+1:]}, components[2:]...)
+}
+
+// getVolumePathName returns the mount point of the volume where the file is located.
+func getVolumePathName(file string) (string, error) {
+	procGetVolumePathName := syscall.NewLazyDLL("kernel32.dll").NewProc("GetVolumePathNameW")
+
+	file = strings.Replace(file, "/", "\\", -1)
+	if strings.HasPrefix(file, `\??\`) {
+		file = `\\?\` + file[4:]
+	}
+
+	buffer := make([]uint16, syscall.MAX_LONG_PATH)
+	r, _, err := procGetVolumePathName.Call(uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(file))),
+		uintptr(unsafe.Pointer(&buffer[0])), uintptr(len(buffer)))
+	if r == 0 {
+		return "", err
+	}
+	return syscall.UTF16ToString(buffer), nil
+}
+
+// listShadowCopyVolumes finds the volumes that the repository spans: the volume of the repository itself and those
+// reached via the top-level symbolic links, junctions, and mount points.
+func listShadowCopyVolumes(top string) (volumes []*shadowCopyVolume) {
+
+	topVolume := top[:1] + ":\\"
+	volumes = append(volumes, &shadowCopyVolume{path: topVolume})
+
+	files, err := ioutil.ReadDir(top)
+	if err != nil {
+		LOG_WARN("VSS_VOLUME", "Failed to list the repository %s: %v", top, err)
+		return volumes
+	}
+
+	normalizedTop := strings.ToLower(filepath.Clean(top)) + "\\"
+	for _, f := range files {
+		if f.Mode()&(os.ModeSymlink|os.ModeIrregular) == 0 {
+			continue
+		}
+
+		isRegular, link, err := Readlink(joinPath(top, f.Name()))
+		if err != nil || isRegular {
+			continue
+		}
+		if strings.HasPrefix(link, `\??\`) {
+			link = `\\?\` + link[4:]
+		}
+		if !filepath.IsAbs(link) && !strings.HasPrefix(link, `\\`) {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(link)+"\\", normalizedTop) {
+			continue
+		}
+
+		volumePath, err := getVolumePathName(link)
+		if err != nil {
+			LOG_WARN("VSS_VOLUME", "Failed to find the volume of %s: %v", link, err)
+			continue
+		}
+		if strings.HasPrefix(volumePath, `\\`) && !strings.HasPrefix(volumePath, `\\?\Volume`) {
+			LOG_INFO("VSS_VOLUME", "No shadow copy will be created for the network share %s", volumePath)
+			continue
+		}
+
+		var volume *shadowCopyVolume
+		for _, existing := range volumes {
+			if strings.EqualFold(existing.path, volumePath) {
+				volume = existing
+				break
+			}
+		}
+		if volume == nil {
+			volume = &shadowCopyVolume{path: volumePath}
+			volumes = append(volumes, volume)
+		}
+		if volume == volumes[0] {
+			// Links to the same volume are already covered by the shadow copy of the repository
+			continue
+		}
+		if volume.links == nil {
+			volume.links = make(map[string]string)
+		}
+		relativePath := ""
+		if len(link) > len(volumePath) {
+			relativePath = link[len(volumePath):]
+		}
+		volume.links[strings.ToLower(f.Name())] = relativePath
+		LOG_DEBUG("VSS_VOLUME", "%s points to the volume %s", f.Name(), volumePath)
+	}
+
+	return volumes
+}
+
+// parseWriterClassIDs converts writer class ids, with or without braces, to GUIDs.
+func parseWriterClassIDs(writers []string) (ids []ole.GUID) {
+	for _, writer := range writers {
+		writer = strings.TrimSpace(writer)
+		if !strings.HasPrefix(writer, "{") {
+			writer = "{" + writer + "}"
+		}
+		id, err := ole.IIDFromString(writer)
+		if err != nil {
+			LOG_ERROR("VSS_WRITER", "Invalid writer class id %s: %v", writer, err)
+			return nil
+		}
+		ids = append(ids, *id)
+	}
+	return ids
 }
 
-func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int) (shadowTop string) {
+// CreateShadowCopy creates a shadow copy for every volume the repository spans, and returns the path of the
+// repository in the shadow copy.  Writers in options.ExcludedWriters (specified by writer class ids) are not
+// involved, so a misbehaving writer, such as one for a database server, can't prevent the shadow copy from being
+// created.  Failed attempts are retried up to options.Retries times.
+func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int,
+	options ShadowCopyOptions) (shadowTop string) {
 
 	if !shadowCopy {
 		return top
@@ -362,9 +538,59 @@ func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int) (shadow
 	if timeoutInSeconds <= 60 {
 		timeoutInSeconds = 60
 	}
+
+	if len(top) < 3 || top[1] != ':' || (top[2] != '/' && top[2] != '\\') {
+		LOG_ERROR("VSS_PATH", "Invalid repository path: %s", top)
+		return top
+	}
+
+	writerClassIDs := parseWriterClassIDs(options.ExcludedWriters)
+	volumes := listShadowCopyVolumes(top)
+
 	ole.CoInitialize(0)
 	defer ole.CoUninitialize()
 
+	for attempt := 0; ; attempt++ {
+		shadowTop, err := createShadowCopy(top, volumes, timeoutInSeconds, writerClassIDs)
+		if err == nil {
+			return shadowTop
+		}
+
+		releaseShadowCopy()
+		if attempt >= options.Retries || shadowCopyErrorIsFatal(err) {
+			LOG_ERROR("VSS_CREATE", "%v", err)
+			return top
+		}
+
+		delay := 10 * (attempt + 1)
+		LOG_WARN("VSS_RETRY", "%v; retrying in %d seconds", err, delay)
+		time.Sleep(time.Duration(delay) * time.Second)
+	}
+}
+
+// shadowCopyError records the error code returned by the failed VSS operation.
+type shadowCopyError struct {
+	message string
+	code    uint32
+}
+
+func (err shadowCopyError) Error() string {
+	return err.message
+}
+
+func shadowCopyErrorIsFatal(err error) bool {
+	vssError, ok := err.(shadowCopyError)
+	return ok && vssError.code == E_ACCESSDENIED
+}
+
+func newShadowCopyError(code int, format string, v ...interface{}) error {
+	return shadowCopyError{message: fmt.Sprintf(format, v...), code: uint32(code)}
+}
+
+// createShadowCopy makes one attempt to create the snapshot set.
+func createShadowCopy(top string, volumes []*shadowCopyVolume, timeoutInSeconds int,
+	writerClassIDs []ole.GUID) (shadowTop string, err error) {
+
 	dllVssApi := syscall.NewLazyDLL("VssApi.dll")
 	procCreateVssBackupComponents :=
 		dllVssApi.NewProc("?CreateVssBackupComponents@@YAJPEAPEAVIVssBackupComponents@@@Z")
@@ -373,150 +599,164 @@ func CreateShadowCopy(top string, shadowCopy bool, timeoutInSeconds int) (shadow
 			dllVssApi.NewProc("?CreateVssBackupComponents@@YGJPAPAVIVssBackupComponents@@@Z")
 	}
 
-	if len(top) < 3 || top[1] != ':' || (top[2] != '/' && top[2] != '\\') {
-		LOG_ERROR("VSS_PATH", "Invalid repository path: %s", top)
-		return top
+	for _, volume := range volumes {
+		LOG_INFO("VSS_CREATE", "Creating a shadow copy for %s", volume.path)
 	}
-	volume := top[:1] + ":\\"
-
-	LOG_INFO("VSS_CREATE", "Creating a shadow copy for %s", volume)
 
 	var unknown *ole.IUnknown
-	r, _, err := procCreateVssBackupComponents.Call(uintptr(unsafe.Pointer(&unknown)))
+	r, _, _ := procCreateVssBackupComponents.Call(uintptr(unsafe.Pointer(&unknown)))
 
-	if r == 0x80070005 {
-		LOG_ERROR("VSS_CREATE", "Only administrators can create shadow copies")
-		return top
+	if r == E_ACCESSDENIED {
+		return top, newShadowCopyError(int(r), "Only administrators can create shadow copies")
 	}
 
 	if r != 0 {
-		LOG_ERROR("VSS_CREATE", "Failed to create the VSS backup component: %d", r)
-		return top
+		return top, newShadowCopyError(int(r), "Failed to create the VSS backup component: %d", r)
 	}
 
 	vssBackupComponent = getIVSS(unknown, IID_IVSS)
 	if vssBackupComponent == nil {
-		LOG_ERROR("VSS_CREATE", "Failed to create the VSS backup component")
-		return top
+		return top, newShadowCopyError(0, "Failed to create the VSS backup component")
 	}
 
 	ret := vssBackupComponent.InitializeForBackup()
 	if ret != 0 {
-		LOG_ERROR("VSS_INIT", "Shadow copy creation failed: InitializeForBackup returned %x", uint(ret))
-		return top
+		return top, newShadowCopyError(ret, "Shadow copy creation failed: InitializeForBackup returned %x", uint(ret))
 	}
 
 	var async *IVSSAsync
 	ret, async = vssBackupComponent.GatherWriterMetadata()
 	if ret != 0 {
-		LOG_ERROR("VSS_GATHER", "Shadow copy creation failed: GatherWriterMetadata returned %x", uint(ret))
-		return top
+		return top, newShadowCopyError(ret, "Shadow copy creation failed: GatherWriterMetadata returned %x", uint(ret))
 	}
 
 	if async == nil {
-		LOG_ERROR("VSS_GATHER",
+		return top, newShadowCopyError(0,
 			"Shadow copy creation failed: GatherWriterMetadata failed to return a valid IVssAsync object")
-		return top
 	}
 
 	if !async.Wait(timeoutInSeconds) {
-		LOG_ERROR("VSS_GATHER", "Shadow copy creation failed: GatherWriterMetadata didn't finish properly")
-		return top
+		async.Release()
+		return top, newShadowCopyError(0, "Shadow copy creation failed: GatherWriterMetadata didn't finish properly")
 	}
 	async.Release()
 
+	if len(writerClassIDs) > 0 {
+		ret = vssBackupComponent.DisableWriterClasses(writerClassIDs)
+		if ret != 0 {
+			return top, newShadowCopyError(ret, "Shadow copy creation failed: DisableWriterClasses returned %x", uint(ret))
+		}
+		LOG_INFO("VSS_WRITER", "%d writer classes excluded from the shadow copy", len(writerClassIDs))
+	}
+
 	var snapshotSetID ole.GUID
 
 	ret = vssBackupComponent.StartSnapshotSet(&snapshotSetID)
 	if ret != 0 {
-		LOG_ERROR("VSS_START", "Shadow copy creation failed: StartSnapshotSet returned %x", uint(ret))
-		return top
+		return top, newShadowCopyError(ret, "Shadow copy creation failed: StartSnapshotSet returned %x", uint(ret))
 	}
 
-	ret = vssBackupComponent.AddToSnapshotSet(volume, &snapshotID)
-	if ret != 0 {
-		LOG_ERROR("VSS_ADD", "Shadow copy creation failed: AddToSnapshotSet returned %x", uint(ret))
-		return top
-	}
+	volumeSnapshotIDs := make([]ole.GUID, len(volumes))
+	for i, volume := range volumes {
+		snapshotID := &volumeSnapshotIDs[i]
+		ret = vssBackupComponent.AddToSnapshotSet(volume.path, snapshotID)
+		if ret != 0 {
+			return top, newShadowCopyError(ret, "Shadow copy creation failed: AddToSnapshotSet returned %x for %s",
+				uint(ret), volume.path)
+		}
 
-	s, _ := ole.StringFromIID(&snapshotID)
-	LOG_DEBUG("VSS_ID", "Creating shadow copy %s", s)
+		s, _ := ole.StringFromIID(snapshotID)
+		LOG_DEBUG("VSS_ID", "Creating shadow copy %s for %s", s, volume.path)
+	}
 
 	ret = vssBackupComponent.SetBackupState()
 	if ret != 0 {
-		LOG_ERROR("VSS_SET", "Shadow copy creation failed: SetBackupState returned %x", uint(ret))
-		return top
+		return top, newShadowCopyError(ret, "Shadow copy creation failed: SetBackupState returned %x", uint(ret))
 	}
 
 	ret, async = vssBackupComponent.PrepareForBackup()
 	if ret != 0 {
-		LOG_ERROR("VSS_PREPARE", "Shadow copy creation failed: PrepareForBackup returned %x", uint(ret))
-		return top
+		return top, newShadowCopyError(ret, "Shadow copy creation failed: PrepareForBackup returned %x", uint(ret))
 	}
 	if async == nil {
-		LOG_ERROR("VSS_PREPARE",
+		return top, newShadowCopyError(0,
 			"Shadow copy creation failed: PrepareForBackup failed to return a valid IVssAsync object")
-		return top
 	}
 
 	if !async.Wait(timeoutInSeconds) {
-		LOG_ERROR("VSS_PREPARE", "Shadow copy creation failed: PrepareForBackup didn't finish properly")
-		return top
+		async.Release()
+		vssBackupComponent.AbortBackup()
+		return top, newShadowCopyError(0, "Shadow copy creation failed: PrepareForBackup didn't finish properly")
 	}
 	async.Release()
 
 	ret, async = vssBackupComponent.DoSnapshotSet()
 	if ret != 0 {
-		LOG_ERROR("VSS_SNAPSHOT", "Shadow copy creation failed: DoSnapshotSet returned %x", uint(ret))
-		return top
+		vssBackupComponent.AbortBackup()
+		return top, newShadowCopyError(ret, "Shadow copy creation failed: DoSnapshotSet returned %x", uint(ret))
 	}
 	if async == nil {
-		LOG_ERROR("VSS_SNAPSHOT",
+		vssBackupComponent.AbortBackup()
+		return top, newShadowCopyError(0,
 			"Shadow copy creation failed: DoSnapshotSet failed to return a valid IVssAsync object")
-		return top
 	}
 
 	if !async.Wait(timeoutInSeconds) {
-		LOG_ERROR("VSS_SNAPSHOT", "Shadow copy creation failed: DoSnapshotSet didn't finish properly")
-		return top
+		async.Release()
+		vssBackupComponent.AbortBackup()
+		return top, newShadowCopyError(0, "Shadow copy creation failed: DoSnapshotSet didn't finish properly")
 	}
 	async.Release()
 
-	properties := SnapshotProperties{}
+	// From now on the shadow copies exist and must be deleted if anything goes wrong
+	snapshotIDs = volumeSnapshotIDs
 
-	ret = vssBackupComponent.GetSnapshotProperties(snapshotID, &properties)
-	if ret != 0 {
-		LOG_ERROR("VSS_PROPERTIES", "GetSnapshotProperties returned %x", ret)
-		return top
-	}
+	preferencePath := GetDuplicacyPreferencePath()
+	redirects := make(map[string]string)
 
-	SnapshotIDString, _ := ole.StringFromIID(&properties.SnapshotID)
-	SnapshotSetIDString, _ := ole.StringFromIID(&properties.SnapshotSetID)
+	for i, volume := range volumes {
+		properties := SnapshotProperties{}
 
-	LOG_DEBUG("VSS_PROPERTY", "SnapshotID: %s", SnapshotIDString)
-	LOG_DEBUG("VSS_PROPERTY", "SnapshotSetID: %s", SnapshotSetIDString)
+		ret = vssBackupComponent.GetSnapshotProperties(snapshotIDs[i], &properties)
+		if ret != 0 {
+			return top, newShadowCopyError(ret, "GetSnapshotProperties returned %x", ret)
+		}
 
-	LOG_DEBUG("VSS_PROPERTY", "SnapshotDeviceObject: %s", uint16ArrayToString(properties.SnapshotDeviceObject))
-	LOG_DEBUG("VSS_PROPERTY", "OriginalVolumeName: %s", uint16ArrayToString(properties.OriginalVolumeName))
-	LOG_DEBUG("VSS_PROPERTY", "OriginatingMachine: %s", uint16ArrayToString(properties.OriginatingMachine))
-	LOG_DEBUG("VSS_PROPERTY", "OriginatingMachine: %s", uint16ArrayToString(properties.OriginatingMachine))
-	LOG_DEBUG("VSS_PROPERTY", "ServiceMachine: %s", uint16ArrayToString(properties.ServiceMachine))
-	LOG_DEBUG("VSS_PROPERTY", "ExposedName: %s", uint16ArrayToString(properties.ExposedName))
-	LOG_DEBUG("VSS_PROPERTY", "ExposedPath: %s", uint16ArrayToString(properties.ExposedPath))
+		SnapshotIDString, _ := ole.StringFromIID(&properties.SnapshotID)
+		SnapshotSetIDString, _ := ole.StringFromIID(&properties.SnapshotSetID)
 
-	LOG_INFO("VSS_DONE", "Shadow copy %s created", SnapshotIDString)
+		LOG_DEBUG("VSS_PROPERTY", "SnapshotID: %s", SnapshotIDString)
+		LOG_DEBUG("VSS_PROPERTY", "SnapshotSetID: %s", SnapshotSetIDString)
 
-	snapshotPath := uint16ArrayToString(properties.SnapshotDeviceObject)
+		LOG_DEBUG("VSS_PROPERTY", "SnapshotDeviceObject: %s", uint16ArrayToString(properties.SnapshotDeviceObject))
+		LOG_DEBUG("VSS_PROPERTY", "OriginalVolumeName: %s", uint16ArrayToString(properties.OriginalVolumeName))
+		LOG_DEBUG("VSS_PROPERTY", "OriginatingMachine: %s", uint16ArrayToString(properties.OriginatingMachine))
+		LOG_DEBUG("VSS_PROPERTY", "ServiceMachine: %s", uint16ArrayToString(properties.ServiceMachine))
+		LOG_DEBUG("VSS_PROPERTY", "ExposedName: %s", uint16ArrayToString(properties.ExposedName))
+		LOG_DEBUG("VSS_PROPERTY", "ExposedPath: %s", uint16ArrayToString(properties.ExposedPath))
 
-	preferencePath := GetDuplicacyPreferencePath()
-	shadowLink = preferencePath + "\\shadow"
-	os.Remove(shadowLink)
-	err = os.Symlink(snapshotPath+"\\", shadowLink)
-	if err != nil {
-		LOG_ERROR("VSS_SYMLINK", "Failed to create a symbolic link to the shadow copy just created: %v", err)
-		return top
-	}
+		LOG_INFO("VSS_DONE", "Shadow copy %s created for %s", SnapshotIDString, volume.path)
+
+		snapshotPath := uint16ArrayToString(properties.SnapshotDeviceObject)
+
+		// The shadow copy of the repository volume keeps the old link name; the others are numbered
+		shadowLink := preferencePath + "\\shadow"
+		if i > 0 {
+			shadowLink += fmt.Sprintf("-%d", i)
+		}
+		os.Remove(shadowLink)
+		err = os.Symlink(snapshotPath+"\\", shadowLink)
+		if err != nil {
+			return top, newShadowCopyError(0, "Failed to create a symbolic link to the shadow copy just created: %v", err)
+		}
+		shadowLinks = append(shadowLinks, shadowLink)
 
-	return shadowLink + "\\" + top[2:]
+		for link, relativePath := range volume.links {
+			redirects[link] = shadowLink + "\\" + relativePath
+		}
+	}
 
+	shadowCopyTop = shadowLinks[0] + "\\" + top[2:]
+	shadowCopyRedirects = redirects
+	return shadowCopyTop, nil
 }
@@ -5,6 +5,7 @@
 package duplicacy
 
 import (
+	"bufio"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -23,6 +24,7 @@ type Snapshot struct {
 	Revision      int    // the revision number
 	Options       string // options used to create this snapshot (some not included)
 	Tag           string // user-assigned tag
+	Note          string // user-assigned free-text description of the revision
 	StartTime     int64  // at what time the snapshot was created
 	EndTime       int64  // at what time the snapshot was done
 	FileSize      int64  // total file size
@@ -45,6 +47,14 @@ type Snapshot struct {
 	Flag bool // used to mark certain snapshots for deletion or copy
 
 	discardAttributes bool
+
+	fileList *entryList // the files when they are too many to be kept in 'Files'
+
+	// The number of chunks at the start that come from the previous snapshot; these are referenced by the files in
+	// 'fileList' in the order of the previous snapshot rather than the order of the files
+	preservedChunks int
+
+	checkpoint bool // an incomplete snapshot whose chunks are all known to be in the storage
 }
 
 // CreateEmptySnapshot creates an empty snapshot.
@@ -57,8 +67,12 @@ func CreateEmptySnapshot(id string) (snapshto *Snapshot) {
 }
 
 // CreateSnapshotFromDirectory creates a snapshot from the local directory 'top'.  Only 'Files'
-// will be constructed, while 'ChunkHashes' and 'ChunkLengths' can only be populated after uploading.
-func CreateSnapshotFromDirectory(id string, top string, nobackupFile string, filtersFile string, excludeByAttribute bool) (snapshot *Snapshot, skippedDirectories []string,
+// will be constructed, while 'ChunkHashes' and 'ChunkLengths' can only be populated after uploading.  If
+// 'oneFileSystem' is true, directories on a file system other than that of their parent are included but not listed;
+// directories linked from the repository root are listed on their own file system.  If 'changes' is not nil, the
+// entries of directories not changed since the previous snapshot are copied from the previous snapshot instead.
+func CreateSnapshotFromDirectory(id string, top string, markerFiles []string, filtersFile string, excludeByAttribute bool,
+	specialFiles bool, oneFileSystem bool, changes *ChangeSet) (snapshot *Snapshot, skippedDirectories []string,
 	skippedFiles []string, err error) {
 
 	snapshot = &Snapshot{
@@ -69,13 +83,7 @@ func CreateSnapshotFromDirectory(id string, top string, nobackupFile string, fil
 
 	var patterns []string
 
-	if filtersFile == "" {
-		filtersFile = joinPath(GetDuplicacyPreferencePath(), "filters")
-	}
-	patterns = ProcessFilters(filtersFile)
-
-	directories := make([]*Entry, 0, 256)
-	directories = append(directories, CreateEntry("", 0, 0, 0))
+	patterns = ProcessFilters(getFiltersFile(filtersFile))
 
 	snapshot.Files = make([]*Entry, 0, 256)
 
@@ -84,38 +92,275 @@ func CreateSnapshotFromDirectory(id string, top string, nobackupFile string, fil
 		attributeThreshold, _ = strconv.Atoi(attributeThresholdValue)
 	}
 
+	bar := StartProgressBar("Scan", 0, "files")
+
+	skippedDirectories, skippedFiles, err = scanRepository(top, patterns, markerFiles, excludeByAttribute, specialFiles,
+		oneFileSystem, changes, &snapshot.discardAttributes, func(entries []*Entry) bool {
+			snapshot.Files = append(snapshot.Files, entries...)
+			bar.Add(int64(len(entries)), 0)
+
+			if !snapshot.discardAttributes && len(snapshot.Files) > attributeThreshold {
+				LOG_INFO("LIST_ATTRIBUTES", "Discarding file attributes")
+				snapshot.discardAttributes = true
+				for _, file := range snapshot.Files {
+					file.Attributes = nil
+				}
+			}
+			return true
+		})
+	if err != nil {
+		LOG_ERROR("LIST_FAILURE", "Failed to list the repository root: %v", err)
+		return nil, nil, nil, err
+	}
+
+	bar.Finish()
+
+	// Remove the root entry
+	snapshot.Files = snapshot.Files[1:]
+
+	if changes != nil && changes.previous != nil {
+		LOG_INFO("JOURNAL_REUSE", "Reused the entries of %d unchanged directories from the previous snapshot",
+			changes.reused)
+	}
+
+	return snapshot, skippedDirectories, skippedFiles, nil
+}
+
+// scanRepository lists the directory 'top' one directory at a time.  'handler' is called with each directory
+// followed by the entries in it other than subdirectories, starting with the repository root, so that the entries
+// arrive in the order they are stored in a snapshot; listing stops if 'handler' returns false.  Attributes are not
+// read once 'discardAttributes' (if not nil) becomes true.  An error is returned only if the repository root can't
+// be listed.
+func scanRepository(top string, patterns []string, markerFiles []string, excludeByAttribute bool, specialFiles bool,
+	oneFileSystem bool, changes *ChangeSet, discardAttributes *bool, handler func(entries []*Entry) bool) (
+	skippedDirectories []string, skippedFiles []string, err error) {
+
+	directories := make([]*Entry, 0, 256)
+	directories = append(directories, CreateEntry("", 0, 0, 0))
+
+	// The rules from the ignore files in the parent directories, for directories yet to be listed
+	inheritedIgnoreRules := make(map[string]IgnoreRules)
+
+	// The file system of each directory yet to be listed, and the mount points not to be listed
+	fileSystems := make(map[string]uint64)
+	mountPoints := make(map[string]bool)
+	if oneFileSystem {
+		if fileSystem, ok := GetFileSystemID(top); ok {
+			fileSystems[""] = fileSystem
+		} else {
+			LOG_WARN("LIST_MOUNT", "Unable to determine the file system of %s; -one-file-system is ignored", top)
+			oneFileSystem = false
+		}
+	}
+
+	if changes != nil {
+		settings := getListingSettings(patterns, markerFiles, excludeByAttribute, specialFiles, oneFileSystem)
+		if changes.previous != nil && changes.Settings != settings {
+			LOG_INFO("JOURNAL_FULL", "Listing all files as the include/exclude options have changed")
+			changes.previous = nil
+		}
+		changes.Settings = settings
+	}
+
 	for len(directories) > 0 {
 
 		directory := directories[len(directories)-1]
 		directories = directories[:len(directories)-1]
-		snapshot.Files = append(snapshot.Files, directory)
-		subdirectories, skipped, err := ListEntries(top, directory.Path, &snapshot.Files, patterns, nobackupFile, snapshot.discardAttributes, excludeByAttribute)
-		if err != nil {
-			if directory.Path == "" {
-				LOG_ERROR("LIST_FAILURE", "Failed to list the repository root: %v", err)
-				return nil, nil, nil, err
+		entries := []*Entry{directory}
+
+		if mountPoints[directory.Path] {
+			delete(mountPoints, directory.Path)
+			if !handler(entries) {
+				return skippedDirectories, skippedFiles, nil
 			}
-			LOG_WARN("LIST_FAILURE", "Failed to list subdirectory %s: %v", directory.Path, err)
-			skippedDirectories = append(skippedDirectories, directory.Path)
 			continue
 		}
+		fileSystem := fileSystems[directory.Path]
+		delete(fileSystems, directory.Path)
+
+		ignoreRules := inheritedIgnoreRules[directory.Path]
+		delete(inheritedIgnoreRules, directory.Path)
+		if rules := LoadIgnoreFile(top, directory.Path); len(rules) > 0 {
+			ignoreRules = append(append(IgnoreRules{}, ignoreRules...), rules...)
+		}
+
+		var subdirectories []*Entry
+		var skipped []string
+		if previousEntries, found := changes.getPreviousEntries(directory.Path); found {
+			for _, entry := range previousEntries {
+				if entry.IsDir() {
+					subdirectories = append([]*Entry{entry}, subdirectories...)
+				} else {
+					entries = append(entries, entry)
+				}
+			}
+		} else {
+			subdirectories, skipped, err = ListEntries(top, directory.Path, &entries, patterns, markerFiles,
+				discardAttributes != nil && *discardAttributes, excludeByAttribute, specialFiles, ignoreRules)
+			if err != nil {
+				if directory.Path == "" {
+					return nil, nil, err
+				}
+				LOG_WARN("LIST_FAILURE", "Failed to list subdirectory %s: %v", directory.Path, err)
+				skippedDirectories = append(skippedDirectories, directory.Path)
+				err = nil
+				if !handler(entries[:1]) {
+					return skippedDirectories, skippedFiles, nil
+				}
+				continue
+			}
+			if changes != nil {
+				changes.markListedSubdirectories(top, directory.Path, entries[1:], subdirectories)
+			}
+		}
 
 		directories = append(directories, subdirectories...)
 		skippedFiles = append(skippedFiles, skipped...)
+		if oneFileSystem {
+			for _, subdirectory := range subdirectories {
+				subdirectoryPath := joinRootPath(top, subdirectory.Path)
+				subdirectoryFileSystem, ok := GetFileSystemID(subdirectoryPath)
+				if stat, err := os.Lstat(subdirectoryPath); ok && err == nil &&
+					(stat.Mode()&os.ModeSymlink != 0 || (directory.Path == "" && isSourceRoot(subdirectory.Path))) {
+					// A directory linked from the repository root or a source root is backed up on whatever file
+					// system it is
+					fileSystems[subdirectory.Path] = subdirectoryFileSystem
+				} else if ok && subdirectoryFileSystem != fileSystem {
+					LOG_INFO("LIST_MOUNT", "Skipped the contents of %s which is on a different file system",
+						subdirectory.Path)
+					mountPoints[subdirectory.Path] = true
+				} else {
+					fileSystems[subdirectory.Path] = fileSystem
+				}
+			}
+		}
+		if len(ignoreRules) > 0 {
+			for _, subdirectory := range subdirectories {
+				inheritedIgnoreRules[subdirectory.Path] = ignoreRules
+			}
+		}
+
+		if !handler(entries) {
+			return skippedDirectories, skippedFiles, nil
+		}
+	}
 
-		if !snapshot.discardAttributes && len(snapshot.Files) > attributeThreshold {
-			LOG_INFO("LIST_ATTRIBUTES", "Discarding file attributes")
-			snapshot.discardAttributes = true
-			for _, file := range snapshot.Files {
-				file.Attributes = nil
+	return skippedDirectories, skippedFiles, nil
+}
+
+// Whether to log the reason each file is included or excluded while listing the repository.
+var traceFilters bool
+
+// SetFilterTracing enables or disables logging the pattern that includes or excludes each file during a backup.
+func SetFilterTracing(enabled bool) {
+	traceFilters = enabled
+}
+
+// ExplainFilter returns whether the entry is included by the filter patterns and the rules from the ignore files,
+// along with the reason.  'entry' is needed to evaluate the predicates in the patterns, but may be nil if only the
+// path is known.
+func ExplainFilter(entryPath string, entry *Entry, patterns []string, ignoreRules IgnoreRules) (included bool,
+	reason string) {
+
+	included = true
+	reason = "included as no pattern is defined"
+	if len(patterns) > 0 {
+		var pattern string
+		included, pattern = MatchPathPattern(entryPath, entry, patterns)
+		if pattern != "" {
+			if included {
+				reason = fmt.Sprintf("included by pattern %s", pattern)
+			} else {
+				reason = fmt.Sprintf("excluded by pattern %s", pattern)
 			}
+		} else if included {
+			reason = "included as no pattern matches and there are exclude patterns"
+		} else {
+			reason = "excluded as no pattern matches and all patterns are include patterns"
 		}
 	}
 
-	// Remove the root entry
-	snapshot.Files = snapshot.Files[1:]
+	if included {
+		if rule := ignoreRules.Match(entryPath); rule != nil {
+			if rule.negate {
+				reason += fmt.Sprintf(", and included again by %s in %s", rule.Pattern, rule.Source)
+			} else {
+				included = false
+				reason += fmt.Sprintf(", but excluded by %s in %s", rule.Pattern, rule.Source)
+			}
+		}
+	}
 
-	return snapshot, skippedDirectories, skippedFiles, nil
+	return included, reason
+}
+
+// ExplainFilters reports for each of 'paths' whether it would be backed up, and which pattern or rule is responsible.
+// Parent directories are checked first since the files under an excluded directory are never listed.
+func ExplainFilters(top string, filtersFile string, markerFiles []string, paths []string) {
+
+	patterns := ProcessFilters(getFiltersFile(filtersFile))
+
+	for _, filePath := range paths {
+		fullPath, err := filepath.Abs(filePath)
+		if err != nil {
+			LOG_WARN("FILTER_PATH", "Invalid path %s: %v", filePath, err)
+			continue
+		}
+		relativePath, err := filepath.Rel(top, fullPath)
+		if rootPath, ok := getRelativeRootPath(fullPath); ok {
+			relativePath, err = rootPath, nil
+		} else if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			LOG_WARN("FILTER_PATH", "%s is not in the repository %s", filePath, top)
+			continue
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if relativePath == "." {
+			LOG_INFO("FILTER_TEST", "%s: the repository root is always included", filePath)
+			continue
+		}
+
+		components := strings.Split(relativePath, "/")
+		stat, err := os.Lstat(fullPath)
+		if err == nil && stat.IsDir() {
+			components[len(components)-1] += "/"
+		}
+
+		var ignoreRules IgnoreRules
+		directory := ""
+		for i, component := range components {
+			if len(markerFiles) > 0 {
+				files, _ := ioutil.ReadDir(joinRootPath(top, directory))
+				if markerFile := findMarkerFile(joinRootPath(top, directory), files, markerFiles); markerFile != "" {
+					LOG_INFO("FILTER_TEST", "%s: excluded by the file %s in %s", relativePath, markerFile, directory)
+					break
+				}
+			}
+			ignoreRules = append(ignoreRules, LoadIgnoreFile(top, directory)...)
+
+			if i < len(components)-1 {
+				component += "/"
+			}
+			entryPath := directory + component
+			if strings.TrimSuffix(component, "/") == DUPLICACY_DIRECTORY {
+				LOG_INFO("FILTER_TEST", "%s: the %s directory is always excluded", relativePath, DUPLICACY_DIRECTORY)
+				break
+			}
+
+			var entry *Entry
+			if i == len(components)-1 && stat != nil {
+				entry = CreateEntryFromFileInfo(stat, directory)
+			}
+			included, reason := ExplainFilter(entryPath, entry, patterns, ignoreRules)
+			if i == len(components)-1 {
+				LOG_INFO("FILTER_TEST", "%s: %s", entryPath, reason)
+			} else if !included {
+				LOG_INFO("FILTER_TEST", "%s: excluded because the parent directory %s is %s", relativePath, entryPath,
+					reason)
+				break
+			}
+			directory = entryPath
+		}
+	}
 }
 
 func AppendPattern(patterns []string, new_pattern string) (new_patterns []string) {
@@ -202,8 +447,19 @@ func ProcessFilterLines(patternFileLines []string, includedFiles []string) (patt
 			continue
 		}
 
+		prefixLength := 1
+		if strings.HasPrefix(pattern, "i:") || strings.HasPrefix(pattern, "e:") {
+			prefixLength = 2
+		}
+		predicates, body := SplitFilterPredicates(pattern[prefixLength:])
+		if predicates != "" {
+			if _, err := ParseFilterPredicates(predicates); err != nil {
+				LOG_ERROR("SNAPSHOT_FILTER", "Invalid predicates encountered for filter: \"%s\", error: %v", pattern, err)
+			}
+		}
+
 		if strings.HasPrefix(pattern, "i:") || strings.HasPrefix(pattern, "e:") {
-			valid, err := IsValidRegex(pattern[2:])
+			valid, err := IsValidRegex(body)
 			if !valid || err != nil {
 				LOG_ERROR("SNAPSHOT_FILTER", "Invalid regular expression encountered for filter: \"%s\", error: %v", pattern, err)
 			}
@@ -220,6 +476,7 @@ type IncompleteSnapshot struct {
 	Files        []*Entry
 	ChunkHashes  []string
 	ChunkLengths []int
+	Checkpoint   bool // saved during the backup; only chunks that have been uploaded are included
 }
 
 // LoadIncompleteSnapshot loads the incomplete snapshot if it exists
@@ -253,6 +510,7 @@ func LoadIncompleteSnapshot() (snapshot *Snapshot) {
 		Files:        incompleteSnapshot.Files,
 		ChunkHashes:  chunkHashes,
 		ChunkLengths: incompleteSnapshot.ChunkLengths,
+		checkpoint:   incompleteSnapshot.Checkpoint,
 	}
 	LOG_INFO("INCOMPLETE_LOAD", "Incomplete snapshot loaded from %s", snapshotFile)
 	return snapshot
@@ -260,41 +518,119 @@ func LoadIncompleteSnapshot() (snapshot *Snapshot) {
 
 // SaveIncompleteSnapshot saves the incomplete snapshot under the preference directory
 func SaveIncompleteSnapshot(snapshot *Snapshot) {
-	var files []*Entry
-	for _, file := range snapshot.Files {
+	saveIncompleteFiles(snapshot.nextProcessedFile(), snapshot.ChunkHashes, snapshot.ChunkLengths, false)
+}
+
+// SaveIncompleteSnapshotCheckpoint saves the files processed so far by an initial backup in progress, along with the
+// chunks that have been uploaded for them.  Unlike the incomplete snapshot saved on errors, the chunks don't need to
+// be listed from the storage when the backup is resumed.
+func SaveIncompleteSnapshotCheckpoint(snapshot *Snapshot) {
+	saveIncompleteFiles(snapshot.nextProcessedFile(), snapshot.ChunkHashes, snapshot.ChunkLengths, true)
+}
+
+// nextProcessedFile returns a function that returns the files of the snapshot one at a time, stopping before the
+// first file that hasn't been processed.
+func (snapshot *Snapshot) nextProcessedFile() func() (*Entry, error) {
+	i := 0
+	return func() (*Entry, error) {
+		if i >= len(snapshot.Files) {
+			return nil, nil
+		}
+		file := snapshot.Files[i]
 		// All unprocessed files will have a size of -1
-		if file.Size >= 0 {
-			file.Attributes = nil
-			files = append(files, file)
-		} else {
-			break
+		if file.Size < 0 && file.IsFile() {
+			i = len(snapshot.Files)
+			return nil, nil
 		}
+		i++
+		return file, nil
 	}
-	var chunkHashes []string
-	for _, chunkHash := range snapshot.ChunkHashes {
-		chunkHashes = append(chunkHashes, hex.EncodeToString([]byte(chunkHash)))
+}
+
+// saveIncompleteFiles saves the files returned by 'next' and the chunks as the incomplete snapshot, either at a
+// checkpoint or on errors.
+func saveIncompleteFiles(next func() (*Entry, error), chunkHashes []string, chunkLengths []int, checkpoint bool) {
+	snapshotFile, numberOfFiles, err := saveIncompleteSnapshot(next, chunkHashes, chunkLengths, checkpoint)
+	if err != nil {
+		return
 	}
+	if checkpoint {
+		LOG_DEBUG("INCOMPLETE_CHECKPOINT", "Saved %d files and %d chunks to %s", numberOfFiles, len(chunkHashes),
+			snapshotFile)
+	} else {
+		LOG_INFO("INCOMPLETE_SAVE", "Incomplete snapshot saved to %s", snapshotFile)
+	}
+}
 
-	incompleteSnapshot := IncompleteSnapshot{
-		Files:        files,
-		ChunkHashes:  chunkHashes,
-		ChunkLengths: snapshot.ChunkLengths,
+// saveIncompleteSnapshot writes the incomplete snapshot to a temporary file first and then renames it, so a crash
+// while saving will never leave a truncated incomplete snapshot behind.  The files are encoded one at a time in the
+// format of IncompleteSnapshot, without their attributes.
+func saveIncompleteSnapshot(next func() (*Entry, error), chunkHashes []string, chunkLengths []int,
+	checkpoint bool) (snapshotFile string, numberOfFiles int, err error) {
+
+	var encodedHashes []string
+	for _, chunkHash := range chunkHashes {
+		encodedHashes = append(encodedHashes, hex.EncodeToString([]byte(chunkHash)))
 	}
 
-	description, err := json.MarshalIndent(incompleteSnapshot, "", "  ")
-	if err != nil {
-		LOG_WARN("INCOMPLETE_ENCODE", "Failed to encode the incomplete snapshot: %v", err)
-		return
+	encode := func(writer *bufio.Writer) error {
+		writer.WriteString("{\"Files\":[")
+		for {
+			file, err := next()
+			if err != nil {
+				return err
+			}
+			if file == nil {
+				break
+			}
+			copied := *file
+			copied.Attributes = nil
+			description, err := json.Marshal(&copied)
+			if err != nil {
+				return err
+			}
+			if numberOfFiles > 0 {
+				writer.WriteString(",\n")
+			}
+			writer.Write(description)
+			numberOfFiles++
+		}
+
+		writer.WriteString("],\n\"ChunkHashes\":")
+		description, _ := json.Marshal(encodedHashes)
+		writer.Write(description)
+		writer.WriteString(",\n\"ChunkLengths\":")
+		description, _ = json.Marshal(chunkLengths)
+		writer.Write(description)
+		_, err := fmt.Fprintf(writer, ",\n\"Checkpoint\":%t}\n", checkpoint)
+		if err != nil {
+			return err
+		}
+		return writer.Flush()
 	}
 
-	snapshotFile := path.Join(GetDuplicacyPreferencePath(), "incomplete")
-	err = ioutil.WriteFile(snapshotFile, description, 0644)
+	snapshotFile = path.Join(GetDuplicacyPreferencePath(), "incomplete")
+	temporaryFile := snapshotFile + ".tmp"
+	file, err := os.OpenFile(temporaryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		err = encode(bufio.NewWriter(file))
+		if err == nil {
+			err = file.Sync()
+		}
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = os.Rename(temporaryFile, snapshotFile)
+	}
 	if err != nil {
+		os.Remove(temporaryFile)
 		LOG_WARN("INCOMPLETE_WRITE", "Failed to save the incomplete snapshot: %v", err)
-		return
+		return "", 0, err
 	}
-
-	LOG_INFO("INCOMPLETE_SAVE", "Incomplete snapshot saved to %s", snapshotFile)
+	return snapshotFile, numberOfFiles, nil
 }
 
 func RemoveIncompleteSnapshot() {
@@ -340,6 +676,11 @@ func CreateSnapshotFromDescription(description []byte) (snapshot *Snapshot, err
 		return nil, fmt.Errorf("Invalid tag is specified in the snapshot")
 	}
 
+	if value, ok := root["note"]; !ok {
+	} else if snapshot.Note, ok = value.(string); !ok {
+		return nil, fmt.Errorf("Invalid note is specified in the snapshot")
+	}
+
 	if value, ok := root["options"]; !ok {
 	} else if snapshot.Options, ok = value.(string); !ok {
 		return nil, fmt.Errorf("Invalid options is specified in the snapshot")
@@ -432,6 +773,18 @@ func (snapshot *Snapshot) LoadLengths(description []byte) (err error) {
 	return json.Unmarshal(description, &snapshot.ChunkLengths)
 }
 
+// IsMetadataOnly returns true if the snapshot was created by a metadata-only backup, which records the files but not
+// their contents.
+func (snapshot *Snapshot) IsMetadataOnly() bool {
+	return strings.Contains(" "+snapshot.Options+" ", " -metadata-only ")
+}
+
+// IsStdin returns true if the snapshot was created by a backup from the standard input, which contains only the file
+// read from it.
+func (snapshot *Snapshot) IsStdin() bool {
+	return strings.Contains(" "+snapshot.Options+" ", " -stdin ")
+}
+
 // MarshalJSON creates a json representation of the snapshot.
 func (snapshot *Snapshot) MarshalJSON() ([]byte, error) {
 
@@ -441,6 +794,9 @@ func (snapshot *Snapshot) MarshalJSON() ([]byte, error) {
 	object["revision"] = snapshot.Revision
 	object["options"] = snapshot.Options
 	object["tag"] = snapshot.Tag
+	if snapshot.Note != "" {
+		object["note"] = snapshot.Note
+	}
 	object["start_time"] = snapshot.StartTime
 	object["end_time"] = snapshot.EndTime
 
@@ -0,0 +1,441 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// The number of snapshots whose file lists are kept in memory by a SnapshotFileSystem
+const snapshotFileSystemCacheSize = 4
+
+// The number of chunks kept in memory by a SnapshotFileSystem
+const snapshotFileSystemChunkCacheSize = 8
+
+// SnapshotFileSystem is a read-only file system presenting every revision in the storage as a directory, in the form
+// of /<snapshot id>/<revision>/<path>.  It implements webdav.FileSystem so it can be served over WebDAV, which makes
+// it accessible from the Windows Explorer or the macOS Finder without any file system driver.
+type SnapshotFileSystem struct {
+	manager   *SnapshotManager
+	startTime time.Time
+
+	// The snapshot manager and its chunk downloader can only be used by one request at a time
+	lock      sync.Mutex
+	snapshots []*fileSystemSnapshot // the snapshots loaded, most recently used first
+	chunks    []fileSystemChunk     // the chunks downloaded, most recently used first
+}
+
+type fileSystemSnapshot struct {
+	snapshot *Snapshot
+	entries  map[string]*Entry   // the files and directories indexed by their paths without the trailing '/'
+	children map[string][]*Entry // the entries in each directory, indexed by the directory path ending with '/'
+}
+
+type fileSystemChunk struct {
+	hash    string
+	content []byte
+}
+
+// CreateSnapshotFileSystem creates a file system for the snapshots in the storage of 'manager'.
+func CreateSnapshotFileSystem(manager *SnapshotManager) *SnapshotFileSystem {
+	return &SnapshotFileSystem{
+		manager:   manager,
+		startTime: time.Now(),
+	}
+}
+
+// catchFileSystemException turns an error logged by the snapshot manager while serving a request into the error
+// returned by the request, as the server must keep running.
+func catchFileSystemException(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(Exception); ok {
+			*err = fmt.Errorf("%s", e.Message)
+			return
+		}
+		panic(r)
+	}
+}
+
+// splitFileSystemPath breaks a path of the file system into the snapshot id, the revision, and the path in the
+// snapshot.
+func splitFileSystemPath(name string) (snapshotID string, revision int, filePath string, err error) {
+	components := strings.SplitN(strings.Trim(path.Clean("/"+name), "/"), "/", 3)
+	if components[0] == "" {
+		return "", 0, "", nil
+	}
+	snapshotID = components[0]
+	if len(components) > 1 {
+		revision, err = strconv.Atoi(components[1])
+		if err != nil || revision <= 0 {
+			return "", 0, "", os.ErrNotExist
+		}
+	}
+	if len(components) > 2 {
+		filePath = components[2]
+	}
+	return snapshotID, revision, filePath, nil
+}
+
+// getSnapshot returns the snapshot with its file list, downloading it if it isn't in memory.  The caller must hold
+// the lock.
+func (fs *SnapshotFileSystem) getSnapshot(snapshotID string, revision int) (*fileSystemSnapshot, error) {
+
+	for i, loaded := range fs.snapshots {
+		if loaded.snapshot.ID == snapshotID && loaded.snapshot.Revision == revision {
+			copy(fs.snapshots[1:i+1], fs.snapshots[:i])
+			fs.snapshots[0] = loaded
+			return loaded, nil
+		}
+	}
+
+	revisions, err := fs.manager.ListSnapshotRevisions(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, existing := range revisions {
+		found = found || existing == revision
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+
+	LOG_DEBUG("MOUNT_SNAPSHOT", "Loading snapshot %s at revision %d", snapshotID, revision)
+	snapshot := fs.manager.DownloadSnapshot(snapshotID, revision)
+	if !fs.manager.DownloadSnapshotContents(snapshot, nil, false) {
+		return nil, fmt.Errorf("snapshot %s at revision %d can't be loaded", snapshotID, revision)
+	}
+
+	loaded := &fileSystemSnapshot{
+		snapshot: snapshot,
+		entries:  make(map[string]*Entry),
+		children: map[string][]*Entry{"": nil},
+	}
+	for _, entry := range snapshot.Files {
+		if !entry.IsFile() && !entry.IsDir() {
+			continue
+		}
+		entryPath := strings.TrimSuffix(entry.Path, "/")
+		parent := ""
+		if i := strings.LastIndex(entryPath, "/"); i >= 0 {
+			parent = entryPath[:i+1]
+		}
+		loaded.entries[entryPath] = entry
+		loaded.children[parent] = append(loaded.children[parent], entry)
+	}
+
+	fs.snapshots = append([]*fileSystemSnapshot{loaded}, fs.snapshots...)
+	if len(fs.snapshots) > snapshotFileSystemCacheSize {
+		fs.snapshots = fs.snapshots[:snapshotFileSystemCacheSize]
+	}
+	return loaded, nil
+}
+
+// getChunk returns the content of a chunk, downloading it if it isn't in memory.  The caller must hold the lock.
+func (fs *SnapshotFileSystem) getChunk(hash string) []byte {
+
+	for i, chunk := range fs.chunks {
+		if chunk.hash == hash {
+			copy(fs.chunks[1:i+1], fs.chunks[:i])
+			fs.chunks[0] = chunk
+			return chunk.content
+		}
+	}
+
+	fs.manager.CreateChunkDownloader()
+
+	// Don't save file chunks to the snapshot cache
+	downloader := fs.manager.chunkDownloader
+	snapshotCache := downloader.snapshotCache
+	downloader.snapshotCache = nil
+	defer func() {
+		downloader.snapshotCache = snapshotCache
+	}()
+
+	chunk := downloader.WaitForChunk(downloader.AddChunk(hash))
+	content := append([]byte{}, chunk.GetBytes()...)
+
+	fs.chunks = append([]fileSystemChunk{{hash: hash, content: content}}, fs.chunks...)
+	if len(fs.chunks) > snapshotFileSystemChunkCacheSize {
+		fs.chunks = fs.chunks[:snapshotFileSystemChunkCacheSize]
+	}
+	return content
+}
+
+// stat returns the information of the file or directory 'name' as well as the entries in it if it is a directory.
+func (fs *SnapshotFileSystem) stat(name string, listing bool) (info *fileSystemInfo, children []os.FileInfo,
+	loaded *fileSystemSnapshot, err error) {
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	defer catchFileSystemException(&err)
+
+	snapshotID, revision, filePath, err := splitFileSystemPath(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if snapshotID == "" {
+		info = &fileSystemInfo{name: "/", isDir: true, modTime: fs.startTime}
+		if listing {
+			snapshotIDs, err := fs.manager.ListSnapshotIDs()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for _, id := range snapshotIDs {
+				children = append(children, &fileSystemInfo{name: id, isDir: true, modTime: fs.startTime})
+			}
+		}
+		return info, children, nil, nil
+	}
+
+	if revision == 0 {
+		revisions, err := fs.manager.ListSnapshotRevisions(snapshotID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(revisions) == 0 {
+			return nil, nil, nil, os.ErrNotExist
+		}
+		info = &fileSystemInfo{name: snapshotID, isDir: true, modTime: fs.startTime}
+		if listing {
+			sort.Ints(revisions)
+			for _, revision := range revisions {
+				children = append(children, &fileSystemInfo{name: strconv.Itoa(revision), isDir: true,
+					modTime: fs.startTime})
+			}
+		}
+		return info, children, nil, nil
+	}
+
+	loaded, err = fs.getSnapshot(snapshotID, revision)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	directory := ""
+	if filePath == "" {
+		info = &fileSystemInfo{name: strconv.Itoa(revision), isDir: true,
+			modTime: time.Unix(loaded.snapshot.StartTime, 0)}
+	} else {
+		entry, found := loaded.entries[filePath]
+		if !found {
+			return nil, nil, nil, os.ErrNotExist
+		}
+		info = createFileSystemInfo(entry)
+		directory = entry.Path
+	}
+
+	if listing && info.isDir {
+		for _, child := range loaded.children[directory] {
+			children = append(children, createFileSystemInfo(child))
+		}
+	}
+	return info, children, loaded, nil
+}
+
+// Stat returns the information of the file or directory 'name'.
+func (fs *SnapshotFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, _, _, err := fs.stat(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// OpenFile opens the file or directory 'name' for reading.  Any attempt to modify the file system fails.
+func (fs *SnapshotFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File,
+	error) {
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	info, children, loaded, err := fs.stat(name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &snapshotFile{fs: fs, info: info, children: children}
+	if info.entry != nil && !info.isDir {
+		if loaded.snapshot.IsMetadataOnly() {
+			return nil, fmt.Errorf("the content of %s isn't available in a metadata-only snapshot", name)
+		}
+		file.chunkHashes = loaded.snapshot.ChunkHashes
+		file.chunkLengths = loaded.snapshot.ChunkLengths
+	}
+	return file, nil
+}
+
+func (fs *SnapshotFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *SnapshotFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *SnapshotFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// fileSystemInfo implements os.FileInfo for snapshot ids, revisions, and entries in snapshots.
+type fileSystemInfo struct {
+	name    string
+	isDir   bool
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	entry   *Entry
+}
+
+func createFileSystemInfo(entry *Entry) *fileSystemInfo {
+	return &fileSystemInfo{
+		name:    path.Base(strings.TrimSuffix(entry.Path, "/")),
+		isDir:   entry.IsDir(),
+		size:    entry.Size,
+		mode:    entry.GetPermissions(),
+		modTime: time.Unix(entry.Time, 0),
+		entry:   entry,
+	}
+}
+
+func (info *fileSystemInfo) Name() string       { return info.name }
+func (info *fileSystemInfo) ModTime() time.Time { return info.modTime }
+func (info *fileSystemInfo) IsDir() bool        { return info.isDir }
+func (info *fileSystemInfo) Sys() interface{}   { return nil }
+
+func (info *fileSystemInfo) Size() int64 {
+	if info.isDir {
+		return 0
+	}
+	return info.size
+}
+
+func (info *fileSystemInfo) Mode() os.FileMode {
+	mode := info.mode
+	if mode == 0 {
+		mode = 0555
+	}
+	if info.isDir {
+		return mode | os.ModeDir
+	}
+	return mode
+}
+
+// snapshotFile is an open file or directory of a SnapshotFileSystem.
+type snapshotFile struct {
+	fs       *SnapshotFileSystem
+	info     *fileSystemInfo
+	children []os.FileInfo // the entries not yet returned by Readdir if this is a directory
+	offset   int64
+
+	chunkHashes  []string
+	chunkLengths []int
+}
+
+func (file *snapshotFile) Close() error {
+	return nil
+}
+
+func (file *snapshotFile) Stat() (os.FileInfo, error) {
+	return file.info, nil
+}
+
+func (file *snapshotFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Readdir returns the next 'count' entries in the directory, or all remaining entries if 'count' is not positive.
+func (file *snapshotFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !file.info.isDir {
+		return nil, os.ErrInvalid
+	}
+	if count <= 0 {
+		children := file.children
+		file.children = nil
+		return children, nil
+	}
+	if len(file.children) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(file.children) {
+		count = len(file.children)
+	}
+	children := file.children[:count]
+	file.children = file.children[count:]
+	return children, nil
+}
+
+func (file *snapshotFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += file.offset
+	case io.SeekEnd:
+		offset += file.info.Size()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	file.offset = offset
+	return offset, nil
+}
+
+// Read reads the file content from the chunks covering the current offset.
+func (file *snapshotFile) Read(p []byte) (n int, err error) {
+
+	if file.info.isDir {
+		return 0, os.ErrInvalid
+	}
+	entry := file.info.entry
+	if file.offset >= entry.Size {
+		return 0, io.EOF
+	}
+
+	file.fs.lock.Lock()
+	defer file.fs.lock.Unlock()
+	defer catchFileSystemException(&err)
+
+	// Find the chunk containing the offset
+	position := int64(0)
+	for i := entry.StartChunk; i <= entry.EndChunk && n < len(p); i++ {
+		start := 0
+		if i == entry.StartChunk {
+			start = entry.StartOffset
+		}
+		end := file.chunkLengths[i]
+		if i == entry.EndChunk {
+			end = entry.EndOffset
+		}
+
+		length := int64(end - start)
+		if position+length <= file.offset {
+			position += length
+			continue
+		}
+
+		content := file.fs.getChunk(file.chunkHashes[i])
+		skip := int(file.offset - position)
+		copied := copy(p[n:], content[start+skip:end])
+		n += copied
+		file.offset += int64(copied)
+		position += length
+	}
+	return n, nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+)
+
+func TestSnapshotFileSystem(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case Exception:
+				t.Errorf("%s %s", e.LogID, e.Message)
+				debug.PrintStack()
+			default:
+				t.Errorf("%v", e)
+				debug.PrintStack()
+			}
+		}
+	}()
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "snapshotfs")
+	os.RemoveAll(testDir)
+
+	os.MkdirAll(joinPath(testDir, "repository1", DUPLICACY_DIRECTORY), 0700)
+	os.MkdirAll(joinPath(testDir, "repository1", "dir"), 0700)
+	createRandomFile(joinPath(testDir, "repository1", "dir", "file1"), 1000000)
+	createRandomFile(joinPath(testDir, "repository1", "file2"), 1000)
+
+	threads := 1
+	storage, err := loadStorage(filepath.Join(testDir, "storage"), threads)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	cleanStorage(storage)
+
+	if !ConfigStorage(storage, 16384, 100, 16*1024, 64*1024, 4*1024, "", nil, false, "", 0, 0) {
+		t.Fatalf("Failed to initialize the storage")
+	}
+
+	SetDuplicacyPreferencePath(filepath.Join(testDir, "repository1", DUPLICACY_DIRECTORY))
+	backupManager := CreateBackupManager("host1", storage, testDir, "", "", "", false)
+	backupManager.SetupSnapshotCache("default")
+	if !backupManager.Backup(filepath.Join(testDir, "repository1"), true, threads, "first", false, false, 0, false) {
+		t.Fatalf("The backup failed")
+	}
+
+	fs := CreateSnapshotFileSystem(backupManager.SnapshotManager)
+	ctx := context.Background()
+
+	for _, name := range []string{"/", "/host1", "/host1/1", "/host1/1/dir"} {
+		info, err := fs.Stat(ctx, name)
+		if err != nil || !info.IsDir() {
+			t.Errorf("%s is not a directory: %v", name, err)
+		}
+	}
+	for _, name := range []string{"/host2", "/host1/2", "/host1/1/file3"} {
+		if _, err := fs.Stat(ctx, name); !os.IsNotExist(err) {
+			t.Errorf("%s exists: %v", name, err)
+		}
+	}
+
+	directory, err := fs.OpenFile(ctx, "/host1/1", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open the revision: %v", err)
+	}
+	children, _ := directory.Readdir(0)
+	names := make(map[string]bool)
+	for _, child := range children {
+		names[child.Name()] = child.IsDir()
+	}
+	if len(names) != 2 || !names["dir"] || names["file2"] {
+		t.Errorf("The revision contains %v", names)
+	}
+
+	if _, err := fs.OpenFile(ctx, "/host1/1/file3", os.O_WRONLY|os.O_CREATE, 0644); !os.IsPermission(err) {
+		t.Errorf("A file can be created: %v", err)
+	}
+
+	original, _ := ioutil.ReadFile(joinPath(testDir, "repository1", "dir", "file1"))
+	file, err := fs.OpenFile(ctx, "/host1/1/dir/file1", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open the file: %v", err)
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil || !bytes.Equal(content, original) {
+		t.Errorf("The file content is different: %v", err)
+	}
+
+	// Read a range in the middle of the file, which likely spans multiple chunks
+	offset := int64(len(original) / 3)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	buffer := make([]byte, len(original)/3)
+	if _, err := io.ReadFull(file, buffer); err != nil || !bytes.Equal(buffer, original[offset:offset+int64(len(buffer))]) {
+		t.Errorf("The content at offset %d is different: %v", offset, err)
+	}
+	file.Close()
+}
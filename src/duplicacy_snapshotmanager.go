@@ -5,7 +5,9 @@
 package duplicacy
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -191,6 +193,43 @@ type SnapshotManager struct {
 
 	chunkDownloader *ChunkDownloader
 	chunkOperator   *ChunkOperator
+
+	quarantineEnabled bool               // Move corrupted chunks to the quarantine directory
+	quarantineMirrors []*SnapshotManager // Where to look for good copies of corrupted chunks
+	failoverStorages  []failoverStorage  // Where to download chunks that can't be downloaded from this storage
+
+	gfsRetention *GFSRetention // Select the snapshots to prune by this policy instead of the -keep policies
+
+	ignorePruneLock bool // Prune even if another client holds the prune lock
+
+	targetSize         int64 // Prune the oldest revisions until the storage size is under this many bytes
+	targetMinRevisions int   // The number of latest revisions of each snapshot id to keep when pruning to a size
+
+	keptTags []string // Never prune revisions with tags matching these patterns
+	keepLast int      // Never prune the latest revisions of each snapshot id
+
+	explainRetention bool // Log which retention rule keeps or deletes each revision
+
+	lowMemoryCheck bool // Check chunk existence with sorted temporary files rather than in-memory maps
+
+	changeFeed  string      // List chunks from an index updated by the change feed at this location
+	fullListing bool        // Rebuild the chunk index from a full listing
+	chunkIndex  *chunkIndex // The chunk index in use
+
+	reverifyAfter     time.Duration // Verify chunks again if they were last verified longer ago than this
+	maxChunksToVerify int           // Verify at most this many chunks in one run of check -chunks
+
+	repairEnabled  bool              // Recover missing and corrupted chunks during check
+	repairTop      string            // The repository whose files can be chunked again to recover chunks
+	repairStorages []failoverStorage // Where to look for copies of the chunks being repaired
+
+	uploadedFiles         map[string]UploadedFileSignature // Signatures of snapshot files uploaded by UploadFileOnce
+	uploadedFilesUsed     map[string]bool                  // Files uploaded or skipped by the current operation
+	uploadedFilesPending  int                              // Signatures recorded but not yet saved to the cache
+	uploadedFileChecksums map[string]map[string]string     // Checksums of the files in the storage, by directory
+
+	cacheStorageName string // The storage name the snapshot cache is set up for
+	cacheSizeLimit   int64  // Remove the least recently used cached chunks when the cache grows beyond this size
 }
 
 // CreateSnapshotManager creates a snapshot manager
@@ -268,9 +307,51 @@ func (reader *sequenceReader) Read(data []byte) (n int, err error) {
 	return reader.buffer.Read(data)
 }
 
+// EnableQuarantine makes the chunk downloader move chunks that fail decryption or hash verification to the
+// quarantine directory.  Good copies of these chunks will be searched for in the snapshot cache and 'mirrors'.
+func (manager *SnapshotManager) EnableQuarantine(mirrors ...*SnapshotManager) {
+	manager.quarantineEnabled = true
+	manager.quarantineMirrors = mirrors
+}
+
+// createChunkQuarantine returns nil if the quarantine is not enabled.
+func (manager *SnapshotManager) createChunkQuarantine() *ChunkQuarantine {
+	if !manager.quarantineEnabled {
+		return nil
+	}
+	return CreateChunkQuarantine(manager.config, manager.storage, manager.snapshotCache, manager.quarantineMirrors)
+}
+
 func (manager *SnapshotManager) CreateChunkDownloader() {
 	if manager.chunkDownloader == nil {
 		manager.chunkDownloader = CreateChunkDownloader(manager.config, manager.storage, manager.snapshotCache, false, 1, false)
+		manager.chunkDownloader.quarantine = manager.createChunkQuarantine()
+		manager.chunkDownloader.failover = manager.failoverStorages
+	}
+}
+
+// stopChunkDownloader stops the goroutines of the chunk downloader kept between calls, so that the next operation
+// creates a new one.  It is called once the tasks of the goroutines have ended, so they are all waiting to be stopped.
+func (manager *SnapshotManager) stopChunkDownloader() {
+	if manager.chunkDownloader != nil {
+		for i := 0; i < manager.chunkDownloader.threads; i++ {
+			manager.chunkDownloader.stopChannel <- true
+		}
+		manager.chunkDownloader = nil
+	}
+}
+
+// SetDownloadThreads replaces the chunk downloader with one using the specified number of threads, so that files
+// retrieved by RetrieveFile can have their chunks prefetched.
+func (manager *SnapshotManager) SetDownloadThreads(threads int) {
+	if threads > 1 {
+		if manager.chunkDownloader != nil {
+			manager.chunkDownloader.Stop()
+		}
+		manager.chunkDownloader = CreateChunkDownloader(manager.config, manager.storage, manager.snapshotCache, false,
+			threads, false)
+		manager.chunkDownloader.quarantine = manager.createChunkQuarantine()
+		manager.chunkDownloader.failover = manager.failoverStorages
 	}
 }
 
@@ -288,50 +369,74 @@ func (manager *SnapshotManager) DownloadSequence(sequence []string) (content []b
 
 func (manager *SnapshotManager) DownloadSnapshotFileSequence(snapshot *Snapshot, patterns []string, attributesNeeded bool) bool {
 
-	manager.CreateChunkDownloader()
-
-	reader := sequenceReader{
-		sequence: snapshot.FileSequence,
-		buffer:   new(bytes.Buffer),
-		refillFunc: func(chunkHash string) []byte {
-			i := manager.chunkDownloader.AddChunk(chunkHash)
-			chunk := manager.chunkDownloader.WaitForChunk(i)
-			return chunk.GetBytes()
-		},
-	}
-
+	reader := manager.createSnapshotFileReader(snapshot)
 	files := make([]*Entry, 0)
-	decoder := json.NewDecoder(&reader)
-
-	// read open bracket
-	_, err := decoder.Token()
-	if err != nil {
-		LOG_ERROR("SNAPSHOT_PARSE", "Failed to load files specified in the snapshot %s at revision %d: not a list of entries",
-			snapshot.ID, snapshot.Revision)
-		return false
-	}
-
-	// while the array contains values
-	for decoder.More() {
-		var entry Entry
-		err = decoder.Decode(&entry)
+	for {
+		entry, err := reader.Next()
 		if err != nil {
 			LOG_ERROR("SNAPSHOT_PARSE", "Failed to load files specified in the snapshot %s at revision %d: %v",
 				snapshot.ID, snapshot.Revision, err)
 			return false
 		}
+		if entry == nil {
+			break
+		}
 
 		// If we don't need the attributes or the file isn't included we clear the attributes to save memory
-		if !attributesNeeded || (len(patterns) != 0 && !MatchPath(entry.Path, patterns)) {
+		if !attributesNeeded || (len(patterns) != 0 && !MatchEntry(entry, patterns)) {
 			entry.Attributes = nil
 		}
 
-		files = append(files, &entry)
+		files = append(files, entry)
 	}
 	snapshot.Files = files
 	return true
 }
 
+// snapshotFileReader decodes the files of a snapshot one at a time while the chunks of the file sequence are being
+// downloaded, so that the files don't need to be all in memory.
+type snapshotFileReader struct {
+	decoder *json.Decoder
+	started bool
+}
+
+// createSnapshotFileReader returns a reader of the files in 'snapshot'.
+func (manager *SnapshotManager) createSnapshotFileReader(snapshot *Snapshot) *snapshotFileReader {
+
+	manager.CreateChunkDownloader()
+
+	reader := &sequenceReader{
+		sequence: snapshot.FileSequence,
+		buffer:   new(bytes.Buffer),
+		refillFunc: func(chunkHash string) []byte {
+			i := manager.chunkDownloader.AddChunk(chunkHash)
+			chunk := manager.chunkDownloader.WaitForChunk(i)
+			return chunk.GetBytes()
+		},
+	}
+	return &snapshotFileReader{decoder: json.NewDecoder(reader)}
+}
+
+// Next returns the next file, or nil after the last one.
+func (reader *snapshotFileReader) Next() (*Entry, error) {
+	if !reader.started {
+		// read open bracket
+		if _, err := reader.decoder.Token(); err != nil {
+			return nil, fmt.Errorf("not a list of entries")
+		}
+		reader.started = true
+	}
+
+	if !reader.decoder.More() {
+		return nil, nil
+	}
+	entry := &Entry{}
+	if err := reader.decoder.Decode(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
 // DownloadSnapshotSequence downloads the content represented by a sequence of chunks, and then unmarshal the content
 // using the specified 'loadFunction'.  It purpose is to decode the chunk sequences representing chunk hashes or chunk lengths
 // in a snapshot.
@@ -495,6 +600,7 @@ func (manager *SnapshotManager) CleanSnapshotCache(latestSnapshot *Snapshot, all
 		}
 	}
 
+	manager.trimSnapshotCache()
 	return true
 
 }
@@ -555,7 +661,18 @@ func (manager *SnapshotManager) ListSnapshotRevisions(snapshotID string) (revisi
 }
 
 // DownloadLatestSnapshot downloads the snapshot with the largest revision number.
-func (manager *SnapshotManager) downloadLatestSnapshot(snapshotID string) (remote *Snapshot) {
+func (manager *SnapshotManager) downloadLatestSnapshot(snapshotID string, attributesNeeded bool) (remote *Snapshot) {
+
+	remote = manager.downloadLatestSnapshotInfo(snapshotID)
+	if remote != nil {
+		manager.DownloadSnapshotContents(remote, nil, attributesNeeded)
+	}
+
+	return remote
+}
+
+// downloadLatestSnapshotInfo downloads the snapshot with the largest revision number without its contents.
+func (manager *SnapshotManager) downloadLatestSnapshotInfo(snapshotID string) (remote *Snapshot) {
 
 	LOG_TRACE("SNAPSHOT_DOWNLOAD_LATEST", "Downloading latest revision for snapshot %s", snapshotID)
 
@@ -577,16 +694,27 @@ func (manager *SnapshotManager) downloadLatestSnapshot(snapshotID string) (remot
 		remote = manager.DownloadSnapshot(snapshotID, latest)
 	}
 
-	if remote != nil {
-		manager.DownloadSnapshotContents(remote, nil, false)
-	}
-
 	return remote
 }
 
 // ListAllFiles return all files and subdirectories in the subtree of the 'top' directory in the specified 'storage'.
 func (manager *SnapshotManager) ListAllFiles(storage Storage, top string) (allFiles []string, allSizes []int64) {
 
+	if !manager.forEachFile(storage, top, func(file string, size int64) {
+		allFiles = append(allFiles, file)
+		allSizes = append(allSizes, size)
+	}) {
+		return nil, nil
+	}
+
+	return allFiles, allSizes
+}
+
+// forEachFile calls 'handler' with each file and subdirectory in the subtree of the 'top' directory in the specified
+// 'storage', without keeping the whole list in memory.  Subdirectories have a size of 0.  Files are passed to the
+// handler as they are listed, so the handler may see entries it has renamed or deleted itself in the same directory.
+func (manager *SnapshotManager) forEachFile(storage Storage, top string, handler func(file string, size int64)) bool {
+
 	directories := make([]string, 0, 1024)
 
 	directories = append(directories, top)
@@ -598,28 +726,25 @@ func (manager *SnapshotManager) ListAllFiles(storage Storage, top string) (allFi
 
 		LOG_TRACE("LIST_FILES", "Listing %s", dir)
 
-		files, sizes, err := storage.ListFiles(0, dir)
-		if err != nil {
-			LOG_ERROR("LIST_FILES", "Failed to list the directory %s: %v", dir, err)
-			return nil, nil
-		}
-
 		if len(dir) > len(top) {
-			allFiles = append(allFiles, dir[len(top):])
-			allSizes = append(allSizes, 0)
+			handler(dir[len(top):], 0)
 		}
 
-		for i, file := range files {
+		err := storage.ListFilesFunc(0, dir, func(file string, size int64) bool {
 			if len(file) > 0 && file[len(file)-1] == '/' {
 				directories = append(directories, dir+file)
 			} else {
-				allFiles = append(allFiles, (dir + file)[len(top):])
-				allSizes = append(allSizes, sizes[i])
+				handler((dir + file)[len(top):], size)
 			}
+			return true
+		})
+		if err != nil {
+			LOG_ERROR("LIST_FILES", "Failed to list the directory %s: %v", dir, err)
+			return false
 		}
 	}
 
-	return allFiles, allSizes
+	return true
 }
 
 // GetSnapshotChunks returns all chunks referenced by a given snapshot. If
@@ -707,10 +832,10 @@ func (manager *SnapshotManager) GetSnapshotChunkHashes(snapshot *Snapshot, chunk
 
 // ListSnapshots shows the information about a snapshot.
 func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList []int, tag string,
-	showFiles bool, showChunks bool) int {
+	showFiles bool, showChunks bool, showStatistics bool) int {
 
-	LOG_DEBUG("LIST_PARAMETERS", "id: %s, revisions: %v, tag: %s, showFiles: %t, showChunks: %t",
-		snapshotID, revisionsToList, tag, showFiles, showChunks)
+	LOG_DEBUG("LIST_PARAMETERS", "id: %s, revisions: %v, tag: %s, showFiles: %t, showChunks: %t, showStatistics: %t",
+		snapshotID, revisionsToList, tag, showFiles, showChunks, showStatistics)
 
 	var snapshotIDs []string
 	var err error
@@ -738,10 +863,19 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 			}
 		}
 
+		var statistics map[int]*revisionStatistics
+		if showStatistics {
+			statistics, err = manager.computeRevisionStatistics(snapshotID, revisionsToList)
+			if err != nil {
+				LOG_ERROR("SNAPSHOT_STATS", "Failed to compute the statistics for snapshot %s: %v", snapshotID, err)
+				return 0
+			}
+		}
+
 		for _, revision := range revisions {
 
 			snapshot := manager.DownloadSnapshot(snapshotID, revision)
-			if tag != "" && snapshot.Tag != tag {
+			if tag != "" && !snapshot.MatchTags([]string{tag}) {
 				continue
 			}
 			creationTime := time.Unix(snapshot.StartTime, 0).Format("2006-01-02 15:04")
@@ -751,6 +885,24 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 			}
 			LOG_INFO("SNAPSHOT_INFO", "Snapshot %s revision %d created at %s %s%s",
 				snapshotID, revision, creationTime, tagWithSpace, snapshot.Options)
+			if snapshot.Note != "" {
+				LOG_INFO("SNAPSHOT_NOTE", "Note: %s", snapshot.Note)
+			}
+			EmitJSONRecord("revision", &JSONRevision{
+				ID:            snapshotID,
+				Revision:      revision,
+				StartTime:     snapshot.StartTime,
+				EndTime:       snapshot.EndTime,
+				Tags:          snapshot.GetTags(),
+				Note:          snapshot.Note,
+				Options:       snapshot.Options,
+				FileSize:      snapshot.FileSize,
+				NumberOfFiles: snapshot.NumberOfFiles,
+			})
+
+			if showStatistics {
+				manager.showRevisionStatistics(snapshot, statistics[revision])
+			}
 
 			if showFiles {
 				manager.DownloadSnapshotFileSequence(snapshot, nil, false)
@@ -788,9 +940,13 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 					}
 				}
 
+				fileChunks := lastChunk + 1
+				if snapshot.IsMetadataOnly() {
+					fileChunks = 0
+				}
 				metaChunks := len(snapshot.FileSequence) + len(snapshot.ChunkSequence) + len(snapshot.LengthSequence)
 				LOG_INFO("SNAPSHOT_STATS", "Files: %d, total size: %d, file chunks: %d, metadata chunks: %d",
-					totalFiles, totalFileSize, lastChunk+1, metaChunks)
+					totalFiles, totalFileSize, fileChunks, metaChunks)
 			}
 
 			if showChunks {
@@ -811,7 +967,14 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToCheck []int, tag string, showStatistics bool, showTabular bool,
 	checkFiles bool, checkChunks, searchFossils bool, resurrect bool, threads int, allowFailures bool) bool {
 
+	// Corrupted chunks can only be repaired if the verification continues after them
+	if manager.repairEnabled {
+		allowFailures = true
+	}
+
 	manager.chunkDownloader = CreateChunkDownloader(manager.config, manager.storage, manager.snapshotCache, false, threads, allowFailures)
+	manager.chunkDownloader.quarantine = manager.createChunkQuarantine()
+	manager.chunkDownloader.failover = manager.failoverStorages
 
 	LOG_DEBUG("LIST_PARAMETERS", "id: %s, revisions: %v, tag: %s, showStatistics: %t, showTabular: %t, checkFiles: %t, searchFossils: %t, resurrect: %t",
 		snapshotID, revisionsToCheck, tag, showStatistics, showTabular, checkFiles, searchFossils, resurrect)
@@ -830,25 +993,32 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 
 	emptyChunks := 0
 
-	LOG_INFO("SNAPSHOT_CHECK", "Listing all chunks")
-	allChunks, allSizes := manager.ListAllFiles(manager.storage, chunkDir)
+	defer manager.saveChunkIndex()
 
-	for i, chunk := range allChunks {
-		if len(chunk) == 0 || chunk[len(chunk)-1] == '/' {
-			continue
-		}
+	// In low-memory mode the chunks are listed into a sorted temporary file instead
+	if !manager.lowMemoryCheck {
+		LOG_INFO("SNAPSHOT_CHECK", "Listing all chunks")
+		listed := manager.listChunks(func(chunk string, size int64) {
+			if len(chunk) == 0 || chunk[len(chunk)-1] == '/' {
+				return
+			}
 
-		if strings.HasSuffix(chunk, ".fsl") {
-			continue
-		}
+			if strings.HasSuffix(chunk, ".fsl") {
+				return
+			}
 
-		chunk = strings.Replace(chunk, "/", "", -1)
-		chunkSizeMap[chunk] = allSizes[i]
+			chunk = strings.Replace(chunk, "/", "", -1)
+			chunkSizeMap[chunk] = size
 
-		if allSizes[i] == 0 && !strings.HasSuffix(chunk, ".tmp") {
-			LOG_WARN("SNAPSHOT_CHECK", "Chunk %s has a size of 0", chunk)
-			emptyChunks++
+			if size == 0 && !strings.HasSuffix(chunk, ".tmp") {
+				LOG_WARN("SNAPSHOT_CHECK", "Chunk %s has a size of 0", chunk)
+				emptyChunks++
+			}
+		})
+		if !listed {
+			return false
 		}
+		manager.rebuildKnownChunks(chunkSizeMap)
 	}
 
 	if snapshotID == "" || showStatistics || showTabular {
@@ -881,7 +1051,7 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 
 		for _, revision := range revisions {
 			snapshot := manager.DownloadSnapshot(snapshotID, revision)
-			if tag != "" && snapshot.Tag != tag {
+			if tag != "" && !snapshot.MatchTags([]string{tag}) {
 				continue
 			}
 			snapshotMap[snapshotID] = append(snapshotMap[snapshotID], snapshot)
@@ -894,6 +1064,13 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 	}
 	LOG_INFO("SNAPSHOT_CHECK", "%d snapshots and %d revisions", len(snapshotMap), totalRevisions)
 
+	if manager.lowMemoryCheck {
+		return manager.checkChunksWithExternalSort(snapshotMap, searchFossils, resurrect)
+	}
+
+	repairer := manager.createChunkRepairer(snapshotMap)
+	defer repairer.report()
+
 	var totalChunkSize int64
 	for _, size := range chunkSizeMap {
 		totalChunkSize += size
@@ -928,49 +1105,48 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 				if !found {
 
 					// Look up the chunk again in case it actually exists, but only if there aren't
-					// too many missing chunks.
-					if missingChunks < 100 {
-						_, exist, _, err := manager.storage.FindChunk(0, chunkID, false)
+					// too many missing chunks, or if the chunks come from a chunk index that may miss
+					// the chunks uploaded recently.
+					if missingChunks < 100 || manager.chunkIndex.mayMissChunks() {
+						chunkPath, exist, size, err := manager.storage.FindChunk(0, chunkID, false)
 						if err != nil {
 							LOG_WARN("SNAPSHOT_VALIDATE", "Failed to check the existence of chunk %s: %v",
 							         chunkID, err)
 						} else if exist {
 							LOG_INFO("SNAPSHOT_VALIDATE", "Chunk %s is confirmed to exist", chunkID)
+							manager.chunkIndex.addFile(chunkPath, size)
 							continue
 						}
 					}
 
-					if !searchFossils {
-						missingChunks += 1
-						LOG_WARN("SNAPSHOT_VALIDATE",
-							"Chunk %s referenced by snapshot %s at revision %d does not exist",
-							chunkID, snapshotID, snapshot.Revision)
-						continue
-					}
+					exist := false
+					if searchFossils {
+						chunkPath, fossilExist, size, err := manager.storage.FindChunk(0, chunkID, true)
+						if err != nil {
+							LOG_ERROR("SNAPSHOT_VALIDATE", "Failed to check the existence of fossil %s: %v",
+								chunkID, err)
+							return false
+						}
 
-					chunkPath, exist, size, err := manager.storage.FindChunk(0, chunkID, true)
-					if err != nil {
-						LOG_ERROR("SNAPSHOT_VALIDATE", "Failed to check the existence of fossil %s: %v",
-							chunkID, err)
-						return false
+						if fossilExist {
+							if resurrect {
+								manager.resurrectChunk(chunkPath, chunkID)
+							} else {
+								LOG_WARN("SNAPSHOT_FOSSIL", "Chunk %s referenced by snapshot %s at revision %d "+
+									"has been marked as a fossil", chunkID, snapshotID, snapshot.Revision)
+							}
+							chunkSizeMap[chunkID] = size
+							exist = true
+						}
 					}
 
-					if !exist {
+					if !exist && !repairer.repairMissingChunk(chunkID, snapshot, chunkSizeMap) {
 						missingChunks += 1
 						LOG_WARN("SNAPSHOT_VALIDATE",
 							"Chunk %s referenced by snapshot %s at revision %d does not exist",
 							chunkID, snapshotID, snapshot.Revision)
 						continue
 					}
-
-					if resurrect {
-						manager.resurrectChunk(chunkPath, chunkID)
-					} else {
-						LOG_WARN("SNAPSHOT_FOSSIL", "Chunk %s referenced by snapshot %s at revision %d "+
-							"has been marked as a fossil", chunkID, snapshotID, snapshot.Revision)
-					}
-
-					chunkSizeMap[chunkID] = size
 				}
 
 				if unique, found := chunkUniqueMap[chunkID]; !found {
@@ -1040,10 +1216,11 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 			LOG_WARN("SNAPSHOT_VERIFY", "Failed to parse the file containing verified chunks: %v", err)
 		}
 	}
-	numberOfVerifiedChunks := len(verifiedChunks)
+	unsavedChunks := 0
+	lastSaveTime := time.Now()
 
 	saveVerifiedChunks := func() {
-		if len(verifiedChunks) > numberOfVerifiedChunks {
+		if unsavedChunks > 0 {
 			var description []byte
 			description, err = json.Marshal(verifiedChunks)
 			if err != nil {
@@ -1053,8 +1230,10 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 				if err != nil {
 					LOG_WARN("SNAPSHOT_VERIFY", "Failed to save the verified chunks file: %v", err)
 				} else {
-					LOG_INFO("SNAPSHOT_VERIFY", "Added %d chunks to the list of verified chunks", len(verifiedChunks) - numberOfVerifiedChunks)
+					LOG_INFO("SNAPSHOT_VERIFY", "Added %d chunks to the list of verified chunks", unsavedChunks)
+					unsavedChunks = 0
 				}
+				lastSaveTime = time.Now()
 			}
 		}
 	}
@@ -1071,16 +1250,9 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 	// some metadata chunks so the index doesn't start with 0.
 	chunkIndex := -1
 
-	skippedChunks := 0
-	for chunkHash := range *allChunkHashes {
-		if len(verifiedChunks) > 0 {
-			chunkID := manager.config.GetChunkIDFromHash(chunkHash)
-			if _, found := verifiedChunks[chunkID]; found {
-				skippedChunks++
-				continue
-			}
-		}
-		chunkHashes = append(chunkHashes, chunkHash)
+	chunkHashes, skippedChunks, postponedChunks := manager.selectChunksToVerify(*allChunkHashes, verifiedChunks,
+		startTime)
+	for _, chunkHash := range chunkHashes {
 		if chunkIndex == -1 {
 			chunkIndex = manager.chunkDownloader.AddChunk(chunkHash)
 		} else {
@@ -1088,19 +1260,33 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 		}
 	}
 
-	if skippedChunks > 0 {
+	if skippedChunks > 0 && manager.reverifyAfter > 0 {
+		LOG_INFO("SNAPSHOT_VERIFY", "Skipped %d chunks that have been verified in the last %d days", skippedChunks,
+			int(manager.reverifyAfter.Hours()/24))
+	} else if skippedChunks > 0 {
 		LOG_INFO("SNAPSHOT_VERIFY", "Skipped %d chunks that have already been verified before", skippedChunks)
 	}
+	if postponedChunks > 0 {
+		LOG_INFO("SNAPSHOT_VERIFY", "%d chunks will be verified in later runs", postponedChunks)
+	}
 
 	var downloadedChunkSize int64
+	var corruptedChunks []string
 	totalChunks := len(chunkHashes)
+	bar := StartProgressBar("Verify", int64(totalChunks), "chunks")
 	for i := 0; i < totalChunks; i++ {
 		chunk := manager.chunkDownloader.WaitForChunk(i + chunkIndex)
 		chunkID := manager.config.GetChunkIDFromHash(chunkHashes[i])
+		bar.Add(1, int64(chunk.GetLength()))
 		if chunk.isBroken {
+			corruptedChunks = append(corruptedChunks, chunkHashes[i])
 			continue
 		}
 		verifiedChunks[chunkID] = startTime.Unix()
+		unsavedChunks++
+		if time.Since(lastSaveTime) >= verifiedChunksSaveInterval {
+			saveVerifiedChunks()
+		}
 		downloadedChunkSize += int64(chunk.GetLength())
 
 		elapsedTime := time.Now().Sub(startTime).Seconds()
@@ -1110,9 +1296,23 @@ func (manager *SnapshotManager) CheckSnapshots(snapshotID string, revisionsToChe
 		LOG_INFO("VERIFY_PROGRESS", "Verified chunk %s (%d/%d), %sB/s %s %.1f%%",
 					chunkID, i + 1, totalChunks, PrettySize(speed), PrettyTime(remainingTime), percentage)
 	}
+	bar.Finish()
+
+	// Repairs may need to download metadata chunks, which can only start after all chunks to verify are downloaded
+	failedChunks := manager.chunkDownloader.NumberOfFailedChunks
+	if repairer != nil && len(corruptedChunks) > 0 {
+		manager.chunkDownloader.snapshotCache = manager.snapshotCache
+		for _, chunkHash := range corruptedChunks {
+			if repairer.repairCorruptedChunk(chunkHash) {
+				verifiedChunks[manager.config.GetChunkIDFromHash(chunkHash)] = startTime.Unix()
+				unsavedChunks++
+				failedChunks--
+			}
+		}
+	}
 
-	if manager.chunkDownloader.NumberOfFailedChunks > 0 {
-		LOG_ERROR("SNAPSHOT_VERIFY", "%d out of %d chunks are corrupted", manager.chunkDownloader.NumberOfFailedChunks, len(*allChunkHashes))
+	if failedChunks > 0 {
+		LOG_ERROR("SNAPSHOT_VERIFY", "%d out of %d chunks are corrupted", failedChunks, len(*allChunkHashes))
 	} else {
 		LOG_INFO("SNAPSHOT_VERIFY", "All %d chunks have been successfully verified", len(*allChunkHashes))
 	}
@@ -1270,6 +1470,9 @@ func (manager *SnapshotManager) PrintSnapshot(snapshot *Snapshot) bool {
 	object["id"] = snapshot.ID
 	object["revision"] = snapshot.Revision
 	object["tag"] = snapshot.Tag
+	if snapshot.Note != "" {
+		object["note"] = snapshot.Note
+	}
 	object["start_time"] = snapshot.StartTime
 	object["end_time"] = snapshot.EndTime
 
@@ -1305,6 +1508,12 @@ func (manager *SnapshotManager) PrintSnapshot(snapshot *Snapshot) bool {
 // and computing the whole file hash for each file.
 func (manager *SnapshotManager) VerifySnapshot(snapshot *Snapshot) bool {
 
+	if snapshot.IsMetadataOnly() {
+		LOG_INFO("SNAPSHOT_VERIFY", "Snapshot %s at revision %d is a metadata-only snapshot with no file contents to verify",
+			snapshot.ID, snapshot.Revision)
+		return true
+	}
+
 	err := manager.CheckSnapshot(snapshot)
 
 	if err != nil {
@@ -1347,6 +1556,12 @@ func (manager *SnapshotManager) RetrieveFile(snapshot *Snapshot, file *Entry, ou
 		return true
 	}
 
+	if snapshot.IsMetadataOnly() {
+		LOG_WARN("SNAPSHOT_METADATA", "The content of %s isn't available in the metadata-only snapshot %s at revision %d",
+			file.Path, snapshot.ID, snapshot.Revision)
+		return false
+	}
+
 	manager.CreateChunkDownloader()
 
 	// Temporarily disable the snapshot cache of the download so that downloaded file chunks won't be saved
@@ -1365,6 +1580,22 @@ func (manager *SnapshotManager) RetrieveFile(snapshot *Snapshot, file *Entry, ou
 
 	var chunk *Chunk
 
+	// Add all chunks of the file to the download list first, so that when there are multiple downloading threads,
+	// later chunks can be prefetched while earlier ones are being consumed.  A chunk identical to the previous one
+	// (or to the chunk last downloaded for the previous file) is only downloaded once.
+	lastChunk, lastChunkHash := manager.chunkDownloader.GetLastDownloadedChunk()
+	chunkIndices := make([]int, 0, file.EndChunk-file.StartChunk+1)
+	for i := file.StartChunk; i <= file.EndChunk; i++ {
+		hash := snapshot.ChunkHashes[i]
+		if i == file.StartChunk && hash == lastChunkHash {
+			chunkIndices = append(chunkIndices, -1)
+		} else if i > file.StartChunk && hash == snapshot.ChunkHashes[i-1] {
+			chunkIndices = append(chunkIndices, chunkIndices[len(chunkIndices)-1])
+		} else {
+			chunkIndices = append(chunkIndices, manager.chunkDownloader.AddChunk(hash))
+		}
+	}
+
 	for i := file.StartChunk; i <= file.EndChunk; i++ {
 		start := 0
 		if i == file.StartChunk {
@@ -1376,10 +1607,8 @@ func (manager *SnapshotManager) RetrieveFile(snapshot *Snapshot, file *Entry, ou
 		}
 
 		hash := snapshot.ChunkHashes[i]
-		lastChunk, lastChunkHash := manager.chunkDownloader.GetLastDownloadedChunk()
-		if lastChunkHash != hash {
-			i := manager.chunkDownloader.AddChunk(hash)
-			chunk = manager.chunkDownloader.WaitForChunk(i)
+		if chunkIndex := chunkIndices[i-file.StartChunk]; chunkIndex >= 0 {
+			chunk = manager.chunkDownloader.WaitForChunk(chunkIndex)
 		} else {
 			chunk = lastChunk
 		}
@@ -1419,15 +1648,16 @@ func (manager *SnapshotManager) FindFile(snapshot *Snapshot, filePath string, su
 	return nil
 }
 
-// PrintFile prints the specified file or the snapshot to stdout.
-func (manager *SnapshotManager) PrintFile(snapshotID string, revision int, path string) bool {
+// PrintFile prints the specified file or the snapshot to stdout.  The chunks of the file are downloaded by
+// 'threads' threads.
+func (manager *SnapshotManager) PrintFile(snapshotID string, revision int, path string, threads int) bool {
 
 	LOG_DEBUG("PRINT_PARAMETERS", "id: %s, revision: %d, path: %s", snapshotID, revision, path)
 
 	var snapshot *Snapshot
 
 	if revision <= 0 {
-		snapshot = manager.downloadLatestSnapshot(snapshotID)
+		snapshot = manager.downloadLatestSnapshot(snapshotID, false)
 		if snapshot == nil {
 			LOG_ERROR("SNAPSHOT_PRINT", "No previous snapshot %s is not found", snapshotID)
 			return false
@@ -1456,23 +1686,37 @@ func (manager *SnapshotManager) PrintFile(snapshotID string, revision int, path
 	}
 
 	file := manager.FindFile(snapshot, path, false)
+
+	manager.SetDownloadThreads(threads)
+
+	// The content is streamed to the standard output as chunks arrive; if the reader goes away (for example, the
+	// program the output is piped to exits), there is no point in downloading the rest of the file
+	output := bufio.NewWriterSize(os.Stdout, 1024*1024)
 	if !manager.RetrieveFile(snapshot, file, func(chunk []byte) {
-			fmt.Printf("%s", chunk)
-		}) {
+		if _, err := output.Write(chunk); err != nil {
+			LOG_ERROR("SNAPSHOT_PRINT", "Failed to write the content of %s: %v", path, err)
+		}
+	}) {
+		output.Flush()
 		LOG_ERROR("SNAPSHOT_RETRIEVE", "File %s is corrupted in snapshot %s at revision %d",
 			path, snapshot.ID, snapshot.Revision)
 		return false
 	}
 
+	if err := output.Flush(); err != nil {
+		LOG_ERROR("SNAPSHOT_PRINT", "Failed to write the content of %s: %v", path, err)
+		return false
+	}
 	return true
 }
 
 // Diff compares two snapshots, or two revision of a file if the file argument is given.
 func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []int,
-	filePath string, compareByHash bool, nobackupFile string, filtersFile string, excludeByAttribute bool) bool {
+	filePath string, compareByHash bool, markerFiles []string, filtersFile string, excludeByAttribute bool,
+	showContent bool) bool {
 
-	LOG_DEBUG("DIFF_PARAMETERS", "top: %s, id: %s, revision: %v, path: %s, compareByHash: %t",
-		top, snapshotID, revisions, filePath, compareByHash)
+	LOG_DEBUG("DIFF_PARAMETERS", "top: %s, id: %s, revision: %v, path: %s, compareByHash: %t, showContent: %t",
+		top, snapshotID, revisions, filePath, compareByHash, showContent)
 
 	var leftSnapshot *Snapshot
 	var rightSnapshot *Snapshot
@@ -1482,7 +1726,7 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 	if len(revisions) <= 1 {
 		// Only scan the repository if filePath is not provided
 		if len(filePath) == 0 {
-			rightSnapshot, _, _, err = CreateSnapshotFromDirectory(snapshotID, top, nobackupFile, filtersFile, excludeByAttribute)
+			rightSnapshot, _, _, err = CreateSnapshotFromDirectory(snapshotID, top, markerFiles, filtersFile, excludeByAttribute, true, false, nil)
 			if err != nil {
 				LOG_ERROR("SNAPSHOT_LIST", "Failed to list the directory %s: %v", top, err)
 				return false
@@ -1494,7 +1738,7 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 
 	// If no revision is specified, use the latest revision as the left-hand side.
 	if len(revisions) < 1 {
-		leftSnapshot = manager.downloadLatestSnapshot(snapshotID)
+		leftSnapshot = manager.downloadLatestSnapshot(snapshotID, false)
 		if leftSnapshot == nil {
 			LOG_ERROR("SNAPSHOT_DIFF", "No previous snapshot %s is not found", snapshotID)
 			return false
@@ -1530,13 +1774,18 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 			}
 		} else {
 			var err error
-			rightFile, err = ioutil.ReadFile(joinPath(top, filePath))
+			rightFile, err = ioutil.ReadFile(joinRootPath(top, filePath))
 			if err != nil {
 				LOG_ERROR("SNAPSHOT_DIFF", "Failed to read %s from the repository: %v", filePath, err)
 				return false
 			}
 		}
 
+		if showContent {
+			printUnifiedDiff(filePath, leftSnapshot, leftFile, rightSnapshot, rightFile)
+			return true
+		}
+
 		leftLines := strings.Split(string(leftFile), "\n")
 		rightLines := strings.Split(string(rightFile), "\n")
 
@@ -1582,10 +1831,18 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 		return true
 	}
 
-	// We only need to decode the 'files' sequence, not 'chunkhashes' or 'chunklengthes'
-	manager.DownloadSnapshotFileSequence(leftSnapshot, nil, false)
-	if rightSnapshot != nil && rightSnapshot.Revision != 0 {
-		manager.DownloadSnapshotFileSequence(rightSnapshot, nil, false)
+	if showContent {
+		// The chunks are needed to reassemble the changed files
+		manager.DownloadSnapshotContents(leftSnapshot, nil, false)
+		if rightSnapshot != nil && rightSnapshot.Revision != 0 {
+			manager.DownloadSnapshotContents(rightSnapshot, nil, false)
+		}
+	} else {
+		// We only need to decode the 'files' sequence, not 'chunkhashes' or 'chunklengthes'
+		manager.DownloadSnapshotFileSequence(leftSnapshot, nil, false)
+		if rightSnapshot != nil && rightSnapshot.Revision != 0 {
+			manager.DownloadSnapshotFileSequence(rightSnapshot, nil, false)
+		}
 	}
 
 	maxSize := int64(9)
@@ -1647,7 +1904,7 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 				same := false
 				if rightSnapshot.Revision == 0 {
 					if compareByHash && right.Size > 0 {
-						right.Hash = manager.config.ComputeFileHash(joinPath(top, right.Path), buffer)
+						right.Hash = manager.config.ComputeFileHash(joinRootPath(top, right.Path), buffer)
 						same = left.Hash == right.Hash
 					} else {
 						same = right.IsSameAs(left)
@@ -1663,6 +1920,9 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 				if !same {
 					LOG_INFO("SNAPSHOT_DIFF", "  %s", left.String(maxSizeDigits))
 					LOG_INFO("SNAPSHOT_DIFF", "* %s", right.String(maxSizeDigits))
+					if showContent {
+						manager.showContentDiff(top, leftSnapshot, left, rightSnapshot, right)
+					}
 				}
 				i++
 				j++
@@ -1674,10 +1934,10 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 
 // ShowHistory shows how a file changes over different revisions.
 func (manager *SnapshotManager) ShowHistory(top string, snapshotID string, revisions []int,
-	filePath string, showLocalHash bool) bool {
+	filePath string, showLocalHash bool, changesOnly bool) bool {
 
-	LOG_DEBUG("HISTORY_PARAMETERS", "top: %s, id: %s, revisions: %v, path: %s, showLocalHash: %t",
-		top, snapshotID, revisions, filePath, showLocalHash)
+	LOG_DEBUG("HISTORY_PARAMETERS", "top: %s, id: %s, revisions: %v, path: %s, showLocalHash: %t, changesOnly: %t",
+		top, snapshotID, revisions, filePath, showLocalHash, changesOnly)
 
 	var err error
 
@@ -1690,31 +1950,44 @@ func (manager *SnapshotManager) ShowHistory(top string, snapshotID string, revis
 	}
 
 	var lastVersion *Entry
+	present := false
 	sort.Ints(revisions)
 	for _, revision := range revisions {
 		snapshot := manager.DownloadSnapshot(snapshotID, revision)
 		manager.DownloadSnapshotFileSequence(snapshot, nil, false)
 		file := manager.FindFile(snapshot, filePath, true)
 
-		if file != nil {
-
-			if !file.IsFile() {
-				continue
-			}
+		if file != nil && file.IsFile() {
 
 			modifiedFlag := ""
-			if lastVersion != nil && lastVersion.Hash != file.Hash {
+			changed := !present
+			if lastVersion != nil && isFileVersionChanged(lastVersion, file) {
 				modifiedFlag = "*"
+				changed = true
 			}
-			LOG_INFO("SNAPSHOT_HISTORY", "%7d: %s%s", revision, file.String(15), modifiedFlag)
+			present = true
 			lastVersion = file
+
+			if !changesOnly {
+				LOG_INFO("SNAPSHOT_HISTORY", "%7d: %s%s", revision, file.String(15), modifiedFlag)
+			} else if changed {
+				LOG_INFO("SNAPSHOT_HISTORY", "%7d (%s): %s", revision, time.Unix(snapshot.StartTime, 0).Format("2006-01-02 15:04"),
+					file.String(15))
+			}
+		} else if file != nil {
+			continue
 		} else {
-			LOG_INFO("SNAPSHOT_HISTORY", "%7d:", revision)
+			if !changesOnly {
+				LOG_INFO("SNAPSHOT_HISTORY", "%7d:", revision)
+			} else if present {
+				LOG_INFO("SNAPSHOT_HISTORY", "%7d (%s): deleted", revision, time.Unix(snapshot.StartTime, 0).Format("2006-01-02 15:04"))
+			}
+			present = false
 		}
 
 	}
 
-	stat, err := os.Stat(joinPath(top, filePath))
+	stat, err := os.Stat(joinRootPath(top, filePath))
 	if stat != nil {
 		localFile := CreateEntry(filePath, stat.Size(), stat.ModTime().Unix(), 0)
 		modifiedFlag := ""
@@ -1722,7 +1995,7 @@ func (manager *SnapshotManager) ShowHistory(top string, snapshotID string, revis
 			modifiedFlag = "*"
 		}
 		if showLocalHash {
-			localFile.Hash = manager.config.ComputeFileHash(joinPath(top, filePath), make([]byte, 32*1024))
+			localFile.Hash = manager.config.ComputeFileHash(joinRootPath(top, filePath), make([]byte, 32*1024))
 			if lastVersion == nil || lastVersion.Hash != localFile.Hash {
 				modifiedFlag = "*"
 			}
@@ -1735,6 +2008,15 @@ func (manager *SnapshotManager) ShowHistory(top string, snapshotID string, revis
 	return true
 }
 
+// isFileVersionChanged returns true if two versions of a file have different contents.  Files in snapshots that
+// don't record file hashes, such as metadata-only snapshots, are compared by size and timestamp instead.
+func isFileVersionChanged(previous *Entry, current *Entry) bool {
+	if previous.Hash == "" || current.Hash == "" {
+		return !previous.IsSameAs(current)
+	}
+	return previous.Hash != current.Hash
+}
+
 // fossilizeChunk turns the chunk into a fossil.
 func (manager *SnapshotManager) fossilizeChunk(chunkID string, filePath string, exclusive bool) bool {
 	if exclusive {
@@ -1757,6 +2039,7 @@ func (manager *SnapshotManager) resurrectChunk(fossilPath string, chunkID string
 
 	if exist {
 		manager.storage.DeleteFile(0, fossilPath)
+		manager.chunkIndex.removeFile(fossilPath)
 		LOG_INFO("FOSSIL_RECREATE", "The chunk %s already exists", chunkID)
 	} else {
 		err := manager.storage.MoveFile(0, fossilPath, chunkPath)
@@ -1765,6 +2048,7 @@ func (manager *SnapshotManager) resurrectChunk(fossilPath string, chunkID string
 				chunkID, fossilPath, err)
 			return false
 		} else {
+			manager.chunkIndex.renameFile(fossilPath, chunkPath)
 			LOG_INFO("FOSSIL_RESURRECT", "The chunk %s has been resurrected", fossilPath)
 		}
 	}
@@ -1797,12 +2081,31 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		snapshotID, revisionsToBeDeleted, tags, retentions,
 		exhaustive, exclusive, dryRun, deleteOnly, collectOnly)
 
-	if len(revisionsToBeDeleted) > 0 && (len(tags) > 0 || len(retentions) > 0) {
+	if len(revisionsToBeDeleted) > 0 && (len(tags) > 0 || len(retentions) > 0 || manager.gfsRetention != nil) {
 		LOG_WARN("DELETE_OPTIONS", "Tags or retention policy will be ignored if at least one revision is specified")
 	}
+	if len(revisionsToBeDeleted) == 0 && manager.gfsRetention != nil {
+		if len(retentions) > 0 {
+			LOG_ERROR("RETENTION_INVALID", "The GFS retention policy can't be combined with -keep policies")
+			return false
+		}
+		LOG_INFO("RETENTION_POLICY", "Keep %s snapshots", manager.gfsRetention)
+	}
+
+	// A dry run doesn't change the storage so it doesn't conflict with other prunes
+	if !dryRun {
+		lock := manager.acquireStorageLock(pruneLockFile, "prune", manager.ignorePruneLock)
+		if lock == nil {
+			return false
+		}
+		defer lock.release()
+	}
 
+	// The chunk index is saved after the chunk operator has completed all operations
+	defer manager.saveChunkIndex()
 	manager.chunkOperator = CreateChunkOperator(manager.storage, threads)
 	defer manager.chunkOperator.Stop()
+	manager.openChunkIndex()
 
 	prefPath := GetDuplicacyPreferencePath()
 	logDir := path.Join(prefPath, "logs")
@@ -1937,6 +2240,16 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 	}
 	maxCollectionNumber := 0
 
+	// Complete the prune that was interrupted, or pick up the snapshots it was deleting
+	var journal *pruneJournal
+	if interrupted := manager.loadPruneJournal(); interrupted != nil {
+		if dryRun {
+			LOG_WARN("PRUNE_RESUME", "An interrupted prune will be completed by the next prune that is not a dry run")
+		} else {
+			journal = manager.finishPruneJournal(interrupted, allSnapshots, logFile)
+		}
+	}
+
 	referencedFossils := make(map[string]bool)
 
 	// Find fossil collections previously created, and delete fossils and temporary files in them if they are
@@ -2057,6 +2370,9 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 			}
 
 			if !dryRun {
+				// The fossils are deleted or resurrected by the chunk operator threads; the collection file can only
+				// be removed once they are all done
+				manager.chunkOperator.Wait()
 				err = manager.snapshotCache.DeleteFile(0, collectionFile)
 				if err != nil {
 					LOG_WARN("FOSSIL_FILE", "Failed to remove the fossil collection file %s: %v", collectionFile, err)
@@ -2081,11 +2397,6 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		revisionMap[revision] = true
 	}
 
-	tagMap := make(map[string]bool)
-	for _, tag := range tags {
-		tagMap[tag] = true
-	}
-
 	// Find the snapshots that need to be deleted
 	for id, snapshots := range allSnapshots {
 
@@ -2105,41 +2416,53 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 			}
 
 			continue
+		} else if manager.gfsRetention != nil {
+			toBeDeleted += manager.flagGFSSnapshots(snapshots, tags, exclusive, dryRun)
 		} else if len(retentionPolicies) > 0 {
 
 			if len(snapshots) <= 1 {
+				for _, snapshot := range snapshots {
+					manager.explainRetentionDecision(snapshot, getDaysBetween(snapshot.StartTime, time.Now().Unix()),
+						"the only revision is always kept")
+				}
 				continue
 			}
 
 			lastSnapshotTime := int64(0)
+			lastRevision := 0
 			now := time.Now().Unix()
 			i := 0
 			for j, snapshot := range snapshots {
 
+				age := getDaysBetween(snapshot.StartTime, now)
+
 				if !exclusive && j == len(snapshots)-1 {
+					manager.explainRetentionDecision(snapshot, age, "the latest revision is always kept")
 					continue
 				}
 
-				if len(tagMap) > 0 {
-					if _, found := tagMap[snapshot.Tag]; !found {
-						continue
-					}
+				if len(tags) > 0 && !snapshot.MatchTags(tags) {
+					manager.explainRetentionDecision(snapshot, age, "the tag '%s' doesn't match", snapshot.Tag)
+					continue
 				}
 
 				// Find out which retent policy applies based on the age.
 				for i < len(retentionPolicies) &&
-					getDaysBetween(snapshot.StartTime, now) < retentionPolicies[i].Age {
+					age < retentionPolicies[i].Age {
 					i++
 					lastSnapshotTime = 0
 				}
 
 				if i < len(retentionPolicies) {
+					rule := fmt.Sprintf("%d:%d", retentionPolicies[i].Interval, retentionPolicies[i].Age)
 					if retentionPolicies[i].Interval == 0 {
 						// No snapshots to keep if interval is 0
 						LOG_DEBUG("SNAPSHOT_DELETE", "Snapshot %s at revision %d to be deleted - older than %d days",
 							snapshot.ID, snapshot.Revision, retentionPolicies[i].Age)
 						snapshot.Flag = true
 						toBeDeleted++
+						manager.explainRetentionDecision(snapshot, age, "rule %s keeps nothing older than %d days",
+							rule, retentionPolicies[i].Age)
 					} else if lastSnapshotTime != 0 &&
 						getDaysBetween(lastSnapshotTime, snapshot.StartTime) < retentionPolicies[i].Interval {
 						// Delete the snapshot if it is too close to the last kept one.
@@ -2147,9 +2470,18 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 							snapshot.ID, snapshot.Revision, retentionPolicies[i].Age, retentionPolicies[i].Interval)
 						snapshot.Flag = true
 						toBeDeleted++
+						manager.explainRetentionDecision(snapshot, age, "rule %s keeps 1 every %d days and revision "+
+							"%d is kept less than %d days earlier", rule, retentionPolicies[i].Interval, lastRevision,
+							retentionPolicies[i].Interval)
 					} else {
 						lastSnapshotTime = snapshot.StartTime
+						lastRevision = snapshot.Revision
+						manager.explainRetentionDecision(snapshot, age, "rule %s keeps 1 every %d days", rule,
+							retentionPolicies[i].Interval)
 					}
+				} else if manager.explainRetention {
+					manager.explainRetentionDecision(snapshot, age, "no rule applies to revisions newer than %d "+
+						"days", retentionPolicies[len(retentionPolicies)-1].Age)
 				} else {
 					// Ran out of retention policy; no need to check further
 					break
@@ -2158,7 +2490,7 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 
 		} else if len(tags) > 0 {
 			for _, snapshot := range snapshots {
-				if _, found := tagMap[snapshot.Tag]; found {
+				if snapshot.MatchTags(tags) {
 					snapshot.Flag = true
 					toBeDeleted++
 				}
@@ -2167,6 +2499,14 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		}
 	}
 
+	toBeDeleted += journal.flagJournalSnapshots(allSnapshots)
+	toBeDeleted -= manager.unflagPinnedSnapshots(allSnapshots)
+	toBeDeleted -= manager.unflagKeptTagSnapshots(allSnapshots)
+	toBeDeleted -= manager.unflagLastSnapshots(allSnapshots)
+	if len(revisionsToBeDeleted) == 0 && manager.targetSize > 0 {
+		toBeDeleted += manager.flagSnapshotsForTargetSize(allSnapshots, snapshotID, exclusive, dryRun)
+	}
+
 	if toBeDeleted == 0 && !exhaustive {
 		LOG_INFO("SNAPSHOT_NONE", "No snapshot to delete")
 		return false
@@ -2174,6 +2514,17 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 
 	collection := CreateFossilCollection(allSnapshots)
 
+	// Record the snapshots to be deleted before turning any chunk into a fossil
+	journal.addToCollection(collection)
+	if !dryRun {
+		journal = createPruneJournal(allSnapshots, exclusive)
+		journal.Fossils = append(journal.Fossils, collection.Fossils...)
+		journal.Temporaries = append(journal.Temporaries, collection.Temporaries...)
+		if !manager.savePruneJournal(journal) {
+			return false
+		}
+	}
+
 	var success bool
 	if exhaustive {
 		success = manager.pruneSnapshotsExhaustive(referencedFossils, allSnapshots, collection, logFile, dryRun, exclusive)
@@ -2188,6 +2539,11 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 	for _, fossil := range manager.chunkOperator.fossils {
 		collection.AddFossil(fossil)
 	}
+	if !dryRun {
+		fossilized, deleted, resurrected := manager.chunkOperator.GetStatistics()
+		LOG_INFO("PRUNE_OPERATIONS", "Fossilized %d chunks, deleted %d files, and resurrected %d fossils using %d threads",
+			fossilized, deleted, resurrected, threads)
+	}
 
 	// Save the deleted revision in the fossil collection
 	for _, snapshots := range allSnapshots {
@@ -2198,6 +2554,14 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		}
 	}
 
+	if !dryRun {
+		journal.Fossils = collection.Fossils
+		journal.Temporaries = collection.Temporaries
+		if !manager.savePruneJournal(journal) {
+			return false
+		}
+	}
+
 	// Save the fossil collection if it is not empty.
 	if !collection.IsEmpty() && !dryRun && !exclusive {
 		collection.EndTime = time.Now().Unix()
@@ -2220,6 +2584,14 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 
 		LOG_INFO("FOSSIL_COLLECT", "Fossil collection %d saved", collectionNumber)
 		fmt.Fprintf(logFile, "Fossil collection %d saved\n", collectionNumber)
+		journal.CollectionNumber = collectionNumber
+	}
+
+	if !dryRun {
+		journal.Collected = true
+		if !manager.savePruneJournal(journal) {
+			return false
+		}
 	}
 
 	// Now delete the snapshot files.
@@ -2229,27 +2601,16 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 				continue
 			}
 
-			snapshotPath := fmt.Sprintf("snapshots/%s/%d", snapshot.ID, snapshot.Revision)
-			err = manager.storage.DeleteFile(0, snapshotPath)
-			if err != nil {
-				LOG_ERROR("SNAPSHOT_DELETE", "Failed to delete the snapshot %s at revision %d: %v",
-					snapshot.ID, snapshot.Revision, err)
+			if !manager.deletePrunedSnapshot(snapshot, logFile) {
 				return false
 			}
-			LOG_INFO("SNAPSHOT_DELETE", "The snapshot %s at revision %d has been removed",
-				snapshot.ID, snapshot.Revision)
-			err = manager.snapshotCache.DeleteFile(0, snapshotPath)
-			if err != nil {
-				LOG_WARN("SNAPSHOT_DELETE", "The cached snapshot %s at revision %d could not be removed: %v",
-					snapshot.ID, snapshot.Revision, err)
-				fmt.Fprintf(logFile, "Cached snapshot %s at revision %d could not be removed: %v",
-					snapshot.ID, snapshot.Revision, err)
-			} else {
-				fmt.Fprintf(logFile, "Deleted cached snapshot %s at revision %d\n", snapshot.ID, snapshot.Revision)
-			}
 		}
 	}
 
+	if !dryRun {
+		manager.removePruneJournal()
+	}
+
 	if collection.IsEmpty() && !dryRun && toBeDeleted != 0 && !exclusive {
 		LOG_INFO("FOSSIL_NONE",
 			"No fossil collection has been created since deleted snapshots did not reference any unique chunks")
@@ -2318,6 +2679,7 @@ func (manager *SnapshotManager) pruneSnapshotsNonExhaustive(allSnapshots map[str
 		}
 	}
 
+	var unreferencedChunks []string
 	for chunk, value := range targetChunks {
 		if value {
 			continue
@@ -2325,6 +2687,7 @@ func (manager *SnapshotManager) pruneSnapshotsNonExhaustive(allSnapshots map[str
 
 		if dryRun {
 			LOG_INFO("CHUNK_UNREFERENCED", "Found unreferenced chunk %s", chunk)
+			unreferencedChunks = append(unreferencedChunks, chunk)
 			continue
 		}
 
@@ -2338,6 +2701,10 @@ func (manager *SnapshotManager) pruneSnapshotsNonExhaustive(allSnapshots map[str
 		targetChunks[chunk] = true
 	}
 
+	if dryRun {
+		manager.estimateUnreferencedChunks(unreferencedChunks).report()
+	}
+
 	return true
 }
 
@@ -2374,10 +2741,13 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 		}
 	}
 
-	allFiles, _ := manager.ListAllFiles(manager.storage, chunkDir)
-	for _, file := range allFiles {
+	estimate := &pruneEstimate{}
+
+	// Chunks fossilized while the listing is in progress may be listed again as fossils
+	fossilized := make(map[string]bool)
+	listed := manager.listChunks(func(file string, size int64) {
 		if file[len(file)-1] == '/' {
-			continue
+			return
 		}
 
 		if strings.HasSuffix(file, ".tmp") {
@@ -2385,7 +2755,7 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 			// a left-over from a restore operation that was terminated abruptly.
 			if dryRun {
 				LOG_INFO("CHUNK_TEMPORARY", "Found temporary file %s", file)
-				continue
+				return
 			}
 
 			if exclusive {
@@ -2395,8 +2765,12 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 			} else {
 				collection.AddTemporary(file)
 			}
-			continue
+			return
 		} else if strings.HasSuffix(file, ".fsl") {
+			if fossilized[strings.TrimSuffix(file, ".fsl")] {
+				return
+			}
+
 			// This is a fossil.  If it is unreferenced, it can be a result of failing to save the fossil
 			// collection file after making it a fossil.
 			if _, found := referencedFossils[file]; !found {
@@ -2408,7 +2782,7 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 
 					if dryRun {
 						LOG_INFO("FOSSIL_REFERENCED", "Found referenced fossil %s", file)
-						continue
+						return
 					}
 
 					manager.chunkOperator.Resurrect(chunk, chunkDir+file)
@@ -2418,7 +2792,8 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 
 					if dryRun {
 						LOG_INFO("FOSSIL_UNREFERENCED", "Found unreferenced fossil %s", file)
-						continue
+						estimate.addFossil(size)
+						return
 					}
 
 					if exclusive {
@@ -2431,26 +2806,28 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 				}
 			}
 
-			continue
+			return
 		}
 
 		chunk := strings.Replace(file, "/", "", -1)
 
 		if !chunkRegex.MatchString(chunk) {
 			LOG_WARN("CHUNK_UNKNOWN_FILE", "File %s is not a chunk", file)
-			continue
+			return
 		}
 
 		if value, found := referencedChunks[chunk]; !found {
 			if dryRun {
 				LOG_INFO("CHUNK_UNREFERENCED", "Found unreferenced chunk %s", chunk)
-				continue
+				estimate.addChunk(size)
+				return
 			}
 
 			manager.fossilizeChunk(chunk, chunkDir+file, exclusive)
 			if exclusive {
 				fmt.Fprintf(logFile, "Deleted chunk %s (exclusive mode)\n", chunk)
 			} else {
+				fossilized[file] = true
 				fmt.Fprintf(logFile, "Marked fossil %s\n", chunk)
 			}
 		} else if value {
@@ -2459,7 +2836,7 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 
 			if dryRun {
 				LOG_INFO("CHUNK_REDUNDANT", "Found redundant chunk %s", chunk)
-				continue
+				return
 			}
 
 			// This is a redundant chunk file (for instance D3/495A8D and D3/49/5A8D )
@@ -2469,6 +2846,13 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 			referencedChunks[chunk] = true
 			LOG_DEBUG("CHUNK_KEEP", "Chunk %s is referenced", chunk)
 		}
+	})
+	if !listed {
+		return false
+	}
+
+	if dryRun {
+		estimate.report()
 	}
 
 	return true
@@ -2477,10 +2861,6 @@ func (manager *SnapshotManager) pruneSnapshotsExhaustive(referencedFossils map[s
 // CheckSnapshot performs sanity checks on the given snapshot.
 func (manager *SnapshotManager) CheckSnapshot(snapshot *Snapshot) (err error) {
 
-	lastChunk := 0
-	lastOffset := 0
-	var lastEntry *Entry
-
 	numberOfChunks := len(snapshot.ChunkHashes)
 
 	if numberOfChunks != len(snapshot.ChunkLengths) {
@@ -2488,91 +2868,212 @@ func (manager *SnapshotManager) CheckSnapshot(snapshot *Snapshot) (err error) {
 			numberOfChunks, len(snapshot.ChunkLengths))
 	}
 
+	checker := &snapshotChecker{snapshot: snapshot}
+
+	// The files in a file list were packed in the order they are listed, so they are already sorted by chunk, except
+	// for those preserved from the previous snapshot, which can only be checked one at a time
+	if snapshot.fileList != nil {
+		if snapshot.preservedChunks > 0 {
+			checker.startChunk = snapshot.preservedChunks
+			checker.lastChunk = snapshot.preservedChunks - 1
+		}
+		reader, err := snapshot.fileList.NewReader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		for {
+			entry, err := reader.Next()
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				break
+			}
+			if err = checker.checkOrder(entry); err != nil {
+				return err
+			}
+			// Entries without contents would otherwise be taken as the first entry in chunk order
+			hasContent := entry.IsFile() && entry.Size > 0
+			if hasContent && entry.EndChunk < snapshot.preservedChunks {
+				err = checker.checkChunks(entry)
+			} else if hasContent || snapshot.preservedChunks == 0 {
+				err = checker.checkContent(entry)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return checker.finish()
+	}
+
 	entries := make([]*Entry, len(snapshot.Files))
 	copy(entries, snapshot.Files)
 	sort.Sort(ByChunk(entries))
 
 	for _, entry := range snapshot.Files {
-		if lastEntry != nil && lastEntry.Compare(entry) >= 0 && !strings.Contains(lastEntry.Path, "\ufffd") {
-			return fmt.Errorf("The entry %s appears before the entry %s", lastEntry.Path, entry.Path)
+		if err = checker.checkOrder(entry); err != nil {
+			return err
 		}
-		lastEntry = entry
+	}
+
+	// Files in a metadata-only snapshot don't reference any chunks
+	if snapshot.IsMetadataOnly() {
+		return nil
 	}
 
 	for _, entry := range entries {
+		if err = checker.checkContent(entry); err != nil {
+			return err
+		}
+	}
 
-		if !entry.IsFile() || entry.Size == 0 {
-			continue
+	return checker.finish()
+}
+
+// snapshotChecker performs the checks of CheckSnapshot one entry at a time.  checkOrder must be called with the
+// entries in the order of the snapshot, and checkContent with the entries sorted by chunk.
+type snapshotChecker struct {
+	snapshot *Snapshot
+
+	lastEntry  *Entry
+	lastChunk  int
+	lastOffset int
+
+	checked    bool // whether checkContent has been called
+	firstChunk int  // the start chunk of the first entry passed to checkContent
+	startChunk int  // where the first entry passed to checkContent must start
+}
+
+func (checker *snapshotChecker) checkOrder(entry *Entry) error {
+	lastEntry := checker.lastEntry
+	if lastEntry != nil && lastEntry.Compare(entry) >= 0 && !strings.Contains(lastEntry.Path, "\ufffd") {
+		return fmt.Errorf("The entry %s appears before the entry %s", lastEntry.Path, entry.Path)
+	}
+	checker.lastEntry = entry
+	return nil
+}
+
+func (checker *snapshotChecker) checkContent(entry *Entry) error {
+
+	if !checker.checked {
+		checker.checked = true
+		checker.firstChunk = entry.StartChunk
+	}
+
+	if !entry.IsFile() || entry.Size == 0 {
+		return nil
+	}
+
+	lastChunk := checker.lastChunk
+	lastOffset := checker.lastOffset
+
+	if err := checker.checkBounds(entry); err != nil {
+		return err
+	}
+
+	if entry.StartOffset > 0 {
+		if entry.StartChunk < lastChunk {
+			return fmt.Errorf("The file %s starts at chunk %d while the last chunk is %d",
+				entry.Path, entry.StartChunk, lastChunk)
 		}
 
-		if entry.StartChunk < 0 {
-			return fmt.Errorf("The file %s starts at chunk %d", entry.Path, entry.StartChunk)
+		if entry.StartChunk > lastChunk+1 {
+			return fmt.Errorf("The file %s starts at chunk %d while the last chunk is %d",
+				entry.Path, entry.StartChunk, lastChunk)
 		}
 
-		if entry.EndChunk >= numberOfChunks {
-			return fmt.Errorf("The file %s ends at chunk %d while the number of chunks is %d",
-				entry.Path, entry.EndChunk, numberOfChunks)
+		if entry.StartChunk == lastChunk && entry.StartOffset < lastOffset {
+			return fmt.Errorf("The file %s starts at offset %d of chunk %d while the last file ends at offset %d",
+				entry.Path, entry.StartOffset, entry.StartChunk, lastOffset)
 		}
 
-		if entry.EndChunk < entry.StartChunk {
-			return fmt.Errorf("The file %s starts at chunk %d and ends at chunk %d",
-				entry.Path, entry.StartChunk, entry.EndChunk)
+		if entry.StartChunk == entry.EndChunk && entry.StartOffset > entry.EndOffset {
+			return fmt.Errorf("The file %s starts at offset %d and ends at offset %d of the same chunk %d",
+				entry.Path, entry.StartOffset, entry.EndOffset, entry.StartChunk)
 		}
+	}
 
-		if entry.StartOffset > 0 {
-			if entry.StartChunk < lastChunk {
-				return fmt.Errorf("The file %s starts at chunk %d while the last chunk is %d",
-					entry.Path, entry.StartChunk, lastChunk)
-			}
+	if err := checker.checkSize(entry); err != nil {
+		return err
+	}
 
-			if entry.StartChunk > lastChunk+1 {
-				return fmt.Errorf("The file %s starts at chunk %d while the last chunk is %d",
-					entry.Path, entry.StartChunk, lastChunk)
-			}
+	checker.lastChunk = entry.EndChunk
+	checker.lastOffset = entry.EndOffset
+	return nil
+}
 
-			if entry.StartChunk == lastChunk && entry.StartOffset < lastOffset {
-				return fmt.Errorf("The file %s starts at offset %d of chunk %d while the last file ends at offset %d",
-					entry.Path, entry.StartOffset, entry.StartChunk, lastOffset)
-			}
+// checkChunks performs the checks of checkContent that don't depend on the other files, for a file that isn't
+// passed to checkContent in chunk order.
+func (checker *snapshotChecker) checkChunks(entry *Entry) error {
+	if err := checker.checkBounds(entry); err != nil {
+		return err
+	}
 
-			if entry.StartChunk == entry.EndChunk && entry.StartOffset > entry.EndOffset {
-				return fmt.Errorf("The file %s starts at offset %d and ends at offset %d of the same chunk %d",
-					entry.Path, entry.StartOffset, entry.EndOffset, entry.StartChunk)
-			}
-		}
+	if entry.StartChunk == entry.EndChunk && entry.StartOffset > entry.EndOffset {
+		return fmt.Errorf("The file %s starts at offset %d and ends at offset %d of the same chunk %d",
+			entry.Path, entry.StartOffset, entry.EndOffset, entry.StartChunk)
+	}
 
-		fileSize := int64(0)
+	return checker.checkSize(entry)
+}
 
-		for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+func (checker *snapshotChecker) checkBounds(entry *Entry) error {
+	numberOfChunks := len(checker.snapshot.ChunkHashes)
 
-			start := 0
-			if i == entry.StartChunk {
-				start = entry.StartOffset
-			}
-			end := snapshot.ChunkLengths[i]
-			if i == entry.EndChunk {
-				end = entry.EndOffset
-			}
+	if entry.StartChunk < 0 {
+		return fmt.Errorf("The file %s starts at chunk %d", entry.Path, entry.StartChunk)
+	}
 
-			fileSize += int64(end - start)
-		}
+	if entry.EndChunk >= numberOfChunks {
+		return fmt.Errorf("The file %s ends at chunk %d while the number of chunks is %d",
+			entry.Path, entry.EndChunk, numberOfChunks)
+	}
+
+	if entry.EndChunk < entry.StartChunk {
+		return fmt.Errorf("The file %s starts at chunk %d and ends at chunk %d",
+			entry.Path, entry.StartChunk, entry.EndChunk)
+	}
+	return nil
+}
+
+// checkSize checks that the size of a file matches the size of its chunks.
+func (checker *snapshotChecker) checkSize(entry *Entry) error {
+	fileSize := int64(0)
 
-		if entry.Size != fileSize {
-			return fmt.Errorf("The file %s has a size of %d but the total size of chunks is %d",
-				entry.Path, entry.Size, fileSize)
+	for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+
+		start := 0
+		if i == entry.StartChunk {
+			start = entry.StartOffset
+		}
+		end := checker.snapshot.ChunkLengths[i]
+		if i == entry.EndChunk {
+			end = entry.EndOffset
 		}
 
-		lastChunk = entry.EndChunk
-		lastOffset = entry.EndOffset
+		fileSize += int64(end - start)
 	}
 
-	if len(entries) > 0 && entries[0].StartChunk != 0 {
-		return fmt.Errorf("The first file starts at chunk %d", entries[0].StartChunk)
+	if entry.Size != fileSize {
+		return fmt.Errorf("The file %s has a size of %d but the total size of chunks is %d",
+			entry.Path, entry.Size, fileSize)
+	}
+	return nil
+}
+
+// finish performs the checks that need all entries to have been passed to checkContent.
+func (checker *snapshotChecker) finish() error {
+
+	if checker.checked && checker.firstChunk != checker.startChunk {
+		return fmt.Errorf("The first file starts at chunk %d", checker.firstChunk)
 	}
 
 	// There may be a last chunk whose size is 0 so we allow this to happen
-	if lastChunk < numberOfChunks-2 {
-		return fmt.Errorf("The last file ends at chunk %d but the number of chunks is %d", lastChunk, numberOfChunks)
+	numberOfChunks := len(checker.snapshot.ChunkHashes)
+	if checker.lastChunk < numberOfChunks-2 {
+		return fmt.Errorf("The last file ends at chunk %d but the number of chunks is %d", checker.lastChunk,
+			numberOfChunks)
 	}
 
 	return nil
@@ -2618,6 +3119,188 @@ func (manager *SnapshotManager) DownloadFile(path string, derivationKey string)
 	return manager.fileChunk.GetBytes()
 }
 
+// The file in the snapshot cache that stores the signatures of snapshot files uploaded by operations that may be
+// retried
+var uploadedFilesFile = "uploaded_files"
+
+// The number of signatures recorded in memory before they are saved to the snapshot cache
+var uploadedFilesBatchSize = 16
+
+// UploadedFileSignature identifies the content of a snapshot file that has been uploaded.  Since encryption uses a
+// random nonce, the hash is computed from the unencrypted content, while the checksum is the one the storage reports
+// for the uploaded file.
+type UploadedFileSignature struct {
+	Hash     string `json:"hash"`
+	Checksum string `json:"checksum"`
+}
+
+// getFileSignature returns the hash of a snapshot file to be uploaded.
+func getFileSignature(path string, content []byte) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(path))
+	hasher.Write(content)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// loadUploadedFiles loads the signatures of uploaded files from the snapshot cache.
+func (manager *SnapshotManager) loadUploadedFiles() {
+	if manager.uploadedFiles != nil {
+		return
+	}
+
+	manager.uploadedFiles = make(map[string]UploadedFileSignature)
+	if manager.snapshotCache == nil {
+		return
+	}
+
+	description, err := ioutil.ReadFile(path.Join(manager.snapshotCache.storageDir, uploadedFilesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("UPLOAD_SIGNATURE", "Failed to load the signatures of uploaded files: %v", err)
+		}
+		return
+	}
+
+	err = json.Unmarshal(description, &manager.uploadedFiles)
+	if err != nil {
+		LOG_WARN("UPLOAD_SIGNATURE", "Failed to parse the signatures of uploaded files: %v", err)
+	}
+}
+
+// saveUploadedFile records the signature of a file that has just been uploaded.  The signatures are saved to the
+// snapshot cache in batches of uploadedFilesBatchSize; losing the last few in a crash only means that the retried
+// run will upload those files again.
+func (manager *SnapshotManager) saveUploadedFile(path string, signature UploadedFileSignature) {
+	if manager.snapshotCache == nil {
+		return
+	}
+
+	manager.loadUploadedFiles()
+	manager.uploadedFiles[path] = signature
+	manager.markUploadedFileUsed(path)
+	manager.uploadedFilesPending++
+	if manager.uploadedFilesPending >= uploadedFilesBatchSize {
+		manager.writeUploadedFiles()
+	}
+}
+
+// markUploadedFileUsed remembers that the current operation has uploaded the file, or skipped it because it had been
+// uploaded by an interrupted run, so that finishUploadedFiles can drop its signature.
+func (manager *SnapshotManager) markUploadedFileUsed(path string) {
+	if manager.uploadedFilesUsed == nil {
+		manager.uploadedFilesUsed = make(map[string]bool)
+	}
+	manager.uploadedFilesUsed[path] = true
+}
+
+// writeUploadedFiles saves the signatures of uploaded files to the snapshot cache, or removes the file from the cache
+// if there are none left.
+func (manager *SnapshotManager) writeUploadedFiles() {
+	manager.uploadedFilesPending = 0
+
+	if len(manager.uploadedFiles) == 0 {
+		err := manager.snapshotCache.DeleteFile(0, uploadedFilesFile)
+		if err != nil && !os.IsNotExist(err) {
+			LOG_WARN("UPLOAD_SIGNATURE", "Failed to remove the signatures of uploaded files: %v", err)
+		}
+		return
+	}
+
+	description, err := json.Marshal(manager.uploadedFiles)
+	if err != nil {
+		LOG_WARN("UPLOAD_SIGNATURE", "Failed to encode the signatures of uploaded files: %v", err)
+		return
+	}
+
+	err = manager.snapshotCache.UploadFile(0, uploadedFilesFile, description)
+	if err != nil {
+		LOG_WARN("UPLOAD_SIGNATURE", "Failed to save the signatures of uploaded files: %v", err)
+	}
+}
+
+// finishUploadedFiles is called once an operation uploading files with UploadFileOnce has succeeded.  Only a retried
+// run of an interrupted operation can skip a file, so the signatures of the files this operation has uploaded or
+// skipped are no longer needed and are removed before the rest are saved.
+func (manager *SnapshotManager) finishUploadedFiles() {
+	manager.uploadedFileChecksums = nil
+	if manager.snapshotCache == nil || manager.uploadedFiles == nil {
+		return
+	}
+
+	changed := manager.uploadedFilesPending > 0
+	for path := range manager.uploadedFilesUsed {
+		if _, found := manager.uploadedFiles[path]; found {
+			delete(manager.uploadedFiles, path)
+			changed = true
+		}
+	}
+	manager.uploadedFilesUsed = nil
+
+	if changed {
+		manager.writeUploadedFiles()
+	}
+}
+
+// isFileUploaded returns true if the file with the same content has already been uploaded to the storage.  The file
+// in the storage may have been replaced by another client since, so it is only skipped if the storage reports the
+// checksum of the uploaded file; the checksums are listed once per directory.
+func (manager *SnapshotManager) isFileUploaded(filePath string, hash string) bool {
+	manager.loadUploadedFiles()
+
+	signature, found := manager.uploadedFiles[filePath]
+	if !found || signature.Hash != hash || signature.Checksum == "" {
+		return false
+	}
+
+	lister, ok := manager.storage.(storageChecksumLister)
+	if !ok {
+		return false
+	}
+
+	dir, file := path.Split(filePath)
+	checksums, found := manager.uploadedFileChecksums[dir]
+	if !found {
+		files, fileChecksums, err := lister.ListChecksums(0, dir)
+		if err != nil {
+			LOG_DEBUG("UPLOAD_SIGNATURE", "Failed to list the checksums of the files in %s: %v", dir, err)
+			return false
+		}
+		checksums = make(map[string]string)
+		for i, name := range files {
+			checksums[name] = fileChecksums[i]
+		}
+		if manager.uploadedFileChecksums == nil {
+			manager.uploadedFileChecksums = make(map[string]map[string]string)
+		}
+		manager.uploadedFileChecksums[dir] = checksums
+	}
+
+	return checksums[file] == signature.Checksum
+}
+
+// UploadFileOnce uploads a snapshot file like UploadFile, unless an interrupted run of the same operation has already
+// uploaded the file with the same content.  The operation must call finishUploadedFiles once it has succeeded.
+func (manager *SnapshotManager) UploadFileOnce(path string, derivationKey string, content []byte) bool {
+
+	hash := getFileSignature(path, content)
+	if manager.isFileUploaded(path, hash) {
+		manager.markUploadedFileUsed(path)
+		LOG_INFO("UPLOAD_FILE_SKIP", "The file %s with the same content has already been uploaded", path)
+		return true
+	}
+
+	if !manager.UploadFile(path, derivationKey, content) {
+		return false
+	}
+
+	checksum := ""
+	if lister, ok := manager.storage.(storageChecksumLister); ok {
+		checksum = lister.ComputeChecksum(manager.fileChunk.GetBytes())
+	}
+	manager.saveUploadedFile(path, UploadedFileSignature{Hash: hash, Checksum: checksum})
+	return true
+}
+
 // UploadFile uploads a non-chunk file from the storage.
 func (manager *SnapshotManager) UploadFile(path string, derivationKey string, content []byte) bool {
 	manager.fileChunk.Reset(false)
@@ -685,3 +685,130 @@ func TestPruneGhostSnapshots(t *testing.T) {
 	checkTestSnapshots(snapshotManager, 3, 0)
 	snapshotManager.CheckSnapshots("vm1@host1", []int{2, 3, 4}, "", false, false, false, false, false, false, 1, false)
 }
+
+func TestIsFileVersionChanged(t *testing.T) {
+
+	previous := CreateEntry("file", 100, 1000, 0644)
+	current := CreateEntry("file", 100, 1000, 0644)
+
+	// Without hashes the versions are compared by size and timestamp
+	if isFileVersionChanged(previous, current) {
+		t.Errorf("Identical versions are considered changed")
+	}
+	current.Time = 2000
+	if !isFileVersionChanged(previous, current) {
+		t.Errorf("A version with a different timestamp is not considered changed")
+	}
+
+	// With hashes only the content matters
+	previous.Hash = "hash1"
+	current.Hash = "hash1"
+	if isFileVersionChanged(previous, current) {
+		t.Errorf("A version with the same content is considered changed")
+	}
+	current.Hash = "hash2"
+	if !isFileVersionChanged(previous, current) {
+		t.Errorf("A version with different content is not considered changed")
+	}
+}
+
+// uploadCountingStorage records the files uploaded to a storage that reports checksums.
+type uploadCountingStorage struct {
+	*checksumTestStorage
+	uploaded []string
+}
+
+func (storage *uploadCountingStorage) UploadFile(threadIndex int, filePath string, content []byte) error {
+	storage.uploaded = append(storage.uploaded, filePath)
+	return storage.checksumTestStorage.UploadFile(threadIndex, filePath, content)
+}
+
+func TestUploadedFilesResume(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	defer func(batchSize int) {
+		uploadedFilesBatchSize = batchSize
+	}(uploadedFilesBatchSize)
+	uploadedFilesBatchSize = 2
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "uploaded_files")
+	snapshotManager := createTestSnapshotManager(testDir)
+	fileStorage := snapshotManager.storage.(*FileStorage)
+	storage := &uploadCountingStorage{checksumTestStorage: &checksumTestStorage{FileStorage: fileStorage}}
+	snapshotManager.storage = storage
+	storage.CreateDirectory(0, "snapshots/host1")
+
+	var paths []string
+	contents := make(map[string][]byte)
+	for i := 1; i <= 3; i++ {
+		file := fmt.Sprintf("snapshots/host1/%d", i)
+		paths = append(paths, file)
+		contents[file] = []byte(fmt.Sprintf("{\"id\":\"host1\",\"revision\":%d}", i))
+	}
+
+	// The operation is interrupted after uploading all three files but before finishing; only the first batch of
+	// signatures has been saved to the snapshot cache
+	for _, file := range paths {
+		if !snapshotManager.UploadFileOnce(file, file, contents[file]) {
+			t.Fatalf("Failed to upload %s", file)
+		}
+	}
+
+	uploadedFilesPath := path.Join(testDir, "cache", uploadedFilesFile)
+	saved := make(map[string]UploadedFileSignature)
+	description, err := ioutil.ReadFile(uploadedFilesPath)
+	if err != nil {
+		t.Fatalf("Failed to read the signatures of uploaded files: %v", err)
+	}
+	if err = json.Unmarshal(description, &saved); err != nil {
+		t.Fatalf("Failed to parse the signatures of uploaded files: %v", err)
+	}
+	if len(saved) != 2 {
+		t.Errorf("%d signatures were saved instead of 2", len(saved))
+	}
+
+	// Another client replaces the second file with a different one of the same size
+	overwritten := path.Join(testDir, paths[1])
+	info, err := os.Stat(overwritten)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", paths[1], err)
+	}
+	garbage := make([]byte, info.Size())
+	rand.Read(garbage)
+	ioutil.WriteFile(overwritten, garbage, 0644)
+
+	// The retried run loads the saved signatures and only skips the file that is still the one it uploaded
+	storage.uploaded = nil
+	retryManager := CreateSnapshotManager(snapshotManager.config, storage)
+	retryManager.snapshotCache = snapshotManager.snapshotCache
+	for _, file := range paths {
+		if !retryManager.UploadFileOnce(file, file, contents[file]) {
+			t.Fatalf("Failed to upload %s again", file)
+		}
+	}
+	if strings.Join(storage.uploaded, " ") != paths[1]+" "+paths[2] {
+		t.Errorf("The retried run uploaded %v", storage.uploaded)
+	}
+	if content, _ := ioutil.ReadFile(overwritten); string(content) == string(garbage) {
+		t.Errorf("The overwritten file wasn't uploaded again")
+	}
+
+	// Once the operation finishes the signatures are no longer needed
+	retryManager.finishUploadedFiles()
+	if len(retryManager.uploadedFiles) != 0 {
+		t.Errorf("%d signatures are left after the operation finished", len(retryManager.uploadedFiles))
+	}
+	if _, err = os.Stat(uploadedFilesPath); !os.IsNotExist(err) {
+		t.Errorf("The signatures of uploaded files were not removed from the snapshot cache: %v", err)
+	}
+
+	// Without checksums reported by the storage the uploaded files can't be told apart, so they are never skipped
+	plainManager := CreateSnapshotManager(snapshotManager.config, fileStorage)
+	plainManager.snapshotCache = snapshotManager.snapshotCache
+	plainManager.UploadFileOnce(paths[0], paths[0], contents[paths[0]])
+	if hash := getFileSignature(paths[0], contents[paths[0]]); plainManager.isFileUploaded(paths[0], hash) {
+		t.Errorf("A file was skipped without a checksum to check")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetBackupNote attaches a note to the revision created by the next backup.
+func (manager *BackupManager) SetBackupNote(note string) {
+	manager.backupNote = strings.TrimSpace(note)
+}
+
+// AnnotateSnapshots replaces the notes of the given revisions, or removes them if 'note' is empty.  As with tags, the
+// snapshot files are uploaded again with only the note changed.
+func (manager *SnapshotManager) AnnotateSnapshots(snapshotID string, revisions []int, note string) bool {
+
+	note = strings.TrimSpace(note)
+	for _, revision := range revisions {
+		snapshot := manager.DownloadSnapshot(snapshotID, revision)
+		if snapshot == nil {
+			return false
+		}
+
+		if snapshot.Note == note {
+			LOG_INFO("SNAPSHOT_NOTE", "The note of snapshot %s at revision %d is unchanged", snapshotID, revision)
+			continue
+		}
+		snapshot.Note = note
+
+		description, err := snapshot.MarshalJSON()
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_NOTE", "Failed to create a json file for snapshot %s at revision %d: %v", snapshotID,
+				revision, err)
+			return false
+		}
+		path := fmt.Sprintf("snapshots/%s/%d", snapshotID, revision)
+		if !manager.UploadFileOnce(path, path, description) {
+			return false
+		}
+		if note == "" {
+			LOG_INFO("SNAPSHOT_NOTE", "Removed the note of snapshot %s at revision %d", snapshotID, revision)
+		} else {
+			LOG_INFO("SNAPSHOT_NOTE", "Snapshot %s at revision %d is now annotated '%s'", snapshotID, revision, note)
+		}
+	}
+	manager.finishUploadedFiles()
+	return true
+}
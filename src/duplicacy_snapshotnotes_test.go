@@ -0,0 +1,59 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotateSnapshots(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		createTestSnapshot(snapshotManager, "vm1@host1", i+1, now-int64(3-i)*3600, now-int64(3-i)*3600+60,
+			[]string{uploadRandomChunk(snapshotManager, chunkSize)}, "")
+	}
+
+	if !snapshotManager.AnnotateSnapshots("vm1@host1", []int{1, 2}, "  before OS upgrade ") {
+		t.Fatalf("Failed to annotate the snapshots")
+	}
+	if !snapshotManager.AnnotateSnapshots("vm1@host1", []int{1}, "") {
+		t.Fatalf("Failed to remove the note")
+	}
+
+	expected := map[int]string{1: "", 2: "before OS upgrade", 3: ""}
+	for revision, note := range expected {
+		snapshot := snapshotManager.DownloadSnapshot("vm1@host1", revision)
+		if snapshot.Note != note {
+			t.Errorf("Revision %d has the note '%s' instead of '%s'", revision, snapshot.Note, note)
+		}
+
+		// Snapshots without a note are saved as before
+		description, _ := snapshot.MarshalJSON()
+		if strings.Contains(string(description), `"note"`) != (note != "") {
+			t.Errorf("The json file of revision %d is %s", revision, description)
+		}
+	}
+
+	// The note survives other changes to the snapshot file
+	if !snapshotManager.TagSnapshots("vm1@host1", []int{2}, []string{"upgrade"}, nil) {
+		t.Fatalf("Failed to tag the snapshot")
+	}
+	snapshot := snapshotManager.DownloadSnapshot("vm1@host1", 2)
+	if snapshot.Note != "before OS upgrade" || snapshot.Tag != "upgrade" {
+		t.Errorf("Revision 2 has the note '%s' and the tag '%s'", snapshot.Note, snapshot.Tag)
+	}
+}
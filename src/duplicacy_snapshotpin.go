@@ -0,0 +1,197 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotPin marks a revision that prune must never delete, such as one under a legal hold or a known-good
+// baseline.  It is saved as snapshots/<id>/<revision>.pin next to the snapshot file, which ListSnapshotRevisions
+// ignores since its name isn't a number.
+type SnapshotPin struct {
+	Reason string `json:"reason,omitempty"`
+	Host   string `json:"host"`
+	Time   int64  `json:"time"`
+}
+
+func getSnapshotPinPath(snapshotID string, revision int) string {
+	return fmt.Sprintf("snapshots/%s/%d.pin", snapshotID, revision)
+}
+
+// PinSnapshots pins the given revisions so prune won't delete them regardless of the retention policies.
+func (manager *SnapshotManager) PinSnapshots(snapshotID string, revisions []int, reason string) bool {
+
+	host, _ := os.Hostname()
+	pin := SnapshotPin{
+		Reason: reason,
+		Host:   host,
+		Time:   time.Now().Unix(),
+	}
+	description, err := json.Marshal(pin)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_PIN", "Failed to create a json file for the pin: %v", err)
+		return false
+	}
+
+	for _, revision := range revisions {
+		snapshotPath := fmt.Sprintf("snapshots/%s/%d", snapshotID, revision)
+		exist, _, _, err := manager.storage.GetFileInfo(0, snapshotPath)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to check if there is a snapshot %s at revision %d: %v",
+				snapshotID, revision, err)
+			return false
+		} else if !exist {
+			LOG_ERROR("SNAPSHOT_PIN", "Snapshot %s at revision %d does not exist", snapshotID, revision)
+			return false
+		}
+
+		err = manager.storage.UploadFile(0, getSnapshotPinPath(snapshotID, revision), description)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to pin snapshot %s at revision %d: %v", snapshotID, revision, err)
+			return false
+		}
+		LOG_INFO("SNAPSHOT_PIN", "Snapshot %s at revision %d has been pinned", snapshotID, revision)
+	}
+	return true
+}
+
+// UnpinSnapshots removes the pins from the given revisions so that they may be pruned again.
+func (manager *SnapshotManager) UnpinSnapshots(snapshotID string, revisions []int) bool {
+
+	for _, revision := range revisions {
+		pinPath := getSnapshotPinPath(snapshotID, revision)
+		exist, _, _, err := manager.storage.GetFileInfo(0, pinPath)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to check if snapshot %s at revision %d is pinned: %v",
+				snapshotID, revision, err)
+			return false
+		} else if !exist {
+			LOG_WARN("SNAPSHOT_PIN", "Snapshot %s at revision %d is not pinned", snapshotID, revision)
+			continue
+		}
+
+		err = manager.storage.DeleteFile(0, pinPath)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to unpin snapshot %s at revision %d: %v", snapshotID, revision, err)
+			return false
+		}
+		LOG_INFO("SNAPSHOT_PIN", "Snapshot %s at revision %d has been unpinned", snapshotID, revision)
+	}
+	return true
+}
+
+// ListPinnedRevisions returns the pinned revisions of the given snapshot id in ascending order.
+func (manager *SnapshotManager) ListPinnedRevisions(snapshotID string) (revisions []int, err error) {
+
+	files, _, err := manager.storage.ListFiles(0, fmt.Sprintf("snapshots/%s/", snapshotID))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".pin") {
+			continue
+		}
+		revision, err := strconv.Atoi(strings.TrimSuffix(file, ".pin"))
+		if err == nil {
+			revisions = append(revisions, revision)
+		}
+	}
+
+	sort.Ints(revisions)
+	return revisions, nil
+}
+
+// ShowPinnedSnapshots lists the pinned revisions with the reasons they were pinned.  All snapshot ids are included
+// if 'snapshotID' is empty.
+func (manager *SnapshotManager) ShowPinnedSnapshots(snapshotID string) bool {
+
+	snapshotIDs := []string{snapshotID}
+	if snapshotID == "" {
+		var err error
+		snapshotIDs, err = manager.ListSnapshotIDs()
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list all snapshots: %v", err)
+			return false
+		}
+	}
+
+	chunk := manager.config.GetChunk()
+	defer manager.config.PutChunk(chunk)
+
+	numberOfPins := 0
+	for _, id := range snapshotIDs {
+		revisions, err := manager.ListPinnedRevisions(id)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to list the pinned revisions of snapshot %s: %v", id, err)
+			return false
+		}
+
+		for _, revision := range revisions {
+			var pin SnapshotPin
+			chunk.Reset(false)
+			err = manager.storage.DownloadFile(0, getSnapshotPinPath(id, revision), chunk)
+			if err == nil {
+				err = json.Unmarshal(chunk.GetBytes(), &pin)
+			}
+			if err != nil {
+				LOG_WARN("SNAPSHOT_PIN", "Failed to read the pin of snapshot %s at revision %d: %v", id, revision, err)
+			}
+
+			description := fmt.Sprintf("Snapshot %s revision %d pinned", id, revision)
+			if pin.Time != 0 {
+				description += fmt.Sprintf(" at %s on %s", time.Unix(pin.Time, 0).Format("2006-01-02 15:04"), pin.Host)
+			}
+			if pin.Reason != "" {
+				description += ": " + pin.Reason
+			}
+			LOG_INFO("SNAPSHOT_PIN", "%s", description)
+			numberOfPins++
+		}
+	}
+
+	if numberOfPins == 0 {
+		LOG_INFO("SNAPSHOT_PIN", "No pinned snapshots")
+	}
+	return true
+}
+
+// unflagPinnedSnapshots clears the deletion flags on pinned snapshots and returns how many were cleared.
+func (manager *SnapshotManager) unflagPinnedSnapshots(allSnapshots map[string][]*Snapshot) int {
+
+	unflagged := 0
+	for id, snapshots := range allSnapshots {
+		flagged := make(map[int]*Snapshot)
+		for _, snapshot := range snapshots {
+			if snapshot.Flag {
+				flagged[snapshot.Revision] = snapshot
+			}
+		}
+		if len(flagged) == 0 {
+			continue
+		}
+
+		revisions, err := manager.ListPinnedRevisions(id)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_PIN", "Failed to list the pinned revisions of snapshot %s: %v", id, err)
+			return unflagged
+		}
+		for _, revision := range revisions {
+			if snapshot, found := flagged[revision]; found {
+				LOG_INFO("SNAPSHOT_PIN", "Snapshot %s at revision %d is pinned and will not be deleted", id, revision)
+				snapshot.Flag = false
+				unflagged++
+			}
+		}
+	}
+	return unflagged
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSnapshotPin(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	createTestSnapshot(snapshotManager, "repository1", 1, now-3*day-3600, now-3*day-60, []string{chunkHash1}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-2*day-3600, now-2*day-60, []string{chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "repository1", 3, now-1*day-3600, now-1*day-60, []string{chunkHash3}, "tag")
+	checkTestSnapshots(snapshotManager, 3, 0)
+
+	if !snapshotManager.PinSnapshots("repository1", []int{1}, "baseline") {
+		t.Fatalf("Failed to pin revision 1")
+	}
+
+	revisions, err := snapshotManager.ListPinnedRevisions("repository1")
+	if err != nil || len(revisions) != 1 || revisions[0] != 1 {
+		t.Errorf("The pinned revisions are %v (%v)", revisions, err)
+	}
+	revisions, err = snapshotManager.ListSnapshotRevisions("repository1")
+	if err != nil || len(revisions) != 3 {
+		t.Errorf("The revisions are %v (%v)", revisions, err)
+	}
+
+	t.Logf("Removing snapshot repository1 revisions 1 and 2 -- revision 1 is pinned")
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1, 2}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 2)
+
+	t.Logf("Removing snapshot repository1 revision 1 after unpinning it")
+	if !snapshotManager.UnpinSnapshots("repository1", []int{1}) {
+		t.Fatalf("Failed to unpin revision 1")
+	}
+	snapshotManager.PruneSnapshots("repository1", "repository1", []int{1}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 1, 4)
+
+	revisions, err = snapshotManager.ListPinnedRevisions("repository1")
+	if err != nil || len(revisions) != 0 {
+		t.Errorf("The pinned revisions are %v (%v)", revisions, err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A snapshot can have multiple tags, which are stored as a comma-separated list in the 'tag' field so that older
+// versions still see them as a single tag.
+const tagSeparator = ","
+
+// GetTags returns the tags of the snapshot.
+func (snapshot *Snapshot) GetTags() (tags []string) {
+	for _, tag := range strings.Split(snapshot.Tag, tagSeparator) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// SetTags replaces the tags of the snapshot.
+func (snapshot *Snapshot) SetTags(tags []string) {
+	snapshot.Tag = strings.Join(tags, tagSeparator)
+}
+
+// MatchTags returns true if any tag of the snapshot matches any of the patterns, which may contain the wildcards '*'
+// and '?'.
+func (snapshot *Snapshot) MatchTags(patterns []string) bool {
+	for _, tag := range snapshot.GetTags() {
+		for _, pattern := range patterns {
+			if matchPattern(tag, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TagSnapshots adds the tags in 'added' to the given revisions and removes the tags matching the patterns in
+// 'removed'.  The snapshot files are uploaded again with only the tags changed, so the chunks are not affected.
+func (manager *SnapshotManager) TagSnapshots(snapshotID string, revisions []int, added []string,
+	removed []string) bool {
+
+	for _, tag := range added {
+		if strings.TrimSpace(tag) == "" || strings.Contains(tag, tagSeparator) || strings.ContainsAny(tag, "*?") {
+			LOG_ERROR("SNAPSHOT_TAG", "Invalid tag '%s'", tag)
+			return false
+		}
+	}
+
+	for _, revision := range revisions {
+		snapshot := manager.DownloadSnapshot(snapshotID, revision)
+		if snapshot == nil {
+			return false
+		}
+
+		var tags []string
+		for _, tag := range snapshot.GetTags() {
+			keep := true
+			for _, pattern := range removed {
+				if matchPattern(tag, pattern) {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				tags = append(tags, tag)
+			}
+		}
+		for _, tag := range added {
+			found := false
+			for _, existing := range tags {
+				if existing == tag {
+					found = true
+					break
+				}
+			}
+			if !found {
+				tags = append(tags, tag)
+			}
+		}
+
+		if strings.Join(tags, tagSeparator) == snapshot.Tag {
+			LOG_INFO("SNAPSHOT_TAG", "The tags of snapshot %s at revision %d are unchanged", snapshotID, revision)
+			continue
+		}
+		snapshot.SetTags(tags)
+
+		description, err := snapshot.MarshalJSON()
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_TAG", "Failed to create a json file for snapshot %s at revision %d: %v", snapshotID,
+				revision, err)
+			return false
+		}
+		path := fmt.Sprintf("snapshots/%s/%d", snapshotID, revision)
+		if !manager.UploadFileOnce(path, path, description) {
+			return false
+		}
+		LOG_INFO("SNAPSHOT_TAG", "Snapshot %s at revision %d is now tagged '%s'", snapshotID, revision, snapshot.Tag)
+	}
+	manager.finishUploadedFiles()
+	return true
+}
+
+// SetKeptTags makes PruneSnapshots keep all revisions with a tag matching any of the patterns, like pinned revisions.
+func (manager *SnapshotManager) SetKeptTags(patterns []string) {
+	manager.keptTags = patterns
+}
+
+// unflagKeptTagSnapshots removes the deletion marks from snapshots with a tag matching the kept tags and returns
+// the number of snapshots affected.
+func (manager *SnapshotManager) unflagKeptTagSnapshots(allSnapshots map[string][]*Snapshot) int {
+
+	if len(manager.keptTags) == 0 {
+		return 0
+	}
+
+	unflagged := 0
+	for _, snapshots := range allSnapshots {
+		for _, snapshot := range snapshots {
+			if snapshot.Flag && snapshot.MatchTags(manager.keptTags) {
+				LOG_INFO("SNAPSHOT_KEEP", "Snapshot %s at revision %d is tagged '%s' and will not be deleted",
+					snapshot.ID, snapshot.Revision, snapshot.Tag)
+				snapshot.Flag = false
+				unflagged++
+			}
+		}
+	}
+	return unflagged
+}
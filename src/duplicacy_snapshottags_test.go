@@ -0,0 +1,58 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneWithTagPatterns(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	for i := 0; i < 6; i++ {
+		startTime := now - int64(10-i)*day
+		createTestSnapshot(snapshotManager, "vm1@host1", i+1, startTime, startTime+60,
+			[]string{uploadRandomChunk(snapshotManager, chunkSize)}, "nightly")
+	}
+	checkTestSnapshots(snapshotManager, 6, 0)
+
+	if !snapshotManager.TagSnapshots("vm1@host1", []int{2, 4}, []string{"release-1.0"}, nil) {
+		t.Fatalf("Failed to tag the snapshots")
+	}
+	if !snapshotManager.TagSnapshots("vm1@host1", []int{3}, []string{"weekly"}, []string{"night*"}) {
+		t.Fatalf("Failed to replace the tag")
+	}
+
+	expected := map[int]string{1: "nightly", 2: "nightly,release-1.0", 3: "weekly", 4: "nightly,release-1.0"}
+	for revision, tags := range expected {
+		snapshot := snapshotManager.DownloadSnapshot("vm1@host1", revision)
+		if strings.Join(snapshot.GetTags(), ",") != tags {
+			t.Errorf("Revision %d is tagged '%s' instead of '%s'", revision, snapshot.Tag, tags)
+		}
+	}
+
+	t.Logf("Removing nightly snapshots except releases with --exclusive")
+	snapshotManager.SetKeptTags([]string{"release-*"})
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{"night?y"}, []string{}, false, true,
+		[]string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 3, 0)
+
+	revisions, _ := snapshotManager.ListSnapshotRevisions("vm1@host1")
+	if len(revisions) != 3 || revisions[0] != 2 || revisions[1] != 3 || revisions[2] != 4 {
+		t.Errorf("Revisions %v are left instead of 2, 3, 4", revisions)
+	}
+}
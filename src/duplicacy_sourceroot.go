@@ -0,0 +1,139 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SourceRoot is a directory outside the repository that is backed up along with it.  Its contents appear in the
+// snapshots under the directory 'Name' at the repository root, as if the repository root contained a symbolic link
+// named 'Name' pointing to 'Path'.
+type SourceRoot struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// The additional source roots of the repository, indexed by their names
+var sourceRoots map[string]string
+
+// SetSourceRoots sets the additional source roots of the repository.
+func SetSourceRoots(roots []SourceRoot) {
+	sourceRoots = nil
+	for _, root := range roots {
+		if sourceRoots == nil {
+			sourceRoots = make(map[string]string)
+		}
+		sourceRoots[root.Name] = root.Path
+	}
+}
+
+// ParseSourceRoot parses a source root specified as <name>=<path>.  The path is converted to an absolute path.
+func ParseSourceRoot(text string) (root SourceRoot, err error) {
+	separator := strings.Index(text, "=")
+	if separator < 0 {
+		return root, fmt.Errorf("'%s' is not in the format of <name>=<path>", text)
+	}
+	root.Name = text[:separator]
+	if root.Name == "" || root.Name == "." || root.Name == ".." || root.Name == DUPLICACY_DIRECTORY ||
+		strings.ContainsAny(root.Name, `/\`) {
+		return root, fmt.Errorf("'%s' is not a valid name for a source root", root.Name)
+	}
+
+	if text[separator+1:] == "" {
+		return root, fmt.Errorf("no path is specified for the source root '%s'", root.Name)
+	}
+	root.Path, err = filepath.Abs(text[separator+1:])
+	if err != nil {
+		return root, err
+	}
+	return root, nil
+}
+
+// isSourceRoot returns true if 'path' is the directory where a source root appears in the snapshot.
+func isSourceRoot(path string) bool {
+	_, found := sourceRoots[strings.TrimSuffix(path, "/")]
+	return found
+}
+
+// joinRootPath returns the full path of the file or directory 'path' in the snapshot, which is under the source root
+// named by its first component, if there is one, or under 'top' otherwise.
+func joinRootPath(top string, path string) string {
+	if len(sourceRoots) > 0 {
+		name, rest := path, ""
+		if i := strings.Index(path, "/"); i >= 0 {
+			name, rest = path[:i], path[i+1:]
+		}
+		if root, found := sourceRoots[name]; found {
+			if rest == "" {
+				return joinPath(root)
+			}
+			return joinPath(root, rest)
+		}
+	}
+	return joinPath(top, path)
+}
+
+// sourceRootInfo is the information of a source root directory, named after the source root.
+type sourceRootInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (info sourceRootInfo) Name() string {
+	return info.name
+}
+
+// listSourceRoots returns the information of the source roots to be listed with the files in the repository root.
+// The roots that can't be accessed are returned in 'skipped'.
+func listSourceRoots() (infos []os.FileInfo, skipped []string) {
+
+	var names []string
+	for name := range sourceRoots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stat, err := os.Stat(sourceRoots[name])
+		if err == nil && !stat.IsDir() {
+			err = fmt.Errorf("not a directory")
+		}
+		if err != nil {
+			LOG_WARN("LIST_ROOT", "Failed to access the source root %s at %s: %v", name, sourceRoots[name], err)
+			skipped = append(skipped, name+"/")
+			continue
+		}
+		infos = append(infos, sourceRootInfo{FileInfo: stat, name: name})
+	}
+	return infos, skipped
+}
+
+// getRelativeRootPath converts the full path of a file under a source root to its path in the snapshot.
+func getRelativeRootPath(fullPath string) (string, bool) {
+	for name, root := range sourceRoots {
+		if relativePath, ok := getRelativePath(root, fullPath, false); ok {
+			if relativePath == "" {
+				return name, true
+			}
+			return name + "/" + relativePath, true
+		}
+	}
+	return "", false
+}
+
+// getSourceRootSettings returns the source roots in a form to be included in the listing settings.
+func getSourceRootSettings() string {
+	var roots []string
+	for name, root := range sourceRoots {
+		roots = append(roots, name+"="+root)
+	}
+	sort.Strings(roots)
+	return strings.Join(roots, "\n")
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceRoots(t *testing.T) {
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "roots")
+	os.RemoveAll(testDir)
+
+	for _, file := range []string{"repository/a", "repository/data/hidden", "data/x/b", "other/c"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(testDir, file)), 0700)
+		ioutil.WriteFile(filepath.Join(testDir, file), []byte(file), 0600)
+	}
+
+	for _, text := range []string{"data", "=path", ".duplicacy=path", "a/b=path", "data="} {
+		if _, err := ParseSourceRoot(text); err == nil {
+			t.Errorf("'%s' should not be a valid source root", text)
+		}
+	}
+
+	var roots []SourceRoot
+	for _, text := range []string{"data=" + filepath.Join(testDir, "data"), "other=" + filepath.Join(testDir, "other"),
+		"missing=" + filepath.Join(testDir, "missing")} {
+		root, err := ParseSourceRoot(text)
+		if err != nil {
+			t.Fatalf("Failed to parse '%s': %v", text, err)
+		}
+		roots = append(roots, root)
+	}
+	SetSourceRoots(roots)
+	defer SetSourceRoots(nil)
+
+	top := filepath.Join(testDir, "repository")
+	if fullPath := joinRootPath(top, "data/x/b"); fullPath != joinPath(testDir, "data", "x", "b") {
+		t.Errorf("The full path of data/x/b is %s", fullPath)
+	}
+	if relativePath, ok := getRelativeRootPath(filepath.Join(testDir, "other", "c")); !ok || relativePath != "other/c" {
+		t.Errorf("The relative path of other/c is %s", relativePath)
+	}
+
+	snapshot, _, skippedFiles, err := CreateSnapshotFromDirectory("test", top, nil, filepath.Join(testDir, "nofilters"),
+		false, false, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to list the directory: %v", err)
+	}
+
+	var listed []string
+	for _, file := range snapshot.Files {
+		listed = append(listed, file.Path)
+	}
+	expected := []string{"a", "data/", "data/x/", "data/x/b", "other/", "other/c"}
+	if len(listed) != len(expected) {
+		t.Fatalf("Listed %v; expected %v", listed, expected)
+	}
+	for i := range listed {
+		if listed[i] != expected[i] {
+			t.Errorf("Listed %v; expected %v", listed, expected)
+			break
+		}
+	}
+	if len(skippedFiles) != 1 || skippedFiles[0] != "missing/" {
+		t.Errorf("Skipped %v; expected missing/", skippedFiles)
+	}
+
+	os.RemoveAll(testDir)
+}
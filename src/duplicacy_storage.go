@@ -5,6 +5,7 @@
 package duplicacy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -27,6 +28,11 @@ type Storage interface {
 	// files will be returned.  If 'dir' is 'chunks', the implementation can return the list either recusively or non-recusively.
 	ListFiles(threadIndex int, dir string) (files []string, sizes []int64, err error)
 
+	// ListFilesFunc calls 'handler' with each file and subdirectory that ListFiles would return for 'dir', in no
+	// particular order, so that storages with paged listings don't have to hold a large directory in memory as a
+	// whole.  The listing stops when 'handler' returns false.
+	ListFilesFunc(threadIndex int, dir string, handler func(file string, size int64) bool) (err error)
+
 	// DeleteFile deletes the file or directory at 'filePath'.
 	DeleteFile(threadIndex int, filePath string) (err error)
 
@@ -70,6 +76,13 @@ type Storage interface {
 
 	// Set the maximum transfer speeds.
 	SetRateLimits(downloadRateLimit int, uploadRateLimit int)
+
+	// SetContext makes the requests of the storage fail once 'ctx' is done.  If it is nil, the requests follow the
+	// context of the running operation.
+	SetContext(ctx context.Context)
+
+	// GetContext returns the context that the requests of the storage are made with.
+	GetContext() context.Context
 }
 
 // StorageBase is the base struct from which all storages are derived from
@@ -83,6 +96,8 @@ type StorageBase struct {
 
 	readLevels []int // At which nesting level to find the chunk with the given id
 	writeLevel int   // Store the uploaded chunk to this level
+
+	ctx context.Context // The context of the requests if not nil
 }
 
 // SetRateLimits sets the maximum download and upload rates
@@ -93,6 +108,19 @@ func (storage *StorageBase) SetRateLimits(downloadRateLimit int, uploadRateLimit
 	// >>> DYNRATE
 }
 
+// SetContext sets the context of the requests, or makes them follow the running operation if 'ctx' is nil
+func (storage *StorageBase) SetContext(ctx context.Context) {
+	storage.ctx = ctx
+}
+
+// GetContext returns the context of the requests
+func (storage *StorageBase) GetContext() context.Context {
+	if storage.ctx != nil {
+		return storage.ctx
+	}
+	return GetOperationContext()
+}
+
 // >>> DYNRATE
 func (storage *StorageBase) UploadRateLimit() int {
 	return int(atomic.LoadInt32(&storage._UploadRateLimit))
@@ -100,6 +128,26 @@ func (storage *StorageBase) UploadRateLimit() int {
 
 // <<< DYNRATE
 
+// ListFilesFunc is the implementation for storages that can only list a directory at once; it calls the handler with
+// each entry returned by ListFiles.
+func (storage *StorageBase) ListFilesFunc(threadIndex int, dir string, handler func(file string, size int64) bool) (err error) {
+	files, sizes, err := storage.DerivedStorage.ListFiles(threadIndex, dir)
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		// Subdirectories of 'snapshots' may be returned without sizes
+		size := int64(0)
+		if i < len(sizes) {
+			size = sizes[i]
+		}
+		if !handler(file, size) {
+			break
+		}
+	}
+	return nil
+}
+
 // SetDefaultNestingLevels sets the default read and write levels.  This is usually called by
 // derived storages to set the levels with old values so that storages initialized by earlier versions
 // will continue to work.
@@ -152,11 +200,7 @@ func (storage *StorageBase) SetNestingLevels(config *Config) {
 func (storage *StorageBase) FindChunk(threadIndex int, chunkID string, isFossil bool) (filePath string, exist bool, size int64, err error) {
 	chunkPaths := make([]string, 0)
 	for _, level := range storage.readLevels {
-		chunkPath := "chunks/"
-		for i := 0; i < level; i++ {
-			chunkPath += chunkID[2*i:2*i+2] + "/"
-		}
-		chunkPath += chunkID[2*level:]
+		chunkPath := getNestedChunkPath(chunkID, level)
 		if isFossil {
 			chunkPath += ".fsl"
 		}
@@ -174,6 +218,21 @@ func (storage *StorageBase) FindChunk(threadIndex int, chunkID string, isFossil
 	return "", false, 0, fmt.Errorf("Invalid chunk nesting setup")
 }
 
+// getNestedChunkPath returns the path of the chunk with the specified id at the nesting level.
+func getNestedChunkPath(chunkID string, level int) string {
+	chunkPath := "chunks/"
+	for i := 0; i < level; i++ {
+		chunkPath += chunkID[2*i:2*i+2] + "/"
+	}
+	return chunkPath + chunkID[2*level:]
+}
+
+// getChunkUploadPath returns the path a new chunk with the specified id is uploaded to, without checking if the chunk
+// already exists at any of the read levels.
+func (storage *StorageBase) getChunkUploadPath(chunkID string) string {
+	return getNestedChunkPath(chunkID, storage.writeLevel)
+}
+
 func checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
 
 	if preferencePath == "" {
@@ -227,6 +286,29 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 
 	storageURL := preference.StorageURL
 
+	// Storages make a few requests by their default retry policy while being created
+	defer func() {
+		if storage == nil || preference.Retry == nil {
+			return
+		}
+		if retryStorage, ok := storage.(RetryPolicyStorage); ok {
+			retryStorage.SetRetryPolicy(preference.Retry)
+			LOG_DEBUG("STORAGE_RETRY", "Retry policy for the storage: %s", preference.Retry)
+		} else {
+			LOG_WARN("STORAGE_RETRY", "The retry policy isn't supported by the storage %s", storageURL)
+		}
+	}()
+
+	// The clients of the storage pick up its network options while being created
+	setStorageNetwork(preference.Network)
+	defer func() {
+		if !clearStorageNetwork() && storage != nil && preference.Network != nil {
+			LOG_WARN("STORAGE_NETWORK", "The network options aren't supported by the storage %s", storageURL)
+		} else if storage != nil && preference.Network != nil {
+			LOG_DEBUG("STORAGE_NETWORK", "Network options for the storage: %s", preference.Network)
+		}
+	}()
+
 	isFileStorage := false
 	isCacheNeeded := false
 
@@ -273,6 +355,15 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 		return fileStorage
 	}
 
+	if strings.HasPrefix(storageURL, "mock://") {
+		mockStorage, err := CreateMockStorage(storageURL[7:], threads)
+		if err != nil {
+			LOG_ERROR("STORAGE_CREATE", "Failed to load the mock storage at %s: %v", storageURL, err)
+			return nil
+		}
+		return mockStorage
+	}
+
 	urlRegex := regexp.MustCompile(`^([\w-]+)://([\w\-@\.]+@)?([^/]+)(/(.+))?`)
 
 	matched := urlRegex.FindStringSubmatch(storageURL)
@@ -439,11 +530,11 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 			}
 
 			authMethods = []ssh.AuthMethod{}
-			if keyringGet(passwordKey) != "" {
+			if keyringGet(getKeyring(preference), passwordKey) != "" {
 				authMethods = append(authMethods, ssh.PasswordCallback(passwordCallback))
 				authMethods = append(authMethods, ssh.KeyboardInteractive(keyboardInteractive))
 			}
-			if keyringGet(keyFileKey) != "" || os.Getenv("SSH_AUTH_SOCK") != "" {
+			if keyringGet(getKeyring(preference), keyFileKey) != "" || os.Getenv("SSH_AUTH_SOCK") != "" {
 				authMethods = append(authMethods, ssh.PublicKeysCallback(publicKeysCallback))
 			}
 		}
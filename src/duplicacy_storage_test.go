@@ -15,6 +15,7 @@ import (
 	"path"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -52,6 +53,18 @@ func loadStorage(localStoragePath string, threads int) (Storage, error) {
 		return storage, err
 	}
 
+	// A mock storage, such as mock://test?errors=0.1, gets a fresh store for each local storage path
+	if strings.HasPrefix(testStorageName, "mock://") {
+		location := testStorageName[len("mock://"):]
+		options := ""
+		if index := strings.Index(location, "?"); index >= 0 {
+			location, options = location[:index], location[index:]
+		}
+		name := location + localStoragePath
+		removeMockStore(name)
+		return CreateMockStorage(name+options, threads)
+	}
+
 	description, err := ioutil.ReadFile("test_storage.conf")
 	if err != nil {
 		return nil, err
@@ -634,3 +647,60 @@ func TestCleanStorage(t *testing.T) {
 	}
 
 }
+
+func TestListFilesFunc(t *testing.T) {
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "storage_listfiles")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+
+	storage, err := loadStorage(testDir, 1)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	storage.CreateDirectory(0, "chunks")
+	storage.CreateDirectory(0, "chunks/ab")
+	for i := 0; i < 10; i++ {
+		filePath := fmt.Sprintf("chunks/ab/%02d", i)
+		if err = storage.UploadFile(0, filePath, make([]byte, i)); err != nil {
+			t.Fatalf("Failed to upload %s: %v", filePath, err)
+		}
+	}
+
+	files, sizes, err := storage.ListFiles(0, "chunks/ab/")
+	if err != nil {
+		t.Fatalf("Failed to list the files: %v", err)
+	}
+	listed := make(map[string]int64)
+	for i, file := range files {
+		listed[file] = sizes[i]
+	}
+
+	streamed := make(map[string]int64)
+	err = storage.ListFilesFunc(0, "chunks/ab/", func(file string, size int64) bool {
+		streamed[file] = size
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to list the files with a handler: %v", err)
+	}
+	if len(streamed) != 10 || len(streamed) != len(listed) {
+		t.Errorf("Listed %d files and %d files with a handler", len(listed), len(streamed))
+	}
+	for file, size := range listed {
+		if streamed[file] != size {
+			t.Errorf("File %s has a size of %d but %d with a handler", file, size, streamed[file])
+		}
+	}
+
+	count := 0
+	storage.ListFilesFunc(0, "chunks/ab/", func(file string, size int64) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Errorf("The listing didn't stop when the handler returned false: %d files", count)
+	}
+}
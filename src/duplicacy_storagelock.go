@@ -0,0 +1,222 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The advisory lock held by a prune.  It lives in the storage rather than the local cache so that prunes and backups
+// from all clients can see it.
+const pruneLockFile = "locks/prune"
+
+var (
+	// How often the holder of a lock updates it
+	storageLockHeartbeat = time.Minute
+
+	// A lock not updated for this long is considered abandoned, for instance by a client that crashed
+	storageLockExpiry = 10 * time.Minute
+
+	// How long to wait before reading the lock back, to detect another client that created it at the same time
+	storageLockConfirmDelay = 5 * time.Second
+)
+
+// StorageLock is an advisory lock object saved on the storage.  Storages don't support atomic creation of files, so
+// the lock is only a best effort to keep clients from running conflicting operations at the same time, such as two
+// prunes whose fossil collections could delete chunks referenced by the other's snapshots.
+type StorageLock struct {
+	Host      string `json:"host"`
+	Owner     string `json:"owner"`      // a random token identifying the holder
+	Operation string `json:"operation"`  // the operation holding the lock
+	StartTime int64  `json:"start_time"` // when the lock was acquired
+	Heartbeat int64  `json:"heartbeat"`  // when the lock was last updated
+	Expiry    int64  `json:"expiry"`     // seconds after the last heartbeat at which the lock expires
+
+	manager     *SnapshotManager
+	path        string
+	stopChannel chan bool
+	stopped     sync.WaitGroup
+}
+
+// isActive returns true if the lock has been updated recently enough that its holder is presumed to be running.
+func (lock *StorageLock) isActive(now time.Time) bool {
+	return now.Unix() < lock.Heartbeat+lock.Expiry
+}
+
+func (lock *StorageLock) String() string {
+	return fmt.Sprintf("%s on %s started at %s", lock.Operation, lock.Host,
+		time.Unix(lock.StartTime, 0).Format("2006-01-02 15:04:05"))
+}
+
+// readStorageLock returns the lock saved at 'lockPath' in the storage, or nil if there isn't one.
+func (manager *SnapshotManager) readStorageLock(lockPath string) (*StorageLock, error) {
+	exist, _, _, err := manager.storage.GetFileInfo(0, lockPath)
+	if err != nil {
+		return nil, err
+	} else if !exist {
+		return nil, nil
+	}
+
+	chunk := manager.config.GetChunk()
+	defer manager.config.PutChunk(chunk)
+	chunk.Reset(false)
+	err = manager.storage.DownloadFile(0, lockPath, chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &StorageLock{}
+	err = json.Unmarshal(chunk.GetBytes(), lock)
+	if err != nil {
+		return nil, fmt.Errorf("the lock file %s is corrupted: %v", lockPath, err)
+	}
+	return lock, nil
+}
+
+// save writes the lock with an updated heartbeat to the storage.
+func (lock *StorageLock) save() error {
+	lock.Heartbeat = time.Now().Unix()
+	description, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	return lock.manager.storage.UploadFile(0, lock.path, description)
+}
+
+// acquireStorageLock saves a lock for 'operation' on the storage and starts updating it periodically.  It fails if
+// another client holds an active lock, unless 'ignoreExisting' is true.
+func (manager *SnapshotManager) acquireStorageLock(lockPath string, operation string, ignoreExisting bool) *StorageLock {
+
+	existing, err := manager.readStorageLock(lockPath)
+	if err != nil {
+		LOG_ERROR("STORAGE_LOCK", "Failed to read the lock %s: %v", lockPath, err)
+		return nil
+	}
+	if existing != nil {
+		if existing.isActive(time.Now()) && !ignoreExisting {
+			LOG_ERROR("STORAGE_LOCK", "The storage is locked by %s; the lock expires at %s unless it is renewed",
+				existing, time.Unix(existing.Heartbeat+existing.Expiry, 0).Format("2006-01-02 15:04:05"))
+			return nil
+		}
+		if existing.isActive(time.Now()) {
+			LOG_WARN("STORAGE_LOCK", "Ignoring the lock held by %s", existing)
+		} else {
+			LOG_INFO("STORAGE_LOCK", "Taking over the expired lock held by %s", existing)
+		}
+	}
+
+	owner := make([]byte, 16)
+	_, err = rand.Read(owner)
+	if err != nil {
+		LOG_ERROR("STORAGE_LOCK", "Failed to generate the lock owner: %v", err)
+		return nil
+	}
+	host, _ := os.Hostname()
+
+	lock := &StorageLock{
+		Host:        host,
+		Owner:       hex.EncodeToString(owner),
+		Operation:   operation,
+		StartTime:   time.Now().Unix(),
+		Expiry:      int64(storageLockExpiry / time.Second),
+		manager:     manager,
+		path:        lockPath,
+		stopChannel: make(chan bool),
+	}
+
+	manager.storage.CreateDirectory(0, "locks")
+	err = lock.save()
+	if err != nil {
+		LOG_ERROR("STORAGE_LOCK", "Failed to save the lock %s: %v", lockPath, err)
+		return nil
+	}
+
+	// If another client saved its lock at about the same time, only one of them can be read back
+	time.Sleep(storageLockConfirmDelay)
+	current, err := manager.readStorageLock(lockPath)
+	if err != nil {
+		LOG_ERROR("STORAGE_LOCK", "Failed to read the lock %s: %v", lockPath, err)
+		return nil
+	} else if current == nil || current.Owner != lock.Owner {
+		if current != nil && !ignoreExisting {
+			LOG_ERROR("STORAGE_LOCK", "The storage has just been locked by %s", current)
+			return nil
+		}
+		LOG_WARN("STORAGE_LOCK", "The lock %s was replaced by another client", lockPath)
+	}
+
+	LOG_DEBUG("STORAGE_LOCK", "Acquired the lock %s", lockPath)
+	lock.stopped.Add(1)
+	go lock.keepAlive()
+	return lock
+}
+
+// keepAlive updates the heartbeat of the lock until the lock is released.
+func (lock *StorageLock) keepAlive() {
+	defer lock.stopped.Done()
+	ticker := time.NewTicker(storageLockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stopChannel:
+			return
+		case <-ticker.C:
+			err := lock.save()
+			if err != nil {
+				LOG_WARN("STORAGE_LOCK", "Failed to update the lock %s: %v", lock.path, err)
+			} else {
+				LOG_TRACE("STORAGE_LOCK", "Updated the lock %s", lock.path)
+			}
+		}
+	}
+}
+
+// release stops updating the lock and removes it from the storage, unless another client has taken it over.
+func (lock *StorageLock) release() {
+	if lock == nil {
+		return
+	}
+
+	close(lock.stopChannel)
+	lock.stopped.Wait()
+
+	current, err := lock.manager.readStorageLock(lock.path)
+	if err != nil {
+		LOG_WARN("STORAGE_LOCK", "Failed to read the lock %s: %v", lock.path, err)
+		return
+	} else if current != nil && current.Owner != lock.Owner {
+		LOG_WARN("STORAGE_LOCK", "The lock %s is now held by %s", lock.path, current)
+		return
+	}
+
+	err = lock.manager.storage.DeleteFile(0, lock.path)
+	if err != nil {
+		LOG_WARN("STORAGE_LOCK", "Failed to remove the lock %s: %v", lock.path, err)
+		return
+	}
+	LOG_DEBUG("STORAGE_LOCK", "Released the lock %s", lock.path)
+}
+
+// SetIgnorePruneLock makes prune proceed even if another client holds the prune lock.
+func (manager *SnapshotManager) SetIgnorePruneLock(ignore bool) {
+	manager.ignorePruneLock = ignore
+}
+
+// checkPruneLock warns if a prune from another client is in progress.  Backups can still run concurrently, but
+// fossils collected by that prune won't be deleted until a later prune sees the new snapshot.
+func (manager *SnapshotManager) checkPruneLock() {
+	lock, err := manager.readStorageLock(pruneLockFile)
+	if err != nil {
+		LOG_DEBUG("STORAGE_LOCK", "Failed to read the prune lock: %v", err)
+	} else if lock != nil && lock.isActive(time.Now()) {
+		LOG_WARN("STORAGE_LOCK", "A prune is in progress: %s", lock)
+	}
+}
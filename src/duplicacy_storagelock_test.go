@@ -0,0 +1,84 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Prune tests would otherwise wait for the lock to be confirmed every time
+	storageLockConfirmDelay = 10 * time.Millisecond
+}
+
+func TestStorageLock(t *testing.T) {
+
+	setTestingT(t)
+	SetLoggingLevel(INFO)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	lock := snapshotManager.acquireStorageLock(pruneLockFile, "prune", false)
+	if lock == nil {
+		t.Fatalf("Failed to acquire the lock")
+	}
+
+	existing, err := snapshotManager.readStorageLock(pruneLockFile)
+	if err != nil || existing == nil {
+		t.Fatalf("Failed to read the lock: %v", err)
+	}
+	if existing.Owner != lock.Owner || !existing.isActive(time.Now()) {
+		t.Errorf("The lock read back is %+v", existing)
+	}
+	if existing.isActive(time.Now().Add(storageLockExpiry + time.Second)) {
+		t.Errorf("The lock is still active after it expires")
+	}
+
+	// A second client can't acquire the lock while it is active; the error is expected so it must not fail the test
+	func() {
+		setTestingT(nil)
+		defer func() {
+			setTestingT(t)
+			if r := recover(); r == nil {
+				t.Errorf("The lock was acquired twice")
+			} else if _, ok := r.(Exception); !ok {
+				panic(r)
+			}
+		}()
+		snapshotManager.acquireStorageLock(pruneLockFile, "prune", false)
+	}()
+
+	second := snapshotManager.acquireStorageLock(pruneLockFile, "prune", true)
+	if second == nil {
+		t.Fatalf("Failed to acquire the lock when ignoring the existing one")
+	}
+
+	// The first client doesn't remove the lock now held by the second one
+	lock.release()
+	if existing, _ = snapshotManager.readStorageLock(pruneLockFile); existing == nil || existing.Owner != second.Owner {
+		t.Errorf("The lock taken over was removed")
+	}
+
+	second.release()
+	if existing, _ = snapshotManager.readStorageLock(pruneLockFile); existing != nil {
+		t.Errorf("The lock was not removed")
+	}
+
+	// An expired lock is taken over
+	err = snapshotManager.storage.UploadFile(0, pruneLockFile, []byte(`{"host":"other","owner":"abc",`+
+		`"operation":"prune","start_time":1,"heartbeat":1,"expiry":60}`))
+	if err != nil {
+		t.Fatalf("Failed to save the lock: %v", err)
+	}
+	lock = snapshotManager.acquireStorageLock(pruneLockFile, "prune", false)
+	if lock == nil {
+		t.Fatalf("Failed to take over the expired lock")
+	}
+	lock.release()
+}
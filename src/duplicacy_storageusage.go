@@ -0,0 +1,182 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SnapshotUsage is the space taken up by all revisions of a snapshot id.  Exclusive chunks are referenced by no other
+// snapshot id, so they are what deleting the snapshot id would free; shared chunks are also referenced by others.
+type SnapshotUsage struct {
+	ID              string `json:"id"`
+	Revisions       int    `json:"revisions"`
+	Chunks          int    `json:"chunks"`
+	Bytes           int64  `json:"bytes"`
+	ExclusiveChunks int    `json:"exclusive_chunks"`
+	ExclusiveBytes  int64  `json:"exclusive_bytes"`
+	SharedChunks    int    `json:"shared_chunks"`
+	SharedBytes     int64  `json:"shared_bytes"`
+}
+
+// StorageUsage is the breakdown of the chunks in a storage by the snapshot ids referencing them.
+type StorageUsage struct {
+	Snapshots          []*SnapshotUsage `json:"snapshots"`
+	TotalChunks        int              `json:"total_chunks"`
+	TotalBytes         int64            `json:"total_bytes"`
+	UnreferencedChunks int              `json:"unreferenced_chunks"`
+	UnreferencedBytes  int64            `json:"unreferenced_bytes"`
+	MissingChunks      int              `json:"missing_chunks"`
+}
+
+// The owner of a chunk in getStorageUsage: the index of the first snapshot id referencing it, and the number of
+// snapshot ids referencing it.
+type chunkOwner struct {
+	first  int
+	owners int
+}
+
+// getStorageUsage lists all chunks and all revisions of every snapshot id to find out which chunks each snapshot id
+// references exclusively.  Chunks referenced by several revisions of the same snapshot id are counted once.
+func (manager *SnapshotManager) getStorageUsage() *StorageUsage {
+
+	usage := &StorageUsage{}
+
+	LOG_INFO("USAGE_LIST", "Listing all chunks")
+	chunkSizes := make(map[string]int64)
+	allFiles, allSizes := manager.ListAllFiles(manager.storage, chunkDir)
+	for i, file := range allFiles {
+		if len(file) == 0 || file[len(file)-1] == '/' || strings.HasSuffix(file, ".fsl") ||
+			strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+		chunkSizes[strings.Replace(file, "/", "", -1)] = allSizes[i]
+		usage.TotalChunks++
+		usage.TotalBytes += allSizes[i]
+	}
+
+	snapshotIDs, err := manager.ListSnapshotIDs()
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_LIST", "Failed to list all snapshots: %v", err)
+		return nil
+	}
+	sort.Strings(snapshotIDs)
+
+	owners := make(map[string]*chunkOwner)
+	for index, snapshotID := range snapshotIDs {
+		revisions, err := manager.ListSnapshotRevisions(snapshotID)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list all revisions for snapshot %s: %v", snapshotID, err)
+			return nil
+		}
+
+		snapshotUsage := &SnapshotUsage{ID: snapshotID, Revisions: len(revisions)}
+		usage.Snapshots = append(usage.Snapshots, snapshotUsage)
+
+		LOG_INFO("USAGE_LIST", "Reading %d revisions of snapshot %s", len(revisions), snapshotID)
+		chunks := make(map[string]bool)
+		for _, revision := range revisions {
+			snapshot := manager.DownloadSnapshot(snapshotID, revision)
+			for _, chunkID := range manager.GetSnapshotChunks(snapshot, false) {
+				chunks[chunkID] = true
+			}
+		}
+
+		for chunkID := range chunks {
+			size, found := chunkSizes[chunkID]
+			if !found {
+				LOG_DEBUG("USAGE_MISSING", "Chunk %s referenced by snapshot %s does not exist", chunkID, snapshotID)
+				usage.MissingChunks++
+				continue
+			}
+			snapshotUsage.Chunks++
+			snapshotUsage.Bytes += size
+			if owner, found := owners[chunkID]; found {
+				owner.owners++
+			} else {
+				owners[chunkID] = &chunkOwner{first: index, owners: 1}
+			}
+		}
+	}
+
+	for chunkID, size := range chunkSizes {
+		owner, found := owners[chunkID]
+		if !found {
+			usage.UnreferencedChunks++
+			usage.UnreferencedBytes += size
+		} else if owner.owners == 1 {
+			usage.Snapshots[owner.first].ExclusiveChunks++
+			usage.Snapshots[owner.first].ExclusiveBytes += size
+		}
+	}
+
+	for _, snapshotUsage := range usage.Snapshots {
+		snapshotUsage.SharedChunks = snapshotUsage.Chunks - snapshotUsage.ExclusiveChunks
+		snapshotUsage.SharedBytes = snapshotUsage.Bytes - snapshotUsage.ExclusiveBytes
+	}
+
+	return usage
+}
+
+// ShowStorageUsage reports for each snapshot id in the storage how many chunks and bytes it owns exclusively and how
+// many it shares with other snapshot ids.  Snapshots are read through a temporary cache as the storage may not
+// belong to the current repository.
+func ShowStorageUsage(config *Config, storage Storage) *StorageUsage {
+
+	cacheDir, err := ioutil.TempDir("", "duplicacy_usage")
+	if err != nil {
+		LOG_ERROR("USAGE_CACHE", "Failed to create the temporary snapshot cache: %v", err)
+		return nil
+	}
+	defer os.RemoveAll(cacheDir)
+
+	snapshotCache, err := CreateFileStorage(cacheDir, false, 1)
+	if err != nil {
+		LOG_ERROR("USAGE_CACHE", "Failed to create the temporary snapshot cache: %v", err)
+		return nil
+	}
+	for _, subdir := range []string{"chunks", "snapshots"} {
+		os.Mkdir(path.Join(cacheDir, subdir), 0700)
+	}
+	snapshotCache.SetDefaultNestingLevels([]int{1}, 1)
+
+	manager := CreateSnapshotManager(config, storage)
+	manager.snapshotCache = snapshotCache
+
+	usage := manager.getStorageUsage()
+	if usage == nil {
+		return nil
+	}
+
+	width := len("Snapshot")
+	for _, snapshotUsage := range usage.Snapshots {
+		if len(snapshotUsage.ID) > width {
+			width = len(snapshotUsage.ID)
+		}
+	}
+
+	LOG_INFO("STORAGE_USAGE", "%-*s %9s %10s %10s %10s %10s %10s %10s", width, "Snapshot", "Revisions", "Chunks",
+		"Bytes", "Exclusive", "Bytes", "Shared", "Bytes")
+	for _, snapshotUsage := range usage.Snapshots {
+		LOG_INFO("STORAGE_USAGE", "%-*s %9d %10d %10s %10d %10s %10d %10s", width, snapshotUsage.ID,
+			snapshotUsage.Revisions, snapshotUsage.Chunks, PrettySize(snapshotUsage.Bytes),
+			snapshotUsage.ExclusiveChunks, PrettySize(snapshotUsage.ExclusiveBytes), snapshotUsage.SharedChunks,
+			PrettySize(snapshotUsage.SharedBytes))
+	}
+
+	LOG_INFO("STORAGE_USAGE", "Total: %d chunks, %s", usage.TotalChunks, PrettySize(usage.TotalBytes))
+	LOG_INFO("STORAGE_USAGE", "Unreferenced: %d chunks, %s", usage.UnreferencedChunks,
+		PrettySize(usage.UnreferencedBytes))
+	if usage.MissingChunks > 0 {
+		LOG_WARN("STORAGE_USAGE", "%d chunks referenced by the snapshots are missing; run the check command to find them",
+			usage.MissingChunks)
+	}
+
+	return usage
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestStorageUsage(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash4 := uploadRandomChunk(snapshotManager, chunkSize)
+	uploadRandomChunk(snapshotManager, chunkSize)
+
+	// The third chunk is shared by both snapshot ids, and the fifth is referenced by neither
+	now := time.Now().Unix()
+	createTestSnapshot(snapshotManager, "repository1", 1, now-7200, now-7100, []string{chunkHash1, chunkHash2}, "")
+	createTestSnapshot(snapshotManager, "repository1", 2, now-3600, now-3500, []string{chunkHash2, chunkHash3}, "")
+	createTestSnapshot(snapshotManager, "repository2", 1, now-3600, now-3500, []string{chunkHash3, chunkHash4}, "")
+
+	usage := snapshotManager.getStorageUsage()
+	if usage == nil {
+		t.Fatalf("Failed to compute the storage usage")
+	}
+
+	// Each revision also references the chunk holding its chunk sequence
+	if usage.TotalChunks != 8 || usage.UnreferencedChunks != 1 || usage.MissingChunks != 0 {
+		t.Errorf("The storage has %d chunks with %d unreferenced and %d missing", usage.TotalChunks,
+			usage.UnreferencedChunks, usage.MissingChunks)
+	}
+	if len(usage.Snapshots) != 2 {
+		t.Fatalf("The usage of %d snapshot ids was computed", len(usage.Snapshots))
+	}
+
+	repository1, repository2 := usage.Snapshots[0], usage.Snapshots[1]
+	if repository1.ID != "repository1" || repository1.Revisions != 2 || repository1.Chunks != 5 ||
+		repository1.ExclusiveChunks != 4 || repository1.SharedChunks != 1 {
+		t.Errorf("The usage of repository1 is %+v", repository1)
+	}
+	if repository2.ID != "repository2" || repository2.Revisions != 1 || repository2.Chunks != 3 ||
+		repository2.ExclusiveChunks != 2 || repository2.SharedChunks != 1 {
+		t.Errorf("The usage of repository2 is %+v", repository2)
+	}
+	if repository1.SharedBytes == 0 || repository1.SharedBytes != repository2.SharedBytes {
+		t.Errorf("The shared chunk has %d bytes for repository1 and %d for repository2", repository1.SharedBytes,
+			repository2.SharedBytes)
+	}
+	if repository1.ExclusiveBytes+repository2.ExclusiveBytes+repository1.SharedBytes+usage.UnreferencedBytes !=
+		usage.TotalBytes {
+		t.Errorf("The bytes of the snapshot ids don't add up to the %d bytes in the storage", usage.TotalBytes)
+	}
+}
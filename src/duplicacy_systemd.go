@@ -0,0 +1,170 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The path of the socket for sending structured logs to journald
+const journalSocket = "/run/systemd/journal/socket"
+
+var systemdEnabled = false
+var systemdCommand string           // the command being run, included in the journald fields
+var notifySocket string             // the socket for sd_notify messages, empty if the service manager doesn't expect them
+var journalEnabled = false          // whether logs are sent to journald instead of the standard output
+var journalConnection *net.UnixConn // opened when the first log is sent to journald
+var lastSystemdStatus time.Time
+
+// The minimum interval between two STATUS notifications, as progress messages may be logged for every chunk
+var systemdStatusInterval = time.Second
+
+// IsRunningUnderSystemd returns true if the program is started by systemd as (part of) a service.
+func IsRunningUnderSystemd() bool {
+	return os.Getenv("INVOCATION_ID") != "" || os.Getenv("NOTIFY_SOCKET") != "" || os.Getenv("JOURNAL_STREAM") != ""
+}
+
+// EnableSystemdIntegration tells the service manager that the program is ready, starts sending watchdog
+// notifications if they are expected, and sends logs to journald with structured fields if the standard output is
+// connected to the journal.  It does nothing if the program is not running under systemd.
+func EnableSystemdIntegration(command string) {
+	if systemdEnabled || !IsRunningUnderSystemd() {
+		return
+	}
+	systemdEnabled = true
+	systemdCommand = command
+
+	notifySocket = os.Getenv("NOTIFY_SOCKET")
+	journalEnabled = isJournalStream(os.Getenv("JOURNAL_STREAM"))
+
+	SystemdNotify("READY=1")
+
+	if interval := getWatchdogInterval(); interval > 0 {
+		go func() {
+			for {
+				time.Sleep(interval / 2)
+				SystemdNotify("WATCHDOG=1")
+			}
+		}()
+	}
+}
+
+// getWatchdogInterval returns the watchdog interval set by the service manager for this process, or 0 if the watchdog
+// is not enabled.
+func getWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// SystemdNotify sends a notification such as 'READY=1' or 'STATUS=...' to the service manager, as sd_notify(3)
+// does.  It returns false if the notification can't be sent.
+func SystemdNotify(state string) bool {
+	if notifySocket == "" {
+		return false
+	}
+
+	name := notifySocket
+	if strings.HasPrefix(name, "@") {
+		// An abstract socket
+		name = "\x00" + name[1:]
+	}
+	connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		LOG_DEBUG("SYSTEMD_NOTIFY", "Failed to connect to %s: %v", notifySocket, err)
+		return false
+	}
+	defer connection.Close()
+
+	_, err = connection.Write([]byte(state))
+	if err != nil {
+		LOG_DEBUG("SYSTEMD_NOTIFY", "Failed to send the notification: %v", err)
+		return false
+	}
+	return true
+}
+
+// updateSystemdStatus reports a progress message as the status of the service, shown by 'systemctl status'.  The
+// caller must hold logMutex.
+func updateSystemdStatus(message string) {
+	if notifySocket == "" || time.Since(lastSystemdStatus) < systemdStatusInterval {
+		return
+	}
+	lastSystemdStatus = time.Now()
+	go SystemdNotify("STATUS=" + message)
+}
+
+// getJournalPriority maps a logging level to a syslog priority.
+func getJournalPriority(level int) int {
+	switch level {
+	case DEBUG, TRACE:
+		return 7
+	case INFO:
+		return 6
+	case WARN:
+		return 4
+	case ERROR:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// encodeJournalField appends a field in the native journal protocol.  Values containing newlines are encoded in
+// binary with their length.
+func encodeJournalField(buffer *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		buffer.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buffer.WriteString(name + "\n")
+	binary.Write(buffer, binary.LittleEndian, uint64(len(value)))
+	buffer.WriteString(value + "\n")
+}
+
+// getJournalRecord returns the datagram sending a log message to journald, with the log id and the subsystem as
+// additional fields.
+func getJournalRecord(level int, logID string, subsystem string, message string) []byte {
+	var buffer bytes.Buffer
+	encodeJournalField(&buffer, "MESSAGE", message)
+	encodeJournalField(&buffer, "PRIORITY", strconv.Itoa(getJournalPriority(level)))
+	encodeJournalField(&buffer, "SYSLOG_IDENTIFIER", "duplicacy")
+	encodeJournalField(&buffer, "DUPLICACY_LEVEL", getLevelName(level))
+	encodeJournalField(&buffer, "DUPLICACY_LOG_ID", logID)
+	if subsystem != "" {
+		encodeJournalField(&buffer, "DUPLICACY_SUBSYSTEM", subsystem)
+	}
+	if systemdCommand != "" {
+		encodeJournalField(&buffer, "DUPLICACY_COMMAND", systemdCommand)
+	}
+	return buffer.Bytes()
+}
+
+// writeJournalRecord sends a log message to journald, returning false if it can't be sent so the caller can write it
+// to the standard output instead.  Logs are no longer sent to journald once the socket can't be opened.  The caller
+// must hold logMutex.
+func writeJournalRecord(level int, logID string, subsystem string, message string) bool {
+	if journalConnection == nil {
+		connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+		if err != nil {
+			journalEnabled = false
+			return false
+		}
+		journalConnection = connection
+	}
+	_, err := journalConnection.Write(getJournalRecord(level, logID, subsystem, message))
+	return err == nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	dbus "github.com/gilbertchen/go.dbus"
+)
+
+// isJournalStream returns true if the standard output is the stream connected to the journal, whose device and inode
+// numbers systemd passes in JOURNAL_STREAM as 'device:inode'.
+func isJournalStream(journalStream string) bool {
+	if journalStream == "" {
+		return false
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stdout.Fd()), &stat); err != nil {
+		return false
+	}
+	return journalStream == fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
+
+// InhibitSleep takes a logind inhibitor lock that prevents the machine from going idle, sleeping, or shutting down
+// while a backup is running.  The returned function releases the lock.  The lock is only taken when running under
+// systemd; if logind is not available, the function returned does nothing.
+func InhibitSleep(why string) func() {
+	if !IsRunningUnderSystemd() {
+		return func() {}
+	}
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		LOG_DEBUG("SYSTEMD_INHIBIT", "Failed to connect to the system bus: %v", err)
+		return func() {}
+	}
+
+	var fd dbus.UnixFD
+	err = conn.Object("org.freedesktop.login1", "/org/freedesktop/login1").Call(
+		"org.freedesktop.login1.Manager.Inhibit", 0, "idle:sleep:shutdown", "duplicacy", why, "block").Store(&fd)
+	if err != nil {
+		LOG_DEBUG("SYSTEMD_INHIBIT", "Failed to take the inhibitor lock: %v", err)
+		return func() {}
+	}
+
+	LOG_DEBUG("SYSTEMD_INHIBIT", "Took the inhibitor lock: %s", why)
+	return func() {
+		syscall.Close(int(fd))
+		LOG_DEBUG("SYSTEMD_INHIBIT", "Released the inhibitor lock")
+	}
+}
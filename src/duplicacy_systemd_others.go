@@ -0,0 +1,17 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build !linux
+
+package duplicacy
+
+// The journal is only available on Linux.
+func isJournalStream(journalStream string) bool {
+	return false
+}
+
+// InhibitSleep does nothing on platforms without logind.
+func InhibitSleep(why string) func() {
+	return func() {}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotify(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test")
+	os.MkdirAll(testDir, 0700)
+	socket := path.Join(testDir, "notify.socket")
+	os.Remove(socket)
+	defer os.Remove(socket)
+
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("Unix datagram sockets are not supported: %v", err)
+	}
+	defer listener.Close()
+
+	notifySocket = socket
+	defer func() { notifySocket = "" }()
+
+	if !SystemdNotify("STATUS=Uploaded chunk 1") {
+		t.Fatalf("Failed to send the notification")
+	}
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := listener.Read(buffer)
+	if err != nil || string(buffer[:n]) != "STATUS=Uploaded chunk 1" {
+		t.Errorf("Received '%s': %v", buffer[:n], err)
+	}
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if interval := getWatchdogInterval(); interval != 0 {
+		t.Errorf("The watchdog for another process is enabled with the interval %s", interval)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := getWatchdogInterval(); interval != 30*time.Second {
+		t.Errorf("The watchdog interval is %s", interval)
+	}
+}
+
+func TestJournalRecord(t *testing.T) {
+
+	record := getJournalRecord(WARN, "UPLOAD_RETRY", "chunkuploader", "Retrying\nchunk")
+
+	expected := []byte("MESSAGE\n")
+	expected = append(expected, 14, 0, 0, 0, 0, 0, 0, 0)
+	expected = append(expected, []byte("Retrying\nchunk\nPRIORITY=4\nSYSLOG_IDENTIFIER=duplicacy\nDUPLICACY_LEVEL=WARN\n"+
+		"DUPLICACY_LOG_ID=UPLOAD_RETRY\nDUPLICACY_SUBSYSTEM=chunkuploader\n")...)
+	if !bytes.Equal(record, expected) {
+		t.Errorf("The journal record is %q", record)
+	}
+}
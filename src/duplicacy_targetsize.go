@@ -0,0 +1,164 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseStorageSize parses a size such as "800G", "1.5T", or "500MB".  Units are powers of 1024, as in PrettySize.
+func ParseStorageSize(sizeString string) (int64, error) {
+	sizeRegex := regexp.MustCompile(`^([0-9]+(\.[0-9]+)?)\s*([kmgtp]?)(i?b)?$`)
+	matched := sizeRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(sizeString)))
+	if matched == nil {
+		return 0, fmt.Errorf("invalid size '%s'", sizeString)
+	}
+
+	size, err := strconv.ParseFloat(matched[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s': %v", sizeString, err)
+	}
+
+	for _, unit := range "kmgtp" {
+		if matched[3] == "" {
+			break
+		}
+		size *= 1024
+		if matched[3] == string(unit) {
+			break
+		}
+	}
+
+	if size < 1 {
+		return 0, fmt.Errorf("the size '%s' is too small", sizeString)
+	}
+	return int64(size), nil
+}
+
+// SetTargetSize makes PruneSnapshots delete the oldest revisions, after all other selection criteria have been
+// applied, until the chunks referenced by the remaining revisions take up no more than 'targetSize' bytes.  The
+// latest 'minRevisions' revisions of every snapshot id are always kept.
+func (manager *SnapshotManager) SetTargetSize(targetSize int64, minRevisions int) {
+	manager.targetSize = targetSize
+	manager.targetMinRevisions = minRevisions
+}
+
+// flagSnapshotsForTargetSize marks the oldest revisions of the selected snapshot id (or all ids if 'snapshotID' is
+// empty) for deletion until the estimated storage size falls under the target, and returns the number of them.
+// The estimate only counts chunks referenced by the revisions to be kept, so chunks that are already unreferenced
+// will only be freed by an exhaustive prune.  Pinned revisions and those with kept tags are never selected.
+func (manager *SnapshotManager) flagSnapshotsForTargetSize(allSnapshots map[string][]*Snapshot, snapshotID string,
+	exclusive bool, dryRun bool) int {
+
+	minRevisions := manager.targetMinRevisions
+	if !exclusive && minRevisions < 1 {
+		// The latest revision can't be deleted without exclusive access
+		minRevisions = 1
+	}
+	if minRevisions < manager.keepLast {
+		minRevisions = manager.keepLast
+	}
+
+	LOG_INFO("PRUNE_TARGET", "Listing all chunks to estimate the storage size")
+	chunkSizes := manager.listChunkSizes()
+
+	var candidates []*Snapshot
+	snapshotChunks := make(map[*Snapshot][]string)
+	references := make(map[string]int)
+	for id, snapshots := range allSnapshots {
+
+		pinned := make(map[int]bool)
+		if len(snapshotID) == 0 || id == snapshotID {
+			revisions, err := manager.ListPinnedRevisions(id)
+			if err != nil {
+				LOG_ERROR("SNAPSHOT_PIN", "Failed to list the pinned revisions of snapshot %s: %v", id, err)
+				return 0
+			}
+			for _, revision := range revisions {
+				pinned[revision] = true
+			}
+		}
+
+		// Snapshots are sorted by revision, so the ones to keep regardless of the size come at the end
+		kept := 0
+		for i := len(snapshots) - 1; i >= 0; i-- {
+			snapshot := snapshots[i]
+			if snapshot.Flag {
+				continue
+			}
+
+			chunks := manager.GetSnapshotChunks(snapshot, false)
+			for _, chunk := range chunks {
+				references[chunk]++
+			}
+
+			kept++
+			if (len(snapshotID) > 0 && id != snapshotID) || kept <= minRevisions || pinned[snapshot.Revision] ||
+				(len(manager.keptTags) > 0 && snapshot.MatchTags(manager.keptTags)) {
+				continue
+			}
+			snapshotChunks[snapshot] = chunks
+			candidates = append(candidates, snapshot)
+		}
+	}
+
+	currentSize := int64(0)
+	for chunk := range references {
+		currentSize += chunkSizes[chunk]
+	}
+
+	if currentSize <= manager.targetSize {
+		LOG_INFO("PRUNE_TARGET", "The estimated storage size %s is already under the target of %s",
+			PrettySize(currentSize), PrettySize(manager.targetSize))
+		return 0
+	}
+
+	// Older revisions go first regardless of their snapshot ids
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].StartTime != candidates[j].StartTime {
+			return candidates[i].StartTime < candidates[j].StartTime
+		}
+		return candidates[i].Revision < candidates[j].Revision
+	})
+
+	estimatedSize := currentSize
+	flagged := 0
+	for _, snapshot := range candidates {
+		if estimatedSize <= manager.targetSize {
+			break
+		}
+
+		freed := int64(0)
+		for _, chunk := range snapshotChunks[snapshot] {
+			references[chunk]--
+			if references[chunk] == 0 {
+				freed += chunkSizes[chunk]
+			}
+		}
+		estimatedSize -= freed
+
+		if dryRun {
+			LOG_INFO("SNAPSHOT_DELETE", "Snapshot %s at revision %d would be deleted to meet the target size, freeing %s",
+				snapshot.ID, snapshot.Revision, PrettySize(freed))
+		} else {
+			LOG_DEBUG("SNAPSHOT_DELETE", "Snapshot %s at revision %d to be deleted - storage size above the target, "+
+				"freeing %s", snapshot.ID, snapshot.Revision, PrettySize(freed))
+		}
+		snapshot.Flag = true
+		flagged++
+	}
+
+	LOG_INFO("PRUNE_TARGET", "Deleting %d revisions would reduce the estimated storage size from %s to %s", flagged,
+		PrettySize(currentSize), PrettySize(estimatedSize))
+	if estimatedSize > manager.targetSize {
+		LOG_WARN("PRUNE_TARGET", "The estimated storage size %s is still above the target of %s after deleting all "+
+			"revisions allowed to be deleted", PrettySize(estimatedSize), PrettySize(manager.targetSize))
+	}
+	return flagged
+}
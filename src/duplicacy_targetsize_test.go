@@ -0,0 +1,99 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseStorageSize(t *testing.T) {
+
+	sizes := map[string]int64{
+		"1000":  1000,
+		"16k":   16 * 1024,
+		"5MB":   5 * 1024 * 1024,
+		"800G":  800 * 1024 * 1024 * 1024,
+		"1.5T":  1536 * 1024 * 1024 * 1024,
+		"2 GiB": 2 * 1024 * 1024 * 1024,
+	}
+	for sizeString, expected := range sizes {
+		size, err := ParseStorageSize(sizeString)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", sizeString, err)
+		} else if size != expected {
+			t.Errorf("%s was parsed as %d instead of %d", sizeString, size, expected)
+		}
+	}
+
+	for _, sizeString := range []string{"", "G", "10X", "-1G", "0"} {
+		if _, err := ParseStorageSize(sizeString); err == nil {
+			t.Errorf("The invalid size '%s' was accepted", sizeString)
+		}
+	}
+}
+
+func TestPruneToTargetSize(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkSize := 1024
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+
+	// Revisions of the two ids alternate in time; the oldest revision of vm1@host1 is pinned
+	for i := 0; i < 4; i++ {
+		startTime := now - int64(10-2*i)*day
+		createTestSnapshot(snapshotManager, "vm1@host1", i+1, startTime, startTime+60,
+			[]string{uploadRandomChunk(snapshotManager, chunkSize)}, "tag")
+	}
+	for i := 0; i < 3; i++ {
+		startTime := now - int64(9-2*i)*day
+		createTestSnapshot(snapshotManager, "vm2@host1", i+1, startTime, startTime+60,
+			[]string{uploadRandomChunk(snapshotManager, chunkSize)}, "tag")
+	}
+	snapshotManager.PinSnapshots("vm1@host1", []int{1}, "")
+	checkTestSnapshots(snapshotManager, 7, 0)
+
+	chunkSizes := snapshotManager.listChunkSizes()
+	totalSize := int64(0)
+	for _, size := range chunkSizes {
+		totalSize += size
+	}
+	oldestSize := int64(0)
+	for _, chunk := range snapshotManager.GetSnapshotChunks(snapshotManager.DownloadSnapshot("vm2@host1", 1), false) {
+		oldestSize += chunkSizes[chunk]
+	}
+
+	t.Logf("Pruning to a target just below the size without the oldest revision")
+	snapshotManager.SetTargetSize(totalSize-oldestSize-1, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "", []int{}, []string{}, []string{}, false, true, []string{}, false,
+		false, false, 1)
+	checkTestSnapshots(snapshotManager, 5, 0)
+	if revisions, _ := snapshotManager.ListSnapshotRevisions("vm1@host1"); len(revisions) != 3 || revisions[1] != 3 {
+		t.Errorf("Revisions %v of vm1@host1 are left instead of 1, 3, 4", revisions)
+	}
+
+	t.Logf("Pruning to a tiny target while keeping the latest 2 revisions of each id")
+	snapshotManager.SetTargetSize(1, 2)
+	snapshotManager.PruneSnapshots("vm1@host1", "", []int{}, []string{}, []string{}, false, true, []string{}, false,
+		false, false, 1)
+	checkTestSnapshots(snapshotManager, 5, 0)
+
+	t.Logf("Pruning to a tiny target while keeping the latest revision of each id")
+	snapshotManager.SetTargetSize(1, 1)
+	snapshotManager.PruneSnapshots("vm1@host1", "", []int{}, []string{}, []string{}, false, true, []string{}, false,
+		false, false, 1)
+	checkTestSnapshots(snapshotManager, 3, 0)
+	if revisions, _ := snapshotManager.ListSnapshotRevisions("vm1@host1"); len(revisions) != 2 || revisions[0] != 1 {
+		t.Errorf("Revisions %v of vm1@host1 are left instead of 1, 4", revisions)
+	}
+}
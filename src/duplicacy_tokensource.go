@@ -0,0 +1,87 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sync"
+)
+
+// tokenSource holds an access token shared by all threads of a storage client.  A thread whose request has been
+// rejected because of an expired token calls Refresh with the generation of the token the request was sent with.
+// Only the first of them obtains a new token while the others wait for it, and a thread whose token has already been
+// replaced simply gets the new one, so that many threads failing at the same time neither stampede the
+// authorization server nor overwrite each other's tokens.
+type tokenSource struct {
+	lock       sync.Mutex
+	refreshed  *sync.Cond // broadcast when a refresh completes
+	token      interface{}
+	generation int // incremented each time the token is replaced
+	refreshing bool
+	attempts   int   // refreshes completed so far, failed or not
+	err        error // the error of the last refresh
+}
+
+// newTokenSource creates a token source starting with 'token', which may be nil if the first token is to be obtained
+// by Refresh with a generation of 0.
+func newTokenSource(token interface{}) *tokenSource {
+	source := &tokenSource{token: token}
+	source.refreshed = sync.NewCond(&source.lock)
+	return source
+}
+
+// Get returns the current token and its generation.
+func (source *tokenSource) Get() (token interface{}, generation int) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	return source.token, source.generation
+}
+
+// Refresh returns a token newer than the one of 'generation', calling 'refresh' with the current token to obtain it
+// unless another thread has already done so.  If this thread waited for a refresh by another thread that failed, the
+// same error is returned instead of trying again.
+func (source *tokenSource) Refresh(generation int, refresh func(current interface{}) (interface{}, error)) (
+	token interface{}, newGeneration int, err error) {
+
+	source.lock.Lock()
+	defer source.lock.Unlock()
+
+	if source.refreshing {
+		attempts := source.attempts
+		for source.refreshing {
+			source.refreshed.Wait()
+		}
+		if source.generation == generation && source.attempts != attempts {
+			return source.token, source.generation, source.err
+		}
+	}
+
+	if source.generation != generation {
+		return source.token, source.generation, nil
+	}
+
+	source.refreshing = true
+	defer func() {
+		source.refreshing = false
+		source.attempts++
+		source.err = err
+		source.refreshed.Broadcast()
+	}()
+
+	token, err = source.callRefresh(refresh, source.token)
+	if err == nil {
+		source.token = token
+		source.generation++
+	}
+	return source.token, source.generation, err
+}
+
+// callRefresh calls 'refresh' without holding the lock, so that other threads can keep using the current token, and
+// takes the lock back even if 'refresh' panics.
+func (source *tokenSource) callRefresh(refresh func(current interface{}) (interface{}, error), current interface{}) (
+	interface{}, error) {
+	source.lock.Unlock()
+	defer source.lock.Lock()
+	return refresh(current)
+}
@@ -0,0 +1,192 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenSource(t *testing.T) {
+
+	setTestingT(t)
+
+	source := newTokenSource("token0")
+	var refreshes int32
+	refresh := func(current interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&refreshes, 1)
+		time.Sleep(20 * time.Millisecond)
+		if current.(string) == "token1" {
+			return nil, fmt.Errorf("refresh %d failed", n)
+		}
+		return fmt.Sprintf("token%d", n), nil
+	}
+
+	// All threads rejected with the same token share a single refresh
+	refreshAll := func(generation int) (errors int32) {
+		var wait sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				if _, _, err := source.Refresh(generation, refresh); err != nil {
+					atomic.AddInt32(&errors, 1)
+				}
+			}()
+		}
+		wait.Wait()
+		return errors
+	}
+
+	if errors := refreshAll(0); errors != 0 {
+		t.Errorf("%d refreshes failed", errors)
+	}
+	if token, generation := source.Get(); refreshes != 1 || token != "token1" || generation != 1 {
+		t.Errorf("The token is %s of generation %d after %d refreshes", token, generation, refreshes)
+	}
+
+	// A thread with an old token gets the current one without a refresh
+	if token, generation, err := source.Refresh(0, refresh); err != nil || token != "token1" || generation != 1 ||
+		refreshes != 1 {
+		t.Errorf("Refreshing an old token returned %s of generation %d: %v", token, generation, err)
+	}
+
+	// A failed refresh isn't repeated by every thread that waited for it
+	if errors := refreshAll(1); errors == 0 || refreshes > 3 {
+		t.Errorf("%d refreshes were made for a failed refresh, with %d errors", refreshes-1, errors)
+	}
+	if token, generation := source.Get(); token != "token1" || generation != 1 {
+		t.Errorf("The token is %s of generation %d after a failed refresh", token, generation)
+	}
+}
+
+func TestB2ClientAuthorization(t *testing.T) {
+
+	setTestingT(t)
+
+	var lock sync.Mutex
+	currentToken := ""
+	authorizations, uploadURLs := 0, 0
+	inFlight := make(map[string]int)
+	concurrentUploads := 0
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		writeJSON := func(status int, output interface{}) {
+			writer.WriteHeader(status)
+			json.NewEncoder(writer).Encode(output)
+		}
+
+		if request.URL.Path == "/b2api/v1/b2_authorize_account" {
+			authorizations++
+			currentToken = fmt.Sprintf("token%d", authorizations)
+			writeJSON(200, map[string]string{"accountId": "account", "authorizationToken": currentToken,
+				"apiUrl": server.URL, "downloadUrl": server.URL})
+			return
+		}
+
+		if strings.HasPrefix(request.URL.Path, "/upload/") {
+			upload := request.URL.Path
+			if request.Header.Get("Authorization") != "upload"+upload[len("/upload/"):] {
+				writeJSON(401, map[string]interface{}{"status": 401, "message": "bad upload token"})
+				return
+			}
+			inFlight[upload]++
+			if inFlight[upload] > 1 {
+				concurrentUploads++
+			}
+			lock.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			lock.Lock()
+			inFlight[upload]--
+			writeJSON(200, map[string]string{})
+			return
+		}
+
+		if currentToken == "" || request.Header.Get("Authorization") != currentToken {
+			writeJSON(401, map[string]interface{}{"status": 401, "code": "expired_auth_token", "message": "expired"})
+			return
+		}
+
+		switch request.URL.Path {
+		case "/b2api/v1/b2_delete_file_version":
+			writeJSON(200, map[string]string{})
+		case "/b2api/v1/b2_get_upload_url":
+			uploadURLs++
+			writeJSON(200, map[string]string{"uploadUrl": fmt.Sprintf("%s/upload/%d", server.URL, uploadURLs),
+				"authorizationToken": fmt.Sprintf("upload%d", uploadURLs)})
+		default:
+			writeJSON(404, map[string]interface{}{"status": 404, "message": "not found"})
+		}
+	}))
+	defer server.Close()
+
+	authorizationURL := B2AuthorizationURL
+	B2AuthorizationURL = server.URL + "/b2api/v1/b2_authorize_account"
+	defer func() { B2AuthorizationURL = authorizationURL }()
+
+	threads := 4
+	client := NewB2Client("id", "key", "", "", threads)
+	client.RetryPolicy = CreateRetryPolicy(3, 0.001, 0, 0)
+	if err, _ := client.AuthorizeAccount(0); err != nil {
+		t.Fatalf("Failed to authorize: %v", err)
+	}
+
+	// The token expires while many threads are using it
+	lock.Lock()
+	currentToken = ""
+	lock.Unlock()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			if err := client.DeleteFile(i%threads, fmt.Sprintf("chunks/%d", i), "id"); err != nil {
+				t.Errorf("Failed to delete file %d: %v", i, err)
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if authorizations != 2 {
+		t.Errorf("The account was authorized %d times instead of 2", authorizations)
+	}
+
+	// Upload URLs are never used by two uploads at once, even by threads with the same index
+	lock.Unlock()
+	for i := 0; i < 16; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			if err := client.UploadFile(i%2, fmt.Sprintf("chunks/%d", i), []byte("content"), 0); err != nil {
+				t.Errorf("Failed to upload file %d: %v", i, err)
+			}
+		}(i)
+		if i%threads == threads-1 {
+			wait.Wait()
+		}
+	}
+	lock.Lock()
+
+	if concurrentUploads != 0 {
+		t.Errorf("Upload URLs were used by concurrent uploads %d times", concurrentUploads)
+	}
+	if uploadURLs > threads {
+		t.Errorf("%d upload URLs were obtained for %d threads", uploadURLs, threads)
+	}
+}
@@ -106,6 +106,11 @@ func (reader *RateLimitedReader) Read(p []byte) (n int, err error) {
 		return 0, io.EOF
 	}
 
+	// Stop the upload immediately if the operation has been cancelled
+	if err = GetOperationContext().Err(); err != nil {
+		return 0, err
+	}
+
 	if reader.Rate <= 0 {
 		n := copy(p, reader.Content[reader.Next:])
 		reader.Next += n
@@ -138,6 +143,7 @@ func (reader *RateLimitedReader) Read(p []byte) (n int, err error) {
 }
 
 func RateLimitedCopy(writer io.Writer, reader io.Reader, rate int) (written int64, err error) {
+	reader = &cancellableReader{reader: reader, ctx: GetOperationContext()}
 	if rate <= 0 {
 		return io.Copy(writer, reader)
 	}
@@ -160,7 +166,7 @@ func GenerateKeyFromPassword(password string, salt []byte, iterations int) []byt
 	return pbkdf2.Key([]byte(password), salt, iterations, 32, sha256.New)
 }
 
-// Get password from preference, env, but don't start any keyring request
+// Get password from preference, env, or the password command, but don't start any keyring request
 func GetPasswordFromPreference(preference Preference, passwordType string) string {
 	passwordID := passwordType
 	if preference.Name != "default" {
@@ -197,7 +203,7 @@ func GetPasswordFromPreference(preference Preference, passwordType string) strin
 		return preference.Keys[passwordType]
 	}
 
-	return ""
+	return getPasswordFromCommand(preference, passwordType, passwordID)
 }
 
 // GetPassword attempts to get the password from KeyChain/KeyRing, environment variables, or keyboard input.
@@ -215,9 +221,9 @@ func GetPassword(preference Preference, passwordType string, prompt string,
 	}
 
 	if resetPassword && !RunInBackground {
-		keyringSet(passwordID, "")
+		keyringSet(getKeyring(preference), passwordID, "")
 	} else {
-		password := keyringGet(passwordID)
+		password := keyringGet(getKeyring(preference), passwordID)
 		if password != "" {
 			LOG_DEBUG("PASSWORD_KEYCHAIN", "Reading %s from keychain/keyring", passwordType)
 			return password
@@ -268,7 +274,7 @@ func SavePassword(preference Preference, passwordType string, password string) {
 	if preference.Name != "default" {
 		passwordID = preference.Name + "_" + passwordID
 	}
-	keyringSet(passwordID, password)
+	keyringSet(getKeyring(preference), passwordID, password)
 }
 
 // The following code was modified from the online article  'Matching Wildcards: An Algorithm', by Kirk J. Krauss,
@@ -338,8 +344,37 @@ func matchPattern(text string, pattern string) bool {
 // MatchPath returns 'true' if the file 'filePath' is excluded by the specified 'patterns'.  Each pattern starts with
 // either '+' or '-', whereas '-' indicates exclusion and '+' indicates inclusion.  Wildcards like '*' and '?' may
 // appear in the patterns.  In case no matching pattern is found, the file will be excluded if all patterns are
-// include patterns, and included otherwise.
+// include patterns, and included otherwise.  Patterns with predicates never match since only the path is known.
 func MatchPath(filePath string, patterns []string) (included bool) {
+	return matchPath(filePath, nil, patterns)
+}
+
+// MatchEntry is the same as MatchPath but also evaluates the size and time predicates against the entry.
+func MatchEntry(entry *Entry, patterns []string) (included bool) {
+	return matchPath(entry.Path, entry, patterns)
+}
+
+func matchPath(filePath string, entry *Entry, patterns []string) (included bool) {
+
+	included, pattern := MatchPathPattern(filePath, entry, patterns)
+	if pattern != "" {
+		if included {
+			LOG_DEBUG("PATTERN_INCLUDE", "%s is included by pattern %s", filePath, pattern)
+		} else {
+			LOG_DEBUG("PATTERN_EXCLUDE", "%s is excluded by pattern %s", filePath, pattern)
+		}
+	} else if included {
+		LOG_DEBUG("PATTERN_INCLUDE", "%s is included", filePath)
+	} else {
+		LOG_DEBUG("PATTERN_EXCLUDE", "%s is excluded", filePath)
+	}
+	return included
+}
+
+// MatchPathPattern is the same as MatchPath but also returns the first pattern that matches the file, which decides
+// whether the file is included.  The pattern is empty if no pattern matches.  'entry' may be nil if only the path is
+// known.
+func MatchPathPattern(filePath string, entry *Entry, patterns []string) (included bool, matchedPattern string) {
 
 	var re *regexp.Regexp = nil
 	var found bool
@@ -348,52 +383,45 @@ func MatchPath(filePath string, patterns []string) (included bool) {
 	allIncludes := true
 
 	for _, pattern := range patterns {
-		if pattern[0] == '+' {
-			if matchPattern(filePath, pattern[1:]) {
-				LOG_DEBUG("PATTERN_INCLUDE", "%s is included by pattern %s", filePath, pattern)
-				return true
-			}
-		} else if pattern[0] == '-' {
+		if pattern[0] == '-' || strings.HasPrefix(pattern, "e:") {
 			allIncludes = false
-			if matchPattern(filePath, pattern[1:]) {
-				LOG_DEBUG("PATTERN_EXCLUDE", "%s is excluded by pattern %s", filePath, pattern)
-				return false
+		}
+
+		prefixLength := 1
+		if pattern[0] != '+' && pattern[0] != '-' {
+			prefixLength = 2
+		}
+		predicates, body := SplitFilterPredicates(pattern[prefixLength:])
+		if predicates != "" {
+			parsed, err := ParseFilterPredicates(predicates)
+			if err != nil || !MatchFilterPredicates(parsed, entry) {
+				continue
 			}
+		}
+
+		if pattern[0] == '+' || pattern[0] == '-' {
+			matched = (predicates != "" && body == "") || matchPattern(filePath, body)
 		} else if strings.HasPrefix(pattern, "i:") || strings.HasPrefix(pattern, "e:") {
-			if re, found = RegexMap[pattern[2:]]; found {
+			if re, found = RegexMap[body]; found {
 				matched = re.MatchString(filePath)
 			} else {
-				re, err := regexp.Compile(pattern)
+				re, err := regexp.Compile(body)
 				if err != nil {
-					LOG_ERROR("REGEX_ERROR", "Invalid regex encountered for pattern \"%s\" - %v", pattern[2:], err)
+					LOG_ERROR("REGEX_ERROR", "Invalid regex encountered for pattern \"%s\" - %v", body, err)
 				}
-				RegexMap[pattern] = re
+				RegexMap[body] = re
 				matched = re.MatchString(filePath)
 			}
-			if matched {
-				if strings.HasPrefix(pattern, "i:") {
-					LOG_DEBUG("PATTERN_INCLUDE", "%s is included by pattern %s", filePath, pattern)
-					return true
-				} else {
-					LOG_DEBUG("PATTERN_EXCLUDE", "%s is excluded by pattern %s", filePath, pattern)
-					return false
+		} else {
+			continue
+		}
 
-				}
-			} else {
-				if strings.HasPrefix(pattern, "e:") {
-					allIncludes = false
-				}
-			}
+		if matched {
+			return pattern[0] == '+' || strings.HasPrefix(pattern, "i:"), pattern
 		}
 	}
 
-	if allIncludes {
-		LOG_DEBUG("PATTERN_EXCLUDE", "%s is excluded", filePath)
-		return false
-	} else {
-		LOG_DEBUG("PATTERN_INCLUDE", "%s is included", filePath)
-		return true
-	}
+	return !allIncludes, ""
 }
 
 func PrettyNumber(number int64) string {
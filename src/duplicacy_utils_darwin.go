@@ -6,9 +6,14 @@ package duplicacy
 
 import (
 	"strings"
+	"syscall"
 )
 
 func excludedByAttribute(attirbutes map[string][]byte) bool {
 	value, ok := attirbutes["com.apple.metadata:com_apple_backup_excludeItem"]
 	return ok && strings.Contains(string(value), "com.apple.backupd")
 }
+
+func mknod(path string, mode uint32, device uint64) error {
+	return syscall.Mknod(path, mode, int(device))
+}
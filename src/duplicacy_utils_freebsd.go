@@ -5,9 +5,14 @@
 package duplicacy
 
 import (
+	"syscall"
 )
 
 func excludedByAttribute(attirbutes map[string][]byte) bool {
 	_, ok := attirbutes["duplicacy_exclude"]
 	return ok
-}
\ No newline at end of file
+}
+
+func mknod(path string, mode uint32, device uint64) error {
+	return syscall.Mknod(path, mode, device)
+}
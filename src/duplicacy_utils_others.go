@@ -8,9 +8,9 @@ package duplicacy
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"path"
-	"path/filepath"
 	"syscall"
 
 	"github.com/pkg/xattr"
@@ -38,8 +38,9 @@ func SetOwner(fullPath string, entry *Entry, fileInfo *os.FileInfo) bool {
 		if entry.UID != -1 && entry.GID != -1 {
 			err := os.Lchown(fullPath, entry.UID, entry.GID)
 			if err != nil {
-				LOG_ERROR("RESTORE_CHOWN", "Failed to change uid or gid: %v", err)
-				return false
+				LOG_WERROR(ownerErrorsAsWarnings, "RESTORE_CHOWN", "Failed to change uid or gid of %s: %v",
+					entry.Path, err)
+				return ownerErrorsAsWarnings
 			}
 		}
 	}
@@ -47,9 +48,56 @@ func SetOwner(fullPath string, entry *Entry, fileInfo *os.FileInfo) bool {
 	return true
 }
 
+// GetDeviceNumber returns the device number of a device node.
+func GetDeviceNumber(fileInfo os.FileInfo) uint64 {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if ok && stat != nil && fileInfo.Mode()&os.ModeDevice != 0 {
+		return uint64(stat.Rdev)
+	}
+	return 0
+}
+
+// GetFileSystemID returns the id of the device containing the file or directory, following symbolic links.
+func GetFileSystemID(fullPath string) (id uint64, ok bool) {
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil {
+		return 0, false
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || stat == nil {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
+
+// CreateSpecialFile creates the named pipe, socket, or device node described by the entry.  Creating device nodes
+// usually requires root privileges.
+func CreateSpecialFile(fullPath string, entry *Entry) error {
+	mode := os.FileMode(entry.Mode)
+	permissions := uint32(entry.GetPermissions().Perm())
+
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return syscall.Mkfifo(fullPath, permissions)
+	case mode&os.ModeSocket != 0:
+		// Binding a unix domain socket leaves the socket file behind after the socket is closed
+		fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		return syscall.Bind(fd, &syscall.SockaddrUnix{Name: fullPath})
+	case mode&os.ModeCharDevice != 0:
+		return mknod(fullPath, syscall.S_IFCHR|permissions, entry.Device)
+	case mode&os.ModeDevice != 0:
+		return mknod(fullPath, syscall.S_IFBLK|permissions, entry.Device)
+	}
+	return fmt.Errorf("unknown file type %v", mode&os.ModeType)
+}
+
 func (entry *Entry) ReadAttributes(top string) {
 
-	fullPath := filepath.Join(top, entry.Path)
+	fullPath := joinRootPath(top, entry.Path)
 	attributes, _ := xattr.List(fullPath)
 	if len(attributes) > 0 {
 		entry.Attributes = make(map[string][]byte)
@@ -60,6 +108,8 @@ func (entry *Entry) ReadAttributes(top string) {
 			}
 		}
 	}
+
+	entry.readFileFlags(fullPath)
 }
 
 func (entry *Entry) SetAttributesToFile(fullPath string) {
@@ -67,6 +117,9 @@ func (entry *Entry) SetAttributesToFile(fullPath string) {
 
 	for _, name := range names {
 
+		if isMetadataAttribute(name) {
+			continue
+		}
 
 		newAttribute, found := entry.Attributes[name]
 		if found {
@@ -81,15 +134,29 @@ func (entry *Entry) SetAttributesToFile(fullPath string) {
 	}
 
 	for name, attribute := range entry.Attributes {
-		xattr.Set(fullPath, name, attribute)
+		if !isMetadataAttribute(name) {
+			xattr.Set(fullPath, name, attribute)
+		}
 	}
 
+	entry.restoreBirthTime(fullPath)
+	entry.restoreFileFlags(fullPath)
+}
+
+// IsSharingViolation always returns false since files in use by other processes can still be read.
+func IsSharingViolation(err error) bool {
+	return false
 }
 
 func joinPath(components ...string) string {
 	return path.Join(components...)
 }
 
+// getNormalPath returns the path as it is since there are no extended-length paths.
+func getNormalPath(fullPath string) string {
+	return fullPath
+}
+
 func SplitDir(fullPath string) (dir string, file string) {
 	return path.Split(fullPath)
 }
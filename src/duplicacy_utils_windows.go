@@ -5,6 +5,7 @@
 package duplicacy
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -48,6 +49,9 @@ const (
 	SYMBOLIC_LINK_FLAG_DIRECTORY     = 0x1
 
 	FILE_READ_ATTRIBUTES = 0x0080
+
+	ERROR_SHARING_VIOLATION = 32
+	ERROR_LOCK_VIOLATION    = 33
 )
 
 // We copied golang source code for Readlink but made a simple modification here:  use FILE_READ_ATTRIBUTES instead of
@@ -110,21 +114,50 @@ func SetOwner(fullPath string, entry *Entry, fileInfo *os.FileInfo) bool {
 	return true
 }
 
-func (entry *Entry) ReadAttributes(top string) {
+func GetDeviceNumber(fileInfo os.FileInfo) uint64 {
+	return 0
 }
 
-func (entry *Entry) SetAttributesToFile(fullPath string) {
+func GetFileSystemID(fullPath string) (id uint64, ok bool) {
+	return 0, false
+}
 
+func CreateSpecialFile(fullPath string, entry *Entry) error {
+	return fmt.Errorf("special files are not supported on Windows")
 }
 
+// joinPath returns the joined path in the extended-length form, so that it can be accessed even if it is longer than
+// MAX_PATH (260 characters).
 func joinPath(components ...string) string {
+	return getExtendedLengthPath(filepath.Join(redirectToShadowCopy(components)...))
+}
 
-	combinedPath := `\\?\` + filepath.Join(components...)
+// getExtendedLengthPath converts a path to the \\?\ form, which is not subject to the MAX_PATH limit.  Such a path
+// must be absolute and is not normalized by Windows, so relative paths are made absolute and cleaned first.  Paths
+// already in this form, or in the \\.\ device form, are returned as they are.
+func getExtendedLengthPath(fullPath string) string {
+	if strings.HasPrefix(fullPath, `\\?\`) || strings.HasPrefix(fullPath, `\\.\`) {
+		return fullPath
+	}
+	if !filepath.IsAbs(fullPath) {
+		if absolutePath, err := filepath.Abs(fullPath); err == nil {
+			fullPath = absolutePath
+		}
+	}
 	// If the path is on a samba drive we must use the UNC format
-	if strings.HasPrefix(combinedPath, `\\?\\\`) {
-		combinedPath = `\\?\UNC\` + combinedPath[6:]
+	if strings.HasPrefix(fullPath, `\\`) {
+		return `\\?\UNC\` + fullPath[2:]
 	}
-	return combinedPath
+	return `\\?\` + fullPath
+}
+
+// getNormalPath converts a path in the extended-length form back to the normal form, so that it can be compared to
+// paths provided by the user.
+func getNormalPath(fullPath string) string {
+	if strings.HasPrefix(fullPath, `\\?\UNC\`) {
+		return `\\` + fullPath[8:]
+	}
+	return strings.TrimPrefix(fullPath, `\\?\`)
 }
 
 func SplitDir(fullPath string) (dir string, file string) {
@@ -135,3 +168,12 @@ func SplitDir(fullPath string) (dir string, file string) {
 func excludedByAttribute(attirbutes map[string][]byte) bool {
 	return false
 }
+
+// IsSharingViolation returns true if the error is caused by the file being opened or locked by another process.
+func IsSharingViolation(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno == ERROR_SHARING_VIOLATION || errno == ERROR_LOCK_VIOLATION
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"testing"
+)
+
+func TestExtendedLengthPath(t *testing.T) {
+
+	for _, test := range []struct {
+		components []string
+		expected   string
+	}{
+		{[]string{`C:\repository`, "node_modules/a/b"}, `\\?\C:\repository\node_modules\a\b`},
+		{[]string{`C:\repository\`, "dir/"}, `\\?\C:\repository\dir`},
+		{[]string{`\\server\share\repository`, "file"}, `\\?\UNC\server\share\repository\file`},
+		{[]string{`\\?\C:\repository`, "file"}, `\\?\C:\repository\file`},
+		{[]string{`\\?\UNC\server\share`, "file"}, `\\?\UNC\server\share\file`},
+	} {
+		fullPath := joinPath(test.components...)
+		if fullPath != test.expected {
+			t.Errorf("%v joined to %s, expected %s", test.components, fullPath, test.expected)
+		}
+		if normalPath := getNormalPath(fullPath); getExtendedLengthPath(normalPath) != fullPath {
+			t.Errorf("%s converted back to %s", fullPath, normalPath)
+		}
+	}
+}
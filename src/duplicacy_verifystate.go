@@ -0,0 +1,57 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sort"
+	"time"
+)
+
+// How often the record of verified chunks is saved while chunks are being verified, so an interrupted check -chunks
+// can resume without verifying those chunks again
+var verifiedChunksSaveInterval = 5 * time.Minute
+
+// SetChunkVerification controls which chunks check -chunks verifies.  Chunks verified less than 'reverifyAfter' ago
+// are skipped; if it is 0 chunks verified once are never verified again.  If 'maxChunks' is positive, at most that
+// many chunks are verified in one run, those never verified or verified longest ago first, so that a large storage
+// can be verified a part at a time.
+func (manager *SnapshotManager) SetChunkVerification(reverifyAfter time.Duration, maxChunks int) {
+	manager.reverifyAfter = reverifyAfter
+	manager.maxChunksToVerify = maxChunks
+}
+
+// selectChunksToVerify returns the chunks to be verified in this run given the times in 'verifiedChunks' at which
+// chunks were last verified, along with the numbers of chunks skipped as recently verified and postponed to later
+// runs because of the limit on the number of chunks.
+func (manager *SnapshotManager) selectChunksToVerify(allChunkHashes map[string]bool, verifiedChunks map[string]int64,
+	now time.Time) (chunkHashes []string, skippedChunks int, postponedChunks int) {
+
+	verifiedTimes := make(map[string]int64)
+	for chunkHash := range allChunkHashes {
+		chunkID := manager.config.GetChunkIDFromHash(chunkHash)
+		if verifiedTime, found := verifiedChunks[chunkID]; found {
+			if manager.reverifyAfter == 0 || now.Sub(time.Unix(verifiedTime, 0)) < manager.reverifyAfter {
+				skippedChunks++
+				continue
+			}
+			verifiedTimes[chunkHash] = verifiedTime
+		}
+		chunkHashes = append(chunkHashes, chunkHash)
+	}
+
+	if manager.maxChunksToVerify > 0 && len(chunkHashes) > manager.maxChunksToVerify {
+		// Chunks never verified have a time of 0 so they come first
+		sort.Slice(chunkHashes, func(i, j int) bool {
+			if verifiedTimes[chunkHashes[i]] != verifiedTimes[chunkHashes[j]] {
+				return verifiedTimes[chunkHashes[i]] < verifiedTimes[chunkHashes[j]]
+			}
+			return chunkHashes[i] < chunkHashes[j]
+		})
+		postponedChunks = len(chunkHashes) - manager.maxChunksToVerify
+		chunkHashes = chunkHashes[:manager.maxChunksToVerify]
+	}
+
+	return chunkHashes, skippedChunks, postponedChunks
+}
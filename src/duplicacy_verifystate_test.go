@@ -0,0 +1,54 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSelectChunksToVerify(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	now := time.Now()
+	day := 24 * time.Hour
+
+	// Chunk 0 is never verified; chunk i was verified i days ago
+	allChunkHashes := make(map[string]bool)
+	verifiedChunks := make(map[string]int64)
+	var chunkHashes []string
+	for i := 0; i < 5; i++ {
+		chunkHash := fmt.Sprintf("chunk%d", i)
+		chunkHashes = append(chunkHashes, chunkHash)
+		allChunkHashes[chunkHash] = true
+		if i > 0 {
+			verifiedChunks[snapshotManager.config.GetChunkIDFromHash(chunkHash)] = now.Add(-time.Duration(i) * day).Unix()
+		}
+	}
+
+	selected, skipped, postponed := snapshotManager.selectChunksToVerify(allChunkHashes, verifiedChunks, now)
+	if len(selected) != 1 || selected[0] != "chunk0" || skipped != 4 || postponed != 0 {
+		t.Errorf("Selected %v, skipped %d, postponed %d without re-verification", selected, skipped, postponed)
+	}
+
+	snapshotManager.SetChunkVerification(2*day+time.Hour, 0)
+	selected, skipped, postponed = snapshotManager.selectChunksToVerify(allChunkHashes, verifiedChunks, now)
+	if len(selected) != 3 || skipped != 2 || postponed != 0 {
+		t.Errorf("Selected %v, skipped %d, postponed %d with re-verification after 2 days", selected, skipped, postponed)
+	}
+
+	snapshotManager.SetChunkVerification(2*day+time.Hour, 2)
+	selected, skipped, postponed = snapshotManager.selectChunksToVerify(allChunkHashes, verifiedChunks, now)
+	if len(selected) != 2 || selected[0] != "chunk0" || selected[1] != "chunk4" || skipped != 2 || postponed != 1 {
+		t.Errorf("Selected %v, skipped %d, postponed %d with at most 2 chunks", selected, skipped, postponed)
+	}
+}
@@ -67,7 +67,7 @@ func CreateWasabiStorage(
 		storageDir: storageDir,
 		key:        accessKey,
 		secret:     secretKey,
-		client:     &http.Client{},
+		client:     newStorageHTTPClient(),
 	}
 
 	wasabi.DerivedStorage = wasabi
@@ -82,6 +82,12 @@ func (storage *WasabiStorage) ListFiles(
 	return storage.s3.ListFiles(threadIndex, dir)
 }
 
+func (storage *WasabiStorage) ListFilesFunc(
+	threadIndex int, dir string, handler func(file string, size int64) bool,
+) (err error) {
+	return storage.s3.ListFilesFunc(threadIndex, dir, handler)
+}
+
 func (storage *WasabiStorage) DeleteFile(
 	threadIndex int, filePath string,
 ) (err error) {
@@ -123,7 +129,7 @@ func (storage *WasabiStorage) MoveFile(threadIndex int, from string, to string)
 
 	authorization := fmt.Sprintf("AWS %s:%s", storage.key, signature)
 
-	request, err := http.NewRequest("MOVE", object, nil)
+	request, err := http.NewRequestWithContext(storage.GetContext(), "MOVE", object, nil)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,227 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// RepositoryWatcher watches every directory in a repository for changes and accumulates them in a change set, so that
+// a backup only needs to list again the directories changed since the previous backup made by the same process.
+type RepositoryWatcher struct {
+	top      string
+	excluded string // the preference directory, whose changes are ignored
+	watcher  *fsnotify.Watcher
+
+	lock       sync.Mutex
+	changes    *ChangeSet
+	pending    int // the number of changes since the last call to Wait
+	lastChange time.Time
+	unwatched  map[string]bool // directories that can't be watched and thus must always be listed
+	notify     chan bool
+}
+
+// CreateRepositoryWatcher starts watching all directories under 'top', including those linked from the repository
+// root, and under the source roots.
+func CreateRepositoryWatcher(top string) (*RepositoryWatcher, error) {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	repositoryWatcher := &RepositoryWatcher{
+		top:       top,
+		watcher:   watcher,
+		changes:   CreateChangeSet(),
+		unwatched: make(map[string]bool),
+		notify:    make(chan bool, 1),
+	}
+
+	if excluded, err := filepath.Abs(GetDuplicacyPreferencePath()); err == nil {
+		repositoryWatcher.excluded = excluded
+	}
+
+	repositoryWatcher.addDirectory("")
+	for name := range sourceRoots {
+		repositoryWatcher.addDirectory(name)
+	}
+	if len(repositoryWatcher.unwatched) > 0 {
+		LOG_WARN("WATCH_INCOMPLETE", "%d directories can't be watched and will be listed in every backup",
+			len(repositoryWatcher.unwatched))
+	}
+
+	go repositoryWatcher.run()
+	return repositoryWatcher, nil
+}
+
+func (watcher *RepositoryWatcher) Close() {
+	watcher.watcher.Close()
+}
+
+// addDirectory watches the directory with the relative path 'directory' and all its subdirectories.  Symbolic links to
+// directories are only followed at the repository root, as when the repository is listed.
+func (watcher *RepositoryWatcher) addDirectory(directory string) {
+
+	root := joinRootPath(watcher.top, directory)
+	filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 && getNormalPath(filepath.Dir(fullPath)) == watcher.top {
+			if stat, err := os.Stat(fullPath); err == nil && stat.IsDir() {
+				watcher.addDirectory(filepath.Base(fullPath))
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if watcher.isExcluded(fullPath) {
+			return filepath.SkipDir
+		}
+
+		if err := watcher.watcher.Add(fullPath); err != nil {
+			relativePath, _ := watcher.getRelativePath(fullPath)
+			LOG_DEBUG("WATCH_ADD", "Failed to watch %s: %v", fullPath, err)
+			watcher.lock.Lock()
+			watcher.unwatched[relativePath] = true
+			watcher.lock.Unlock()
+		}
+		return nil
+	})
+}
+
+// getRelativePath returns the path in the snapshot of a file under the repository or a source root.
+func (watcher *RepositoryWatcher) getRelativePath(fullPath string) (string, bool) {
+	if relativePath, ok := getRelativeRootPath(fullPath); ok {
+		return relativePath, true
+	}
+	return getRelativePath(watcher.top, fullPath, false)
+}
+
+func (watcher *RepositoryWatcher) isExcluded(fullPath string) bool {
+	fullPath = getNormalPath(fullPath)
+	if filepath.Base(fullPath) == DUPLICACY_DIRECTORY && filepath.Dir(fullPath) == watcher.top {
+		return true
+	}
+	return watcher.excluded != "" && (fullPath == watcher.excluded ||
+		strings.HasPrefix(fullPath, watcher.excluded+string(os.PathSeparator)))
+}
+
+func (watcher *RepositoryWatcher) run() {
+
+	defer CatchLogException()
+
+	for {
+		select {
+		case event, ok := <-watcher.watcher.Events:
+			if !ok {
+				return
+			}
+			watcher.handleEvent(event)
+		case err, ok := <-watcher.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost so the next backup must list everything
+			LOG_WARN("WATCH_ERROR", "Failed to watch the repository: %v", err)
+			watcher.markChanged("", true)
+		}
+	}
+}
+
+func (watcher *RepositoryWatcher) handleEvent(event fsnotify.Event) {
+
+	if watcher.isExcluded(event.Name) {
+		return
+	}
+	relativePath, ok := watcher.getRelativePath(event.Name)
+	if !ok || relativePath == "" {
+		return
+	}
+
+	LOG_TRACE("WATCH_EVENT", "%s", event)
+
+	recursive := false
+	if event.Op&fsnotify.Create != 0 {
+		if stat, err := os.Lstat(event.Name); err == nil && stat.IsDir() {
+			// Files created in the new directory before the watch is added are caught by listing it recursively
+			watcher.addDirectory(relativePath)
+			recursive = true
+		}
+	}
+	watcher.markChanged(relativePath, recursive)
+}
+
+func (watcher *RepositoryWatcher) markChanged(relativePath string, recursive bool) {
+
+	watcher.lock.Lock()
+	watcher.changes.MarkChanged(relativePath, recursive)
+	watcher.pending++
+	watcher.lastChange = time.Now()
+	watcher.lock.Unlock()
+
+	select {
+	case watcher.notify <- true:
+	default:
+	}
+}
+
+// Wait blocks until changes have been detected and either no more changes have been made for 'interval', or the
+// number of changes has reached 'threshold' (if 'threshold' is positive).  It returns the changes accumulated since the
+// previous call, to be passed to BackupManager.SetChangeSet.  'last' is the change set used by the last backup.
+func (watcher *RepositoryWatcher) Wait(last *ChangeSet, interval time.Duration, threshold int) *ChangeSet {
+
+	for {
+		watcher.lock.Lock()
+		pending := watcher.pending
+		quiet := time.Since(watcher.lastChange)
+		if pending > 0 && (quiet >= interval || (threshold > 0 && pending >= threshold)) {
+			changes := watcher.takeChanges(last)
+			watcher.lock.Unlock()
+			LOG_INFO("WATCH_CHANGES", "%d changes detected in %d directories", pending, len(changes.changed))
+			return changes
+		}
+		watcher.lock.Unlock()
+
+		wait := interval
+		if pending > 0 {
+			wait = interval - quiet
+		}
+		select {
+		case <-watcher.notify:
+		case <-time.After(wait):
+		case <-GetOperationContext().Done():
+			checkOperationCancelled(GetOperationContext())
+		}
+	}
+}
+
+// takeChanges replaces the accumulated changes with an empty change set.  The files that the last backup couldn't
+// back up and the directories not watched are marked as changed so they will be listed again.
+func (watcher *RepositoryWatcher) takeChanges(last *ChangeSet) *ChangeSet {
+
+	changes := watcher.changes
+	changes.Settings = last.Settings
+	changes.revision = last.revision
+	for _, path := range last.retry {
+		changes.MarkChanged(path, strings.HasSuffix(path, "/"))
+	}
+	for directory := range watcher.unwatched {
+		changes.MarkChanged(directory, true)
+	}
+
+	watcher.changes = CreateChangeSet()
+	watcher.pending = 0
+	return changes
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepositoryWatcher(t *testing.T) {
+
+	testDir := filepath.Join(os.TempDir(), "duplicacy_test", "watcher")
+	os.RemoveAll(testDir)
+	os.MkdirAll(filepath.Join(testDir, "a", "b"), 0700)
+	os.MkdirAll(filepath.Join(testDir, "c"), 0700)
+
+	watcher, err := CreateRepositoryWatcher(testDir)
+	if err != nil {
+		t.Skipf("Failed to watch the directory: %v", err)
+	}
+	defer watcher.Close()
+
+	last := CreateChangeSet()
+	last.revision = 3
+	last.retry = []string{"c/locked"}
+
+	ioutil.WriteFile(filepath.Join(testDir, "a", "b", "file"), []byte("file"), 0600)
+	os.MkdirAll(filepath.Join(testDir, "d", "e"), 0700)
+
+	changes := watcher.Wait(last, 500*time.Millisecond, 0)
+	if changes.revision != 3 {
+		t.Errorf("The revision is %d; expected 3", changes.revision)
+	}
+	for directory, recursive := range map[string]bool{"a/b/": false, "": false, "d/": true, "c/": false} {
+		if changed, found := changes.changed[directory]; !found || changed != recursive {
+			t.Errorf("%s: found is %t, recursive is %t", directory, found, changed)
+		}
+	}
+	if _, found := changes.changed["a/"]; found {
+		t.Errorf("a/ should not be changed")
+	}
+
+	// Changes made after Wait returns belong to the next change set
+	ioutil.WriteFile(filepath.Join(testDir, "d", "e", "file"), []byte("file"), 0600)
+	changes = watcher.Wait(changes, 500*time.Millisecond, 1)
+	if _, found := changes.changed["d/e/"]; !found || len(changes.changed) != 1 {
+		t.Errorf("The changed directories are %v; expected d/e/", changes.changed)
+	}
+
+	os.RemoveAll(testDir)
+}
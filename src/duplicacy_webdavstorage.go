@@ -15,13 +15,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	//"net/http/httputil"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 )
 
 type WebDAVStorage struct {
@@ -36,6 +34,7 @@ type WebDAVStorage struct {
 
 	client             *http.Client
 	threads            int
+	retryPolicy        *RetryPolicy
 	directoryCache     map[string]int // stores directories known to exist by this backend
 	directoryCacheLock sync.Mutex     // lock for accessing directoryCache
 }
@@ -61,8 +60,9 @@ func CreateWebDAVStorage(host string, port int, username string, password string
 		storageDir: "",
 		useHTTP:    useHTTP,
 
-		client:         http.DefaultClient,
+		client:         newStorageHTTPClient(),
 		threads:        threads,
+		retryPolicy:    CreateRetryPolicy(8, 1, 0, 0.5),
 		directoryCache: make(map[string]int),
 	}
 
@@ -108,17 +108,31 @@ func (storage *WebDAVStorage) createConnectionString(uri string) string {
 	return url + "/" + storage.storageDir + uri
 }
 
-func (storage *WebDAVStorage) retry(backoff int) int {
-	delay := rand.Intn(backoff*500) + backoff*500
-	time.Sleep(time.Duration(delay) * time.Millisecond)
-	backoff *= 2
-	return backoff
+// SetRetryPolicy replaces the settings of the default retry policy with the non-zero ones of 'policy'.
+func (storage *WebDAVStorage) SetRetryPolicy(policy *RetryPolicy) {
+	storage.retryPolicy = storage.retryPolicy.override(policy)
+}
+
+// startRequest returns the retry state of a request.
+func (storage *WebDAVStorage) startRequest(method string, uri string, depth int) *retryState {
+	class := RetryClassOther
+	switch {
+	case method == "PROPFIND" && depth > 0:
+		class = RetryClassList
+	case method == "GET":
+		class = RetryClassDownload
+	case method == "PUT":
+		class = RetryClassUpload
+	case method == "DELETE":
+		class = RetryClassDelete
+	}
+	return storage.retryPolicy.startRequest(storage.GetContext(), "WEBDAV", class, method+" "+uri)
 }
 
 func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int, data []byte) (io.ReadCloser, http.Header, error) {
 
-	backoff := 1
-	for i := 0; i < 8; i++ {
+	retryState := storage.startRequest(method, uri, depth)
+	for {
 
 		var dataReader io.Reader
 		headers := make(map[string]string)
@@ -144,7 +158,7 @@ func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int,
 			dataReader = bytes.NewReader(data)
 		}
 
-		request, err := http.NewRequest(method, storage.createConnectionString(uri), dataReader)
+		request, err := http.NewRequestWithContext(storage.GetContext(), method, storage.createConnectionString(uri), dataReader)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -167,7 +181,9 @@ func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int,
 		response, err := storage.client.Do(request)
 		if err != nil {
 			LOG_TRACE("WEBDAV_ERROR", "URL request '%s %s' returned an error (%v)", method, uri, err)
-			backoff = storage.retry(backoff)
+			if !retryState.retry(err, 0) {
+				return nil, nil, errWebDAVMaximumBackoff
+			}
 			continue
 		}
 
@@ -190,10 +206,11 @@ func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int,
 		} else if response.StatusCode == 405 {
 			return nil, nil, errWebDAVMethodNotAllowed
 		}
-		LOG_INFO("WEBDAV_RETRY", "URL request '%s %s' returned status code %d", method, uri, response.StatusCode)
-		backoff = storage.retry(backoff)
+		err = fmt.Errorf("URL request '%s %s' returned status code %d", method, uri, response.StatusCode)
+		if !retryState.retry(err, 0) {
+			return nil, nil, errWebDAVMaximumBackoff
+		}
 	}
-	return nil, nil, errWebDAVMaximumBackoff
 }
 
 type WebDAVProperties map[string]string
@@ -222,8 +239,8 @@ type WebDAVMultiStatus struct {
 
 func (storage *WebDAVStorage) getProperties(uri string, depth int, properties ...string) (map[string]WebDAVProperties, error) {
 
-	maxTries := 3
-	for tries := 0; ; tries++ {
+	retryState := storage.startRequest("PROPFIND", uri, depth)
+	for {
 		propfind := "<prop>"
 		for _, p := range properties {
 			propfind += fmt.Sprintf("<%s/>", p)
@@ -242,8 +259,7 @@ func (storage *WebDAVStorage) getProperties(uri string, depth int, properties ..
 		object := WebDAVMultiStatus{}
 		err = xml.NewDecoder(readCloser).Decode(&object)
 		if err != nil {
-			if strings.Contains(err.Error(), "unexpected EOF") && tries < maxTries {
-				LOG_WARN("WEBDAV_RETRY", "Retrying on %v", err)
+			if strings.Contains(err.Error(), "unexpected EOF") && retryState.retry(err, 0) {
 				continue
 			}
 			return nil, err